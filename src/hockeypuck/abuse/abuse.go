@@ -0,0 +1,362 @@
+// Package abuse scores misbehaving HKP clients and decides when they should
+// be refused service.
+//
+// Each client address accumulates a score from reported incidents. Scores
+// decay exponentially over time, so only sustained misbehavior leads to a
+// ban.
+package abuse
+
+import (
+	"math"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"hockeypuck/clock"
+	"hockeypuck/logging"
+	log "hockeypuck/logrus"
+)
+
+var logger = logging.Module("abuse")
+
+// Reasons for reporting a client.
+const (
+	ReasonHoneypot = "honeypot"
+)
+
+type Settings struct {
+	// BanThreshold is the score at which a client is banned. Zero disables
+	// banning; incidents are still logged and counted.
+	BanThreshold float64 `toml:"banThreshold"`
+
+	// BanDurationSecs is how long a ban lasts once the threshold is reached.
+	BanDurationSecs int `toml:"banDurationSecs"`
+
+	// DecayHalfLifeSecs is the period over which a client's score halves.
+	DecayHalfLifeSecs int `toml:"decayHalfLifeSecs"`
+
+	// HoneypotFingerprints lists the fingerprints of keys which are stored
+	// on this server but published nowhere. A client looking one of them up
+	// has most likely been enumerating the whole index.
+	HoneypotFingerprints []string `toml:"honeypotFingerprints"`
+
+	// HoneypotWeight is the score added for each honeypot lookup.
+	HoneypotWeight float64 `toml:"honeypotWeight"`
+
+	// RateLimit is the number of HTTP requests per second allowed from each
+	// client on average. Zero disables rate limiting.
+	RateLimit float64 `toml:"rateLimit"`
+
+	// RateBurst is the number of requests a client may make in a burst
+	// above RateLimit.
+	RateBurst int `toml:"rateBurst"`
+
+	// EventLog is the path of a file to which incidents, bans and refused
+	// requests are written as JSON lines, for host-level blocking such as
+	// fail2ban. If empty, no event log is written.
+	EventLog string `toml:"eventLog"`
+}
+
+const (
+	DefaultBanThreshold      = 0
+	DefaultBanDurationSecs   = 86400
+	DefaultDecayHalfLifeSecs = 3600
+	DefaultHoneypotWeight    = 10
+	DefaultRateLimit         = 0
+	DefaultRateBurst         = 20
+)
+
+func DefaultSettings() *Settings {
+	return &Settings{
+		BanThreshold:      DefaultBanThreshold,
+		BanDurationSecs:   DefaultBanDurationSecs,
+		DecayHalfLifeSecs: DefaultDecayHalfLifeSecs,
+		HoneypotWeight:    DefaultHoneypotWeight,
+		RateLimit:         DefaultRateLimit,
+		RateBurst:         DefaultRateBurst,
+	}
+}
+
+type client struct {
+	score       float64
+	updated     time.Time
+	bannedUntil time.Time
+	lastReason  string
+}
+
+// ClientStatus describes the current standing of a scored client.
+type ClientStatus struct {
+	Addr        string    `json:"addr"`
+	Score       float64   `json:"score"`
+	LastReason  string    `json:"lastReason"`
+	BannedUntil time.Time `json:"bannedUntil,omitempty"`
+}
+
+// Scorer tracks abuse scores per client address.
+type Scorer struct {
+	mu       sync.Mutex
+	settings Settings
+	honeypot map[string]bool
+	clients  map[string]*client
+	clock    clock.Clock
+	events   *EventLog
+}
+
+func NewScorer(s *Settings) *Scorer {
+	registerMetrics()
+	sc := &Scorer{
+		clients: map[string]*client{},
+		clock:   clock.Real(),
+	}
+	sc.SetSettings(s)
+	return sc
+}
+
+// SetClock sets the clock used to decay scores and expire bans.
+func (sc *Scorer) SetClock(c clock.Clock) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	sc.clock = c
+}
+
+// SetEventLog sets the log to which incidents, bans and refused requests are
+// written.
+func (sc *Scorer) SetEventLog(l *EventLog) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	sc.events = l
+}
+
+// SetSettings replaces the scoring settings. Existing client scores are kept.
+func (sc *Scorer) SetSettings(s *Settings) {
+	if s == nil {
+		s = DefaultSettings()
+	}
+	honeypot := map[string]bool{}
+	for _, fp := range s.HoneypotFingerprints {
+		honeypot[normalizeFingerprint(fp)] = true
+	}
+
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	sc.settings = *s
+	sc.honeypot = honeypot
+}
+
+func normalizeFingerprint(fp string) string {
+	fp = strings.ToLower(strings.Replace(fp, " ", "", -1))
+	return strings.TrimPrefix(fp, "0x")
+}
+
+// IsHoneypot returns whether the given fingerprint is a planted honeypot key.
+func (sc *Scorer) IsHoneypot(fp string) bool {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	return sc.honeypot[normalizeFingerprint(fp)]
+}
+
+// ClientAddr returns the client host portion of a request remote address.
+func ClientAddr(remoteAddr string) string {
+	if host, _, err := net.SplitHostPort(remoteAddr); err == nil {
+		return host
+	}
+	return remoteAddr
+}
+
+// decay brings a client's score up to date. The caller must hold sc.mu.
+func (sc *Scorer) decay(c *client, t time.Time) {
+	if sc.settings.DecayHalfLifeSecs > 0 && !c.updated.IsZero() {
+		elapsed := t.Sub(c.updated).Seconds()
+		c.score *= math.Pow(0.5, elapsed/float64(sc.settings.DecayHalfLifeSecs))
+	}
+	c.updated = t
+}
+
+// Record adds weight to the score of the client at addr for the given
+// reason, and returns whether the client is now banned. The event is written
+// to the event log once sc.mu is released, so that a slow disk does not hold
+// up every request.
+func (sc *Scorer) Record(addr, reason string, weight float64) bool {
+	t, ev, events, banned := sc.record(addr, reason, weight)
+	events.write(t, ev)
+	return banned
+}
+
+// record scores an incident as Record does, returning the event to log and
+// the log to write it to.
+func (sc *Scorer) record(addr, reason string, weight float64) (time.Time, Event, *EventLog, bool) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	t := sc.clock.Now()
+	c, ok := sc.clients[addr]
+	if !ok {
+		c = &client{}
+		sc.clients[addr] = c
+	}
+	sc.decay(c, t)
+	c.score += weight
+	c.lastReason = reason
+	abuseMetrics.incidents.WithLabelValues(reason).Inc()
+
+	fields := log.Fields{
+		"client": addr,
+		"reason": reason,
+		"score":  c.score,
+	}
+	ev := Event{Client: addr, Action: ActionIncident, Reason: reason, Score: c.score}
+	if sc.settings.BanThreshold > 0 && c.score >= sc.settings.BanThreshold && !c.bannedUntil.After(t) {
+		c.bannedUntil = t.Add(time.Duration(sc.settings.BanDurationSecs) * time.Second)
+		abuseMetrics.bans.Inc()
+		fields["bannedUntil"] = c.bannedUntil.UTC().Format(time.RFC3339)
+		logger.WithFields(fields).Warning("client banned")
+		ev.Action = ActionBan
+		ev.BannedUntil = formatEventTime(c.bannedUntil)
+	} else {
+		logger.WithFields(fields).Info("incident")
+	}
+	return t, ev, sc.events, c.bannedUntil.After(t)
+}
+
+// RecordHoneypot records a lookup of a honeypot key by the client at addr.
+func (sc *Scorer) RecordHoneypot(addr, fp string) bool {
+	sc.mu.Lock()
+	weight := sc.settings.HoneypotWeight
+	sc.mu.Unlock()
+	abuseMetrics.honeypotHits.Inc()
+	logger.WithFields(log.Fields{
+		"client": addr,
+		"fp":     fp,
+	}).Warning("honeypot key lookup")
+	return sc.Record(addr, ReasonHoneypot, weight)
+}
+
+// Banned returns whether the client at addr is currently banned.
+func (sc *Scorer) Banned(addr string) bool {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	c, ok := sc.clients[addr]
+	if !ok {
+		return false
+	}
+	return c.bannedUntil.After(sc.clock.Now())
+}
+
+// RecordRefused records a request refused from the client at addr, which is
+// banned.
+func (sc *Scorer) RecordRefused(addr string) {
+	sc.mu.Lock()
+	c, ok := sc.clients[addr]
+	if !ok {
+		sc.mu.Unlock()
+		return
+	}
+	t, events := sc.clock.Now(), sc.events
+	ev := Event{
+		Client:      addr,
+		Action:      ActionRefused,
+		Reason:      c.lastReason,
+		BannedUntil: formatEventTime(c.bannedUntil),
+	}
+	sc.mu.Unlock()
+	events.write(t, ev)
+}
+
+// BannedClients returns the status of the clients currently banned, highest
+// score first.
+func (sc *Scorer) BannedClients() []ClientStatus {
+	result := []ClientStatus{}
+	for _, status := range sc.Clients() {
+		if !status.BannedUntil.IsZero() {
+			result = append(result, status)
+		}
+	}
+	return result
+}
+
+// Clients returns the status of all tracked clients, highest score first.
+// Clients whose score has decayed to nothing and who are not banned are
+// forgotten.
+func (sc *Scorer) Clients() []ClientStatus {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	t := sc.clock.Now()
+	var result []ClientStatus
+	for addr, c := range sc.clients {
+		sc.decay(c, t)
+		banned := c.bannedUntil.After(t)
+		if c.score < 0.01 && !banned {
+			delete(sc.clients, addr)
+			continue
+		}
+		status := ClientStatus{
+			Addr:       addr,
+			Score:      c.score,
+			LastReason: c.lastReason,
+		}
+		if banned {
+			status.BannedUntil = c.bannedUntil
+		}
+		result = append(result, status)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Score != result[j].Score {
+			return result[i].Score > result[j].Score
+		}
+		return result[i].Addr < result[j].Addr
+	})
+	return result
+}
+
+var abuseMetrics = struct {
+	bans         prometheus.Counter
+	honeypotHits prometheus.Counter
+	incidents    *prometheus.CounterVec
+	rateLimited  prometheus.Counter
+}{
+	bans: prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: "hockeypuck",
+			Name:      "abuse_bans",
+			Help:      "Clients banned for abuse since startup",
+		},
+	),
+	honeypotHits: prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: "hockeypuck",
+			Name:      "abuse_honeypot_hits",
+			Help:      "Lookups of honeypot keys since startup",
+		},
+	),
+	incidents: prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "hockeypuck",
+			Name:      "abuse_incidents",
+			Help:      "Abuse incidents recorded since startup",
+		},
+		[]string{"reason"},
+	),
+	rateLimited: prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: "hockeypuck",
+			Name:      "abuse_rate_limited",
+			Help:      "Requests refused by the per-client rate limit since startup",
+		},
+	),
+}
+
+var metricsRegister sync.Once
+
+func registerMetrics() {
+	metricsRegister.Do(func() {
+		prometheus.MustRegister(abuseMetrics.bans)
+		prometheus.MustRegister(abuseMetrics.honeypotHits)
+		prometheus.MustRegister(abuseMetrics.incidents)
+		prometheus.MustRegister(abuseMetrics.rateLimited)
+	})
+}
@@ -0,0 +1,159 @@
+package abuse
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	stdtesting "testing"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	gc "gopkg.in/check.v1"
+
+	"hockeypuck/clock"
+)
+
+func Test(t *stdtesting.T) { gc.TestingT(t) }
+
+type AbuseSuite struct {
+	clock *clock.Fake
+}
+
+var _ = gc.Suite(&AbuseSuite{})
+
+func (s *AbuseSuite) SetUpTest(c *gc.C) {
+	s.clock = clock.NewFake(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+}
+
+func (s *AbuseSuite) TestScoreDecay(c *gc.C) {
+	sc := NewScorer(&Settings{
+		BanThreshold:      10,
+		BanDurationSecs:   3600,
+		DecayHalfLifeSecs: 600,
+	})
+	sc.SetClock(s.clock)
+
+	c.Assert(sc.Record("192.0.2.1", "test", 8), gc.Equals, false)
+	s.clock.Advance(10 * time.Minute)
+	clients := sc.Clients()
+	c.Assert(clients, gc.HasLen, 1)
+	c.Assert(clients[0].Score, gc.Equals, 4.0)
+
+	// Decayed to 4, so another 5 stays below the threshold.
+	c.Assert(sc.Record("192.0.2.1", "test", 5), gc.Equals, false)
+	c.Assert(sc.Banned("192.0.2.1"), gc.Equals, false)
+}
+
+func (s *AbuseSuite) TestBanExpiry(c *gc.C) {
+	sc := NewScorer(&Settings{
+		BanThreshold:      10,
+		BanDurationSecs:   3600,
+		DecayHalfLifeSecs: 600,
+	})
+	sc.SetClock(s.clock)
+
+	c.Assert(sc.Record("192.0.2.1", "test", 10), gc.Equals, true)
+	c.Assert(sc.Banned("192.0.2.1"), gc.Equals, true)
+	c.Assert(sc.Banned("192.0.2.2"), gc.Equals, false)
+
+	s.clock.Advance(59 * time.Minute)
+	c.Assert(sc.Banned("192.0.2.1"), gc.Equals, true)
+	s.clock.Advance(time.Minute)
+	c.Assert(sc.Banned("192.0.2.1"), gc.Equals, false)
+}
+
+func (s *AbuseSuite) TestRateLimit(c *gc.C) {
+	l := NewRateLimiter(2, 3)
+	l.SetClock(s.clock)
+
+	for i := 0; i < 3; i++ {
+		c.Assert(l.Allow("192.0.2.1"), gc.Equals, true)
+	}
+	c.Assert(l.Allow("192.0.2.1"), gc.Equals, false)
+	c.Assert(l.Allow("192.0.2.2"), gc.Equals, true)
+
+	// Two tokens per second.
+	s.clock.Advance(500 * time.Millisecond)
+	c.Assert(l.Allow("192.0.2.1"), gc.Equals, true)
+	c.Assert(l.Allow("192.0.2.1"), gc.Equals, false)
+
+	s.clock.Advance(time.Hour)
+	for i := 0; i < 3; i++ {
+		c.Assert(l.Allow("192.0.2.1"), gc.Equals, true)
+	}
+	c.Assert(l.Allow("192.0.2.1"), gc.Equals, false)
+}
+
+func (s *AbuseSuite) TestRateLimitDisabled(c *gc.C) {
+	l := NewRateLimiter(0, 1)
+	l.SetClock(s.clock)
+	for i := 0; i < 100; i++ {
+		c.Assert(l.Allow("192.0.2.1"), gc.Equals, true)
+	}
+}
+
+type bufferCloser struct {
+	bytes.Buffer
+}
+
+func (*bufferCloser) Close() error { return nil }
+
+func (s *AbuseSuite) TestEventLog(c *gc.C) {
+	var buf bufferCloser
+	events := newEventLog(&buf)
+	sc := NewScorer(&Settings{
+		BanThreshold:    10,
+		BanDurationSecs: 3600,
+	})
+	sc.SetClock(s.clock)
+	sc.SetEventLog(events)
+	l := NewRateLimiter(1, 1)
+	l.SetClock(s.clock)
+	l.SetEventLog(events)
+
+	sc.Record("192.0.2.1", "honeypot", 6)
+	sc.Record("192.0.2.1", "honeypot", 6)
+	sc.RecordRefused("192.0.2.1")
+	// Clients never recorded are not logged as refused.
+	sc.RecordRefused("192.0.2.3")
+	c.Assert(l.Allow("2001:db8::1"), gc.Equals, true)
+	c.Assert(l.Allow("2001:db8::1"), gc.Equals, false)
+
+	c.Assert(strings.Split(buf.String(), "\n"), gc.DeepEquals, []string{
+		`{"time":"2020-01-01T00:00:00Z","client":"192.0.2.1","action":"incident","reason":"honeypot","score":6}`,
+		`{"time":"2020-01-01T00:00:00Z","client":"192.0.2.1","action":"ban","reason":"honeypot","score":12,"bannedUntil":"2020-01-01T01:00:00Z"}`,
+		`{"time":"2020-01-01T00:00:00Z","client":"192.0.2.1","action":"refused","reason":"honeypot","bannedUntil":"2020-01-01T01:00:00Z"}`,
+		`{"time":"2020-01-01T00:00:00Z","client":"2001:db8::1","action":"rate-limited","reason":"rate-limit"}`,
+		``,
+	})
+}
+
+func (s *AbuseSuite) TestBannedClients(c *gc.C) {
+	sc := NewScorer(&Settings{
+		BanThreshold:    10,
+		BanDurationSecs: 3600,
+	})
+	sc.SetClock(s.clock)
+	sc.Record("192.0.2.1", "test", 10)
+	sc.Record("192.0.2.2", "test", 5)
+	sc.Record("192.0.2.3", "test", 20)
+
+	banned := sc.BannedClients()
+	c.Assert(banned, gc.HasLen, 2)
+	c.Assert(banned[0].Addr, gc.Equals, "192.0.2.3")
+	c.Assert(banned[1].Addr, gc.Equals, "192.0.2.1")
+
+	r := httprouter.New()
+	sc.Register(r)
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest("GET", "/abuse/banned?format=text", nil))
+	c.Assert(rec.Code, gc.Equals, http.StatusOK)
+	c.Assert(rec.Body.String(), gc.Equals, "192.0.2.3\n192.0.2.1\n")
+
+	s.clock.Advance(time.Hour)
+	rec = httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest("GET", "/abuse/banned", nil))
+	c.Assert(rec.Code, gc.Equals, http.StatusOK)
+	c.Assert(rec.Body.String(), gc.Equals, "[]\n")
+}
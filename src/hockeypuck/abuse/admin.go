@@ -0,0 +1,37 @@
+package abuse
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// Register adds the admin API for inspecting abusive clients:
+//
+//	GET /abuse/clients  lists every tracked client, highest score first
+//	GET /abuse/banned   lists the clients currently banned; with
+//	                    format=text, one address per line
+func (sc *Scorer) Register(r *httprouter.Router) {
+	r.GET("/abuse/clients", sc.listClients)
+	r.GET("/abuse/banned", sc.listBanned)
+}
+
+func (sc *Scorer) listClients(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(sc.Clients())
+}
+
+func (sc *Scorer) listBanned(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	banned := sc.BannedClients()
+	if r.FormValue("format") == "text" {
+		w.Header().Set("Content-Type", "text/plain")
+		for _, status := range banned {
+			fmt.Fprintln(w, status.Addr)
+		}
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(banned)
+}
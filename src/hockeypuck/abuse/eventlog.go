@@ -0,0 +1,118 @@
+package abuse
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Actions taken on abusive clients, as logged in the event log.
+const (
+	// ActionIncident records an incident which did not lead to a ban.
+	ActionIncident = "incident"
+
+	// ActionBan records that a client was banned.
+	ActionBan = "ban"
+
+	// ActionRefused records a request refused from a banned client.
+	ActionRefused = "refused"
+
+	// ActionRateLimited records a request refused by the rate limit.
+	ActionRateLimited = "rate-limited"
+)
+
+// ReasonRateLimit is the reason given for rate limited requests.
+const ReasonRateLimit = "rate-limit"
+
+// eventTimeFormat is the format of event times, always in UTC.
+const eventTimeFormat = "2006-01-02T15:04:05Z"
+
+// Event is a line of the abuse event log. Its fields are always written in
+// the same order, the first three always present, so that tools such as
+// fail2ban can match lines like
+//
+//	{"time":"2024-01-31T12:00:00Z","client":"192.0.2.1","action":"ban","reason":"honeypot","score":10,"bannedUntil":"2024-02-01T12:00:00Z"}
+type Event struct {
+	Time        string  `json:"time"`
+	Client      string  `json:"client"`
+	Action      string  `json:"action"`
+	Reason      string  `json:"reason"`
+	Score       float64 `json:"score,omitempty"`
+	BannedUntil string  `json:"bannedUntil,omitempty"`
+}
+
+// EventLog writes abuse events as JSON lines, apart from the server log, so
+// that host-level blocking can act on them. A nil *EventLog discards
+// events.
+type EventLog struct {
+	path string
+
+	mu  sync.Mutex
+	w   io.WriteCloser
+	enc *json.Encoder
+}
+
+// OpenEventLog opens the event log at path for appending.
+func OpenEventLog(path string) (*EventLog, error) {
+	l := &EventLog{path: path}
+	err := l.Reopen()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return l, nil
+}
+
+func newEventLog(w io.WriteCloser) *EventLog {
+	return &EventLog{w: w, enc: json.NewEncoder(w)}
+}
+
+// Reopen closes and reopens the log file, such as after logrotate has moved
+// it aside.
+func (l *EventLog) Reopen() error {
+	f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.w != nil {
+		l.w.Close()
+	}
+	l.w, l.enc = f, json.NewEncoder(f)
+	return nil
+}
+
+// Close closes the log file.
+func (l *EventLog) Close() error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return errors.WithStack(l.w.Close())
+}
+
+// write logs an event which happened at t.
+func (l *EventLog) write(t time.Time, ev Event) {
+	if l == nil {
+		return
+	}
+	ev.Time = t.UTC().Format(eventTimeFormat)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	err := l.enc.Encode(&ev)
+	if err != nil {
+		logger.WithField("error", err).Error("failed to write abuse event")
+	}
+}
+
+func formatEventTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(eventTimeFormat)
+}
@@ -0,0 +1,126 @@
+package abuse
+
+import (
+	"sync"
+	"time"
+
+	"hockeypuck/clock"
+)
+
+// maxBuckets bounds the number of clients tracked by a RateLimiter. When
+// exceeded, buckets which have refilled completely are forgotten.
+const maxBuckets = 65536
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// RateLimiter is a per-client token bucket limiter.
+type RateLimiter struct {
+	mu      sync.Mutex
+	rate    float64
+	burst   float64
+	buckets map[string]*bucket
+	clock   clock.Clock
+	events  *EventLog
+}
+
+// NewRateLimiter returns a limiter allowing each client rate requests per
+// second on average, with bursts of up to burst requests. A rate of zero
+// disables limiting.
+func NewRateLimiter(rate float64, burst int) *RateLimiter {
+	registerMetrics()
+	l := &RateLimiter{
+		buckets: map[string]*bucket{},
+		clock:   clock.Real(),
+	}
+	l.SetLimit(rate, burst)
+	return l
+}
+
+// SetClock sets the clock used to refill client buckets.
+func (l *RateLimiter) SetClock(c clock.Clock) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.clock = c
+}
+
+// SetEventLog sets the log to which rate limited requests are written.
+func (l *RateLimiter) SetEventLog(events *EventLog) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.events = events
+}
+
+// SetLimit changes the rate and burst size. Existing client buckets are
+// kept, clamped to the new burst size.
+func (l *RateLimiter) SetLimit(rate float64, burst int) {
+	if burst < 1 {
+		burst = 1
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.rate = rate
+	l.burst = float64(burst)
+	for _, b := range l.buckets {
+		if b.tokens > l.burst {
+			b.tokens = l.burst
+		}
+	}
+}
+
+// Allow consumes a token for the client at addr and returns whether the
+// request may proceed. Refused requests are written to the event log once
+// l.mu is released.
+func (l *RateLimiter) Allow(addr string) bool {
+	t, events, ok := l.allow(addr)
+	if !ok {
+		events.write(t, Event{Client: addr, Action: ActionRateLimited, Reason: ReasonRateLimit})
+	}
+	return ok
+}
+
+// allow consumes a token as Allow does, returning the time of the request
+// and the log to write it to if it is refused.
+func (l *RateLimiter) allow(addr string) (time.Time, *EventLog, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.rate <= 0 {
+		return time.Time{}, nil, true
+	}
+
+	t := l.clock.Now()
+	b, ok := l.buckets[addr]
+	if !ok {
+		if len(l.buckets) >= maxBuckets {
+			l.prune(t)
+		}
+		b = &bucket{tokens: l.burst, last: t}
+		l.buckets[addr] = b
+	} else {
+		b.tokens += t.Sub(b.last).Seconds() * l.rate
+		if b.tokens > l.burst {
+			b.tokens = l.burst
+		}
+		b.last = t
+	}
+
+	if b.tokens < 1 {
+		abuseMetrics.rateLimited.Inc()
+		return t, l.events, false
+	}
+	b.tokens--
+	return t, nil, true
+}
+
+// prune forgets clients whose buckets would have refilled by t. The caller
+// must hold l.mu.
+func (l *RateLimiter) prune(t time.Time) {
+	for addr, b := range l.buckets {
+		if b.tokens+t.Sub(b.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, addr)
+		}
+	}
+}
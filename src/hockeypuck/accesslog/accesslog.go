@@ -0,0 +1,298 @@
+// Package accesslog writes an HTTP access log in Common or Combined Log
+// Format, for operators who do not run hockeypuck behind a proxy which logs
+// requests.
+//
+// Keyserver requests reveal who is looking up whom, so the log may be
+// scrubbed of client addresses, query strings, referers and user agents.
+// The log file is rotated when it grows too large or too old, keeping a
+// limited number of rotated files.
+package accesslog
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"hockeypuck/clock"
+)
+
+// Log formats.
+const (
+	FormatCommon   = "common"
+	FormatCombined = "combined"
+)
+
+const DefaultMaxBackups = 7
+
+type Settings struct {
+	// Path is the file to which requests are logged. If empty, no access
+	// log is written.
+	Path string `toml:"path"`
+
+	// Format is "common" or "combined", which adds the referer and user
+	// agent.
+	Format string `toml:"format"`
+
+	// MaxSize is the size in bytes above which the log is rotated. Zero
+	// disables rotation by size.
+	MaxSize int64 `toml:"maxSize"`
+
+	// RotateIntervalSecs is how long the log is written before it is
+	// rotated. Zero disables rotation by time.
+	RotateIntervalSecs int `toml:"rotateIntervalSecs"`
+
+	// MaxBackups is the number of rotated logs kept. Zero keeps them all.
+	MaxBackups int `toml:"maxBackups"`
+
+	// MaskAddrs logs client addresses with their host bits cleared, to the
+	// /24 network for IPv4 and the /48 network for IPv6.
+	MaskAddrs bool `toml:"maskAddrs"`
+
+	// OmitQuery logs request paths without their query strings, which
+	// contain the search terms of lookups.
+	OmitQuery bool `toml:"omitQuery"`
+
+	// OmitReferer and OmitUserAgent log "-" in place of the referer and
+	// user agent in the combined format.
+	OmitReferer   bool `toml:"omitReferer"`
+	OmitUserAgent bool `toml:"omitUserAgent"`
+}
+
+func DefaultSettings() *Settings {
+	return &Settings{
+		Format:     FormatCombined,
+		MaxBackups: DefaultMaxBackups,
+	}
+}
+
+// Enabled returns whether an access log is written.
+func (s *Settings) Enabled() bool {
+	return s != nil && s.Path != ""
+}
+
+// Log writes an entry for each request served by its handler.
+type Log struct {
+	settings Settings
+	w        *rotatingFile
+	clock    clock.Clock
+
+	mu  sync.Mutex
+	buf []byte
+}
+
+// New opens the access log described by settings.
+func New(settings *Settings) (*Log, error) {
+	return newLog(settings, clock.Real())
+}
+
+func newLog(settings *Settings, clk clock.Clock) (*Log, error) {
+	if !settings.Enabled() {
+		return nil, errors.New("access log path not set")
+	}
+	l := &Log{
+		settings: *settings,
+		clock:    clk,
+	}
+	switch l.settings.Format {
+	case "":
+		l.settings.Format = FormatCombined
+	case FormatCommon, FormatCombined:
+	default:
+		return nil, errors.Errorf("invalid access log format %q, expected %q or %q",
+			settings.Format, FormatCommon, FormatCombined)
+	}
+	if settings.MaxSize < 0 || settings.RotateIntervalSecs < 0 || settings.MaxBackups < 0 {
+		return nil, errors.New("access log rotation settings must not be negative")
+	}
+	var err error
+	l.w, err = openRotatingFile(settings.Path, settings.MaxSize,
+		time.Duration(settings.RotateIntervalSecs)*time.Second, settings.MaxBackups, l.clock)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return l, nil
+}
+
+// Rotate rotates the log file now, such as on a signal from logrotate.
+func (l *Log) Rotate() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return errors.WithStack(l.w.rotate())
+}
+
+// Close closes the log file.
+func (l *Log) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return errors.WithStack(l.w.Close())
+}
+
+// Handler is middleware logging the requests served by next.
+func (l *Log) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		start := l.clock.Now()
+		crw := &countingResponseWriter{ResponseWriter: rw}
+		next.ServeHTTP(crw, req)
+		l.log(req, crw, start)
+	})
+}
+
+func (l *Log) log(req *http.Request, crw *countingResponseWriter, start time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.buf = l.appendEntry(l.buf[:0], req, crw.status(), crw.written, start)
+	// A failed write cannot be reported to the client, which has already
+	// been served; the next write tries again.
+	l.w.Write(l.buf)
+}
+
+// appendEntry appends a log line such as
+//
+//	127.0.0.1 - - [10/Oct/2000:13:55:36 -0700] "GET /pks/lookup?op=get&search=0x1234 HTTP/1.1" 200 2326 "-" "curl/7.68.0"
+func (l *Log) appendEntry(b []byte, req *http.Request, status int, written int64, start time.Time) []byte {
+	b = append(b, l.clientAddr(req.RemoteAddr)...)
+	b = append(b, " - - ["...)
+	b = start.AppendFormat(b, "02/Jan/2006:15:04:05 -0700")
+	b = append(b, "] \""...)
+	b = appendField(b, req.Method)
+	b = append(b, ' ')
+	uri := req.RequestURI
+	if uri == "" {
+		uri = req.URL.RequestURI()
+	}
+	if l.settings.OmitQuery {
+		if i := strings.IndexByte(uri, '?'); i >= 0 {
+			uri = uri[:i]
+		}
+	}
+	b = appendQuoted(b, uri)
+	b = append(b, ' ')
+	b = appendField(b, req.Proto)
+	b = append(b, "\" "...)
+	b = strconv.AppendInt(b, int64(status), 10)
+	b = append(b, ' ')
+	if written > 0 {
+		b = strconv.AppendInt(b, written, 10)
+	} else {
+		b = append(b, '-')
+	}
+	if l.settings.Format == FormatCombined {
+		referer, userAgent := req.Referer(), req.UserAgent()
+		if l.settings.OmitReferer || referer == "" {
+			referer = "-"
+		}
+		if l.settings.OmitUserAgent || userAgent == "" {
+			userAgent = "-"
+		}
+		b = append(b, " \""...)
+		b = appendQuoted(b, referer)
+		b = append(b, "\" \""...)
+		b = appendQuoted(b, userAgent)
+		b = append(b, '"')
+	}
+	return append(b, '\n')
+}
+
+// clientAddr returns the client host of remoteAddr, masked if configured.
+func (l *Log) clientAddr(remoteAddr string) string {
+	host := remoteAddr
+	if h, _, err := net.SplitHostPort(remoteAddr); err == nil {
+		host = h
+	}
+	if host == "" {
+		return "-"
+	}
+	if !l.settings.MaskAddrs {
+		return host
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return "-"
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(net.CIDRMask(24, 32)).String()
+	}
+	return ip.Mask(net.CIDRMask(48, 128)).String()
+}
+
+// appendField appends s, which must not contain spaces or quotes to be
+// parsed as one field.
+func appendField(b []byte, s string) []byte {
+	if s == "" {
+		return append(b, '-')
+	}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c <= ' ' || c == '"' || c >= 0x7f {
+			b = appendEscaped(b, c)
+		} else {
+			b = append(b, c)
+		}
+	}
+	return b
+}
+
+// appendQuoted appends s, escaping quotes and control characters as Apache
+// does, so that a request cannot forge log lines.
+func appendQuoted(b []byte, s string) []byte {
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c < ' ' || c == '"' || c == '\\' || c >= 0x7f {
+			b = appendEscaped(b, c)
+		} else {
+			b = append(b, c)
+		}
+	}
+	return b
+}
+
+func appendEscaped(b []byte, c byte) []byte {
+	switch c {
+	case '"', '\\':
+		return append(b, '\\', c)
+	}
+	return append(b, fmt.Sprintf(`\x%02x`, c)...)
+}
+
+// countingResponseWriter records the status and length of a response.
+type countingResponseWriter struct {
+	http.ResponseWriter
+	statusCode int
+	written    int64
+}
+
+func (w *countingResponseWriter) WriteHeader(code int) {
+	if w.statusCode == 0 {
+		w.statusCode = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *countingResponseWriter) Write(p []byte) (int, error) {
+	if w.statusCode == 0 {
+		w.statusCode = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(p)
+	w.written += int64(n)
+	return n, err
+}
+
+// Flush implements http.Flusher, if the underlying writer does.
+func (w *countingResponseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *countingResponseWriter) status() int {
+	if w.statusCode == 0 {
+		return http.StatusOK
+	}
+	return w.statusCode
+}
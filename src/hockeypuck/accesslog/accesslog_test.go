@@ -0,0 +1,178 @@
+package accesslog
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	stdtesting "testing"
+	"time"
+
+	gc "gopkg.in/check.v1"
+
+	"hockeypuck/clock"
+)
+
+func Test(t *stdtesting.T) { gc.TestingT(t) }
+
+type AccessLogSuite struct {
+	dir   string
+	clock *clock.Fake
+}
+
+var _ = gc.Suite(&AccessLogSuite{})
+
+func (s *AccessLogSuite) SetUpTest(c *gc.C) {
+	s.dir = c.MkDir()
+	s.clock = clock.NewFake(time.Date(2000, 10, 10, 13, 55, 36, 0, time.FixedZone("", -7*3600)))
+}
+
+func (s *AccessLogSuite) newLog(c *gc.C, settings *Settings) *Log {
+	settings.Path = filepath.Join(s.dir, "access.log")
+	l, err := newLog(settings, s.clock)
+	c.Assert(err, gc.IsNil)
+	return l
+}
+
+func (s *AccessLogSuite) serve(l *Log, req *http.Request) {
+	l.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte("hello"))
+	})).ServeHTTP(httptest.NewRecorder(), req)
+}
+
+func (s *AccessLogSuite) read(c *gc.C, name string) []string {
+	data, err := ioutil.ReadFile(filepath.Join(s.dir, name))
+	c.Assert(err, gc.IsNil)
+	return strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+}
+
+func (s *AccessLogSuite) TestCombined(c *gc.C) {
+	l := s.newLog(c, DefaultSettings())
+	req := httptest.NewRequest("GET", "/pks/lookup?op=get&search=0x1234", nil)
+	req.RemoteAddr = "192.0.2.10:54321"
+	req.Header.Set("User-Agent", `curl/7.68.0 "evil"`)
+	s.serve(l, req)
+	req = httptest.NewRequest("POST", "/missing", nil)
+	req.RemoteAddr = "[2001:db8:1:2::1]:54321"
+	req.Header.Set("Referer", "http://example.com/")
+	s.serve(l, req)
+	c.Assert(l.Close(), gc.IsNil)
+
+	c.Assert(s.read(c, "access.log"), gc.DeepEquals, []string{
+		`192.0.2.10 - - [10/Oct/2000:13:55:36 -0700] "GET /pks/lookup?op=get&search=0x1234 HTTP/1.1" 200 5 "-" "curl/7.68.0 \"evil\""`,
+		`2001:db8:1:2::1 - - [10/Oct/2000:13:55:36 -0700] "POST /missing HTTP/1.1" 404 19 "http://example.com/" "-"`,
+	})
+}
+
+func (s *AccessLogSuite) TestScrubbed(c *gc.C) {
+	l := s.newLog(c, &Settings{
+		Format:        FormatCombined,
+		MaskAddrs:     true,
+		OmitQuery:     true,
+		OmitReferer:   true,
+		OmitUserAgent: true,
+	})
+	req := httptest.NewRequest("GET", "/pks/lookup?op=index&search=alice%40example.com", nil)
+	req.RemoteAddr = "192.0.2.10:54321"
+	req.Header.Set("User-Agent", "gnupg/2.2")
+	req.Header.Set("Referer", "http://example.com/")
+	s.serve(l, req)
+	req.RemoteAddr = "[2001:db8:1:2::1]:54321"
+	s.serve(l, req)
+	c.Assert(l.Close(), gc.IsNil)
+
+	c.Assert(s.read(c, "access.log"), gc.DeepEquals, []string{
+		`192.0.2.0 - - [10/Oct/2000:13:55:36 -0700] "GET /pks/lookup HTTP/1.1" 200 5 "-" "-"`,
+		`2001:db8:1:: - - [10/Oct/2000:13:55:36 -0700] "GET /pks/lookup HTTP/1.1" 200 5 "-" "-"`,
+	})
+}
+
+func (s *AccessLogSuite) TestCommon(c *gc.C) {
+	l := s.newLog(c, &Settings{Format: FormatCommon})
+	req := httptest.NewRequest("GET", "/pks/lookup?search=a%0Ab", nil)
+	req.RequestURI = "/pks/lookup?search=a\nb"
+	req.RemoteAddr = "192.0.2.10:54321"
+	req.Header.Set("User-Agent", "gnupg/2.2")
+	s.serve(l, req)
+	c.Assert(l.Close(), gc.IsNil)
+
+	c.Assert(s.read(c, "access.log"), gc.DeepEquals, []string{
+		`192.0.2.10 - - [10/Oct/2000:13:55:36 -0700] "GET /pks/lookup?search=a\x0ab HTTP/1.1" 200 5`,
+	})
+}
+
+func (s *AccessLogSuite) TestInvalid(c *gc.C) {
+	_, err := New(&Settings{})
+	c.Assert(err, gc.ErrorMatches, "access log path not set")
+	_, err = New(&Settings{Path: filepath.Join(s.dir, "access.log"), Format: "json"})
+	c.Assert(err, gc.ErrorMatches, `invalid access log format "json", expected "common" or "combined"`)
+	_, err = New(&Settings{Path: filepath.Join(s.dir, "access.log"), MaxSize: -1})
+	c.Assert(err, gc.ErrorMatches, "access log rotation settings must not be negative")
+}
+
+func (s *AccessLogSuite) backups(c *gc.C) []string {
+	matches, err := filepath.Glob(filepath.Join(s.dir, "access.log.*"))
+	c.Assert(err, gc.IsNil)
+	for i := range matches {
+		matches[i] = filepath.Base(matches[i])
+	}
+	return matches
+}
+
+func (s *AccessLogSuite) TestRotateSize(c *gc.C) {
+	l := s.newLog(c, &Settings{Format: FormatCommon, MaxSize: 200, MaxBackups: 2})
+	req := httptest.NewRequest("GET", "/", nil)
+	for i := 0; i < 8; i++ {
+		// Each entry is 63 bytes, so three fit in a file.
+		s.serve(l, req)
+		s.clock.Advance(time.Second)
+	}
+	c.Assert(l.Close(), gc.IsNil)
+
+	c.Assert(s.backups(c), gc.DeepEquals, []string{"access.log.20001010-205539", "access.log.20001010-205542"})
+	c.Assert(s.read(c, "access.log.20001010-205539"), gc.HasLen, 3)
+	c.Assert(s.read(c, "access.log.20001010-205542"), gc.HasLen, 3)
+	c.Assert(s.read(c, "access.log"), gc.HasLen, 2)
+}
+
+func (s *AccessLogSuite) TestRotateInterval(c *gc.C) {
+	l := s.newLog(c, &Settings{Format: FormatCommon, RotateIntervalSecs: 3600})
+	req := httptest.NewRequest("GET", "/", nil)
+	s.serve(l, req)
+	s.clock.Advance(59 * time.Minute)
+	s.serve(l, req)
+	c.Assert(s.backups(c), gc.HasLen, 0)
+	s.clock.Advance(time.Minute)
+	s.serve(l, req)
+	c.Assert(s.backups(c), gc.DeepEquals, []string{"access.log.20001010-215536"})
+
+	// An idle log is not rotated.
+	s.clock.Advance(2 * time.Hour)
+	c.Assert(l.Rotate(), gc.IsNil)
+	c.Assert(l.Rotate(), gc.IsNil)
+	c.Assert(s.backups(c), gc.DeepEquals, []string{"access.log.20001010-215536", "access.log.20001010-235536"})
+	c.Assert(l.Close(), gc.IsNil)
+	c.Assert(s.read(c, "access.log.20001010-215536"), gc.HasLen, 2)
+}
+
+func (s *AccessLogSuite) TestRotateMoved(c *gc.C) {
+	l := s.newLog(c, &Settings{Format: FormatCommon})
+	req := httptest.NewRequest("GET", "/", nil)
+	s.serve(l, req)
+	// logrotate moves the file aside before signalling the server.
+	err := os.Rename(filepath.Join(s.dir, "access.log"), filepath.Join(s.dir, "moved.log"))
+	c.Assert(err, gc.IsNil)
+	c.Assert(l.Rotate(), gc.IsNil)
+	s.serve(l, req)
+	c.Assert(l.Close(), gc.IsNil)
+
+	c.Assert(s.backups(c), gc.HasLen, 0)
+	c.Assert(s.read(c, "moved.log"), gc.HasLen, 1)
+	c.Assert(s.read(c, "access.log"), gc.HasLen, 1)
+}
@@ -0,0 +1,192 @@
+package accesslog
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"hockeypuck/clock"
+)
+
+// backupTimeFormat names rotated logs by the UTC time they were rotated, so
+// that they sort in order.
+const backupTimeFormat = "20060102-150405"
+
+// rotatingFile is a file which is renamed aside and replaced when it exceeds
+// a size or age. It is not safe for concurrent use.
+type rotatingFile struct {
+	path       string
+	maxSize    int64
+	interval   time.Duration
+	maxBackups int
+	clock      clock.Clock
+
+	f       *os.File
+	size    int64
+	created time.Time
+}
+
+func openRotatingFile(path string, maxSize int64, interval time.Duration, maxBackups int, clk clock.Clock) (*rotatingFile, error) {
+	rf := &rotatingFile{
+		path:       path,
+		maxSize:    maxSize,
+		interval:   interval,
+		maxBackups: maxBackups,
+		clock:      clk,
+	}
+	err := rf.open()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return rf, nil
+}
+
+// open opens the log file for appending. An existing file is counted from
+// its size and modification time, so that a restart does not postpone
+// rotation indefinitely.
+func (rf *rotatingFile) open() error {
+	f, err := os.OpenFile(rf.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return errors.WithStack(err)
+	}
+	rf.f, rf.size, rf.created = f, fi.Size(), rf.clock.Now()
+	if fi.Size() > 0 && fi.ModTime().Before(rf.created) {
+		rf.created = fi.ModTime()
+	}
+	return nil
+}
+
+func (rf *rotatingFile) Write(p []byte) (int, error) {
+	if rf.due(int64(len(p))) {
+		err := rf.rotate()
+		if err != nil {
+			return 0, errors.WithStack(err)
+		}
+	}
+	if rf.f == nil {
+		// A previous rotation failed to reopen the file.
+		err := rf.open()
+		if err != nil {
+			return 0, errors.WithStack(err)
+		}
+	}
+	n, err := rf.f.Write(p)
+	rf.size += int64(n)
+	return n, errors.WithStack(err)
+}
+
+func (rf *rotatingFile) due(n int64) bool {
+	if rf.size == 0 {
+		return false
+	}
+	if rf.maxSize > 0 && rf.size+n > rf.maxSize {
+		return true
+	}
+	return rf.interval > 0 && !rf.clock.Now().Before(rf.created.Add(rf.interval))
+}
+
+// rotate renames the current file aside, opens a new one and removes the
+// oldest backups beyond maxBackups. An empty file is not rotated.
+func (rf *rotatingFile) rotate() error {
+	if rf.f != nil {
+		err := rf.f.Close()
+		rf.f = nil
+		if err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	if rf.size > 0 {
+		err := os.Rename(rf.path, rf.backupName())
+		if err != nil && !os.IsNotExist(err) {
+			return errors.WithStack(err)
+		}
+	}
+	err := rf.open()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(rf.prune())
+}
+
+// backupName returns an unused name for the current file once rotated.
+func (rf *rotatingFile) backupName() string {
+	name := rf.path + "." + rf.clock.Now().UTC().Format(backupTimeFormat)
+	backup := name
+	for i := 1; ; i++ {
+		if _, err := os.Lstat(backup); os.IsNotExist(err) {
+			return backup
+		}
+		backup = fmt.Sprintf("%s.%03d", name, i)
+	}
+}
+
+// backups returns the rotated logs, oldest first.
+func (rf *rotatingFile) backups() ([]string, error) {
+	matches, err := filepath.Glob(globEscape(rf.path) + ".*")
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	var result []string
+	prefix := rf.path + "."
+	for _, match := range matches {
+		suffix := strings.TrimPrefix(match, prefix)
+		if len(suffix) < len(backupTimeFormat) {
+			continue
+		}
+		if _, err := time.Parse(backupTimeFormat, suffix[:len(backupTimeFormat)]); err != nil {
+			continue
+		}
+		result = append(result, match)
+	}
+	sort.Strings(result)
+	return result, nil
+}
+
+func (rf *rotatingFile) prune() error {
+	if rf.maxBackups <= 0 {
+		return nil
+	}
+	backups, err := rf.backups()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	for len(backups) > rf.maxBackups {
+		err = os.Remove(backups[0])
+		if err != nil && !os.IsNotExist(err) {
+			return errors.WithStack(err)
+		}
+		backups = backups[1:]
+	}
+	return nil
+}
+
+func (rf *rotatingFile) Close() error {
+	if rf.f == nil {
+		return nil
+	}
+	err := rf.f.Close()
+	rf.f = nil
+	return errors.WithStack(err)
+}
+
+func globEscape(path string) string {
+	var b strings.Builder
+	for _, c := range path {
+		switch c {
+		case '*', '?', '[', '\\':
+			b.WriteRune('\\')
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
@@ -0,0 +1,56 @@
+package announce
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/pkg/errors"
+)
+
+// Register adds the admin API for managing announcements:
+//
+//	GET    /announcements      lists every announcement and whether it is shown
+//	POST   /announcements      posts an announcement, given its id, level,
+//	                           message, link, start and end as form values
+//	DELETE /announcements/:id  removes a posted announcement
+func (b *Board) Register(r *httprouter.Router) {
+	r.GET("/announcements", b.list)
+	r.POST("/announcements", b.post)
+	r.DELETE("/announcements/:id", b.remove)
+}
+
+func (b *Board) list(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(b.Status())
+}
+
+func (b *Board) post(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	a, err := b.Post(Announcement{
+		ID:      r.FormValue("id"),
+		Level:   r.FormValue("level"),
+		Message: r.FormValue("message"),
+		Link:    r.FormValue("link"),
+		Start:   r.FormValue("start"),
+		End:     r.FormValue("end"),
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(a)
+}
+
+func (b *Board) remove(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	err := b.Remove(ps.ByName("id"))
+	if errors.Is(err, ErrNotFound) {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	b.list(w, r, ps)
+}
@@ -0,0 +1,359 @@
+// Package announce publishes operator announcements, such as maintenance
+// windows and deprecation notices, to the users of a keyserver.
+//
+// Announcements are configured, or posted through the admin API until the
+// server restarts. Each may be limited to a window of time, outside which it
+// is not shown. Active announcements are listed in stats, shown on the web
+// pages which display them, and optionally sent in an X-HKP-Announcement
+// header on every response.
+package announce
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"hockeypuck/logging"
+	log "hockeypuck/logrus"
+)
+
+var logger = logging.Module("announce")
+
+// HeaderName is the response header which carries active announcements.
+const HeaderName = "X-HKP-Announcement"
+
+// Announcement levels, from least to most urgent.
+const (
+	LevelInfo     = "info"
+	LevelWarning  = "warning"
+	LevelCritical = "critical"
+)
+
+var levels = map[string]int{
+	LevelInfo:     0,
+	LevelWarning:  1,
+	LevelCritical: 2,
+}
+
+type Settings struct {
+	// Header sends each active announcement in an X-HKP-Announcement
+	// header on every response.
+	Header bool `toml:"header"`
+
+	Announcements []Announcement `toml:"announcement"`
+}
+
+func DefaultSettings() *Settings {
+	return &Settings{}
+}
+
+// Announcement is a message to the users of the keyserver.
+type Announcement struct {
+	// ID identifies the announcement. Announcements posted without one
+	// are given one.
+	ID string `toml:"id" json:"id"`
+
+	// Level is "info", "warning" or "critical". The default is "info".
+	Level string `toml:"level" json:"level"`
+
+	Message string `toml:"message" json:"message"`
+
+	// Link is the URL of more information, if any.
+	Link string `toml:"link" json:"link,omitempty"`
+
+	// Start and End limit when the announcement is shown, as RFC 3339
+	// times or dates such as "2024-01-31". Either may be empty.
+	Start string `toml:"start" json:"start,omitempty"`
+	End   string `toml:"end" json:"end,omitempty"`
+}
+
+type announcement struct {
+	Announcement
+	start, end time.Time
+	posted     bool
+}
+
+func parseTime(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err == nil {
+		return t, nil
+	}
+	return time.Parse("2006-01-02", s)
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
+func newAnnouncement(a Announcement) (*announcement, error) {
+	if a.ID == "" {
+		return nil, errors.New("announcement has no id")
+	}
+	a.Message = strings.TrimSpace(a.Message)
+	if a.Message == "" {
+		return nil, errors.Errorf("announcement %q has no message", a.ID)
+	}
+	if a.Level == "" {
+		a.Level = LevelInfo
+	}
+	if _, ok := levels[a.Level]; !ok {
+		return nil, errors.Errorf("announcement %q has unknown level %q", a.ID, a.Level)
+	}
+	result := &announcement{}
+	var err error
+	result.start, err = parseTime(a.Start)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid start time for announcement %q", a.ID)
+	}
+	result.end, err = parseTime(a.End)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid end time for announcement %q", a.ID)
+	}
+	if !result.start.IsZero() && !result.end.IsZero() && !result.end.After(result.start) {
+		return nil, errors.Errorf("announcement %q ends before it starts", a.ID)
+	}
+	a.Start, a.End = formatTime(result.start), formatTime(result.end)
+	result.Announcement = a
+	return result, nil
+}
+
+func (a *announcement) active(now time.Time) bool {
+	if !a.start.IsZero() && now.Before(a.start) {
+		return false
+	}
+	return a.end.IsZero() || now.Before(a.end)
+}
+
+// Validate returns an error if an announcement is invalid or two share an
+// ID.
+func (s *Settings) Validate() error {
+	_, err := configured(s)
+	return err
+}
+
+func configured(s *Settings) ([]*announcement, error) {
+	var result []*announcement
+	ids := map[string]bool{}
+	for _, a := range s.Announcements {
+		if ids[a.ID] {
+			return nil, errors.Errorf("duplicate announcement %q", a.ID)
+		}
+		ids[a.ID] = true
+		ann, err := newAnnouncement(a)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		result = append(result, ann)
+	}
+	return result, nil
+}
+
+// Board holds the announcements of a keyserver. A nil *Board has none.
+type Board struct {
+	now func() time.Time
+
+	mu         sync.RWMutex
+	header     bool
+	configured []*announcement
+	posted     []*announcement
+	nextID     int
+}
+
+// New returns a board of the announcements configured by settings.
+func New(settings *Settings) (*Board, error) {
+	b := &Board{now: time.Now, nextID: 1}
+	err := b.SetSettings(settings)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return b, nil
+}
+
+// SetSettings replaces the configured announcements. Those posted through
+// the admin API are kept.
+func (b *Board) SetSettings(s *Settings) error {
+	if s == nil {
+		s = DefaultSettings()
+	}
+	anns, err := configured(s)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.header = s.Header
+	b.configured = anns
+	return nil
+}
+
+// find returns the announcement with the given ID. The caller must hold
+// b.mu.
+func (b *Board) find(id string) (*announcement, int) {
+	for _, a := range b.configured {
+		if a.ID == id {
+			return a, -1
+		}
+	}
+	for i, a := range b.posted {
+		if a.ID == id {
+			return a, i
+		}
+	}
+	return nil, -1
+}
+
+// Post adds an announcement until it is removed or the server restarts,
+// returning it as it will be shown.
+func (b *Board) Post(a Announcement) (Announcement, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if a.ID == "" {
+		for {
+			a.ID = fmt.Sprintf("posted-%d", b.nextID)
+			b.nextID++
+			if ann, _ := b.find(a.ID); ann == nil {
+				break
+			}
+		}
+	} else if ann, _ := b.find(a.ID); ann != nil {
+		return Announcement{}, errors.Errorf("duplicate announcement %q", a.ID)
+	}
+	ann, err := newAnnouncement(a)
+	if err != nil {
+		return Announcement{}, errors.WithStack(err)
+	}
+	ann.posted = true
+	b.posted = append(b.posted, ann)
+	logger.WithFields(log.Fields{
+		"id":    ann.ID,
+		"level": ann.Level,
+	}).Info("announcement posted")
+	return ann.Announcement, nil
+}
+
+// ErrNotFound is returned when removing an announcement which does not
+// exist.
+var ErrNotFound = errors.New("announcement not found")
+
+// Remove removes an announcement posted through the admin API. Configured
+// announcements are removed from the configuration.
+func (b *Board) Remove(id string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	ann, i := b.find(id)
+	if ann == nil {
+		return errors.WithStack(ErrNotFound)
+	}
+	if !ann.posted {
+		return errors.Errorf("announcement %q is configured, and must be removed from the configuration", id)
+	}
+	b.posted = append(b.posted[:i], b.posted[i+1:]...)
+	logger.WithField("id", id).Info("announcement removed")
+	return nil
+}
+
+// sortAnnouncements sorts announcements most urgent first, then by start
+// time.
+func sortAnnouncements(anns []*announcement) {
+	sort.SliceStable(anns, func(i, j int) bool {
+		if li, lj := levels[anns[i].Level], levels[anns[j].Level]; li != lj {
+			return li > lj
+		}
+		return anns[i].start.Before(anns[j].start)
+	})
+}
+
+// Active returns the announcements to be shown now, most urgent first.
+func (b *Board) Active() []Announcement {
+	if b == nil {
+		return nil
+	}
+	now := b.now()
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	var anns []*announcement
+	for _, list := range [][]*announcement{b.configured, b.posted} {
+		for _, a := range list {
+			if a.active(now) {
+				anns = append(anns, a)
+			}
+		}
+	}
+	sortAnnouncements(anns)
+	var result []Announcement
+	for _, a := range anns {
+		result = append(result, a.Announcement)
+	}
+	return result
+}
+
+// Status describes an announcement in the admin API.
+type Status struct {
+	Announcement
+	Active bool `json:"active"`
+	Posted bool `json:"posted"`
+}
+
+// Status returns every announcement, including those not yet or no longer
+// shown.
+func (b *Board) Status() []Status {
+	now := b.now()
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	var anns []*announcement
+	anns = append(anns, b.configured...)
+	anns = append(anns, b.posted...)
+	sortAnnouncements(anns)
+	result := []Status{}
+	for _, a := range anns {
+		result = append(result, Status{
+			Announcement: a.Announcement,
+			Active:       a.active(now),
+			Posted:       a.posted,
+		})
+	}
+	return result
+}
+
+// Handler sends the active announcements in X-HKP-Announcement headers, if
+// so configured, before passing requests to next. It may be called on a nil
+// Board.
+func (b *Board) Handler(next http.Handler) http.Handler {
+	if b == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b.mu.RLock()
+		header := b.header
+		b.mu.RUnlock()
+		if header {
+			for _, a := range b.Active() {
+				w.Header().Add(HeaderName, headerValue(a))
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// headerValue formats an announcement as a header value, such as
+// `warning; "Maintenance on Sunday"; link="https://example.com/"`. The
+// message is quoted with non-ASCII characters escaped.
+func headerValue(a Announcement) string {
+	v := fmt.Sprintf("%s; %+q", a.Level, a.Message)
+	if a.Link != "" {
+		v += fmt.Sprintf("; link=%+q", a.Link)
+	}
+	return v
+}
@@ -0,0 +1,164 @@
+package announce
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	stdtesting "testing"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/pkg/errors"
+	gc "gopkg.in/check.v1"
+)
+
+func Test(t *stdtesting.T) { gc.TestingT(t) }
+
+type AnnounceSuite struct{}
+
+var _ = gc.Suite(&AnnounceSuite{})
+
+var now = time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+
+func newBoard(c *gc.C, settings *Settings) *Board {
+	b, err := New(settings)
+	c.Assert(err, gc.IsNil)
+	b.now = func() time.Time { return now }
+	return b
+}
+
+func ids(anns []Announcement) []string {
+	var result []string
+	for _, a := range anns {
+		result = append(result, a.ID)
+	}
+	return result
+}
+
+func (s *AnnounceSuite) TestActive(c *gc.C) {
+	b := newBoard(c, &Settings{Announcements: []Announcement{{
+		ID: "past", Message: "done", End: "2024-05-01",
+	}, {
+		ID: "future", Message: "soon", Start: "2024-07-01",
+	}, {
+		ID: "notice", Message: "hello",
+	}, {
+		ID: "window", Level: LevelCritical, Message: "maintenance",
+		Start: "2024-06-01T00:00:00Z", End: "2024-06-02T00:00:00Z",
+	}}})
+
+	active := b.Active()
+	c.Assert(ids(active), gc.DeepEquals, []string{"window", "notice"})
+	c.Assert(active[1].Level, gc.Equals, LevelInfo)
+	c.Assert(active[0].End, gc.Equals, "2024-06-02T00:00:00Z")
+
+	status := b.Status()
+	c.Assert(status, gc.HasLen, 4)
+	for _, st := range status {
+		c.Assert(st.Active, gc.Equals, st.ID == "window" || st.ID == "notice", gc.Commentf("%s", st.ID))
+	}
+
+	var nilBoard *Board
+	c.Assert(nilBoard.Active(), gc.HasLen, 0)
+}
+
+func (s *AnnounceSuite) TestValidate(c *gc.C) {
+	for _, t := range []struct {
+		a   Announcement
+		err string
+	}{
+		{Announcement{Message: "x"}, "announcement has no id"},
+		{Announcement{ID: "a"}, `announcement "a" has no message`},
+		{Announcement{ID: "a", Message: "x", Level: "loud"}, `announcement "a" has unknown level "loud"`},
+		{Announcement{ID: "a", Message: "x", Start: "soon"}, `invalid start time for announcement "a".*`},
+		{Announcement{ID: "a", Message: "x", Start: "2024-02-01", End: "2024-01-01"}, `announcement "a" ends before it starts`},
+	} {
+		err := (&Settings{Announcements: []Announcement{t.a}}).Validate()
+		c.Assert(err, gc.ErrorMatches, t.err)
+	}
+	err := (&Settings{Announcements: []Announcement{
+		{ID: "a", Message: "x"}, {ID: "a", Message: "y"},
+	}}).Validate()
+	c.Assert(err, gc.ErrorMatches, `duplicate announcement "a"`)
+}
+
+func (s *AnnounceSuite) TestPostRemove(c *gc.C) {
+	b := newBoard(c, &Settings{Announcements: []Announcement{{ID: "configured", Message: "hello"}}})
+
+	a, err := b.Post(Announcement{Message: "posted"})
+	c.Assert(err, gc.IsNil)
+	c.Assert(a.ID, gc.Equals, "posted-1")
+	_, err = b.Post(Announcement{ID: "configured", Message: "again"})
+	c.Assert(err, gc.ErrorMatches, `duplicate announcement "configured"`)
+	c.Assert(b.Active(), gc.HasLen, 2)
+
+	// Posted announcements survive a reload.
+	c.Assert(b.SetSettings(nil), gc.IsNil)
+	c.Assert(ids(b.Active()), gc.DeepEquals, []string{"posted-1"})
+
+	c.Assert(b.Remove("posted-1"), gc.IsNil)
+	c.Assert(b.Active(), gc.HasLen, 0)
+	c.Assert(errors.Is(b.Remove("posted-1"), ErrNotFound), gc.Equals, true)
+}
+
+func (s *AnnounceSuite) TestHeader(c *gc.C) {
+	settings := &Settings{Announcements: []Announcement{{
+		ID: "a", Level: LevelWarning, Message: "Maintenance on Sünday", Link: "https://example.com/",
+	}}}
+	b := newBoard(c, settings)
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	get := func() http.Header {
+		w := httptest.NewRecorder()
+		b.Handler(next).ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+		return w.Header()
+	}
+	c.Assert(get().Get(HeaderName), gc.Equals, "")
+
+	settings.Header = true
+	c.Assert(b.SetSettings(settings), gc.IsNil)
+	c.Assert(get().Values(HeaderName), gc.DeepEquals, []string{
+		`warning; "Maintenance on S\u00fcnday"; link="https://example.com/"`,
+	})
+}
+
+func (s *AnnounceSuite) TestAdmin(c *gc.C) {
+	b := newBoard(c, nil)
+	r := httprouter.New()
+	b.Register(r)
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	res, err := http.PostForm(srv.URL+"/announcements", url.Values{
+		"id":      {"vacuum"},
+		"level":   {LevelWarning},
+		"message": {"Submissions are paused for maintenance"},
+	})
+	c.Assert(err, gc.IsNil)
+	res.Body.Close()
+	c.Assert(res.StatusCode, gc.Equals, http.StatusCreated)
+
+	res, err = http.PostForm(srv.URL+"/announcements", url.Values{"level": {"loud"}, "message": {"x"}})
+	c.Assert(err, gc.IsNil)
+	res.Body.Close()
+	c.Assert(res.StatusCode, gc.Equals, http.StatusBadRequest)
+
+	res, err = http.Get(srv.URL + "/announcements")
+	c.Assert(err, gc.IsNil)
+	var status []Status
+	c.Assert(json.NewDecoder(res.Body).Decode(&status), gc.IsNil)
+	res.Body.Close()
+	c.Assert(status, gc.HasLen, 1)
+	c.Assert(status[0].ID, gc.Equals, "vacuum")
+	c.Assert(status[0].Active, gc.Equals, true)
+	c.Assert(status[0].Posted, gc.Equals, true)
+
+	for _, expect := range []int{http.StatusOK, http.StatusNotFound} {
+		req, err := http.NewRequest("DELETE", srv.URL+"/announcements/vacuum", nil)
+		c.Assert(err, gc.IsNil)
+		res, err = http.DefaultClient.Do(req)
+		c.Assert(err, gc.IsNil)
+		res.Body.Close()
+		c.Assert(res.StatusCode, gc.Equals, expect)
+	}
+}
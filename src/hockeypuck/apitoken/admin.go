@@ -0,0 +1,94 @@
+package apitoken
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// Register adds the admin API for issuing and revoking tokens:
+//
+//	GET    /tokens      lists every token and its usage
+//	POST   /tokens      issues a token with the JSON grant in the body
+//	GET    /tokens/:id  shows a token and its usage
+//	DELETE /tokens/:id  revokes a token
+//
+// The response to POST includes the token itself, which is not kept and so
+// cannot be shown again.
+func (t *Tokens) Register(r *httprouter.Router) {
+	r.GET("/tokens", t.list)
+	r.POST("/tokens", t.issue)
+	r.GET("/tokens/:id", t.get)
+	r.DELETE("/tokens/:id", t.revoke)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func (t *Tokens) list(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	writeJSON(w, http.StatusOK, t.List())
+}
+
+// IssuedToken is the response to issuing a token.
+type IssuedToken struct {
+	Secret string `json:"token"`
+	*Token
+}
+
+func (t *Tokens) issue(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	var g Grant
+	err := json.NewDecoder(r.Body).Decode(&g)
+	if err != nil {
+		http.Error(w, "invalid grant: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	value, tok, err := t.Issue(g)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, http.StatusCreated, &IssuedToken{Secret: value, Token: tok})
+}
+
+func (t *Tokens) get(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	tok, ok := t.Get(ps.ByName("id"))
+	if !ok {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, tok)
+}
+
+func (t *Tokens) revoke(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	ok, err := t.Revoke(ps.ByName("id"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ServeUsage shows the holder of a token its grant and usage. It must be
+// served behind Handler.
+func (t *Tokens) ServeUsage(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	tok, ok := FromContext(r.Context())
+	if !ok {
+		unauthorized(w, errInvalidToken)
+		return
+	}
+	// Report usage as of now, rather than as of the start of the request.
+	current, ok := t.Get(tok.ID)
+	if !ok {
+		unauthorized(w, errInvalidToken)
+		return
+	}
+	writeJSON(w, http.StatusOK, current)
+}
@@ -0,0 +1,437 @@
+// Package apitoken issues API tokens to clients which need more than
+// anonymous access, such as mirrors and bulk consumers.
+//
+// A token is presented as "Authorization: Bearer <token>". It may raise the
+// client's rate limit, cap the requests it makes in a day, and grant access
+// to restricted endpoints which anonymous clients are refused. Requests made
+// with each token are counted, and the counts are reported to the operator
+// on the admin API and to the holder of the token on /pks/token.
+//
+// Tokens are issued and revoked on the admin API, and kept with their usage
+// in a file, so that they survive restarts. Only a hash of each token's
+// secret is kept.
+package apitoken
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"hockeypuck/abuse"
+	"hockeypuck/clock"
+)
+
+// UsagePath is where the holder of a token may see its usage.
+const UsagePath = "/pks/token"
+
+type Settings struct {
+	// Path is the file in which issued tokens and their usage are kept.
+	// Tokens are disabled if empty.
+	Path string `toml:"path"`
+
+	// Restricted lists request paths, such as "/pks/modified", which are
+	// only served to tokens granted access to them.
+	Restricted []string `toml:"restricted"`
+}
+
+func DefaultSettings() *Settings {
+	return &Settings{}
+}
+
+// Enabled returns whether API tokens are configured.
+func (s *Settings) Enabled() bool {
+	return s != nil && s.Path != ""
+}
+
+// Grant describes what a token allows its holder.
+type Grant struct {
+	// Name identifies the holder of the token to the operator.
+	Name string `json:"name"`
+
+	// RateLimit and RateBurst replace the anonymous rate limit for
+	// requests made with the token, if RateLimit is set.
+	RateLimit float64 `json:"rateLimit,omitempty"`
+	RateBurst int     `json:"rateBurst,omitempty"`
+
+	// DailyQuota limits the requests made with the token in each UTC day,
+	// if set.
+	DailyQuota int64 `json:"dailyQuota,omitempty"`
+
+	// Paths are the restricted paths which the token may request.
+	Paths []string `json:"paths,omitempty"`
+
+	// Expires is when the token stops being accepted, if set.
+	Expires *time.Time `json:"expires,omitempty"`
+}
+
+// Usage counts the requests made with a token.
+type Usage struct {
+	Requests    int64      `json:"requests"`
+	RateLimited int64      `json:"rateLimited"`
+	OverQuota   int64      `json:"overQuota"`
+	Day         string     `json:"day,omitempty"`
+	DayRequests int64      `json:"dayRequests"`
+	LastUsed    *time.Time `json:"lastUsed,omitempty"`
+}
+
+// Token describes an issued token, without its secret.
+type Token struct {
+	ID string `json:"id"`
+	Grant
+	Created time.Time `json:"created"`
+	Usage   Usage     `json:"usage"`
+}
+
+// storedToken is a token as kept in the token file.
+type storedToken struct {
+	Token
+	Hash string `json:"hash"`
+}
+
+type token struct {
+	Token
+	hash    []byte
+	limiter *abuse.RateLimiter
+}
+
+func (t *token) allows(path string) bool {
+	for _, p := range t.Paths {
+		if p == path {
+			return true
+		}
+	}
+	return false
+}
+
+// Tokens authenticates requests made with API tokens, and counts them.
+type Tokens struct {
+	path       string
+	restricted map[string]bool
+
+	mu     sync.Mutex
+	tokens map[string]*token
+	clock  clock.Clock
+}
+
+// New returns the tokens kept in the file given by settings.
+func New(settings *Settings) (*Tokens, error) {
+	t := &Tokens{
+		path:       settings.Path,
+		restricted: map[string]bool{},
+		tokens:     map[string]*token{},
+		clock:      clock.Real(),
+	}
+	for _, path := range settings.Restricted {
+		t.restricted[path] = true
+	}
+	err := t.load()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return t, nil
+}
+
+func (t *Tokens) newToken(st *storedToken) (*token, error) {
+	hash, err := hex.DecodeString(st.Hash)
+	if err != nil || len(hash) != sha256.Size {
+		return nil, errors.Errorf("invalid hash for token %q", st.ID)
+	}
+	tok := &token{Token: st.Token, hash: hash}
+	if tok.RateLimit > 0 {
+		tok.limiter = abuse.NewRateLimiter(tok.RateLimit, tok.RateBurst)
+		tok.limiter.SetClock(t.clock)
+	}
+	return tok, nil
+}
+
+func (t *Tokens) load() error {
+	buf, err := ioutil.ReadFile(t.path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return errors.WithStack(err)
+	}
+	var stored []*storedToken
+	err = json.Unmarshal(buf, &stored)
+	if err != nil {
+		return errors.Wrapf(err, "invalid token file %q", t.path)
+	}
+	for _, st := range stored {
+		tok, err := t.newToken(st)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		t.tokens[tok.ID] = tok
+	}
+	return nil
+}
+
+// save writes the tokens to the token file. The caller must hold t.mu.
+func (t *Tokens) save() error {
+	var stored []*storedToken
+	for _, tok := range t.tokens {
+		stored = append(stored, &storedToken{Token: tok.Token, Hash: hex.EncodeToString(tok.hash)})
+	}
+	sort.Slice(stored, func(i, j int) bool { return stored[i].ID < stored[j].ID })
+	buf, err := json.MarshalIndent(stored, "", "  ")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	tmp := t.path + ".tmp"
+	err = ioutil.WriteFile(tmp, buf, 0600)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(os.Rename(tmp, t.path))
+}
+
+// Close writes the usage of each token to the token file.
+func (t *Tokens) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return errors.WithStack(t.save())
+}
+
+func randomBytes(n int) []byte {
+	buf := make([]byte, n)
+	rand.Read(buf)
+	return buf
+}
+
+// Issue issues a new token with the given grant, returning the token to give
+// its holder and a description of it.
+func (t *Tokens) Issue(g Grant) (string, *Token, error) {
+	if g.Name == "" {
+		return "", nil, errors.New("token has no name")
+	}
+	if g.RateLimit < 0 || g.RateBurst < 0 || g.DailyQuota < 0 {
+		return "", nil, errors.New("token limits must not be negative")
+	}
+	for _, path := range g.Paths {
+		if !t.restricted[path] {
+			return "", nil, errors.Errorf("path %q is not restricted", path)
+		}
+	}
+
+	secret := base64.RawURLEncoding.EncodeToString(randomBytes(32))
+	hash := sha256.Sum256([]byte(secret))
+	st := &storedToken{
+		Token: Token{
+			Grant:   g,
+			Created: t.clock.Now().UTC(),
+		},
+		Hash: hex.EncodeToString(hash[:]),
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for {
+		st.ID = hex.EncodeToString(randomBytes(8))
+		if _, ok := t.tokens[st.ID]; !ok {
+			break
+		}
+	}
+	tok, err := t.newToken(st)
+	if err != nil {
+		return "", nil, errors.WithStack(err)
+	}
+	t.tokens[tok.ID] = tok
+	err = t.save()
+	if err != nil {
+		delete(t.tokens, tok.ID)
+		return "", nil, errors.WithStack(err)
+	}
+	result := tok.Token
+	return tok.ID + "." + secret, &result, nil
+}
+
+// Revoke revokes the token with the given ID, returning false if there is
+// no such token.
+func (t *Tokens) Revoke(id string) (bool, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	tok, ok := t.tokens[id]
+	if !ok {
+		return false, nil
+	}
+	delete(t.tokens, id)
+	err := t.save()
+	if err != nil {
+		t.tokens[id] = tok
+		return false, errors.WithStack(err)
+	}
+	return true, nil
+}
+
+// Get returns the token with the given ID.
+func (t *Tokens) Get(id string) (Token, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	tok, ok := t.tokens[id]
+	if !ok {
+		return Token{}, false
+	}
+	return tok.Token, true
+}
+
+// List returns every token, ordered by when it was issued.
+func (t *Tokens) List() []Token {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	result := []Token{}
+	for _, tok := range t.tokens {
+		result = append(result, tok.Token)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if !result[i].Created.Equal(result[j].Created) {
+			return result[i].Created.Before(result[j].Created)
+		}
+		return result[i].ID < result[j].ID
+	})
+	return result
+}
+
+var (
+	errInvalidToken = errors.New("invalid token")
+	errExpiredToken = errors.New("token expired")
+)
+
+// authenticate returns the token with the given value. The caller must hold
+// t.mu.
+func (t *Tokens) authenticate(value string) (*token, error) {
+	dot := strings.IndexByte(value, '.')
+	if dot < 0 {
+		return nil, errInvalidToken
+	}
+	tok, ok := t.tokens[value[:dot]]
+	if !ok {
+		return nil, errInvalidToken
+	}
+	hash := sha256.Sum256([]byte(value[dot+1:]))
+	if subtle.ConstantTimeCompare(hash[:], tok.hash) != 1 {
+		return nil, errInvalidToken
+	}
+	if tok.Expires != nil && !t.clock.Now().Before(*tok.Expires) {
+		return nil, errExpiredToken
+	}
+	return tok, nil
+}
+
+// bearerToken returns the token given in the Authorization header of r.
+func bearerToken(r *http.Request) (string, bool) {
+	auth := r.Header.Get("Authorization")
+	if len(auth) < 7 || !strings.EqualFold(auth[:7], "bearer ") {
+		return "", false
+	}
+	return strings.TrimSpace(auth[7:]), true
+}
+
+type useResult int
+
+const (
+	useAllowed useResult = iota
+	useRateLimited
+	useOverQuota
+)
+
+// use counts a request made with tok and returns whether it may proceed.
+// The caller must hold t.mu.
+func (t *Tokens) use(tok *token) useResult {
+	now := t.clock.Now().UTC()
+	day := now.Format("2006-01-02")
+	if tok.Usage.Day != day {
+		tok.Usage.Day = day
+		tok.Usage.DayRequests = 0
+	}
+	tok.Usage.LastUsed = &now
+	if tok.DailyQuota > 0 && tok.Usage.DayRequests >= tok.DailyQuota {
+		tok.Usage.OverQuota++
+		return useOverQuota
+	}
+	if tok.limiter != nil && !tok.limiter.Allow(tok.ID) {
+		tok.Usage.RateLimited++
+		return useRateLimited
+	}
+	tok.Usage.Requests++
+	tok.Usage.DayRequests++
+	return useAllowed
+}
+
+type contextKey struct{}
+
+// FromContext returns the token with which a request was made, if any, from
+// the request context.
+func FromContext(ctx context.Context) (Token, bool) {
+	tok, ok := ctx.Value(contextKey{}).(Token)
+	return tok, ok
+}
+
+func unauthorized(w http.ResponseWriter, err error) {
+	w.Header().Set("WWW-Authenticate", `Bearer realm="hockeypuck"`)
+	http.Error(w, err.Error(), http.StatusUnauthorized)
+}
+
+// Handler authenticates requests made with a token, counting them against
+// its limits, and refuses requests for restricted paths made without a
+// token granting access to them.
+func (t *Tokens) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		restricted := t.restricted[r.URL.Path]
+		value, ok := bearerToken(r)
+		if !ok {
+			if restricted {
+				unauthorized(w, errors.New("a token is required"))
+				return
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		t.mu.Lock()
+		tok, err := t.authenticate(value)
+		if err != nil {
+			t.mu.Unlock()
+			unauthorized(w, err)
+			return
+		}
+		if restricted && !tok.allows(r.URL.Path) {
+			t.mu.Unlock()
+			http.Error(w, "token does not grant access to "+r.URL.Path, http.StatusForbidden)
+			return
+		}
+		// Holders may always see their usage, even over quota.
+		result := useAllowed
+		if r.URL.Path != UsagePath {
+			result = t.use(tok)
+		}
+		current := tok.Token
+		t.mu.Unlock()
+
+		switch result {
+		case useOverQuota:
+			now := t.clock.Now().UTC()
+			midnight := time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, time.UTC)
+			w.Header().Set("Retry-After", strconv.Itoa(int(midnight.Sub(now).Seconds())+1))
+			http.Error(w, "daily quota exceeded", http.StatusTooManyRequests)
+			return
+		case useRateLimited:
+			http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), contextKey{}, current)))
+	})
+}
@@ -0,0 +1,190 @@
+package apitoken
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	stdtesting "testing"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	gc "gopkg.in/check.v1"
+
+	"hockeypuck/clock"
+)
+
+func Test(t *stdtesting.T) { gc.TestingT(t) }
+
+type TokensSuite struct {
+	settings *Settings
+	clock    *clock.Fake
+	tokens   *Tokens
+	srv      *httptest.Server
+	admin    *httptest.Server
+}
+
+var _ = gc.Suite(&TokensSuite{})
+
+func (s *TokensSuite) SetUpTest(c *gc.C) {
+	s.settings = &Settings{
+		Path:       filepath.Join(c.MkDir(), "tokens.json"),
+		Restricted: []string{"/pks/modified"},
+	}
+	s.clock = clock.NewFake(time.Date(2024, 3, 1, 23, 0, 0, 0, time.UTC))
+	s.open(c)
+}
+
+func (s *TokensSuite) open(c *gc.C) {
+	var err error
+	s.tokens, err = New(s.settings)
+	c.Assert(err, gc.IsNil)
+	s.tokens.clock = s.clock
+
+	r := httprouter.New()
+	r.GET("/pks/lookup", func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {})
+	r.GET("/pks/modified", func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {})
+	r.GET(UsagePath, s.tokens.ServeUsage)
+	s.srv = httptest.NewServer(s.tokens.Handler(r))
+
+	admin := httprouter.New()
+	s.tokens.Register(admin)
+	s.admin = httptest.NewServer(admin)
+}
+
+func (s *TokensSuite) TearDownTest(c *gc.C) {
+	s.srv.Close()
+	s.admin.Close()
+}
+
+func (s *TokensSuite) get(c *gc.C, path, token string) *http.Response {
+	req, err := http.NewRequest("GET", s.srv.URL+path, nil)
+	c.Assert(err, gc.IsNil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	c.Assert(err, gc.IsNil)
+	return resp
+}
+
+func (s *TokensSuite) status(c *gc.C, path, token string) int {
+	resp := s.get(c, path, token)
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func (s *TokensSuite) issue(c *gc.C, grant string) *IssuedToken {
+	resp, err := http.Post(s.admin.URL+"/tokens", "application/json", strings.NewReader(grant))
+	c.Assert(err, gc.IsNil)
+	defer resp.Body.Close()
+	c.Assert(resp.StatusCode, gc.Equals, http.StatusCreated)
+	var issued IssuedToken
+	err = json.NewDecoder(resp.Body).Decode(&issued)
+	c.Assert(err, gc.IsNil)
+	return &issued
+}
+
+func (s *TokensSuite) TestRestricted(c *gc.C) {
+	mirror := s.issue(c, `{"name": "mirror", "paths": ["/pks/modified"]}`)
+	other := s.issue(c, `{"name": "other"}`)
+
+	c.Assert(s.status(c, "/pks/lookup", ""), gc.Equals, http.StatusOK)
+	c.Assert(s.status(c, "/pks/modified", ""), gc.Equals, http.StatusUnauthorized)
+	c.Assert(s.status(c, "/pks/modified", other.Secret), gc.Equals, http.StatusForbidden)
+	c.Assert(s.status(c, "/pks/modified", mirror.Secret), gc.Equals, http.StatusOK)
+	c.Assert(s.status(c, "/pks/lookup", mirror.Secret), gc.Equals, http.StatusOK)
+
+	for _, bad := range []string{"garbage", mirror.ID + ".wrong", mirror.Secret + "x"} {
+		c.Check(s.status(c, "/pks/lookup", bad), gc.Equals, http.StatusUnauthorized, gc.Commentf("%q", bad))
+	}
+
+	// Only restricted paths may be granted.
+	resp, err := http.Post(s.admin.URL+"/tokens", "application/json",
+		strings.NewReader(`{"name": "bad", "paths": ["/pks/lookup"]}`))
+	c.Assert(err, gc.IsNil)
+	resp.Body.Close()
+	c.Assert(resp.StatusCode, gc.Equals, http.StatusBadRequest)
+}
+
+func (s *TokensSuite) TestQuota(c *gc.C) {
+	issued := s.issue(c, `{"name": "bulk", "dailyQuota": 2}`)
+	c.Assert(s.status(c, "/pks/lookup", issued.Secret), gc.Equals, http.StatusOK)
+	c.Assert(s.status(c, "/pks/lookup", issued.Secret), gc.Equals, http.StatusOK)
+	resp := s.get(c, "/pks/lookup", issued.Secret)
+	resp.Body.Close()
+	c.Assert(resp.StatusCode, gc.Equals, http.StatusTooManyRequests)
+	c.Assert(resp.Header.Get("Retry-After"), gc.Equals, "3601")
+
+	// The holder may still see its usage.
+	resp = s.get(c, UsagePath, issued.Secret)
+	var tok Token
+	err := json.NewDecoder(resp.Body).Decode(&tok)
+	resp.Body.Close()
+	c.Assert(err, gc.IsNil)
+	c.Assert(tok.ID, gc.Equals, issued.ID)
+	c.Assert(tok.Usage.Requests, gc.Equals, int64(2))
+	c.Assert(tok.Usage.DayRequests, gc.Equals, int64(2))
+	c.Assert(tok.Usage.OverQuota, gc.Equals, int64(1))
+	c.Assert(tok.Usage.Day, gc.Equals, "2024-03-01")
+
+	// The quota is renewed each day.
+	s.clock.Advance(time.Hour)
+	c.Assert(s.status(c, "/pks/lookup", issued.Secret), gc.Equals, http.StatusOK)
+	tok, ok := s.tokens.Get(issued.ID)
+	c.Assert(ok, gc.Equals, true)
+	c.Assert(tok.Usage.Requests, gc.Equals, int64(3))
+	c.Assert(tok.Usage.DayRequests, gc.Equals, int64(1))
+
+	c.Assert(s.status(c, UsagePath, ""), gc.Equals, http.StatusUnauthorized)
+}
+
+func (s *TokensSuite) TestRateLimit(c *gc.C) {
+	issued := s.issue(c, `{"name": "fast", "rateLimit": 1, "rateBurst": 2}`)
+	for i := 0; i < 2; i++ {
+		resp := s.get(c, "/pks/lookup", issued.Secret)
+		resp.Body.Close()
+		c.Assert(resp.StatusCode, gc.Equals, http.StatusOK)
+	}
+	c.Assert(s.status(c, "/pks/lookup", issued.Secret), gc.Equals, http.StatusTooManyRequests)
+	tok, _ := s.tokens.Get(issued.ID)
+	c.Assert(tok.Usage.RateLimited, gc.Equals, int64(1))
+}
+
+func (s *TokensSuite) TestExpires(c *gc.C) {
+	issued := s.issue(c, `{"name": "trial", "expires": "2024-03-02T00:00:00Z"}`)
+	c.Assert(s.status(c, "/pks/lookup", issued.Secret), gc.Equals, http.StatusOK)
+	s.clock.Advance(time.Hour)
+	c.Assert(s.status(c, "/pks/lookup", issued.Secret), gc.Equals, http.StatusUnauthorized)
+}
+
+func (s *TokensSuite) TestPersist(c *gc.C) {
+	issued := s.issue(c, `{"name": "mirror", "paths": ["/pks/modified"]}`)
+	revoked := s.issue(c, `{"name": "revoked"}`)
+	c.Assert(s.status(c, "/pks/modified", issued.Secret), gc.Equals, http.StatusOK)
+
+	req, err := http.NewRequest("DELETE", s.admin.URL+"/tokens/"+revoked.ID, nil)
+	c.Assert(err, gc.IsNil)
+	resp, err := http.DefaultClient.Do(req)
+	c.Assert(err, gc.IsNil)
+	resp.Body.Close()
+	c.Assert(resp.StatusCode, gc.Equals, http.StatusNoContent)
+	c.Assert(s.status(c, "/pks/lookup", revoked.Secret), gc.Equals, http.StatusUnauthorized)
+
+	c.Assert(s.tokens.Close(), gc.IsNil)
+	s.TearDownTest(c)
+	s.open(c)
+
+	c.Assert(s.status(c, "/pks/modified", issued.Secret), gc.Equals, http.StatusOK)
+	c.Assert(s.status(c, "/pks/lookup", revoked.Secret), gc.Equals, http.StatusUnauthorized)
+	resp, err = http.Get(s.admin.URL + "/tokens")
+	c.Assert(err, gc.IsNil)
+	var tokens []Token
+	err = json.NewDecoder(resp.Body).Decode(&tokens)
+	resp.Body.Close()
+	c.Assert(err, gc.IsNil)
+	c.Assert(tokens, gc.HasLen, 1)
+	c.Assert(tokens[0].Name, gc.Equals, "mirror")
+	c.Assert(tokens[0].Usage.Requests, gc.Equals, int64(2))
+}
@@ -0,0 +1,162 @@
+// Package clock abstracts the passage of time, so that time-dependent
+// behavior such as key expiry, statistics retention, gossip scheduling and
+// rate limiting can be tested deterministically.
+package clock
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Clock tells the time and creates timers.
+type Clock interface {
+	// Now returns the current time.
+	Now() time.Time
+
+	// NewTimer returns a timer which fires once after d has elapsed.
+	NewTimer(d time.Duration) Timer
+}
+
+// Timer is a single-event timer, like time.Timer.
+type Timer interface {
+	// C returns the channel on which the time is delivered when the timer
+	// fires.
+	C() <-chan time.Time
+
+	// Stop prevents the timer from firing. It returns false if the timer
+	// has already fired or been stopped.
+	Stop() bool
+
+	// Reset changes the timer to fire after d. It returns true if the timer
+	// had been active.
+	Reset(d time.Duration) bool
+}
+
+type realClock struct{}
+
+// Real returns the system clock.
+func Real() Clock { return realClock{} }
+
+func (realClock) Now() time.Time { return time.Now() }
+
+func (realClock) NewTimer(d time.Duration) Timer { return realTimer{time.NewTimer(d)} }
+
+type realTimer struct {
+	*time.Timer
+}
+
+func (t realTimer) C() <-chan time.Time { return t.Timer.C }
+
+// Fake is a clock which only moves when told to. It is safe for concurrent
+// use.
+type Fake struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []*fakeTimer
+}
+
+// NewFake returns a fake clock set to t.
+func NewFake(t time.Time) *Fake {
+	return &Fake{now: t}
+}
+
+func (f *Fake) Now() time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.now
+}
+
+func (f *Fake) NewTimer(d time.Duration) Timer {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	t := &fakeTimer{
+		clock: f,
+		c:     make(chan time.Time, 1),
+	}
+	f.schedule(t, d)
+	return t
+}
+
+// Advance moves the clock forward by d, firing any timers which become due
+// in the order of their deadlines.
+func (f *Fake) Advance(d time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	target := f.now.Add(d)
+	for {
+		sort.Slice(f.timers, func(i, j int) bool {
+			return f.timers[i].deadline.Before(f.timers[j].deadline)
+		})
+		if len(f.timers) == 0 || f.timers[0].deadline.After(target) {
+			break
+		}
+		t := f.timers[0]
+		f.timers = f.timers[1:]
+		f.now = t.deadline
+		t.active = false
+		select {
+		case t.c <- f.now:
+		default:
+		}
+	}
+	f.now = target
+}
+
+// Set moves the clock to t, firing any timers which become due.
+func (f *Fake) Set(t time.Time) {
+	f.Advance(t.Sub(f.Now()))
+}
+
+// Timers returns the number of timers waiting to fire.
+func (f *Fake) Timers() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.timers)
+}
+
+// schedule arms t to fire after d. The caller must hold f.mu.
+func (f *Fake) schedule(t *fakeTimer, d time.Duration) {
+	t.deadline = f.now.Add(d)
+	t.active = true
+	f.timers = append(f.timers, t)
+}
+
+// unschedule disarms t, returning whether it was active. The caller must
+// hold f.mu.
+func (f *Fake) unschedule(t *fakeTimer) bool {
+	if !t.active {
+		return false
+	}
+	for i := range f.timers {
+		if f.timers[i] == t {
+			f.timers = append(f.timers[:i], f.timers[i+1:]...)
+			break
+		}
+	}
+	t.active = false
+	return true
+}
+
+type fakeTimer struct {
+	clock    *Fake
+	c        chan time.Time
+	deadline time.Time
+	active   bool
+}
+
+func (t *fakeTimer) C() <-chan time.Time { return t.c }
+
+func (t *fakeTimer) Stop() bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	return t.clock.unschedule(t)
+}
+
+func (t *fakeTimer) Reset(d time.Duration) bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	active := t.clock.unschedule(t)
+	t.clock.schedule(t, d)
+	return active
+}
@@ -0,0 +1,70 @@
+package clock
+
+import (
+	stdtesting "testing"
+	"time"
+
+	gc "gopkg.in/check.v1"
+)
+
+func Test(t *stdtesting.T) { gc.TestingT(t) }
+
+type ClockSuite struct{}
+
+var _ = gc.Suite(&ClockSuite{})
+
+var epoch = time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+func fired(t Timer) (time.Time, bool) {
+	select {
+	case ft := <-t.C():
+		return ft, true
+	default:
+		return time.Time{}, false
+	}
+}
+
+func (s *ClockSuite) TestFakeAdvance(c *gc.C) {
+	f := NewFake(epoch)
+	c.Assert(f.Now(), gc.Equals, epoch)
+
+	t1 := f.NewTimer(time.Minute)
+	t2 := f.NewTimer(time.Hour)
+	c.Assert(f.Timers(), gc.Equals, 2)
+
+	f.Advance(59 * time.Second)
+	_, ok := fired(t1)
+	c.Assert(ok, gc.Equals, false)
+
+	f.Advance(time.Second)
+	ft, ok := fired(t1)
+	c.Assert(ok, gc.Equals, true)
+	c.Assert(ft, gc.Equals, epoch.Add(time.Minute))
+	c.Assert(f.Timers(), gc.Equals, 1)
+
+	f.Set(epoch.Add(2 * time.Hour))
+	ft, ok = fired(t2)
+	c.Assert(ok, gc.Equals, true)
+	c.Assert(ft, gc.Equals, epoch.Add(time.Hour))
+	c.Assert(f.Now(), gc.Equals, epoch.Add(2*time.Hour))
+}
+
+func (s *ClockSuite) TestFakeStopReset(c *gc.C) {
+	f := NewFake(epoch)
+	t := f.NewTimer(time.Minute)
+	c.Assert(t.Stop(), gc.Equals, true)
+	c.Assert(t.Stop(), gc.Equals, false)
+	f.Advance(time.Hour)
+	_, ok := fired(t)
+	c.Assert(ok, gc.Equals, false)
+
+	c.Assert(t.Reset(time.Minute), gc.Equals, false)
+	c.Assert(t.Reset(2*time.Minute), gc.Equals, true)
+	f.Advance(time.Minute)
+	_, ok = fired(t)
+	c.Assert(ok, gc.Equals, false)
+	f.Advance(time.Minute)
+	ft, ok := fired(t)
+	c.Assert(ok, gc.Equals, true)
+	c.Assert(ft, gc.Equals, epoch.Add(time.Hour+2*time.Minute))
+}
@@ -78,7 +78,7 @@ func visit(node recon.PrefixNode) {
 	}
 	if node.IsLeaf() {
 		for _, element := range recon.MustElements(node) {
-			render.Fingerprints = append(render.Fingerprints, fmt.Sprintf("%x", element.Bytes()))
+			render.Fingerprints = append(render.Fingerprints, element.FullKeyHash())
 		}
 	}
 	for _, child := range recon.MustChildren(node) {
@@ -20,32 +20,62 @@
    along with this program.  If not, see <http://www.gnu.org/licenses/>.
 */
 
-// primegen is a utility for generating large primes that bound
-// a given bit length.
+// primegen generates and validates finite fields for recon.
+//
+// Hockeypuck reconciles keys by their 16-byte MD5 digests, so fields must
+// hold digests of that length. By default, primegen generates a new such
+// field, for a recon network kept apart from SKS. With -check, it validates
+// a field given as a decimal prime. The result may be configured as the
+// field of a recon peer, in conflux.recon.field.
 package main
 
 import (
-	"crypto/rand"
+	"crypto/md5"
+	"flag"
 	"fmt"
+	"math/big"
+	"os"
+
+	"hockeypuck/conflux"
 )
 
+var check = flag.String("check", "", "validate a field given as a decimal prime")
+
+func die(err error) {
+	fmt.Fprintln(os.Stderr, err)
+	os.Exit(1)
+}
+
+func describe(p *big.Int) {
+	fmt.Printf("field = %q\n", p.String())
+	fmt.Printf("# %d-bit prime, %d-byte digests, %d-byte wire elements\n",
+		p.BitLen(), conflux.DigestLen(p), conflux.WireLen(p))
+}
+
 func main() {
-	for _, n := range []int{128, 160, 256, 512} {
-		p, err := rand.Prime(rand.Reader, n+1)
+	flag.Parse()
+	if flag.NArg() > 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if *check != "" {
+		p, ok := new(big.Int).SetString(*check, 10)
+		if !ok {
+			die(fmt.Errorf("invalid integer %q", *check))
+		}
+		err := conflux.ValidatePrime(p)
 		if err != nil {
-			panic(err)
+			die(err)
 		}
-		fmt.Printf("var p_%v = big.NewInt(0).SetBytes([]byte{", n)
-		data := p.Bytes()
-		for i, b := range data {
-			if i > 0 {
-				fmt.Printf(",")
-			}
-			if i < len(data)-1 && i%8 == 0 {
-				fmt.Printf("\n\t")
-			}
-			fmt.Printf("0x%x", b)
+		if n := conflux.DigestLen(p); n != md5.Size {
+			die(fmt.Errorf("field %v holds %d-byte digests, keys have %d-byte MD5 digests", p, n, md5.Size))
 		}
-		fmt.Printf("})\n\n")
+		describe(p)
+		return
+	}
+	p, err := conflux.GeneratePrime(md5.Size * 8)
+	if err != nil {
+		die(err)
 	}
+	describe(p)
 }
@@ -66,7 +66,7 @@ func Interpolate(values []Zp, points []Zp, degDiff int) (*RationalFn, error) {
 			accum.Mul(accum, kj)
 		}
 		kjma := accum.Copy()
-		accum = fj.Neg()
+		accum.Set(fj).Neg()
 		for i := ma; i < mbar; i++ {
 			matrix.Set(i, j, accum)
 			accum.Mul(accum, kj)
@@ -123,12 +123,15 @@ func polyPowMod(f *Poly, n *big.Int, g *Poly) (*Poly, error) {
 		return nil, errors.WithStack(ErrPowModSmallN)
 	}
 
-	var err error
+	// The products and their remainders are computed in place, reusing the
+	// same Polys throughout.
 	h := NewPoly(Zi(f.p, 1))
+	f = f.Copy()
+	prod := NewPolyP(f.p)
 	for {
 		if n.Bit(0) > 0 {
-			h = NewPoly().Mul(h, f)
-			h, err = PolyMod(h, g)
+			prod.Mul(h, f)
+			err := divmod(nil, h, prod, g)
 			if err != nil {
 				return nil, errors.WithStack(err)
 			}
@@ -138,8 +141,8 @@ func polyPowMod(f *Poly, n *big.Int, g *Poly) (*Poly, error) {
 		if n.Cmp(zero) == 0 {
 			break
 		}
-		f = NewPoly().Mul(f, f)
-		f, err = PolyMod(f, g)
+		prod.Mul(f, f)
+		err := divmod(nil, f, prod, g)
 		if err != nil {
 			return nil, errors.WithStack(err)
 		}
@@ -233,7 +236,7 @@ func factorCheck(p *Poly) bool {
 		return true
 	}
 	z := NewPoly(Zi(p.p, 0), Zi(p.p, 1))
-	zq, err := polyPowMod(z, P_SKS, p)
+	zq, err := polyPowMod(z, p.p, p)
 	if err != nil {
 		return false
 	}
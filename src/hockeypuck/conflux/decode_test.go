@@ -329,6 +329,17 @@ func reconcileTest(c *gc.C) {
 	c.Assert(diff2.Equal(set2), gc.Equals, true)
 }
 
+func (s *DecodeSuite) TestInterpolateKeepsValues(c *gc.C) {
+	p := big.NewInt(int64(97))
+	values := []Zp{*Zi(p, 3), *Zi(p, 5), *Zi(p, 7), *Zi(p, 11)}
+	points := Zpoints(p, len(values))
+	_, err := Interpolate(values, points, 0)
+	c.Assert(err, gc.IsNil)
+	for i, v := range []int{3, 5, 7, 11} {
+		c.Assert(values[i].Int64(), gc.Equals, int64(v))
+	}
+}
+
 func (s *DecodeSuite) TestLowMBar(c *gc.C) {
 	p := P_SKS
 	values := []Zp{
@@ -380,3 +391,35 @@ func (s *DecodeSuite) TestPolyNomNomNom(c *gc.C) {
 	rational := Z(p).Div(numAt, denomAt)
 	c.Assert(rational.String(), gc.Equals, "372597725470208235965358485960825765733")
 }
+
+func (s *DecodeSuite) BenchmarkReconcile(c *gc.C) {
+	p := P_SKS
+	mbar := 20
+	n := mbar + 1
+	svalues1 := Zarray(p, n, Zi(p, 1))
+	svalues2 := Zarray(p, n, Zi(p, 1))
+	points := Zpoints(p, n)
+	set1 := setInit(10, func() *Zp { return Zrand(p) })
+	set2 := setInit(5, func() *Zp { return Zrand(p) })
+	for _, s1i := range set1.Items() {
+		for i := 0; i < n; i++ {
+			svalues1[i].Mul(&svalues1[i], Z(p).Sub(&points[i], &s1i))
+		}
+	}
+	for _, s2i := range set2.Items() {
+		for i := 0; i < n; i++ {
+			svalues2[i].Mul(&svalues2[i], Z(p).Sub(&points[i], &s2i))
+		}
+	}
+	values := make([]Zp, n)
+	for i := range values {
+		values[i].Div(&svalues1[i], &svalues2[i])
+	}
+	c.ResetTimer()
+	for i := 0; i < c.N; i++ {
+		diff1, diff2, err := Reconcile(values, points, 5)
+		c.Assert(err, gc.IsNil)
+		c.Assert(diff1.Equal(set1), gc.Equals, true)
+		c.Assert(diff2.Equal(set2), gc.Equals, true)
+	}
+}
@@ -0,0 +1,64 @@
+/*
+   conflux - Distributed database synchronization library
+	Based on the algorithm described in
+		"Set Reconciliation with Nearly Optimal	Communication Complexity",
+			Yaron Minsky, Ari Trachtenberg, and Richard Zippel, 2004.
+
+   Copyright (c) 2012-2015  Casey Marshall <cmars@cmarstech.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package conflux
+
+import (
+	"crypto/rand"
+	"math/big"
+
+	"github.com/pkg/errors"
+)
+
+// primeRounds is the number of Miller-Rabin rounds used to check primes.
+const primeRounds = 32
+
+// GeneratePrime returns a random prime p for reconciling digests of the
+// given number of bits, which must be a positive multiple of 8. Every such
+// digest is an element of Z(p), and DigestLen(p) is the digest length in
+// bytes.
+func GeneratePrime(bits int) (*big.Int, error) {
+	if bits <= 0 || bits%8 != 0 {
+		return nil, errors.Errorf("invalid digest size %d bits, must be a positive multiple of 8", bits)
+	}
+	p, err := rand.Prime(rand.Reader, bits+1)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return p, nil
+}
+
+// ValidatePrime checks that p is suitable for reconciling digests of
+// DigestLen(p) bytes. Such digests are always smaller than p, so p need only
+// be prime and large enough to hold a digest.
+func ValidatePrime(p *big.Int) error {
+	if p == nil || p.Sign() <= 0 {
+		return errors.New("field must be a positive integer")
+	}
+	if DigestLen(p) < 1 {
+		return errors.Errorf("field %v is too small", p)
+	}
+	if !p.ProbablyPrime(primeRounds) {
+		return errors.Errorf("field %v is not prime", p)
+	}
+	return nil
+}
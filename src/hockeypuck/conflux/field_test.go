@@ -0,0 +1,64 @@
+/*
+   conflux - Distributed database synchronization library
+	Based on the algorithm described in
+		"Set Reconciliation with Nearly Optimal	Communication Complexity",
+			Yaron Minsky, Ari Trachtenberg, and Richard Zippel, 2004.
+
+   Copyright (c) 2012-2015  Casey Marshall <cmars@cmarstech.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package conflux
+
+import (
+	"math/big"
+
+	gc "gopkg.in/check.v1"
+)
+
+type FieldSuite struct{}
+
+var _ = gc.Suite(&FieldSuite{})
+
+func (s *FieldSuite) TestGeneratePrime(c *gc.C) {
+	for _, bits := range []int{64, 128, 256} {
+		p, err := GeneratePrime(bits)
+		c.Assert(err, gc.IsNil)
+		c.Assert(DigestLen(p), gc.Equals, bits/8)
+		c.Assert(ValidatePrime(p), gc.IsNil)
+	}
+	_, err := GeneratePrime(100)
+	c.Assert(err, gc.ErrorMatches, "invalid digest size 100 bits.*")
+	_, err = GeneratePrime(0)
+	c.Assert(err, gc.ErrorMatches, "invalid digest size 0 bits.*")
+}
+
+func (s *FieldSuite) TestValidatePrime(c *gc.C) {
+	for _, p := range []*big.Int{P_SKS, P_128, P_160, P_256, P_512} {
+		c.Assert(ValidatePrime(p), gc.IsNil)
+	}
+
+	composite := new(big.Int).Add(P_SKS, big.NewInt(1))
+	c.Assert(ValidatePrime(composite), gc.ErrorMatches, ".* is not prime")
+
+	// A prime just below a power of two holds digests a byte shorter than
+	// its elements.
+	mersenne := new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), 127), big.NewInt(1))
+	c.Assert(ValidatePrime(mersenne), gc.IsNil)
+	c.Assert(DigestLen(mersenne), gc.Equals, 15)
+
+	c.Assert(ValidatePrime(big.NewInt(251)), gc.ErrorMatches, "field 251 is too small")
+	c.Assert(ValidatePrime(big.NewInt(-7)), gc.ErrorMatches, "field must be a positive integer")
+}
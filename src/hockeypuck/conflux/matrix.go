@@ -76,10 +76,11 @@ func (m *Matrix) Reduce() error {
 func (m *Matrix) backSubstitute(j int) {
 	if m.Get(j, j).Int64() == int64(1) {
 		last := m.rows - 1
+		var scmult Zp
 		for j2 := j - 1; j2 >= 0; j2-- {
-			scmult := m.Get(j, j2).Copy()
-			m.rowsub(last, j, j2, scmult)
-			m.Set(j, j2, Zi(scmult.P(), 0))
+			scmult.Set(m.Get(j, j2))
+			m.rowsub(last, j, j2, &scmult)
+			m.Get(j, j2).i.SetInt64(0)
 		}
 	}
 }
@@ -103,8 +104,10 @@ func (m *Matrix) processRowForward(j int) {
 	if v.Int64() != int64(1) {
 		m.scmultRow(j, j, v.Copy().Inv())
 	}
+	var scmult Zp
 	for j2 := j + 1; j2 < m.rows; j2++ {
-		m.rowsub(j, j, j2, m.Get(j, j2).Copy())
+		scmult.Set(m.Get(j, j2))
+		m.rowsub(j, j, j2, &scmult)
 	}
 }
 
@@ -125,12 +128,13 @@ func (m *Matrix) scmultRow(scol, j int, sc *Zp) {
 }
 
 func (m *Matrix) rowsub(scol, src, dst int, scmult *Zp) {
+	var t Zp
 	for i := scol; i < m.columns; i++ {
 		sval := m.Get(i, src)
 		if !sval.IsZero() {
 			v := m.Get(i, dst)
 			if scmult.Int64() != int64(1) {
-				v.Sub(v, Z(scmult.P()).Mul(sval, scmult))
+				v.Sub(v, t.Mul(sval, scmult))
 			} else {
 				v.Sub(v, sval)
 			}
@@ -165,22 +165,63 @@ func (p *Poly) Equal(q *Poly) bool {
 	return true
 }
 
+// reset sets the Poly to zero, with n coefficients in the finite field fp.
+// The storage of its coefficients is reused, so that repeated arithmetic on
+// the same Polys does not allocate. The Poly must not be an operand of the
+// arithmetic filling it in.
+func (p *Poly) reset(fp *big.Int, n int) {
+	if cap(p.coeff) >= n {
+		p.coeff = p.coeff[:n]
+	} else {
+		coeff := make([]Zp, n)
+		copy(coeff, p.coeff[:cap(p.coeff)])
+		p.coeff = coeff
+	}
+	for i := range p.coeff {
+		p.coeff[i].p = fp
+		p.coeff[i].i.SetInt64(0)
+	}
+	p.p = fp
+	p.degree = n - 1
+}
+
+// set sets the Poly to a copy of x, reusing its storage.
+func (p *Poly) set(x *Poly) {
+	if p == x {
+		return
+	}
+	p.reset(x.p, x.degree+1)
+	for i := 0; i <= x.degree; i++ {
+		p.coeff[i].i.Set(&x.coeff[i].i)
+	}
+}
+
 // Add sets the Poly instance to the sum of two Polys, returning the result.
 func (p *Poly) Add(x, y *Poly) *Poly {
+	return p.addSub(x, y, false)
+}
+
+func (p *Poly) addSub(x, y *Poly, sub bool) *Poly {
 	x.assertP(y.p)
-	p.p = x.p
-	p.degree = x.degree
-	if y.degree > p.degree {
-		p.degree = y.degree
+	if p == x || p == y {
+		*p = *NewPolyP(x.p).addSub(x, y, sub)
+		return p
 	}
-	p.coeff = make([]Zp, p.degree+1)
+	degree := x.degree
+	if y.degree > degree {
+		degree = y.degree
+	}
+	p.reset(x.p, degree+1)
 	for i := 0; i <= p.degree; i++ {
-		p.coeff[i] = *Z(x.p)
 		if i <= x.degree {
 			p.coeff[i].Add(&p.coeff[i], &x.coeff[i])
 		}
 		if i <= y.degree {
-			p.coeff[i].Add(&p.coeff[i], &y.coeff[i])
+			if sub {
+				p.coeff[i].Sub(&p.coeff[i], &y.coeff[i])
+			} else {
+				p.coeff[i].Add(&p.coeff[i], &y.coeff[i])
+			}
 		}
 	}
 	p.trim()
@@ -203,19 +244,22 @@ func (p *Poly) Neg() *Poly {
 
 // Sub sets the Poly to the difference of two Polys, returning the result.
 func (p *Poly) Sub(x, y *Poly) *Poly {
-	return p.Add(x, y.Copy().Neg())
+	return p.addSub(x, y, true)
 }
 
 // Mul sets the Poly to the product of two Polys, returning the result.
 func (p *Poly) Mul(x, y *Poly) *Poly {
 	x.assertP(y.p)
-	p.p = x.p
-	p.coeff = make([]Zp, x.degree+y.degree+1)
-	p.degree = x.degree + y.degree
+	if p == x || p == y {
+		*p = *NewPolyP(x.p).Mul(x, y)
+		return p
+	}
+	p.reset(x.p, x.degree+y.degree+1)
+	var t Zp
 	for i := 0; i <= x.degree; i++ {
 		for j := 0; j <= y.degree; j++ {
 			zp := &p.coeff[i+j]
-			zp.Add(zp.In(p.p), Z(p.p).Mul(&x.coeff[i], &y.coeff[j]))
+			zp.Add(zp, t.Mul(&x.coeff[i], &y.coeff[j]))
 		}
 	}
 	p.trim()
@@ -229,9 +273,12 @@ func (p *Poly) IsConstant(c *Zp) bool {
 
 // Eval returns the output value of the Poly at the given sample point z.
 func (p *Poly) Eval(z *Zp) *Zp {
+	// Horner's method: each coefficient is added to the sum of those of
+	// higher degree, times z.
 	sum := Zi(p.p, 0)
-	for d := 0; d <= p.degree; d++ {
-		sum.Add(sum, Z(p.p).Mul(&p.coeff[d], Z(p.p).Exp(z, Zi(p.p, d))))
+	for d := p.degree; d >= 0; d-- {
+		sum.Mul(sum, z)
+		sum.Add(sum, &p.coeff[d])
 	}
 	return sum
 }
@@ -244,10 +291,9 @@ func PolyTerm(degree int, c *Zp) *Poly {
 		p:      c.P(),
 	}
 	for i := 0; i <= degree; i++ {
+		p.coeff[i].In(p.p)
 		if i == degree {
-			p.coeff[i] = *c
-		} else {
-			p.coeff[i] = *Z(p.p)
+			p.coeff[i].Set(c)
 		}
 	}
 	return p
@@ -261,26 +307,59 @@ func PolyDivmod(x, y *Poly) (q *Poly, r *Poly, err error) {
 	} else if y.degree > x.degree {
 		return NewPoly(Z(x.p)), x, nil
 	}
-	degDiff := x.degree - y.degree
-	if degDiff < 0 {
-		return nil, nil, errors.Errorf("quotient degree %d < dividend %d", x.degree, y.degree)
+	q, r = NewPolyP(x.p), NewPolyP(x.p)
+	err = divmod(q, r, x, y)
+	if err != nil {
+		return nil, nil, errors.WithStack(err)
 	}
-	c := Z(x.p).Div(&x.coeff[x.degree], &y.coeff[y.degree])
-	m := PolyTerm(degDiff, c)
-	my := NewPolyP(x.p).Mul(m, y)
-	newX := NewPolyP(x.p).Sub(x, my)
+	return q, r, nil
+}
 
-	if newX.degree < x.degree || x.degree == 0 {
-		// TODO: eliminate recursion
-		q, r, err := PolyDivmod(newX, y)
-		if err != nil {
-			return nil, nil, errors.WithStack(err)
+// divmod sets q and r to the quotient and remainder of x divided by y, by
+// long division, reusing their storage. q may be nil if only the remainder
+// is wanted, and r may be x to divide in place.
+func divmod(q, r, x, y *Poly) error {
+	if y.degree == 0 && y.coeff[0].IsZero() {
+		return errors.New("division by zero polynomial")
+	}
+	degree := x.degree
+	r.set(x)
+	if y.degree > degree {
+		if q != nil {
+			q.reset(x.p, 1)
+			q.degree = 0
 		}
-
-		q = NewPolyP(x.p).Add(q, m)
-		return q, r, nil
+		return nil
+	}
+	if q != nil {
+		q.reset(x.p, degree-y.degree+1)
+	}
+	var inv, c, t Zp
+	inv.Set(&y.coeff[y.degree])
+	if !inv.i.IsInt64() || inv.i.Int64() != 1 {
+		// Divisors are often monic, needing no inverse.
+		inv.Inv()
+	}
+	for k := degree; k >= y.degree; k-- {
+		rk := &r.coeff[k]
+		if rk.IsZero() {
+			continue
+		}
+		c.Mul(rk, &inv)
+		if q != nil {
+			q.coeff[k-y.degree].Set(&c)
+		}
+		for j := 0; j <= y.degree; j++ {
+			v := &r.coeff[k-y.degree+j]
+			v.Sub(v, t.Mul(&c, &y.coeff[j]))
+		}
+	}
+	r.degree = degree
+	r.trim()
+	if q != nil {
+		q.trim()
 	}
-	return nil, nil, errors.New("divmod error")
+	return nil
 }
 
 // PolyDiv returns the quotient between two Polys.
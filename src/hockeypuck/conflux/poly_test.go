@@ -123,6 +123,25 @@ func (s *PolySuite) TestPolyDivmod(c *gc.C) {
 	c.Assert(err, gc.IsNil)
 }
 
+func (s *PolySuite) TestPolyReuse(c *gc.C) {
+	p := big.NewInt(int64(97))
+	x := NewPoly(Zi(p, -6), Zi(p, 11), Zi(p, -6), Zi(p, 1))
+	y := NewPoly(Zi(p, 2), Zi(p, 1))
+	z := NewPolyP(p).Mul(x, y)
+	// Reusing z's storage for a smaller product
+	c.Assert(z.Mul(y, y).Equal(NewPoly(Zi(p, 4), Zi(p, 4), Zi(p, 1))), gc.Equals, true)
+	// z as an operand
+	c.Assert(z.Add(z, y).Equal(NewPoly(Zi(p, 6), Zi(p, 5), Zi(p, 1))), gc.Equals, true)
+	c.Assert(z.Sub(z, z).Equal(NewPoly(Zi(p, 0))), gc.Equals, true)
+	// Division in place
+	z.Mul(x, y)
+	err := divmod(nil, z, z, x)
+	c.Assert(err, gc.IsNil)
+	c.Assert(z.Equal(NewPoly(Zi(p, 0))), gc.Equals, true)
+	_, _, err = PolyDivmod(x, NewPoly(Zi(p, 0)))
+	c.Assert(err, gc.NotNil)
+}
+
 func (s *PolySuite) TestGcd(c *gc.C) {
 	p := big.NewInt(int64(97))
 	x := NewPoly(Zi(p, 1), Zi(p, 2), Zi(p, 1))
@@ -0,0 +1,174 @@
+/*
+   conflux - Distributed database synchronization library
+	Based on the algorithm described in
+		"Set Reconciliation with Nearly Optimal	Communication Complexity",
+			Yaron Minsky, Ari Trachtenberg, and Richard Zippel, 2004.
+
+   Copyright (c) 2012-2015  Casey Marshall <cmars@cmarstech.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package conflux
+
+import (
+	"math/rand"
+	"reflect"
+	"testing/quick"
+
+	gc "gopkg.in/check.v1"
+)
+
+// PropertySuite checks the field and polynomial arithmetic laws against
+// randomly generated values.
+type PropertySuite struct{}
+
+var _ = gc.Suite(&PropertySuite{})
+
+var quickConfig = &quick.Config{MaxCount: 200}
+
+// qZp is a random element of Z(P_SKS).
+type qZp struct{ *Zp }
+
+func (qZp) Generate(r *rand.Rand, size int) reflect.Value {
+	buf := make([]byte, (P_SKS.BitLen()+7)/8)
+	r.Read(buf)
+	// Small values exercise the edges of the field.
+	switch r.Intn(8) {
+	case 0:
+		return reflect.ValueOf(qZp{Zi(P_SKS, r.Intn(3))})
+	case 1:
+		return reflect.ValueOf(qZp{Zi(P_SKS, -1-r.Intn(3))})
+	}
+	return reflect.ValueOf(qZp{Zb(P_SKS, buf)})
+}
+
+// qPoly is a random polynomial over Z(P_SKS) of degree less than 8.
+type qPoly struct{ *Poly }
+
+func (qPoly) Generate(r *rand.Rand, size int) reflect.Value {
+	coeff := make([]Zp, 1+r.Intn(8))
+	for i := range coeff {
+		coeff[i] = *qZp{}.Generate(r, size).Interface().(qZp).Zp
+	}
+	return reflect.ValueOf(qPoly{NewPolySlice(coeff)})
+}
+
+func (s *PropertySuite) TestZpAddLaws(c *gc.C) {
+	commutative := func(x, y qZp) bool {
+		return Z(P_SKS).Add(x.Zp, y.Zp).Cmp(Z(P_SKS).Add(y.Zp, x.Zp)) == 0
+	}
+	c.Assert(quick.Check(commutative, quickConfig), gc.IsNil)
+
+	associative := func(x, y, z qZp) bool {
+		lhs := Z(P_SKS).Add(Z(P_SKS).Add(x.Zp, y.Zp), z.Zp)
+		rhs := Z(P_SKS).Add(x.Zp, Z(P_SKS).Add(y.Zp, z.Zp))
+		return lhs.Cmp(rhs) == 0
+	}
+	c.Assert(quick.Check(associative, quickConfig), gc.IsNil)
+
+	inverse := func(x qZp) bool {
+		return Z(P_SKS).Add(x.Zp, x.Copy().Neg()).IsZero() &&
+			Z(P_SKS).Sub(x.Zp, x.Zp).IsZero() &&
+			Z(P_SKS).Add(x.Zp, Z(P_SKS)).Cmp(x.Zp) == 0
+	}
+	c.Assert(quick.Check(inverse, quickConfig), gc.IsNil)
+}
+
+func (s *PropertySuite) TestZpMulLaws(c *gc.C) {
+	commutative := func(x, y qZp) bool {
+		return Z(P_SKS).Mul(x.Zp, y.Zp).Cmp(Z(P_SKS).Mul(y.Zp, x.Zp)) == 0
+	}
+	c.Assert(quick.Check(commutative, quickConfig), gc.IsNil)
+
+	associative := func(x, y, z qZp) bool {
+		lhs := Z(P_SKS).Mul(Z(P_SKS).Mul(x.Zp, y.Zp), z.Zp)
+		rhs := Z(P_SKS).Mul(x.Zp, Z(P_SKS).Mul(y.Zp, z.Zp))
+		return lhs.Cmp(rhs) == 0
+	}
+	c.Assert(quick.Check(associative, quickConfig), gc.IsNil)
+
+	distributive := func(x, y, z qZp) bool {
+		lhs := Z(P_SKS).Mul(x.Zp, Z(P_SKS).Add(y.Zp, z.Zp))
+		rhs := Z(P_SKS).Add(Z(P_SKS).Mul(x.Zp, y.Zp), Z(P_SKS).Mul(x.Zp, z.Zp))
+		return lhs.Cmp(rhs) == 0
+	}
+	c.Assert(quick.Check(distributive, quickConfig), gc.IsNil)
+
+	inverse := func(x qZp) bool {
+		if x.IsZero() {
+			return true
+		}
+		one := Zi(P_SKS, 1)
+		return Z(P_SKS).Mul(x.Zp, x.Copy().Inv()).Cmp(one) == 0 &&
+			Z(P_SKS).Div(x.Zp, x.Zp).Cmp(one) == 0
+	}
+	c.Assert(quick.Check(inverse, quickConfig), gc.IsNil)
+}
+
+func (s *PropertySuite) TestZpBytes(c *gc.C) {
+	roundTrip := func(x qZp) bool {
+		y := Z(P_SKS)
+		y.SetBytes(x.Bytes())
+		return y.Cmp(x.Zp) == 0
+	}
+	c.Assert(quick.Check(roundTrip, quickConfig), gc.IsNil)
+}
+
+func (s *PropertySuite) TestPolyLaws(c *gc.C) {
+	addCommutative := func(x, y qPoly) bool {
+		return NewPolyP(P_SKS).Add(x.Poly, y.Poly).Equal(NewPolyP(P_SKS).Add(y.Poly, x.Poly))
+	}
+	c.Assert(quick.Check(addCommutative, quickConfig), gc.IsNil)
+
+	mulCommutative := func(x, y qPoly) bool {
+		return NewPolyP(P_SKS).Mul(x.Poly, y.Poly).Equal(NewPolyP(P_SKS).Mul(y.Poly, x.Poly))
+	}
+	c.Assert(quick.Check(mulCommutative, quickConfig), gc.IsNil)
+
+	subInverse := func(x, y qPoly) bool {
+		diff := NewPolyP(P_SKS).Sub(x.Poly, y.Poly)
+		return NewPolyP(P_SKS).Add(diff, y.Poly).Equal(x.Poly)
+	}
+	c.Assert(quick.Check(subInverse, quickConfig), gc.IsNil)
+}
+
+func (s *PropertySuite) TestPolyEval(c *gc.C) {
+	// Evaluation at a point is a ring homomorphism.
+	homomorphism := func(x, y qPoly, z qZp) bool {
+		sum := NewPolyP(P_SKS).Add(x.Poly, y.Poly).Eval(z.Zp)
+		product := NewPolyP(P_SKS).Mul(x.Poly, y.Poly).Eval(z.Zp)
+		return sum.Cmp(Z(P_SKS).Add(x.Eval(z.Zp), y.Eval(z.Zp))) == 0 &&
+			product.Cmp(Z(P_SKS).Mul(x.Eval(z.Zp), y.Eval(z.Zp))) == 0
+	}
+	c.Assert(quick.Check(homomorphism, quickConfig), gc.IsNil)
+}
+
+func (s *PropertySuite) TestPolyDivmod(c *gc.C) {
+	divmod := func(x, y qPoly) bool {
+		if y.IsConstant(Z(P_SKS)) {
+			return true
+		}
+		q, r, err := PolyDivmod(x.Poly, y.Poly)
+		if err != nil {
+			return false
+		}
+		if !r.IsConstant(Z(P_SKS)) && r.Degree() >= y.Degree() {
+			return false
+		}
+		product := NewPolyP(P_SKS).Mul(q, y.Poly)
+		return NewPolyP(P_SKS).Add(product, r).Equal(x.Poly)
+	}
+	c.Assert(quick.Check(divmod, quickConfig), gc.IsNil)
+}
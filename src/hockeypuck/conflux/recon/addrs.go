@@ -0,0 +1,267 @@
+/*
+   conflux - Distributed database synchronization library
+	Based on the algorithm described in
+		"Set Reconciliation with Nearly Optimal	Communication Complexity",
+			Yaron Minsky, Ari Trachtenberg, and Richard Zippel, 2004.
+
+   Copyright (c) 2012-2015  Casey Marshall <cmars@cmarstech.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package recon
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// happyEyeballsDelay is how long a connection attempt to one of a
+	// partner's addresses is given before the next is also attempted, as
+	// recommended by RFC 8305.
+	happyEyeballsDelay = 250 * time.Millisecond
+
+	// lookupTTL is how long the addresses of a partner's host name are
+	// kept, so that matching each incoming connection against the partners
+	// does not look up all of their names. Failed lookups are kept for
+	// lookupFailureTTL.
+	lookupTTL        = 5 * time.Minute
+	lookupFailureTTL = 30 * time.Second
+)
+
+// lookupResult is the outcome of looking up a host name, kept until it
+// expires.
+type lookupResult struct {
+	ips     []net.IP
+	err     error
+	expires time.Time
+}
+
+var lookups = struct {
+	sync.Mutex
+	results map[string]lookupResult
+}{results: map[string]lookupResult{}}
+
+// lookupIP returns the IP addresses of host, looking it up again only once
+// the last lookup has expired.
+func lookupIP(host string) ([]net.IP, error) {
+	now := time.Now()
+	lookups.Lock()
+	result, ok := lookups.results[host]
+	lookups.Unlock()
+	if ok && now.Before(result.expires) {
+		return result.ips, result.err
+	}
+	ips, err := net.LookupIP(host)
+	result = lookupResult{ips: ips, err: errors.WithStack(err), expires: now.Add(lookupTTL)}
+	if err != nil {
+		result.expires = now.Add(lookupFailureTTL)
+	}
+	lookups.Lock()
+	defer lookups.Unlock()
+	for name, r := range lookups.results {
+		if !now.Before(r.expires) {
+			delete(lookups.results, name)
+		}
+	}
+	lookups.results[host] = result
+	return result.ips, result.err
+}
+
+// resolveAll returns every address to which addr resolves on network n,
+// such as both the IPv4 and IPv6 addresses of a host name. Host names are
+// looked up at most once every lookupTTL.
+func (n netType) resolveAll(addr string) ([]net.Addr, error) {
+	if n != NetworkDefault && n != NetworkTCP {
+		resolved, err := n.Resolve(addr)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		return []net.Addr{resolved}, nil
+	}
+	host, portName, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	port, err := strconv.Atoi(portName)
+	if err != nil {
+		port, err = net.LookupPort("tcp", portName)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+	}
+	var ips []net.IP
+	if ip := net.ParseIP(host); ip != nil || host == "" {
+		ips = []net.IP{ip}
+	} else {
+		ips, err = lookupIP(host)
+		if err != nil {
+			return nil, err
+		}
+	}
+	var result []net.Addr
+	for _, ip := range ips {
+		result = append(result, &net.TCPAddr{IP: ip, Port: port})
+	}
+	return result, nil
+}
+
+// reconAddrs returns the recon addresses of the partner, ReconAddr first.
+func (partner *Partner) reconAddrs() []string {
+	return append([]string{partner.ReconAddr}, partner.ReconAddrs...)
+}
+
+// ips returns the IP addresses at which the partner may connect: those of
+// its recon and HTTP addresses. Addresses which do not resolve are skipped.
+func (partner *Partner) ips() []net.IP {
+	var result []net.IP
+	add := func(n netType, addr string) {
+		if n != NetworkDefault && n != NetworkTCP {
+			return
+		}
+		resolved, err := n.resolveAll(addr)
+		if err != nil {
+			return
+		}
+		for _, a := range resolved {
+			if ip := a.(*net.TCPAddr).IP; ip != nil {
+				result = append(result, ip)
+			}
+		}
+	}
+	add(partner.HTTPNet, partner.HTTPAddr)
+	for _, addr := range partner.reconAddrs() {
+		add(partner.ReconNet, addr)
+	}
+	return result
+}
+
+// dialAddrs returns every address of the partner's recon service, in the
+// order in which they are attempted: alternating between IPv6 and IPv4,
+// starting with IPv6, as RFC 8305 recommends. Addresses which do not resolve
+// are skipped, unless none do.
+func (partner *Partner) dialAddrs() ([]net.Addr, error) {
+	var v6, v4, other []net.Addr
+	var firstErr error
+	seen := map[string]bool{}
+	for _, addr := range partner.reconAddrs() {
+		resolved, err := partner.ReconNet.resolveAll(addr)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		for _, a := range resolved {
+			if seen[a.String()] {
+				continue
+			}
+			seen[a.String()] = true
+			tcpAddr, ok := a.(*net.TCPAddr)
+			switch {
+			case !ok || tcpAddr.IP == nil:
+				other = append(other, a)
+			case tcpAddr.IP.To4() == nil:
+				v6 = append(v6, a)
+			default:
+				v4 = append(v4, a)
+			}
+		}
+	}
+	var result []net.Addr
+	for i := 0; i < len(v6) || i < len(v4); i++ {
+		if i < len(v6) {
+			result = append(result, v6[i])
+		}
+		if i < len(v4) {
+			result = append(result, v4[i])
+		}
+	}
+	result = append(result, other...)
+	if len(result) == 0 && firstErr != nil {
+		return nil, errors.WithStack(firstErr)
+	}
+	return result, nil
+}
+
+type dialResult struct {
+	conn net.Conn
+	err  error
+}
+
+// dialHappyEyeballs connects to the first of addrs to accept a connection
+// within timeout. Each address is attempted once the one before it has
+// failed, or delay has passed without it connecting. Connections which lose
+// the race are closed.
+func dialHappyEyeballs(addrs []net.Addr, delay, timeout time.Duration) (net.Conn, error) {
+	if len(addrs) == 0 {
+		return nil, errors.New("no addresses to dial")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	results := make(chan dialResult, len(addrs))
+	var dialer net.Dialer
+	var (
+		started, pending int
+		next             <-chan time.Time
+		firstErr         error
+	)
+	startNext := func() {
+		addr := addrs[started]
+		started++
+		pending++
+		go func() {
+			conn, err := dialer.DialContext(ctx, addr.Network(), addr.String())
+			results <- dialResult{conn: conn, err: err}
+		}()
+		next = nil
+		if started < len(addrs) {
+			next = time.After(delay)
+		}
+	}
+	startNext()
+	for {
+		select {
+		case <-next:
+			startNext()
+		case result := <-results:
+			pending--
+			if result.err == nil {
+				// Close the connections of attempts still pending, should
+				// they succeed.
+				go func(n int) {
+					for i := 0; i < n; i++ {
+						if r := <-results; r.conn != nil {
+							r.conn.Close()
+						}
+					}
+				}(pending)
+				return result.conn, nil
+			}
+			if firstErr == nil {
+				firstErr = result.err
+			}
+			if started < len(addrs) {
+				startNext()
+			} else if pending == 0 {
+				return nil, errors.WithStack(firstErr)
+			}
+		}
+	}
+}
@@ -0,0 +1,141 @@
+/*
+   conflux - Distributed database synchronization library
+	Based on the algorithm described in
+		"Set Reconciliation with Nearly Optimal	Communication Complexity",
+			Yaron Minsky, Ari Trachtenberg, and Richard Zippel, 2004.
+
+   Copyright (c) 2012-2015  Casey Marshall <cmars@cmarstech.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package recon
+
+import (
+	"net"
+	"time"
+
+	gc "gopkg.in/check.v1"
+)
+
+type AddrsSuite struct{}
+
+var _ = gc.Suite(&AddrsSuite{})
+
+func addrStrings(addrs []net.Addr) []string {
+	var result []string
+	for _, addr := range addrs {
+		result = append(result, addr.String())
+	}
+	return result
+}
+
+func (s *AddrsSuite) TestDialAddrs(c *gc.C) {
+	partner := Partner{
+		ReconAddr: "192.0.2.1:11370",
+		ReconAddrs: []string{
+			"[2001:db8::1]:11370",
+			"192.0.2.2:11370",
+			"192.0.2.1:11370",
+			"[2001:db8::2]:11370",
+			"[2001:db8::3]:11370",
+		},
+	}
+	addrs, err := partner.dialAddrs()
+	c.Assert(err, gc.IsNil)
+	c.Assert(addrStrings(addrs), gc.DeepEquals, []string{
+		"[2001:db8::1]:11370",
+		"192.0.2.1:11370",
+		"[2001:db8::2]:11370",
+		"192.0.2.2:11370",
+		"[2001:db8::3]:11370",
+	})
+}
+
+func (s *AddrsSuite) TestPartnerIPv6(c *gc.C) {
+	partner := Partner{
+		HTTPAddr:   "192.0.2.1:11371",
+		ReconAddr:  "192.0.2.1:11370",
+		ReconAddrs: []string{"[2001:db8::1]:11370"},
+	}
+	c.Assert(partner.matches(&net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 54321}), gc.Equals, true)
+	c.Assert(partner.matches(&net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 54321}), gc.Equals, false)
+
+	settings := DefaultSettings()
+	settings.Partners = PartnerMap{"alice": partner}
+	m, err := settings.Matcher()
+	c.Assert(err, gc.IsNil)
+	c.Assert(m.Match(net.ParseIP("192.0.2.1")), gc.Equals, true)
+	c.Assert(m.Match(net.ParseIP("2001:db8::1")), gc.Equals, true)
+	// IPv6 addresses are allowed alone, not with their /32.
+	c.Assert(m.Match(net.ParseIP("2001:db8::2")), gc.Equals, false)
+	c.Assert(m.Match(net.ParseIP("192.0.2.2")), gc.Equals, false)
+}
+
+func (s *AddrsSuite) TestDialHappyEyeballs(c *gc.C) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, gc.IsNil)
+	defer ln.Close()
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, gc.IsNil)
+	closedAddr := closed.Addr()
+	closed.Close()
+
+	// A refused address gives way to the next at once.
+	start := time.Now()
+	conn, err := dialHappyEyeballs([]net.Addr{closedAddr, ln.Addr()}, time.Minute, time.Minute)
+	c.Assert(err, gc.IsNil)
+	c.Assert(time.Since(start) < time.Minute, gc.Equals, true)
+	c.Assert(conn.RemoteAddr().String(), gc.Equals, ln.Addr().String())
+	conn.Close()
+
+	_, err = dialHappyEyeballs([]net.Addr{closedAddr}, time.Millisecond, time.Minute)
+	c.Assert(err, gc.NotNil)
+	_, err = dialHappyEyeballs(nil, time.Millisecond, time.Minute)
+	c.Assert(err, gc.ErrorMatches, "no addresses to dial")
+}
+
+func (s *AddrsSuite) TestLookupCached(c *gc.C) {
+	const host = "partner.invalid"
+	lookups.Lock()
+	lookups.results[host] = lookupResult{
+		ips:     []net.IP{net.ParseIP("192.0.2.7")},
+		expires: time.Now().Add(time.Minute),
+	}
+	lookups.Unlock()
+	defer func() {
+		lookups.Lock()
+		delete(lookups.results, host)
+		lookups.Unlock()
+	}()
+
+	partner := Partner{ReconAddr: host + ":11370"}
+	c.Assert(partner.matches(&net.TCPAddr{IP: net.ParseIP("192.0.2.7"), Port: 1234}), gc.Equals, true)
+	pm := PartnerMap{"alice": partner}
+	_, ok := pm.byAddr(&net.TCPAddr{IP: net.ParseIP("192.0.2.7"), Port: 11370})
+	c.Assert(ok, gc.Equals, true)
+
+	// Expired addresses are looked up again.
+	lookups.Lock()
+	lookups.results[host] = lookupResult{
+		ips:     []net.IP{net.ParseIP("192.0.2.7")},
+		expires: time.Now().Add(-time.Second),
+	}
+	lookups.Unlock()
+	c.Assert(partner.matches(&net.TCPAddr{IP: net.ParseIP("192.0.2.7"), Port: 1234}), gc.Equals, false)
+	lookups.Lock()
+	result := lookups.results[host]
+	lookups.Unlock()
+	c.Assert(result.err, gc.NotNil)
+	c.Assert(time.Until(result.expires) <= lookupFailureTTL, gc.Equals, true)
+}
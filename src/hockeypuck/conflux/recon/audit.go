@@ -0,0 +1,106 @@
+/*
+   conflux - Distributed database synchronization library
+	Based on the algorithm described in
+		"Set Reconciliation with Nearly Optimal	Communication Complexity",
+			Yaron Minsky, Ari Trachtenberg, and Richard Zippel, 2004.
+
+   Copyright (c) 2012-2015  Casey Marshall <cmars@cmarstech.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package recon
+
+import (
+	"encoding/hex"
+	"net"
+	"time"
+
+	log "hockeypuck/logrus"
+
+	cf "hockeypuck/conflux"
+)
+
+const AUDIT = "audit"
+
+// AuditReport describes the last recon session with an audited partner.
+type AuditReport struct {
+	// Time is when the session ended.
+	Time time.Time `json:"time"`
+
+	// RemoteAddr is the partner's address in the session.
+	RemoteAddr string `json:"remoteAddr"`
+
+	// Digests are the hex digests of the keys which the partner has and
+	// this peer lacks, which would have been recovered from it.
+	Digests []string `json:"digests"`
+}
+
+// partnerAudited returns whether the partner at addr is configured for
+// audit.
+func (p *Peer) partnerAudited(addr net.Addr) bool {
+	p.muSettings.RLock()
+	defer p.muSettings.RUnlock()
+	for _, partner := range p.settings.Partners {
+		if partner.Audit && partner.matches(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// recordAudit records the elements found in a recon session with the
+// audited partner at addr, in place of recovering them.
+func (p *Peer) recordAudit(addr net.Addr, items []cf.Zp) {
+	report := &AuditReport{
+		Time:       p.clock.Now(),
+		RemoteAddr: addr.String(),
+		Digests:    make([]string, len(items)),
+	}
+	for i := range items {
+		report.Digests[i] = hex.EncodeToString(items[i].DigestBytes())
+	}
+	name := p.PartnerName(addr)
+	p.logFields(AUDIT, log.Fields{
+		"remoteAddr": addr,
+		"partner":    name,
+		"keys":       len(items),
+	}).Info("not recovering keys from audited partner")
+	for _, digest := range report.Digests {
+		p.logFields(AUDIT, log.Fields{"partner": name}).Debugf("would recover %s", digest)
+	}
+	if name == "" {
+		return
+	}
+	p.muStatus.Lock()
+	defer p.muStatus.Unlock()
+	if p.partnerAudits == nil {
+		p.partnerAudits = map[string]*AuditReport{}
+	}
+	p.partnerAudits[name] = report
+}
+
+// Audits returns the report of the last recon session with each audited
+// partner, by name.
+func (p *Peer) Audits() map[string]AuditReport {
+	partners := p.Partners()
+	p.muStatus.Lock()
+	defer p.muStatus.Unlock()
+	result := map[string]AuditReport{}
+	for name, partner := range partners {
+		if report, ok := p.partnerAudits[name]; ok && partner.Audit {
+			result[name] = *report
+		}
+	}
+	return result
+}
@@ -0,0 +1,205 @@
+/*
+   conflux - Distributed database synchronization library
+	Based on the algorithm described in
+		"Set Reconciliation with Nearly Optimal	Communication Complexity",
+			Yaron Minsky, Ari Trachtenberg, and Richard Zippel, 2004.
+
+   Copyright (c) 2012-2015  Casey Marshall <cmars@cmarstech.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package recon
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"net"
+
+	"github.com/pkg/errors"
+
+	log "hockeypuck/logrus"
+)
+
+// configAuthNonce is the Config.Custom key carrying a peer's challenge, when
+// it shares a key with the partner. Peers which both send a challenge then
+// exchange proofs of the key before accepting each other's config.
+const configAuthNonce = "authNonce"
+
+// configAuthID is the Config.Custom key carrying the identity of a peer
+// which sends a challenge: a random value chosen when the peer is created,
+// so that a peer can tell its own proofs from its partner's.
+const configAuthID = "authID"
+
+const authNonceLen = 16
+
+// authVersion separates recon authentication proofs from other uses of the
+// shared key.
+const authVersion = "hockeypuck recon auth v1"
+
+// newAuthID returns a random peer identity.
+func newAuthID() string {
+	id := make([]byte, authNonceLen)
+	_, err := rand.Read(id)
+	if err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(id)
+}
+
+// partnerPSK returns the key shared with the partner at addr, if any.
+func (p *Peer) partnerPSK(addr net.Addr) string {
+	p.muSettings.RLock()
+	defer p.muSettings.RUnlock()
+	for _, partner := range p.settings.Partners {
+		if partner.PSK != "" && partner.matches(addr) {
+			return partner.PSK
+		}
+	}
+	return ""
+}
+
+// localConfig returns the config to send to the partner at addr, with a
+// challenge if a key is shared with it.
+func (p *Peer) localConfig(addr net.Addr) (*Config, error) {
+	config, err := p.settings.Config()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if p.partnerPSK(addr) == "" {
+		return config, nil
+	}
+	nonce := make([]byte, authNonceLen)
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if config.Custom == nil {
+		config.Custom = map[string]string{}
+	}
+	config.Custom[configAuthNonce] = hex.EncodeToString(nonce)
+	config.Custom[configAuthID] = p.authID
+	return config, nil
+}
+
+// authSession identifies one authentication exchange: the identities and
+// challenges of the initiating client and the serving peer.
+type authSession struct {
+	clientID, clientNonce string
+	serverID, serverNonce string
+}
+
+// newAuthSession returns the session seen by a peer in the given role,
+// which sent config and received remoteConfig.
+func newAuthSession(role string, config, remoteConfig *Config) authSession {
+	local := [2]string{config.Custom[configAuthID], config.Custom[configAuthNonce]}
+	remote := [2]string{remoteConfig.Custom[configAuthID], remoteConfig.Custom[configAuthNonce]}
+	if role == SERVE {
+		local, remote = remote, local
+	}
+	return authSession{
+		clientID: local[0], clientNonce: local[1],
+		serverID: remote[0], serverNonce: remote[1],
+	}
+}
+
+// proof proves knowledge of psk by the peer in role. It is bound to both
+// identities and both challenges of the session, so that it cannot be
+// reflected back to the peer which made it, nor replayed in another session.
+func (as authSession) proof(psk, role string) string {
+	mac := hmac.New(sha256.New, []byte(psk))
+	for _, field := range []string{
+		authVersion, role, as.clientID, as.serverID, as.clientNonce, as.serverNonce,
+	} {
+		mac.Write([]byte(field))
+		mac.Write([]byte{0})
+	}
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// authenticate checks that the remote peer shares our key for it, if we
+// sent it a challenge. It returns a reason to reject the remote config, or
+// "" if it is accepted.
+//
+// The client proves itself first. The server only sends its own proof once
+// the client's is verified, and sends an empty proof otherwise, so that it
+// reveals nothing to a peer which does not know the key.
+func (p *Peer) authenticate(conn net.Conn, role string, config, remoteConfig *Config) (string, error) {
+	nonce := config.Custom[configAuthNonce]
+	if nonce == "" {
+		return "", nil
+	}
+	remoteNonce := remoteConfig.Custom[configAuthNonce]
+	if remoteNonce == "" {
+		p.logConn(role, conn).Error("partner did not authenticate")
+		return "authentication required", nil
+	}
+	psk := p.partnerPSK(conn.RemoteAddr())
+	if psk == "" {
+		return "authentication failed", nil
+	}
+	remoteID := remoteConfig.Custom[configAuthID]
+	// A partner presenting our own identity is reflecting our challenge.
+	valid := remoteID != "" && remoteID != p.authID
+	session := newAuthSession(role, config, remoteConfig)
+	remoteRole := SERVE
+	if role == SERVE {
+		remoteRole = GOSSIP
+	}
+	verify := func(remoteProof string) bool {
+		expected := session.proof(psk, remoteRole)
+		return valid && hmac.Equal([]byte(remoteProof), []byte(expected))
+	}
+
+	w := bufio.NewWriter(conn)
+	send := func(proof string) error {
+		err := WriteString(w, proof)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		return errors.WithStack(w.Flush())
+	}
+	if role == SERVE {
+		remoteProof, err := ReadString(conn)
+		if err != nil {
+			return "", errors.WithStack(err)
+		}
+		valid = verify(remoteProof)
+		proof := ""
+		if valid {
+			proof = session.proof(psk, role)
+		}
+		err = send(proof)
+		if err != nil {
+			return "", errors.WithStack(err)
+		}
+	} else {
+		err := send(session.proof(psk, role))
+		if err != nil {
+			return "", errors.WithStack(err)
+		}
+		remoteProof, err := ReadString(conn)
+		if err != nil {
+			return "", errors.WithStack(err)
+		}
+		valid = verify(remoteProof)
+	}
+	if !valid {
+		p.logConnFields(role, conn, log.Fields{"remoteAddr": conn.RemoteAddr()}).Error("partner authentication failed")
+		return "authentication failed", nil
+	}
+	return "", nil
+}
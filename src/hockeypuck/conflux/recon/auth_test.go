@@ -0,0 +1,139 @@
+/*
+   conflux - Distributed database synchronization library
+	Based on the algorithm described in
+		"Set Reconciliation with Nearly Optimal	Communication Complexity",
+			Yaron Minsky, Ari Trachtenberg, and Richard Zippel, 2004.
+
+   Copyright (c) 2012-2015  Casey Marshall <cmars@cmarstech.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package recon
+
+import (
+	"net"
+
+	gc "gopkg.in/check.v1"
+	"gopkg.in/tomb.v2"
+)
+
+type AuthSuite struct{}
+
+var _ = gc.Suite(&AuthSuite{})
+
+// newAuthPeer returns a peer which shares psk with its partner at the other
+// end of a net.Pipe.
+func newAuthPeer(psk string) *Peer {
+	p := NewMemPeer()
+	p.settings.Partners["pipe"] = Partner{ReconAddr: "pipe", PSK: psk}
+	return p
+}
+
+// handshake performs the config handshake between a gossiping and a serving
+// peer, returning the errors of each.
+func handshake(c *gc.C, gossip, serve *Peer) (gossipErr, serveErr error) {
+	conn1, conn2 := net.Pipe()
+	defer conn1.Close()
+	defer conn2.Close()
+	var t tomb.Tomb
+	t.Go(func() error {
+		_, gossipErr = gossip.handleConfig(conn1, GOSSIP, "")
+		if gossipErr != nil {
+			conn1.Close()
+		}
+		return nil
+	})
+	t.Go(func() error {
+		_, serveErr = serve.handleConfig(conn2, SERVE, "")
+		if serveErr != nil {
+			conn2.Close()
+		}
+		return nil
+	})
+	c.Assert(t.Wait(), gc.IsNil)
+	return gossipErr, serveErr
+}
+
+func (s *AuthSuite) TestSharedKey(c *gc.C) {
+	gossipErr, serveErr := handshake(c, newAuthPeer("sekrit"), newAuthPeer("sekrit"))
+	c.Assert(gossipErr, gc.IsNil)
+	c.Assert(serveErr, gc.IsNil)
+}
+
+func (s *AuthSuite) TestWrongKey(c *gc.C) {
+	gossipErr, serveErr := handshake(c, newAuthPeer("sekrit"), newAuthPeer("guess"))
+	c.Assert(gossipErr, gc.ErrorMatches, "cannot peer: authentication failed")
+	c.Assert(serveErr, gc.ErrorMatches, "cannot peer: authentication failed")
+}
+
+func (s *AuthSuite) TestKeyRequired(c *gc.C) {
+	gossipErr, serveErr := handshake(c, newAuthPeer(""), newAuthPeer("sekrit"))
+	c.Assert(gossipErr, gc.NotNil)
+	c.Assert(serveErr, gc.ErrorMatches, "cannot peer: authentication required")
+
+	gossipErr, serveErr = handshake(c, newAuthPeer("sekrit"), newAuthPeer(""))
+	c.Assert(gossipErr, gc.ErrorMatches, "cannot peer: authentication required")
+	c.Assert(serveErr, gc.NotNil)
+}
+
+func (s *AuthSuite) TestNoKey(c *gc.C) {
+	gossipErr, serveErr := handshake(c, newAuthPeer(""), newAuthPeer(""))
+	c.Assert(gossipErr, gc.IsNil)
+	c.Assert(serveErr, gc.IsNil)
+}
+
+func (s *AuthSuite) TestShapeMismatch(c *gc.C) {
+	gossip, serve := newAuthPeer(""), newAuthPeer("")
+	serve.settings.ThreshMult = 4
+	gossipErr, serveErr := handshake(c, gossip, serve)
+	c.Assert(gossipErr, gc.ErrorMatches, "cannot peer: mismatched threshmult 4, expected 10")
+	c.Assert(serveErr, gc.ErrorMatches, "cannot peer: mismatched threshmult 10, expected 4")
+
+	gossip.settings.ThreshMult = 4
+	gossipErr, serveErr = handshake(c, gossip, serve)
+	c.Assert(gossipErr, gc.IsNil)
+	c.Assert(serveErr, gc.IsNil)
+
+	serve.settings.MBar = 15
+	gossipErr, serveErr = handshake(c, gossip, serve)
+	c.Assert(gossipErr, gc.ErrorMatches, "cannot peer: mismatched mbar 15, expected 5")
+	c.Assert(serveErr, gc.ErrorMatches, "cannot peer: mismatched mbar 5, expected 15")
+}
+
+func (s *AuthSuite) TestReflected(c *gc.C) {
+	// A peer cannot authenticate to itself with its own proofs.
+	p := newAuthPeer("sekrit")
+	gossipErr, serveErr := handshake(c, p, p)
+	c.Assert(gossipErr, gc.ErrorMatches, "cannot peer: authentication failed")
+	c.Assert(serveErr, gc.ErrorMatches, "cannot peer: authentication failed")
+}
+
+func (s *AuthSuite) TestProofBinding(c *gc.C) {
+	session := authSession{clientID: "a", clientNonce: "1", serverID: "b", serverNonce: "2"}
+	proof := session.proof("sekrit", GOSSIP)
+	c.Assert(proof, gc.Equals, session.proof("sekrit", GOSSIP))
+
+	// A proof made by one peer is not valid for the other.
+	c.Assert(proof, gc.Not(gc.Equals), session.proof("sekrit", SERVE))
+	// Proofs are bound to both identities and both challenges.
+	for _, other := range []authSession{
+		{clientID: "b", clientNonce: "1", serverID: "a", serverNonce: "2"},
+		{clientID: "a", clientNonce: "2", serverID: "b", serverNonce: "1"},
+		{clientID: "a", clientNonce: "1", serverID: "c", serverNonce: "2"},
+		{clientID: "a", clientNonce: "1", serverID: "b", serverNonce: "3"},
+	} {
+		c.Assert(proof, gc.Not(gc.Equals), other.proof("sekrit", GOSSIP))
+	}
+	c.Assert(proof, gc.Not(gc.Equals), session.proof("guess", GOSSIP))
+}
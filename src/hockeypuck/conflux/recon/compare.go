@@ -0,0 +1,139 @@
+/*
+   conflux - Distributed database synchronization library
+	Based on the algorithm described in
+		"Set Reconciliation with Nearly Optimal	Communication Complexity",
+			Yaron Minsky, Ari Trachtenberg, and Richard Zippel, 2004.
+
+   Copyright (c) 2012-2015  Casey Marshall <cmars@cmarstech.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package recon
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+
+	cf "hockeypuck/conflux"
+)
+
+// ErrPaused is returned when the prefix tree cannot be read because recon
+// is paused.
+var ErrPaused = errors.New("recon is paused")
+
+// compareRetryInterval is how often Peer.Compare retries while the prefix
+// tree is being mutated.
+const compareRetryInterval = 100 * time.Millisecond
+
+// Compare reconciles two prefix trees built with the same configuration, as
+// a recon session would, returning the elements only in a and those only in
+// b. Nodes whose sample values agree are skipped; where they differ, the
+// difference is solved from the sample values, descending to the children
+// of nodes with too many differences to solve, and comparing the elements of
+// leaves.
+func Compare(a, b PrefixTree) (*cf.ZSet, *cf.ZSet, error) {
+	points := a.Points()
+	if !zpsEqual(points, b.Points()) {
+		return nil, nil, errors.New("prefix trees have different sample points")
+	}
+	root, err := a.Root()
+	if err != nil {
+		return nil, nil, errors.WithStack(err)
+	}
+	aOnly, bOnly := cf.NewZSet(), cf.NewZSet()
+	keys := []*cf.Bitstring{root.Key()}
+	for len(keys) > 0 {
+		key := keys[len(keys)-1]
+		keys = keys[:len(keys)-1]
+		aNode, err := a.Node(key)
+		if err != nil {
+			return nil, nil, errors.WithStack(err)
+		}
+		bNode, err := b.Node(key)
+		if err != nil {
+			return nil, nil, errors.WithStack(err)
+		}
+		atKey := aNode.Key().BitLen() == key.BitLen() && bNode.Key().BitLen() == key.BitLen()
+		if atKey && aNode.Size() == bNode.Size() && zpsEqual(aNode.SValues(), bNode.SValues()) {
+			continue
+		}
+		if atKey && !aNode.IsLeaf() && !bNode.IsLeaf() {
+			aSamples, bSamples := aNode.SValues(), bNode.SValues()
+			values := make([]cf.Zp, len(aSamples))
+			for i := range aSamples {
+				values[i].Div(&aSamples[i], &bSamples[i])
+			}
+			aSet, bSet, err := cf.Reconcile(values, points, aNode.Size()-bNode.Size())
+			if err == nil {
+				aOnly.AddAll(aSet)
+				bOnly.AddAll(bSet)
+				continue
+			}
+			children, err := aNode.Children()
+			if err != nil {
+				return nil, nil, errors.WithStack(err)
+			}
+			for _, child := range children {
+				keys = append(keys, child.Key())
+			}
+			continue
+		}
+		// One tree is not split this deeply, so compare the elements under
+		// the key.
+		aElements, err := prefixElements(aNode, key)
+		if err != nil {
+			return nil, nil, errors.WithStack(err)
+		}
+		bElements, err := prefixElements(bNode, key)
+		if err != nil {
+			return nil, nil, errors.WithStack(err)
+		}
+		aSet, bSet := cf.NewZSetSlice(aElements), cf.NewZSetSlice(bElements)
+		aOnly.AddAll(cf.ZSetDiff(aSet, bSet))
+		bOnly.AddAll(cf.ZSetDiff(bSet, aSet))
+	}
+	return aOnly, bOnly, nil
+}
+
+func zpsEqual(a, b []cf.Zp) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].Cmp(&b[i]) != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Compare reconciles the peer's prefix tree with another, returning the
+// elements only in the peer's tree and those only in the other. The peer's
+// tree is read as in a recon session, so that it is not mutated meanwhile.
+// It fails with ErrPaused if recon is paused.
+func (p *Peer) Compare(other PrefixTree) (*cf.ZSet, *cf.ZSet, error) {
+	for !p.readAcquire() {
+		if p.Paused() {
+			return nil, nil, errors.WithStack(ErrPaused)
+		}
+		select {
+		case <-p.t.Dying():
+			return nil, nil, errors.New("recon peer stopped")
+		case <-time.After(compareRetryInterval):
+		}
+	}
+	defer p.readRelease()
+	return Compare(p.ptree, other)
+}
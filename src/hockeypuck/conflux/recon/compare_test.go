@@ -0,0 +1,97 @@
+/*
+   conflux - Distributed database synchronization library
+	Based on the algorithm described in
+		"Set Reconciliation with Nearly Optimal	Communication Complexity",
+			Yaron Minsky, Ari Trachtenberg, and Richard Zippel, 2004.
+
+   Copyright (c) 2012-2015  Casey Marshall <cmars@cmarstech.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package recon
+
+import (
+	gc "gopkg.in/check.v1"
+
+	cf "hockeypuck/conflux"
+)
+
+type CompareSuite struct{}
+
+var _ = gc.Suite(&CompareSuite{})
+
+func newMemTree() *MemPrefixTree {
+	tree := new(MemPrefixTree)
+	tree.Init()
+	return tree
+}
+
+func insertRandom(c *gc.C, n int, trees ...PrefixTree) *cf.ZSet {
+	zs := cf.NewZSet()
+	for i := 0; i < n; i++ {
+		z := cf.Zrand(cf.P_SKS)
+		zs.Add(z)
+		for _, tree := range trees {
+			c.Assert(tree.Insert(z), gc.IsNil)
+		}
+	}
+	return zs
+}
+
+func (s *CompareSuite) TestCompare(c *gc.C) {
+	for _, t := range []struct {
+		shared, aOnly, bOnly int
+	}{
+		{0, 0, 0},
+		{5000, 0, 0},
+		{5000, 3, 2},
+		{5000, 0, 1},
+		// Too many differences to solve at the root.
+		{2000, 600, 400},
+		{0, 50, 0},
+	} {
+		a, b := newMemTree(), newMemTree()
+		insertRandom(c, t.shared, a, b)
+		aWant := insertRandom(c, t.aOnly, a)
+		bWant := insertRandom(c, t.bOnly, b)
+		aOnly, bOnly, err := Compare(a, b)
+		c.Assert(err, gc.IsNil)
+		c.Assert(aOnly.Equal(aWant), gc.Equals, true, gc.Commentf("%+v", t))
+		c.Assert(bOnly.Equal(bWant), gc.Equals, true, gc.Commentf("%+v", t))
+	}
+}
+
+func (s *CompareSuite) TestCompareDifferentPoints(c *gc.C) {
+	a, b := newMemTree(), newMemTree()
+	b.points = cf.Zpoints(b.Field.P(), b.NumSamples()+1)
+	_, _, err := Compare(a, b)
+	c.Assert(err, gc.ErrorMatches, "prefix trees have different sample points")
+}
+
+func (s *CompareSuite) TestPeerCompare(c *gc.C) {
+	p := NewMemPeer()
+	other := newMemTree()
+	insertRandom(c, 1000, p.ptree, other)
+	want := insertRandom(c, 5, other)
+	localOnly, otherOnly, err := p.Compare(other)
+	c.Assert(err, gc.IsNil)
+	c.Assert(localOnly.Len(), gc.Equals, 0)
+	c.Assert(otherOnly.Equal(want), gc.Equals, true)
+
+	p.Pause()
+	_, _, err = p.Compare(other)
+	c.Assert(err, gc.ErrorMatches, "recon is paused")
+	p.Resume()
+	c.Assert(p.Stop(), gc.IsNil)
+}
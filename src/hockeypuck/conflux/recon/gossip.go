@@ -23,9 +23,11 @@ package recon
 
 import (
 	"bufio"
+	"context"
 	"fmt"
 	"math/rand"
 	"net"
+	"sync"
 	"time"
 
 	"github.com/pkg/errors"
@@ -36,49 +38,41 @@ import (
 
 const GOSSIP = "gossip"
 
-// skewedGossipInterval returns the configured gossip interval
-// with a randomised skew of between +/-10%, giving 90% to 110%
-// of the configured interval.
+// skewedGossipInterval returns the configured gossip interval with a
+// random skew of up to the configured jitter either way.
 func (p *Peer) skewedGossipInterval() time.Duration {
-	interval := float32(p.settings.GossipIntervalSecs)
-	base := time.Duration(interval * 0.9)
-	skew := time.Duration(rand.Intn(int(interval*0.2) + 1))
-	return (base + skew) * time.Second
+	interval := time.Duration(p.settings.GossipIntervalSecs) * time.Second
+	jitter := interval * time.Duration(p.settings.GossipJitterPercent) / 100
+	if jitter <= 0 {
+		return interval
+	}
+	return interval - jitter + time.Duration(rand.Int63n(int64(2*jitter)+1))
+}
+
+// gossipStagger returns a random delay of up to the configured stagger.
+func (p *Peer) gossipStagger() time.Duration {
+	stagger := time.Duration(p.settings.GossipStaggerSecs) * time.Second
+	if stagger <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(stagger) + 1))
 }
 
 // Gossip with remote servers, acting as a client.
 func (p *Peer) Gossip() error {
 	rand.Seed(time.Now().UnixNano())
-	timer := time.NewTimer(p.skewedGossipInterval())
+	p.markGossip()
+	timer := p.clock.NewTimer(p.skewedGossipInterval() + p.gossipStagger())
 	for {
 		select {
 		case <-p.t.Dying():
 			return nil
-		case <-timer.C:
+		case <-timer.C():
+			p.markGossip()
 
+			p.gossipRound()
 			if p.readAcquire() {
-				peer, err := p.choosePartner()
-				if err != nil {
-					if errors.Is(err, ErrNoPartners) {
-						p.log(GOSSIP).Debug("no partners to gossip with")
-					} else {
-						p.logErr(GOSSIP, err).Error("choosePartner")
-					}
-				} else {
-					start := time.Now()
-					recordReconInitiate(peer, CLIENT)
-					err = p.InitiateRecon(peer)
-					if errors.Is(err, ErrPeerBusy) {
-						p.logErr(GOSSIP, err).Debug()
-						recordReconBusyPeer(peer, CLIENT)
-					} else if err != nil {
-						p.logErr(GOSSIP, err).Errorf("recon with %v failed", peer)
-						recordReconFailure(peer, time.Since(start), CLIENT)
-					} else {
-						recordReconSuccess(peer, time.Since(start), CLIENT)
-					}
-				}
-
+				p.countNodes()
 				p.readRelease()
 			}
 
@@ -89,25 +83,113 @@ func (p *Peer) Gossip() error {
 	}
 }
 
+// gossipRound reconciles with as many partners at once as configured,
+// each after a random stagger. Each session holds off mutation of the
+// prefix tree only once its stagger has passed, so that elements inserted
+// meanwhile are not held up.
+func (p *Peer) gossipRound() {
+	partners, err := p.choosePartners()
+	if err != nil {
+		if errors.Is(err, ErrNoPartners) || errors.Is(err, ErrPartnersBackingOff) || errors.Is(err, ErrNoPullPartners) {
+			p.log(GOSSIP).Debug(err)
+		} else {
+			p.logErr(GOSSIP, err).Error("choosePartners")
+		}
+		return
+	}
+	var wg sync.WaitGroup
+	for _, peer := range partners {
+		wg.Add(1)
+		go func(peer net.Addr) {
+			defer wg.Done()
+			if stagger := p.gossipStagger(); stagger > 0 {
+				timer := p.clock.NewTimer(stagger)
+				defer timer.Stop()
+				select {
+				case <-p.t.Dying():
+					return
+				case <-timer.C():
+				}
+			}
+			if !p.readAcquire() {
+				return
+			}
+			defer p.readRelease()
+			p.gossipWith(peer)
+		}(peer)
+	}
+	wg.Wait()
+}
+
+func (p *Peer) gossipWith(peer net.Addr) {
+	start := time.Now()
+	recordReconInitiate(peer, CLIENT)
+	err := p.InitiateRecon(peer)
+	p.recordPartnerSession(peer, start, err)
+	p.recordPartnerBackoff(peer, err)
+	if errors.Is(err, ErrPeerBusy) {
+		p.logErr(GOSSIP, err).Debug()
+		recordReconBusyPeer(peer, CLIENT)
+	} else if err != nil {
+		p.logErr(GOSSIP, err).Errorf("recon with %v failed", peer)
+		recordReconFailure(peer, time.Since(start), CLIENT)
+	} else {
+		recordReconSuccess(peer, time.Since(start), CLIENT)
+	}
+}
+
 var ErrNoPartners error = fmt.Errorf("no recon partners configured")
+var ErrPartnersBackingOff error = fmt.Errorf("every recon partner is backing off after failures")
+var ErrNoPullPartners error = fmt.Errorf("every recon partner is push-only")
 var ErrIncompatiblePeer error = fmt.Errorf("remote peer configuration is not compatible")
 var ErrPeerBusy error = fmt.Errorf("peer is busy handling another request")
 var ErrReconDone = fmt.Errorf("reconciliation done")
 
-func (p *Peer) choosePartner() (net.Addr, error) {
-	partner, err := p.settings.RandomPartnerAddr()
+// choosePartners returns the addresses of the partners to gossip with in a
+// round, leaving out push-only partners and those backing off after
+// failures.
+func (p *Peer) choosePartners() ([]net.Addr, error) {
+	n := p.settings.GossipConcurrency
+	if n < 1 {
+		n = 1
+	}
+	var backingOff, pushOnly bool
+	exclude := func(name string) bool {
+		partner := p.settings.Partners[name]
+		if !partner.initiates() {
+			pushOnly = true
+			return true
+		}
+		if p.backingOff(name) {
+			backingOff = true
+			return true
+		}
+		return false
+	}
+	p.muSettings.RLock()
+	partners, err := p.settings.RandomPartnerAddrs(n, exclude)
+	p.muSettings.RUnlock()
 	if err != nil {
 		return nil, errors.WithStack(err)
 	}
-	if partner == nil {
+	if len(partners) == 0 && backingOff {
+		return nil, errors.WithStack(ErrPartnersBackingOff)
+	} else if len(partners) == 0 && pushOnly {
+		return nil, errors.WithStack(ErrNoPullPartners)
+	} else if len(partners) == 0 {
 		return nil, errors.WithStack(ErrNoPartners)
 	}
-	return partner, nil
+	return partners, nil
 }
 
-func (p *Peer) InitiateRecon(addr net.Addr) error {
+func (p *Peer) InitiateRecon(addr net.Addr) (_err error) {
+	ctx, span := p.startRound(GOSSIP, addr)
+	defer func() {
+		span.SetError(_err)
+		span.End()
+	}()
 	p.log(GOSSIP).Debugf("initiating recon with peer %v", addr)
-	conn, err := net.DialTimeout(addr.Network(), addr.String(), 30*time.Second)
+	conn, err := p.dial(addr)
 	if err != nil {
 		return errors.WithStack(err)
 	}
@@ -119,7 +201,7 @@ func (p *Peer) InitiateRecon(addr net.Addr) error {
 	}
 
 	// Interact with peer
-	return p.clientRecon(conn, remoteConfig)
+	return p.clientRecon(ctx, conn, remoteConfig)
 }
 
 type msgProgress struct {
@@ -147,15 +229,17 @@ func msgTypes(messages []ReconMsg) []string {
 
 type msgProgressChan chan *msgProgress
 
-func (p *Peer) clientRecon(conn net.Conn, remoteConfig *Config) error {
+func (p *Peer) clientRecon(ctx context.Context, conn net.Conn, remoteConfig *Config) error {
 	w := bufio.NewWriter(conn)
 	respSet := cf.NewZSet()
 	defer func() {
-		p.sendItems(respSet.Items(), conn, remoteConfig)
+		p.sendItems(ctx, respSet.Items(), conn, remoteConfig)
 	}()
 
+	mem := newSessionMemory(p.settings)
+	steps := p.interactWithServer(conn, mem)
 	var pendingMessages []ReconMsg
-	for step := range p.interactWithServer(conn) {
+	for step := range steps {
 		if step.err != nil {
 			if errors.Is(step.err, ErrReconDone) {
 				p.logConn(GOSSIP, conn).Info("reconcilation done")
@@ -169,6 +253,25 @@ func (p *Peer) clientRecon(conn net.Conn, remoteConfig *Config) error {
 				break
 			}
 		} else {
+			err := mem.alloc(mem.messagesSize(step.messages) + mem.elementsSize(step.elements.Len()))
+			if err != nil {
+				// Stop reading from the server, recovering what has been
+				// found so far. The error tells the server to start its
+				// next session with this peer at a deeper split.
+				go func() {
+					for range steps {
+					}
+				}()
+				recordReconMemoryExceeded(conn.RemoteAddr(), CLIENT)
+				werr := WriteMsg(w, &Error{&textMsg{Text: err.Error()}})
+				if werr == nil {
+					werr = w.Flush()
+				}
+				if werr != nil {
+					p.logConnErr(GOSSIP, conn, werr).Error()
+				}
+				return errors.WithStack(err)
+			}
 			pendingMessages = append(pendingMessages, step.messages...)
 			if step.flush {
 				for _, msg := range pendingMessages {
@@ -177,6 +280,7 @@ func (p *Peer) clientRecon(conn net.Conn, remoteConfig *Config) error {
 						return errors.WithStack(err)
 					}
 				}
+				mem.free(mem.messagesSize(pendingMessages))
 				pendingMessages = nil
 
 				err := w.Flush()
@@ -192,7 +296,7 @@ func (p *Peer) clientRecon(conn net.Conn, remoteConfig *Config) error {
 	return nil
 }
 
-func (p *Peer) interactWithServer(conn net.Conn) msgProgressChan {
+func (p *Peer) interactWithServer(conn net.Conn, mem *sessionMemory) msgProgressChan {
 	out := make(msgProgressChan)
 	go func() {
 		defer close(out)
@@ -201,7 +305,7 @@ func (p *Peer) interactWithServer(conn net.Conn) msgProgressChan {
 		var n int
 		for resp == nil || resp.err == nil {
 			p.setReadDeadline(conn, defaultTimeout)
-			msg, err := ReadMsg(conn)
+			msg, err := ReadMsgIn(conn, p.settings.Field.P())
 			if err != nil {
 				p.logConnErr(GOSSIP, conn, err).Error("interact: read msg")
 				out <- &msgProgress{err: err}
@@ -210,7 +314,7 @@ func (p *Peer) interactWithServer(conn net.Conn) msgProgressChan {
 			p.logConnFields(GOSSIP, conn, log.Fields{"msg": msg}).Debug("interact")
 			switch m := msg.(type) {
 			case *ReconRqstPoly:
-				resp = p.handleReconRqstPoly(m, conn)
+				resp = p.handleReconRqstPoly(m, conn, mem)
 			case *ReconRqstFull:
 				resp = p.handleReconRqstFull(m, conn)
 			case *Elements:
@@ -233,7 +337,7 @@ func (p *Peer) interactWithServer(conn net.Conn) msgProgressChan {
 var ErrReconRqstPolyNotFound = fmt.Errorf(
 	"peer should not receive a request for a non-existant node in ReconRqstPoly")
 
-func (p *Peer) handleReconRqstPoly(rp *ReconRqstPoly, conn net.Conn) *msgProgress {
+func (p *Peer) handleReconRqstPoly(rp *ReconRqstPoly, conn net.Conn, mem *sessionMemory) *msgProgress {
 	remoteSize := rp.Size
 	points := p.ptree.Points()
 	remoteSamples := rp.Samples
@@ -241,10 +345,26 @@ func (p *Peer) handleReconRqstPoly(rp *ReconRqstPoly, conn net.Conn) *msgProgres
 	if errors.Is(err, ErrNodeNotFound) {
 		return &msgProgress{err: ErrReconRqstPolyNotFound}
 	}
+	if node.Key().BitLen() < rp.Prefix.BitLen() {
+		// The local tree is not split this deeply, so the samples of the
+		// node found are not comparable. Send the elements under the prefix.
+		elements, err := prefixElements(node, rp.Prefix)
+		if err != nil {
+			return &msgProgress{err: errors.WithStack(err)}
+		}
+		return &msgProgress{elements: cf.NewZSet(), messages: []ReconMsg{
+			&FullElements{ZSet: cf.NewZSetSlice(elements)}}}
+	}
+	scratch := mem.interpolationSize(len(remoteSamples))
+	if err := mem.alloc(scratch); err != nil {
+		p.logConnErr(GOSSIP, conn, err).Debug("ReconRqstPoly: sending SyncFail")
+		return &msgProgress{elements: cf.NewZSet(), messages: []ReconMsg{&SyncFail{}}}
+	}
 	localSamples := node.SValues()
 	localSize := node.Size()
 	remoteSet, localSet, err := p.solve(
 		remoteSamples, localSamples, remoteSize, localSize, points, conn)
+	mem.free(scratch)
 	if errors.Is(err, cf.ErrLowMBar) {
 		p.logConn(GOSSIP, conn).Debug("ReconRqstPoly: low MBar")
 		if node.IsLeaf() || node.Size() < (p.settings.ThreshMult*p.settings.MBar) {
@@ -290,7 +410,7 @@ func (p *Peer) handleReconRqstFull(rf *ReconRqstFull, conn net.Conn) *msgProgres
 	} else if err != nil {
 		return &msgProgress{err: err}
 	} else {
-		elements, err := node.Elements()
+		elements, err := prefixElements(node, rf.Prefix)
 		if err != nil {
 			return &msgProgress{err: err}
 		}
@@ -32,10 +32,13 @@ import (
 	"bytes"
 	"encoding/gob"
 	"fmt"
+	"io"
+	"math/big"
 	"os"
 
 	"github.com/pkg/errors"
 	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/opt"
 
 	cf "hockeypuck/conflux"
 	"hockeypuck/conflux/recon"
@@ -46,9 +49,20 @@ type prefixTree struct {
 	recon.PTreeConfig
 	path string
 
-	root   *prefixNode
-	db     *leveldb.DB
-	points []cf.Zp
+	root    *prefixNode
+	db      *leveldb.DB
+	tx      *leveldb.Transaction
+	pending *pending
+	points  []cf.Zp
+}
+
+var _ recon.Batcher = (*prefixTree)(nil)
+
+// kv is implemented by both the database and its transactions.
+type kv interface {
+	Get(key []byte, ro *opt.ReadOptions) ([]byte, error)
+	Put(key, value []byte, wo *opt.WriteOptions) error
+	Delete(key []byte, wo *opt.WriteOptions) error
 }
 
 type prefixNode struct {
@@ -86,8 +100,8 @@ func mustEncodeZZarray(arr []cf.Zp) []byte {
 	return w.Bytes()
 }
 
-func mustDecodeZZarray(buf []byte) []cf.Zp {
-	arr, err := recon.ReadZZarray(bytes.NewBuffer(buf))
+func mustDecodeZZarray(p *big.Int, buf []byte) []cf.Zp {
+	arr, err := recon.ReadZZarrayIn(bytes.NewBuffer(buf), p)
 	if err != nil {
 		panic(err)
 	}
@@ -96,11 +110,24 @@ func mustDecodeZZarray(buf []byte) []cf.Zp {
 
 const COLLECTION_NAME = "conflux.recon"
 
+// fieldKey records the field of a prefix tree, if other than P_SKS. It is
+// longer than any node key or element likely to collide with it.
+var fieldKey = []byte("conflux.recon.ptree.field")
+
+// shapeKey records the bitquantum, mbar and threshmult of a prefix tree, if
+// other than the defaults. Trees recorded before threshmult was have the
+// default.
+var shapeKey = []byte("conflux.recon.ptree.shape")
+
+// checkedKey records that a prefix tree has been checked by a version which
+// writes each update to it atomically, so that it need not be checked again.
+var checkedKey = []byte("conflux.recon.ptree.checked")
+
 func New(config recon.PTreeConfig, path string) (recon.PrefixTree, error) {
 	return &prefixTree{
 		PTreeConfig: config,
 		path:        path,
-		points:      cf.Zpoints(cf.P_SKS, config.NumSamples())}, nil
+		points:      cf.Zpoints(config.Field.P(), config.NumSamples())}, nil
 }
 
 func (t *prefixTree) Create() error {
@@ -109,7 +136,121 @@ func (t *prefixTree) Create() error {
 	if err != nil {
 		return errors.WithStack(err)
 	}
-	return errors.WithStack(t.ensureRoot())
+	err = t.ensureField()
+	if err != nil {
+		t.db.Close()
+		return errors.WithStack(err)
+	}
+	err = t.ensureShape()
+	if err != nil {
+		t.db.Close()
+		return errors.WithStack(err)
+	}
+	err = t.ensureRoot()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	err = t.ensureChecked()
+	if err != nil {
+		t.db.Close()
+		return errors.WithStack(err)
+	}
+	return nil
+}
+
+// ensureField records the field of a new prefix tree, or checks that an
+// existing tree was built for the configured field. Trees built before the
+// field was configurable use P_SKS.
+func (t *prefixTree) ensureField() error {
+	field := recon.Field{}
+	val, err := t.db.Get(fieldKey, nil)
+	if err == nil {
+		err = field.UnmarshalText(val)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+	} else if err != leveldb.ErrNotFound {
+		return errors.WithStack(err)
+	} else if !t.Field.IsSKS() {
+		empty, err := t.empty()
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if empty {
+			return errors.WithStack(t.db.Put(fieldKey, []byte(t.Field.String()), nil))
+		}
+	}
+	if field.P().Cmp(t.Field.P()) != 0 {
+		return errors.Errorf("prefix tree %q was built for field %v, rebuild it to use %v", t.path, field, t.Field)
+	}
+	return nil
+}
+
+// ensureShape records the bitquantum, mbar and threshmult of a new prefix
+// tree, or checks that an existing tree was built with those configured, as
+// they determine its nodes. Trees built before they were recorded have the
+// defaults.
+func (t *prefixTree) ensureShape() error {
+	bitQuantum, mbar, threshMult := recon.DefaultBitQuantum, recon.DefaultMBar, recon.DefaultThreshMult
+	val, err := t.db.Get(shapeKey, nil)
+	if err == nil {
+		n, err := fmt.Sscan(string(val), &bitQuantum, &mbar, &threshMult)
+		if err != nil && !(n == 2 && err == io.EOF) {
+			return errors.Wrapf(err, "invalid prefix tree shape %q", val)
+		}
+	} else if err != leveldb.ErrNotFound {
+		return errors.WithStack(err)
+	} else if t.BitQuantum == bitQuantum && t.MBar == mbar && t.ThreshMult == threshMult {
+		return nil
+	} else {
+		empty, err := t.empty()
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if empty {
+			return errors.WithStack(t.db.Put(shapeKey, []byte(fmt.Sprintf("%d %d %d", t.BitQuantum, t.MBar, t.ThreshMult)), nil))
+		}
+	}
+	if t.BitQuantum != bitQuantum || t.MBar != mbar || t.ThreshMult != threshMult {
+		return errors.Errorf("prefix tree %q was built with bitQuantum %d, mBar %d and threshMult %d, rebuild it to use bitQuantum %d, mBar %d and threshMult %d",
+			t.path, bitQuantum, mbar, threshMult, t.BitQuantum, t.MBar, t.ThreshMult)
+	}
+	return nil
+}
+
+// ensureChecked checks a prefix tree the first time it is opened, unless it
+// is new. Trees written before each update was written atomically may have
+// been left inconsistent by an unclean shutdown, and cannot be repaired.
+func (t *prefixTree) ensureChecked() error {
+	_, err := t.db.Get(checkedKey, nil)
+	if err == nil {
+		return nil
+	} else if err != leveldb.ErrNotFound {
+		return errors.WithStack(err)
+	}
+	root, err := t.getNode(mustEncodeBitstring(cf.NewBitstring(0)))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if !root.IsLeaf() {
+		log.WithField("path", t.path).Info("checking prefix tree")
+	}
+	err = root.check()
+	if err != nil {
+		return errors.Errorf("prefix tree %q is inconsistent, rebuild it with hockeypuck-pbuild: %v", t.path, err)
+	}
+	return errors.WithStack(t.db.Put(checkedKey, []byte{}, nil))
+}
+
+// empty returns whether the prefix tree has no root node yet.
+func (t *prefixTree) empty() (bool, error) {
+	_, err := t.Root()
+	if errors.Is(err, recon.ErrNodeNotFound) {
+		return true, nil
+	} else if err != nil {
+		return false, errors.WithStack(err)
+	}
+	return false, nil
 }
 
 func (t *prefixTree) Drop() error {
@@ -122,9 +263,46 @@ func (t *prefixTree) Drop() error {
 }
 
 func (t *prefixTree) Close() (err error) {
+	if t.tx != nil {
+		t.tx.Discard()
+		t.tx = nil
+	}
 	return errors.WithStack(t.db.Close())
 }
 
+// store returns the update or batch in progress, if any, or else the
+// database.
+func (t *prefixTree) store() kv {
+	if t.pending != nil {
+		return t.pending
+	}
+	if t.tx != nil {
+		return t.tx
+	}
+	return t.db
+}
+
+func (t *prefixTree) Begin() error {
+	if t.tx != nil {
+		return errors.New("prefix tree batch already in progress")
+	}
+	tx, err := t.db.OpenTransaction()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	t.tx = tx
+	return nil
+}
+
+func (t *prefixTree) Commit() error {
+	if t.tx == nil {
+		return errors.New("no prefix tree batch in progress")
+	}
+	tx := t.tx
+	t.tx = nil
+	return errors.WithStack(tx.Commit())
+}
+
 func (t *prefixTree) Init() {}
 
 func (t *prefixTree) ensureRoot() (err error) {
@@ -146,15 +324,23 @@ func (t *prefixTree) Root() (recon.PrefixNode, error) {
 	return n, nil
 }
 
+func (t *prefixTree) Stats() (*recon.PTreeStats, error) {
+	root, err := t.Root()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return recon.SubtreeStats(root)
+}
+
 func (t *prefixTree) hasKey(key []byte) bool {
-	_, err := t.db.Get(key, nil)
+	_, err := t.store().Get(key, nil)
 	return err == nil
 }
 
 func (t *prefixTree) getNode(key []byte) (*prefixNode, error) {
 	var val []byte
 	var err error
-	if val, err = t.db.Get(key, nil); err != nil {
+	if val, err = t.store().Get(key, nil); err != nil {
 		if err == leveldb.ErrNotFound {
 			return nil, errors.WithStack(recon.ErrNodeNotFound)
 		}
@@ -226,7 +412,7 @@ func (n *prefixNode) insert(z *cf.Zp, marray []cf.Zp, bs *cf.Bitstring, depth in
 }
 
 func (n *prefixNode) deleteNode() error {
-	err := n.db.Delete(n.NodeKey, nil)
+	err := n.store().Delete(n.NodeKey, nil)
 	return errors.WithStack(err)
 }
 
@@ -280,7 +466,7 @@ func (n *prefixNode) split(depth int) error {
 	}
 	// Move elements into child nodes
 	for _, element := range splitElements {
-		z := cf.Zb(cf.P_SKS, element)
+		z := cf.Zb(n.Field.P(), element)
 		bs := cf.NewZpBitstring(z)
 		childIndex := recon.NextChild(n, bs, depth)
 		child := children[childIndex]
@@ -349,8 +535,12 @@ func (n *prefixNode) join() error {
 	return n.upsertNode()
 }
 
+// ErrDuplicate is returned, wrapped, on inserting an element which is
+// already in the prefix tree.
+var ErrDuplicate = errors.New("duplicate element")
+
 func ErrDuplicateElement(z *cf.Zp) error {
-	return fmt.Errorf("attempt to insert duplicate element %v", z)
+	return errors.Wrapf(ErrDuplicate, "attempt to insert element %v", z)
 }
 
 func ErrElementNotFound(z *cf.Zp) error {
@@ -358,44 +548,48 @@ func ErrElementNotFound(z *cf.Zp) error {
 }
 
 func (t *prefixTree) Insert(z *cf.Zp) error {
-	_, lookupErr := t.db.Get(z.Bytes(), nil)
-	if lookupErr == nil {
-		return errors.WithStack(ErrDuplicateElement(z))
-	} else if lookupErr != leveldb.ErrNotFound {
-		return lookupErr
-	}
-	bs := cf.NewZpBitstring(z)
-	root, err := t.Root()
-	if err != nil {
-		return errors.WithStack(err)
-	}
-	marray, err := recon.AddElementArray(t, z)
-	if err != nil {
-		return errors.WithStack(err)
-	}
-	err = root.(*prefixNode).insert(z, marray, bs, 0)
-	if err != nil {
-		return errors.WithStack(err)
-	}
-	return errors.WithStack(t.db.Put(z.Bytes(), []byte{}, nil))
+	return t.update(func() error {
+		_, lookupErr := t.store().Get(z.Bytes(), nil)
+		if lookupErr == nil {
+			return errors.WithStack(ErrDuplicateElement(z))
+		} else if lookupErr != leveldb.ErrNotFound {
+			return lookupErr
+		}
+		bs := cf.NewZpBitstring(z)
+		root, err := t.Root()
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		marray, err := recon.AddElementArray(t, z)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		err = root.(*prefixNode).insert(z, marray, bs, 0)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		return errors.WithStack(t.store().Put(z.Bytes(), []byte{}, nil))
+	})
 }
 
 func (t *prefixTree) Remove(z *cf.Zp) error {
-	_, lookupErr := t.db.Get(z.Bytes(), nil)
-	if lookupErr != nil {
-		return errors.WithStack(lookupErr)
-	}
-	bs := cf.NewZpBitstring(z)
-	root, err := t.Root()
-	if err != nil {
-		return errors.WithStack(err)
-	}
-	marray := recon.DelElementArray(t, z)
-	err = root.(*prefixNode).remove(z, marray, bs, 0)
-	if err != nil {
-		return errors.WithStack(err)
-	}
-	return t.db.Delete(z.Bytes(), nil)
+	return t.update(func() error {
+		_, lookupErr := t.store().Get(z.Bytes(), nil)
+		if lookupErr != nil {
+			return errors.WithStack(lookupErr)
+		}
+		bs := cf.NewZpBitstring(z)
+		root, err := t.Root()
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		marray := recon.DelElementArray(t, z)
+		err = root.(*prefixNode).remove(z, marray, bs, 0)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		return t.store().Delete(z.Bytes(), nil)
+	})
 }
 
 func (t *prefixTree) newChildNode(parent *prefixNode, childIndex int) *prefixNode {
@@ -417,7 +611,7 @@ func (t *prefixTree) newChildNode(parent *prefixNode, childIndex int) *prefixNod
 	}
 	n.NodeKey = mustEncodeBitstring(key)
 	svalues := make([]cf.Zp, t.NumSamples())
-	zOne := cf.Zi(cf.P_SKS, 1)
+	zOne := cf.Zi(t.Field.P(), 1)
 	for i := 0; i < len(svalues); i++ {
 		svalues[i].Set(zOne)
 	}
@@ -431,7 +625,38 @@ func (n *prefixNode) upsertNode() error {
 	if err := enc.Encode(n); err != nil {
 		return errors.WithStack(err)
 	}
-	return errors.WithStack(n.db.Put(n.NodeKey, buf.Bytes(), nil))
+	return errors.WithStack(n.store().Put(n.NodeKey, buf.Bytes(), nil))
+}
+
+// check returns an error if a node below n is missing, or if n does not
+// count the elements below it.
+func (n *prefixNode) check() error {
+	if n.IsLeaf() {
+		if n.NumElements != len(n.NodeElements) {
+			return errors.Errorf("node %v counts %d elements but holds %d", n.Key(), n.NumElements, len(n.NodeElements))
+		}
+		return nil
+	}
+	children, err := n.Children()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	var sum int
+	for _, child := range children {
+		// Node finds the nearest ancestor of a missing node.
+		if child.Key().BitLen() != n.Key().BitLen()+n.BitQuantum {
+			return errors.Errorf("node %v is missing children", n.Key())
+		}
+		err = child.(*prefixNode).check()
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		sum += child.Size()
+	}
+	if n.NumElements != sum {
+		return errors.Errorf("node %v counts %d elements but has %d below it", n.Key(), n.NumElements, sum)
+	}
+	return nil
 }
 
 func (n *prefixNode) IsLeaf() bool {
@@ -469,7 +694,7 @@ func (n *prefixNode) Elements() ([]cf.Zp, error) {
 	if n.IsLeaf() {
 		result = make([]cf.Zp, len(n.NodeElements))
 		for i := range n.NodeElements {
-			result[i].In(cf.P_SKS).SetBytes(n.NodeElements[i])
+			result[i].In(n.Field.P()).SetBytes(n.NodeElements[i])
 		}
 	} else {
 		children, err := n.Children()
@@ -490,7 +715,7 @@ func (n *prefixNode) Elements() ([]cf.Zp, error) {
 func (n *prefixNode) Size() int { return n.NumElements }
 
 func (n *prefixNode) SValues() []cf.Zp {
-	return mustDecodeZZarray(n.NodeSValues)
+	return mustDecodeZZarray(n.Field.P(), n.NodeSValues)
 }
 
 func (n *prefixNode) Key() *cf.Bitstring {
@@ -515,7 +740,7 @@ func (n *prefixNode) updateSvalues(marray []cf.Zp) {
 	if len(marray) != len(n.points) {
 		panic("Inconsistent NumSamples size")
 	}
-	svalues := mustDecodeZZarray(n.NodeSValues)
+	svalues := mustDecodeZZarray(n.Field.P(), n.NodeSValues)
 	for i := 0; i < len(marray); i++ {
 		svalues[i].Mul(&svalues[i], &marray[i])
 	}
@@ -24,6 +24,8 @@ package leveldb
 import (
 	"path/filepath"
 
+	"github.com/pkg/errors"
+	"github.com/syndtr/goleveldb/leveldb"
 	gc "gopkg.in/check.v1"
 
 	cf "hockeypuck/conflux"
@@ -168,6 +170,49 @@ func (s *PtreeSuite) TestInsertDups(c *gc.C) {
 	}
 }
 
+func (s *PtreeSuite) TestBatch(c *gc.C) {
+	batcher := s.ptree.(recon.Batcher)
+	c.Assert(batcher.Commit(), gc.ErrorMatches, "no prefix tree batch in progress")
+	c.Assert(batcher.Begin(), gc.IsNil)
+	c.Assert(batcher.Begin(), gc.ErrorMatches, "prefix tree batch already in progress")
+
+	// Enough elements to split nodes within the batch.
+	items := cf.NewZSet()
+	for i := 0; i < s.config.SplitThreshold()*4; i++ {
+		z := cf.Zrand(cf.P_SKS)
+		items.Add(z)
+		c.Assert(s.ptree.Insert(z), gc.IsNil)
+	}
+	err := s.ptree.Insert(&items.Items()[0])
+	c.Assert(errors.Is(err, ErrDuplicate), gc.Equals, true)
+
+	// An update which fails within a batch writes nothing to it.
+	t := s.ptree.(*prefixTree)
+	key := []byte("update")
+	err = t.update(func() error {
+		c.Assert(t.store().Put(key, []byte{1}, nil), gc.IsNil)
+		return errors.New("failed")
+	})
+	c.Assert(err, gc.ErrorMatches, "failed")
+	_, err = t.tx.Get(key, nil)
+	c.Assert(err, gc.Equals, leveldb.ErrNotFound)
+
+	root, err := s.ptree.Root()
+	c.Assert(err, gc.IsNil)
+	c.Assert(cf.NewZSetSlice(recon.MustElements(root)).Equal(items), gc.Equals, true)
+	c.Assert(batcher.Commit(), gc.IsNil)
+
+	// Committed elements survive re-opening the tree.
+	c.Assert(s.ptree.Close(), gc.IsNil)
+	s.ptree, err = New(s.config, s.path)
+	c.Assert(err, gc.IsNil)
+	c.Assert(s.ptree.Create(), gc.IsNil)
+	root, err = s.ptree.Root()
+	c.Assert(err, gc.IsNil)
+	c.Assert(root.IsLeaf(), gc.Equals, false)
+	c.Assert(cf.NewZSetSlice(recon.MustElements(root)).Equal(items), gc.Equals, true)
+}
+
 func (s *PtreeSuite) TestInsertNodeSplit(c *gc.C) {
 	root, err := s.ptree.Root()
 	for _, sv := range root.SValues() {
@@ -197,6 +242,26 @@ func (s *PtreeSuite) TestInsertNodeSplit(c *gc.C) {
 	c.Assert(recon.MustElements(root), gc.HasLen, 0)
 }
 
+func (s *PtreeSuite) TestStats(c *gc.C) {
+	n := s.config.SplitThreshold() * 4
+	for i := 0; i < n; i++ {
+		err := s.ptree.Insert(cf.Zi(cf.P_SKS, i+65536))
+		c.Assert(err, gc.IsNil)
+	}
+	stats, err := s.ptree.Stats()
+	c.Assert(err, gc.IsNil)
+	c.Assert(stats.Elements, gc.Equals, n)
+	c.Assert(stats.LeafElements, gc.Equals, n)
+	c.Assert(stats.MaxDepth() > 0, gc.Equals, true)
+	c.Assert(stats.Depths[0], gc.Equals, 1)
+	var nodes int
+	for _, depth := range stats.Depths {
+		nodes += depth
+	}
+	c.Assert(stats.Nodes, gc.Equals, nodes)
+	c.Assert(stats.Leaves < stats.Nodes, gc.Equals, true)
+}
+
 func (s *PtreeSuite) TestNewChildIndex(c *gc.C) {
 	root, err := s.ptree.Root()
 	c.Assert(err, gc.IsNil)
@@ -210,3 +275,174 @@ func (s *PtreeSuite) TestNewChildIndex(c *gc.C) {
 	c.Assert(child11.Key().Get(0), gc.Equals, 1)
 	c.Assert(child11.Key().Get(1), gc.Equals, 1)
 }
+
+func (s *PtreeSuite) TestField(c *gc.C) {
+	config := recon.DefaultSettings().PTreeConfig
+	field, err := recon.NewField(cf.P_256)
+	c.Assert(err, gc.IsNil)
+	config.Field = field
+	path := filepath.Join(c.MkDir(), "db")
+	ptree, err := New(config, path)
+	c.Assert(err, gc.IsNil)
+	c.Assert(ptree.Create(), gc.IsNil)
+
+	// Enough elements to split the root.
+	items := cf.NewZSet()
+	for i := 0; i < 2*config.SplitThreshold(); i++ {
+		z := cf.Zrand(cf.P_256)
+		items.Add(z)
+		c.Assert(ptree.Insert(z), gc.IsNil)
+	}
+	root, err := ptree.Root()
+	c.Assert(err, gc.IsNil)
+	c.Assert(root.IsLeaf(), gc.Equals, false)
+	c.Assert(cf.NewZSetSlice(recon.MustElements(root)).Equal(items), gc.Equals, true)
+	for _, sv := range root.SValues() {
+		c.Assert(sv.P().Cmp(cf.P_256), gc.Equals, 0)
+	}
+	c.Assert(ptree.Close(), gc.IsNil)
+
+	// The tree cannot be used with another field.
+	ptree, err = New(recon.DefaultSettings().PTreeConfig, path)
+	c.Assert(err, gc.IsNil)
+	c.Assert(ptree.Create(), gc.ErrorMatches, `prefix tree ".*" was built for field `+cf.P_256.String()+`, rebuild it to use `+cf.P_SKS.String())
+
+	ptree, err = New(config, path)
+	c.Assert(err, gc.IsNil)
+	c.Assert(ptree.Create(), gc.IsNil)
+	c.Assert(ptree.Close(), gc.IsNil)
+}
+
+func (s *PtreeSuite) TestShape(c *gc.C) {
+	config := recon.DefaultSettings().PTreeConfig
+	config.BitQuantum = 4
+	config.MBar = 15
+	path := filepath.Join(c.MkDir(), "db")
+	ptree, err := New(config, path)
+	c.Assert(err, gc.IsNil)
+	c.Assert(ptree.Create(), gc.IsNil)
+	for i := 0; i < 2*config.SplitThreshold(); i++ {
+		c.Assert(ptree.Insert(cf.Zrand(cf.P_SKS)), gc.IsNil)
+	}
+	root, err := ptree.Root()
+	c.Assert(err, gc.IsNil)
+	c.Assert(root.SValues(), gc.HasLen, config.NumSamples())
+	c.Assert(recon.MustChildren(root), gc.HasLen, 16)
+	c.Assert(ptree.Close(), gc.IsNil)
+
+	// The tree cannot be used with another shape.
+	ptree, err = New(recon.DefaultSettings().PTreeConfig, path)
+	c.Assert(err, gc.IsNil)
+	c.Assert(ptree.Create(), gc.ErrorMatches, `prefix tree ".*" was built with bitQuantum 4, mBar 15 and threshMult 10, rebuild it to use bitQuantum 2, mBar 5 and threshMult 10`)
+	other := config
+	other.ThreshMult = 20
+	ptree, err = New(other, path)
+	c.Assert(err, gc.IsNil)
+	c.Assert(ptree.Create(), gc.ErrorMatches, `prefix tree ".*" was built with bitQuantum 4, mBar 15 and threshMult 10, rebuild it to use bitQuantum 4, mBar 15 and threshMult 20`)
+
+	ptree, err = New(config, path)
+	c.Assert(err, gc.IsNil)
+	c.Assert(ptree.Create(), gc.IsNil)
+
+	// A shape recorded before threshMult was has the default.
+	c.Assert(ptree.(*prefixTree).db.Put(shapeKey, []byte("4 15"), nil), gc.IsNil)
+	c.Assert(ptree.Close(), gc.IsNil)
+	ptree, err = New(config, path)
+	c.Assert(err, gc.IsNil)
+	c.Assert(ptree.Create(), gc.IsNil)
+	c.Assert(ptree.Close(), gc.IsNil)
+	ptree, err = New(other, path)
+	c.Assert(err, gc.IsNil)
+	c.Assert(ptree.Create(), gc.ErrorMatches, `prefix tree ".*" was built with bitQuantum 4, mBar 15 and threshMult 10, .*`)
+
+	// Nor can a tree with the default shape, which is not recorded.
+	c.Assert(s.ptree.Close(), gc.IsNil)
+	ptree, err = New(config, s.path)
+	c.Assert(err, gc.IsNil)
+	c.Assert(ptree.Create(), gc.ErrorMatches, `prefix tree ".*" was built with bitQuantum 2, mBar 5 and threshMult 10, rebuild it to use bitQuantum 4, mBar 15 and threshMult 10`)
+	s.ptree, err = New(s.config, s.path)
+	c.Assert(err, gc.IsNil)
+	c.Assert(s.ptree.Create(), gc.IsNil)
+}
+
+func (s *PtreeSuite) TestUpdate(c *gc.C) {
+	for i := 0; i < 2*s.config.SplitThreshold(); i++ {
+		c.Assert(s.ptree.Insert(cf.Zrand(cf.P_SKS)), gc.IsNil)
+	}
+	c.Assert(s.ptree.Remove(&recon.MustElements(s.mustRoot(c))[0]), gc.IsNil)
+
+	// An update reads its own writes, which are written only once it
+	// succeeds.
+	t := s.ptree.(*prefixTree)
+	key := []byte("update")
+	err := t.update(func() error {
+		c.Assert(t.store().Put(key, []byte{1}, nil), gc.IsNil)
+		val, err := t.store().Get(key, nil)
+		c.Assert(err, gc.IsNil)
+		c.Assert(val, gc.DeepEquals, []byte{1})
+		return errors.New("failed")
+	})
+	c.Assert(err, gc.ErrorMatches, "failed")
+	_, err = t.db.Get(key, nil)
+	c.Assert(err, gc.Equals, leveldb.ErrNotFound)
+
+	// The tree written by updates matches one reopened from disk.
+	expected, err := s.ptree.Stats()
+	c.Assert(err, gc.IsNil)
+	c.Assert(s.ptree.Close(), gc.IsNil)
+	s.ptree, err = New(s.config, s.path)
+	c.Assert(err, gc.IsNil)
+	c.Assert(s.ptree.Create(), gc.IsNil)
+	stats, err := s.ptree.Stats()
+	c.Assert(err, gc.IsNil)
+	c.Assert(stats, gc.DeepEquals, expected)
+}
+
+func (s *PtreeSuite) mustRoot(c *gc.C) recon.PrefixNode {
+	root, err := s.ptree.Root()
+	c.Assert(err, gc.IsNil)
+	return root
+}
+
+func (s *PtreeSuite) TestInconsistent(c *gc.C) {
+	// A new tree needs no check.
+	_, err := s.ptree.(*prefixTree).db.Get(checkedKey, nil)
+	c.Assert(err, gc.IsNil)
+
+	// A tree left inconsistent before each update was written atomically
+	// is found when it is next opened.
+	for _, t := range []struct {
+		corrupt func(root *prefixNode) error
+		err     string
+	}{{
+		func(root *prefixNode) error {
+			children, err := root.Children()
+			c.Assert(err, gc.IsNil)
+			return root.db.Delete(children[1].(*prefixNode).NodeKey, nil)
+		},
+		`prefix tree ".*" is inconsistent, rebuild it with hockeypuck-pbuild: node .* is missing children`,
+	}, {
+		func(root *prefixNode) error {
+			root.NumElements++
+			return root.upsertNode()
+		},
+		`prefix tree ".*" is inconsistent, rebuild it with hockeypuck-pbuild: node .* counts \d+ elements but has \d+ below it`,
+	}} {
+		path := filepath.Join(c.MkDir(), "db")
+		ptree, err := New(s.config, path)
+		c.Assert(err, gc.IsNil)
+		c.Assert(ptree.Create(), gc.IsNil)
+		for i := 0; i < 4*s.config.SplitThreshold(); i++ {
+			c.Assert(ptree.Insert(cf.Zrand(cf.P_SKS)), gc.IsNil)
+		}
+		root, err := ptree.Root()
+		c.Assert(err, gc.IsNil)
+		c.Assert(t.corrupt(root.(*prefixNode)), gc.IsNil)
+		c.Assert(ptree.(*prefixTree).db.Delete(checkedKey, nil), gc.IsNil)
+		c.Assert(ptree.Close(), gc.IsNil)
+
+		ptree, err = New(s.config, path)
+		c.Assert(err, gc.IsNil)
+		c.Assert(ptree.Create(), gc.ErrorMatches, t.err)
+	}
+}
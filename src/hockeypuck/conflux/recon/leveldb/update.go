@@ -0,0 +1,98 @@
+/*
+   conflux - Distributed database synchronization library
+	Based on the algorithm described in
+		"Set Reconciliation with Nearly Optimal	Communication Complexity",
+			Yaron Minsky, Ari Trachtenberg, and Richard Zippel, 2004.
+
+   Copyright (c) 2012-2015  Casey Marshall <cmars@cmarstech.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package leveldb
+
+import (
+	"github.com/pkg/errors"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+)
+
+// pending collects the writes of an update to the prefix tree, which reads
+// its own writes until they are written together.
+type pending struct {
+	kv kv
+
+	// vals holds the value last written to each key, or nil if the key
+	// was deleted.
+	vals map[string][]byte
+}
+
+func newPending(kv kv) *pending {
+	return &pending{kv: kv, vals: map[string][]byte{}}
+}
+
+func (p *pending) Get(key []byte, ro *opt.ReadOptions) ([]byte, error) {
+	if val, ok := p.vals[string(key)]; ok {
+		if val == nil {
+			return nil, leveldb.ErrNotFound
+		}
+		return val, nil
+	}
+	return p.kv.Get(key, ro)
+}
+
+func (p *pending) Put(key, value []byte, wo *opt.WriteOptions) error {
+	p.vals[string(key)] = append([]byte{}, value...)
+	return nil
+}
+
+func (p *pending) Delete(key []byte, wo *opt.WriteOptions) error {
+	p.vals[string(key)] = nil
+	return nil
+}
+
+func (p *pending) batch() *leveldb.Batch {
+	batch := new(leveldb.Batch)
+	for key, val := range p.vals {
+		if val == nil {
+			batch.Delete([]byte(key))
+		} else {
+			batch.Put([]byte(key), val)
+		}
+	}
+	return batch
+}
+
+// update makes the writes of f to the prefix tree as one update. Each insert
+// or remove changes several nodes, which leveldb writes together, so that
+// the prefix tree is never left with an update partly written. Updates are
+// written to the batch in progress, if any, and synced when it is committed.
+func (t *prefixTree) update(f func() error) error {
+	if t.tx != nil {
+		t.pending = newPending(t.tx)
+	} else {
+		t.pending = newPending(t.db)
+	}
+	defer func() { t.pending = nil }()
+	err := f()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if len(t.pending.vals) == 0 {
+		return nil
+	}
+	if t.tx != nil {
+		return errors.WithStack(t.tx.Write(t.pending.batch(), nil))
+	}
+	return errors.WithStack(t.db.Write(t.pending.batch(), &opt.WriteOptions{Sync: true}))
+}
@@ -27,6 +27,10 @@ import (
 	"encoding/binary"
 	"fmt"
 	"io"
+	"math/big"
+	"sort"
+	"strconv"
+	"strings"
 
 	"github.com/pkg/errors"
 
@@ -34,18 +38,15 @@ import (
 )
 
 var (
-	SksZpNbytes int
+	SksZpNbytes = cf.WireLen(cf.P_SKS)
 
 	maxReadLen = 1 << 24
 )
 
-func init() {
-	SksZpNbytes = cf.P_SKS.BitLen() / 8
-	if cf.P_SKS.BitLen()%8 != 0 {
-		SksZpNbytes++
-	}
-}
-
+// PadSksElement pads the byte representation of an element to the SKS wire
+// length.
+//
+// Deprecated: use Zp.WireBytes.
 func PadSksElement(zb []byte) []byte {
 	for len(zb) < SksZpNbytes {
 		zb = append(zb, byte(0))
@@ -99,19 +100,19 @@ func (mt MsgType) String() string {
 
 type ReconMsg interface {
 	MsgType() MsgType
-	unmarshal(r io.Reader) error
+	unmarshal(r io.Reader, p *big.Int) error
 	marshal(w io.Writer) error
 }
 
 type emptyMsg struct{}
 
-func (msg *emptyMsg) unmarshal(r io.Reader) error { return nil }
+func (msg *emptyMsg) unmarshal(r io.Reader, p *big.Int) error { return nil }
 
 func (msg *emptyMsg) marshal(w io.Writer) error { return nil }
 
 type textMsg struct{ Text string }
 
-func (msg *textMsg) unmarshal(r io.Reader) (err error) {
+func (msg *textMsg) unmarshal(r io.Reader, p *big.Int) (err error) {
 	msg.Text, err = ReadString(r)
 	return
 }
@@ -122,7 +123,7 @@ func (msg *textMsg) marshal(w io.Writer) error {
 
 type notImplMsg struct{}
 
-func (msg *notImplMsg) unmarshal(r io.Reader) error {
+func (msg *notImplMsg) unmarshal(r io.Reader, p *big.Int) error {
 	panic("not implemented")
 }
 
@@ -214,16 +215,21 @@ func WriteBitstring(w io.Writer, bs *cf.Bitstring) error {
 }
 
 func ReadZZarray(r io.Reader) ([]cf.Zp, error) {
+	return ReadZZarrayIn(r, cf.P_SKS)
+}
+
+// ReadZZarrayIn reads an array of elements of the finite field p.
+func ReadZZarrayIn(r io.Reader, p *big.Int) ([]cf.Zp, error) {
 	n, err := ReadInt(r)
 	if err != nil {
 		return nil, errors.WithStack(err)
 	}
-	if n*SksZpNbytes > maxReadLen {
-		return nil, errors.Errorf("read length %d exceeds maximum limit", n*SksZpNbytes)
+	if n*cf.WireLen(p) > maxReadLen {
+		return nil, errors.Errorf("read length %d exceeds maximum limit", n*cf.WireLen(p))
 	}
 	arr := make([]cf.Zp, n)
 	for i := 0; i < n; i++ {
-		err := ReadZp(r, &arr[i])
+		err := ReadZpIn(r, p, &arr[i])
 		if err != nil {
 			return nil, errors.WithStack(err)
 		}
@@ -246,7 +252,12 @@ func WriteZZarray(w io.Writer, arr []cf.Zp) error {
 }
 
 func ReadZSet(r io.Reader) (*cf.ZSet, error) {
-	arr, err := ReadZZarray(r)
+	return ReadZSetIn(r, cf.P_SKS)
+}
+
+// ReadZSetIn reads a set of elements of the finite field p.
+func ReadZSetIn(r io.Reader, p *big.Int) (*cf.ZSet, error) {
+	arr, err := ReadZZarrayIn(r, p)
 	if err != nil {
 		return nil, errors.WithStack(err)
 	}
@@ -260,27 +271,21 @@ func WriteZSet(w io.Writer, zset *cf.ZSet) error {
 }
 
 func ReadZp(r io.Reader, zp *cf.Zp) error {
-	buf := make([]byte, SksZpNbytes)
+	return ReadZpIn(r, cf.P_SKS, zp)
+}
+
+// ReadZpIn reads an element of the finite field p.
+func ReadZpIn(r io.Reader, p *big.Int, zp *cf.Zp) error {
+	buf := make([]byte, cf.WireLen(p))
 	_, err := io.ReadFull(r, buf)
 	if err != nil {
 		return errors.WithStack(err)
 	}
-	zp.In(cf.P_SKS).SetBytes(buf)
-	zp.Norm()
-	return nil
+	return errors.WithStack(zp.In(p).SetWireBytes(buf))
 }
 
 func WriteZp(w io.Writer, z *cf.Zp) error {
-	var err error
-	num := z.Bytes()
-	_, err = w.Write(num)
-	if err != nil {
-		return errors.WithStack(err)
-	}
-	if len(num) < SksZpNbytes {
-		pad := make([]byte, SksZpNbytes-len(num))
-		_, err = w.Write(pad)
-	}
+	_, err := w.Write(z.WireBytes())
 	return errors.WithStack(err)
 }
 
@@ -312,7 +317,7 @@ func (msg *ReconRqstPoly) marshal(w io.Writer) error {
 	return errors.WithStack(err)
 }
 
-func (msg *ReconRqstPoly) unmarshal(r io.Reader) error {
+func (msg *ReconRqstPoly) unmarshal(r io.Reader, p *big.Int) error {
 	var err error
 	msg.Prefix, err = ReadBitstring(r)
 	if err != nil {
@@ -322,7 +327,7 @@ func (msg *ReconRqstPoly) unmarshal(r io.Reader) error {
 	if err != nil {
 		return errors.WithStack(err)
 	}
-	msg.Samples, err = ReadZZarray(r)
+	msg.Samples, err = ReadZZarrayIn(r, p)
 	return errors.WithStack(err)
 }
 
@@ -349,13 +354,13 @@ func (msg *ReconRqstFull) marshal(w io.Writer) error {
 	return errors.WithStack(err)
 }
 
-func (msg *ReconRqstFull) unmarshal(r io.Reader) error {
+func (msg *ReconRqstFull) unmarshal(r io.Reader, p *big.Int) error {
 	var err error
 	msg.Prefix, err = ReadBitstring(r)
 	if err != nil {
 		return errors.WithStack(err)
 	}
-	msg.Elements, err = ReadZSet(r)
+	msg.Elements, err = ReadZSetIn(r, p)
 	return errors.WithStack(err)
 }
 
@@ -376,9 +381,9 @@ func (msg *Elements) marshal(w io.Writer) error {
 	return errors.WithStack(err)
 }
 
-func (msg *Elements) unmarshal(r io.Reader) error {
+func (msg *Elements) unmarshal(r io.Reader, p *big.Int) error {
 	var err error
-	msg.ZSet, err = ReadZSet(r)
+	msg.ZSet, err = ReadZSetIn(r, p)
 	return errors.WithStack(err)
 }
 
@@ -399,9 +404,9 @@ func (msg *FullElements) marshal(w io.Writer) error {
 	return errors.WithStack(err)
 }
 
-func (msg *FullElements) unmarshal(r io.Reader) error {
+func (msg *FullElements) unmarshal(r io.Reader, p *big.Int) error {
 	var err error
-	msg.ZSet, err = ReadZSet(r)
+	msg.ZSet, err = ReadZSetIn(r, p)
 	return errors.WithStack(err)
 }
 
@@ -480,6 +485,13 @@ func (msg *DbRepl) MsgType() MsgType {
 var RemoteConfigPassed string = "passed"
 var RemoteConfigFailed string = "failed"
 
+// configField is the Config.Custom key declaring a field other than P_SKS.
+const configField = "field"
+
+// configThreshMult is the Config.Custom key declaring a threshMult other
+// than the default.
+const configThreshMult = "threshmult"
+
 type Config struct {
 	Version    string
 	HTTPPort   int
@@ -487,6 +499,10 @@ type Config struct {
 	MBar       int
 	Filters    string
 	Custom     map[string]string
+
+	// legacyInts is set when integer values were received in a legacy
+	// encoding, rather than as 4-byte integers.
+	legacyInts bool
 }
 
 func (msg *Config) String() string {
@@ -494,6 +510,50 @@ func (msg *Config) String() string {
 		msg.Version, msg.HTTPPort, msg.BitQuantum, msg.MBar, msg.Filters)
 }
 
+// filtersMatch returns whether two comma-separated filter declarations name
+// the same set of filters, regardless of order.
+func filtersMatch(a, b string) bool {
+	return normalizeFilters(a) == normalizeFilters(b)
+}
+
+func normalizeFilters(filters string) string {
+	set := map[string]bool{}
+	for _, f := range strings.Split(filters, ",") {
+		f = strings.TrimSpace(f)
+		if f != "" {
+			set[f] = true
+		}
+	}
+	var result []string
+	for f := range set {
+		result = append(result, f)
+	}
+	sort.Strings(result)
+	return strings.Join(result, ",")
+}
+
+// field returns the field declared by the peer, or P_SKS if none.
+func (msg *Config) field() string {
+	if field, ok := msg.Custom[configField]; ok {
+		return field
+	}
+	return cf.P_SKS.String()
+}
+
+// threshMult returns the threshMult declared by the peer, the default if
+// none, or zero if the declaration is invalid.
+func (msg *Config) threshMult() int {
+	v, ok := msg.Custom[configThreshMult]
+	if !ok {
+		return DefaultThreshMult
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return 0
+	}
+	return n
+}
+
 func (msg *Config) MsgType() MsgType {
 	return MsgTypeConfig
 }
@@ -554,7 +614,7 @@ func (msg *Config) marshal(w io.Writer) error {
 	return nil
 }
 
-func (msg *Config) unmarshal(r io.Reader) error {
+func (msg *Config) unmarshal(r io.Reader, p *big.Int) error {
 	n, err := ReadLen(r)
 	if err != nil {
 		return errors.WithStack(err)
@@ -577,7 +637,17 @@ func (msg *Config) unmarshal(r io.Reader) error {
 			if ival, err = ReadLen(r); err != nil {
 				return errors.WithStack(err)
 			} else if ival != 4 {
-				return errors.Errorf("Invalid length=%d for integer config value %s", ival, k)
+				// Some peers send integers as decimal strings. Whether
+				// this is acceptable depends on the peer.
+				buf := make([]byte, ival)
+				if _, err = io.ReadFull(r, buf); err != nil {
+					return errors.WithStack(err)
+				}
+				if ival, err = strconv.Atoi(strings.TrimSpace(string(buf))); err != nil {
+					return errors.Errorf("Invalid encoding %q for integer config value %s", buf, k)
+				}
+				msg.legacyInts = true
+				break
 			}
 			// Read the int
 			if ival, err = ReadInt(r); err != nil {
@@ -608,6 +678,11 @@ func (msg *Config) unmarshal(r io.Reader) error {
 }
 
 func ReadMsg(r io.Reader) (ReconMsg, error) {
+	return ReadMsgIn(r, cf.P_SKS)
+}
+
+// ReadMsgIn reads a message in which elements are of the finite field p.
+func ReadMsgIn(r io.Reader, p *big.Int) (ReconMsg, error) {
 	msgSize, err := ReadLen(r)
 	if err != nil {
 		return nil, errors.WithStack(err)
@@ -651,7 +726,7 @@ func ReadMsg(r io.Reader) (ReconMsg, error) {
 	default:
 		return nil, errors.Errorf("unexpected message code: %d", msgType)
 	}
-	err = msg.unmarshal(br)
+	err = msg.unmarshal(br, p)
 	return msg, errors.WithStack(err)
 }
 
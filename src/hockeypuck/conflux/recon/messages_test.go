@@ -23,8 +23,11 @@ package recon
 
 import (
 	"bytes"
+	"encoding/hex"
 
 	gc "gopkg.in/check.v1"
+
+	cf "hockeypuck/conflux"
 )
 
 type MessagesSuite struct{}
@@ -42,7 +45,7 @@ func (s *MessagesSuite) TestConfigRoundTrip(c *gc.C) {
 	c.Assert(err, gc.IsNil)
 	c.Logf("config=%x", &buf)
 	conf2 := &Config{}
-	err = conf2.unmarshal(bytes.NewBuffer(buf.Bytes()))
+	err = conf2.unmarshal(bytes.NewBuffer(buf.Bytes()), cf.P_SKS)
 	c.Assert(err, gc.IsNil)
 	c.Assert(conf.Version, gc.Equals, conf2.Version)
 	c.Assert(conf.HTTPPort, gc.Equals, conf2.HTTPPort)
@@ -67,3 +70,85 @@ func (s *MessagesSuite) TestConfigMsgRoundTrip(c *gc.C) {
 	c.Assert(conf.BitQuantum, gc.Equals, conf2.BitQuantum)
 	c.Assert(conf.MBar, gc.Equals, conf2.MBar)
 }
+
+func (s *MessagesSuite) TestFiltersMatch(c *gc.C) {
+	c.Assert(filtersMatch("", ""), gc.Equals, true)
+	c.Assert(filtersMatch("yminsky.dedup,yminsky.merge", "yminsky.merge,yminsky.dedup"), gc.Equals, true)
+	c.Assert(filtersMatch("yminsky.dedup, yminsky.merge", "yminsky.merge,yminsky.dedup,"), gc.Equals, true)
+	c.Assert(filtersMatch("yminsky.dedup,yminsky.merge", "yminsky.dedup"), gc.Equals, false)
+	c.Assert(filtersMatch("yminsky.dedup", ""), gc.Equals, false)
+}
+
+func (s *MessagesSuite) TestConfigLegacyInts(c *gc.C) {
+	var buf bytes.Buffer
+	c.Assert(WriteInt(&buf, 2), gc.IsNil)
+	c.Assert(WriteString(&buf, "http port"), gc.IsNil)
+	c.Assert(WriteString(&buf, "11371"), gc.IsNil)
+	c.Assert(WriteString(&buf, "mbar"), gc.IsNil)
+	c.Assert(WriteInt(&buf, 4), gc.IsNil)
+	c.Assert(WriteInt(&buf, 5), gc.IsNil)
+
+	conf := &Config{}
+	err := conf.unmarshal(&buf, cf.P_SKS)
+	c.Assert(err, gc.IsNil)
+	c.Assert(conf.HTTPPort, gc.Equals, 11371)
+	c.Assert(conf.MBar, gc.Equals, 5)
+	c.Assert(conf.legacyInts, gc.Equals, true)
+}
+
+func (s *MessagesSuite) TestZZarrayWire(c *gc.C) {
+	// A count followed by fixed-width little-endian elements, as sent by
+	// SKS in ReconRqstPoly samples and Elements messages.
+	wire := "00000002" +
+		"da84f40d830a7be2a3c0b7f2e146bfaa00" +
+		"1a43a530d9851fc9df1f8b87e4101d8f01"
+	arr := []cf.Zp{
+		*cf.Zs(cf.P_SKS, "226961925653542187316360787891122898138"),
+		*cf.Zi(cf.P_SKS, -1),
+	}
+	var buf bytes.Buffer
+	c.Assert(WriteZZarray(&buf, arr), gc.IsNil)
+	c.Assert(hex.EncodeToString(buf.Bytes()), gc.Equals, wire)
+
+	arr2, err := ReadZZarray(&buf)
+	c.Assert(err, gc.IsNil)
+	c.Assert(arr2, gc.HasLen, 2)
+	for i := range arr {
+		c.Assert(arr2[i].Cmp(&arr[i]), gc.Equals, 0)
+	}
+
+	// Truncated elements are an error.
+	truncated, err := hex.DecodeString(wire[:len(wire)-2])
+	c.Assert(err, gc.IsNil)
+	_, err = ReadZZarray(bytes.NewReader(truncated))
+	c.Assert(err, gc.NotNil)
+}
+
+func (s *MessagesSuite) TestElementsWire(c *gc.C) {
+	// Set elements are written in ascending order, whatever the order in
+	// which they were added.
+	wire := "00000027" + "02" + "00000002" +
+		"0100010000000000000000000000000000" +
+		"1a43a530d9851fc9df1f8b87e4101d8f01"
+	for i := 0; i < 10; i++ {
+		zs := cf.NewZSet(cf.Zi(cf.P_SKS, -1), cf.Zi(cf.P_SKS, 65537))
+		buf := bytes.NewBuffer(nil)
+		c.Assert(WriteMsg(buf, &Elements{ZSet: zs}), gc.IsNil)
+		c.Assert(hex.EncodeToString(buf.Bytes()), gc.Equals, wire)
+	}
+}
+
+func (s *MessagesSuite) TestFieldMsgRoundTrip(c *gc.C) {
+	zs := cf.NewZSet(cf.Zi(cf.P_256, 65537), cf.Zi(cf.P_256, -1))
+	buf := bytes.NewBuffer(nil)
+	err := WriteMsg(buf, &Elements{ZSet: zs})
+	c.Assert(err, gc.IsNil)
+	// A count and two elements of 33 bytes, after the length and type.
+	c.Assert(buf.Len(), gc.Equals, 4+1+4+2*33)
+
+	msg, err := ReadMsgIn(bytes.NewBuffer(buf.Bytes()), cf.P_256)
+	c.Assert(err, gc.IsNil)
+	elements := msg.(*Elements)
+	c.Assert(elements.Len(), gc.Equals, 2)
+	c.Assert(elements.Contains(cf.Zi(cf.P_256, -1)), gc.Equals, true)
+}
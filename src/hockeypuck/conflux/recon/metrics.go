@@ -2,6 +2,7 @@ package recon
 
 import (
 	"net"
+	"strconv"
 	"sync"
 	"time"
 
@@ -15,10 +16,17 @@ const (
 
 var reconMetrics = struct {
 	itemsRecovered      *prometheus.CounterVec
+	ptreeElements       prometheus.Gauge
+	ptreeNodes          prometheus.Gauge
+	ptreeLeaves         prometheus.Gauge
+	ptreeDepthNodes     *prometheus.GaugeVec
+	ptreeMaxLeaf        prometheus.Gauge
 	reconBusyPeer       *prometheus.CounterVec
 	reconDuration       *prometheus.HistogramVec
 	reconEventTimestamp *prometheus.GaugeVec
 	reconFailure        *prometheus.CounterVec
+	reconMemoryExceeded *prometheus.CounterVec
+	reconSetDifference  *prometheus.HistogramVec
 	reconSuccess        *prometheus.CounterVec
 }{
 	itemsRecovered: prometheus.NewCounterVec(
@@ -29,6 +37,42 @@ var reconMetrics = struct {
 		},
 		[]string{"peer"},
 	),
+	ptreeElements: prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: "conflux",
+			Name:      "ptree_elements",
+			Help:      "Number of elements in the prefix tree",
+		},
+	),
+	ptreeNodes: prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: "conflux",
+			Name:      "ptree_nodes",
+			Help:      "Number of nodes in the prefix tree, as of the last count",
+		},
+	),
+	ptreeLeaves: prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: "conflux",
+			Name:      "ptree_leaves",
+			Help:      "Number of leaf nodes in the prefix tree, as of the last count",
+		},
+	),
+	ptreeDepthNodes: prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "conflux",
+			Name:      "ptree_depth_nodes",
+			Help:      "Number of nodes at each depth of the prefix tree, as of the last count",
+		},
+		[]string{"depth"},
+	),
+	ptreeMaxLeaf: prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: "conflux",
+			Name:      "ptree_max_leaf_elements",
+			Help:      "Number of elements in the fullest leaf of the prefix tree, as of the last count",
+		},
+	),
 	reconBusyPeer: prometheus.NewCounterVec(
 		prometheus.CounterOpts{
 			Namespace: "conflux",
@@ -62,6 +106,23 @@ var reconMetrics = struct {
 		},
 		[]string{"peer"},
 	),
+	reconMemoryExceeded: prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "conflux",
+			Name:      "reconciliation_memory_exceeded",
+			Help:      "Count of reconciliations ended for exceeding the session memory limit since startup",
+		},
+		[]string{"peer"},
+	),
+	reconSetDifference: prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: "conflux",
+			Name:      "reconciliation_set_difference",
+			Help:      "Number of items missing locally found by a reconciliation",
+			Buckets:   prometheus.ExponentialBuckets(1, 4, 10), // 1 to 262144
+		},
+		[]string{"peer"},
+	),
 	reconSuccess: prometheus.NewCounterVec(
 		prometheus.CounterOpts{
 			Namespace: "conflux",
@@ -77,10 +138,17 @@ var metricsRegister sync.Once
 func registerMetrics() {
 	metricsRegister.Do(func() {
 		prometheus.MustRegister(reconMetrics.itemsRecovered)
+		prometheus.MustRegister(reconMetrics.ptreeElements)
+		prometheus.MustRegister(reconMetrics.ptreeNodes)
+		prometheus.MustRegister(reconMetrics.ptreeLeaves)
+		prometheus.MustRegister(reconMetrics.ptreeDepthNodes)
+		prometheus.MustRegister(reconMetrics.ptreeMaxLeaf)
 		prometheus.MustRegister(reconMetrics.reconBusyPeer)
 		prometheus.MustRegister(reconMetrics.reconDuration)
 		prometheus.MustRegister(reconMetrics.reconEventTimestamp)
 		prometheus.MustRegister(reconMetrics.reconFailure)
+		prometheus.MustRegister(reconMetrics.reconMemoryExceeded)
+		prometheus.MustRegister(reconMetrics.reconSetDifference)
 		prometheus.MustRegister(reconMetrics.reconSuccess)
 	})
 }
@@ -96,6 +164,22 @@ func recordItemsRecovered(peer net.Addr, items int) {
 	reconMetrics.itemsRecovered.WithLabelValues(hostFromPeer(peer)).Add(float64(items))
 }
 
+func recordPTreeElements(elements int) {
+	reconMetrics.ptreeElements.Set(float64(elements))
+}
+
+func recordPTreeStats(stats *PTreeStats) {
+	reconMetrics.ptreeNodes.Set(float64(stats.Nodes))
+	reconMetrics.ptreeLeaves.Set(float64(stats.Leaves))
+	reconMetrics.ptreeMaxLeaf.Set(float64(stats.MaxLeafElements))
+	// Depths the tree no longer reaches are reset, rather than left at
+	// their last count.
+	reconMetrics.ptreeDepthNodes.Reset()
+	for depth, n := range stats.Depths {
+		reconMetrics.ptreeDepthNodes.WithLabelValues(strconv.Itoa(depth)).Set(float64(n))
+	}
+}
+
 func recordReconBusyPeer(peer net.Addr, role string) {
 	reconMetrics.reconBusyPeer.WithLabelValues(hostFromPeer(peer)).Inc()
 	reconMetrics.reconEventTimestamp.WithLabelValues(hostFromPeer(peer), "busy", role).Set(float64(time.Now().Unix()))
@@ -111,6 +195,15 @@ func recordReconInitiate(peer net.Addr, role string) {
 	reconMetrics.reconEventTimestamp.WithLabelValues(hostFromPeer(peer), "initiate", role).Set(float64(time.Now().Unix()))
 }
 
+func recordReconMemoryExceeded(peer net.Addr, role string) {
+	reconMetrics.reconEventTimestamp.WithLabelValues(hostFromPeer(peer), "memory_exceeded", role).Set(float64(time.Now().Unix()))
+	reconMetrics.reconMemoryExceeded.WithLabelValues(hostFromPeer(peer)).Inc()
+}
+
+func recordReconSetDifference(peer net.Addr, items int) {
+	reconMetrics.reconSetDifference.WithLabelValues(hostFromPeer(peer)).Observe(float64(items))
+}
+
 func recordReconSuccess(peer net.Addr, duration time.Duration, role string) {
 	reconMetrics.reconDuration.WithLabelValues(hostFromPeer(peer), "success").Observe(duration.Seconds())
 	reconMetrics.reconEventTimestamp.WithLabelValues(hostFromPeer(peer), "success", role).Set(float64(time.Now().Unix()))
@@ -23,6 +23,7 @@ package recon
 
 import (
 	"bufio"
+	"context"
 	"fmt"
 	"net"
 	"strings"
@@ -31,11 +32,17 @@ import (
 
 	"github.com/pkg/errors"
 	"gopkg.in/tomb.v2"
+	"hockeypuck/clock"
+	"hockeypuck/logging"
 	log "hockeypuck/logrus"
+	"hockeypuck/proxyproto"
+	"hockeypuck/tracing"
 
 	cf "hockeypuck/conflux"
 )
 
+var logger = logging.Module("recon")
+
 const SERVE = "serve"
 
 var ErrNodeNotFound error = fmt.Errorf("prefix-tree node not found")
@@ -47,6 +54,10 @@ type Recover struct {
 	RemoteConfig   *Config
 	RemoteElements []cf.Zp
 	Done           chan struct{}
+
+	// Context carries the trace of the recon round which found the
+	// elements, so that their recovery may be traced within it.
+	Context context.Context
 }
 
 func (r *Recover) String() string {
@@ -57,7 +68,10 @@ func (r *Recover) HkpAddr() (string, error) {
 	// Use remote HKP host:port as peer-unique identifier
 	host, _, err := net.SplitHostPort(r.RemoteAddr.String())
 	if err != nil {
-		log.Errorf("cannot parse HKP remote address from %q: %v", r.RemoteAddr, err)
+		logger.WithFields(log.Fields{
+			"remoteAddr": r.RemoteAddr,
+			"error":      err,
+		}).Error("cannot parse HKP remote address")
 		return "", errors.WithStack(err)
 	}
 	if strings.Contains(host, ":") {
@@ -80,6 +94,11 @@ type Peer struct {
 	settings *Settings
 	ptree    PrefixTree
 
+	// muSettings guards the partner settings and matcher, which may be
+	// replaced while the peer is running.
+	muSettings sync.RWMutex
+	matcher    IPMatcher
+
 	RecoverChan RecoverChan
 
 	muDie sync.Mutex
@@ -90,13 +109,49 @@ type Peer struct {
 	once     *sync.Once
 	full     bool
 	mutating bool
+	paused   bool
 	readers  int
 
+	// refusedSince is when sessions were first refused, other than while
+	// paused, since one was last allowed. gossiped is when gossip was last
+	// attempted. Both are guarded by mu.
+	refusedSince time.Time
+	gossiped     time.Time
+
 	muElements     sync.Mutex
 	insertElements []cf.Zp
 	removeElements []cf.Zp
 
 	mutatedFunc func()
+
+	clock clock.Clock
+
+	// authID identifies this peer in authentication proofs.
+	authID string
+
+	// nodesCounted is when the prefix tree nodes were last counted. It is
+	// only accessed by the gossip goroutine.
+	nodesCounted time.Time
+
+	// muStats guards the statistics collected by the last node count.
+	muStats    sync.Mutex
+	ptreeStats *PTreeStats
+
+	// muSplit guards where the next session served to each partner starts,
+	// for partners whose sessions have exceeded their memory limit.
+	muSplit sync.Mutex
+	splits  map[string]*sessionSplit
+
+	// muNames guards the partner names found by address for logging, which
+	// are forgotten when the partners are replaced.
+	muNames      sync.Mutex
+	partnerNames map[string]string
+
+	// muStatus guards the status of recon sessions with each partner, by
+	// name.
+	muStatus        sync.Mutex
+	partnerStatuses map[string]*PartnerStatus
+	partnerAudits   map[string]*AuditReport
 }
 
 func NewPeer(settings *Settings, tree PrefixTree) *Peer {
@@ -105,6 +160,8 @@ func NewPeer(settings *Settings, tree PrefixTree) *Peer {
 		settings:    settings,
 		once:        &sync.Once{},
 		ptree:       tree,
+		clock:       clock.Real(),
+		authID:      newAuthID(),
 	}
 	p.cond = sync.NewCond(&p.mu)
 
@@ -130,14 +187,54 @@ func (p *Peer) logConn(label string, conn net.Conn) *log.Entry {
 
 func (p *Peer) logFields(label string, fields log.Fields) *log.Entry {
 	fields["label"] = fmt.Sprintf("%s %s", label, p.settings.ReconAddr)
-	return log.WithFields(fields)
+	return logger.WithFields(fields)
 }
 
 func (p *Peer) logConnFields(label string, conn net.Conn, fields log.Fields) *log.Entry {
 	fields["remoteAddr"] = conn.RemoteAddr()
+	if name := p.PartnerName(conn.RemoteAddr()); name != "" {
+		fields["partner"] = name
+	}
 	return p.logFields(label, fields)
 }
 
+// maxPartnerNames limits the addresses whose partner names are remembered,
+// as addresses allowed by CIDR need not be partners.
+const maxPartnerNames = 1024
+
+// PartnerName returns the name under which the partner at addr is
+// configured, or "" if it is not a partner. Names are remembered, as
+// matching addresses to partners may resolve their hostnames.
+func (p *Peer) PartnerName(addr net.Addr) string {
+	key := addr.String()
+	if tcpAddr, ok := addr.(*net.TCPAddr); ok {
+		key = tcpAddr.IP.String()
+	}
+	p.muNames.Lock()
+	name, ok := p.partnerNames[key]
+	p.muNames.Unlock()
+	if ok {
+		return name
+	}
+
+	p.muSettings.RLock()
+	for partnerName, partner := range p.settings.Partners {
+		if partner.matches(addr) {
+			name = partnerName
+			break
+		}
+	}
+	p.muSettings.RUnlock()
+
+	p.muNames.Lock()
+	if p.partnerNames == nil || len(p.partnerNames) >= maxPartnerNames {
+		p.partnerNames = map[string]string{}
+	}
+	p.partnerNames[key] = name
+	p.muNames.Unlock()
+	return name
+}
+
 func (p *Peer) logErr(label string, err error) *log.Entry {
 	return p.logFields(label, log.Fields{"error": fmt.Sprintf("%+v", err)})
 }
@@ -159,6 +256,13 @@ func (p *Peer) StartMode(mode PeerMode) {
 }
 
 func (p *Peer) Start() {
+	if !p.settings.IsDefaultShape() {
+		p.log(GOSSIP).WithFields(log.Fields{
+			"bitQuantum": p.settings.BitQuantum,
+			"mBar":       p.settings.MBar,
+			"threshMult": p.settings.ThreshMult,
+		}).Warning("prefix tree shape differs from SKS, only partners configured alike can reconcile")
+	}
 	p.t.Go(p.Serve)
 	p.t.Go(p.Gossip)
 }
@@ -188,6 +292,12 @@ func (p *Peer) Remove(zs ...cf.Zp) {
 	p.removeElements = append(p.removeElements, zs...)
 }
 
+// SetClock sets the clock used to schedule gossip. It must be called before
+// the peer is started.
+func (p *Peer) SetClock(c clock.Clock) {
+	p.clock = c
+}
+
 func (p *Peer) SetMutatedFunc(f func()) {
 	p.muElements.Lock()
 	defer p.muElements.Unlock()
@@ -198,10 +308,19 @@ func (p *Peer) readAcquire() bool {
 	p.mu.Lock()
 	defer p.mu.Unlock()
 
-	// Mutating or outbound recovery channel is full.
+	// Paused, mutating or outbound recovery channel is full. Time spent
+	// paused, however long, is not a stall.
+	if p.paused {
+		p.refusedSince = time.Time{}
+		return false
+	}
 	if p.mutating || p.full {
+		if p.refusedSince.IsZero() {
+			p.refusedSince = p.clock.Now()
+		}
 		return false
 	}
+	p.refusedSince = time.Time{}
 
 	p.readers++
 	p.once.Do(p.mutate)
@@ -218,7 +337,61 @@ func (p *Peer) readRelease() {
 		panic("negative readers")
 	}
 
-	p.cond.Signal()
+	p.cond.Broadcast()
+}
+
+// Pause stops new recon sessions, both gossip with partners and sessions
+// they initiate, and waits for those in progress to finish. Elements
+// inserted or removed meanwhile are applied to the prefix tree once sessions
+// resume.
+func (p *Peer) Pause() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.paused = true
+	for p.readers != 0 {
+		p.cond.Wait()
+	}
+}
+
+// Resume allows recon sessions after Pause.
+func (p *Peer) Resume() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.paused = false
+}
+
+// Paused returns whether recon is paused.
+func (p *Peer) Paused() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.paused
+}
+
+// markGossip records that gossip was attempted.
+func (p *Peer) markGossip() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.gossiped = p.clock.Now()
+}
+
+// CheckProgress returns an error if recon has made no progress for longer
+// than limit: if sessions have been refused that long, other than while
+// paused, as when a mutation waits on a session which never finishes, or if
+// gossip has not been attempted that long.
+func (p *Peer) CheckProgress(limit time.Duration) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := p.clock.Now()
+	if p.paused {
+		p.refusedSince = time.Time{}
+	}
+	if !p.refusedSince.IsZero() && now.Sub(p.refusedSince) > limit {
+		return errors.Errorf("recon sessions refused for %s", now.Sub(p.refusedSince).Round(time.Second))
+	}
+	if !p.gossiped.IsZero() && now.Sub(p.gossiped) > limit {
+		return errors.Errorf("no gossip attempted for %s", now.Sub(p.gossiped).Round(time.Second))
+	}
+	return nil
 }
 
 func (p *Peer) isDying() bool {
@@ -260,11 +433,27 @@ func (p *Peer) mutate() {
 func (p *Peer) flush() {
 	p.muElements.Lock()
 
+	// The changes are written in one batch where the prefix tree can, so
+	// that they are synced to disk once rather than one by one.
+	batcher, batching := p.ptree.(Batcher)
+	batching = batching && len(p.insertElements)+len(p.removeElements) > 0
+	if batching {
+		err := batcher.Begin()
+		if err != nil {
+			p.logErr("mutate", err).Warning("cannot begin prefix tree batch")
+			batching = false
+		}
+	}
+
 	for i := range p.insertElements {
 		z := &p.insertElements[i]
 		err := p.ptree.Insert(z)
 		if err != nil {
-			log.Warningf("cannot insert %q (%s) into prefix tree: %v", z, z.FullKeyHash(), err)
+			p.logFields("mutate", log.Fields{
+				"element": z,
+				"hash":    z.FullKeyHash(),
+				"error":   err,
+			}).Warning("cannot insert into prefix tree")
 		}
 	}
 	if len(p.insertElements) > 0 {
@@ -275,41 +464,197 @@ func (p *Peer) flush() {
 		z := &p.removeElements[i]
 		err := p.ptree.Remove(z)
 		if err != nil {
-			log.Warningf("cannot remove %q (%s) from prefix tree: %v", z, z.FullKeyHash(), err)
+			p.logFields("mutate", log.Fields{
+				"element": z,
+				"hash":    z.FullKeyHash(),
+				"error":   err,
+			}).Warning("cannot remove from prefix tree")
 		}
 	}
 	if len(p.removeElements) > 0 {
 		p.logFields("mutate", log.Fields{"elements": len(p.removeElements)}).Debugf("removed")
 	}
 
+	if batching {
+		err := batcher.Commit()
+		if err != nil {
+			p.logErr("mutate", err).Error("cannot commit prefix tree batch")
+		}
+	}
+
 	p.insertElements = nil
 	p.removeElements = nil
+	if root, err := p.ptree.Root(); err == nil {
+		recordPTreeElements(root.Size())
+	}
 	if p.mutatedFunc != nil {
 		p.mutatedFunc()
 	}
 	p.muElements.Unlock()
 }
 
-func (p *Peer) Serve() error {
-	addr, err := p.settings.ReconNet.Resolve(p.settings.ReconAddr)
+// nodeCountInterval is the minimum time between prefix tree node counts,
+// which visit every node in the tree.
+const nodeCountInterval = 10 * time.Minute
+
+// countNodes updates the prefix tree statistics and size metrics, if they
+// have not been updated within nodeCountInterval. The caller must hold a
+// read lock on the prefix tree.
+func (p *Peer) countNodes() {
+	now := p.clock.Now()
+	if now.Sub(p.nodesCounted) < nodeCountInterval {
+		return
+	}
+	p.nodesCounted = now
+	stats, err := p.ptree.Stats()
+	if err != nil {
+		p.logErr(GOSSIP, err).Warning("cannot count prefix tree nodes")
+		return
+	}
+	stats.Counted = now
+	if stats.LeafElements != stats.Elements {
+		p.logFields(GOSSIP, log.Fields{
+			"elements":     stats.Elements,
+			"leafElements": stats.LeafElements,
+		}).Warning("prefix tree leaves do not hold as many elements as the root")
+	}
+	p.muStats.Lock()
+	p.ptreeStats = stats
+	p.muStats.Unlock()
+	recordPTreeElements(stats.Elements)
+	recordPTreeStats(stats)
+}
+
+// PTreeStats returns the prefix tree statistics collected by the last node
+// count, or nil if the nodes have not yet been counted.
+func (p *Peer) PTreeStats() *PTreeStats {
+	p.muStats.Lock()
+	defer p.muStats.Unlock()
+	if p.ptreeStats == nil {
+		return nil
+	}
+	stats := *p.ptreeStats
+	stats.Depths = append([]int(nil), p.ptreeStats.Depths...)
+	return &stats
+}
+
+// SetPartners replaces the recon partners and allowed CIDRs of a running
+// peer. Subsequent gossip and inbound connections use the new settings;
+// reconciliations already in progress are not interrupted.
+func (p *Peer) SetPartners(partners PartnerMap, allowCIDRs []string) error {
+	update := &Settings{Partners: partners, AllowCIDRs: allowCIDRs}
+	matcher, err := update.Matcher()
 	if err != nil {
 		return errors.WithStack(err)
 	}
-	matcher, err := p.settings.Matcher()
+
+	p.muSettings.Lock()
+	defer p.muSettings.Unlock()
+	p.settings.Partners = partners
+	p.settings.AllowCIDRs = allowCIDRs
+	p.matcher = matcher
+
+	p.muNames.Lock()
+	p.partnerNames = nil
+	p.muNames.Unlock()
+	return nil
+}
+
+// acceptsFrom returns whether incoming recon is accepted from addr. It is
+// refused if addr is that of a pull-only partner, unless another partner at
+// the same address accepts it.
+func (p *Peer) acceptsFrom(addr net.Addr) bool {
+	p.muSettings.RLock()
+	defer p.muSettings.RUnlock()
+	var refused bool
+	for _, partner := range p.settings.Partners {
+		if !partner.matches(addr) {
+			continue
+		}
+		if partner.accepts() {
+			return true
+		}
+		refused = true
+	}
+	return !refused
+}
+
+// Partners returns a copy of the currently configured recon partners.
+func (p *Peer) Partners() PartnerMap {
+	p.muSettings.RLock()
+	defer p.muSettings.RUnlock()
+	result := make(PartnerMap, len(p.settings.Partners))
+	for k, v := range p.settings.Partners {
+		result[k] = v
+	}
+	return result
+}
+
+func (p *Peer) currentMatcher() IPMatcher {
+	p.muSettings.RLock()
+	defer p.muSettings.RUnlock()
+	return p.matcher
+}
+
+// Serve accepts recon sessions on ReconAddr and any ListenAddrs until the
+// peer is stopped.
+func (p *Peer) Serve() error {
+	var err error
+	p.muSettings.Lock()
+	p.matcher, err = p.settings.Matcher()
+	p.muSettings.Unlock()
 	if err != nil {
-		log.Errorf("cannot create matcher: %v", err)
+		p.logErr(SERVE, err).Error("cannot create matcher")
 		return errors.WithStack(err)
 	}
 
-	ln, err := net.Listen(addr.Network(), addr.String())
+	trusted, err := proxyproto.ParseTrusted(p.settings.ProxyProtocol)
 	if err != nil {
 		return errors.WithStack(err)
 	}
+
+	var tlsID *tlsIdentity
+	if p.settings.TLS != nil {
+		tlsID, err = p.settings.TLS.load()
+		if err != nil {
+			return errors.WithStack(err)
+		}
+	}
+
+	var lns []net.Listener
+	for _, listenAddr := range append([]string{p.settings.ReconAddr}, p.settings.ListenAddrs...) {
+		addr, err := p.settings.ReconNet.Resolve(listenAddr)
+		if err == nil {
+			var ln net.Listener
+			ln, err = net.Listen(addr.Network(), addr.String())
+			if err == nil {
+				lns = append(lns, ln)
+				continue
+			}
+		}
+		for _, ln := range lns {
+			ln.Close()
+		}
+		return errors.WithStack(err)
+	}
 	p.t.Go(func() error {
 		<-p.t.Dying()
-		return ln.Close()
+		for _, ln := range lns {
+			ln.Close()
+		}
+		return nil
 	})
+	for _, ln := range lns[1:] {
+		ln := ln
+		p.t.Go(func() error {
+			return p.serveListener(ln, trusted, tlsID)
+		})
+	}
+	return p.serveListener(lns[0], trusted, tlsID)
+}
 
+// serveListener accepts recon sessions on ln.
+func (p *Peer) serveListener(ln net.Listener, trusted *proxyproto.Trusted, tlsID *tlsIdentity) error {
 	for {
 		conn, err := ln.Accept()
 		if err != nil {
@@ -319,14 +664,8 @@ func (p *Peer) Serve() error {
 		if tcConn, ok := conn.(*net.TCPConn); ok {
 			tcConn.SetKeepAlive(true)
 			tcConn.SetKeepAlivePeriod(3 * time.Minute)
-
-			remoteAddr := tcConn.RemoteAddr().(*net.TCPAddr)
-			if !matcher.Match(remoteAddr.IP) {
-				log.Warningf("connection rejected from %q", remoteAddr)
-				conn.Close()
-				continue
-			}
 		}
+		conn = trusted.Conn(conn)
 
 		p.muDie.Lock()
 		if p.isDying() {
@@ -334,14 +673,38 @@ func (p *Peer) Serve() error {
 			return nil
 		}
 		p.t.Go(func() error {
-			err = p.Accept(conn)
+			// The partner address may come from a PROXY protocol header,
+			// which is read here rather than holding up the accept loop.
+			if remoteAddr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+				if !p.currentMatcher().Match(remoteAddr.IP) {
+					p.logConn(SERVE, conn).Warning("connection rejected")
+					conn.Close()
+					return nil
+				}
+			}
+			if !p.acceptsFrom(conn.RemoteAddr()) {
+				p.logConn(SERVE, conn).Debug("connection rejected from pull-only partner")
+				conn.Close()
+				return nil
+			}
+			if tlsID != nil {
+				authConn, err := p.acceptTLS(conn, tlsID)
+				if err != nil {
+					p.logConnErr(SERVE, conn, err).Warning("connection rejected")
+					conn.Close()
+					return nil
+				}
+				conn = authConn
+			}
 			start := time.Now()
+			err := p.Accept(conn)
+			p.recordPartnerSession(conn.RemoteAddr(), start, err)
 			recordReconInitiate(conn.RemoteAddr(), SERVER)
 			if errors.Is(err, ErrPeerBusy) {
 				p.logConnErr(GOSSIP, conn, err).Debug()
 				recordReconBusyPeer(conn.RemoteAddr(), SERVER)
 			} else if err != nil {
-				p.logErr(SERVE, err).Errorf("recon with %v failed", conn.RemoteAddr())
+				p.logConnErr(SERVE, conn, err).Error("recon failed")
 				recordReconFailure(conn.RemoteAddr(), time.Since(start), SERVER)
 			} else {
 				recordReconSuccess(conn.RemoteAddr(), time.Since(start), SERVER)
@@ -357,7 +720,10 @@ var defaultTimeout = 300 * time.Second
 func (p *Peer) setReadDeadline(conn net.Conn, d time.Duration) {
 	err := conn.SetReadDeadline(time.Now().Add(d))
 	if err != nil {
-		log.Warningf("failed to set read deadline: %v", err)
+		logger.WithFields(log.Fields{
+			"remoteAddr": conn.RemoteAddr(),
+			"error":      err,
+		}).Warning("failed to set read deadline")
 	}
 }
 
@@ -388,7 +754,7 @@ func (p *Peer) remoteConfig(conn net.Conn, role string, config *Config) (*Config
 		<-ch
 		p.logConn(role, conn).Debug("reading remote config")
 		var msg ReconMsg
-		msg, err := ReadMsg(conn)
+		msg, err := ReadMsgIn(conn, p.settings.Field.P())
 		if err != nil {
 			return errors.WithStack(err)
 		}
@@ -409,7 +775,7 @@ func (p *Peer) remoteConfig(conn net.Conn, role string, config *Config) (*Config
 	return remoteConfig, nil
 }
 
-func (p *Peer) ackConfig(conn net.Conn) error {
+func (p *Peer) ackConfig(conn net.Conn, quirks Quirks) error {
 	w := bufio.NewWriter(conn)
 
 	ch := make(chan struct{})
@@ -437,7 +803,9 @@ func (p *Peer) ackConfig(conn net.Conn) error {
 		}
 		if remoteConfigStatus != RemoteConfigPassed {
 			reason, err := ReadString(conn)
-			if err != nil {
+			if err != nil && quirks.OptionalFailReason {
+				return errors.Wrap(ErrRemoteRejectedConfig, "no reason given")
+			} else if err != nil {
 				return errors.Wrapf(ErrRemoteRejectedConfig, "remote rejected config: %v", err)
 			}
 			return errors.Wrap(ErrRemoteRejectedConfig, reason)
@@ -451,7 +819,7 @@ func (p *Peer) ackConfig(conn net.Conn) error {
 func (p *Peer) handleConfig(conn net.Conn, role string, failResp string) (_ *Config, _err error) {
 	p.setReadDeadline(conn, defaultTimeout)
 
-	config, err := p.settings.Config()
+	config, err := p.localConfig(conn.RemoteAddr())
 	if err != nil {
 		return nil, errors.WithStack(err)
 	}
@@ -461,27 +829,86 @@ func (p *Peer) handleConfig(conn net.Conn, role string, failResp string) (_ *Con
 		return nil, errors.WithStack(err)
 	}
 
+	return p.negotiateConfig(conn, role, failResp, config, remoteConfig)
+}
+
+// negotiateConfig checks that the remote config is compatible with ours,
+// then exchanges the result with the remote peer. The remote config is
+// returned if both sides accept.
+func (p *Peer) negotiateConfig(conn net.Conn, role string, failResp string, config, remoteConfig *Config) (*Config, error) {
 	p.logConnFields(role, conn, log.Fields{"remoteConfig": remoteConfig}).Debug()
 
+	quirks := p.partnerQuirks(conn.RemoteAddr())
+	if quirks.ConfigDefaults {
+		if remoteConfig.BitQuantum == 0 {
+			remoteConfig.BitQuantum = DefaultBitQuantum
+		}
+		if remoteConfig.MBar == 0 {
+			remoteConfig.MBar = DefaultMBar
+		}
+	}
+
+	// Both peers authenticate whether or not they accept the config, so
+	// that they agree on what is sent next.
+	authResp, err := p.authenticate(conn, role, config, remoteConfig)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if failResp == "" {
+		failResp = authResp
+	}
+
 	if failResp == "" {
-		if remoteConfig.BitQuantum != config.BitQuantum {
-			failResp = "mismatched bitquantum"
+		if remoteConfig.legacyInts && !quirks.LenientConfigInts {
+			failResp = "invalid config encoding"
+			p.logConn(role, conn).Error("remote config uses legacy integer encoding")
+		} else if remoteConfig.BitQuantum != config.BitQuantum {
+			failResp = fmt.Sprintf("mismatched bitquantum %d, expected %d", remoteConfig.BitQuantum, config.BitQuantum)
 			p.logConnFields(role, conn, log.Fields{
 				"remoteBitquantum": remoteConfig.BitQuantum,
 				"localBitquantum":  config.BitQuantum,
 			}).Error("mismatched BitQuantum values")
+		} else if remoteConfig.field() != config.field() {
+			failResp = "mismatched field"
+			p.logConnFields(role, conn, log.Fields{
+				"remoteField": remoteConfig.field(),
+				"localField":  config.field(),
+			}).Error("mismatched field")
 		} else if remoteConfig.MBar != config.MBar {
-			failResp = "mismatched mbar"
+			failResp = fmt.Sprintf("mismatched mbar %d, expected %d", remoteConfig.MBar, config.MBar)
 			p.logConnFields(role, conn, log.Fields{
 				"remoteMBar": remoteConfig.MBar,
 				"localMBar":  config.MBar,
 			}).Error("mismatched MBar")
+		} else if remoteConfig.threshMult() != config.threshMult() {
+			// Peers whose trees split at different sizes would not
+			// converge.
+			failResp = fmt.Sprintf("mismatched threshmult %d, expected %d", remoteConfig.threshMult(), config.threshMult())
+			p.logConnFields(role, conn, log.Fields{
+				"remoteThreshMult": remoteConfig.threshMult(),
+				"localThreshMult":  config.threshMult(),
+			}).Error("mismatched ThreshMult")
+		} else if !filtersMatch(config.Filters, remoteConfig.Filters) {
+			if remoteConfig.Filters == "" || quirks.IgnoreFilters {
+				// Older Hockeypuck releases do not declare any filters,
+				// though they apply the same ones.
+				p.logConnFields(role, conn, log.Fields{
+					"remoteFilters": remoteConfig.Filters,
+					"localFilters":  config.Filters,
+				}).Warning("ignoring filter mismatch")
+			} else {
+				failResp = "mismatched filters"
+				p.logConnFields(role, conn, log.Fields{
+					"remoteFilters": remoteConfig.Filters,
+					"localFilters":  config.Filters,
+				}).Error("mismatched filters")
+			}
 		}
 	}
 
 	w := bufio.NewWriter(conn)
 	if failResp != "" {
-		err = conn.SetWriteDeadline(time.Now().Add(3 * time.Second))
+		err := conn.SetWriteDeadline(time.Now().Add(3 * time.Second))
 		if err != nil {
 			p.logConnErr(role, conn, err)
 		}
@@ -502,7 +929,7 @@ func (p *Peer) handleConfig(conn net.Conn, role string, failResp string) (_ *Con
 		return nil, errors.Errorf("cannot peer: %v", failResp)
 	}
 
-	err = p.ackConfig(conn)
+	err = p.ackConfig(conn, quirks)
 	if err != nil {
 		return nil, errors.WithStack(err)
 	}
@@ -513,16 +940,21 @@ func (p *Peer) handleConfig(conn net.Conn, role string, failResp string) (_ *Con
 func (p *Peer) Accept(conn net.Conn) (_err error) {
 	defer conn.Close()
 
+	ctx, span := p.startRound(SERVE, conn.RemoteAddr())
 	p.logConn(SERVE, conn).Debug("accepted connection")
 	defer func() {
 		if _err != nil {
 			p.logConnErr(SERVE, conn, _err).Error()
 		}
+		span.SetError(_err)
+		span.End()
 	}()
 
 	var failResp string
 	if p.readAcquire() {
 		defer p.readRelease()
+	} else if p.Paused() {
+		failResp = "sync not available, paused for maintenance"
 	} else {
 		failResp = "sync not available, currently mutating"
 	}
@@ -533,7 +965,18 @@ func (p *Peer) Accept(conn net.Conn) (_err error) {
 	}
 
 	if failResp == "" {
-		return p.interactWithClient(conn, remoteConfig, cf.NewBitstring(0))
+		start, err := p.sessionRoot(conn.RemoteAddr())
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		err = p.interactWithClient(ctx, conn, remoteConfig, start)
+		if errors.Is(err, ErrSessionMemory) {
+			recordReconMemoryExceeded(conn.RemoteAddr(), SERVER)
+			p.sessionDone(conn.RemoteAddr(), true)
+		} else if err == nil {
+			p.sessionDone(conn.RemoteAddr(), false)
+		}
+		return errors.WithStack(err)
 	}
 	return nil
 }
@@ -588,6 +1031,7 @@ type reconWithClient struct {
 	requestQ []*requestEntry
 	bottomQ  []*bottomEntry
 	rcvrSet  *cf.ZSet
+	mem      *sessionMemory
 	flushing bool
 	conn     net.Conn
 	bwr      *bufio.Writer
@@ -684,6 +1128,10 @@ func (rwc *reconWithClient) handleReply(p *Peer, msg ReconMsg, req *requestEntry
 			}
 		}
 	case *Elements:
+		err := rwc.mem.alloc(rwc.mem.elementsSize(m.Len()))
+		if err != nil {
+			return errors.WithStack(err)
+		}
 		rwc.rcvrSet.AddAll(m.ZSet)
 	case *FullElements:
 		elements, err := req.node.Elements()
@@ -693,12 +1141,23 @@ func (rwc *reconWithClient) handleReply(p *Peer, msg ReconMsg, req *requestEntry
 		local := cf.NewZSetSlice(elements)
 		localNeeds := cf.ZSetDiff(m.ZSet, local)
 		remoteNeeds := cf.ZSetDiff(local, m.ZSet)
+		err = rwc.mem.alloc(rwc.mem.elementsSize(localNeeds.Len() + remoteNeeds.Len()))
+		if err != nil {
+			return errors.WithStack(err)
+		}
 		elementsMsg := &Elements{ZSet: remoteNeeds}
 		rwc.Peer.logConnFields(SERVE, rwc.conn, log.Fields{
 			"msg": elementsMsg,
 		}).Debug("handleReply: sending")
 		rwc.messages = append(rwc.messages, elementsMsg)
 		rwc.rcvrSet.AddAll(localNeeds)
+	case *Error:
+		if strings.Contains(m.Text, ErrSessionMemory.Error()) {
+			// The client ran out of memory; the next session with it
+			// starts at a deeper split.
+			return errors.Wrap(ErrSessionMemory, "client")
+		}
+		return errors.Errorf("client error: %s", m.Text)
 	default:
 		return errors.Errorf("unexpected message: %v", m)
 	}
@@ -716,6 +1175,7 @@ func (rwc *reconWithClient) flushQueue() error {
 	if err != nil {
 		return errors.WithStack(err)
 	}
+	rwc.mem.free(rwc.mem.messagesSize(rwc.messages))
 	rwc.messages = nil
 	rwc.pushBottom(&bottomEntry{state: reconStateFlushEnded})
 	rwc.flushing = true
@@ -724,8 +1184,9 @@ func (rwc *reconWithClient) flushQueue() error {
 
 var zeroTime time.Time
 
-func (p *Peer) interactWithClient(conn net.Conn, remoteConfig *Config, bitstring *cf.Bitstring) error {
-	p.logConn(SERVE, conn).Debug("interacting with client")
+// interactWithClient reconciles the subtree at start with a client.
+func (p *Peer) interactWithClient(ctx context.Context, conn net.Conn, remoteConfig *Config, start PrefixNode) error {
+	p.logConnFields(SERVE, conn, log.Fields{"start": start.Key()}).Debug("interacting with client")
 	p.setReadDeadline(conn, defaultTimeout)
 
 	recon := reconWithClient{
@@ -733,20 +1194,18 @@ func (p *Peer) interactWithClient(conn net.Conn, remoteConfig *Config, bitstring
 		conn:    conn,
 		bwr:     bufio.NewWriter(conn),
 		rcvrSet: cf.NewZSet(),
+		mem:     newSessionMemory(p.settings),
 	}
-	root, err := p.ptree.Root()
-	if err != nil {
-		return errors.WithStack(err)
-	}
+	var err error
 
 	defer func() {
-		p.sendItems(recon.rcvrSet.Items(), conn, remoteConfig)
+		p.sendItems(ctx, recon.rcvrSet.Items(), conn, remoteConfig)
 	}()
 	defer func() {
 		WriteMsg(recon.bwr, &Done{})
 	}()
 
-	recon.pushRequest(&requestEntry{node: root, key: bitstring})
+	recon.pushRequest(&requestEntry{node: start, key: start.Key()})
 	for !recon.isDone() {
 		bottom := recon.topBottom()
 		p.logConnFields(SERVE, conn, log.Fields{"bottom": bottom}).Debug("interact")
@@ -773,7 +1232,7 @@ func (p *Peer) interactWithClient(conn net.Conn, remoteConfig *Config, bitstring
 
 			// Set a small read timeout to simulate non-blocking I/O
 			p.setReadDeadline(conn, time.Millisecond)
-			msg, nbErr := ReadMsg(conn)
+			msg, nbErr := ReadMsgIn(conn, p.settings.Field.P())
 			hasMsg = (nbErr == nil)
 
 			// Restore blocking I/O
@@ -795,7 +1254,7 @@ func (p *Peer) interactWithClient(conn net.Conn, remoteConfig *Config, bitstring
 				} else {
 					recon.popBottom()
 					p.setReadDeadline(conn, 3*time.Second)
-					msg, err = ReadMsg(conn)
+					msg, err = ReadMsgIn(conn, p.settings.Field.P())
 					if err != nil {
 						return errors.WithStack(err)
 					}
@@ -819,8 +1278,33 @@ func (p *Peer) interactWithClient(conn net.Conn, remoteConfig *Config, bitstring
 	return nil
 }
 
-func (p *Peer) sendItems(items []cf.Zp, conn net.Conn, remoteConfig *Config) error {
+// startRound starts the span of a recon round with the peer at addr, as the
+// client when gossiping or the server when serving.
+func (p *Peer) startRound(role string, addr net.Addr) (context.Context, *tracing.Span) {
+	ctx, span := tracing.StartSpan(context.Background(), "recon."+role)
+	if role == SERVE {
+		span.SetKind(tracing.KindServer)
+	} else {
+		span.SetKind(tracing.KindClient)
+	}
+	span.SetAttribute("net.peer.addr", addr.String())
+	if name := p.PartnerName(addr); name != "" {
+		span.SetAttribute("recon.partner", name)
+	}
+	return ctx, span
+}
+
+func (p *Peer) sendItems(ctx context.Context, items []cf.Zp, conn net.Conn, remoteConfig *Config) error {
+	recordReconSetDifference(conn.RemoteAddr(), len(items))
+	p.recordPartnerDifference(conn.RemoteAddr(), len(items))
+	if p.partnerAudited(conn.RemoteAddr()) {
+		p.recordAudit(conn.RemoteAddr(), items)
+		return nil
+	}
 	if len(items) > 0 && p.t.Alive() {
+		ctx, span := tracing.StartSpan(ctx, "recon.recover")
+		defer span.End()
+		span.SetAttribute("recon.elements", len(items))
 		done := make(chan struct{})
 		select {
 		case p.RecoverChan <- &Recover{
@@ -828,6 +1312,7 @@ func (p *Peer) sendItems(items []cf.Zp, conn net.Conn, remoteConfig *Config) err
 			RemoteConfig:   remoteConfig,
 			RemoteElements: items,
 			Done:           done,
+			Context:        ctx,
 		}:
 			p.logConn(SERVE, conn).Infof("recovering %d items", len(items))
 			<-done
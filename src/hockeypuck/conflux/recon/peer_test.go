@@ -22,9 +22,17 @@
 package recon
 
 import (
+	"context"
 	"net"
+	"sort"
+	"time"
 
+	"github.com/pkg/errors"
 	gc "gopkg.in/check.v1"
+
+	"hockeypuck/clock"
+
+	cf "hockeypuck/conflux"
 )
 
 type PeerSuite struct{}
@@ -61,3 +69,435 @@ func (s *PeerSuite) TestResolveRecoverAddr(c *gc.C) {
 		c.Assert(testHost, gc.Equals, hkpHost)
 	}
 }
+
+func (s *PeerSuite) TestSetPartners(c *gc.C) {
+	p := NewMemPeer()
+	c.Assert(p.Partners(), gc.HasLen, 0)
+
+	err := p.SetPartners(PartnerMap{
+		"alice": Partner{HTTPAddr: "147.26.10.11:11371", ReconAddr: "147.26.10.11:11370"},
+	}, []string{"10.0.0.0/8"})
+	c.Assert(err, gc.IsNil)
+	c.Assert(p.Partners(), gc.HasLen, 1)
+	c.Assert(p.currentMatcher().Match(net.ParseIP("147.26.10.11")), gc.Equals, true)
+	c.Assert(p.currentMatcher().Match(net.ParseIP("10.1.2.3")), gc.Equals, true)
+	c.Assert(p.currentMatcher().Match(net.ParseIP("147.26.10.12")), gc.Equals, false)
+
+	addrs, err := p.choosePartners()
+	c.Assert(err, gc.IsNil)
+	c.Assert(addrs, gc.HasLen, 1)
+	c.Assert(addrs[0].String(), gc.Equals, "147.26.10.11:11370")
+
+	err = p.SetPartners(PartnerMap{}, nil)
+	c.Assert(err, gc.IsNil)
+	c.Assert(p.currentMatcher().Match(net.ParseIP("147.26.10.11")), gc.Equals, false)
+	_, err = p.choosePartners()
+	c.Assert(err, gc.ErrorMatches, ".*no recon partners configured")
+
+	err = p.SetPartners(PartnerMap{}, []string{"bogus"})
+	c.Assert(err, gc.NotNil)
+}
+
+func (s *PeerSuite) TestPartnerQuirks(c *gc.C) {
+	q, err := ParseQuirks([]string{PresetSKSLegacy})
+	c.Assert(err, gc.IsNil)
+	c.Assert(q, gc.DeepEquals, Quirks{
+		LenientConfigInts:  true,
+		ConfigDefaults:     true,
+		OptionalFailReason: true,
+		IgnoreFilters:      true,
+	})
+	_, err = ParseQuirks([]string{"bogus"})
+	c.Assert(err, gc.ErrorMatches, `unknown compatibility switch "bogus"`)
+
+	p := NewMemPeer()
+	err = p.SetPartners(PartnerMap{
+		"old": Partner{
+			HTTPAddr:  "147.26.10.11:11371",
+			ReconAddr: "147.26.10.11:11370",
+			Compat:    []string{QuirkIgnoreFilters},
+		},
+		"new": Partner{
+			HTTPAddr:  "147.26.10.12:11371",
+			ReconAddr: "147.26.10.12:11370",
+		},
+	}, nil)
+	c.Assert(err, gc.IsNil)
+	c.Assert(p.partnerQuirks(&net.TCPAddr{IP: net.ParseIP("147.26.10.11"), Port: 40000}),
+		gc.DeepEquals, Quirks{IgnoreFilters: true})
+	c.Assert(p.partnerQuirks(&net.TCPAddr{IP: net.ParseIP("147.26.10.12"), Port: 40000}),
+		gc.DeepEquals, Quirks{})
+}
+
+func (s *PeerSuite) TestPause(c *gc.C) {
+	p := NewMemPeer()
+	c.Assert(p.readAcquire(), gc.Equals, true)
+
+	paused := make(chan struct{})
+	go func() {
+		p.Pause()
+		close(paused)
+	}()
+	select {
+	case <-paused:
+		c.Fatal("pause did not wait for the session in progress")
+	case <-time.After(50 * time.Millisecond):
+	}
+	p.readRelease()
+	select {
+	case <-paused:
+	case <-time.After(5 * time.Second):
+		c.Fatal("timed out waiting for pause")
+	}
+	c.Assert(p.Paused(), gc.Equals, true)
+	c.Assert(p.readAcquire(), gc.Equals, false)
+
+	p.Resume()
+	c.Assert(p.Paused(), gc.Equals, false)
+	c.Assert(p.readAcquire(), gc.Equals, true)
+	p.readRelease()
+}
+
+func (s *PeerSuite) TestCheckProgress(c *gc.C) {
+	p := NewMemPeer()
+	fake := clock.NewFake(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	p.SetClock(fake)
+	c.Assert(p.CheckProgress(time.Minute), gc.IsNil)
+
+	// Sessions refused while paused are not a stall.
+	p.Pause()
+	c.Assert(p.readAcquire(), gc.Equals, false)
+	fake.Advance(2 * time.Minute)
+	c.Assert(p.CheckProgress(time.Minute), gc.IsNil)
+	p.Resume()
+
+	p.mu.Lock()
+	p.mutating = true
+	p.mu.Unlock()
+	c.Assert(p.readAcquire(), gc.Equals, false)
+	fake.Advance(30 * time.Second)
+	c.Assert(p.readAcquire(), gc.Equals, false)
+	c.Assert(p.CheckProgress(time.Minute), gc.IsNil)
+	fake.Advance(time.Minute)
+	c.Assert(p.CheckProgress(time.Minute), gc.ErrorMatches, "recon sessions refused for 1m30s")
+
+	p.mu.Lock()
+	p.mutating = false
+	p.mu.Unlock()
+	c.Assert(p.readAcquire(), gc.Equals, true)
+	p.readRelease()
+	c.Assert(p.CheckProgress(time.Minute), gc.IsNil)
+
+	// Nor are sessions refused before a pause, once it has begun.
+	p.mu.Lock()
+	p.mutating = true
+	p.mu.Unlock()
+	c.Assert(p.readAcquire(), gc.Equals, false)
+	p.mu.Lock()
+	p.mutating = false
+	p.mu.Unlock()
+	p.Pause()
+	fake.Advance(2 * time.Minute)
+	c.Assert(p.CheckProgress(time.Minute), gc.IsNil)
+	p.Resume()
+	c.Assert(p.CheckProgress(time.Minute), gc.IsNil)
+
+	p.markGossip()
+	fake.Advance(2 * time.Minute)
+	c.Assert(p.CheckProgress(time.Minute), gc.ErrorMatches, "no gossip attempted for 2m0s")
+}
+
+func (s *PeerSuite) TestPartnerStatus(c *gc.C) {
+	p := NewMemPeer()
+	fake := clock.NewFake(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	p.SetClock(fake)
+	err := p.SetPartners(PartnerMap{
+		"alice": Partner{HTTPAddr: "147.26.10.11:11371", ReconAddr: "147.26.10.11:11370"},
+		"bob":   Partner{HTTPAddr: "147.26.10.12:11371", ReconAddr: "147.26.10.12:11370"},
+	}, []string{"10.0.0.0/8"})
+	c.Assert(err, gc.IsNil)
+	alice := &net.TCPAddr{IP: net.ParseIP("147.26.10.11"), Port: 11370}
+	stranger := &net.TCPAddr{IP: net.ParseIP("10.1.2.3"), Port: 11370}
+
+	status := p.PartnerStatus()
+	c.Assert(status, gc.HasLen, 2)
+	c.Assert(status["alice"], gc.Equals, PartnerStatus{})
+
+	start := fake.Now()
+	fake.Advance(time.Second)
+	p.recordPartnerSession(alice, start, nil)
+	p.recordPartnerDifference(alice, 42)
+	p.recordPartnerSession(stranger, start, nil)
+	status = p.PartnerStatus()
+	c.Assert(status, gc.HasLen, 2)
+	c.Assert(status["alice"], gc.Equals, PartnerStatus{
+		LastAttempt:   start,
+		LastSuccess:   fake.Now(),
+		SetDifference: 42,
+		Reachable:     true,
+	})
+	c.Assert(status["bob"], gc.Equals, PartnerStatus{})
+
+	// A busy partner is reachable.
+	p.recordPartnerSession(alice, fake.Now(), ErrPeerBusy)
+	c.Assert(p.PartnerStatus()["alice"].Reachable, gc.Equals, true)
+
+	fake.Advance(time.Minute)
+	p.recordPartnerSession(alice, fake.Now(), errors.New("connection refused"))
+	status = p.PartnerStatus()
+	c.Assert(status["alice"].Reachable, gc.Equals, false)
+	c.Assert(status["alice"].LastError, gc.Equals, "connection refused")
+	c.Assert(status["alice"].LastErrorTime, gc.Equals, fake.Now())
+	c.Assert(status["alice"].LastSuccess, gc.Equals, start.Add(time.Second))
+
+	// Former partners are forgotten.
+	err = p.SetPartners(PartnerMap{
+		"bob": Partner{HTTPAddr: "147.26.10.12:11371", ReconAddr: "147.26.10.12:11370"},
+	}, nil)
+	c.Assert(err, gc.IsNil)
+	c.Assert(p.PartnerStatus(), gc.HasLen, 1)
+}
+
+func (s *PeerSuite) TestGossipSchedule(c *gc.C) {
+	p := NewMemPeer()
+	p.settings.GossipIntervalSecs = 60
+	p.settings.GossipJitterPercent = 10
+	p.settings.GossipStaggerSecs = 5
+	for i := 0; i < 100; i++ {
+		interval := p.skewedGossipInterval()
+		c.Assert(interval >= 54*time.Second && interval <= 66*time.Second, gc.Equals, true, gc.Commentf("%s", interval))
+		stagger := p.gossipStagger()
+		c.Assert(stagger >= 0 && stagger <= 5*time.Second, gc.Equals, true, gc.Commentf("%s", stagger))
+	}
+
+	p.settings.GossipJitterPercent = 0
+	p.settings.GossipStaggerSecs = 0
+	c.Assert(p.skewedGossipInterval(), gc.Equals, time.Minute)
+	c.Assert(p.gossipStagger(), gc.Equals, time.Duration(0))
+}
+
+func (s *PeerSuite) TestGossipConcurrency(c *gc.C) {
+	p := NewMemPeer()
+	err := p.SetPartners(PartnerMap{
+		"alice": Partner{HTTPAddr: "147.26.10.11:11371", ReconAddr: "147.26.10.11:11370"},
+		"bob":   Partner{HTTPAddr: "147.26.10.12:11371", ReconAddr: "147.26.10.12:11370"},
+		"carol": Partner{HTTPAddr: "147.26.10.13:11371", ReconAddr: "147.26.10.13:11370"},
+		"dave":  Partner{HTTPAddr: "147.26.10.14:11371", ReconAddr: "147.26.10.14:11370", Weight: -1},
+	}, nil)
+	c.Assert(err, gc.IsNil)
+
+	p.settings.GossipConcurrency = 2
+	addrs, err := p.choosePartners()
+	c.Assert(err, gc.IsNil)
+	c.Assert(addrs, gc.HasLen, 2)
+	c.Assert(addrs[0].String(), gc.Not(gc.Equals), addrs[1].String())
+
+	// Partners with negative weight are never chosen.
+	p.settings.GossipConcurrency = 10
+	addrs, err = p.choosePartners()
+	c.Assert(err, gc.IsNil)
+	c.Assert(addrs, gc.HasLen, 3)
+}
+
+func (s *PeerSuite) TestGossipStaggerUnlocked(c *gc.C) {
+	p := NewMemPeer()
+	fake := clock.NewFake(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	p.SetClock(fake)
+	p.settings.GossipStaggerSecs = 3600
+	err := p.SetPartners(PartnerMap{
+		"alice": Partner{HTTPAddr: "147.26.10.11:11371", ReconAddr: "147.26.10.11:11370"},
+	}, nil)
+	c.Assert(err, gc.IsNil)
+
+	done := make(chan struct{})
+	go func() {
+		p.gossipRound()
+		close(done)
+	}()
+	for i := 0; fake.Timers() == 0; i++ {
+		c.Assert(i < 500, gc.Equals, true, gc.Commentf("timed out waiting for the stagger"))
+		time.Sleep(10 * time.Millisecond)
+	}
+	// The prefix tree may be mutated while the session is staggered.
+	p.mu.Lock()
+	readers := p.readers
+	p.mu.Unlock()
+	c.Assert(readers, gc.Equals, 0)
+
+	p.t.Kill(nil)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		c.Fatal("timed out waiting for the gossip round")
+	}
+}
+
+func (s *PeerSuite) TestGossipBackoff(c *gc.C) {
+	p := NewMemPeer()
+	fake := clock.NewFake(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	p.SetClock(fake)
+	p.settings.GossipIntervalSecs = 60
+	p.settings.GossipBackoffMaxSecs = 300
+	err := p.SetPartners(PartnerMap{
+		"alice": Partner{HTTPAddr: "147.26.10.11:11371", ReconAddr: "147.26.10.11:11370"},
+	}, nil)
+	c.Assert(err, gc.IsNil)
+	alice := &net.TCPAddr{IP: net.ParseIP("147.26.10.11"), Port: 11370}
+	failed := errors.New("connection refused")
+
+	for _, backoff := range []time.Duration{time.Minute, 2 * time.Minute, 4 * time.Minute, 5 * time.Minute, 5 * time.Minute} {
+		p.recordPartnerBackoff(alice, failed)
+		c.Assert(p.PartnerStatus()["alice"].BackoffUntil, gc.Equals, fake.Now().Add(backoff))
+		_, err = p.choosePartners()
+		c.Assert(errors.Is(err, ErrPartnersBackingOff), gc.Equals, true)
+		fake.Advance(backoff)
+		_, err = p.choosePartners()
+		c.Assert(err, gc.IsNil)
+	}
+	c.Assert(p.PartnerStatus()["alice"].Failures, gc.Equals, 5)
+
+	// Busy partners are not failing.
+	p.recordPartnerBackoff(alice, ErrPeerBusy)
+	c.Assert(p.PartnerStatus()["alice"].Failures, gc.Equals, 5)
+
+	p.recordPartnerBackoff(alice, nil)
+	status := p.PartnerStatus()["alice"]
+	c.Assert(status.Failures, gc.Equals, 0)
+	c.Assert(status.BackoffUntil.IsZero(), gc.Equals, true)
+
+	// Backoff may be disabled.
+	p.settings.GossipBackoffMaxSecs = 0
+	p.recordPartnerBackoff(alice, failed)
+	_, err = p.choosePartners()
+	c.Assert(err, gc.IsNil)
+}
+
+func (s *PeerSuite) TestPartnerModes(c *gc.C) {
+	p := NewMemPeer()
+	err := p.SetPartners(PartnerMap{
+		"alice": Partner{HTTPAddr: "147.26.10.11:11371", ReconAddr: "147.26.10.11:11370", Mode: PartnerModePull},
+		"bob":   Partner{HTTPAddr: "147.26.10.12:11371", ReconAddr: "147.26.10.12:11370", Mode: PartnerModePush},
+		"carol": Partner{HTTPAddr: "147.26.10.13:11371", ReconAddr: "147.26.10.13:11370", Mode: PartnerModeBoth},
+	}, nil)
+	c.Assert(err, gc.IsNil)
+
+	// Push-only partners are never gossiped with.
+	p.settings.GossipConcurrency = 10
+	addrs, err := p.choosePartners()
+	c.Assert(err, gc.IsNil)
+	var chosen []string
+	for _, addr := range addrs {
+		chosen = append(chosen, addr.String())
+	}
+	sort.Strings(chosen)
+	c.Assert(chosen, gc.DeepEquals, []string{"147.26.10.11:11370", "147.26.10.13:11370"})
+
+	// Pull-only partners may not connect.
+	for _, t := range []struct {
+		ip      string
+		accepts bool
+	}{
+		{"147.26.10.11", false},
+		{"147.26.10.12", true},
+		{"147.26.10.13", true},
+		{"10.0.0.1", true},
+	} {
+		addr := &net.TCPAddr{IP: net.ParseIP(t.ip), Port: 54321}
+		c.Assert(p.acceptsFrom(addr), gc.Equals, t.accepts, gc.Commentf("%s", t.ip))
+	}
+
+	err = p.SetPartners(PartnerMap{
+		"bob": Partner{HTTPAddr: "147.26.10.12:11371", ReconAddr: "147.26.10.12:11370", Mode: PartnerModePush},
+	}, nil)
+	c.Assert(err, gc.IsNil)
+	_, err = p.choosePartners()
+	c.Assert(errors.Is(err, ErrNoPullPartners), gc.Equals, true)
+}
+
+type addrConn struct {
+	net.Conn
+	remoteAddr net.Addr
+}
+
+func (c *addrConn) RemoteAddr() net.Addr { return c.remoteAddr }
+
+func (s *PeerSuite) TestPartnerAudit(c *gc.C) {
+	p := NewMemPeer()
+	fake := clock.NewFake(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	p.SetClock(fake)
+	err := p.SetPartners(PartnerMap{
+		"alice": Partner{HTTPAddr: "147.26.10.11:11371", ReconAddr: "147.26.10.11:11370", Audit: true},
+		"bob":   Partner{HTTPAddr: "147.26.10.12:11371", ReconAddr: "147.26.10.12:11370"},
+	}, nil)
+	c.Assert(err, gc.IsNil)
+	alice := &addrConn{remoteAddr: &net.TCPAddr{IP: net.ParseIP("147.26.10.11"), Port: 11370}}
+	c.Assert(p.Audits(), gc.HasLen, 0)
+
+	// Elements found with an audited partner are recorded, not recovered,
+	// so nothing need read RecoverChan.
+	items := []cf.Zp{*cf.Zi(cf.P_SKS, 65537), *cf.Zi(cf.P_SKS, 1)}
+	err = p.sendItems(context.Background(), items, alice, nil)
+	c.Assert(err, gc.IsNil)
+	c.Assert(p.full, gc.Equals, false)
+	c.Assert(p.Audits(), gc.DeepEquals, map[string]AuditReport{
+		"alice": {
+			Time:       fake.Now(),
+			RemoteAddr: "147.26.10.11:11370",
+			Digests: []string{
+				"01000100000000000000000000000000",
+				"01000000000000000000000000000000",
+			},
+		},
+	})
+	c.Assert(p.PartnerStatus()["alice"].SetDifference, gc.Equals, 2)
+
+	// Audit reports are dropped once the partner is no longer audited.
+	err = p.SetPartners(PartnerMap{
+		"alice": Partner{HTTPAddr: "147.26.10.11:11371", ReconAddr: "147.26.10.11:11370"},
+	}, nil)
+	c.Assert(err, gc.IsNil)
+	c.Assert(p.Audits(), gc.HasLen, 0)
+}
+
+// batchTree records the writes and batches of a prefix tree.
+type batchTree struct {
+	*MemPrefixTree
+	calls []string
+}
+
+func (t *batchTree) Begin() error {
+	t.calls = append(t.calls, "begin")
+	return nil
+}
+
+func (t *batchTree) Commit() error {
+	t.calls = append(t.calls, "commit")
+	return nil
+}
+
+func (t *batchTree) Insert(z *cf.Zp) error {
+	t.calls = append(t.calls, "insert")
+	return t.MemPrefixTree.Insert(z)
+}
+
+func (t *batchTree) Remove(z *cf.Zp) error {
+	t.calls = append(t.calls, "remove")
+	return t.MemPrefixTree.Remove(z)
+}
+
+func (s *PeerSuite) TestFlushBatch(c *gc.C) {
+	tree := &batchTree{MemPrefixTree: new(MemPrefixTree)}
+	tree.Init()
+	p := NewPeer(DefaultSettings(), tree)
+
+	// Nothing to flush begins no batch.
+	p.flush()
+	c.Assert(tree.calls, gc.HasLen, 0)
+
+	// Every change flushed is written in one batch.
+	z := cf.Zi(cf.P_SKS, 65537)
+	p.Insert(*z, *cf.Zi(cf.P_SKS, 65539))
+	p.Remove(*z)
+	p.flush()
+	c.Assert(tree.calls, gc.DeepEquals, []string{"begin", "insert", "insert", "remove", "commit"})
+}
@@ -0,0 +1,86 @@
+/*
+   conflux - Distributed database synchronization library
+	Based on the algorithm described in
+		"Set Reconciliation with Nearly Optimal	Communication Complexity",
+			Yaron Minsky, Ari Trachtenberg, and Richard Zippel, 2004.
+
+   Copyright (c) 2012-2015  Casey Marshall <cmars@cmarstech.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package recon
+
+import (
+	"net"
+
+	"github.com/pkg/errors"
+)
+
+// ProbeResult describes the outcome of probing a prospective partner.
+type ProbeResult struct {
+	// Config is the configuration declared by the partner.
+	Config *Config
+
+	// HandshakeErr is set if either side rejected the other's
+	// configuration.
+	HandshakeErr error
+
+	// Size is the number of elements in the partner's prefix tree, or -1
+	// if it could not be determined.
+	Size int
+}
+
+// Probe connects to the recon service at addr and performs the config
+// handshake, as if initiating a reconciliation. If the handshake succeeds,
+// the size of the remote prefix tree is read from the partner's first
+// request and the connection is closed without reconciling, which the
+// partner may log as a failed reconciliation.
+//
+// Probe does not require the peer to be started.
+func (p *Peer) Probe(addr net.Addr) (*ProbeResult, error) {
+	conn, err := p.dial(addr)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer conn.Close()
+	p.setReadDeadline(conn, defaultTimeout)
+
+	config, err := p.localConfig(conn.RemoteAddr())
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	remoteConfig, err := p.remoteConfig(conn, GOSSIP, config)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	result := &ProbeResult{Config: remoteConfig, Size: -1}
+	_, err = p.negotiateConfig(conn, GOSSIP, "", config, remoteConfig)
+	if err != nil {
+		result.HandshakeErr = err
+		return result, nil
+	}
+
+	msg, err := ReadMsgIn(conn, p.settings.Field.P())
+	if err != nil {
+		return result, nil
+	}
+	switch m := msg.(type) {
+	case *ReconRqstPoly:
+		result.Size = m.Size
+	case *ReconRqstFull:
+		result.Size = m.Elements.Len()
+	}
+	return result, nil
+}
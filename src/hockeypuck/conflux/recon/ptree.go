@@ -39,6 +39,23 @@ type PrefixTree interface {
 	Node(key *cf.Bitstring) (PrefixNode, error)
 	Insert(z *cf.Zp) error
 	Remove(z *cf.Zp) error
+
+	// Stats visits every node to collect statistics on the tree's shape.
+	Stats() (*PTreeStats, error)
+}
+
+// Batcher may be implemented by prefix trees which can group many writes
+// together. Batched writes are much faster than single writes when building
+// a large tree or flushing many changes.
+type Batcher interface {
+	// Begin starts a batch. Until it is committed, writes are visible only
+	// to the prefix tree and lost if the process is interrupted. A tree
+	// interrupted while building in batches, as by pbuild, must be rebuilt
+	// or resumed from the last batch committed.
+	Begin() error
+
+	// Commit atomically writes the batch begun by Begin.
+	Commit() error
 }
 
 type PrefixNode interface {
@@ -89,8 +106,10 @@ func (t *MemPrefixTree) Root() (PrefixNode, error) { return t.root, nil }
 // Init configures the tree with default settings if not already set,
 // and initializes the internal state with sample data points, root node, etc.
 func (t *MemPrefixTree) Init() {
-	t.PTreeConfig = defaultPTreeConfig
-	t.points = cf.Zpoints(cf.P_SKS, t.NumSamples())
+	if t.MBar == 0 {
+		t.PTreeConfig = defaultPTreeConfig
+	}
+	t.points = cf.Zpoints(t.Field.P(), t.NumSamples())
 	t.allElements = cf.NewZSet()
 	t.Create()
 }
@@ -109,6 +128,8 @@ func (t *MemPrefixTree) Drop() error {
 
 func (t *MemPrefixTree) Close() error { return nil }
 
+func (t *MemPrefixTree) Stats() (*PTreeStats, error) { return SubtreeStats(t.root) }
+
 func Find(t PrefixTree, z *cf.Zp) (PrefixNode, error) {
 	bs := cf.NewZpBitstring(z)
 	return t.Node(bs)
@@ -253,7 +274,7 @@ func (n *MemPrefixNode) SValues() []cf.Zp { return n.svalues }
 func (n *MemPrefixNode) init(t *MemPrefixTree) {
 	n.MemPrefixTree = t
 	n.svalues = make([]cf.Zp, t.NumSamples())
-	zOne := cf.Zi(cf.P_SKS, 1)
+	zOne := cf.Zi(t.Field.P(), 1)
 	for i := 0; i < len(n.svalues); i++ {
 		n.svalues[i].Set(zOne)
 	}
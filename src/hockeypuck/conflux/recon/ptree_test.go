@@ -97,6 +97,33 @@ func (s *PtreeSuite) TestInsertNodeSplit(c *gc.C) {
 	c.Assert(tree.root.elements, gc.HasLen, 0)
 }
 
+func (s *PtreeSuite) TestStats(c *gc.C) {
+	tree := new(MemPrefixTree)
+	tree.Init()
+	stats, err := tree.Stats()
+	c.Assert(err, gc.IsNil)
+	c.Assert(stats, gc.DeepEquals, &PTreeStats{Nodes: 1, Leaves: 1, Depths: []int{1}})
+
+	n := tree.SplitThreshold() * 4
+	for i := 0; i < n; i++ {
+		tree.Insert(cf.Zi(cf.P_SKS, i+65536))
+	}
+	stats, err = tree.Stats()
+	c.Assert(err, gc.IsNil)
+	c.Assert(stats.Elements, gc.Equals, n)
+	c.Assert(stats.LeafElements, gc.Equals, n)
+	c.Assert(stats.MaxDepth() > 0, gc.Equals, true)
+	c.Assert(stats.Depths[0], gc.Equals, 1)
+	c.Assert(stats.Depths[1], gc.Equals, 1<<uint(tree.BitQuantum))
+	c.Assert(stats.MaxLeafElements <= tree.SplitThreshold(), gc.Equals, true)
+	var nodes int
+	for _, depth := range stats.Depths {
+		nodes += depth
+	}
+	c.Assert(stats.Nodes, gc.Equals, nodes)
+	c.Assert(stats.Leaves < stats.Nodes, gc.Equals, true)
+}
+
 // TestKeyMatch tests key consistency
 func (s *PtreeSuite) TestKeyMatch(c *gc.C) {
 	tree1 := new(MemPrefixTree)
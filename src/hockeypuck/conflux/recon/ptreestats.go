@@ -0,0 +1,95 @@
+/*
+   conflux - Distributed database synchronization library
+	Based on the algorithm described in
+		"Set Reconciliation with Nearly Optimal	Communication Complexity",
+			Yaron Minsky, Ari Trachtenberg, and Richard Zippel, 2004.
+
+   Copyright (c) 2012-2015  Casey Marshall <cmars@cmarstech.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package recon
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// PTreeStats describes the shape of a prefix tree, to diagnose a tree which
+// has grown too deep or whose nodes disagree on how many elements it holds.
+type PTreeStats struct {
+	// Counted is when the tree was last visited to collect the statistics.
+	Counted time.Time `json:"counted"`
+
+	// Elements is the number of elements held, according to the root.
+	Elements int `json:"elements"`
+
+	// LeafElements is the number of elements held by the leaves, which is
+	// the same as Elements unless the tree is corrupt.
+	LeafElements int `json:"leafElements"`
+
+	Nodes  int `json:"nodes"`
+	Leaves int `json:"leaves"`
+
+	// MaxLeafElements is the number of elements held by the fullest leaf.
+	MaxLeafElements int `json:"maxLeafElements"`
+
+	// Depths is the number of nodes at each depth, the root being at
+	// depth zero.
+	Depths []int `json:"depths"`
+}
+
+// MaxDepth returns the depth of the deepest node.
+func (s *PTreeStats) MaxDepth() int {
+	return len(s.Depths) - 1
+}
+
+// SubtreeStats visits every node below node to collect statistics on the
+// subtree's shape.
+func SubtreeStats(node PrefixNode) (*PTreeStats, error) {
+	stats := &PTreeStats{Elements: node.Size()}
+	err := stats.add(node, 0)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return stats, nil
+}
+
+func (s *PTreeStats) add(node PrefixNode, depth int) error {
+	s.Nodes++
+	if depth == len(s.Depths) {
+		s.Depths = append(s.Depths, 0)
+	}
+	s.Depths[depth]++
+	if node.IsLeaf() {
+		s.Leaves++
+		s.LeafElements += node.Size()
+		if node.Size() > s.MaxLeafElements {
+			s.MaxLeafElements = node.Size()
+		}
+		return nil
+	}
+	children, err := node.Children()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	for _, child := range children {
+		err = s.add(child, depth+1)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	return nil
+}
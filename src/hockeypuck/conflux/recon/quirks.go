@@ -0,0 +1,122 @@
+/*
+   conflux - Distributed database synchronization library
+	Based on the algorithm described in
+		"Set Reconciliation with Nearly Optimal	Communication Complexity",
+			Yaron Minsky, Ari Trachtenberg, and Richard Zippel, 2004.
+
+   Copyright (c) 2012-2015  Casey Marshall <cmars@cmarstech.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package recon
+
+import (
+	"net"
+
+	"github.com/pkg/errors"
+)
+
+// Compatibility switches which may be enabled per partner to interoperate
+// with peers that deviate from the protocol as implemented here.
+const (
+	// QuirkLenientConfigInts accepts integer config values encoded with a
+	// length other than 4, such as decimal strings.
+	QuirkLenientConfigInts = "lenient-config-ints"
+
+	// QuirkConfigDefaults assumes the SKS default bitquantum and mbar when
+	// the peer's config omits them.
+	QuirkConfigDefaults = "config-defaults"
+
+	// QuirkOptionalFailReason tolerates a peer which rejects our config
+	// without sending a reason.
+	QuirkOptionalFailReason = "optional-fail-reason"
+
+	// QuirkIgnoreFilters reconciles even when the peer declares different
+	// filters.
+	QuirkIgnoreFilters = "ignore-filters"
+
+	// PresetSKSLegacy enables all of the quirks needed by SKS 1.1.x.
+	PresetSKSLegacy = "sks-legacy"
+)
+
+// Quirks holds the compatibility switches in effect for a partner.
+type Quirks struct {
+	LenientConfigInts  bool
+	ConfigDefaults     bool
+	OptionalFailReason bool
+	IgnoreFilters      bool
+}
+
+// ParseQuirks returns the switches enabled by the given quirk and preset
+// names.
+func ParseQuirks(names []string) (Quirks, error) {
+	var q Quirks
+	for _, name := range names {
+		switch name {
+		case QuirkLenientConfigInts:
+			q.LenientConfigInts = true
+		case QuirkConfigDefaults:
+			q.ConfigDefaults = true
+		case QuirkOptionalFailReason:
+			q.OptionalFailReason = true
+		case QuirkIgnoreFilters:
+			q.IgnoreFilters = true
+		case PresetSKSLegacy:
+			q = Quirks{
+				LenientConfigInts:  true,
+				ConfigDefaults:     true,
+				OptionalFailReason: true,
+				IgnoreFilters:      true,
+			}
+		default:
+			return Quirks{}, errors.Errorf("unknown compatibility switch %q", name)
+		}
+	}
+	return q, nil
+}
+
+// matches returns whether addr is one of the partner's addresses.
+func (partner *Partner) matches(addr net.Addr) bool {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		for _, paddr := range partner.reconAddrs() {
+			if addr.String() == paddr {
+				return true
+			}
+		}
+		return false
+	}
+	for _, ip := range partner.ips() {
+		if ip.Equal(tcpAddr.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// partnerQuirks returns the compatibility switches configured for the
+// partner at addr.
+func (p *Peer) partnerQuirks(addr net.Addr) Quirks {
+	p.muSettings.RLock()
+	defer p.muSettings.RUnlock()
+	for _, partner := range p.settings.Partners {
+		if len(partner.Compat) == 0 || !partner.matches(addr) {
+			continue
+		}
+		// Settings are validated by Resolve.
+		q, _ := ParseQuirks(partner.Compat)
+		return q
+	}
+	return Quirks{}
+}
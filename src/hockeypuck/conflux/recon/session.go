@@ -0,0 +1,225 @@
+/*
+   conflux - Distributed database synchronization library
+	Based on the algorithm described in
+		"Set Reconciliation with Nearly Optimal	Communication Complexity",
+			Yaron Minsky, Ari Trachtenberg, and Richard Zippel, 2004.
+
+   Copyright (c) 2012-2015  Casey Marshall <cmars@cmarstech.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package recon
+
+import (
+	"fmt"
+	"math/big"
+	"net"
+	"sync"
+
+	"github.com/pkg/errors"
+
+	cf "hockeypuck/conflux"
+)
+
+// ErrSessionMemory is returned when a recon session holds more memory than
+// the MaxSessionMemory setting allows.
+var ErrSessionMemory = fmt.Errorf("recon session memory limit exceeded")
+
+// elementOverhead approximates the memory held for each element of a ZSet
+// beyond its value: the map entry, its string key and the big.Int header.
+const elementOverhead = 128
+
+// maxSplitDepth limits how deep served sessions may start in the prefix
+// tree after exceeding their memory limit.
+const maxSplitDepth = 8
+
+// sessionMemory accounts for the memory held by one recon session: the
+// elements collected for recovery, the elements queued to be sent to the
+// partner and the scratch space used to interpolate set differences.
+type sessionMemory struct {
+	limit int
+	p     *big.Int
+
+	mu   sync.Mutex
+	used int
+}
+
+func newSessionMemory(settings *Settings) *sessionMemory {
+	return &sessionMemory{limit: settings.MaxSessionMemory, p: settings.Field.P()}
+}
+
+// elementsSize returns the memory held by n elements.
+func (m *sessionMemory) elementsSize(n int) int {
+	return n * (cf.WireLen(m.p) + elementOverhead)
+}
+
+// interpolationSize returns the scratch memory used to interpolate a set
+// difference from n samples, which solves an n by n+1 system.
+func (m *sessionMemory) interpolationSize(n int) int {
+	return m.elementsSize(n * (n + 1))
+}
+
+// alloc accounts for size more bytes, failing with ErrSessionMemory if the
+// limit would be exceeded. A limit of zero or less is unlimited.
+func (m *sessionMemory) alloc(size int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.limit > 0 && m.used+size > m.limit {
+		return errors.Wrapf(ErrSessionMemory, "%d bytes held, %d more requested, limit %d", m.used, size, m.limit)
+	}
+	m.used += size
+	return nil
+}
+
+// free accounts for size bytes released.
+func (m *sessionMemory) free(size int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.used -= size
+	if m.used < 0 {
+		m.used = 0
+	}
+}
+
+// messagesSize returns the memory held by the elements in messages.
+func (m *sessionMemory) messagesSize(messages []ReconMsg) int {
+	var n int
+	for _, msg := range messages {
+		switch msg := msg.(type) {
+		case *Elements:
+			n += msg.Len()
+		case *FullElements:
+			n += msg.Len()
+		case *ReconRqstFull:
+			n += msg.Elements.Len()
+		}
+	}
+	return m.elementsSize(n)
+}
+
+// sessionSplit is where the next session served to a partner starts: the
+// index of the subtree to descend into at each split below the root. The
+// last index is the subtree reconciled next at the deepest split, and those
+// before it the subtrees of shallower splits being reconciled a part at a
+// time.
+type sessionSplit struct {
+	path []int
+}
+
+// splitKey identifies the partner at addr for tracking its session splits:
+// by name if it is a configured partner, otherwise by address.
+func (p *Peer) splitKey(addr net.Addr) string {
+	if name := p.PartnerName(addr); name != "" {
+		return name
+	}
+	if tcpAddr, ok := addr.(*net.TCPAddr); ok {
+		return tcpAddr.IP.String()
+	}
+	return addr.String()
+}
+
+// sessionRoot returns the prefix tree node from which a session served to
+// the partner at addr starts. Normally this is the root. After a session
+// with the partner exceeds its memory limit, its sessions instead start at
+// the subtrees of a deeper split, one at a time in turn, so that each holds
+// only part of the set difference.
+func (p *Peer) sessionRoot(addr net.Addr) (PrefixNode, error) {
+	root, err := p.ptree.Root()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	var path []int
+	key := p.splitKey(addr)
+	p.muSplit.Lock()
+	if s, ok := p.splits[key]; ok {
+		path = append(path, s.path...)
+	}
+	p.muSplit.Unlock()
+
+	node := root
+	for _, next := range path {
+		if node.IsLeaf() {
+			break
+		}
+		children, err := node.Children()
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		node = children[next]
+	}
+	return node, nil
+}
+
+// sessionDone records whether a session served to the partner at addr
+// exceeded the memory limit of either side, choosing where the partner's
+// next session starts. A session which exceeds it is retried from the first
+// of its subtrees at the next split, or if the deepest split is reached, the
+// subtree is skipped. Once every subtree at a split has been reconciled,
+// sessions return to the previous split, continuing with the subtree after
+// the one which was split.
+func (p *Peer) sessionDone(addr net.Addr, exceeded bool) {
+	key := p.splitKey(addr)
+	p.muSplit.Lock()
+	defer p.muSplit.Unlock()
+	split, ok := p.splits[key]
+	if !ok {
+		if !exceeded {
+			return
+		}
+		split = &sessionSplit{}
+		if p.splits == nil {
+			p.splits = map[string]*sessionSplit{}
+		}
+		p.splits[key] = split
+	}
+	if exceeded && len(split.path) < maxSplitDepth {
+		split.path = append(split.path, 0)
+		return
+	}
+	numChildren := 1 << uint(p.settings.BitQuantum)
+	for len(split.path) > 0 {
+		last := len(split.path) - 1
+		split.path[last]++
+		if split.path[last] < numChildren {
+			return
+		}
+		split.path = split.path[:last]
+	}
+	delete(p.splits, key)
+}
+
+// prefixElements returns the elements of node under prefix. The node may be
+// an ancestor of the node at prefix if the local tree is not split as deeply
+// as the partner's.
+func prefixElements(node PrefixNode, prefix *cf.Bitstring) ([]cf.Zp, error) {
+	elements, err := node.Elements()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if node.Key().BitLen() >= prefix.BitLen() {
+		return elements, nil
+	}
+	var result []cf.Zp
+	for i := range elements {
+		bs := cf.NewZpBitstring(&elements[i])
+		match := true
+		for j := 0; j < prefix.BitLen() && match; j++ {
+			match = bs.Get(j) == prefix.Get(j)
+		}
+		if match {
+			result = append(result, elements[i])
+		}
+	}
+	return result, nil
+}
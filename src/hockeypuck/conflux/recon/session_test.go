@@ -0,0 +1,189 @@
+/*
+   conflux - Distributed database synchronization library
+	Based on the algorithm described in
+		"Set Reconciliation with Nearly Optimal	Communication Complexity",
+			Yaron Minsky, Ari Trachtenberg, and Richard Zippel, 2004.
+
+   Copyright (c) 2012-2015  Casey Marshall <cmars@cmarstech.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package recon
+
+import (
+	"errors"
+	"net"
+
+	gc "gopkg.in/check.v1"
+
+	cf "hockeypuck/conflux"
+)
+
+type SessionSuite struct{}
+
+var _ = gc.Suite(&SessionSuite{})
+
+func (s *SessionSuite) TestAlloc(c *gc.C) {
+	settings := DefaultSettings()
+	settings.MaxSessionMemory = 1000
+	mem := newSessionMemory(settings)
+	c.Assert(mem.alloc(600), gc.IsNil)
+	err := mem.alloc(600)
+	c.Assert(errors.Is(err, ErrSessionMemory), gc.Equals, true)
+	mem.free(600)
+	c.Assert(mem.alloc(1000), gc.IsNil)
+
+	settings.MaxSessionMemory = 0
+	mem = newSessionMemory(settings)
+	c.Assert(mem.alloc(1<<40), gc.IsNil)
+}
+
+func (s *SessionSuite) TestMessagesSize(c *gc.C) {
+	mem := newSessionMemory(DefaultSettings())
+	zs := cf.NewZSet(cf.Zi(cf.P_SKS, 1), cf.Zi(cf.P_SKS, 2))
+	size := mem.messagesSize([]ReconMsg{&Elements{ZSet: zs}, &Flush{}, &FullElements{ZSet: zs}})
+	c.Assert(size, gc.Equals, mem.elementsSize(4))
+}
+
+func (s *SessionSuite) TestSplitRotation(c *gc.C) {
+	tree := new(MemPrefixTree)
+	tree.Init()
+	for i := 1; i < 1000; i++ {
+		c.Assert(tree.Insert(cf.Zi(cf.P_SKS, 65537*i)), gc.IsNil)
+	}
+	p := NewPeer(DefaultSettings(), tree)
+	quantum := p.settings.BitQuantum
+	addr := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 11370}
+	other := &net.TCPAddr{IP: net.ParseIP("192.0.2.2"), Port: 11370}
+
+	node, err := p.sessionRoot(addr)
+	c.Assert(err, gc.IsNil)
+	c.Assert(node.Key().BitLen(), gc.Equals, 0)
+
+	// Exceeding the limit moves sessions one split deeper, visiting each
+	// subtree in turn before returning to the root.
+	p.sessionDone(addr, true)
+	for i := 0; i < 1<<uint(quantum); i++ {
+		node, err = p.sessionRoot(addr)
+		c.Assert(err, gc.IsNil)
+		c.Assert(node.Key().BitLen(), gc.Equals, quantum)
+		p.sessionDone(addr, false)
+	}
+	node, err = p.sessionRoot(addr)
+	c.Assert(err, gc.IsNil)
+	c.Assert(node.Key().BitLen(), gc.Equals, 0)
+	c.Assert(p.splits, gc.HasLen, 0)
+
+	// Exceeding it again within a subtree splits that subtree.
+	p.sessionDone(addr, true)
+	p.sessionDone(addr, false)
+	p.sessionDone(addr, true)
+	node, err = p.sessionRoot(addr)
+	c.Assert(err, gc.IsNil)
+	c.Assert(node.Key().BitLen(), gc.Equals, 2*quantum)
+	c.Assert(p.splits["192.0.2.1"].path, gc.DeepEquals, []int{1, 0})
+
+	// Other partners are unaffected.
+	node, err = p.sessionRoot(other)
+	c.Assert(err, gc.IsNil)
+	c.Assert(node.Key().BitLen(), gc.Equals, 0)
+}
+
+func (s *SessionSuite) TestSplitNested(c *gc.C) {
+	tree := new(MemPrefixTree)
+	tree.Init()
+	for i := 1; i < 10000; i++ {
+		c.Assert(tree.Insert(cf.Zi(cf.P_SKS, 65537*i)), gc.IsNil)
+	}
+	p := NewPeer(DefaultSettings(), tree)
+	quantum := p.settings.BitQuantum
+	numChildren := 1 << uint(quantum)
+	addr := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 11370}
+	assertPath := func(path ...int) {
+		if len(path) == 0 {
+			c.Assert(p.splits, gc.HasLen, 0)
+		} else {
+			c.Assert(p.splits["192.0.2.1"].path, gc.DeepEquals, path)
+		}
+		node, err := p.sessionRoot(addr)
+		c.Assert(err, gc.IsNil)
+		c.Assert(node.Key().BitLen(), gc.Equals, len(path)*quantum)
+	}
+
+	// Subtree 1 is split, then its subtree 1 split again.
+	p.sessionDone(addr, true)
+	p.sessionDone(addr, false)
+	assertPath(1)
+	p.sessionDone(addr, true)
+	p.sessionDone(addr, false)
+	assertPath(1, 1)
+	p.sessionDone(addr, true)
+	assertPath(1, 1, 0)
+
+	// Once the deepest split is done, sessions continue with the next
+	// subtree of each shallower split, rather than starting it over.
+	for i := 0; i < numChildren; i++ {
+		p.sessionDone(addr, false)
+	}
+	assertPath(1, 2)
+	for i := 2; i < numChildren; i++ {
+		p.sessionDone(addr, false)
+	}
+	assertPath(2)
+	for i := 2; i < numChildren; i++ {
+		p.sessionDone(addr, false)
+	}
+	assertPath()
+}
+
+func (s *SessionSuite) TestClientMemoryExceeded(c *gc.C) {
+	p := NewMemPeer()
+	conn, _ := net.Pipe()
+	defer conn.Close()
+	rwc := &reconWithClient{Peer: p, conn: conn, mem: newSessionMemory(p.settings)}
+	err := rwc.handleReply(p, &Error{&textMsg{Text: "1 bytes held: " + ErrSessionMemory.Error()}}, nil)
+	c.Assert(errors.Is(err, ErrSessionMemory), gc.Equals, true)
+	err = rwc.handleReply(p, &Error{&textMsg{Text: "oops"}}, nil)
+	c.Assert(err, gc.ErrorMatches, "client error: oops")
+}
+
+func (s *SessionSuite) TestPrefixElements(c *gc.C) {
+	ptree := new(MemPrefixTree)
+	ptree.Init()
+	for i := 1; i < 20; i++ {
+		c.Assert(ptree.Insert(cf.Zi(cf.P_SKS, 65537*i)), gc.IsNil)
+	}
+	root, err := ptree.Root()
+	c.Assert(err, gc.IsNil)
+	c.Assert(root.IsLeaf(), gc.Equals, true)
+
+	all, err := prefixElements(root, cf.NewBitstring(0))
+	c.Assert(err, gc.IsNil)
+	c.Assert(all, gc.HasLen, 19)
+
+	var total int
+	for bit := 0; bit < 2; bit++ {
+		prefix := cf.NewBitstring(1)
+		if bit == 1 {
+			prefix.Set(0)
+		}
+		elements, err := prefixElements(root, prefix)
+		c.Assert(err, gc.IsNil)
+		for i := range elements {
+			c.Assert(cf.NewZpBitstring(&elements[i]).Get(0), gc.Equals, bit)
+		}
+		total += len(elements)
+	}
+	c.Assert(total, gc.Equals, 19)
+}
@@ -30,35 +30,123 @@ package recon
 
 import (
 	"fmt"
+	"math/big"
 	"net"
+	"strconv"
 	"strings"
 
 	"github.com/BurntSushi/toml"
 	"github.com/jmcvetta/randutil"
 	"github.com/pkg/errors"
+
+	cf "hockeypuck/conflux"
 )
 
 type PartnerMap map[string]Partner
 
+// PTreeConfig describes the prefix tree. BitQuantum, MBar and ThreshMult
+// determine its shape, and must be the same for all peers reconciling with
+// each other. Peers other than SKS may use non-default values, such as in a
+// private mesh reconciling large differences at once.
 type PTreeConfig struct {
 	ThreshMult int `toml:"threshMult"`
 	BitQuantum int `toml:"bitQuantum"`
 	MBar       int `toml:"mBar"`
+
+	// Field is the finite field in which elements are reconciled. All peers
+	// must use the same field, and the prefix tree must be rebuilt when it
+	// changes.
+	Field Field `toml:"field"`
+}
+
+// Field is a finite field for recon, configured as a decimal prime. The zero
+// value is P_SKS, the field used by SKS. Hockeypuck reconciles MD5 digests,
+// so a field must hold 16-byte digests; use the primegen command to generate
+// one for a recon network kept apart from SKS.
+type Field struct {
+	p *big.Int
+}
+
+// NewField returns the field Z(p), if p is suitable for recon. P_SKS given
+// by value is the zero Field.
+func NewField(p *big.Int) (Field, error) {
+	if p.Cmp(cf.P_SKS) == 0 {
+		return Field{}, nil
+	}
+	err := cf.ValidatePrime(p)
+	if err != nil {
+		return Field{}, errors.WithStack(err)
+	}
+	return Field{p: p}, nil
+}
+
+// P returns the prime modulus of the field.
+func (f Field) P() *big.Int {
+	if f.p == nil {
+		return cf.P_SKS
+	}
+	return f.p
+}
+
+// IsSKS returns whether the field is the one used by SKS.
+func (f Field) IsSKS() bool {
+	return f.p == nil
+}
+
+// String implements the fmt.Stringer interface.
+func (f Field) String() string {
+	return f.P().String()
+}
+
+// MarshalText implements the encoding.TextMarshaler interface.
+func (f Field) MarshalText() ([]byte, error) {
+	return []byte(f.String()), nil
+}
+
+// UnmarshalText implements the encoding.TextUnmarshaler interface.
+func (f *Field) UnmarshalText(text []byte) error {
+	s := strings.TrimSpace(string(text))
+	if s == "" {
+		*f = Field{}
+		return nil
+	}
+	p, ok := new(big.Int).SetString(s, 10)
+	if !ok {
+		return errors.Errorf("invalid field %q", s)
+	}
+	field, err := NewField(p)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	*f = field
+	return nil
 }
 
 // Settings holds the configuration settings for the local reconciliation peer.
 type Settings struct {
 	PTreeConfig
 
-	Version    string     `toml:"version"`
-	LogName    string     `toml:"logname" json:"-"`
-	HTTPAddr   string     `toml:"httpAddr"`
-	HTTPNet    netType    `toml:"httpNet" json:"-"`
-	ReconAddr  string     `toml:"reconAddr"`
-	ReconNet   netType    `toml:"reconNet" json:"-"`
-	Partners   PartnerMap `toml:"partner"`
-	AllowCIDRs []string   `toml:"allowCIDRs"`
-	Filters    []string   `toml:"filters"`
+	Version   string     `toml:"version"`
+	LogName   string     `toml:"logname" json:"-"`
+	HTTPAddr  string     `toml:"httpAddr"`
+	HTTPNet   netType    `toml:"httpNet" json:"-"`
+	ReconAddr string     `toml:"reconAddr"`
+	ReconNet  netType    `toml:"reconNet" json:"-"`
+	Partners  PartnerMap `toml:"partner"`
+
+	// ListenAddrs lists further addresses on which recon is served, such
+	// as "[2001:db8::1]:11370" alongside an IPv4 ReconAddr.
+	ListenAddrs []string `toml:"listenAddrs" json:"-"`
+
+	AllowCIDRs []string `toml:"allowCIDRs"`
+	Filters    []string `toml:"filters"`
+
+	// ProxyProtocol lists the networks, such as load balancers, trusted to
+	// give the address of recon partners in a PROXY protocol header.
+	ProxyProtocol []string `toml:"proxyProtocol" json:"-"`
+
+	// TLS runs recon over TLS, authenticating partners by certificate.
+	TLS *TLSConfig `toml:"tls" json:"-"`
 
 	// Backwards-compatible keys
 	CompatHTTPPort     int      `toml:"httpPort" json:"-"`
@@ -67,6 +155,44 @@ type Settings struct {
 
 	GossipIntervalSecs          int `toml:"gossipIntervalSecs" json:"-"`
 	MaxOutstandingReconRequests int `toml:"maxOutstandingReconRequests" json:"-"`
+
+	// GossipJitterPercent varies each gossip interval randomly by up to
+	// this percentage either way, so that servers restarted together do
+	// not gossip in step.
+	GossipJitterPercent int `toml:"gossipJitterPercent" json:"-"`
+
+	// GossipStaggerSecs delays each session of a gossip round, and the
+	// first round after start, by a random time up to this long.
+	GossipStaggerSecs int `toml:"gossipStaggerSecs" json:"-"`
+
+	// GossipConcurrency is how many partners are reconciled with at once
+	// in each gossip round.
+	GossipConcurrency int `toml:"gossipConcurrency" json:"-"`
+
+	// GossipBackoffMaxSecs limits how long a failing partner is skipped
+	// for. A partner is skipped for a gossip interval after it fails,
+	// doubling with each further failure until it succeeds. Zero disables
+	// backoff.
+	GossipBackoffMaxSecs int `toml:"gossipBackoffMaxSecs" json:"-"`
+
+	// MaxSessionMemory limits the memory, in bytes, which a single recon
+	// session may hold for elements and interpolation. A session which
+	// exceeds it is ended, recovering what it found so far, and later
+	// sessions reconcile smaller parts of the prefix tree. Zero is
+	// unlimited.
+	MaxSessionMemory int `toml:"maxSessionMemory" json:"-"`
+
+	// RecoveryBytesPerSec and RecoveryKeysPerSec limit the rate at which
+	// keys found by recon are fetched from partners and merged, so that
+	// catching up on a large difference does not saturate the partner's
+	// uplink or the database. Zero is unlimited.
+	RecoveryBytesPerSec int `toml:"recoveryBytesPerSec" json:"-"`
+	RecoveryKeysPerSec  int `toml:"recoveryKeysPerSec" json:"-"`
+
+	// RecoveryChunkSize is the most keys requested from a partner in one
+	// hashquery. Recovery starts with single keys, and requests more at a
+	// time as long as requests succeed.
+	RecoveryChunkSize int `toml:"recoveryChunkSize" json:"-"`
 }
 
 type Partner struct {
@@ -75,6 +201,100 @@ type Partner struct {
 	ReconAddr string  `toml:"reconAddr"`
 	ReconNet  netType `toml:"reconNet" json:"-"`
 	Weight    int     `toml:"weight"`
+
+	// ReconAddrs lists further addresses of the partner's recon service,
+	// such as an IPv6 address alongside an IPv4 ReconAddr. Gossip attempts
+	// all of them, and those which host names resolve to, alternating
+	// between IPv6 and IPv4 until one connects.
+	ReconAddrs []string `toml:"reconAddrs" json:"-"`
+
+	// Compat lists compatibility switches, or a preset such as
+	// "sks-legacy", to enable when reconciling with this partner.
+	Compat []string `toml:"compat" json:"-"`
+
+	// TLSPins lists the SHA-256 fingerprints of certificates which this
+	// partner may present in recon over TLS. If empty, the partner's
+	// certificate must be certified by the recon TLS ca.
+	TLSPins []string `toml:"tlsPins" json:"-"`
+
+	// Plaintext initiates recon with this partner without TLS, such as
+	// with an SKS partner, when recon TLS is configured.
+	Plaintext bool `toml:"plaintext" json:"-"`
+
+	// PSK is a key shared with this partner. If set, recon with the partner
+	// is only accepted once each side has proven that it knows the key.
+	// Both partners must be Hockeypuck peers configured with the same key.
+	// It may refer to a secret, like other credentials in the settings.
+	PSK string `toml:"psk" json:"-"`
+
+	// Mode is PartnerModePull to only initiate recon with this partner,
+	// refusing its incoming connections, PartnerModePush to only accept its
+	// incoming connections, never gossiping with it, or PartnerModeBoth, the
+	// default.
+	Mode string `toml:"mode" json:"mode,omitempty"`
+
+	// Audit reconciles with this partner without recovering keys from it.
+	// The digests of the keys which would have been fetched are logged and
+	// kept for the admin API instead, so that a prospective partner's
+	// database may be evaluated before peering.
+	Audit bool `toml:"audit" json:"audit,omitempty"`
+
+	// Recovery rejects some keys recovered from this partner, in addition
+	// to the server's ingest policy, so that a poisoned partner cannot
+	// inject keys which then propagate to other peers.
+	Recovery RecoveryPolicy `toml:"recovery" json:"-"`
+}
+
+// RecoveryPolicy rejects keys recovered from a partner. Rejected keys are
+// not stored, and so are not passed on to other partners.
+type RecoveryPolicy struct {
+	// MaxKeyLength rejects keys whose packets are longer than this many
+	// bytes in all, if positive.
+	MaxKeyLength int `toml:"maxKeyLength"`
+
+	// Blacklist lists the fingerprints of keys rejected from this partner.
+	// The server's blacklist applies to every partner.
+	Blacklist []string `toml:"blacklist"`
+
+	// RequireSelfSigs rejects keys with a user ID, user attribute or subkey
+	// which lacks a self-signature that verifies.
+	RequireSelfSigs bool `toml:"requireSelfSigs"`
+}
+
+// Partner recon modes, which arrange one-way peering such as a feed into an
+// internal mirror.
+const (
+	PartnerModeBoth = "both"
+	PartnerModePull = "pull"
+	PartnerModePush = "push"
+)
+
+// initiates returns whether gossip initiates recon with the partner.
+func (partner *Partner) initiates() bool {
+	return partner.Mode != PartnerModePush
+}
+
+// accepts returns whether incoming recon is accepted from the partner.
+func (partner *Partner) accepts() bool {
+	return partner.Mode != PartnerModePull
+}
+
+// byAddr returns the partner one of whose recon addresses resolves to addr.
+func (pm PartnerMap) byAddr(addr net.Addr) (Partner, bool) {
+	for _, partner := range pm {
+		for _, paddr := range partner.reconAddrs() {
+			resolved, err := partner.ReconNet.resolveAll(paddr)
+			if err != nil {
+				continue
+			}
+			for _, partnerAddr := range resolved {
+				if partnerAddr.Network() == addr.Network() && partnerAddr.String() == addr.String() {
+					return partner, true
+				}
+			}
+		}
+	}
+	return Partner{}, false
 }
 
 type matchAccessType uint8
@@ -96,21 +316,12 @@ func newIPMatcher() *ipMatcher {
 }
 
 func (m *ipMatcher) allow(partner Partner) error {
-	var httpAddr *net.TCPAddr
-	if partner.HTTPNet == NetworkDefault || partner.HTTPNet == NetworkTCP {
-		httpAddr, resolveErr := net.ResolveTCPAddr("tcp", partner.HTTPAddr)
-		if resolveErr == nil && httpAddr.IP != nil {
-			err := m.allowCIDR(fmt.Sprintf("%s/32", httpAddr.IP.String()))
-			if err != nil {
-				return errors.WithStack(err)
-			}
-		}
-	}
-	if partner.ReconNet == NetworkDefault || partner.ReconNet == NetworkTCP {
-		addr, resolveErr := net.ResolveTCPAddr("tcp", partner.ReconAddr)
-		if resolveErr == nil && addr.IP != nil && (httpAddr == nil || !addr.IP.Equal(httpAddr.IP)) {
-			return m.allowCIDR(fmt.Sprintf("%s/32", addr.IP.String()))
+	for _, ip := range partner.ips() {
+		bits := 8 * net.IPv6len
+		if ip4 := ip.To4(); ip4 != nil {
+			ip, bits = ip4, 8*net.IPv4len
 		}
+		m.nets = append(m.nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
 	}
 	return nil
 }
@@ -185,11 +396,23 @@ const (
 	DefaultHTTPAddr                    = ":11371"
 	DefaultReconAddr                   = ":11370"
 	DefaultGossipIntervalSecs          = 60
+	DefaultGossipJitterPercent         = 10
+	DefaultGossipStaggerSecs           = 10
+	DefaultGossipConcurrency           = 1
+	DefaultGossipBackoffMaxSecs        = 3600
 	DefaultMaxOutstandingReconRequests = 100
+	DefaultMaxSessionMemory            = 256 << 20
+	DefaultRecoveryChunkSize           = 100
 
 	DefaultThreshMult = 10
 	DefaultBitQuantum = 2
 	DefaultMBar       = 5
+
+	// MaxBitQuantum and MaxMBar bound the prefix tree shape. Nodes have
+	// 2**BitQuantum children and MBar+1 sample values, and interpolation
+	// takes time cubic in MBar.
+	MaxBitQuantum = 8
+	MaxMBar       = 256
 )
 
 var defaultPTreeConfig = PTreeConfig{
@@ -207,7 +430,13 @@ var defaultSettings = Settings{
 	ReconAddr: DefaultReconAddr,
 
 	GossipIntervalSecs:          DefaultGossipIntervalSecs,
+	GossipJitterPercent:         DefaultGossipJitterPercent,
+	GossipStaggerSecs:           DefaultGossipStaggerSecs,
+	GossipConcurrency:           DefaultGossipConcurrency,
+	GossipBackoffMaxSecs:        DefaultGossipBackoffMaxSecs,
 	MaxOutstandingReconRequests: DefaultMaxOutstandingReconRequests,
+	MaxSessionMemory:            DefaultMaxSessionMemory,
+	RecoveryChunkSize:           DefaultRecoveryChunkSize,
 }
 
 // Resolve resolves network addresses and backwards-compatible settings. Use
@@ -234,13 +463,65 @@ func (s *Settings) Resolve() error {
 		}
 	}
 
+	for name, partner := range s.Partners {
+		_, err := ParseQuirks(partner.Compat)
+		if err != nil {
+			return errors.Wrapf(err, "invalid compat for partner %q", name)
+		}
+		for _, pin := range partner.TLSPins {
+			_, err = normalizePin(pin)
+			if err != nil {
+				return errors.Wrapf(err, "invalid tlsPins for partner %q", name)
+			}
+		}
+		switch partner.Mode {
+		case "", PartnerModeBoth, PartnerModePull, PartnerModePush:
+		default:
+			return errors.Errorf("invalid mode %q for partner %q", partner.Mode, name)
+		}
+		if partner.Recovery.MaxKeyLength < 0 {
+			return errors.Errorf("invalid recovery maxKeyLength for partner %q", name)
+		}
+		for _, addr := range partner.ReconAddrs {
+			if _, _, err := net.SplitHostPort(addr); err != nil && partner.ReconNet != NetworkUnix {
+				return errors.Wrapf(err, "invalid reconAddrs for partner %q", name)
+			}
+		}
+	}
+	if s.TLS != nil && (s.TLS.Cert == "" || s.TLS.Key == "") {
+		return errors.New("recon tls requires cert and key")
+	}
+	if s.GossipJitterPercent < 0 || s.GossipJitterPercent > 100 {
+		return errors.Errorf("invalid gossipJitterPercent %d", s.GossipJitterPercent)
+	}
+	if s.GossipStaggerSecs < 0 || s.GossipConcurrency < 0 || s.GossipBackoffMaxSecs < 0 {
+		return errors.New("gossip settings must not be negative")
+	}
+	if s.RecoveryBytesPerSec < 0 || s.RecoveryKeysPerSec < 0 {
+		return errors.New("recovery rate limits must not be negative")
+	}
+	if s.RecoveryChunkSize < 1 {
+		return errors.Errorf("invalid recoveryChunkSize %d", s.RecoveryChunkSize)
+	}
+	if s.BitQuantum < 1 || s.BitQuantum > MaxBitQuantum {
+		return errors.Errorf("invalid bitQuantum %d, expected 1 to %d", s.BitQuantum, MaxBitQuantum)
+	}
+	if s.MBar < 1 || s.MBar > MaxMBar {
+		return errors.Errorf("invalid mBar %d, expected 1 to %d", s.MBar, MaxMBar)
+	}
+	if s.ThreshMult < 2 {
+		return errors.Errorf("invalid threshMult %d, expected at least 2", s.ThreshMult)
+	}
+
 	_, err := s.HTTPNet.Resolve(s.HTTPAddr)
 	if err != nil {
 		return errors.Wrapf(err, "invalid httpNet %q httpAddr %q", s.HTTPNet, s.HTTPAddr)
 	}
-	_, err = s.ReconNet.Resolve(s.ReconAddr)
-	if err != nil {
-		return errors.Wrapf(err, "invalid reconNet %q reconAddr %q", s.ReconNet, s.ReconAddr)
+	for _, addr := range append([]string{s.ReconAddr}, s.ListenAddrs...) {
+		_, err = s.ReconNet.Resolve(addr)
+		if err != nil {
+			return errors.Wrapf(err, "invalid reconNet %q reconAddr %q", s.ReconNet, addr)
+		}
 	}
 
 	return nil
@@ -294,6 +575,18 @@ func (s *Settings) Config() (*Config, error) {
 		MBar:       s.MBar,
 		Filters:    strings.Join(s.Filters, ","),
 	}
+	if !s.Field.IsSKS() {
+		// SKS does not know of other fields, so the field is only declared
+		// when it differs.
+		config.Custom = map[string]string{configField: s.Field.String()}
+	}
+	if s.ThreshMult != DefaultThreshMult {
+		// Nor does SKS declare threshMult, so likewise.
+		if config.Custom == nil {
+			config.Custom = map[string]string{}
+		}
+		config.Custom[configThreshMult] = strconv.Itoa(s.ThreshMult)
+	}
 
 	// Try to obtain httpPort
 	addr, err := s.HTTPNet.Resolve(s.HTTPAddr)
@@ -308,6 +601,12 @@ func (s *Settings) Config() (*Config, error) {
 	return config, nil
 }
 
+// IsDefaultShape returns whether the prefix tree has the shape used by SKS,
+// with which any peer may reconcile.
+func (c *PTreeConfig) IsDefaultShape() bool {
+	return c.BitQuantum == DefaultBitQuantum && c.MBar == DefaultMBar && c.ThreshMult == DefaultThreshMult
+}
+
 // SplitThreshold returns the maximum number of elements a prefix tree node may
 // contain before creating child nodes and distributing the elements among them.
 func (c *PTreeConfig) SplitThreshold() int {
@@ -330,8 +629,22 @@ func (c *PTreeConfig) NumSamples() int {
 // RandomPartnerAddr returns the a weighted-random chosen resolved network
 // addresses of configured partner peers.
 func (s *Settings) RandomPartnerAddr() (net.Addr, error) {
+	addrs, err := s.RandomPartnerAddrs(1, nil)
+	if err != nil || len(addrs) == 0 {
+		return nil, err
+	}
+	return addrs[0], nil
+}
+
+// RandomPartnerAddrs returns the resolved recon addresses of up to n
+// different partners, chosen at random by weight. Partners whose names
+// exclude returns true for are not chosen.
+func (s *Settings) RandomPartnerAddrs(n int, exclude func(name string) bool) ([]net.Addr, error) {
 	var choices []randutil.Choice
-	for _, partner := range s.Partners {
+	for name, partner := range s.Partners {
+		if exclude != nil && exclude(name) {
+			continue
+		}
 		addr, err := partner.ReconNet.Resolve(partner.ReconAddr)
 		if err != nil {
 			return nil, errors.WithStack(err)
@@ -344,12 +657,19 @@ func (s *Settings) RandomPartnerAddr() (net.Addr, error) {
 			choices = append(choices, randutil.Choice{Weight: weight, Item: addr})
 		}
 	}
-	if len(choices) == 0 {
-		return nil, nil
-	}
-	choice, err := randutil.WeightedChoice(choices)
-	if err != nil {
-		return nil, errors.WithStack(err)
+	var result []net.Addr
+	for len(result) < n && len(choices) > 0 {
+		choice, err := randutil.WeightedChoice(choices)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		result = append(result, choice.Item.(net.Addr))
+		for i := range choices {
+			if choices[i].Item == choice.Item {
+				choices = append(choices[:i], choices[i+1:]...)
+				break
+			}
+		}
 	}
-	return choice.Item.(net.Addr), nil
+	return result, nil
 }
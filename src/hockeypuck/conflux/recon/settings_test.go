@@ -26,6 +26,8 @@ import (
 	"testing"
 
 	gc "gopkg.in/check.v1"
+
+	cf "hockeypuck/conflux"
 )
 
 func Test(t *testing.T) { gc.TestingT(t) }
@@ -62,7 +64,13 @@ filters=["something","else"]
 			ReconAddr:                   ":11370",
 			Partners:                    PartnerMap{},
 			GossipIntervalSecs:          DefaultGossipIntervalSecs,
+			GossipJitterPercent:         DefaultGossipJitterPercent,
+			GossipStaggerSecs:           DefaultGossipStaggerSecs,
+			GossipConcurrency:           DefaultGossipConcurrency,
+			GossipBackoffMaxSecs:        DefaultGossipBackoffMaxSecs,
 			MaxOutstandingReconRequests: DefaultMaxOutstandingReconRequests,
+			MaxSessionMemory:            DefaultMaxSessionMemory,
+			RecoveryChunkSize:           DefaultRecoveryChunkSize,
 		},
 		"",
 	}, {
@@ -84,7 +92,13 @@ filters=["something","else"]
 			Filters:                     []string{"something", "else"},
 			Partners:                    PartnerMap{},
 			GossipIntervalSecs:          DefaultGossipIntervalSecs,
+			GossipJitterPercent:         DefaultGossipJitterPercent,
+			GossipStaggerSecs:           DefaultGossipStaggerSecs,
+			GossipConcurrency:           DefaultGossipConcurrency,
+			GossipBackoffMaxSecs:        DefaultGossipBackoffMaxSecs,
 			MaxOutstandingReconRequests: DefaultMaxOutstandingReconRequests,
+			MaxSessionMemory:            DefaultMaxSessionMemory,
+			RecoveryChunkSize:           DefaultRecoveryChunkSize,
 		},
 		"",
 	}, {
@@ -153,7 +167,13 @@ reconAddr="8.7.6.5:11370"
 			HTTPAddr:                    DefaultHTTPAddr,
 			ReconAddr:                   DefaultReconAddr,
 			GossipIntervalSecs:          DefaultGossipIntervalSecs,
+			GossipJitterPercent:         DefaultGossipJitterPercent,
+			GossipStaggerSecs:           DefaultGossipStaggerSecs,
+			GossipConcurrency:           DefaultGossipConcurrency,
+			GossipBackoffMaxSecs:        DefaultGossipBackoffMaxSecs,
 			MaxOutstandingReconRequests: DefaultMaxOutstandingReconRequests,
+			MaxSessionMemory:            DefaultMaxSessionMemory,
+			RecoveryChunkSize:           DefaultRecoveryChunkSize,
 			Partners: map[string]Partner{
 				"alice": Partner{
 					HTTPAddr:  "1.2.3.4:11371",
@@ -183,7 +203,13 @@ partners=["1.2.3.4:11370","5.6.7.8:11370"]
 			CompatHTTPPort:              11371,
 			CompatReconPort:             11370,
 			GossipIntervalSecs:          DefaultGossipIntervalSecs,
+			GossipJitterPercent:         DefaultGossipJitterPercent,
+			GossipStaggerSecs:           DefaultGossipStaggerSecs,
+			GossipConcurrency:           DefaultGossipConcurrency,
+			GossipBackoffMaxSecs:        DefaultGossipBackoffMaxSecs,
 			MaxOutstandingReconRequests: DefaultMaxOutstandingReconRequests,
+			MaxSessionMemory:            DefaultMaxSessionMemory,
+			RecoveryChunkSize:           DefaultRecoveryChunkSize,
 			Partners: map[string]Partner{
 				"1.2.3.4": Partner{
 					HTTPAddr:  "1.2.3.4:11371",
@@ -197,6 +223,120 @@ partners=["1.2.3.4:11370","5.6.7.8:11370"]
 			CompatPartnerAddrs: []string{"1.2.3.4:11370", "5.6.7.8:11370"},
 		},
 		"",
+	}, {
+		"gossip scheduling",
+		`
+[conflux.recon]
+gossipIntervalSecs=120
+gossipJitterPercent=25
+gossipStaggerSecs=30
+gossipConcurrency=4
+gossipBackoffMaxSecs=0
+`,
+		&Settings{
+			PTreeConfig:                 defaultPTreeConfig,
+			Version:                     DefaultVersion,
+			LogName:                     DefaultLogName,
+			HTTPAddr:                    DefaultHTTPAddr,
+			ReconAddr:                   DefaultReconAddr,
+			GossipIntervalSecs:          120,
+			GossipJitterPercent:         25,
+			GossipStaggerSecs:           30,
+			GossipConcurrency:           4,
+			GossipBackoffMaxSecs:        0,
+			MaxOutstandingReconRequests: DefaultMaxOutstandingReconRequests,
+			MaxSessionMemory:            DefaultMaxSessionMemory,
+			RecoveryChunkSize:           DefaultRecoveryChunkSize,
+			Partners:                    map[string]Partner{},
+		},
+		"",
+	}, {
+		"invalid partner mode",
+		`
+[conflux.recon.partner.alice]
+httpAddr="1.2.3.4:11371"
+reconAddr="1.2.3.4:11370"
+mode="sideways"
+`,
+		nil,
+		`.*invalid mode "sideways" for partner "alice"`,
+	}, {
+		"invalid partner recon addresses",
+		`
+[conflux.recon.partner.alice]
+httpAddr="1.2.3.4:11371"
+reconAddr="1.2.3.4:11370"
+reconAddrs=["2001:db8::1"]
+`,
+		nil,
+		`.*invalid reconAddrs for partner "alice".*`,
+	}, {
+		"invalid listen address",
+		`
+[conflux.recon]
+listenAddrs=["[::1]"]
+`,
+		nil,
+		`.*invalid reconNet "tcp" reconAddr "\[::1\]".*`,
+	}, {
+		"negative recovery rate limit",
+		`
+[conflux.recon]
+recoveryKeysPerSec=-1
+`,
+		nil,
+		`.*recovery rate limits must not be negative.*`,
+	}, {
+		"invalid recovery chunk size",
+		`
+[conflux.recon]
+recoveryChunkSize=0
+`,
+		nil,
+		`.*invalid recoveryChunkSize 0.*`,
+	}, {
+		"invalid bitquantum",
+		`
+[conflux.recon]
+bitQuantum=9
+`,
+		nil,
+		`.*invalid bitQuantum 9, expected 1 to 8`,
+	}, {
+		"invalid mbar",
+		`
+[conflux.recon]
+mBar=0
+`,
+		nil,
+		`.*invalid mBar 0, expected 1 to 256`,
+	}, {
+		"invalid threshmult",
+		`
+[conflux.recon]
+threshMult=1
+`,
+		nil,
+		`.*invalid threshMult 1, expected at least 2`,
+	}, {
+		"invalid partner recovery policy",
+		`
+[conflux.recon.partner.alice]
+httpAddr="1.2.3.4:11371"
+reconAddr="1.2.3.4:11370"
+[conflux.recon.partner.alice.recovery]
+maxKeyLength=-1
+`,
+		nil,
+		`.*invalid recovery maxKeyLength for partner "alice"`,
+	}, {
+		"invalid gossip jitter",
+		`
+[conflux.recon]
+gossipJitterPercent=150
+`,
+		nil,
+		".*invalid gossipJitterPercent 150",
 	}}
 	for i, testCase := range testCases {
 		c.Logf("test#%d: %s", i, testCase.desc)
@@ -209,6 +349,71 @@ partners=["1.2.3.4:11370","5.6.7.8:11370"]
 	}
 }
 
+func (s *SettingsSuite) TestField(c *gc.C) {
+	settings, err := ParseSettings(``)
+	c.Assert(err, gc.IsNil)
+	c.Assert(settings.Field.IsSKS(), gc.Equals, true)
+	config, err := settings.Config()
+	c.Assert(err, gc.IsNil)
+	c.Assert(config.Custom, gc.HasLen, 0)
+	c.Assert(config.field(), gc.Equals, cf.P_SKS.String())
+
+	// P_SKS given by value is the default field.
+	settings, err = ParseSettings(`
+[conflux.recon]
+field="` + cf.P_SKS.String() + `"
+`)
+	c.Assert(err, gc.IsNil)
+	c.Assert(settings.Field, gc.Equals, Field{})
+	c.Assert(settings.Field.P(), gc.Equals, cf.P_SKS)
+
+	settings, err = ParseSettings(`
+[conflux.recon]
+field="` + cf.P_256.String() + `"
+`)
+	c.Assert(err, gc.IsNil)
+	c.Assert(settings.Field.IsSKS(), gc.Equals, false)
+	c.Assert(settings.Field.P().Cmp(cf.P_256), gc.Equals, 0)
+	config, err = settings.Config()
+	c.Assert(err, gc.IsNil)
+	c.Assert(config.field(), gc.Equals, cf.P_256.String())
+
+	_, err = ParseSettings(`
+[conflux.recon]
+field="65536"
+`)
+	c.Assert(err, gc.ErrorMatches, ".*field 65536 is not prime")
+	_, err = ParseSettings(`
+[conflux.recon]
+field="0x10001"
+`)
+	c.Assert(err, gc.ErrorMatches, `.*invalid field "0x10001"`)
+}
+
+func (s *SettingsSuite) TestShape(c *gc.C) {
+	settings, err := ParseSettings(``)
+	c.Assert(err, gc.IsNil)
+	c.Assert(settings.IsDefaultShape(), gc.Equals, true)
+	config, err := settings.Config()
+	c.Assert(err, gc.IsNil)
+	c.Assert(config.threshMult(), gc.Equals, DefaultThreshMult)
+
+	settings, err = ParseSettings(`
+[conflux.recon]
+bitQuantum=4
+mBar=15
+threshMult=4
+`)
+	c.Assert(err, gc.IsNil)
+	c.Assert(settings.IsDefaultShape(), gc.Equals, false)
+	config, err = settings.Config()
+	c.Assert(err, gc.IsNil)
+	c.Assert(config.BitQuantum, gc.Equals, 4)
+	c.Assert(config.MBar, gc.Equals, 15)
+	c.Assert(config.Custom, gc.DeepEquals, map[string]string{"threshmult": "4"})
+	c.Assert(config.threshMult(), gc.Equals, 4)
+}
+
 func (s *SettingsSuite) TestMatcher(c *gc.C) {
 	settings := &Settings{
 		AllowCIDRs: []string{"192.168.1.0/24", "10.0.0.0/8", "20.21.22.23/32"},
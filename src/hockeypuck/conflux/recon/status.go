@@ -0,0 +1,167 @@
+/*
+   conflux - Distributed database synchronization library
+	Based on the algorithm described in
+		"Set Reconciliation with Nearly Optimal	Communication Complexity",
+			Yaron Minsky, Ari Trachtenberg, and Richard Zippel, 2004.
+
+   Copyright (c) 2012-2015  Casey Marshall <cmars@cmarstech.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package recon
+
+import (
+	"net"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// PartnerStatus describes the recent recon sessions with a partner.
+type PartnerStatus struct {
+	// LastAttempt is when a session with the partner last began, initiated
+	// by either side.
+	LastAttempt time.Time `json:"lastAttempt"`
+
+	// LastSuccess is when a session with the partner last completed.
+	LastSuccess time.Time `json:"lastSuccess"`
+
+	// LastError is why the last failed session failed, and LastErrorTime
+	// when it did. Errors can reveal details of the partner's network, so
+	// servers should only show them to their operators.
+	LastError     string    `json:"lastError,omitempty"`
+	LastErrorTime time.Time `json:"lastErrorTime"`
+
+	// SetDifference is how many elements the partner had which this peer
+	// lacked, as last measured.
+	SetDifference int `json:"setDifference"`
+
+	// Reachable is whether the last session completed, or was refused by
+	// a busy partner.
+	Reachable bool `json:"reachable"`
+
+	// Failures counts the gossip sessions with the partner which have
+	// failed since one last completed, and BackoffUntil is when gossip
+	// with the partner resumes after them.
+	Failures     int       `json:"failures"`
+	BackoffUntil time.Time `json:"backoffUntil"`
+}
+
+// recordPartnerSession records the outcome of a recon session with the
+// partner at addr. Sessions with peers which are not partners are not
+// recorded.
+func (p *Peer) recordPartnerSession(addr net.Addr, start time.Time, err error) {
+	name := p.PartnerName(addr)
+	if name == "" {
+		return
+	}
+	p.muStatus.Lock()
+	defer p.muStatus.Unlock()
+	status := p.partnerStatus(name)
+	status.LastAttempt = start
+	switch {
+	case err == nil:
+		status.LastSuccess = p.clock.Now()
+		status.Reachable = true
+	case errors.Is(err, ErrPeerBusy):
+		status.Reachable = true
+	default:
+		status.LastError = err.Error()
+		status.LastErrorTime = p.clock.Now()
+		status.Reachable = false
+	}
+}
+
+// recordPartnerDifference records the set difference found in a recon
+// session with the partner at addr.
+func (p *Peer) recordPartnerDifference(addr net.Addr, items int) {
+	name := p.PartnerName(addr)
+	if name == "" {
+		return
+	}
+	p.muStatus.Lock()
+	defer p.muStatus.Unlock()
+	p.partnerStatus(name).SetDifference = items
+}
+
+// recordPartnerBackoff records the outcome of a gossip session with the
+// partner at addr, backing off from the partner for longer after each
+// consecutive failure.
+func (p *Peer) recordPartnerBackoff(addr net.Addr, err error) {
+	name := p.PartnerName(addr)
+	if name == "" || errors.Is(err, ErrPeerBusy) {
+		return
+	}
+	p.muStatus.Lock()
+	defer p.muStatus.Unlock()
+	status := p.partnerStatus(name)
+	if err == nil {
+		status.Failures = 0
+		status.BackoffUntil = time.Time{}
+		return
+	}
+	status.Failures++
+	max := time.Duration(p.settings.GossipBackoffMaxSecs) * time.Second
+	if max <= 0 {
+		return
+	}
+	backoff := time.Duration(p.settings.GossipIntervalSecs) * time.Second
+	for i := 1; i < status.Failures && backoff < max; i++ {
+		backoff *= 2
+	}
+	if backoff > max {
+		backoff = max
+	}
+	status.BackoffUntil = p.clock.Now().Add(backoff)
+}
+
+// backingOff returns whether gossip with the partner name is held off
+// after failures.
+func (p *Peer) backingOff(name string) bool {
+	p.muStatus.Lock()
+	defer p.muStatus.Unlock()
+	status, ok := p.partnerStatuses[name]
+	return ok && p.clock.Now().Before(status.BackoffUntil)
+}
+
+// partnerStatus returns the status of the partner name. The caller must
+// hold p.muStatus.
+func (p *Peer) partnerStatus(name string) *PartnerStatus {
+	if p.partnerStatuses == nil {
+		p.partnerStatuses = map[string]*PartnerStatus{}
+	}
+	status, ok := p.partnerStatuses[name]
+	if !ok {
+		status = &PartnerStatus{}
+		p.partnerStatuses[name] = status
+	}
+	return status
+}
+
+// PartnerStatus returns the status of each configured partner, by name.
+// Partners with which no session has been attempted have a zero status.
+func (p *Peer) PartnerStatus() map[string]PartnerStatus {
+	partners := p.Partners()
+	p.muStatus.Lock()
+	defer p.muStatus.Unlock()
+	result := make(map[string]PartnerStatus, len(partners))
+	for name := range partners {
+		if status, ok := p.partnerStatuses[name]; ok {
+			result[name] = *status
+		} else {
+			result[name] = PartnerStatus{}
+		}
+	}
+	return result
+}
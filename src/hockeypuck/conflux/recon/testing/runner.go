@@ -106,7 +106,7 @@ func (s *ReconSuite) pollRootConvergence(c *gc.C, peer1, peer2 *recon.Peer, ptre
 					mu.Unlock()
 					return nil
 				} else {
-					c.Logf("reconciling: peer1 has %q, peer2 has %q", zs1, zs2)
+					c.Logf("reconciling: peers differ by %q", cf.ZSetSymmetricDiff(zs1, zs2))
 				}
 				mu.Unlock()
 			case <-t.Dying():
@@ -135,7 +135,7 @@ func (s *ReconSuite) pollRootConvergence(c *gc.C, peer1, peer2 *recon.Peer, ptre
 					mu.Unlock()
 					return nil
 				} else {
-					c.Logf("reconciling: peer1 has %q, peer2 has %q", zs1, zs2)
+					c.Logf("reconciling: peers differ by %q", cf.ZSetSymmetricDiff(zs1, zs2))
 				}
 				mu.Unlock()
 			case <-t.Dying():
@@ -264,6 +264,43 @@ func (s *ReconSuite) TestFullSync(c *gc.C) {
 	c.Assert(err, gc.IsNil)
 }
 
+// Test probing a partner without reconciling.
+func (s *ReconSuite) TestProbe(c *gc.C) {
+	ptree1, cleanup, err := s.Factory()
+	c.Assert(err, gc.IsNil)
+	defer cleanup()
+
+	ptree2, cleanup, err := s.Factory()
+	c.Assert(err, gc.IsNil)
+	defer cleanup()
+
+	ptree2.Insert(cf.Zi(cf.P_SKS, 65537))
+	ptree2.Insert(cf.Zi(cf.P_SKS, 65541))
+
+	port1, port2 := portPair(c)
+	peer2 := s.newPeer(port2, port1, recon.PeerModeServeOnly, ptree2)
+	defer peer2.Stop()
+
+	settings := recon.DefaultSettings()
+	peer1 := recon.NewPeer(settings, ptree1)
+
+	addr, err := net.ResolveTCPAddr("tcp", fmt.Sprintf("localhost:%d", port2))
+	c.Assert(err, gc.IsNil)
+	var result *recon.ProbeResult
+	for i := 0; i < 50; i++ {
+		result, err = peer1.Probe(addr)
+		if err == nil {
+			break
+		}
+		time.Sleep(ShortDelay)
+	}
+	c.Assert(err, gc.IsNil)
+	c.Assert(result.HandshakeErr, gc.IsNil)
+	c.Assert(result.Config.BitQuantum, gc.Equals, settings.BitQuantum)
+	c.Assert(result.Config.MBar, gc.Equals, settings.MBar)
+	c.Assert(result.Size, gc.Equals, 2)
+}
+
 // Test sync with polynomial interpolation.
 func (s *ReconSuite) TestPolySyncMBar(c *gc.C) {
 	ptree1, cleanup, err := s.Factory()
@@ -0,0 +1,285 @@
+/*
+   conflux - Distributed database synchronization library
+	Based on the algorithm described in
+		"Set Reconciliation with Nearly Optimal	Communication Complexity",
+			Yaron Minsky, Ari Trachtenberg, and Richard Zippel, 2004.
+
+   Copyright (c) 2012-2015  Casey Marshall <cmars@cmarstech.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package recon
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"io/ioutil"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// TLSConfig configures recon over TLS with mutual authentication. Each peer
+// presents its certificate and verifies its partner's, either against CA or
+// against the partner's pinned certificates.
+type TLSConfig struct {
+	// Cert and Key are the PEM-encoded certificate and private key which
+	// this peer presents, both when serving and when initiating recon.
+	Cert string `toml:"cert"`
+	Key  string `toml:"key"`
+
+	// CA is a PEM-encoded bundle of certificate authorities trusted to
+	// certify partners which do not have pinned certificates.
+	CA string `toml:"ca"`
+
+	// AllowPlaintext accepts incoming recon without TLS, such as from SKS
+	// partners, on the same address. Such connections are only checked
+	// against the partner addresses.
+	AllowPlaintext bool `toml:"allowPlaintext"`
+}
+
+// CertFingerprint returns the SHA-256 fingerprint of a certificate, in the
+// hex form used to pin partner certificates.
+func CertFingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+// normalizePin returns a pinned fingerprint in the form returned by
+// CertFingerprint, accepting upper case and the colon-separated form printed
+// by openssl.
+func normalizePin(pin string) (string, error) {
+	fp := strings.ToLower(strings.Replace(strings.TrimSpace(pin), ":", "", -1))
+	buf, err := hex.DecodeString(fp)
+	if err != nil || len(buf) != sha256.Size {
+		return "", errors.Errorf("invalid certificate fingerprint %q", pin)
+	}
+	return fp, nil
+}
+
+// tlsIdentity is the loaded TLS configuration of a peer.
+type tlsIdentity struct {
+	settings *TLSConfig
+	cert     tls.Certificate
+	roots    *x509.CertPool
+}
+
+func (c *TLSConfig) load() (*tlsIdentity, error) {
+	cert, err := tls.LoadX509KeyPair(c.Cert, c.Key)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to load recon TLS certificate=%q key=%q", c.Cert, c.Key)
+	}
+	id := &tlsIdentity{settings: c, cert: cert}
+	if c.CA != "" {
+		buf, err := ioutil.ReadFile(c.CA)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		id.roots = x509.NewCertPool()
+		if !id.roots.AppendCertsFromPEM(buf) {
+			return nil, errors.Errorf("no certificates found in recon TLS ca %q", c.CA)
+		}
+	}
+	return id, nil
+}
+
+// verifier returns a function which accepts a peer certificate if it
+// matches one of pins, or otherwise if it is certified by the trusted CAs.
+// Host names are not checked, since partners are identified by address.
+func (id *tlsIdentity) verifier(pins []string, usage x509.ExtKeyUsage) func([][]byte, [][]*x509.Certificate) error {
+	return func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		if len(rawCerts) == 0 {
+			return errors.New("recon partner did not present a certificate")
+		}
+		certs := make([]*x509.Certificate, len(rawCerts))
+		for i := range rawCerts {
+			cert, err := x509.ParseCertificate(rawCerts[i])
+			if err != nil {
+				return errors.WithStack(err)
+			}
+			certs[i] = cert
+		}
+		if len(pins) > 0 {
+			fp := CertFingerprint(certs[0])
+			for _, pin := range pins {
+				if pin == fp {
+					return nil
+				}
+			}
+			return errors.Errorf("recon partner certificate %s is not pinned", fp)
+		}
+		if id.roots == nil {
+			return errors.New("recon partner certificate cannot be verified without a ca or pinned certificates")
+		}
+		intermediates := x509.NewCertPool()
+		for _, cert := range certs[1:] {
+			intermediates.AddCert(cert)
+		}
+		_, err := certs[0].Verify(x509.VerifyOptions{
+			Roots:         id.roots,
+			Intermediates: intermediates,
+			KeyUsages:     []x509.ExtKeyUsage{usage},
+		})
+		return errors.WithStack(err)
+	}
+}
+
+// serverConfig returns the configuration for accepting recon from
+// remoteAddr. Only the pinned certificates of the partners at that address
+// are accepted, so that one partner cannot present its certificate from
+// another's address.
+func (id *tlsIdentity) serverConfig(partners PartnerMap, remoteAddr net.Addr) *tls.Config {
+	var pins []string
+	for _, partner := range partners {
+		if !partner.matches(remoteAddr) {
+			continue
+		}
+		for _, pin := range partner.TLSPins {
+			fp, err := normalizePin(pin)
+			if err == nil {
+				pins = append(pins, fp)
+			}
+		}
+	}
+	if id.roots != nil && len(pins) > 0 {
+		// Partners certified by a trusted CA are accepted too.
+		verifyPins := id.verifier(pins, x509.ExtKeyUsageClientAuth)
+		verifyCA := id.verifier(nil, x509.ExtKeyUsageClientAuth)
+		return id.config(tls.RequireAnyClientCert, func(rawCerts [][]byte, chains [][]*x509.Certificate) error {
+			if verifyPins(rawCerts, chains) == nil {
+				return nil
+			}
+			return verifyCA(rawCerts, chains)
+		})
+	}
+	return id.config(tls.RequireAnyClientCert, id.verifier(pins, x509.ExtKeyUsageClientAuth))
+}
+
+// clientConfig returns the configuration for initiating recon with partner.
+func (id *tlsIdentity) clientConfig(partner Partner) (*tls.Config, error) {
+	var pins []string
+	for _, pin := range partner.TLSPins {
+		fp, err := normalizePin(pin)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		pins = append(pins, fp)
+	}
+	config := id.config(tls.NoClientCert, id.verifier(pins, x509.ExtKeyUsageServerAuth))
+	if host, _, err := net.SplitHostPort(partner.ReconAddr); err == nil && net.ParseIP(host) == nil {
+		config.ServerName = host
+	}
+	return config, nil
+}
+
+func (id *tlsIdentity) config(clientAuth tls.ClientAuthType, verify func([][]byte, [][]*x509.Certificate) error) *tls.Config {
+	return &tls.Config{
+		Certificates: []tls.Certificate{id.cert},
+		ClientAuth:   clientAuth,
+		// Certificates are verified by VerifyPeerCertificate instead.
+		InsecureSkipVerify:    true,
+		VerifyPeerCertificate: verify,
+		MinVersion:            tls.VersionTLS12,
+	}
+}
+
+// tlsRecordHandshake is the first byte of a TLS connection. A recon message
+// starts with its length, which is never large enough to begin with it.
+const tlsRecordHandshake = 0x16
+
+// sniffConn is a connection whose first bytes have been read ahead.
+type sniffConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *sniffConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// acceptTLS completes the TLS handshake on an incoming recon connection. A
+// plaintext connection is returned as it is if allowed.
+func (p *Peer) acceptTLS(conn net.Conn, id *tlsIdentity) (net.Conn, error) {
+	p.setReadDeadline(conn, defaultTimeout)
+	sc := &sniffConn{Conn: conn, r: bufio.NewReader(conn)}
+	first, err := sc.r.Peek(1)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if first[0] != tlsRecordHandshake {
+		if id.settings.AllowPlaintext {
+			return sc, nil
+		}
+		return nil, errors.New("plaintext recon not allowed")
+	}
+	p.muSettings.RLock()
+	config := id.serverConfig(p.settings.Partners, conn.RemoteAddr())
+	p.muSettings.RUnlock()
+	tlsConn := tls.Server(sc, config)
+	err = tlsConn.Handshake()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return tlsConn, nil
+}
+
+// dial connects to a recon partner, at whichever of its addresses connects
+// first, over TLS if it is configured.
+func (p *Peer) dial(addr net.Addr) (net.Conn, error) {
+	p.muSettings.RLock()
+	partner, ok := p.settings.Partners.byAddr(addr)
+	p.muSettings.RUnlock()
+	addrs := []net.Addr{addr}
+	if ok {
+		// A partner may be reached at any of its addresses.
+		all, err := partner.dialAddrs()
+		if err == nil && len(all) > 0 {
+			addrs = all
+		}
+	}
+	conn, err := dialHappyEyeballs(addrs, happyEyeballsDelay, 30*time.Second)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if p.settings.TLS == nil {
+		return conn, nil
+	}
+	if ok && partner.Plaintext {
+		return conn, nil
+	}
+	id, err := p.settings.TLS.load()
+	if err != nil {
+		conn.Close()
+		return nil, errors.WithStack(err)
+	}
+	config, err := id.clientConfig(partner)
+	if err != nil {
+		conn.Close()
+		return nil, errors.WithStack(err)
+	}
+	tlsConn := tls.Client(conn, config)
+	tlsConn.SetDeadline(time.Now().Add(30 * time.Second))
+	err = tlsConn.Handshake()
+	if err != nil {
+		conn.Close()
+		return nil, errors.Wrapf(err, "TLS handshake with %v failed", addr)
+	}
+	tlsConn.SetDeadline(time.Time{})
+	return tlsConn, nil
+}
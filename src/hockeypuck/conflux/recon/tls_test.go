@@ -0,0 +1,227 @@
+/*
+   conflux - Distributed database synchronization library
+	Based on the algorithm described in
+		"Set Reconciliation with Nearly Optimal	Communication Complexity",
+			Yaron Minsky, Ari Trachtenberg, and Richard Zippel, 2004.
+
+   Copyright (c) 2012-2015  Casey Marshall <cmars@cmarstech.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package recon
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"path/filepath"
+	"time"
+
+	gc "gopkg.in/check.v1"
+)
+
+type TLSSuite struct {
+	dir string
+	ca  *testCert
+}
+
+var _ = gc.Suite(&TLSSuite{})
+
+type testCert struct {
+	cert     *x509.Certificate
+	key      *ecdsa.PrivateKey
+	certFile string
+	keyFile  string
+}
+
+// newTestCert creates a certificate for recon, signed by parent or
+// self-signed if parent is nil.
+func (s *TLSSuite) newTestCert(c *gc.C, name string, parent *testCert) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	c.Assert(err, gc.IsNil)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IsCA:         parent == nil,
+
+		BasicConstraintsValid: true,
+	}
+	signer, signerKey := template, key
+	if parent != nil {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	c.Assert(err, gc.IsNil)
+	cert, err := x509.ParseCertificate(der)
+	c.Assert(err, gc.IsNil)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	c.Assert(err, gc.IsNil)
+
+	tc := &testCert{
+		cert:     cert,
+		key:      key,
+		certFile: filepath.Join(s.dir, name+".crt"),
+		keyFile:  filepath.Join(s.dir, name+".key"),
+	}
+	err = ioutil.WriteFile(tc.certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	c.Assert(err, gc.IsNil)
+	err = ioutil.WriteFile(tc.keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+	c.Assert(err, gc.IsNil)
+	return tc
+}
+
+func (s *TLSSuite) SetUpTest(c *gc.C) {
+	s.dir = c.MkDir()
+	s.ca = s.newTestCert(c, "ca", nil)
+}
+
+func (s *TLSSuite) tlsConfig(tc *testCert) *TLSConfig {
+	return &TLSConfig{Cert: tc.certFile, Key: tc.keyFile}
+}
+
+// serve starts a peer serving recon over TLS and returns its address.
+func (s *TLSSuite) serve(c *gc.C, config *TLSConfig, partners PartnerMap) (*Peer, net.Addr) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, gc.IsNil)
+	addr := ln.Addr()
+	ln.Close()
+
+	settings := DefaultSettings()
+	settings.ReconAddr = addr.String()
+	settings.Partners = partners
+	settings.TLS = config
+	tree := new(MemPrefixTree)
+	tree.Init()
+	peer := NewPeer(settings, tree)
+	peer.StartMode(PeerModeServeOnly)
+	for i := 0; i < 50; i++ {
+		conn, err := net.Dial("tcp", addr.String())
+		if err == nil {
+			conn.Close()
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return peer, addr
+}
+
+// probe probes addr from a peer with the given TLS config.
+func (s *TLSSuite) probe(c *gc.C, config *TLSConfig, addr net.Addr, partner Partner) (*ProbeResult, error) {
+	settings := DefaultSettings()
+	settings.TLS = config
+	partner.ReconAddr = addr.String()
+	settings.Partners["server"] = partner
+	tree := new(MemPrefixTree)
+	tree.Init()
+	peer := NewPeer(settings, tree)
+	return peer.Probe(addr)
+}
+
+func (s *TLSSuite) TestPinned(c *gc.C) {
+	server := s.newTestCert(c, "server", nil)
+	client := s.newTestCert(c, "client", nil)
+	other := s.newTestCert(c, "other", nil)
+
+	peer, addr := s.serve(c, s.tlsConfig(server), PartnerMap{
+		"client":    Partner{ReconAddr: "127.0.0.1:1", TLSPins: []string{CertFingerprint(client.cert)}},
+		"elsewhere": Partner{ReconAddr: "192.0.2.1:1", TLSPins: []string{CertFingerprint(other.cert)}},
+	})
+	defer peer.Stop()
+
+	result, err := s.probe(c, s.tlsConfig(client), addr, Partner{
+		TLSPins: []string{CertFingerprint(server.cert)},
+	})
+	c.Assert(err, gc.IsNil)
+	c.Assert(result.HandshakeErr, gc.IsNil)
+	c.Assert(result.Config.MBar, gc.Equals, DefaultMBar)
+
+	// The server's certificate must be pinned by the client.
+	_, err = s.probe(c, s.tlsConfig(client), addr, Partner{
+		TLSPins: []string{CertFingerprint(other.cert)},
+	})
+	c.Assert(err, gc.ErrorMatches, ".*recon partner certificate .* is not pinned")
+
+	// The client's certificate must be pinned by the server for the
+	// partner at the client's address.
+	_, err = s.probe(c, s.tlsConfig(other), addr, Partner{
+		TLSPins: []string{CertFingerprint(server.cert)},
+	})
+	c.Assert(err, gc.NotNil)
+}
+
+func (s *TLSSuite) TestCA(c *gc.C) {
+	server := s.newTestCert(c, "server", s.ca)
+	client := s.newTestCert(c, "client", s.ca)
+	other := s.newTestCert(c, "other", nil)
+
+	serverConfig := s.tlsConfig(server)
+	serverConfig.CA = s.ca.certFile
+	peer, addr := s.serve(c, serverConfig, nil)
+	defer peer.Stop()
+
+	clientConfig := s.tlsConfig(client)
+	clientConfig.CA = s.ca.certFile
+	result, err := s.probe(c, clientConfig, addr, Partner{})
+	c.Assert(err, gc.IsNil)
+	c.Assert(result.HandshakeErr, gc.IsNil)
+
+	// A certificate from another authority is refused.
+	otherConfig := s.tlsConfig(other)
+	otherConfig.CA = s.ca.certFile
+	_, err = s.probe(c, otherConfig, addr, Partner{})
+	c.Assert(err, gc.NotNil)
+}
+
+func (s *TLSSuite) TestPlaintext(c *gc.C) {
+	server := s.newTestCert(c, "server", nil)
+	config := s.tlsConfig(server)
+	peer, addr := s.serve(c, config, nil)
+	defer peer.Stop()
+
+	_, err := s.probe(c, nil, addr, Partner{})
+	c.Assert(err, gc.NotNil)
+
+	config.AllowPlaintext = true
+	peer2, addr2 := s.serve(c, config, nil)
+	defer peer2.Stop()
+	result, err := s.probe(c, nil, addr2, Partner{})
+	c.Assert(err, gc.IsNil)
+	c.Assert(result.HandshakeErr, gc.IsNil)
+
+	// Partners may be reached without TLS, even when it is configured.
+	client := s.newTestCert(c, "client", nil)
+	result, err = s.probe(c, s.tlsConfig(client), addr2, Partner{Plaintext: true})
+	c.Assert(err, gc.IsNil)
+	c.Assert(result.HandshakeErr, gc.IsNil)
+}
+
+func (s *TLSSuite) TestNormalizePin(c *gc.C) {
+	fp := fmt.Sprintf("%064x", 1)
+	pin, err := normalizePin("00:00:" + fp[4:])
+	c.Assert(err, gc.IsNil)
+	c.Assert(pin, gc.Equals, fp)
+	_, err = normalizePin("abcd")
+	c.Assert(err, gc.ErrorMatches, `invalid certificate fingerprint "abcd"`)
+}
@@ -28,6 +28,11 @@ import (
 	"encoding/hex"
 	"fmt"
 	"math/big"
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
 )
 
 // P_128 defines a finite field Z(P) that includes all 128-bit integers.
@@ -60,12 +65,16 @@ var P_512 = big.NewInt(0).SetBytes([]byte{
 	0xb6, 0x68, 0x3b, 0x65, 0x40, 0x89, 0x18, 0x3e, 0xbd})
 
 // P_SKS is the finite field used by SKS, the Synchronizing Key Server.
+// Products of integers in Z(P_SKS) are computed by a faster routine when the
+// field is given by this pointer rather than by an equal value;
+// recon.NewField normalizes it so.
 var P_SKS *big.Int
 
 var zero = big.NewInt(0)
 
 func init() {
 	P_SKS, _ = big.NewInt(0).SetString("530512889551602322505127520352579437339", 10)
+	initSKS()
 }
 
 // Zp represents a value in the finite field Z(p), an integer in which all
@@ -180,14 +189,65 @@ func (zp *Zp) P() *big.Int {
 
 // FullKeyHash returns Zp in the format of a full-key hash.
 func (zp *Zp) FullKeyHash() string {
-	return hex.EncodeToString(zp.Bytes())
+	return hex.EncodeToString(zp.DigestBytes())
 }
 
-// Bytes returns the byte representation of Zp.
+// Bytes returns the byte representation of Zp: little-endian, without
+// trailing zero bytes. Use WireBytes or DigestBytes for the fixed-width
+// representations exchanged with SKS.
 func (zp *Zp) Bytes() []byte {
 	return reversed(zp.i.Bytes())
 }
 
+// WireLen returns the length of the SKS wire representation of integers in
+// the finite field p.
+func WireLen(p *big.Int) int {
+	return (p.BitLen() + 7) / 8
+}
+
+// DigestLen returns the length of the key digests represented by integers
+// in the finite field p. The field is chosen to be just larger than the
+// digests, so that a digest is one byte shorter than the wire
+// representation. For P_SKS, digests are 16-byte MD5 sums.
+func DigestLen(p *big.Int) int {
+	return WireLen(p) - 1
+}
+
+// WireBytes returns the SKS wire representation of Zp: little-endian and
+// zero-padded to WireLen bytes.
+func (zp *Zp) WireBytes() []byte {
+	buf := make([]byte, WireLen(zp.p))
+	copy(buf, zp.Bytes())
+	return buf
+}
+
+// SetWireBytes sets the integer from its SKS wire representation, which must
+// be exactly WireLen bytes.
+func (zp *Zp) SetWireBytes(b []byte) error {
+	if n := WireLen(zp.p); len(b) != n {
+		return errors.Errorf("invalid wire length %d for Z(p), expected %d", len(b), n)
+	}
+	zp.SetBytes(b)
+	return nil
+}
+
+// DigestBytes returns the key digest represented by Zp: the wire
+// representation without its final byte, which is always zero for a
+// digest.
+func (zp *Zp) DigestBytes() []byte {
+	return zp.WireBytes()[:DigestLen(zp.p)]
+}
+
+// SetDigestBytes sets the integer to represent a key digest, which must be
+// exactly DigestLen bytes.
+func (zp *Zp) SetDigestBytes(b []byte) error {
+	if n := DigestLen(zp.p); len(b) != n {
+		return errors.Errorf("invalid digest length %d for Z(p), expected %d", len(b), n)
+	}
+	zp.SetBytes(b)
+	return nil
+}
+
 // Set sets zp to x and returns zp.
 func (zp *Zp) Set(x *Zp) *Zp {
 	zp.p = x.p
@@ -208,10 +268,25 @@ func (zp *Zp) Copy() *Zp {
 
 // Norm normalizes the integer to its finite field, (mod P).
 func (zp *Zp) Norm() *Zp {
+	if zp.i.Sign() >= 0 && zp.i.Cmp(zp.p) < 0 {
+		return zp
+	}
 	zp.i.Mod(&zp.i, zp.p)
 	return zp
 }
 
+// normSum normalizes the integer after adding or subtracting two integers
+// in the finite field, which leaves it within P of the field, without the
+// division of Norm.
+func (zp *Zp) normSum() {
+	if zp.i.Sign() < 0 {
+		zp.i.Add(&zp.i, zp.p)
+	} else if zp.i.Cmp(zp.p) >= 0 {
+		zp.i.Sub(&zp.i, zp.p)
+	}
+	zp.Norm()
+}
+
 // Cmp compares zp with another integer. See big.Int.Cmp for return value
 // semantics.
 func (zp *Zp) Cmp(x *Zp) int {
@@ -229,7 +304,7 @@ func (zp *Zp) Add(x, y *Zp) *Zp {
 	x.assertP(y.p)
 	zp.p = x.p
 	zp.i.Add(&x.i, &y.i)
-	zp.Norm()
+	zp.normSum()
 	return zp
 }
 
@@ -238,7 +313,7 @@ func (zp *Zp) Sub(x, y *Zp) *Zp {
 	x.assertP(y.p)
 	zp.p = x.p
 	zp.i.Sub(&x.i, &y.i)
-	zp.Norm()
+	zp.normSum()
 	return zp
 }
 
@@ -246,8 +321,13 @@ func (zp *Zp) Sub(x, y *Zp) *Zp {
 func (zp *Zp) Mul(x, y *Zp) *Zp {
 	x.assertP(y.p)
 	zp.p = x.p
-	zp.i.Mul(&x.i, &y.i)
-	zp.Norm()
+	if zp.p == P_SKS && mulSKS(&zp.i, &x.i, &y.i) {
+		return zp
+	}
+	s := scratchPool.Get().(*scratch)
+	s.prod.Mul(&x.i, &y.i)
+	reduce(&zp.i, &s.prod, zp.p, s)
+	scratchPool.Put(s)
 	return zp
 }
 
@@ -274,7 +354,7 @@ func (zp *Zp) Div(x, y *Zp) *Zp {
 // Neg sets the integer to its additive inverse, returning the result.
 func (zp *Zp) Neg() *Zp {
 	zp.i.Sub(zp.p, &zp.i)
-	zp.Norm()
+	zp.normSum()
 	return zp
 }
 
@@ -299,7 +379,7 @@ func (zp *Zp) In(p *big.Int) *Zp {
 
 // assertP asserts an integer is in the expected finite field P.
 func (zp *Zp) assertP(p *big.Int) {
-	if zp.p.Cmp(p) != 0 {
+	if zp.p != p && zp.p.Cmp(p) != 0 {
 		panic(fmt.Sprintf("expect finite field Z(%v), was Z(%v)", p, zp.p))
 	}
 }
@@ -311,6 +391,74 @@ func (zp *Zp) assertEqualP(values ...*Zp) {
 	}
 }
 
+// scratch holds the temporaries of multiplication in a finite field, which
+// are pooled so that the many products computed by interpolation and
+// factoring do not allocate.
+type scratch struct {
+	prod, a, b big.Int
+}
+
+var scratchPool = sync.Pool{
+	New: func() interface{} { return new(scratch) },
+}
+
+// reducer reduces products of integers in the finite field Z(p) by Barrett
+// reduction, which unlike big.Int.Mod does not allocate.
+type reducer struct {
+	p *big.Int
+	k uint
+
+	// mu is floor(4**k / p).
+	mu big.Int
+}
+
+// maxReducers is the most reducers kept, one for each finite field in use.
+// Products in any further fields are reduced by division.
+const maxReducers = 16
+
+var (
+	reducers    sync.Map // *big.Int to *reducer
+	numReducers int32
+)
+
+func reducerFor(p *big.Int) *reducer {
+	if r, ok := reducers.Load(p); ok {
+		return r.(*reducer)
+	}
+	if atomic.LoadInt32(&numReducers) >= maxReducers {
+		return nil
+	}
+	r := &reducer{p: p, k: uint(p.BitLen())}
+	r.mu.Lsh(big.NewInt(1), 2*r.k)
+	r.mu.Div(&r.mu, p)
+	if actual, loaded := reducers.LoadOrStore(p, r); loaded {
+		return actual.(*reducer)
+	}
+	atomic.AddInt32(&numReducers, 1)
+	return r
+}
+
+// reduce sets z to x (mod p), where x is the product of two integers in the
+// finite field Z(p). z may be x.
+func reduce(z, x, p *big.Int, s *scratch) {
+	r := reducerFor(p)
+	if r == nil || x.Sign() < 0 || uint(x.BitLen()) > 2*r.k {
+		z.Mod(x, p)
+		return
+	}
+	s.a.Rsh(x, r.k-1)
+	s.b.Mul(&s.a, &r.mu)
+	s.a.Rsh(&s.b, r.k+1)
+	s.b.Mul(&s.a, p)
+	s.b.Sub(x, &s.b)
+	for s.b.Cmp(p) >= 0 {
+		s.b.Sub(&s.b, p)
+	}
+	// The remainder is set last, so that z needs no more room than any
+	// integer in the field.
+	z.Set(&s.b)
+}
+
 // ZSet is a set of integers in a finite field.
 type ZSet struct {
 	s map[string]*big.Int
@@ -411,7 +559,7 @@ func (zs *ZSet) RemoveAll(other *ZSet) {
 	}
 }
 
-// Items returns a slice of all elements in the set.
+// Items returns a slice of all elements in the set, in ascending order.
 func (zs *ZSet) Items() []Zp {
 	if zs == nil {
 		return nil
@@ -423,22 +571,37 @@ func (zs *ZSet) Items() []Zp {
 		result[i].i.Set(v)
 		i++
 	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].i.Cmp(&result[j].i) < 0
+	})
 	return result
 }
 
-// String returns a string representation of the set.
+// Each calls f with each element in the set, in ascending order, until f
+// returns false.
+func (zs *ZSet) Each(f func(*Zp) bool) {
+	items := zs.Items()
+	for i := range items {
+		if !f(&items[i]) {
+			return
+		}
+	}
+}
+
+// String returns a string representation of the set, in ascending order.
 func (zs *ZSet) String() string {
 	buf := bytes.NewBuffer(nil)
 	fmt.Fprintf(buf, "{")
 	first := true
-	for k, _ := range zs.s {
+	zs.Each(func(z *Zp) bool {
 		if first {
 			first = false
 		} else {
 			fmt.Fprintf(buf, ", ")
 		}
-		fmt.Fprintf(buf, "%v", k)
-	}
+		fmt.Fprintf(buf, "%v", z)
+		return true
+	})
 	fmt.Fprintf(buf, "}")
 	return string(buf.Bytes())
 }
@@ -463,6 +626,33 @@ func (zp ZpSlice) String() string {
 	return string(buf.Bytes())
 }
 
+// WireBytes returns the concatenated SKS wire representations of the
+// integers in the slice.
+func (zp ZpSlice) WireBytes() []byte {
+	var buf []byte
+	for i := range zp {
+		buf = append(buf, zp[i].WireBytes()...)
+	}
+	return buf
+}
+
+// ZpSliceWire returns the integers in the finite field p from their
+// concatenated SKS wire representations.
+func ZpSliceWire(p *big.Int, b []byte) (ZpSlice, error) {
+	n := WireLen(p)
+	if len(b)%n != 0 {
+		return nil, errors.Errorf("invalid wire length %d for Z(p) elements of %d bytes", len(b), n)
+	}
+	result := make(ZpSlice, len(b)/n)
+	for i := range result {
+		err := result[i].In(p).SetWireBytes(b[i*n : (i+1)*n])
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+	}
+	return result, nil
+}
+
 // ZSetDiff returns the set difference between two ZSets:
 // the set of all Z(p) in a that are not in b.
 func ZSetDiff(a *ZSet, b *ZSet) *ZSet {
@@ -480,3 +670,29 @@ func ZSetDiff(a *ZSet, b *ZSet) *ZSet {
 	}
 	return result
 }
+
+// ZSetIntersect returns the set intersection of two ZSets:
+// the set of all Z(p) in both a and b.
+func ZSetIntersect(a *ZSet, b *ZSet) *ZSet {
+	result := NewZSet()
+	if a.p != nil {
+		result.p = a.p
+	} else if b.p != nil {
+		result.p = b.p
+	}
+	for k, v := range a.s {
+		_, has := b.s[k]
+		if has {
+			result.s[k] = v
+		}
+	}
+	return result
+}
+
+// ZSetSymmetricDiff returns the symmetric difference of two ZSets:
+// the set of all Z(p) in either a or b, but not both.
+func ZSetSymmetricDiff(a *ZSet, b *ZSet) *ZSet {
+	result := ZSetDiff(a, b)
+	result.AddAll(ZSetDiff(b, a))
+	return result
+}
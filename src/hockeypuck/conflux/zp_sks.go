@@ -0,0 +1,175 @@
+/*
+   conflux - Distributed database synchronization library
+	Based on the algorithm described in
+		"Set Reconciliation with Nearly Optimal	Communication Complexity",
+			Yaron Minsky, Ari Trachtenberg, and Richard Zippel, 2004.
+
+   Copyright (c) 2012-2015  Casey Marshall <cmars@cmarstech.com>
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU General Public License as published by
+   the Free Software Foundation, either version 3 of the License, or
+   (at your option) any later version.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU General Public License for more details.
+
+   You should have received a copy of the GNU General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package conflux
+
+import (
+	"math/big"
+	"math/bits"
+)
+
+// sksWords is the number of 64-bit words holding an integer in Z(P_SKS),
+// which is a 129-bit prime.
+const sksWords = 3
+
+// sks holds the constants for multiplying in Z(P_SKS) with fixed-width
+// words, which is much faster than with big.Int, and does not allocate.
+// Products are reduced by Barrett reduction.
+var sks struct {
+	p [sksWords]uint64
+
+	// k is the length of P_SKS in bits.
+	k uint
+
+	// mu is floor(4**k / P_SKS).
+	mu [sksWords]uint64
+}
+
+func initSKS() {
+	copyWords(sks.p[:], P_SKS)
+	sks.k = uint(P_SKS.BitLen())
+	var mu big.Int
+	mu.Lsh(big.NewInt(1), 2*sks.k)
+	mu.Div(&mu, P_SKS)
+	copyWords(sks.mu[:], &mu)
+}
+
+// copyWords copies the words of x, which must fit, to w.
+func copyWords(w []uint64, x *big.Int) {
+	for i := range w {
+		w[i] = 0
+	}
+	for i, v := range x.Bits() {
+		w[i] = uint64(v)
+	}
+}
+
+// sksLess returns whether x < y.
+func sksLess(x, y *[sksWords]uint64) bool {
+	for i := sksWords - 1; i >= 0; i-- {
+		if x[i] != y[i] {
+			return x[i] < y[i]
+		}
+	}
+	return false
+}
+
+// sksMulWords returns the full product of x and y.
+func sksMulWords(x, y *[sksWords]uint64) (z [2 * sksWords]uint64) {
+	for i := 0; i < sksWords; i++ {
+		var carry uint64
+		for j := 0; j < sksWords; j++ {
+			hi, lo := bits.Mul64(x[i], y[j])
+			var c uint64
+			lo, c = bits.Add64(lo, z[i+j], 0)
+			hi += c
+			lo, c = bits.Add64(lo, carry, 0)
+			hi += c
+			z[i+j] = lo
+			carry = hi
+		}
+		z[i+sksWords] = carry
+	}
+	return z
+}
+
+// sksMulLow returns the low words of the product of x and y.
+func sksMulLow(x, y *[sksWords]uint64) (z [sksWords]uint64) {
+	for i := 0; i < sksWords; i++ {
+		var carry uint64
+		for j := 0; i+j < sksWords; j++ {
+			hi, lo := bits.Mul64(x[i], y[j])
+			var c uint64
+			lo, c = bits.Add64(lo, z[i+j], 0)
+			hi += c
+			lo, c = bits.Add64(lo, carry, 0)
+			hi += c
+			z[i+j] = lo
+			carry = hi
+		}
+	}
+	return z
+}
+
+// sksSub sets x to x - y, modulo 2**192.
+func sksSub(x, y *[sksWords]uint64) {
+	var borrow uint64
+	for i := 0; i < sksWords; i++ {
+		x[i], borrow = bits.Sub64(x[i], y[i], borrow)
+	}
+}
+
+// sksShift returns the low words of x >> n.
+func sksShift(x *[2 * sksWords]uint64, n uint) (z [sksWords]uint64) {
+	w, b := n/64, n%64
+	for i := 0; i < sksWords; i++ {
+		j := int(w) + i
+		if j < len(x) {
+			z[i] = x[j] >> b
+		}
+		if b > 0 && j+1 < len(x) {
+			z[i] |= x[j+1] << (64 - b)
+		}
+	}
+	return z
+}
+
+// mulSKS sets z to x * y in Z(P_SKS), returning false if x or y are not
+// integers in the field, or words are not 64 bits wide, in which case the
+// product must be computed with big.Int. z may be x or y.
+func mulSKS(z, x, y *big.Int) bool {
+	if bits.UintSize != 64 || x.Sign() < 0 || y.Sign() < 0 ||
+		len(x.Bits()) > sksWords || len(y.Bits()) > sksWords {
+		return false
+	}
+	var xw, yw [sksWords]uint64
+	copyWords(xw[:], x)
+	copyWords(yw[:], y)
+	if !sksLess(&xw, &sks.p) || !sksLess(&yw, &sks.p) {
+		return false
+	}
+
+	// Barrett reduction: q estimates prod / P_SKS, short by at most two,
+	// so the remainder is less than 3*P_SKS and fits in the low words.
+	prod := sksMulWords(&xw, &yw)
+	q1 := sksShift(&prod, sks.k-1)
+	q2 := sksMulWords(&q1, &sks.mu)
+	q3 := sksShift(&q2, sks.k+1)
+	qp := sksMulLow(&q3, &sks.p)
+	var r [sksWords]uint64
+	copy(r[:], prod[:sksWords])
+	sksSub(&r, &qp)
+	for !sksLess(&r, &sks.p) {
+		sksSub(&r, &sks.p)
+	}
+
+	words := z.Bits()
+	if cap(words) < sksWords {
+		words = make([]big.Word, sksWords)
+	}
+	words = words[:sksWords]
+	for i := range words {
+		words[i] = big.Word(r[i])
+	}
+	z.SetBits(words)
+	return true
+}
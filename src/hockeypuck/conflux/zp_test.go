@@ -23,7 +23,9 @@
 package conflux
 
 import (
+	"encoding/hex"
 	"math/big"
+	"testing"
 
 	gc "gopkg.in/check.v1"
 )
@@ -80,6 +82,76 @@ func (s *ZpSuite) TestMul(c *gc.C) {
 	c.Assert(int64(1), gc.Equals, a.Int64())
 }
 
+func (s *ZpSuite) TestMulReduce(c *gc.C) {
+	for _, p := range []*big.Int{big.NewInt(97), P_SKS, P_128, P_160, P_256, P_512} {
+		for i := 0; i < 1000; i++ {
+			x, y := Zrand(p), Zrand(p)
+			var expect big.Int
+			expect.Mul(&x.i, &y.i)
+			expect.Mod(&expect, p)
+			c.Assert(Z(p).Mul(x, y).i.Cmp(&expect), gc.Equals, 0, gc.Commentf("%v * %v in Z(%v)", x, y, p))
+			// In place
+			c.Assert(x.Mul(x, y).i.Cmp(&expect), gc.Equals, 0)
+		}
+		max := Zi(p, -1)
+		c.Assert(Z(p).Mul(max, max).Int64(), gc.Equals, int64(1))
+	}
+}
+
+func (s *ZpSuite) TestMulSKS(c *gc.C) {
+	pm1 := Zi(P_SKS, -1)
+	values := []*Zp{Zi(P_SKS, 0), Zi(P_SKS, 1), Zi(P_SKS, 2), pm1}
+	for i := 0; i < 100; i++ {
+		values = append(values, Zrand(P_SKS))
+	}
+	for _, x := range values {
+		for _, y := range values {
+			var z, expect big.Int
+			c.Assert(mulSKS(&z, &x.i, &y.i), gc.Equals, true)
+			expect.Mul(&x.i, &y.i)
+			expect.Mod(&expect, P_SKS)
+			c.Assert(z.Cmp(&expect), gc.Equals, 0, gc.Commentf("%v * %v", x, y))
+		}
+	}
+	// P_SKS given by value is multiplied in by the general routine.
+	pSKS := new(big.Int).Set(P_SKS)
+	for _, x := range values[:8] {
+		for _, y := range values[:8] {
+			z := Z(pSKS).Mul(Zb(pSKS, x.Bytes()), Zb(pSKS, y.Bytes()))
+			c.Assert(z.i.Cmp(&Z(P_SKS).Mul(x, y).i), gc.Equals, 0, gc.Commentf("%v * %v", x, y))
+		}
+	}
+	// Integers outside the field are left to big.Int.
+	var z big.Int
+	c.Assert(mulSKS(&z, P_SKS, &pm1.i), gc.Equals, false)
+	c.Assert(mulSKS(&z, big.NewInt(-1), &pm1.i), gc.Equals, false)
+}
+
+func (s *ZpSuite) BenchmarkMulSKS(c *gc.C) {
+	x, y := Zrand(P_SKS), Zrand(P_SKS)
+	for i := 0; i < c.N; i++ {
+		x.Mul(x, y)
+	}
+}
+
+func (s *ZpSuite) BenchmarkMul128(c *gc.C) {
+	x, y := Zrand(P_128), Zrand(P_128)
+	for i := 0; i < c.N; i++ {
+		x.Mul(x, y)
+	}
+}
+
+func (s *ZpSuite) TestArithmeticAllocs(c *gc.C) {
+	x, y := Zrand(P_SKS), Zrand(P_SKS)
+	z := Z(P_SKS).Mul(x, y)
+	allocs := testing.AllocsPerRun(100, func() {
+		z.Add(z, x)
+		z.Sub(z, y)
+		z.Mul(z, x)
+	})
+	c.Assert(allocs, gc.Equals, float64(0))
+}
+
 func (s *ZpSuite) TestDiv(c *gc.C) {
 	// in Z(5), 1 / 2 = 3 because 3 * 2 = 1.
 	a := zp5(1)
@@ -172,6 +244,38 @@ func (s *ZpSuite) TestZSetDiff(c *gc.C) {
 	c.Assert(zs4.Items(), gc.HasLen, 1)
 }
 
+func (s *ZpSuite) TestZSetSorted(c *gc.C) {
+	zs := NewZSet(Zi(P_SKS, 65541), Zi(P_SKS, 3), Zi(P_SKS, 65537), Zi(P_SKS, 256))
+	c.Assert(zs.Items(), gc.DeepEquals, []Zp{
+		*Zi(P_SKS, 3), *Zi(P_SKS, 256), *Zi(P_SKS, 65537), *Zi(P_SKS, 65541)})
+	c.Assert(zs.String(), gc.Equals, "{3, 256, 65537, 65541}")
+
+	var seen []int64
+	zs.Each(func(z *Zp) bool {
+		seen = append(seen, z.Int64())
+		return len(seen) < 2
+	})
+	c.Assert(seen, gc.DeepEquals, []int64{3, 256})
+}
+
+func (s *ZpSuite) TestZSetIntersect(c *gc.C) {
+	zs1 := NewZSet(Zi(P_SKS, 65537), Zi(P_SKS, 65539))
+	zs2 := NewZSet(Zi(P_SKS, 65537), Zi(P_SKS, 65541))
+	c.Assert(ZSetIntersect(zs1, zs2).Equal(NewZSet(Zi(P_SKS, 65537))), gc.Equals, true)
+	c.Assert(ZSetIntersect(zs2, zs1).Equal(NewZSet(Zi(P_SKS, 65537))), gc.Equals, true)
+	c.Assert(ZSetIntersect(zs1, NewZSet()).Len(), gc.Equals, 0)
+}
+
+func (s *ZpSuite) TestZSetSymmetricDiff(c *gc.C) {
+	zs1 := NewZSet(Zi(P_SKS, 65537), Zi(P_SKS, 65539))
+	zs2 := NewZSet(Zi(P_SKS, 65537), Zi(P_SKS, 65541))
+	expect := NewZSet(Zi(P_SKS, 65539), Zi(P_SKS, 65541))
+	c.Assert(ZSetSymmetricDiff(zs1, zs2).Equal(expect), gc.Equals, true)
+	c.Assert(ZSetSymmetricDiff(zs2, zs1).Equal(expect), gc.Equals, true)
+	c.Assert(ZSetSymmetricDiff(zs1, zs1).Len(), gc.Equals, 0)
+	c.Assert(ZSetSymmetricDiff(zs1, NewZSet()).Equal(zs1), gc.Equals, true)
+}
+
 func (s *ZpSuite) TestZSetDiffEmpty(c *gc.C) {
 	zs1 := NewZSet(Zi(P_SKS, 65537), Zi(P_SKS, 65539))
 	zs2 := NewZSet()
@@ -196,3 +300,67 @@ func (s *ZpSuite) TestByteRtt(c *gc.C) {
 	z2 := Zb(P_SKS, z.Bytes())
 	c.Assert(z.Bytes(), gc.DeepEquals, z2.Bytes())
 }
+
+// sksVectors are key digests and the integers SKS represents them by,
+// reading each digest as a little-endian number.
+var sksVectors = []struct {
+	digest, value string
+}{
+	{"da84f40d830a7be2a3c0b7f2e146bfaa", "226961925653542187316360787891122898138"},
+	{"00000000000000000000000000000001", "1329227995784915872903807060280344576"},
+	{"0100000000000000000000000000000f", "19938419936773738093557105904205168641"},
+	// Digests ending in zero bytes lose them in Bytes.
+	{"ffffffffffffffffffffffffffffff00", "1329227995784915872903807060280344575"},
+	{"ffffffffffffffffffffffffffffffff", "340282366920938463463374607431768211455"},
+}
+
+func (s *ZpSuite) TestDigestBytes(c *gc.C) {
+	c.Assert(WireLen(P_SKS), gc.Equals, 17)
+	c.Assert(DigestLen(P_SKS), gc.Equals, 16)
+	for i, v := range sksVectors {
+		c.Logf("test#%d: %s", i, v.digest)
+		digest, err := hex.DecodeString(v.digest)
+		c.Assert(err, gc.IsNil)
+		z := Z(P_SKS)
+		c.Assert(z.SetDigestBytes(digest), gc.IsNil)
+		c.Assert(z.String(), gc.Equals, v.value)
+		c.Assert(z.DigestBytes(), gc.DeepEquals, digest)
+		c.Assert(z.FullKeyHash(), gc.Equals, v.digest)
+		c.Assert(z.WireBytes(), gc.DeepEquals, append(digest, 0))
+
+		z2 := Z(P_SKS)
+		c.Assert(z2.SetWireBytes(z.WireBytes()), gc.IsNil)
+		c.Assert(z2.Cmp(Zs(P_SKS, v.value)), gc.Equals, 0)
+	}
+}
+
+func (s *ZpSuite) TestWireBytes(c *gc.C) {
+	// The largest element uses the final byte.
+	z := Zi(P_SKS, -1)
+	c.Assert(hex.EncodeToString(z.WireBytes()), gc.Equals, "1a43a530d9851fc9df1f8b87e4101d8f01")
+	c.Assert(Zi(P_SKS, 0).WireBytes(), gc.DeepEquals, make([]byte, 17))
+
+	// Values are reduced mod P.
+	buf, err := hex.DecodeString("1b43a530d9851fc9df1f8b87e4101d8f01")
+	c.Assert(err, gc.IsNil)
+	c.Assert(z.SetWireBytes(buf), gc.IsNil)
+	c.Assert(z.IsZero(), gc.Equals, true)
+
+	c.Assert(z.SetWireBytes(buf[:16]), gc.ErrorMatches, "invalid wire length 16.*")
+	c.Assert(z.SetDigestBytes(buf), gc.ErrorMatches, "invalid digest length 17.*")
+}
+
+func (s *ZpSuite) TestZpSliceWire(c *gc.C) {
+	zs := ZpSlice{*Zi(P_SKS, 1), *Zi(P_SKS, -1), *Zi(P_SKS, 0)}
+	buf := zs.WireBytes()
+	c.Assert(buf, gc.HasLen, 3*17)
+	zs2, err := ZpSliceWire(P_SKS, buf)
+	c.Assert(err, gc.IsNil)
+	c.Assert(zs2, gc.HasLen, 3)
+	for i := range zs {
+		c.Assert(zs2[i].Cmp(&zs[i]), gc.Equals, 0)
+	}
+
+	_, err = ZpSliceWire(P_SKS, buf[1:])
+	c.Assert(err, gc.ErrorMatches, "invalid wire length 50.*")
+}
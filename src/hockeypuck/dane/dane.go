@@ -0,0 +1,147 @@
+// Package dane publishes keys in the DNS as OPENPGPKEY records (RFC 7929),
+// so that DANE-based key discovery can be driven from the key database.
+//
+// Each record holds a key reduced to its self-signatures and the single user
+// ID for the address. Addresses are lower-cased before their local part is
+// hashed, so clients must look up the lower-cased form of an address.
+package dane
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"hockeypuck/openpgp"
+)
+
+// Record is an OPENPGPKEY resource record.
+type Record struct {
+	// Owner is the fully-qualified owner name of the record.
+	Owner string
+
+	// Address is the email address published.
+	Address string
+
+	// Fingerprint is that of the published key.
+	Fingerprint string
+
+	// Key is the minimal transferable public key.
+	Key []byte
+}
+
+// OwnerName returns the owner name of the OPENPGPKEY records for an address:
+// the first 28 octets of the SHA-256 digest of its local part, in hex, as a
+// label under _openpgpkey in its domain.
+func OwnerName(addr string) (string, error) {
+	at := strings.LastIndex(addr, "@")
+	if at < 1 || at == len(addr)-1 {
+		return "", errors.Errorf("invalid address %q", addr)
+	}
+	digest := sha256.Sum256([]byte(addr[:at]))
+	return fmt.Sprintf("%s._openpgpkey.%s.", hex.EncodeToString(digest[:28]), strings.TrimSuffix(addr[at+1:], ".")), nil
+}
+
+// Records returns the records for every address in one of domains on the
+// given keys. Revoked and expired keys, and user IDs without a valid
+// self-signature, are not published.
+func Records(keys []*openpgp.PrimaryKey, domains []string) ([]Record, error) {
+	inDomain := map[string]bool{}
+	for _, domain := range domains {
+		inDomain[strings.ToLower(strings.TrimSuffix(domain, "."))] = true
+	}
+
+	var result []Record
+	for _, key := range keys {
+		if key.Revoked() || key.Expired() {
+			continue
+		}
+		addrs := map[string]bool{}
+		for _, uid := range key.UserIDs {
+			addr := uid.Address()
+			if !inDomain[addr[strings.LastIndex(addr, "@")+1:]] {
+				continue
+			}
+			selfSigs, _ := uid.SigInfo(key)
+			if selfSigs.Valid() {
+				addrs[addr] = true
+			}
+		}
+		if len(addrs) == 0 {
+			continue
+		}
+
+		var full bytes.Buffer
+		err := openpgp.WritePackets(&full, key)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		for addr := range addrs {
+			record, err := newRecord(full.Bytes(), addr)
+			if err != nil {
+				return nil, errors.Wrapf(err, "key %s", key.Fingerprint())
+			}
+			result = append(result, *record)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Owner != result[j].Owner {
+			return result[i].Owner < result[j].Owner
+		}
+		return result[i].Fingerprint < result[j].Fingerprint
+	})
+	return result, nil
+}
+
+// newRecord returns the record publishing a copy of the serialized key
+// reduced to the user ID for addr.
+func newRecord(keyBytes []byte, addr string) (*Record, error) {
+	keys, err := openpgp.NewKeyReader(bytes.NewReader(keyBytes)).Read()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if len(keys) != 1 {
+		return nil, errors.Errorf("expected one key, got %d", len(keys))
+	}
+	key := keys[0]
+	_, err = openpgp.Minimize(key, func(uid *openpgp.UserID) bool {
+		return uid.Address() == addr
+	})
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	owner, err := OwnerName(addr)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	var buf bytes.Buffer
+	err = openpgp.WritePackets(&buf, key)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return &Record{
+		Owner:       owner,
+		Address:     addr,
+		Fingerprint: key.Fingerprint(),
+		Key:         buf.Bytes(),
+	}, nil
+}
+
+// WriteZone writes records in zone file format, each preceded by a comment
+// naming its address and key.
+func WriteZone(w io.Writer, records []Record, ttl int) error {
+	for _, r := range records {
+		_, err := fmt.Fprintf(w, "; %s %s\n%s %d IN OPENPGPKEY %s\n",
+			r.Address, r.Fingerprint, r.Owner, ttl, base64.StdEncoding.EncodeToString(r.Key))
+		if err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,89 @@
+package dane
+
+import (
+	"bytes"
+	"encoding/base64"
+	"strings"
+	stdtesting "testing"
+
+	gc "gopkg.in/check.v1"
+
+	"hockeypuck/openpgp"
+	"hockeypuck/testing"
+)
+
+func Test(t *stdtesting.T) { gc.TestingT(t) }
+
+type DANESuite struct{}
+
+var _ = gc.Suite(&DANESuite{})
+
+func (s *DANESuite) TestOwnerName(c *gc.C) {
+	// Example from RFC 7929, section 3.
+	owner, err := OwnerName("hugh@example.com")
+	c.Assert(err, gc.IsNil)
+	c.Assert(owner, gc.Equals, "c93f1e400f26708f98cb19d936620da35eec8f72e57f9eec01c1afd6._openpgpkey.example.com.")
+
+	for _, addr := range []string{"hugh", "@example.com", "hugh@"} {
+		_, err = OwnerName(addr)
+		c.Assert(err, gc.NotNil, gc.Commentf("%q", addr))
+	}
+}
+
+func (s *DANESuite) TestRecords(c *gc.C) {
+	keys := openpgp.MustReadArmorKeys(testing.MustInput("alice_signed.asc"))
+	keys = append(keys, openpgp.MustReadArmorKeys(testing.MustInput("ecc_keys.asc"))...)
+
+	records, err := Records(keys, []string{"Example.com."})
+	c.Assert(err, gc.IsNil)
+	c.Assert(records, gc.HasLen, 7)
+	for i := 1; i < len(records); i++ {
+		c.Assert(records[i-1].Owner < records[i].Owner, gc.Equals, true)
+	}
+
+	var alice *Record
+	for i := range records {
+		if records[i].Address == "alice@example.com" {
+			alice = &records[i]
+		}
+	}
+	c.Assert(alice, gc.NotNil)
+	owner, err := OwnerName("alice@example.com")
+	c.Assert(err, gc.IsNil)
+	c.Assert(alice.Owner, gc.Equals, owner)
+	published := openpgp.MustReadKeys(bytes.NewBuffer(alice.Key))
+	c.Assert(published, gc.HasLen, 1)
+	c.Assert(published[0].Fingerprint(), gc.Equals, "10fe8cf1b483f7525039aa2a361bc1f023e0dcca")
+	c.Assert(published[0].UserIDs, gc.HasLen, 1)
+	for _, sig := range published[0].UserIDs[0].Signatures {
+		c.Assert(sig.RIssuerKeyID, gc.Equals, published[0].RKeyID)
+	}
+
+	records, err = Records(keys, []string{"example.org"})
+	c.Assert(err, gc.IsNil)
+	c.Assert(records, gc.HasLen, 0)
+}
+
+func (s *DANESuite) TestRecordsRevoked(c *gc.C) {
+	keys := openpgp.MustReadArmorKeys(testing.MustInput("test-key-revoked.asc"))
+	records, err := Records(keys, []string{"example.org"})
+	c.Assert(err, gc.IsNil)
+	c.Assert(records, gc.HasLen, 0)
+}
+
+func (s *DANESuite) TestWriteZone(c *gc.C) {
+	var buf bytes.Buffer
+	err := WriteZone(&buf, []Record{{
+		Owner:       "c93f1e400f26708f98cb19d936620da35eec8f72e57f9eec01c1afd6._openpgpkey.example.com.",
+		Address:     "hugh@example.com",
+		Fingerprint: "abcd",
+		Key:         []byte("key"),
+	}}, 3600)
+	c.Assert(err, gc.IsNil)
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	c.Assert(lines, gc.DeepEquals, []string{
+		"; hugh@example.com abcd",
+		"c93f1e400f26708f98cb19d936620da35eec8f72e57f9eec01c1afd6._openpgpkey.example.com. 3600 IN OPENPGPKEY " +
+			base64.StdEncoding.EncodeToString([]byte("key")),
+	})
+}
@@ -0,0 +1,278 @@
+// Package deprecation marks legacy endpoints and parameters as deprecated,
+// so that operators can measure who still uses them before retiring them.
+//
+// Requests matching a configured rule are served as usual, with Deprecation
+// and, if a retirement date is set, Sunset headers (RFC 9745 and RFC 8594).
+// Each such request is counted by rule and by the client software named in
+// its User-Agent.
+package deprecation
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const DefaultMaxClients = 100
+
+// otherClients counts the clients of a rule beyond MaxClients.
+const otherClients = "other"
+
+type Settings struct {
+	Rules []Rule `toml:"rule"`
+
+	// MaxClients limits the number of distinct clients counted for each
+	// rule. Further clients are counted together.
+	MaxClients int `toml:"maxClients"`
+}
+
+func DefaultSettings() *Settings {
+	return &Settings{
+		MaxClients: DefaultMaxClients,
+	}
+}
+
+// Rule describes deprecated requests. For example, short key ID lookups are
+// matched by path "/pks/lookup", param "search" and pattern
+// "^(0x)?[0-9a-fA-F]{8}$".
+type Rule struct {
+	// Name identifies the rule in metrics and usage reports.
+	Name string `toml:"name"`
+
+	// Path is the request path, such as "/pks/lookup".
+	Path string `toml:"path"`
+
+	// Method restricts the rule to one request method, if set.
+	Method string `toml:"method"`
+
+	// Param restricts the rule to requests with this query or form
+	// parameter, if set.
+	Param string `toml:"param"`
+
+	// Pattern is a regular expression which the value of Param must match,
+	// if set.
+	Pattern string `toml:"pattern"`
+
+	// Since is when the behavior was deprecated, as an RFC 3339 time or a
+	// date such as "2024-01-31". If empty, requests are only marked as
+	// deprecated.
+	Since string `toml:"since"`
+
+	// Sunset is when the behavior is to be retired, in the same format.
+	Sunset string `toml:"sunset"`
+
+	// Link is the URL of documentation about the deprecation.
+	Link string `toml:"link"`
+}
+
+type rule struct {
+	Rule
+	pattern *regexp.Regexp
+	since   time.Time
+	sunset  time.Time
+	clients map[string]int
+}
+
+func parseTime(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err == nil {
+		return t, nil
+	}
+	return time.Parse("2006-01-02", s)
+}
+
+func newRule(r Rule) (*rule, error) {
+	if r.Name == "" {
+		return nil, errors.New("deprecation rule has no name")
+	}
+	if r.Path == "" {
+		return nil, errors.Errorf("deprecation rule %q has no path", r.Name)
+	}
+	result := &rule{Rule: r, clients: map[string]int{}}
+	var err error
+	if r.Pattern != "" {
+		if r.Param == "" {
+			return nil, errors.Errorf("deprecation rule %q has a pattern but no param", r.Name)
+		}
+		result.pattern, err = regexp.Compile(r.Pattern)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid pattern for deprecation rule %q", r.Name)
+		}
+	}
+	result.since, err = parseTime(r.Since)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid since time for deprecation rule %q", r.Name)
+	}
+	result.sunset, err = parseTime(r.Sunset)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid sunset time for deprecation rule %q", r.Name)
+	}
+	return result, nil
+}
+
+func (r *rule) match(req *http.Request) bool {
+	if req.URL.Path != r.Path {
+		return false
+	}
+	if r.Method != "" && !strings.EqualFold(req.Method, r.Method) {
+		return false
+	}
+	if r.Param == "" {
+		return true
+	}
+	values, ok := req.URL.Query()[r.Param]
+	if !ok {
+		return false
+	}
+	if r.pattern == nil {
+		return true
+	}
+	for _, v := range values {
+		if r.pattern.MatchString(v) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *rule) setHeaders(h http.Header) {
+	if r.since.IsZero() {
+		h.Set("Deprecation", "true")
+	} else {
+		h.Set("Deprecation", fmt.Sprintf("@%d", r.since.Unix()))
+	}
+	if !r.sunset.IsZero() {
+		h.Set("Sunset", r.sunset.UTC().Format(http.TimeFormat))
+	}
+	if r.Link != "" {
+		h.Add("Link", fmt.Sprintf("<%s>; rel=\"deprecation\"", r.Link))
+	}
+}
+
+// Deprecations marks and counts requests matching deprecation rules.
+type Deprecations struct {
+	maxClients int
+
+	mu    sync.Mutex
+	rules []*rule
+}
+
+// New returns the deprecations configured by settings, or nil if there are
+// none.
+func New(settings *Settings) (*Deprecations, error) {
+	if settings == nil || len(settings.Rules) == 0 {
+		return nil, nil
+	}
+	registerMetrics()
+	d := &Deprecations{maxClients: settings.MaxClients}
+	if d.maxClients <= 0 {
+		d.maxClients = DefaultMaxClients
+	}
+	names := map[string]bool{}
+	for _, r := range settings.Rules {
+		if names[r.Name] {
+			return nil, errors.Errorf("duplicate deprecation rule %q", r.Name)
+		}
+		names[r.Name] = true
+		rule, err := newRule(r)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		d.rules = append(d.rules, rule)
+	}
+	return d, nil
+}
+
+// clientName returns the client software named by a User-Agent header: its
+// first product token, without the version.
+func clientName(userAgent string) string {
+	fields := strings.Fields(userAgent)
+	if len(fields) == 0 {
+		return "unknown"
+	}
+	name := strings.ToLower(strings.SplitN(fields[0], "/", 2)[0])
+	if len(name) > 64 {
+		name = name[:64]
+	}
+	if name == "" {
+		return "unknown"
+	}
+	return name
+}
+
+// Handler marks responses to requests which match a rule as deprecated and
+// counts them, before passing them to next. The first matching rule
+// applies. It may be called on nil Deprecations.
+func (d *Deprecations) Handler(next http.Handler) http.Handler {
+	if d == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, rule := range d.rules {
+			if rule.match(r) {
+				rule.setHeaders(w.Header())
+				d.record(rule, clientName(r.UserAgent()))
+				break
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (d *Deprecations) record(r *rule, client string) {
+	d.mu.Lock()
+	if _, ok := r.clients[client]; !ok && len(r.clients) >= d.maxClients {
+		client = otherClients
+	}
+	r.clients[client]++
+	d.mu.Unlock()
+	deprecationMetrics.requests.WithLabelValues(r.Name, client).Inc()
+}
+
+// ClientUsage is the number of deprecated requests made by a client.
+type ClientUsage struct {
+	Client   string `json:"client"`
+	Requests int    `json:"requests"`
+}
+
+// RuleUsage reports the use of a deprecated behavior since startup.
+type RuleUsage struct {
+	Name    string        `json:"name"`
+	Sunset  string        `json:"sunset,omitempty"`
+	Clients []ClientUsage `json:"clients"`
+}
+
+// Usage returns the requests matching each rule since startup, by client,
+// with the busiest clients first.
+func (d *Deprecations) Usage() []RuleUsage {
+	if d == nil {
+		return nil
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var result []RuleUsage
+	for _, r := range d.rules {
+		usage := RuleUsage{Name: r.Name, Sunset: r.Sunset, Clients: []ClientUsage{}}
+		for client, n := range r.clients {
+			usage.Clients = append(usage.Clients, ClientUsage{Client: client, Requests: n})
+		}
+		sort.Slice(usage.Clients, func(i, j int) bool {
+			a, b := usage.Clients[i], usage.Clients[j]
+			if a.Requests != b.Requests {
+				return a.Requests > b.Requests
+			}
+			return a.Client < b.Client
+		})
+		result = append(result, usage)
+	}
+	return result
+}
@@ -0,0 +1,109 @@
+package deprecation
+
+import (
+	"net/http"
+	"net/http/httptest"
+	stdtesting "testing"
+
+	gc "gopkg.in/check.v1"
+)
+
+func Test(t *stdtesting.T) { gc.TestingT(t) }
+
+type DeprecationSuite struct{}
+
+var _ = gc.Suite(&DeprecationSuite{})
+
+var shortKeyID = Rule{
+	Name:    "short-keyid",
+	Path:    "/pks/lookup",
+	Param:   "search",
+	Pattern: "^(0x)?[0-9a-fA-F]{8}$",
+	Since:   "2024-01-01",
+	Sunset:  "2025-01-01T00:00:00Z",
+	Link:    "https://example.com/short-keyids",
+}
+
+func serve(h http.Handler, target, userAgent string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("GET", target, nil)
+	if userAgent != "" {
+		req.Header.Set("User-Agent", userAgent)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	return w
+}
+
+var ok = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+})
+
+func (s *DeprecationSuite) TestHeaders(c *gc.C) {
+	d, err := New(&Settings{Rules: []Rule{shortKeyID, {Name: "stats", Path: "/pks/stats"}}})
+	c.Assert(err, gc.IsNil)
+	h := d.Handler(ok)
+
+	w := serve(h, "/pks/lookup?op=get&search=0x23E0DCCA", "GnuPG/2.2.40")
+	c.Assert(w.Code, gc.Equals, http.StatusOK)
+	c.Assert(w.Header().Get("Deprecation"), gc.Equals, "@1704067200")
+	c.Assert(w.Header().Get("Sunset"), gc.Equals, "Wed, 01 Jan 2025 00:00:00 GMT")
+	c.Assert(w.Header().Get("Link"), gc.Equals, `<https://example.com/short-keyids>; rel="deprecation"`)
+
+	w = serve(h, "/pks/stats", "")
+	c.Assert(w.Header().Get("Deprecation"), gc.Equals, "true")
+	c.Assert(w.Header().Get("Sunset"), gc.Equals, "")
+
+	for _, target := range []string{
+		"/pks/lookup?op=get&search=0x361BC1F023E0DCCA",
+		"/pks/lookup?op=get&search=alice",
+		"/pks/lookup?op=stats",
+		"/pks/add",
+	} {
+		w = serve(h, target, "GnuPG/2.2.40")
+		c.Check(w.Header().Get("Deprecation"), gc.Equals, "", gc.Commentf("%s", target))
+	}
+}
+
+func (s *DeprecationSuite) TestUsage(c *gc.C) {
+	d, err := New(&Settings{Rules: []Rule{shortKeyID}, MaxClients: 2})
+	c.Assert(err, gc.IsNil)
+	h := d.Handler(ok)
+
+	for _, ua := range []string{
+		"GnuPG/2.2.40", "gnupg/2.4.0", "Thunderbird/115.0", "", "curl/8.0",
+	} {
+		serve(h, "/pks/lookup?op=get&search=23e0dcca", ua)
+	}
+	c.Assert(d.Usage(), gc.DeepEquals, []RuleUsage{{
+		Name:   "short-keyid",
+		Sunset: "2025-01-01T00:00:00Z",
+		Clients: []ClientUsage{
+			{Client: "gnupg", Requests: 2},
+			{Client: "other", Requests: 2},
+			{Client: "thunderbird", Requests: 1},
+		},
+	}})
+}
+
+func (s *DeprecationSuite) TestInvalid(c *gc.C) {
+	d, err := New(&Settings{})
+	c.Assert(err, gc.IsNil)
+	c.Assert(d, gc.IsNil)
+	c.Assert(serve(d.Handler(ok), "/pks/stats", "").Code, gc.Equals, http.StatusOK)
+	c.Assert(d.Usage(), gc.IsNil)
+
+	for _, t := range []struct {
+		rules []Rule
+		err   string
+	}{
+		{[]Rule{{Path: "/pks/stats"}}, "deprecation rule has no name"},
+		{[]Rule{{Name: "x"}}, `deprecation rule "x" has no path`},
+		{[]Rule{{Name: "x", Path: "/", Pattern: "y"}}, `deprecation rule "x" has a pattern but no param`},
+		{[]Rule{{Name: "x", Path: "/", Param: "p", Pattern: "("}}, `invalid pattern for deprecation rule "x".*`},
+		{[]Rule{{Name: "x", Path: "/", Sunset: "soon"}}, `invalid sunset time for deprecation rule "x".*`},
+		{[]Rule{{Name: "x", Path: "/"}, {Name: "x", Path: "/"}}, `duplicate deprecation rule "x"`},
+	} {
+		_, err := New(&Settings{Rules: t.rules})
+		c.Check(err, gc.ErrorMatches, t.err)
+	}
+}
@@ -0,0 +1,28 @@
+package deprecation
+
+import (
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var deprecationMetrics = struct {
+	requests *prometheus.CounterVec
+}{
+	requests: prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "hockeypuck",
+			Name:      "deprecated_requests",
+			Help:      "Requests using deprecated behaviors since startup, by rule and client software",
+		},
+		[]string{"rule", "client"},
+	),
+}
+
+var metricsRegister sync.Once
+
+func registerMetrics() {
+	metricsRegister.Do(func() {
+		prometheus.MustRegister(deprecationMetrics.requests)
+	})
+}
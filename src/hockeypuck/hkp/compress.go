@@ -0,0 +1,147 @@
+package hkp
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const DefaultCompressionMinSize = 1024
+
+// Compression configures compression of get and index responses, which
+// armored keyrings and indexes are well suited to.
+type Compression struct {
+	// Enabled compresses responses for clients which accept gzip or
+	// deflate encoding.
+	Enabled bool `toml:"enabled"`
+
+	// MinSize is the size in bytes of the smallest response compressed.
+	// Smaller responses gain too little to be worth it.
+	MinSize int `toml:"minSize"`
+
+	// Level is the compression level, from 1 for the fastest to 9 for the
+	// smallest. Zero uses the default level.
+	Level int `toml:"level"`
+}
+
+func DefaultCompression() Compression {
+	return Compression{
+		MinSize: DefaultCompressionMinSize,
+	}
+}
+
+// CompressResponses sets how get and index responses are compressed.
+func CompressResponses(c Compression) HandlerOption {
+	return func(h *Handler) error {
+		if c.Level < 0 || c.Level > 9 {
+			return errors.Errorf("invalid compression level %d", c.Level)
+		}
+		if c.Level == 0 {
+			c.Level = gzip.DefaultCompression
+		}
+		h.compression = c
+		return nil
+	}
+}
+
+// acceptedEncoding returns the content coding, "gzip" or "deflate", which
+// a client accepts according to its Accept-Encoding header, preferring
+// gzip. It returns "" if the client accepts neither.
+func acceptedEncoding(header string) string {
+	q := map[string]float64{}
+	for _, part := range strings.Split(header, ",") {
+		params := strings.Split(part, ";")
+		coding := strings.ToLower(strings.TrimSpace(params[0]))
+		if coding == "" {
+			continue
+		}
+		weight := 1.0
+		for _, param := range params[1:] {
+			param = strings.TrimSpace(param)
+			if !strings.HasPrefix(param, "q=") {
+				continue
+			}
+			v, err := strconv.ParseFloat(param[2:], 64)
+			if err == nil {
+				weight = v
+			}
+		}
+		q[coding] = weight
+	}
+	best, bestQ := "", 0.0
+	for _, coding := range []string{"gzip", "deflate"} {
+		weight, ok := q[coding]
+		if !ok {
+			weight, ok = q["*"]
+		}
+		if ok && weight > bestQ {
+			best, bestQ = coding, weight
+		}
+	}
+	return best
+}
+
+// compress returns body compressed with the encoding the client accepts,
+// setting the Content-Encoding header, and the encoding used. The body is
+// returned as it is if compression is disabled, the client accepts no
+// encoding, or it is smaller than the minimum size.
+func (h *Handler) compress(w http.ResponseWriter, r *http.Request, body []byte) ([]byte, string, error) {
+	if !h.compression.Enabled {
+		return body, "", nil
+	}
+	// Responses differ by encoding, whether or not this one is compressed.
+	w.Header().Add("Vary", "Accept-Encoding")
+	if len(body) < h.compression.MinSize {
+		return body, "", nil
+	}
+	encoding := acceptedEncoding(r.Header.Get("Accept-Encoding"))
+	var buf bytes.Buffer
+	var zw io.WriteCloser
+	var err error
+	switch encoding {
+	case "gzip":
+		zw, err = gzip.NewWriterLevel(&buf, h.compression.Level)
+	case "deflate":
+		// HTTP deflate is the zlib format, rather than raw deflate.
+		zw, err = zlib.NewWriterLevel(&buf, h.compression.Level)
+	default:
+		return body, "", nil
+	}
+	if err != nil {
+		return nil, "", errors.WithStack(err)
+	}
+	_, err = zw.Write(body)
+	if err != nil {
+		return nil, "", errors.WithStack(err)
+	}
+	err = zw.Close()
+	if err != nil {
+		return nil, "", errors.WithStack(err)
+	}
+	w.Header().Set("Content-Encoding", encoding)
+	return buf.Bytes(), encoding, nil
+}
+
+// bufferedResponseWriter holds a response back so that it may be compressed
+// once it is complete.
+type bufferedResponseWriter struct {
+	http.ResponseWriter
+	buf    bytes.Buffer
+	status int
+}
+
+func (b *bufferedResponseWriter) Write(p []byte) (int, error) {
+	return b.buf.Write(p)
+}
+
+func (b *bufferedResponseWriter) WriteHeader(status int) {
+	if b.status == 0 {
+		b.status = status
+	}
+}
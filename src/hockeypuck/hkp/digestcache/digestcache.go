@@ -0,0 +1,244 @@
+// Package digestcache remembers the digests of stored keys by fingerprint,
+// so that the subsystems which map between the two, such as hashquery,
+// prefix tree updates and lookups, share what any of them has learned
+// rather than each querying storage or digesting the same keys again.
+//
+// The cache is process-wide: the server creates one and plugs it into each
+// subsystem. Each change to a key advances the generation, evicts the
+// digests the change removed, and remembers the generation at which each was
+// removed. A digest learned from a key fetched before the digest was removed
+// is not cached, since it is of the key as it was; changes to other keys do
+// not prevent it.
+package digestcache
+
+import (
+	"container/list"
+	"sync"
+
+	"github.com/pkg/errors"
+
+	"hockeypuck/hkp/storage"
+	"hockeypuck/openpgp"
+)
+
+const (
+	DefaultMaxEntries = 65536
+)
+
+type Settings struct {
+	// MaxEntries bounds the number of digests cached. Zero disables the
+	// cache.
+	MaxEntries int `toml:"maxEntries"`
+}
+
+func DefaultSettings() *Settings {
+	return &Settings{
+		MaxEntries: DefaultMaxEntries,
+	}
+}
+
+// Enabled returns whether digests are cached.
+func (s *Settings) Enabled() bool {
+	return s != nil && s.MaxEntries > 0
+}
+
+// entry is the digest of a stored key.
+type entry struct {
+	rfp    string
+	digest string
+}
+
+// Cache maps the reversed fingerprints of stored keys to their digests, and
+// back. It is safe for concurrent use.
+type Cache struct {
+	maxEntries int
+
+	mu         sync.Mutex
+	lru        *list.List
+	rfps       map[string]*list.Element
+	digests    map[string]*list.Element
+	generation uint64
+
+	// removed maps recently removed digests to the generation at which they
+	// were removed, oldest first in removals. Digests forgotten to bound it
+	// were removed at or before floor, so nothing fetched before then is
+	// cached.
+	removed  map[string]uint64
+	removals *list.List
+	floor    uint64
+}
+
+// New returns a cache with the given settings.
+func New(settings *Settings) (*Cache, error) {
+	if !settings.Enabled() {
+		return nil, errors.New("digest cache size not set")
+	}
+	registerMetrics()
+	return &Cache{
+		maxEntries: settings.MaxEntries,
+		lru:        list.New(),
+		rfps:       map[string]*list.Element{},
+		digests:    map[string]*list.Element{},
+		removed:    map[string]uint64{},
+		removals:   list.New(),
+	}, nil
+}
+
+// Generation returns the current generation of the cache. It is read before
+// fetching keys whose digests are then cached with Put.
+func (c *Cache) Generation() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.generation
+}
+
+// Put caches the digest of the key with the given reversed fingerprint,
+// unless the digest was removed since generation gen, when the key was
+// fetched.
+func (c *Cache) Put(gen uint64, rfp, digest string) {
+	if rfp == "" || digest == "" {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.removedSince(gen, digest) {
+		return
+	}
+	c.put(rfp, digest)
+}
+
+// PutKeys caches the digests of keys fetched at generation gen, as Put does.
+func (c *Cache) PutKeys(gen uint64, keys []*openpgp.PrimaryKey) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, key := range keys {
+		if key != nil && key.RFingerprint != "" && key.MD5 != "" && !c.removedSince(gen, key.MD5) {
+			c.put(key.RFingerprint, key.MD5)
+		}
+	}
+}
+
+// removedSince returns whether digest may have been removed since
+// generation gen. The caller must hold c.mu.
+func (c *Cache) removedSince(gen uint64, digest string) bool {
+	if gen < c.floor {
+		return true
+	}
+	removedAt, ok := c.removed[digest]
+	return ok && removedAt > gen
+}
+
+// put caches a digest. The caller must hold c.mu.
+func (c *Cache) put(rfp, digest string) {
+	if elem, ok := c.rfps[rfp]; ok {
+		if elem.Value.(*entry).digest == digest {
+			c.lru.MoveToFront(elem)
+			return
+		}
+		c.remove(elem)
+	}
+	if elem, ok := c.digests[digest]; ok {
+		// Keys with the same content have the same digest.
+		c.remove(elem)
+	}
+	elem := c.lru.PushFront(&entry{rfp: rfp, digest: digest})
+	c.rfps[rfp] = elem
+	c.digests[digest] = elem
+	for c.lru.Len() > c.maxEntries {
+		c.remove(c.lru.Back())
+	}
+	cacheMetrics.entries.Set(float64(c.lru.Len()))
+}
+
+// remove evicts a cached digest. The caller must hold c.mu.
+func (c *Cache) remove(elem *list.Element) {
+	e := c.lru.Remove(elem).(*entry)
+	delete(c.rfps, e.rfp)
+	delete(c.digests, e.digest)
+	cacheMetrics.entries.Set(float64(c.lru.Len()))
+}
+
+// Digest returns the cached digest of the key with the given reversed
+// fingerprint.
+func (c *Cache) Digest(rfp string) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.rfps[rfp]
+	if !ok {
+		cacheMetrics.requests.WithLabelValues("miss").Inc()
+		return "", false
+	}
+	cacheMetrics.requests.WithLabelValues("hit").Inc()
+	c.lru.MoveToFront(elem)
+	return elem.Value.(*entry).digest, true
+}
+
+// RFingerprint returns the reversed fingerprint of the stored key with the
+// given digest, if it is cached.
+func (c *Cache) RFingerprint(digest string) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.digests[digest]
+	if !ok {
+		cacheMetrics.requests.WithLabelValues("miss").Inc()
+		return "", false
+	}
+	cacheMetrics.requests.WithLabelValues("hit").Inc()
+	c.lru.MoveToFront(elem)
+	return elem.Value.(*entry).rfp, true
+}
+
+// MatchMD5 returns the reversed fingerprints of the stored keys with the
+// given digests, as storage.Queryer.MatchMD5 does, querying st only for the
+// digests which are not cached.
+func (c *Cache) MatchMD5(st storage.Queryer, digests []string) ([]string, error) {
+	var rfps, missed []string
+	for _, digest := range digests {
+		if rfp, ok := c.RFingerprint(digest); ok {
+			rfps = append(rfps, rfp)
+		} else {
+			missed = append(missed, digest)
+		}
+	}
+	if len(missed) == 0 {
+		return rfps, nil
+	}
+	found, err := st.MatchMD5(missed)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return append(rfps, found...), nil
+}
+
+// KeyChanged evicts the digests which a change removed, and advances the
+// generation, remembering when they were removed. It is subscribed to
+// storage notifications.
+func (c *Cache) KeyChanged(kc storage.KeyChange) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.generation++
+	for _, digest := range kc.RemoveDigests() {
+		if elem, ok := c.digests[digest]; ok {
+			c.remove(elem)
+		}
+		if _, ok := c.removed[digest]; !ok {
+			c.removals.PushBack(digest)
+		}
+		c.removed[digest] = c.generation
+	}
+	for c.removals.Len() > c.maxEntries {
+		digest := c.removals.Remove(c.removals.Front()).(string)
+		if removedAt := c.removed[digest]; removedAt > c.floor {
+			c.floor = removedAt
+		}
+		delete(c.removed, digest)
+	}
+	return nil
+}
+
+// Len returns the number of cached digests.
+func (c *Cache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lru.Len()
+}
@@ -0,0 +1,156 @@
+package digestcache
+
+import (
+	stdtesting "testing"
+
+	gc "gopkg.in/check.v1"
+
+	"hockeypuck/hkp/storage"
+	"hockeypuck/hkp/storage/mock"
+	"hockeypuck/openpgp"
+	"hockeypuck/testing"
+)
+
+func Test(t *stdtesting.T) { gc.TestingT(t) }
+
+type DigestCacheSuite struct {
+	storage *mock.Storage
+	cache   *Cache
+}
+
+var _ = gc.Suite(&DigestCacheSuite{})
+
+const (
+	aliceRFP    = "accd0e320f1cb163a2aa9305257f384b1fc8ef01"
+	aliceDigest = "00000000000000000000000000000001"
+	otherRFP    = "46a4aa10053f9575b8368eec8b24bf84a5f0047a"
+	otherDigest = "00000000000000000000000000000002"
+)
+
+func (s *DigestCacheSuite) SetUpTest(c *gc.C) {
+	stored := map[string]string{aliceDigest: aliceRFP, otherDigest: otherRFP}
+	s.storage = mock.NewStorage(
+		mock.MatchMD5(func(digests []string) ([]string, error) {
+			var result []string
+			for _, digest := range digests {
+				if rfp, ok := stored[digest]; ok {
+					result = append(result, rfp)
+				}
+			}
+			return result, nil
+		}),
+	)
+	var err error
+	s.cache, err = New(DefaultSettings())
+	c.Assert(err, gc.IsNil)
+}
+
+func (s *DigestCacheSuite) TestPut(c *gc.C) {
+	gen := s.cache.Generation()
+	s.cache.Put(gen, aliceRFP, aliceDigest)
+	digest, ok := s.cache.Digest(aliceRFP)
+	c.Assert(ok, gc.Equals, true)
+	c.Assert(digest, gc.Equals, aliceDigest)
+	rfp, ok := s.cache.RFingerprint(aliceDigest)
+	c.Assert(ok, gc.Equals, true)
+	c.Assert(rfp, gc.Equals, aliceRFP)
+
+	// A new digest for the same key replaces the old one.
+	s.cache.Put(gen, aliceRFP, otherDigest)
+	c.Assert(s.cache.Len(), gc.Equals, 1)
+	_, ok = s.cache.RFingerprint(aliceDigest)
+	c.Assert(ok, gc.Equals, false)
+
+	_, ok = s.cache.Digest(otherRFP)
+	c.Assert(ok, gc.Equals, false)
+}
+
+func (s *DigestCacheSuite) TestPutKeys(c *gc.C) {
+	key := openpgp.MustReadArmorKeys(testing.MustInput("alice_signed.asc"))[0]
+	s.cache.PutKeys(s.cache.Generation(), []*openpgp.PrimaryKey{key})
+	digest, ok := s.cache.Digest(key.RFingerprint)
+	c.Assert(ok, gc.Equals, true)
+	c.Assert(digest, gc.Equals, key.MD5)
+}
+
+func (s *DigestCacheSuite) TestChangedWhileFetching(c *gc.C) {
+	gen := s.cache.Generation()
+	err := s.cache.KeyChanged(storage.KeyReplaced{OldDigest: aliceDigest, NewDigest: "00000000000000000000000000000003"})
+	c.Assert(err, gc.IsNil)
+	s.cache.Put(gen, aliceRFP, aliceDigest)
+	c.Assert(s.cache.Len(), gc.Equals, 0)
+
+	// Changes to other keys do not keep a digest from being cached.
+	err = s.cache.KeyChanged(storage.KeyRemoved{Digest: otherDigest})
+	c.Assert(err, gc.IsNil)
+	s.cache.PutKeys(gen, nil)
+	s.cache.Put(gen, aliceRFP, "00000000000000000000000000000003")
+	c.Assert(s.cache.Len(), gc.Equals, 1)
+}
+
+func (s *DigestCacheSuite) TestRemovalsBounded(c *gc.C) {
+	var err error
+	s.cache, err = New(&Settings{MaxEntries: 1})
+	c.Assert(err, gc.IsNil)
+	gen := s.cache.Generation()
+	c.Assert(s.cache.KeyChanged(storage.KeyRemoved{Digest: otherDigest}), gc.IsNil)
+	c.Assert(s.cache.KeyChanged(storage.KeyRemoved{Digest: "00000000000000000000000000000003"}), gc.IsNil)
+	// The removal of otherDigest was forgotten, so digests fetched before
+	// it are not cached at all.
+	s.cache.Put(gen, aliceRFP, aliceDigest)
+	c.Assert(s.cache.Len(), gc.Equals, 0)
+	s.cache.Put(s.cache.Generation(), aliceRFP, aliceDigest)
+	c.Assert(s.cache.Len(), gc.Equals, 1)
+}
+
+func (s *DigestCacheSuite) TestKeyChanged(c *gc.C) {
+	s.cache.Put(s.cache.Generation(), aliceRFP, aliceDigest)
+	s.cache.Put(s.cache.Generation(), otherRFP, otherDigest)
+
+	err := s.cache.KeyChanged(storage.KeyAdded{Digest: "00000000000000000000000000000003"})
+	c.Assert(err, gc.IsNil)
+	c.Assert(s.cache.Len(), gc.Equals, 2)
+
+	err = s.cache.KeyChanged(storage.KeyReplaced{OldDigest: aliceDigest, NewDigest: "00000000000000000000000000000003"})
+	c.Assert(err, gc.IsNil)
+	c.Assert(s.cache.Len(), gc.Equals, 1)
+	_, ok := s.cache.Digest(aliceRFP)
+	c.Assert(ok, gc.Equals, false)
+
+	err = s.cache.KeyChanged(storage.KeyRemoved{Digest: otherDigest})
+	c.Assert(err, gc.IsNil)
+	c.Assert(s.cache.Len(), gc.Equals, 0)
+}
+
+func (s *DigestCacheSuite) TestMatchMD5(c *gc.C) {
+	s.cache.Put(s.cache.Generation(), aliceRFP, aliceDigest)
+	rfps, err := s.cache.MatchMD5(s.storage, []string{aliceDigest})
+	c.Assert(err, gc.IsNil)
+	c.Assert(rfps, gc.DeepEquals, []string{aliceRFP})
+	c.Assert(s.storage.MethodCount("MatchMD5"), gc.Equals, 0)
+
+	// Only the digests not cached are queried.
+	rfps, err = s.cache.MatchMD5(s.storage, []string{aliceDigest, otherDigest, "00000000000000000000000000000003"})
+	c.Assert(err, gc.IsNil)
+	c.Assert(rfps, gc.DeepEquals, []string{aliceRFP, otherRFP})
+	c.Assert(s.storage.MethodCount("MatchMD5"), gc.Equals, 1)
+}
+
+func (s *DigestCacheSuite) TestMaxEntries(c *gc.C) {
+	var err error
+	s.cache, err = New(&Settings{MaxEntries: 1})
+	c.Assert(err, gc.IsNil)
+	s.cache.Put(s.cache.Generation(), aliceRFP, aliceDigest)
+	s.cache.Put(s.cache.Generation(), otherRFP, otherDigest)
+	c.Assert(s.cache.Len(), gc.Equals, 1)
+	// The least recently used digest was evicted.
+	_, ok := s.cache.Digest(aliceRFP)
+	c.Assert(ok, gc.Equals, false)
+	_, ok = s.cache.Digest(otherRFP)
+	c.Assert(ok, gc.Equals, true)
+}
+
+func (s *DigestCacheSuite) TestInvalid(c *gc.C) {
+	_, err := New(&Settings{})
+	c.Assert(err, gc.ErrorMatches, "digest cache size not set")
+}
@@ -0,0 +1,37 @@
+package digestcache
+
+import (
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var cacheMetrics = struct {
+	requests *prometheus.CounterVec
+	entries  prometheus.Gauge
+}{
+	requests: prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "hockeypuck",
+			Name:      "digest_cache_requests",
+			Help:      "Digest cache lookups since startup, by whether the digest was cached",
+		},
+		[]string{"result"},
+	),
+	entries: prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: "hockeypuck",
+			Name:      "digest_cache_entries",
+			Help:      "Digests currently cached",
+		},
+	),
+}
+
+var metricsRegister sync.Once
+
+func registerMetrics() {
+	metricsRegister.Do(func() {
+		prometheus.MustRegister(cacheMetrics.requests)
+		prometheus.MustRegister(cacheMetrics.entries)
+	})
+}
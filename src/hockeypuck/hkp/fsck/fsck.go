@@ -0,0 +1,426 @@
+// Package fsck checks that the keys in storage agree with the digests in the
+// recon prefix tree, and optionally repairs them.
+//
+// Storage is paged through in modification order, so it must support
+// storage.CapModifiedSince. Each key is fetched to check that it still
+// parses, and its fingerprint is checked against those already seen, since
+// bulk loads drop the constraints which otherwise prevent duplicates. The
+// prefix tree is then walked leaf by leaf and its digests compared with the
+// stored ones.
+//
+// Repair deletes keys which fail to parse, merges the rows of duplicate
+// fingerprints which parse into one key, and then inserts missing digests
+// into the prefix tree and removes those of keys which are not stored.
+package fsck
+
+import (
+	"encoding/hex"
+	"sort"
+
+	"github.com/pkg/errors"
+
+	cf "hockeypuck/conflux"
+	"hockeypuck/conflux/recon"
+	"hockeypuck/hkp/sks"
+	"hockeypuck/hkp/storage"
+	log "hockeypuck/logrus"
+	"hockeypuck/openpgp"
+)
+
+// Kinds of problem found.
+const (
+	// MissingFromPrefixTree is a stored key whose digest is not in the
+	// prefix tree, so that recon partners are not offered it.
+	MissingFromPrefixTree = "missing-from-ptree"
+
+	// MissingFromStorage is a digest in the prefix tree of a key which is
+	// not stored, so that recon partners cannot fetch it.
+	MissingFromStorage = "missing-from-storage"
+
+	// Unparseable is a stored key which fails to parse.
+	Unparseable = "unparseable"
+
+	// Duplicate is a fingerprint stored more than once.
+	Duplicate = "duplicate-fingerprint"
+)
+
+const pageSize = 1000
+
+// progressInterval is how many keys are checked between progress reports.
+const progressInterval = 50000
+
+// Problem is an inconsistency found by a check.
+type Problem struct {
+	Kind         string `json:"kind"`
+	RFingerprint string `json:"rfingerprint,omitempty"`
+	Digest       string `json:"digest,omitempty"`
+	Detail       string `json:"detail,omitempty"`
+	Repaired     bool   `json:"repaired"`
+}
+
+// Report is the result of a check.
+type Report struct {
+	// Keys is the number of stored keys.
+	Keys int `json:"keys"`
+
+	// Elements is the number of digests in the prefix tree.
+	Elements int `json:"elements"`
+
+	Problems []Problem `json:"problems"`
+}
+
+// Unrepaired returns the number of problems which were not repaired.
+func (r *Report) Unrepaired() int {
+	var n int
+	for _, p := range r.Problems {
+		if !p.Repaired {
+			n++
+		}
+	}
+	return n
+}
+
+type checker struct {
+	st     storage.Storage
+	ptree  recon.PrefixTree
+	repair bool
+	report Report
+
+	// digests maps each stored digest to whether it was found in the
+	// prefix tree.
+	digests map[string]bool
+
+	// rows maps fingerprints stored more than once to the digests of
+	// their rows.
+	rows map[string][]string
+
+	unparseable []int
+	duplicates  []int
+}
+
+// Check compares st with ptree, repairing the problems found if repair is
+// set. The prefix tree must not be in use by a running server.
+func Check(st storage.Storage, ptree recon.PrefixTree, repair bool) (*Report, error) {
+	if !storage.Supports(st, storage.CapModifiedSince) {
+		return nil, errors.New("storage cannot list every key")
+	}
+	c := &checker{
+		st:      st,
+		ptree:   ptree,
+		repair:  repair,
+		digests: map[string]bool{},
+		rows:    map[string][]string{},
+	}
+	err := c.checkStorage()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if repair {
+		err = c.repairStorage()
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+	}
+	err = c.checkPrefixTree()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if c.report.Problems == nil {
+		c.report.Problems = []Problem{}
+	}
+	return &c.report, nil
+}
+
+func (c *checker) addProblem(p Problem) int {
+	c.report.Problems = append(c.report.Problems, p)
+	return len(c.report.Problems) - 1
+}
+
+// checkStorage pages through every stored key, recording its digest and
+// checking that it parses and that its fingerprint is unique.
+func (c *checker) checkStorage() error {
+	first := map[string]string{}
+	var after storage.ModifiedKey
+	for {
+		page, err := c.st.ModifiedAfter(after, pageSize)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if len(page) == 0 {
+			break
+		}
+		var rfps []string
+		for _, mk := range page {
+			c.digests[mk.MD5] = false
+			if digest, ok := first[mk.RFingerprint]; !ok {
+				first[mk.RFingerprint] = mk.MD5
+				rfps = append(rfps, mk.RFingerprint)
+			} else {
+				if _, ok := c.rows[mk.RFingerprint]; !ok {
+					c.rows[mk.RFingerprint] = []string{digest}
+					c.duplicates = append(c.duplicates, c.addProblem(Problem{
+						Kind:         Duplicate,
+						RFingerprint: mk.RFingerprint,
+					}))
+				}
+				c.rows[mk.RFingerprint] = append(c.rows[mk.RFingerprint], mk.MD5)
+			}
+			c.report.Keys++
+			if c.report.Keys%progressInterval == 0 {
+				log.Infof("fsck: %d keys checked", c.report.Keys)
+			}
+		}
+		err = c.checkParse(rfps, first)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		after = page[len(page)-1]
+	}
+	return nil
+}
+
+// checkParse fetches a page of keys. If any fails to parse, they are fetched
+// one by one to find which.
+func (c *checker) checkParse(rfps []string, digests map[string]string) error {
+	keys, err := c.st.FetchKeys(rfps)
+	if err == nil && !hasNil(keys) {
+		return nil
+	}
+	for _, rfp := range rfps {
+		keys, err := c.st.FetchKeys([]string{rfp})
+		var detail string
+		if err != nil {
+			detail = errors.Cause(err).Error()
+		} else if len(keys) == 0 || hasNil(keys) {
+			detail = "no key found"
+		} else {
+			continue
+		}
+		c.unparseable = append(c.unparseable, c.addProblem(Problem{
+			Kind:         Unparseable,
+			RFingerprint: rfp,
+			Digest:       digests[rfp],
+			Detail:       detail,
+		}))
+	}
+	return nil
+}
+
+func hasNil(keys []*openpgp.PrimaryKey) bool {
+	for _, key := range keys {
+		if key == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// repairStorage deletes keys which fail to parse, and replaces each
+// fingerprint stored more than once with the merge of its rows. Where only
+// some rows of a fingerprint fail to parse, the others are merged.
+func (c *checker) repairStorage() error {
+	// repaired maps the fingerprints already repaired to their digest, or
+	// to "" if they were deleted.
+	repaired := map[string]string{}
+	unrepaired := map[string]bool{}
+	for _, i := range c.unparseable {
+		p := &c.report.Problems[i]
+		if _, ok := c.rows[p.RFingerprint]; ok {
+			digest, ok, err := c.repairRows(p)
+			if err != nil {
+				return errors.WithStack(err)
+			} else if !ok {
+				p.Detail += "; storage cannot fetch its rows apart to merge those which parse"
+				unrepaired[p.RFingerprint] = true
+				continue
+			}
+			repaired[p.RFingerprint] = digest
+			p.Repaired = true
+			continue
+		}
+		_, err := c.st.Delete(openpgp.Reverse(p.RFingerprint))
+		if err != nil && !errors.Is(err, storage.ErrKeyNotFound) {
+			return errors.Wrapf(err, "cannot delete key %q", p.RFingerprint)
+		}
+		repaired[p.RFingerprint] = ""
+		c.forget(p.RFingerprint, p.Digest)
+		p.Repaired = true
+	}
+	for _, i := range c.duplicates {
+		p := &c.report.Problems[i]
+		if digest, ok := repaired[p.RFingerprint]; ok {
+			p.Digest = digest
+			p.Repaired = true
+			continue
+		} else if unrepaired[p.RFingerprint] {
+			continue
+		}
+		keys, err := c.st.FetchKeys([]string{p.RFingerprint})
+		if err != nil {
+			return errors.Wrapf(err, "cannot fetch key %q", p.RFingerprint)
+		}
+		if len(keys) == 0 {
+			continue
+		}
+		p.Digest, err = c.replaceRows(p.RFingerprint, keys)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		p.Repaired = true
+	}
+	return nil
+}
+
+// repairRows replaces the rows of a fingerprint stored more than once, some
+// of which fail to parse, with the merge of those which parse. The rows which
+// fail to parse are added to the detail of p. It returns the digest of the
+// merged key, or "" if none parse and the fingerprint is deleted. It returns
+// false if the storage cannot fetch rows by digest.
+func (c *checker) repairRows(p *Problem) (string, bool, error) {
+	rfp := p.RFingerprint
+	df, ok := c.st.(storage.DigestFetcher)
+	if !ok {
+		return "", false, nil
+	}
+	var keys []*openpgp.PrimaryKey
+	for _, digest := range c.rows[rfp] {
+		key, err := df.FetchKeyByMD5(digest)
+		if errors.Is(err, storage.ErrKeyNotFound) {
+			continue
+		} else if storage.IsUnparseable(err) {
+			p.Detail += "; " + errors.Cause(err).Error()
+			continue
+		} else if err != nil {
+			return "", false, errors.Wrapf(err, "cannot fetch key %q", digest)
+		}
+		keys = append(keys, key)
+	}
+	if len(keys) == 0 {
+		_, err := c.st.Delete(openpgp.Reverse(rfp))
+		if err != nil && !errors.Is(err, storage.ErrKeyNotFound) {
+			return "", false, errors.Wrapf(err, "cannot delete key %q", rfp)
+		}
+		c.forget(rfp, "")
+		return "", true, nil
+	}
+	digest, err := c.replaceRows(rfp, keys)
+	if err != nil {
+		return "", false, errors.WithStack(err)
+	}
+	return digest, true, nil
+}
+
+// replaceRows replaces every row of a fingerprint with the merge of keys,
+// returning the digest of the merged key.
+func (c *checker) replaceRows(rfp string, keys []*openpgp.PrimaryKey) (string, error) {
+	merged := keys[0]
+	for _, key := range keys[1:] {
+		err := openpgp.Merge(merged, key)
+		if err != nil {
+			return "", errors.Wrapf(err, "cannot merge key %q", rfp)
+		}
+	}
+	_, err := c.st.Delete(openpgp.Reverse(rfp))
+	if err != nil {
+		return "", errors.Wrapf(err, "cannot delete key %q", rfp)
+	}
+	_, err = c.st.Insert([]*openpgp.PrimaryKey{merged})
+	if err != nil {
+		return "", errors.Wrapf(err, "cannot insert key %q", rfp)
+	}
+	c.forget(rfp, "")
+	c.digests[merged.MD5] = false
+	return merged.MD5, nil
+}
+
+// forget removes the digests of a deleted fingerprint.
+func (c *checker) forget(rfp, digest string) {
+	if rows, ok := c.rows[rfp]; ok {
+		for _, digest := range rows {
+			delete(c.digests, digest)
+		}
+		delete(c.rows, rfp)
+	} else if digest != "" {
+		delete(c.digests, digest)
+	}
+}
+
+// checkPrefixTree walks the prefix tree, matching its digests with the
+// stored ones.
+func (c *checker) checkPrefixTree() error {
+	root, err := c.ptree.Root()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	p := root.Config().Field.P()
+
+	var remove []string
+	nodes := []recon.PrefixNode{root}
+	for len(nodes) > 0 {
+		node := nodes[len(nodes)-1]
+		nodes = nodes[:len(nodes)-1]
+		if !node.IsLeaf() {
+			children, err := node.Children()
+			if err != nil {
+				return errors.WithStack(err)
+			}
+			nodes = append(nodes, children...)
+			continue
+		}
+		elements, err := node.Elements()
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		for i := range elements {
+			c.report.Elements++
+			digest := hex.EncodeToString(elements[i].DigestBytes())
+			if _, ok := c.digests[digest]; ok {
+				c.digests[digest] = true
+			} else {
+				remove = append(remove, digest)
+			}
+		}
+	}
+
+	var insert []string
+	for digest, found := range c.digests {
+		if !found {
+			insert = append(insert, digest)
+		}
+	}
+	sort.Strings(insert)
+	sort.Strings(remove)
+
+	for _, digest := range insert {
+		problem := Problem{Kind: MissingFromPrefixTree, Digest: digest}
+		if c.repair {
+			var z cf.Zp
+			err := sks.DigestZpIn(p, digest, &z)
+			if err != nil {
+				problem.Detail = err.Error()
+			} else if err := c.ptree.Insert(&z); err != nil {
+				return errors.Wrapf(err, "cannot insert digest %q", digest)
+			} else {
+				problem.Repaired = true
+			}
+		}
+		c.addProblem(problem)
+	}
+	for _, digest := range remove {
+		problem := Problem{Kind: MissingFromStorage, Digest: digest}
+		if c.repair {
+			var z cf.Zp
+			err := sks.DigestZpIn(p, digest, &z)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+			err = c.ptree.Remove(&z)
+			if err != nil {
+				return errors.Wrapf(err, "cannot remove digest %q", digest)
+			}
+			problem.Repaired = true
+		}
+		c.addProblem(problem)
+	}
+	return nil
+}
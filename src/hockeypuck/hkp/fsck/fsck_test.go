@@ -0,0 +1,213 @@
+package fsck
+
+import (
+	"encoding/hex"
+	stdtesting "testing"
+	"time"
+
+	"github.com/pkg/errors"
+	gc "gopkg.in/check.v1"
+
+	cf "hockeypuck/conflux"
+	"hockeypuck/conflux/recon"
+	"hockeypuck/hkp/sks"
+	"hockeypuck/hkp/storage"
+	"hockeypuck/hkp/storage/mock"
+	"hockeypuck/openpgp"
+	"hockeypuck/testing"
+)
+
+func Test(t *stdtesting.T) { gc.TestingT(t) }
+
+type FsckSuite struct {
+	alice *openpgp.PrimaryKey
+	tails *openpgp.PrimaryKey
+	rows  []storage.ModifiedKey
+	st    *mock.Storage
+	ptree *recon.MemPrefixTree
+}
+
+var _ = gc.Suite(&FsckSuite{})
+
+const (
+	badRFP       = "0123456789abcdef0123456789abcdef01234567"
+	badDigest    = "0123456789abcdef0123456789abcdef"
+	aliceDup     = "00112233445566778899aabbccddeeff"
+	strayDigest  = "ffeeddccbbaa99887766554433221100"
+	mergedDigest = "4b579f34dfc533283d425cf9e103f03f"
+)
+
+func readKey(name string) *openpgp.PrimaryKey {
+	return openpgp.MustReadArmorKeys(testing.MustInput(name))[0]
+}
+
+func (s *FsckSuite) SetUpTest(c *gc.C) {
+	s.alice = readKey("alice_signed.asc")
+	s.tails = readKey("tails.asc")
+	mtime := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	s.rows = []storage.ModifiedKey{
+		{RFingerprint: s.alice.RFingerprint, MTime: mtime, MD5: s.alice.MD5},
+		{RFingerprint: s.tails.RFingerprint, MTime: mtime, MD5: s.tails.MD5},
+		{RFingerprint: badRFP, MTime: mtime, MD5: badDigest},
+		{RFingerprint: s.alice.RFingerprint, MTime: mtime, MD5: aliceDup},
+	}
+	s.st = mock.NewStorage(
+		mock.ModifiedAfter(func(after storage.ModifiedKey, limit int) ([]storage.ModifiedKey, error) {
+			if !after.MTime.IsZero() {
+				return nil, nil
+			}
+			return s.rows, nil
+		}),
+		mock.FetchKeys(func(rfps []string) ([]*openpgp.PrimaryKey, error) {
+			var keys []*openpgp.PrimaryKey
+			for _, rfp := range rfps {
+				switch rfp {
+				case badRFP:
+					return nil, errors.New("malformed key")
+				case s.alice.RFingerprint:
+					// Both rows of the duplicate fingerprint.
+					keys = append(keys, readKey("alice_signed.asc"), readKey("alice_signed.asc"))
+				case s.tails.RFingerprint:
+					keys = append(keys, readKey("tails.asc"))
+				}
+			}
+			return keys, nil
+		}),
+	)
+
+	s.ptree = &recon.MemPrefixTree{}
+	s.ptree.Init()
+	for _, digest := range []string{s.alice.MD5, badDigest, strayDigest} {
+		var z cf.Zp
+		c.Assert(sks.DigestZp(digest, &z), gc.IsNil)
+		c.Assert(s.ptree.Insert(&z), gc.IsNil)
+	}
+}
+
+func (s *FsckSuite) ptreeDigests(c *gc.C) []string {
+	root, err := s.ptree.Root()
+	c.Assert(err, gc.IsNil)
+	var result []string
+	for _, z := range recon.MustElements(root) {
+		result = append(result, hex.EncodeToString(z.DigestBytes()))
+	}
+	return result
+}
+
+func (s *FsckSuite) TestCheck(c *gc.C) {
+	report, err := Check(s.st, s.ptree, false)
+	c.Assert(err, gc.IsNil)
+	c.Assert(report.Keys, gc.Equals, 4)
+	c.Assert(report.Elements, gc.Equals, 3)
+	c.Assert(report.Problems, gc.DeepEquals, []Problem{
+		{Kind: Duplicate, RFingerprint: s.alice.RFingerprint},
+		{Kind: Unparseable, RFingerprint: badRFP, Digest: badDigest, Detail: "malformed key"},
+		{Kind: MissingFromPrefixTree, Digest: aliceDup},
+		{Kind: MissingFromPrefixTree, Digest: s.tails.MD5},
+		{Kind: MissingFromStorage, Digest: strayDigest},
+	})
+	c.Assert(report.Unrepaired(), gc.Equals, 5)
+	c.Assert(s.st.MethodCount("Delete"), gc.Equals, 0)
+	c.Assert(s.ptreeDigests(c), gc.HasLen, 3)
+}
+
+func (s *FsckSuite) TestRepair(c *gc.C) {
+	var inserted []*openpgp.PrimaryKey
+	var deleted []string
+	base := s.st
+	s.st = mock.NewStorage(
+		mock.ModifiedAfter(base.ModifiedAfter),
+		mock.FetchKeys(base.FetchKeys),
+		mock.Delete(func(fp string) (string, error) {
+			deleted = append(deleted, fp)
+			return "", nil
+		}),
+		mock.Insert(func(keys []*openpgp.PrimaryKey) (int, error) {
+			inserted = append(inserted, keys...)
+			return len(keys), nil
+		}),
+	)
+
+	report, err := Check(s.st, s.ptree, true)
+	c.Assert(err, gc.IsNil)
+	c.Assert(report.Unrepaired(), gc.Equals, 0)
+	c.Assert(report.Problems, gc.DeepEquals, []Problem{
+		{Kind: Duplicate, RFingerprint: s.alice.RFingerprint, Digest: mergedDigest, Repaired: true},
+		{Kind: Unparseable, RFingerprint: badRFP, Digest: badDigest, Detail: "malformed key", Repaired: true},
+		{Kind: MissingFromPrefixTree, Digest: s.tails.MD5, Repaired: true},
+		// The digest of the deleted key is removed too.
+		{Kind: MissingFromStorage, Digest: badDigest, Repaired: true},
+		{Kind: MissingFromStorage, Digest: strayDigest, Repaired: true},
+	})
+
+	c.Assert(deleted, gc.DeepEquals, []string{openpgp.Reverse(badRFP), s.alice.Fingerprint()})
+	c.Assert(inserted, gc.HasLen, 1)
+	c.Assert(inserted[0].MD5, gc.Equals, mergedDigest)
+
+	// The prefix tree now holds the digests of the stored keys.
+	c.Assert(cf.NewZSetSlice(s.zs(c, s.ptreeDigests(c)...)).Equal(
+		cf.NewZSetSlice(s.zs(c, s.alice.MD5, s.tails.MD5))), gc.Equals, true)
+}
+
+func (s *FsckSuite) TestRepairPartlyUnparseable(c *gc.C) {
+	var inserted []*openpgp.PrimaryKey
+	var deleted []string
+	base := s.st
+	s.st = mock.NewStorage(
+		mock.ModifiedAfter(base.ModifiedAfter),
+		mock.FetchKeys(func(rfps []string) ([]*openpgp.PrimaryKey, error) {
+			for _, rfp := range rfps {
+				if rfp == s.alice.RFingerprint {
+					return nil, errors.New("malformed key")
+				}
+			}
+			return base.FetchKeys(rfps)
+		}),
+		mock.FetchKeyByMD5(func(digest string) (*openpgp.PrimaryKey, error) {
+			if digest == s.alice.MD5 {
+				return readKey("alice_signed.asc"), nil
+			}
+			// The duplicate row fails to parse.
+			return nil, errors.WithStack(&storage.UnparseableError{Digest: digest, Err: errors.New("bad packet")})
+		}),
+		mock.Delete(func(fp string) (string, error) {
+			deleted = append(deleted, fp)
+			return "", nil
+		}),
+		mock.Insert(func(keys []*openpgp.PrimaryKey) (int, error) {
+			inserted = append(inserted, keys...)
+			return len(keys), nil
+		}),
+	)
+
+	report, err := Check(s.st, s.ptree, true)
+	c.Assert(err, gc.IsNil)
+	c.Assert(report.Unrepaired(), gc.Equals, 0)
+	c.Assert(report.Problems, gc.DeepEquals, []Problem{
+		{Kind: Duplicate, RFingerprint: s.alice.RFingerprint, Digest: s.alice.MD5, Repaired: true},
+		{Kind: Unparseable, RFingerprint: s.alice.RFingerprint, Digest: s.alice.MD5, Detail: `malformed key; stored key "` + aliceDup + `" cannot be parsed: bad packet`, Repaired: true},
+		{Kind: Unparseable, RFingerprint: badRFP, Digest: badDigest, Detail: "malformed key", Repaired: true},
+		{Kind: MissingFromPrefixTree, Digest: s.tails.MD5, Repaired: true},
+		{Kind: MissingFromStorage, Digest: badDigest, Repaired: true},
+		{Kind: MissingFromStorage, Digest: strayDigest, Repaired: true},
+	})
+
+	// The row which parses is kept rather than deleted with the other.
+	c.Assert(deleted, gc.DeepEquals, []string{s.alice.Fingerprint(), openpgp.Reverse(badRFP)})
+	c.Assert(inserted, gc.HasLen, 1)
+	c.Assert(inserted[0].MD5, gc.Equals, s.alice.MD5)
+}
+
+func (s *FsckSuite) zs(c *gc.C, digests ...string) []cf.Zp {
+	result := make([]cf.Zp, len(digests))
+	for i, digest := range digests {
+		c.Assert(sks.DigestZp(digest, &result[i]), gc.IsNil)
+	}
+	return result
+}
+
+func (s *FsckSuite) TestUnsupported(c *gc.C) {
+	st := mock.NewStorage(mock.Unsupported(storage.CapModifiedSince))
+	_, err := Check(st, s.ptree, false)
+	c.Assert(err, gc.ErrorMatches, "storage cannot list every key")
+}
@@ -19,14 +19,19 @@ package hkp
 
 import (
 	"bytes"
+	"context"
+	"crypto/md5"
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"html/template"
 	"net/http"
+	"net/http/httputil"
 	"net/url"
 	"path/filepath"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/julienschmidt/httprouter"
@@ -34,13 +39,26 @@ import (
 	xopenpgp "golang.org/x/crypto/openpgp"
 	"golang.org/x/crypto/openpgp/armor"
 
+	"hockeypuck/abuse"
+	"hockeypuck/apitoken"
 	"hockeypuck/conflux/recon"
+	"hockeypuck/hkp/digestcache"
+	"hockeypuck/hkp/jsonhkp"
+	"hockeypuck/hkp/keycache"
 	"hockeypuck/hkp/sks"
 	"hockeypuck/hkp/storage"
+	"hockeypuck/ingest"
+	"hockeypuck/logging"
 	log "hockeypuck/logrus"
+	"hockeypuck/notify"
 	"hockeypuck/openpgp"
+	"hockeypuck/proofs"
+	"hockeypuck/rollout"
+	"hockeypuck/tracing"
 )
 
+var logger = logging.Module("hkp")
+
 const (
 	shortKeyIDLen       = 8
 	longKeyIDLen        = 16
@@ -48,10 +66,18 @@ const (
 )
 
 var errKeywordSearchNotAvailable = errors.New("keyword search is not available")
+var errTimeRangeNotAvailable = errors.New("time range search is not available")
+
+// maxTimeRangeResults limits the keys found by a time range lookup without a
+// search.
+const maxTimeRangeResults = 100
 
-func httpError(w http.ResponseWriter, statusCode int, err error) {
+func httpError(w http.ResponseWriter, r *http.Request, statusCode int, err error) {
 	if statusCode != http.StatusNotFound {
-		log.Errorf("HTTP %d: %+v", statusCode, err)
+		logger.WithFields(logging.RequestFields(r)).WithFields(log.Fields{
+			"status": statusCode,
+			"error":  fmt.Sprintf("%+v", err),
+		}).Error("HTTP error")
 	}
 	http.Error(w, http.StatusText(statusCode), statusCode)
 }
@@ -64,12 +90,41 @@ type Handler struct {
 
 	statsTemplate *template.Template
 	statsFunc     func() (interface{}, error)
+	policyFunc    func() (interface{}, error)
 
 	selfSignedOnly  bool
 	fingerprintOnly bool
+	redact          string
+	limits          Limits
+	quarantineDir   string
+
+	maxResponseLength int
+	truncateLargeKeys bool
+	slimKeys          bool
+	attestedOnly      bool
+	excludeExpired    bool
+	refuseShortKeyIDs bool
+	compression       Compression
 
 	keyReaderOptions []openpgp.KeyReaderOption
 	keyWriterOptions []openpgp.KeyWriterOption
+	armorVariant     string
+
+	abuseScorer *abuse.Scorer
+	notifier    *notify.Dispatcher
+	reporter    notify.Publisher
+	rollout     *rollout.Flags
+	ingest      *ingest.Scheduler
+	proofs      *proofs.Verifier
+	keyCache    *keycache.Cache
+	digestCache *digestcache.Cache
+	provenance  *provenance
+
+	hashQueryProxy http.Handler
+
+	modifiedWaitTokens bool
+	modifiedOnce       sync.Once
+	modified           modifiedSignal
 }
 
 type HandlerOption func(h *Handler) error
@@ -130,6 +185,15 @@ func StatsFunc(f func() (interface{}, error)) HandlerOption {
 	}
 }
 
+// PolicyFunc sets the function which describes the server's key publication
+// policy, served at /pks/policy.
+func PolicyFunc(f func() (interface{}, error)) HandlerOption {
+	return func(h *Handler) error {
+		h.policyFunc = f
+		return nil
+	}
+}
+
 func SelfSignedOnly(selfSignedOnly bool) HandlerOption {
 	return func(h *Handler) error {
 		h.selfSignedOnly = selfSignedOnly
@@ -144,6 +208,19 @@ func FingerprintOnly(fingerprintOnly bool) HandlerOption {
 	}
 }
 
+// RedactUserIDs hides user IDs from index lookups, other than by exact key
+// ID, as the jsonhkp redaction mode requires.
+func RedactUserIDs(mode string) HandlerOption {
+	return func(h *Handler) error {
+		err := jsonhkp.CheckRedaction(mode)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		h.redact = mode
+		return nil
+	}
+}
+
 func KeyReaderOptions(opts []openpgp.KeyReaderOption) HandlerOption {
 	return func(h *Handler) error {
 		h.keyReaderOptions = opts
@@ -153,12 +230,192 @@ func KeyReaderOptions(opts []openpgp.KeyReaderOption) HandlerOption {
 
 func KeyWriterOptions(opts []openpgp.KeyWriterOption) HandlerOption {
 	return func(h *Handler) error {
+		akw, err := openpgp.NewArmoredKeyWriter(opts...)
+		if err != nil {
+			return errors.WithStack(err)
+		}
 		h.keyWriterOptions = opts
+		h.armorVariant = armorVariant(akw.Headers())
+		return nil
+	}
+}
+
+// armorVariant returns the entity tag variant of armored responses with the
+// given armor headers, so that changing them changes the tag. It is empty if
+// there are none.
+func armorVariant(headers map[string]string) string {
+	if len(headers) == 0 {
+		return ""
+	}
+	var names []string
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	hash := md5.New()
+	for _, name := range names {
+		fmt.Fprintf(hash, "%s: %s\n", name, headers[name])
+	}
+	return "armor" + hex.EncodeToString(hash.Sum(nil))[:8]
+}
+
+// AbuseScorer reports lookups of honeypot keys to the given scorer.
+func AbuseScorer(sc *abuse.Scorer) HandlerOption {
+	return func(h *Handler) error {
+		h.abuseScorer = sc
+		return nil
+	}
+}
+
+// Notifier sets the dispatcher which publishes keys added or updated by
+// submissions.
+func Notifier(d *notify.Dispatcher) HandlerOption {
+	return func(h *Handler) error {
+		h.notifier = d
+		return nil
+	}
+}
+
+// ChangeReporter sets a publisher which must be told of every key change
+// made by submissions, such as a cluster front end's reporter to the
+// stateful server. Unlike the notifier, which may drop events, it is
+// expected to deliver every change.
+func ChangeReporter(p notify.Publisher) HandlerOption {
+	return func(h *Handler) error {
+		h.reporter = p
+		return nil
+	}
+}
+
+// publish tells the notifier and reporter, if any, of a key change.
+func (h *Handler) publish(fingerprint string, change storage.KeyChange, source string) {
+	h.notifier.Publish(fingerprint, change, source)
+	if h.reporter != nil {
+		h.reporter.Publish(fingerprint, change, source)
+	}
+}
+
+// Rollout sets the flags which decide, per key, whether new ingest behaviors
+// apply to submissions.
+func Rollout(f *rollout.Flags) HandlerOption {
+	return func(h *Handler) error {
+		h.rollout = f
+		return nil
+	}
+}
+
+// IngestScheduler sets the scheduler which shares storage writes fairly
+// between submissions and other sources of key updates.
+func IngestScheduler(s *ingest.Scheduler) HandlerOption {
+	return func(h *Handler) error {
+		h.ingest = s
+		return nil
+	}
+}
+
+// ProofVerifier sets the verifier which checks the identity proofs listed in
+// key indexes.
+func ProofVerifier(v *proofs.Verifier) HandlerOption {
+	return func(h *Handler) error {
+		h.proofs = v
+		return nil
+	}
+}
+
+// KeyCache caches the keys found by get lookups of fingerprints and long
+// key IDs.
+func KeyCache(c *keycache.Cache) HandlerOption {
+	return func(h *Handler) error {
+		h.keyCache = c
+		return nil
+	}
+}
+
+// DigestCache shares the digests of the keys fetched by lookups and
+// hashqueries with the other subsystems using c, and resolves hashquery
+// digests from it.
+func DigestCache(c *digestcache.Cache) HandlerOption {
+	return func(h *Handler) error {
+		h.digestCache = c
+		return nil
+	}
+}
+
+// ResponseLimit limits the length of each key served by get lookups to
+// maxLength bytes of packets. Larger keys are truncated to their
+// self-signatures if truncate is set, and refused otherwise.
+func ResponseLimit(maxLength int, truncate bool) HandlerOption {
+	return func(h *Handler) error {
+		h.maxResponseLength = maxLength
+		h.truncateLargeKeys = truncate
+		return nil
+	}
+}
+
+// SlimKeys serves keys from get lookups without superseded self-signatures
+// or expired certifications, as if every lookup had the slim option. Stored
+// keys are unchanged.
+func SlimKeys(slim bool) HandlerOption {
+	return func(h *Handler) error {
+		h.slimKeys = slim
+		return nil
+	}
+}
+
+// AttestedOnly serves keys from get lookups with only the certifications by
+// other keys which the key's holder has attested to, as if every lookup had
+// the attested option. Stored keys are unchanged.
+func AttestedOnly(attested bool) HandlerOption {
+	return func(h *Handler) error {
+		h.attestedOnly = attested
+		return nil
+	}
+}
+
+// ExcludeExpired omits expired keys from get and index lookups, as if every
+// lookup had the exclude-expired option. Keys fetched by hash are still
+// served.
+func ExcludeExpired(exclude bool) HandlerOption {
+	return func(h *Handler) error {
+		h.excludeExpired = exclude
+		return nil
+	}
+}
+
+// RefuseShortKeyIDs refuses get and index lookups by 32-bit key ID, which
+// are trivially spoofed, explaining why in the response. Lookups by 64-bit
+// key ID or fingerprint are unaffected.
+func RefuseShortKeyIDs(refuse bool) HandlerOption {
+	return func(h *Handler) error {
+		h.refuseShortKeyIDs = refuse
+		return nil
+	}
+}
+
+// ModifiedWaitTokens holds /pks/modified requests open waiting for a
+// modification only for clients which present an API token. Other clients
+// are answered at once, and so are rate limited like any other request.
+func ModifiedWaitTokens(tokensOnly bool) HandlerOption {
+	return func(h *Handler) error {
+		h.modifiedWaitTokens = tokensOnly
+		return nil
+	}
+}
+
+// ForwardHashQuery forwards /pks/hashquery requests to the server at u. A
+// front end without a prefix tree uses it to route recon to the stateful
+// server it shares storage with.
+func ForwardHashQuery(u *url.URL) HandlerOption {
+	return func(h *Handler) error {
+		proxy := httputil.NewSingleHostReverseProxy(u)
+		proxy.Transport = &tracing.Transport{}
+		h.hashQueryProxy = proxy
 		return nil
 	}
 }
 
 func NewHandler(storage storage.Storage, options ...HandlerOption) (*Handler, error) {
+	registerMetrics()
 	h := &Handler{
 		storage: storage,
 	}
@@ -168,6 +425,13 @@ func NewHandler(storage storage.Storage, options ...HandlerOption) (*Handler, er
 			return nil, errors.WithStack(err)
 		}
 	}
+	for _, f := range []IndexFormat{h.indexWriter, h.vindexWriter} {
+		if hf, ok := f.(*HTMLFormat); ok {
+			hf.Proofs = h.proofs
+			hf.Redact = h.redact
+			hf.Provenance = h.provenanceRecorder()
+		}
+	}
 	return h, nil
 }
 
@@ -177,49 +441,78 @@ func (h *Handler) Register(r *httprouter.Router) {
 	r.POST("/pks/replace", h.Replace)
 	r.POST("/pks/delete", h.Delete)
 	r.POST("/pks/hashquery", h.HashQuery)
+	r.GET("/pks/modified", h.Modified)
+	r.GET("/pks/mail", h.Mail)
+	r.GET("/pks/select", h.Select)
+	r.GET("/pks/policy", h.Policy)
+	if h.provenance != nil {
+		r.GET("/pks/challenge", h.Challenge)
+	}
+}
+
+// provenanceRecorder returns the storage recording key provenance, if
+// submissions may be proven.
+func (h *Handler) provenanceRecorder() storage.ProvenanceRecorder {
+	if h.provenance == nil {
+		return nil
+	}
+	return h.provenance.recorder
 }
 
 func (h *Handler) Lookup(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	_, span := tracing.StartSpan(r.Context(), "hkp.parse")
 	l, err := ParseLookup(r)
+	span.SetError(err)
+	span.End()
 	if err != nil {
-		httpError(w, http.StatusBadRequest, err)
+		httpError(w, r, http.StatusBadRequest, err)
+		return
+	}
+	if h.refuseShortKeyIDs && l.Op != OperationHGet && isShortKeyID(l.Search) {
+		refuseLookup(w, r, refusedShortKeyID, shortKeyIDMessage)
 		return
 	}
 	switch l.Op {
 	case OperationGet, OperationHGet:
-		h.get(w, l)
+		h.get(w, r, l)
 	case OperationIndex:
-		h.index(w, l, h.indexWriter)
+		h.index(w, r, l, h.indexWriter)
 	case OperationVIndex:
-		h.index(w, l, h.vindexWriter)
+		h.index(w, r, l, h.vindexWriter)
 	case OperationStats:
-		h.stats(w, l)
+		h.stats(w, r, l)
 	default:
-		httpError(w, http.StatusNotFound, errors.Errorf("operation not found: %v", l.Op))
+		httpError(w, r, http.StatusNotFound, errors.Errorf("operation not found: %v", l.Op))
 		return
 	}
 }
 
 func (h *Handler) HashQuery(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	if h.hashQueryProxy != nil {
+		h.hashQueryProxy.ServeHTTP(w, r)
+		return
+	}
 	hq, err := ParseHashQuery(r)
 	if err != nil {
-		httpError(w, http.StatusBadRequest, errors.WithStack(err))
+		httpError(w, r, http.StatusBadRequest, errors.WithStack(err))
 		return
 	}
 	var result []*openpgp.PrimaryKey
+	_, span := tracing.StartSpan(r.Context(), "storage.hashquery")
 	for _, digest := range hq.Digests {
-		rfps, err := h.storage.MatchMD5([]string{digest})
+		keys, err := h.hashQueryKeys(digest)
 		if err != nil {
-			log.Errorf("error resolving hashquery digest %q", digest)
-			continue
-		}
-		keys, err := h.storage.FetchKeys(rfps)
-		if err != nil {
-			log.Errorf("error fetching hashquery key %q", digest)
+			logger.WithFields(logging.RequestFields(r)).WithFields(log.Fields{
+				"digest": digest,
+				"error":  err,
+			}).Error("error fetching hashquery key")
 			continue
 		}
 		result = append(result, keys...)
 	}
+	span.SetAttribute("hkp.digests", len(hq.Digests))
+	span.SetAttribute("hkp.keys", len(result))
+	span.End()
 
 	w.Header().Set("Content-Type", "pgp/keys")
 
@@ -229,19 +522,159 @@ func (h *Handler) HashQuery(w http.ResponseWriter, r *http.Request, _ httprouter
 		// Write each key in binary packet format, prefixed with length
 		err = writeHashqueryKey(w, key)
 		if err != nil {
-			log.Errorf("error writing hashquery key %q: %v", key.RFingerprint, err)
+			logger.WithFields(logging.RequestFields(r)).WithFields(log.Fields{
+				"fp":    key.Fingerprint(),
+				"error": err,
+			}).Error("error writing hashquery key")
 			return
 		}
-		log.WithFields(log.Fields{
+		logger.WithFields(log.Fields{
 			"fp":     key.Fingerprint(),
 			"length": key.Length,
-		}).Info("hashquery result")
+		}).WithFields(logging.RequestFields(r)).Info("hashquery result")
 	}
 
 	// SKS expects hashquery response to terminate with a CRLF
 	_, err = w.Write([]byte{0x0d, 0x0a})
 	if err != nil {
-		log.Errorf("error writing hashquery terminator: %v", err)
+		logger.WithFields(logging.RequestFields(r)).WithField("error", err).Error("error writing hashquery terminator")
+	}
+}
+
+// hashQueryKeys returns the stored keys with the given digest, resolving it
+// from the digest cache if it is cached.
+func (h *Handler) hashQueryKeys(digest string) ([]*openpgp.PrimaryKey, error) {
+	if h.digestCache == nil {
+		rfps, err := h.storage.MatchMD5([]string{digest})
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		keys, err := h.storage.FetchKeys(rfps)
+		return keys, errors.WithStack(err)
+	}
+	if rfp, ok := h.digestCache.RFingerprint(digest); ok {
+		keys, err := h.storage.FetchKeys([]string{rfp})
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		if len(keys) == 1 && keys[0].MD5 == digest {
+			return keys, nil
+		}
+		// The key was changed by another server since its digest was
+		// cached.
+	}
+	gen := h.digestCache.Generation()
+	rfps, err := h.storage.MatchMD5([]string{digest})
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	keys, err := h.storage.FetchKeys(rfps)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	h.digestCache.PutKeys(gen, keys)
+	return keys, nil
+}
+
+// modifiedPollInterval is how often storage is checked for modifications
+// while a /pks/modified request waits for one. Waiting requests are woken by
+// changes made through this server's storage; the poll finds changes made by
+// other servers sharing the database.
+const modifiedPollInterval = 30 * time.Second
+
+// modifiedSignal wakes /pks/modified requests waiting for a modification.
+type modifiedSignal struct {
+	mu sync.Mutex
+	ch chan struct{}
+}
+
+// wait returns a channel which is closed at the next key change.
+func (ms *modifiedSignal) wait() <-chan struct{} {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	if ms.ch == nil {
+		ms.ch = make(chan struct{})
+	}
+	return ms.ch
+}
+
+// KeyChanged wakes the requests waiting for a modification. It is subscribed
+// to storage key changes.
+func (ms *modifiedSignal) KeyChanged(change storage.KeyChange) error {
+	if _, ok := change.(storage.KeyNotChanged); ok {
+		return nil
+	}
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	if ms.ch != nil {
+		close(ms.ch)
+		ms.ch = nil
+	}
+	return nil
+}
+
+// ModifiedResponse is the JSON response to a /pks/modified request.
+type ModifiedResponse struct {
+	Keys []storage.ModifiedKey `json:"keys"`
+}
+
+// Modified pages through keyrings in the order they were modified, so that
+// replicas can follow changes to this server. If there are no modifications
+// after the requested position, the request waits for one up to the
+// requested time.
+func (h *Handler) Modified(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	if !storage.Supports(h.storage, storage.CapModifiedSince) {
+		httpError(w, r, http.StatusNotImplemented, errors.New("storage does not support modification paging"))
+		return
+	}
+	m, err := ParseModified(r)
+	if err != nil {
+		httpError(w, r, http.StatusBadRequest, errors.WithStack(err))
+		return
+	}
+	if _, ok := apitoken.FromContext(r.Context()); h.modifiedWaitTokens && !ok {
+		m.Wait = 0
+	}
+	h.modifiedOnce.Do(func() {
+		h.storage.Subscribe(h.modified.KeyChanged)
+	})
+
+	deadline := time.Now().Add(m.Wait)
+	var keys []storage.ModifiedKey
+	for {
+		// Take the signal before querying, so that a change made meanwhile
+		// is not missed.
+		changed := h.modified.wait()
+		keys, err = h.storage.ModifiedAfter(m.After, m.Limit)
+		if err != nil {
+			httpError(w, r, http.StatusInternalServerError, errors.WithStack(err))
+			return
+		}
+		remaining := time.Until(deadline)
+		if len(keys) > 0 || remaining <= 0 {
+			break
+		}
+		if remaining > modifiedPollInterval {
+			remaining = modifiedPollInterval
+		}
+		timer := time.NewTimer(remaining)
+		select {
+		case <-r.Context().Done():
+			timer.Stop()
+			return
+		case <-changed:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+	if keys == nil {
+		keys = []storage.ModifiedKey{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(&ModifiedResponse{Keys: keys})
+	if err != nil {
+		logger.WithFields(logging.RequestFields(r)).WithField("error", err).Error("error writing modified response")
 	}
 }
 
@@ -262,10 +695,22 @@ func writeHashqueryKey(w http.ResponseWriter, key *openpgp.PrimaryKey) error {
 	return nil
 }
 
+// isShortKeyID returns whether search is a 32-bit key ID, which resolve
+// looks up by key ID rather than by keyword.
+func isShortKeyID(search string) bool {
+	return strings.HasPrefix(search, "0x") && len(search) == 2+shortKeyIDLen
+}
+
 func (h *Handler) resolve(l *Lookup) ([]string, error) {
 	if l.Op == OperationHGet {
 		return h.storage.MatchMD5([]string{l.Search})
 	}
+	if l.Search == "" {
+		if h.fingerprintOnly || !storage.Supports(h.storage, storage.CapTimeRange) {
+			return nil, errTimeRangeNotAvailable
+		}
+		return h.storage.MatchTimeRange(l.Range, maxTimeRangeResults)
+	}
 	if strings.HasPrefix(l.Search, "0x") {
 		keyID := openpgp.Reverse(strings.ToLower(l.Search[2:]))
 		switch len(keyID) {
@@ -273,26 +718,48 @@ func (h *Handler) resolve(l *Lookup) ([]string, error) {
 			return h.storage.Resolve([]string{keyID})
 		}
 	}
-	if h.fingerprintOnly {
+	if h.fingerprintOnly || !storage.Supports(h.storage, storage.CapKeywordSearch) {
 		return nil, errKeywordSearchNotAvailable
 	}
 	return h.storage.MatchKeyword([]string{l.Search})
 }
 
-func (h *Handler) keys(l *Lookup) ([]*openpgp.PrimaryKey, error) {
-	rfps, err := h.resolve(l)
+func (h *Handler) keys(r *http.Request, l *Lookup) ([]*openpgp.PrimaryKey, error) {
+	_, span := tracing.StartSpan(r.Context(), "storage.lookup")
+	span.SetAttribute("hkp.op", string(l.Op))
+	keys, err := h.fetch(l)
+	span.SetAttribute("hkp.keys", len(keys))
+	span.SetError(err)
+	span.End()
 	if err != nil {
 		return nil, err
 	}
-	keys, err := h.storage.FetchKeys(rfps)
-	if err != nil {
-		return nil, errors.WithStack(err)
+	if !l.Range.IsZero() {
+		var inRange []*openpgp.PrimaryKey
+		for _, key := range keys {
+			if l.Range.Match(key) {
+				inRange = append(inRange, key)
+			}
+		}
+		keys = inRange
+	}
+	if l.Op != OperationHGet && (h.excludeExpired || l.Options[OptionExcludeExpired]) {
+		var unexpired []*openpgp.PrimaryKey
+		for _, key := range keys {
+			if !key.Expired() {
+				unexpired = append(unexpired, key)
+			}
+		}
+		keys = unexpired
 	}
+	_, span = tracing.StartSpan(r.Context(), "openpgp.validate")
+	defer span.End()
 	for _, key := range keys {
 		if err := openpgp.ValidSelfSigned(key, h.selfSignedOnly); err != nil {
+			span.SetError(err)
 			return nil, errors.WithStack(err)
 		}
-		log.WithFields(log.Fields{
+		logger.WithFields(logging.RequestFields(r)).WithFields(log.Fields{
 			"fp":     key.Fingerprint(),
 			"length": key.Length,
 			"op":     l.Op,
@@ -301,19 +768,79 @@ func (h *Handler) keys(l *Lookup) ([]*openpgp.PrimaryKey, error) {
 	return keys, nil
 }
 
-func (h *Handler) get(w http.ResponseWriter, l *Lookup) {
-	keys, err := h.keys(l)
-	if err == errKeywordSearchNotAvailable {
-		httpError(w, http.StatusBadRequest, errors.WithStack(err))
+// fetch returns the keys matching a lookup, from the key cache if it is a
+// get by fingerprint or long key ID.
+func (h *Handler) fetch(l *Lookup) ([]*openpgp.PrimaryKey, error) {
+	if h.keyCache != nil && l.Op == OperationGet && strings.HasPrefix(l.Search, "0x") {
+		keyID := openpgp.Reverse(strings.ToLower(l.Search[2:]))
+		if keycache.Cacheable(keyID) {
+			keys, err := h.keyCache.Lookup(h.storage, keyID)
+			return keys, errors.WithStack(err)
+		}
+	}
+	var gen uint64
+	if h.digestCache != nil {
+		gen = h.digestCache.Generation()
+	}
+	rfps, err := h.resolve(l)
+	if err != nil {
+		return nil, err
+	}
+	keys, err := h.storage.FetchKeys(rfps)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if h.digestCache != nil {
+		h.digestCache.PutKeys(gen, keys)
+	}
+	return keys, nil
+}
+
+// checkHoneypots reports the client to the abuse scorer if any of the keys
+// it looked up is a honeypot. Hashquery is not checked, since recon partners
+// legitimately fetch every key that way.
+func (h *Handler) checkHoneypots(r *http.Request, keys []*openpgp.PrimaryKey) {
+	if h.abuseScorer == nil {
+		return
+	}
+	for _, key := range keys {
+		fp := key.Fingerprint()
+		if h.abuseScorer.IsHoneypot(fp) {
+			h.abuseScorer.RecordHoneypot(abuse.ClientAddr(r.RemoteAddr), fp)
+		}
+	}
+}
+
+func (h *Handler) get(w http.ResponseWriter, r *http.Request, l *Lookup) {
+	keys, err := h.keys(r, l)
+	if err == errKeywordSearchNotAvailable || err == errTimeRangeNotAvailable {
+		httpError(w, r, http.StatusBadRequest, errors.WithStack(err))
 		return
 	} else if err != nil {
-		httpError(w, http.StatusInternalServerError, errors.WithStack(err))
+		httpError(w, r, http.StatusInternalServerError, errors.WithStack(err))
 		return
 	}
 	if len(keys) == 0 {
-		httpError(w, http.StatusNotFound, errors.New("not found"))
+		httpError(w, r, http.StatusNotFound, errors.New("not found"))
 		return
 	}
+	h.checkHoneypots(r, keys)
+
+	_, span := tracing.StartSpan(r.Context(), "hkp.render")
+	defer span.End()
+
+	// Keys fetched by hash are served whole, so that they match the digest.
+	slim := l.Op == OperationGet && (h.slimKeys || l.Options[OptionSlim])
+	attested := l.Op == OperationGet && (h.attestedOnly || l.Options[OptionAttested])
+	var variants []string
+	if attested {
+		variants = append(variants, "attested")
+	}
+	if slim {
+		variants = append(variants, "slim")
+	}
+	digests := keyDigests(keys)
+	modTime := h.modTime(keys)
 
 	// Drop malformed packets, since these break GPG imports.
 	for _, key := range keys {
@@ -327,52 +854,221 @@ func (h *Handler) get(w http.ResponseWriter, l *Lookup) {
 		key.Others = others
 	}
 
-	w.Header().Set("Content-Type", "text/plain")
-	err = openpgp.WriteArmoredPackets(w, keys, h.keyWriterOptions...)
+	if attested {
+		for _, key := range keys {
+			err = openpgp.AttestedOnly(key)
+			if err != nil {
+				httpError(w, r, http.StatusInternalServerError, errors.WithStack(err))
+				return
+			}
+		}
+	}
+
+	if slim {
+		for _, key := range keys {
+			err = openpgp.Slim(key)
+			if err != nil {
+				httpError(w, r, http.StatusInternalServerError, errors.WithStack(err))
+				return
+			}
+		}
+	}
+
+	if h.maxResponseLength > 0 {
+		truncated := false
+		for _, key := range keys {
+			if key.SerializedLength() <= h.maxResponseLength {
+				continue
+			}
+			if h.truncateLargeKeys {
+				err = openpgp.Truncate(key)
+				if err != nil {
+					httpError(w, r, http.StatusInternalServerError, errors.WithStack(err))
+					return
+				}
+			}
+			if length := key.SerializedLength(); length > h.maxResponseLength {
+				logger.WithFields(logging.RequestFields(r)).WithFields(log.Fields{
+					"fp":     key.Fingerprint(),
+					"length": length,
+				}).Warning("key exceeds the response limit")
+				http.Error(w, fmt.Sprintf("key %s exceeds the limit of %d bytes",
+					key.Fingerprint(), h.maxResponseLength), http.StatusUnprocessableEntity)
+				return
+			}
+			logger.WithFields(logging.RequestFields(r)).WithFields(log.Fields{
+				"fp": key.Fingerprint(),
+			}).Info("key truncated to fit the response limit")
+			w.Header().Add("X-HKP-Truncated", key.Fingerprint())
+			truncated = true
+		}
+		if truncated {
+			variants = append(variants, "truncated")
+		}
+	}
+	if h.armorVariant != "" {
+		variants = append(variants, h.armorVariant)
+	}
+	etag := keysETag(digests, variants...)
+
+	var buf bytes.Buffer
+	err = openpgp.WriteArmoredPackets(&buf, keys, h.keyWriterOptions...)
 	if err != nil {
-		log.Errorf("get %q: error writing armored keys: %v", l.Search, err)
+		httpError(w, r, http.StatusInternalServerError, errors.WithStack(err))
+		return
 	}
 	// Write a trailing newline as required by the HKP spec
 	// (§3.1.2.1) and as expected by many tools, e.g. RPM.
-	_, err = w.Write([]byte("\n"))
+	buf.WriteString("\n")
+
+	// ServeContent answers If-None-Match and If-Modified-Since with 304 Not
+	// Modified, so that mirrors and caches need not download unchanged keys
+	// again.
+	w.Header().Set("Content-Type", "text/plain")
+	body, encoding, err := h.compress(w, r, buf.Bytes())
+	if err != nil {
+		httpError(w, r, http.StatusInternalServerError, errors.WithStack(err))
+		return
+	}
+	if encoding != "" {
+		// Each encoding is a representation of its own.
+		etag = strings.TrimSuffix(etag, `"`) + "-" + encoding + `"`
+	}
+	w.Header().Set("ETag", etag)
+	http.ServeContent(w, r, "", modTime, bytes.NewReader(body))
+}
+
+// keyDigests returns the digests of keys as stored, before they are
+// filtered or truncated.
+func keyDigests(keys []*openpgp.PrimaryKey) []string {
+	var digests []string
+	for _, key := range keys {
+		digests = append(digests, key.MD5)
+	}
+	return digests
+}
+
+// keysETag returns the entity tag of a get response for keys with the given
+// stored digests, and the variants of the response, such as slim or
+// truncated. A response of several keys has a weak tag, since storage may
+// return them in any order.
+func keysETag(digests []string, variants ...string) string {
+	var tag string
+	if len(digests) == 1 {
+		tag = digests[0]
+	} else {
+		sorted := append([]string(nil), digests...)
+		sort.Strings(sorted)
+		sum := md5.Sum([]byte(strings.Join(sorted, ",")))
+		tag = hex.EncodeToString(sum[:])
+	}
+	for _, variant := range variants {
+		tag += "-" + variant
+	}
+	if len(digests) > 1 {
+		return `W/"` + tag + `"`
+	}
+	return `"` + tag + `"`
+}
+
+// modTime returns when the most recently modified of keys was stored, or
+// the zero time if the storage backend does not record it. Keys served from
+// the key cache carry their modification time, so that storage is only
+// queried for the others.
+func (h *Handler) modTime(keys []*openpgp.PrimaryKey) time.Time {
+	if h.keyCache != nil {
+		var latest time.Time
+		cached := true
+		for _, key := range keys {
+			t, ok := h.keyCache.ModTime(key.MD5)
+			if !ok {
+				cached = false
+				break
+			}
+			if t.After(latest) {
+				latest = t
+			}
+		}
+		if cached {
+			return latest
+		}
+	}
+	fetcher, ok := h.storage.(storage.ModTimeFetcher)
+	if !ok {
+		return time.Time{}
+	}
+	var rfps []string
+	for _, key := range keys {
+		rfps = append(rfps, key.RFingerprint)
+	}
+	modTimes, err := fetcher.FetchModTimes(rfps)
 	if err != nil {
-		log.Errorf("get %q: failed to write trailing newline: %v", l.Search, err)
+		logger.WithField("error", err).Warning("failed to fetch key modification times")
+		return time.Time{}
+	}
+	var latest time.Time
+	for _, t := range modTimes {
+		if t.After(latest) {
+			latest = t
+		}
 	}
+	return latest
 }
 
-func (h *Handler) index(w http.ResponseWriter, l *Lookup, f IndexFormat) {
-	keys, err := h.keys(l)
-	if err == errKeywordSearchNotAvailable {
-		httpError(w, http.StatusBadRequest, errors.WithStack(err))
+func (h *Handler) index(w http.ResponseWriter, r *http.Request, l *Lookup, f IndexFormat) {
+	keys, err := h.keys(r, l)
+	if err == errKeywordSearchNotAvailable || err == errTimeRangeNotAvailable {
+		httpError(w, r, http.StatusBadRequest, errors.WithStack(err))
 		return
 	} else if err != nil {
-		httpError(w, http.StatusInternalServerError, errors.WithStack(err))
+		httpError(w, r, http.StatusInternalServerError, errors.WithStack(err))
 		return
 	}
 	if len(keys) == 0 {
-		httpError(w, http.StatusNotFound, errors.New("not found"))
+		httpError(w, r, http.StatusNotFound, errors.New("not found"))
 		return
 	}
+	h.checkHoneypots(r, keys)
+
+	_, span := tracing.StartSpan(r.Context(), "hkp.render")
+	defer span.End()
 
 	if l.Options[OptionMachineReadable] {
-		f = mrFormat
+		f = &MRFormat{Redact: h.redact}
 	} else if l.Options[OptionJSON] || f == nil {
-		f = jsonFormat
+		f = &JSONFormat{Proofs: h.proofs, Redact: h.redact, Provenance: h.provenanceRecorder()}
 	}
 
-	err = f.Write(w, l, keys)
+	if !h.compression.Enabled {
+		err = f.Write(w, l, keys)
+		if err != nil {
+			httpError(w, r, http.StatusInternalServerError, errors.WithStack(err))
+		}
+		return
+	}
+	bw := &bufferedResponseWriter{ResponseWriter: w}
+	err = f.Write(bw, l, keys)
+	if err != nil {
+		httpError(w, r, http.StatusInternalServerError, errors.WithStack(err))
+		return
+	}
+	body, _, err := h.compress(w, r, bw.buf.Bytes())
 	if err != nil {
-		httpError(w, http.StatusInternalServerError, errors.WithStack(err))
+		httpError(w, r, http.StatusInternalServerError, errors.WithStack(err))
 		return
 	}
+	if bw.status != 0 {
+		w.WriteHeader(bw.status)
+	}
+	w.Write(body)
 }
 
-func (h *Handler) indexJSON(w http.ResponseWriter, keys []*openpgp.PrimaryKey) {
+func (h *Handler) indexJSON(w http.ResponseWriter, r *http.Request, keys []*openpgp.PrimaryKey) {
 	w.Header().Set("Content-Type", "application/json")
 	enc := json.NewEncoder(w)
 	err := enc.Encode(&keys)
 	if err != nil {
-		httpError(w, http.StatusInternalServerError, errors.WithStack(err))
+		httpError(w, r, http.StatusInternalServerError, errors.WithStack(err))
 		return
 	}
 }
@@ -389,15 +1085,15 @@ type StatsResponse struct {
 	Stats *sks.Stats
 }
 
-func (h *Handler) stats(w http.ResponseWriter, l *Lookup) {
+func (h *Handler) stats(w http.ResponseWriter, r *http.Request, l *Lookup) {
 	if h.statsFunc == nil {
-		httpError(w, http.StatusBadRequest, errors.New("stats not configured"))
+		httpError(w, r, http.StatusBadRequest, errors.New("stats not configured"))
 		fmt.Fprintln(w, "stats not configured")
 		return
 	}
 	data, err := h.statsFunc()
 	if err != nil {
-		httpError(w, http.StatusInternalServerError, errors.WithStack(err))
+		httpError(w, r, http.StatusInternalServerError, errors.WithStack(err))
 		return
 	}
 
@@ -407,7 +1103,27 @@ func (h *Handler) stats(w http.ResponseWriter, l *Lookup) {
 		err = json.NewEncoder(w).Encode(data)
 	}
 	if err != nil {
-		httpError(w, http.StatusInternalServerError, errors.WithStack(err))
+		httpError(w, r, http.StatusInternalServerError, errors.WithStack(err))
+	}
+}
+
+// Policy responds with a JSON document describing what the server checks
+// when accepting and serving keys.
+func (h *Handler) Policy(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	if h.policyFunc == nil {
+		httpError(w, r, http.StatusNotFound, errors.New("policy not configured"))
+		return
+	}
+	data, err := h.policyFunc()
+	if err != nil {
+		httpError(w, r, http.StatusInternalServerError, errors.WithStack(err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "public, max-age=3600")
+	err = json.NewEncoder(w).Encode(data)
+	if err != nil {
+		logger.WithFields(logging.RequestFields(r)).WithField("error", err).Error("error writing policy")
 	}
 }
 
@@ -415,47 +1131,162 @@ type AddResponse struct {
 	Inserted []string `json:"inserted"`
 	Updated  []string `json:"updated"`
 	Ignored  []string `json:"ignored"`
+
+	// Proven lists the keys submitted with proof of possession.
+	Proven []string `json:"proven,omitempty"`
+
+	// Warnings explain problems with the submission which did not prevent
+	// it from being stored.
+	Warnings []string `json:"warnings,omitempty"`
+
+	// Changes report what ingest policy dropped from the submitted keys,
+	// including keys which were dropped entirely.
+	Changes []openpgp.PolicyChange `json:"changes,omitempty"`
+}
+
+// policyReport collects the changes ingest policy makes to a submission.
+// Repeated changes of the same kind to a key are merged into one.
+type policyReport struct {
+	changes []openpgp.PolicyChange
+}
+
+func (pr *policyReport) add(change openpgp.PolicyChange) {
+	for i := range pr.changes {
+		c := &pr.changes[i]
+		if c.Fingerprint == change.Fingerprint && c.Policy == change.Policy &&
+			c.Dropped == change.Dropped && c.Detail == change.Detail {
+			c.Count += change.Count
+			return
+		}
+	}
+	pr.changes = append(pr.changes, change)
+}
+
+// readerOptions returns the handler's key reader options, reporting the
+// changes they make to report.
+func (h *Handler) readerOptions(report *policyReport) []openpgp.KeyReaderOption {
+	opts := make([]openpgp.KeyReaderOption, 0, len(h.keyReaderOptions)+1)
+	opts = append(opts, h.keyReaderOptions...)
+	return append(opts, openpgp.ReportChanges(report.add))
 }
 
 func (h *Handler) Add(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	var body *cappedBody
+	if max := h.limits.maxRequestLength(); max > 0 {
+		body = &cappedBody{ReadCloser: r.Body, remaining: max}
+		r.Body = body
+	}
 	add, err := ParseAdd(r)
-	if err != nil {
-		httpError(w, http.StatusBadRequest, errors.WithStack(err))
+	if body != nil && body.exceeded {
+		rejectSubmission(w, r, newLimitError(http.StatusRequestEntityTooLarge, limitLength,
+			"request exceeds the limit of %d bytes", h.limits.maxRequestLength()))
+		return
+	} else if err != nil {
+		httpError(w, r, http.StatusBadRequest, errors.WithStack(err))
 		return
 	}
 
 	// Check and decode the armor
 	armorBlock, err := armor.Decode(bytes.NewBufferString(add.Keytext))
 	if err != nil {
-		httpError(w, http.StatusBadRequest, errors.WithStack(err))
+		httpError(w, r, http.StatusBadRequest, errors.WithStack(err))
+		return
+	}
+	keytext, stripped, err := h.limits.readSubmission(armorBlock.Body)
+	if le, ok := err.(*limitError); ok {
+		if le.reason == limitSecret {
+			h.quarantine(r, add.Keytext)
+		}
+		rejectSubmission(w, r, le)
+		return
+	} else if err != nil {
+		httpError(w, r, http.StatusBadRequest, errors.WithStack(err))
 		return
 	}
 
 	var result AddResponse
-	kr := openpgp.NewKeyReader(armorBlock.Body, h.keyReaderOptions...)
-	keys, err := kr.Read()
-	if err != nil {
-		httpError(w, http.StatusBadRequest, errors.WithStack(err))
+	var report policyReport
+	if stripped > 0 {
+		h.warnSecretStripped(w, r, add.Keytext, stripped)
+		result.Warnings = append(result.Warnings, secretKeyWarning)
+		report.add(openpgp.PolicyChange{
+			Policy:  limitSecret,
+			Dropped: "secret key material",
+			Count:   stripped,
+		})
+	}
+
+	if revocationOnly(keytext) {
+		h.addRevocations(w, r, keytext)
 		return
 	}
-	for _, key := range keys {
-		err := openpgp.DropDuplicates(key)
+
+	_, span := tracing.StartSpan(r.Context(), "openpgp.parse")
+	kr := openpgp.NewKeyReader(bytes.NewReader(keytext), h.readerOptions(&report)...)
+	keys, err := kr.ReadContext(r.Context())
+	span.SetAttribute("hkp.keys", len(keys))
+	span.SetError(err)
+	span.End()
+	if errors.Is(err, openpgp.ErrBudgetExceeded) {
+		h.rejectOverBudget(w, r, add.Keytext, err)
+		return
+	} else if err != nil {
+		httpError(w, r, http.StatusBadRequest, errors.WithStack(err))
+		return
+	}
+	var provenFp string
+	if h.provenance != nil && add.Challenge != "" {
+		provenFp, err = h.provenance.prove(add.Keytext, add.Challenge, add.Keysig)
 		if err != nil {
-			httpError(w, http.StatusInternalServerError, errors.WithStack(err))
+			httpError(w, r, http.StatusBadRequest, errors.Wrap(err, "invalid proof of possession"))
+			return
+		}
+	}
+	release, ok := h.acquireIngest(w, r)
+	if !ok {
+		return
+	}
+	defer release()
+	for _, key := range keys {
+		ctx, cancel := openpgp.WithKeyBudget(r.Context(), h.keyReaderOptions...)
+		err := openpgp.DropDuplicatesContext(ctx, key)
+		if err == nil {
+			err = h.applyRollout(ctx, key, &report)
+		}
+		cancel()
+		if errors.Is(err, openpgp.ErrBudgetExceeded) {
+			h.rejectOverBudget(w, r, add.Keytext, errors.Wrapf(err, "key %s", key.Fingerprint()))
+			return
+		} else if err != nil {
+			httpError(w, r, http.StatusInternalServerError, errors.WithStack(err))
 			return
 		}
 
-		change, err := storage.UpsertKey(h.storage, key)
+		_, span := tracing.StartSpan(r.Context(), "storage.upsert")
+		span.SetAttribute("hkp.fp", key.Fingerprint())
+		change, err := storage.UpsertKey(h.storage, key, h.keyReaderOptions...)
+		span.SetError(err)
+		span.End()
 		if err != nil {
 			if errors.Is(err, storage.ErrKeyNotFound) {
-				httpError(w, http.StatusNotFound, errors.WithStack(err))
+				httpError(w, r, http.StatusNotFound, errors.WithStack(err))
+			} else if errors.Is(err, openpgp.ErrBudgetExceeded) {
+				h.rejectOverBudget(w, r, add.Keytext, errors.Wrapf(err, "key %s", key.Fingerprint()))
 			} else {
-				httpError(w, http.StatusInternalServerError, errors.WithStack(err))
+				httpError(w, r, http.StatusInternalServerError, errors.WithStack(err))
 			}
 			return
 		}
+		h.publish(key.Fingerprint(), change, notify.SourceAdd)
 
 		fp := key.QualifiedFingerprint()
+		proven, err := h.recordProvenance(key, provenFp)
+		if err != nil {
+			httpError(w, r, http.StatusInternalServerError, errors.WithStack(err))
+			return
+		} else if proven {
+			result.Proven = append(result.Proven, fp)
+		}
 		switch change.(type) {
 		case storage.KeyAdded:
 			result.Inserted = append(result.Inserted, fp)
@@ -465,10 +1296,12 @@ func (h *Handler) Add(w http.ResponseWriter, r *http.Request, _ httprouter.Param
 			result.Ignored = append(result.Ignored, fp)
 		}
 	}
-	log.WithFields(log.Fields{
+	result.Changes = report.changes
+	logger.WithFields(log.Fields{
 		"inserted": result.Inserted,
 		"updated":  result.Updated,
-	}).Info("add")
+		"changes":  len(result.Changes),
+	}).WithFields(logging.RequestFields(r)).Info("add")
 
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
@@ -476,31 +1309,112 @@ func (h *Handler) Add(w http.ResponseWriter, r *http.Request, _ httprouter.Param
 	enc.Encode(&result)
 }
 
+// warnSecretStripped records a submission from which secret key material
+// was discarded, quarantining it so that an operator may warn its owner, and
+// warns the submitter in the Warning header.
+func (h *Handler) warnSecretStripped(w http.ResponseWriter, r *http.Request, keytext string, stripped int) {
+	limitMetrics.stripped.Inc()
+	logger.WithFields(logging.RequestFields(r)).WithField("packets", stripped).Warning("secret key material discarded from submission")
+	h.quarantine(r, keytext)
+	w.Header().Add("Warning", fmt.Sprintf("299 - %q", secretKeyWarning))
+}
+
+// rejectOverBudget quarantines and rejects a submission with a key which
+// could not be processed within the key budget.
+func (h *Handler) rejectOverBudget(w http.ResponseWriter, r *http.Request, keytext string, err error) {
+	logger.WithFields(logging.RequestFields(r)).WithField("error", err).Warning("key processing budget exceeded")
+	h.quarantine(r, keytext)
+	rejectSubmission(w, r, newLimitError(http.StatusUnprocessableEntity, limitBudget, "%v", err))
+}
+
+// recordProvenance records that key was proven by its holder, if it is the
+// key with the fingerprint provenFp and submissions may be proven.
+func (h *Handler) recordProvenance(key *openpgp.PrimaryKey, provenFp string) (bool, error) {
+	if h.provenance == nil || provenFp == "" || key.Fingerprint() != provenFp {
+		return false, nil
+	}
+	err := h.provenance.recorder.RecordProvenance([]string{key.RFingerprint})
+	if err != nil {
+		return false, errors.WithStack(err)
+	}
+	return true, nil
+}
+
+// acquireIngest waits for a worker to write submitted keys to storage. If
+// none can be had, it responds to the request and returns false.
+func (h *Handler) acquireIngest(w http.ResponseWriter, r *http.Request) (func(), bool) {
+	release, err := h.ingest.Acquire(r.Context(), ingest.ClassSubmission)
+	if errors.Is(err, ingest.ErrQueueFull) {
+		w.Header().Set("Retry-After", "60")
+		httpError(w, r, http.StatusServiceUnavailable, errors.WithStack(err))
+		return nil, false
+	} else if err != nil {
+		// The client has gone away.
+		logger.WithFields(logging.RequestFields(r)).WithField("error", err).Debug("add abandoned")
+		return nil, false
+	}
+	return release, true
+}
+
+// applyRollout applies the ingest behaviors rolled out to a submitted key,
+// reporting what they drop to report. It fails if ctx is done before the
+// key's signatures are verified.
+func (h *Handler) applyRollout(ctx context.Context, key *openpgp.PrimaryKey, report *policyReport) error {
+	fp := key.Fingerprint()
+	strip := h.rollout.Enabled(rollout.StripUnverified, fp)
+	selfSignedOnly := h.rollout.Enabled(rollout.DropThirdPartySigs, fp)
+	if !strip && !selfSignedOnly {
+		return nil
+	}
+	policy := rollout.StripUnverified
+	if selfSignedOnly {
+		policy = rollout.DropThirdPartySigs
+	}
+	changes, err := openpgp.ApplyPolicy(key, policy, func(key *openpgp.PrimaryKey) error {
+		return openpgp.ValidSelfSignedContext(ctx, key, selfSignedOnly)
+	})
+	if err != nil {
+		return err
+	}
+	for _, change := range changes {
+		report.add(change)
+	}
+	return nil
+}
+
 func (h *Handler) Replace(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 	replace, err := ParseReplace(r)
 	if err != nil {
-		httpError(w, http.StatusBadRequest, errors.WithStack(err))
+		httpError(w, r, http.StatusBadRequest, errors.WithStack(err))
 		return
 	}
 
 	signingFp, err := h.checkSignature(replace.Keytext, replace.Keysig)
 	if err != nil {
-		httpError(w, http.StatusBadRequest, errors.Wrap(err, "invalid signature"))
+		httpError(w, r, http.StatusBadRequest, errors.Wrap(err, "invalid signature"))
 		return
 	}
 
 	// Check and decode the armor
 	armorBlock, err := armor.Decode(bytes.NewBufferString(replace.Keytext))
 	if err != nil {
-		httpError(w, http.StatusBadRequest, errors.WithStack(err))
+		httpError(w, r, http.StatusBadRequest, errors.WithStack(err))
 		return
 	}
 
 	var result AddResponse
-	kr := openpgp.NewKeyReader(armorBlock.Body, h.keyReaderOptions...)
-	keys, err := kr.Read()
-	if err != nil {
-		httpError(w, http.StatusBadRequest, errors.WithStack(err))
+	var report policyReport
+	_, span := tracing.StartSpan(r.Context(), "openpgp.parse")
+	kr := openpgp.NewKeyReader(armorBlock.Body, h.readerOptions(&report)...)
+	keys, err := kr.ReadContext(r.Context())
+	span.SetAttribute("hkp.keys", len(keys))
+	span.SetError(err)
+	span.End()
+	if errors.Is(err, openpgp.ErrBudgetExceeded) {
+		h.rejectOverBudget(w, r, replace.Keytext, err)
+		return
+	} else if err != nil {
+		httpError(w, r, http.StatusBadRequest, errors.WithStack(err))
 		return
 	}
 	for _, key := range keys {
@@ -509,20 +1423,33 @@ func (h *Handler) Replace(w http.ResponseWriter, r *http.Request, _ httprouter.P
 		}
 		err := openpgp.DropDuplicates(key)
 		if err != nil {
-			httpError(w, http.StatusInternalServerError, errors.WithStack(err))
+			httpError(w, r, http.StatusInternalServerError, errors.WithStack(err))
 			return
 		}
+		_, span := tracing.StartSpan(r.Context(), "storage.replace")
+		span.SetAttribute("hkp.fp", key.Fingerprint())
 		change, err := storage.ReplaceKey(h.storage, key)
+		span.SetError(err)
+		span.End()
 		if err != nil {
 			if errors.Is(err, storage.ErrKeyNotFound) {
-				httpError(w, http.StatusNotFound, errors.WithStack(err))
+				httpError(w, r, http.StatusNotFound, errors.WithStack(err))
 			} else {
-				httpError(w, http.StatusInternalServerError, errors.WithStack(err))
+				httpError(w, r, http.StatusInternalServerError, errors.WithStack(err))
 			}
 			return
 		}
+		h.publish(key.Fingerprint(), change, notify.SourceReplace)
 
+		// The replacement is signed by the key, which proves possession.
 		fp := key.QualifiedFingerprint()
+		proven, err := h.recordProvenance(key, signingFp)
+		if err != nil {
+			httpError(w, r, http.StatusInternalServerError, errors.WithStack(err))
+			return
+		} else if proven {
+			result.Proven = append(result.Proven, fp)
+		}
 		switch change.(type) {
 		case storage.KeyAdded:
 			result.Inserted = append(result.Inserted, fp)
@@ -532,10 +1459,12 @@ func (h *Handler) Replace(w http.ResponseWriter, r *http.Request, _ httprouter.P
 			result.Ignored = append(result.Ignored, fp)
 		}
 	}
-	log.WithFields(log.Fields{
+	result.Changes = report.changes
+	logger.WithFields(log.Fields{
 		"inserted": result.Inserted,
 		"updated":  result.Updated,
-	}).Info("add")
+		"changes":  len(result.Changes),
+	}).WithFields(logging.RequestFields(r)).Info("add")
 
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
@@ -546,27 +1475,28 @@ func (h *Handler) Replace(w http.ResponseWriter, r *http.Request, _ httprouter.P
 func (h *Handler) Delete(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 	del, err := ParseDelete(r)
 	if err != nil {
-		httpError(w, http.StatusBadRequest, errors.WithStack(err))
+		httpError(w, r, http.StatusBadRequest, errors.WithStack(err))
 		return
 	}
 
 	signingFp, err := h.checkSignature(del.Keytext, del.Keysig)
 	if err != nil {
-		httpError(w, http.StatusBadRequest, errors.Wrap(err, "invalid signature"))
+		httpError(w, r, http.StatusBadRequest, errors.Wrap(err, "invalid signature"))
 		return
 	}
 
 	change, err := storage.DeleteKey(h.storage, signingFp)
 	if err != nil {
 		if errors.Is(err, storage.ErrKeyNotFound) {
-			httpError(w, http.StatusNotFound, errors.WithStack(err))
+			httpError(w, r, http.StatusNotFound, errors.WithStack(err))
 		} else {
-			httpError(w, http.StatusInternalServerError, errors.Wrap(err, "failed to delete key"))
+			httpError(w, r, http.StatusInternalServerError, errors.Wrap(err, "failed to delete key"))
 		}
 		return
 	}
+	h.publish(signingFp, change, notify.SourceDelete)
 
-	log.WithFields(log.Fields{
+	logger.WithFields(logging.RequestFields(r)).WithFields(log.Fields{
 		"change":  change,
 		"deleted": []string{signingFp},
 	}).Info("delete")
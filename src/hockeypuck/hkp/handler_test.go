@@ -19,20 +19,43 @@ package hkp
 
 import (
 	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	stdtesting "testing"
+	"time"
 
 	"github.com/julienschmidt/httprouter"
+	xopenpgp "golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+	"golang.org/x/crypto/openpgp/packet"
 	gc "gopkg.in/check.v1"
 
+	"hockeypuck/abuse"
+	"hockeypuck/clock"
+	"hockeypuck/conflux/recon"
+	"hockeypuck/hkp/digestcache"
+	"hockeypuck/hkp/jsonhkp"
+	"hockeypuck/hkp/keycache"
+	"hockeypuck/ingest"
 	"hockeypuck/openpgp"
+	"hockeypuck/proofs"
+	"hockeypuck/rollout"
 	"hockeypuck/testing"
 
+	"hockeypuck/hkp/storage"
 	"hockeypuck/hkp/storage/mock"
 )
 
@@ -127,6 +150,249 @@ func (s *HandlerSuite) TestGetKeyID(c *gc.C) {
 	c.Assert(s.storage.MethodCount("FetchKeys"), gc.Equals, 1)
 }
 
+func (s *HandlerSuite) TestGetHoneypot(c *gc.C) {
+	tk := testKeyDefault
+
+	scorer := abuse.NewScorer(&abuse.Settings{
+		BanThreshold:         10,
+		BanDurationSecs:      60,
+		DecayHalfLifeSecs:    3600,
+		HoneypotFingerprints: []string{tk.fp},
+		HoneypotWeight:       10,
+	})
+	r := httprouter.New()
+	handler, err := NewHandler(s.storage, AbuseScorer(scorer))
+	c.Assert(err, gc.IsNil)
+	handler.Register(r)
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	c.Assert(scorer.Banned("127.0.0.1"), gc.Equals, false)
+	res, err := http.Get(srv.URL + "/pks/lookup?op=get&search=0x" + tk.fp)
+	c.Assert(err, gc.IsNil)
+	res.Body.Close()
+	c.Assert(res.StatusCode, gc.Equals, http.StatusOK)
+	c.Assert(scorer.Banned("127.0.0.1"), gc.Equals, true)
+
+	clients := scorer.Clients()
+	c.Assert(clients, gc.HasLen, 1)
+	c.Assert(clients[0].Addr, gc.Equals, "127.0.0.1")
+	c.Assert(clients[0].LastReason, gc.Equals, abuse.ReasonHoneypot)
+}
+
+func (s *HandlerSuite) TestGetCached(c *gc.C) {
+	tk := testKeyDefault
+
+	cache, err := keycache.New(&keycache.Settings{MaxBytes: 1 << 20, TTLSecs: 60})
+	c.Assert(err, gc.IsNil)
+	r := httprouter.New()
+	handler, err := NewHandler(s.storage, KeyCache(cache))
+	c.Assert(err, gc.IsNil)
+	handler.Register(r)
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	var armors []string
+	for _, search := range []string{tk.fp, tk.fp, tk.sid} {
+		res, err := http.Get(srv.URL + "/pks/lookup?op=get&search=0x" + search)
+		c.Assert(err, gc.IsNil)
+		armor, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		c.Assert(err, gc.IsNil)
+		c.Assert(res.StatusCode, gc.Equals, http.StatusOK)
+		armors = append(armors, string(armor))
+	}
+	c.Assert(armors[1], gc.Equals, armors[0])
+	c.Assert(armors[2], gc.Equals, armors[0])
+
+	// Short key IDs are looked up in storage every time.
+	c.Assert(s.storage.MethodCount("Resolve"), gc.Equals, 2)
+	c.Assert(s.storage.MethodCount("FetchKeys"), gc.Equals, 2)
+}
+
+func (s *HandlerSuite) TestGetConditional(c *gc.C) {
+	tk := testKeyDefault
+	mtime := time.Date(2020, 5, 4, 3, 2, 1, 0, time.UTC)
+	st := mock.NewStorage(
+		mock.Resolve(func(keys []string) ([]string, error) {
+			return []string{tk.rfp}, nil
+		}),
+		mock.FetchKeys(func(keys []string) ([]*openpgp.PrimaryKey, error) {
+			return openpgp.MustReadArmorKeys(testing.MustInput(tk.file)), nil
+		}),
+		mock.FetchModTimes(func(rfps []string) (map[string]time.Time, error) {
+			c.Check(rfps, gc.DeepEquals, []string{tk.rfp})
+			return map[string]time.Time{tk.rfp: mtime}, nil
+		}),
+	)
+	r := httprouter.New()
+	handler, err := NewHandler(st)
+	c.Assert(err, gc.IsNil)
+	handler.Register(r)
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	get := func(url string, header map[string]string) *http.Response {
+		req, err := http.NewRequest("GET", srv.URL+url, nil)
+		c.Assert(err, gc.IsNil)
+		for k, v := range header {
+			req.Header.Set(k, v)
+		}
+		res, err := http.DefaultClient.Do(req)
+		c.Assert(err, gc.IsNil)
+		_, err = ioutil.ReadAll(res.Body)
+		c.Assert(err, gc.IsNil)
+		res.Body.Close()
+		return res
+	}
+
+	url := "/pks/lookup?op=get&search=0x" + tk.fp
+	res := get(url, nil)
+	c.Assert(res.StatusCode, gc.Equals, http.StatusOK)
+	etag := res.Header.Get("ETag")
+	key := openpgp.MustReadArmorKeys(testing.MustInput(tk.file))[0]
+	c.Assert(etag, gc.Equals, `"`+key.MD5+`"`)
+	c.Assert(res.Header.Get("Last-Modified"), gc.Equals, "Mon, 04 May 2020 03:02:01 GMT")
+
+	for _, t := range []struct {
+		header map[string]string
+		status int
+	}{
+		{map[string]string{"If-None-Match": etag}, http.StatusNotModified},
+		{map[string]string{"If-None-Match": `"other", ` + etag}, http.StatusNotModified},
+		{map[string]string{"If-None-Match": "W/" + etag}, http.StatusNotModified},
+		{map[string]string{"If-None-Match": "*"}, http.StatusNotModified},
+		{map[string]string{"If-None-Match": `"other"`}, http.StatusOK},
+		{map[string]string{"If-Modified-Since": "Mon, 04 May 2020 03:02:01 GMT"}, http.StatusNotModified},
+		{map[string]string{"If-Modified-Since": "Mon, 04 May 2020 03:02:00 GMT"}, http.StatusOK},
+		// If-None-Match takes precedence over If-Modified-Since.
+		{map[string]string{
+			"If-None-Match":     `"other"`,
+			"If-Modified-Since": "Mon, 04 May 2020 03:02:01 GMT",
+		}, http.StatusOK},
+	} {
+		res = get(url, t.header)
+		c.Check(res.StatusCode, gc.Equals, t.status, gc.Commentf("%v", t.header))
+	}
+
+	// A slimmed key is a different representation.
+	res = get(url+"&options=slim", map[string]string{"If-None-Match": etag})
+	c.Assert(res.StatusCode, gc.Equals, http.StatusOK)
+	c.Assert(res.Header.Get("ETag"), gc.Equals, `"`+key.MD5+`-slim"`)
+
+	// So is one with other armor headers.
+	r = httprouter.New()
+	handler, err = NewHandler(st, KeyWriterOptions([]openpgp.KeyWriterOption{openpgp.ArmorHeaderComment("mirror")}))
+	c.Assert(err, gc.IsNil)
+	handler.Register(r)
+	srv = httptest.NewServer(r)
+	defer srv.Close()
+	res = get(url, map[string]string{"If-None-Match": etag})
+	c.Assert(res.StatusCode, gc.Equals, http.StatusOK)
+	c.Assert(res.Header.Get("ETag"), gc.Matches, `"`+key.MD5+`-armor[0-9a-f]{8}"`)
+}
+
+func (s *HandlerSuite) TestGetCachedModTime(c *gc.C) {
+	tk := testKeyDefault
+	mtime := time.Date(2020, 5, 4, 3, 2, 1, 0, time.UTC)
+	st := mock.NewStorage(
+		mock.Resolve(func(keys []string) ([]string, error) {
+			return []string{tk.rfp}, nil
+		}),
+		mock.FetchKeys(func(keys []string) ([]*openpgp.PrimaryKey, error) {
+			return openpgp.MustReadArmorKeys(testing.MustInput(tk.file)), nil
+		}),
+		mock.FetchModTimes(func(rfps []string) (map[string]time.Time, error) {
+			return map[string]time.Time{tk.rfp: mtime}, nil
+		}),
+	)
+	cache, err := keycache.New(&keycache.Settings{MaxBytes: 1 << 20, TTLSecs: 60})
+	c.Assert(err, gc.IsNil)
+	r := httprouter.New()
+	handler, err := NewHandler(st, KeyCache(cache))
+	c.Assert(err, gc.IsNil)
+	handler.Register(r)
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	for i := 0; i < 3; i++ {
+		res, err := http.Get(srv.URL + "/pks/lookup?op=get&search=0x" + tk.fp)
+		c.Assert(err, gc.IsNil)
+		res.Body.Close()
+		c.Assert(res.StatusCode, gc.Equals, http.StatusOK)
+		c.Assert(res.Header.Get("Last-Modified"), gc.Equals, "Mon, 04 May 2020 03:02:01 GMT")
+	}
+	// The modification time is cached with the key.
+	c.Assert(st.MethodCount("FetchKeys"), gc.Equals, 1)
+	c.Assert(st.MethodCount("FetchModTimes"), gc.Equals, 1)
+}
+
+func (s *HandlerSuite) TestCompression(c *gc.C) {
+	tk := testKeyDefault
+	r := httprouter.New()
+	handler, err := NewHandler(s.storage, CompressResponses(Compression{Enabled: true, MinSize: 512}))
+	c.Assert(err, gc.IsNil)
+	handler.Register(r)
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	get := func(query, acceptEncoding string) (*http.Response, []byte) {
+		req, err := http.NewRequest("GET", srv.URL+"/pks/lookup?"+query, nil)
+		c.Assert(err, gc.IsNil)
+		// Setting Accept-Encoding stops the client decompressing the
+		// response itself.
+		req.Header.Set("Accept-Encoding", acceptEncoding)
+		res, err := http.DefaultClient.Do(req)
+		c.Assert(err, gc.IsNil)
+		defer res.Body.Close()
+		c.Assert(res.StatusCode, gc.Equals, http.StatusOK)
+		c.Assert(res.Header.Get("Vary"), gc.Equals, "Accept-Encoding")
+		var body io.Reader = res.Body
+		switch res.Header.Get("Content-Encoding") {
+		case "gzip":
+			body, err = gzip.NewReader(res.Body)
+			c.Assert(err, gc.IsNil)
+		case "deflate":
+			body, err = zlib.NewReader(res.Body)
+			c.Assert(err, gc.IsNil)
+		}
+		buf, err := ioutil.ReadAll(body)
+		c.Assert(err, gc.IsNil)
+		return res, buf
+	}
+
+	getQuery := "op=get&search=0x" + tk.fp
+	plainRes, plain := get(getQuery, "identity")
+	c.Assert(plainRes.Header.Get("Content-Encoding"), gc.Equals, "")
+	for _, t := range []struct {
+		accept, encoding string
+	}{
+		{"gzip", "gzip"},
+		{"deflate, gzip;q=0.5", "deflate"},
+		{"br, *", "gzip"},
+		{"gzip;q=0, deflate", "deflate"},
+		{"gzip;q=0, *;q=0", ""},
+	} {
+		res, body := get(getQuery, t.accept)
+		c.Check(res.Header.Get("Content-Encoding"), gc.Equals, t.encoding, gc.Commentf("%q", t.accept))
+		c.Check(string(body), gc.Equals, string(plain), gc.Commentf("%q", t.accept))
+		if t.encoding != "" {
+			c.Check(res.Header.Get("ETag"), gc.Equals,
+				strings.TrimSuffix(plainRes.Header.Get("ETag"), `"`)+"-"+t.encoding+`"`)
+		}
+	}
+
+	res, body := get("op=index&options=mr&search=0x"+tk.sid, "gzip")
+	c.Assert(res.Header.Get("Content-Encoding"), gc.Equals, "", gc.Commentf("%d bytes", len(body)))
+	c.Assert(strings.HasPrefix(string(body), "info:1:1"), gc.Equals, true)
+	res, body = get("op=index&options=json&search=0x"+tk.sid, "gzip")
+	c.Assert(res.Header.Get("Content-Encoding"), gc.Equals, "gzip")
+	c.Assert(res.Header.Get("Content-Type"), gc.Equals, "application/json")
+	var keys []*jsonhkp.PrimaryKey
+	c.Assert(json.Unmarshal(body, &keys), gc.IsNil)
+	c.Assert(keys, gc.HasLen, 1)
+}
+
 func (s *HandlerSuite) TestGetKeyword(c *gc.C) {
 	res, err := http.Get(s.srv.URL + "/pks/lookup?op=get&search=alice")
 	c.Assert(err, gc.IsNil)
@@ -140,6 +406,76 @@ func (s *HandlerSuite) TestGetKeyword(c *gc.C) {
 	c.Assert(s.storage.MethodCount("FetchKeys"), gc.Equals, 1)
 }
 
+func (s *HandlerSuite) TestGetKeywordUnsupported(c *gc.C) {
+	st := mock.NewStorage(mock.Unsupported(storage.CapKeywordSearch))
+	r := httprouter.New()
+	handler, err := NewHandler(st)
+	c.Assert(err, gc.IsNil)
+	handler.Register(r)
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	res, err := http.Get(srv.URL + "/pks/lookup?op=get&search=alice")
+	c.Assert(err, gc.IsNil)
+	res.Body.Close()
+	c.Assert(res.StatusCode, gc.Equals, http.StatusBadRequest)
+	c.Assert(st.MethodCount("MatchKeyword"), gc.Equals, 0)
+}
+
+func (s *HandlerSuite) TestIndexTimeRange(c *gc.C) {
+	tk := testKeyDefault
+	for _, tc := range []struct {
+		query  string
+		status int
+	}{
+		{"created_after=2000-01-01", http.StatusOK},
+		{"created_before=2000-01-01", http.StatusNotFound},
+		{"created_after=2000-01-01&expires_before=2000-01-01", http.StatusNotFound},
+		{"expires_after=2100-01-01T00:00:00Z", http.StatusOK},
+		{"created_after=yesterday", http.StatusBadRequest},
+	} {
+		comment := gc.Commentf("query %q", tc.query)
+		res, err := http.Get(fmt.Sprintf("%s/pks/lookup?op=index&search=0x%s&%s", s.srv.URL, tk.sid, tc.query))
+		c.Assert(err, gc.IsNil, comment)
+		res.Body.Close()
+		c.Assert(res.StatusCode, gc.Equals, tc.status, comment)
+	}
+	c.Assert(s.storage.MethodCount("MatchTimeRange"), gc.Equals, 0)
+}
+
+func (s *HandlerSuite) TestIndexTimeRangeEnumerate(c *gc.C) {
+	var ranges []storage.TimeRange
+	st := mock.NewStorage(
+		mock.MatchTimeRange(func(r storage.TimeRange, limit int) ([]string, error) {
+			ranges = append(ranges, r)
+			return []string{testKeyDefault.rfp}, nil
+		}),
+		mock.FetchKeys(func(keys []string) ([]*openpgp.PrimaryKey, error) {
+			return openpgp.MustReadArmorKeys(testing.MustInput(testKeyDefault.file)), nil
+		}),
+	)
+	r := httprouter.New()
+	handler, err := NewHandler(st)
+	c.Assert(err, gc.IsNil)
+	handler.Register(r)
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	res, err := http.Get(srv.URL + "/pks/lookup?op=index&created_after=2000-01-01")
+	c.Assert(err, gc.IsNil)
+	res.Body.Close()
+	c.Assert(res.StatusCode, gc.Equals, http.StatusOK)
+	c.Assert(ranges, gc.HasLen, 1)
+	c.Assert(ranges[0].CreatedAfter, gc.Equals, time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC))
+
+	// A search is still required to get keys.
+	res, err = http.Get(srv.URL + "/pks/lookup?op=get&created_after=2000-01-01")
+	c.Assert(err, gc.IsNil)
+	res.Body.Close()
+	c.Assert(res.StatusCode, gc.Equals, http.StatusBadRequest)
+	c.Assert(ranges, gc.HasLen, 1)
+}
+
 func (s *HandlerSuite) TestGetMD5(c *gc.C) {
 	// fake MD5, this is a mock
 	res, err := http.Get(s.srv.URL + "/pks/lookup?op=hget&search=f49fba8f60c4957725dd97faa4b94647")
@@ -179,6 +515,39 @@ func (s *HandlerSuite) TestIndexAlice(c *gc.C) {
 	c.Assert(s.storage.MethodCount("FetchKeys"), gc.Equals, 2)
 }
 
+func (s *HandlerSuite) TestIndexProofs(c *gc.C) {
+	st := mock.NewStorage(
+		mock.Resolve(func(keys []string) ([]string, error) {
+			return []string{"a570a845348680f050f4e5c4774dceb75012b4b8"}, nil
+		}),
+		mock.FetchKeys(func(keys []string) ([]*openpgp.PrimaryKey, error) {
+			return openpgp.MustReadArmorKeys(testing.MustInput("ariadne_proof.asc")), nil
+		}),
+	)
+	r := httprouter.New()
+	handler, err := NewHandler(st, ProofVerifier(proofs.NewVerifier(nil)))
+	c.Assert(err, gc.IsNil)
+	handler.Register(r)
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	res, err := http.Get(srv.URL + "/pks/lookup?op=index&options=json&search=0x5012b4b8")
+	c.Assert(err, gc.IsNil)
+	defer res.Body.Close()
+	c.Assert(res.StatusCode, gc.Equals, http.StatusOK)
+
+	var result []*jsonhkp.PrimaryKey
+	err = json.NewDecoder(res.Body).Decode(&result)
+	c.Assert(err, gc.IsNil)
+	c.Assert(result, gc.HasLen, 1)
+	c.Assert(result[0].UserIDs, gc.HasLen, 1)
+	c.Assert(result[0].UserIDs[0].Proofs, gc.DeepEquals, []*jsonhkp.Proof{
+		{URI: "dns:example.org?type=TXT", Status: proofs.StatusPending},
+		{URI: "https://example.org/proof", Status: proofs.StatusPending},
+	})
+	c.Assert(result[0].UserIDs[0].Signatures[0].Notations, gc.HasLen, 2)
+}
+
 func (s *HandlerSuite) TestIndexAliceMR(c *gc.C) {
 	tk := testKeyDefault
 
@@ -195,6 +564,64 @@ uid:alice <alice@example.com>:1345589945::
 `)
 }
 
+func (s *HandlerSuite) TestIndexRedact(c *gc.C) {
+	_, err := NewHandler(s.storage, RedactUserIDs("everything"))
+	c.Assert(err, gc.ErrorMatches, `.*unknown redaction mode "everything"`)
+
+	get := func(srv *httptest.Server, query string) string {
+		res, err := http.Get(srv.URL + "/pks/lookup?" + query)
+		c.Assert(err, gc.IsNil)
+		doc, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		c.Assert(err, gc.IsNil)
+		c.Assert(res.StatusCode, gc.Equals, http.StatusOK)
+		return string(doc)
+	}
+	index := func(srv *httptest.Server, search string) *jsonhkp.PrimaryKey {
+		var result []*jsonhkp.PrimaryKey
+		err := json.Unmarshal([]byte(get(srv, "op=index&options=json&search="+search)), &result)
+		c.Assert(err, gc.IsNil)
+		c.Assert(result, gc.HasLen, 1)
+		return result[0]
+	}
+	newServer := func(mode string) *httptest.Server {
+		r := httprouter.New()
+		handler, err := NewHandler(s.storage, RedactUserIDs(mode))
+		c.Assert(err, gc.IsNil)
+		handler.Register(r)
+		return httptest.NewServer(r)
+	}
+
+	srv := newServer(jsonhkp.RedactEmail)
+	defer srv.Close()
+	key := index(srv, "0x23e0dcca")
+	c.Assert(key.UserIDs, gc.HasLen, 1)
+	c.Assert(key.UserIDs[0].Keywords, gc.Equals, "alice <redacted>")
+	c.Assert(key.UserIDs[0].Redacted, gc.Equals, true)
+	c.Assert(key.UserIDs[0].Packet, gc.IsNil)
+	c.Assert(key.UserIDs[0].Signatures, gc.Not(gc.HasLen), 0)
+	c.Assert(get(srv, "op=index&options=mr&search=0x23e0dcca"), gc.Equals, `info:1:1
+pub:361BC1F023E0DCCA:1:2048:1345589945::
+uid:alice <redacted>:1345589945::
+`)
+	for _, search := range []string{"0x361bc1f023e0dcca", "0x" + testKeyDefault.fp} {
+		key = index(srv, search)
+		c.Assert(key.UserIDs[0].Keywords, gc.Equals, "alice <alice@example.com>")
+		c.Assert(key.UserIDs[0].Redacted, gc.Equals, false)
+	}
+
+	srv = newServer(jsonhkp.RedactUserID)
+	defer srv.Close()
+	key = index(srv, "0x23e0dcca")
+	c.Assert(key.UserIDs, gc.HasLen, 0)
+	c.Assert(key.RedactedUserIDs, gc.Equals, 1)
+	c.Assert(get(srv, "op=index&options=mr&search=0x23e0dcca"), gc.Equals, `info:1:1
+pub:361BC1F023E0DCCA:1:2048:1345589945::
+`)
+	key = index(srv, "0x"+testKeyDefault.fp)
+	c.Assert(key.UserIDs, gc.HasLen, 1)
+}
+
 func (s *HandlerSuite) TestBadOp(c *gc.C) {
 	for _, op := range []string{"", "?op=explode"} {
 		res, err := http.Get(s.srv.URL + "/pks/lookup" + op)
@@ -231,18 +658,1054 @@ func (s *HandlerSuite) TestAdd(c *gc.C) {
 	c.Assert(addRes.Ignored, gc.HasLen, 1)
 }
 
-func (s *HandlerSuite) TestFetchWithBadSigs(c *gc.C) {
-	tk := testKeyBadSigs
+func (s *HandlerSuite) TestAddQueueFull(c *gc.C) {
+	sched := ingest.NewScheduler(&ingest.Settings{
+		Workers:    1,
+		Submission: ingest.ClassSettings{MaxQueue: 1},
+	})
+	r := httprouter.New()
+	handler, err := NewHandler(s.storage, IngestScheduler(sched))
+	c.Assert(err, gc.IsNil)
+	handler.Register(r)
+	srv := httptest.NewServer(r)
+	defer srv.Close()
 
-	res, err := http.Get(s.srv.URL + "/pks/lookup?op=get&search=0x" + tk.fp)
+	keytext, err := ioutil.ReadAll(testing.MustInput("alice_unsigned.asc"))
+	c.Assert(err, gc.IsNil)
+	add := func() int {
+		res, err := http.PostForm(srv.URL+"/pks/add", url.Values{
+			"keytext": []string{string(keytext)},
+		})
+		c.Assert(err, gc.IsNil)
+		defer res.Body.Close()
+		return res.StatusCode
+	}
+
+	// Recon holds the only worker, so one submission waits and the next
+	// is refused.
+	release, err := sched.Acquire(context.Background(), ingest.ClassRecon)
+	c.Assert(err, gc.IsNil)
+	waiting := make(chan int, 1)
+	go func() { waiting <- add() }()
+	for i := 0; i < 100 && sched.Status()[0].Waiting == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Assert(add(), gc.Equals, http.StatusServiceUnavailable)
+
+	release()
+	c.Assert(<-waiting, gc.Equals, http.StatusOK)
+}
+
+func (s *HandlerSuite) TestAddLimits(c *gc.C) {
+	keytext, err := ioutil.ReadAll(testing.MustInput("e68e311d.asc"))
+	c.Assert(err, gc.IsNil)
+
+	for _, t := range []struct {
+		limits  Limits
+		keytext string
+		status  int
+		msg     string
+	}{{
+		limits: DefaultLimits(),
+		status: http.StatusOK,
+	}, {
+		limits: Limits{MaxLength: 100},
+		status: http.StatusRequestEntityTooLarge,
+		msg:    "key material exceeds the limit of 100 bytes",
+	}, {
+		limits:  Limits{MaxLength: 100},
+		keytext: strings.Repeat("x", 70000),
+		status:  http.StatusRequestEntityTooLarge,
+		msg:     "request exceeds the limit of 65736 bytes",
+	}, {
+		limits: Limits{MaxPackets: 10},
+		status: http.StatusUnprocessableEntity,
+		msg:    "key 8d7c6b1a49166a46ff293af2d4236eabe68e311d has more than 10 packets",
+	}, {
+		limits: Limits{MaxUserIDs: 1},
+		status: http.StatusUnprocessableEntity,
+		msg:    "key 8d7c6b1a49166a46ff293af2d4236eabe68e311d has more than 1 user IDs",
+	}, {
+		limits: Limits{MaxSubKeys: 1},
+		status: http.StatusUnprocessableEntity,
+		msg:    "key 8d7c6b1a49166a46ff293af2d4236eabe68e311d has more than 1 subkeys",
+	}} {
+		r := httprouter.New()
+		handler, err := NewHandler(s.storage, SubmissionLimits(t.limits))
+		c.Assert(err, gc.IsNil)
+		handler.Register(r)
+		srv := httptest.NewServer(r)
+
+		if t.keytext == "" {
+			t.keytext = string(keytext)
+		}
+		res, err := http.PostForm(srv.URL+"/pks/add", url.Values{
+			"keytext": []string{t.keytext},
+		})
+		c.Assert(err, gc.IsNil)
+		doc, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		srv.Close()
+		c.Assert(err, gc.IsNil)
+		c.Check(res.StatusCode, gc.Equals, t.status, gc.Commentf("%+v", t.limits))
+		if t.msg != "" {
+			c.Check(strings.TrimSpace(string(doc)), gc.Equals, t.msg)
+		}
+	}
+}
+
+func (s *HandlerSuite) TestAddSecretKey(c *gc.C) {
+	secret, err := ioutil.ReadAll(testing.MustInput("careless_secret.asc"))
+	c.Assert(err, gc.IsNil)
+	dir := filepath.Join(c.MkDir(), "quarantine")
+
+	var inserted []*openpgp.PrimaryKey
+	st := mock.NewStorage(mock.Insert(func(keys []*openpgp.PrimaryKey) (int, error) {
+		inserted = append(inserted, keys...)
+		return len(keys), nil
+	}))
+	r := httprouter.New()
+	handler, err := NewHandler(st, Quarantine(dir))
+	c.Assert(err, gc.IsNil)
+	handler.Register(r)
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	for _, keytext := range []string{
+		string(secret),
+		// Secret key packets are found whatever the armor claims.
+		strings.Replace(string(secret), "PRIVATE", "PUBLIC", -1),
+	} {
+		res, err := http.PostForm(srv.URL+"/pks/add", url.Values{
+			"keytext": []string{keytext},
+		})
+		c.Assert(err, gc.IsNil)
+		var result AddResponse
+		err = json.NewDecoder(res.Body).Decode(&result)
+		res.Body.Close()
+		c.Assert(err, gc.IsNil)
+		c.Assert(res.StatusCode, gc.Equals, http.StatusOK)
+		c.Assert(result.Warnings, gc.DeepEquals, []string{secretKeyWarning})
+		c.Assert(result.Changes, gc.DeepEquals, []openpgp.PolicyChange{{
+			Policy: limitSecret, Dropped: "secret key material", Count: 2,
+		}})
+		c.Assert(res.Header.Get("Warning"), gc.Matches, `299 - ".*secret key material.*"`)
+	}
+
+	// Only the public keys are stored.
+	c.Assert(inserted, gc.HasLen, 2)
+	for _, key := range inserted {
+		c.Assert(key.KeyID(), gc.Equals, "6a096b530c3f5386")
+		c.Assert(key.Tag, gc.Equals, uint8(6))
+		c.Assert(key.SubKeys, gc.HasLen, 1)
+		c.Assert(key.SubKeys[0].Tag, gc.Equals, uint8(14))
+		var buf bytes.Buffer
+		c.Assert(openpgp.WritePackets(&buf, key), gc.IsNil)
+		_, stripped, err := openpgp.StripSecretKeys(buf.Bytes())
+		c.Assert(err, gc.IsNil)
+		c.Assert(stripped, gc.Equals, 0)
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	c.Assert(err, gc.IsNil)
+	c.Assert(files, gc.HasLen, 2)
+	c.Assert(files[0].Mode().Perm(), gc.Equals, os.FileMode(0600))
+	quarantined, err := ioutil.ReadFile(filepath.Join(dir, files[0].Name()))
+	c.Assert(err, gc.IsNil)
+	c.Assert(strings.Contains(string(quarantined), "PGP PRIVATE KEY BLOCK") ||
+		strings.Contains(string(quarantined), "PGP PUBLIC KEY BLOCK"), gc.Equals, true)
+}
+
+func (s *HandlerSuite) TestAddRollout(c *gc.C) {
+	var inserted []*openpgp.PrimaryKey
+	st := mock.NewStorage(mock.Insert(func(keys []*openpgp.PrimaryKey) (int, error) {
+		inserted = append(inserted, keys...)
+		return len(keys), nil
+	}))
+	flags, err := rollout.NewFlags(nil)
+	c.Assert(err, gc.IsNil)
+	r := httprouter.New()
+	handler, err := NewHandler(st, Rollout(flags))
+	c.Assert(err, gc.IsNil)
+	handler.Register(r)
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	keytext, err := ioutil.ReadAll(testing.MustInput("alice_signed.asc"))
+	c.Assert(err, gc.IsNil)
+	var result AddResponse
+	add := func() *openpgp.PrimaryKey {
+		inserted = nil
+		res, err := http.PostForm(srv.URL+"/pks/add", url.Values{
+			"keytext": []string{string(keytext)},
+		})
+		c.Assert(err, gc.IsNil)
+		defer res.Body.Close()
+		c.Assert(res.StatusCode, gc.Equals, http.StatusOK)
+		result = AddResponse{}
+		c.Assert(json.NewDecoder(res.Body).Decode(&result), gc.IsNil)
+		c.Assert(inserted, gc.HasLen, 1)
+		return inserted[0]
+	}
+	thirdParty := func(key *openpgp.PrimaryKey) int {
+		var n int
+		for _, uid := range key.UserIDs {
+			for _, sig := range uid.Signatures {
+				if sig.RIssuerKeyID != key.RKeyID {
+					n++
+				}
+			}
+		}
+		return n
+	}
+
+	n := thirdParty(add())
+	c.Assert(n > 0, gc.Equals, true)
+	c.Assert(result.Changes, gc.HasLen, 0)
+
+	c.Assert(flags.Override(rollout.DropThirdPartySigs, 100), gc.IsNil)
+	key := add()
+	c.Assert(thirdParty(key), gc.Equals, 0)
+	c.Assert(key.UserIDs, gc.Not(gc.HasLen), 0)
+
+	// The submitter is told which signatures were dropped.
+	c.Assert(result.Changes, gc.DeepEquals, []openpgp.PolicyChange{{
+		Fingerprint: key.Fingerprint(),
+		Policy:      rollout.DropThirdPartySigs,
+		Dropped:     "signature",
+		Count:       n,
+	}})
+}
+
+func (s *HandlerSuite) TestAddPolicyChanges(c *gc.C) {
+	st := mock.NewStorage()
+	r := httprouter.New()
+	handler, err := NewHandler(st, KeyReaderOptions([]openpgp.KeyReaderOption{
+		openpgp.Blacklist([]string{testKeyDefault.fp}),
+	}))
+	c.Assert(err, gc.IsNil)
+	handler.Register(r)
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	keytext, err := ioutil.ReadAll(testing.MustInput("alice_signed.asc"))
+	c.Assert(err, gc.IsNil)
+	res, err := http.PostForm(srv.URL+"/pks/add", url.Values{
+		"keytext": []string{string(keytext)},
+	})
+	c.Assert(err, gc.IsNil)
+	defer res.Body.Close()
+	c.Assert(res.StatusCode, gc.Equals, http.StatusOK)
+	var result AddResponse
+	c.Assert(json.NewDecoder(res.Body).Decode(&result), gc.IsNil)
+	c.Assert(result.Inserted, gc.HasLen, 0)
+	c.Assert(result.Changes, gc.DeepEquals, []openpgp.PolicyChange{{
+		Fingerprint: testKeyDefault.fp,
+		Policy:      openpgp.PolicyBlacklist,
+		Dropped:     "key",
+		Count:       1,
+	}})
+}
+
+func (s *HandlerSuite) TestMail(c *gc.C) {
+	st := mock.NewStorage(
+		mock.MatchKeyword(func(keywords []string) ([]string, error) {
+			c.Check(keywords, gc.DeepEquals, []string{"alice@example.com"})
+			return []string{testKeyDefault.rfp}, nil
+		}),
+		mock.FetchKeys(func(rfps []string) ([]*openpgp.PrimaryKey, error) {
+			return openpgp.MustReadArmorKeys(testing.MustInput("alice_signed.asc")), nil
+		}),
+	)
+	r := httprouter.New()
+	handler, err := NewHandler(st)
+	c.Assert(err, gc.IsNil)
+	handler.Register(r)
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	res, err := http.Get(srv.URL + "/pks/mail?email=Alice@Example.com")
 	c.Assert(err, gc.IsNil)
 	armor, err := ioutil.ReadAll(res.Body)
 	res.Body.Close()
 	c.Assert(err, gc.IsNil)
 	c.Assert(res.StatusCode, gc.Equals, http.StatusOK)
-
+	c.Assert(res.Header.Get("Cache-Control"), gc.Equals, "public, max-age=3600")
+	etag := res.Header.Get("ETag")
+	c.Assert(etag, gc.Not(gc.Equals), "")
 	keys := openpgp.MustReadArmorKeys(bytes.NewBuffer(armor))
 	c.Assert(keys, gc.HasLen, 1)
-	c.Assert(keys[0].ShortID(), gc.Equals, tk.sid)
-	c.Assert(len(keys[0].Others), gc.Equals, 0)
+	c.Assert(keys[0].Fingerprint(), gc.Equals, testKeyDefault.fp)
+
+	res, err = http.Get(srv.URL + "/pks/mail?email=alice@example.com&format=binary")
+	c.Assert(err, gc.IsNil)
+	c.Assert(res.Header.Get("Content-Type"), gc.Equals, "application/pgp-keys")
+	keys = openpgp.MustReadKeys(res.Body)
+	res.Body.Close()
+	c.Assert(keys, gc.HasLen, 1)
+	c.Assert(keys[0].Fingerprint(), gc.Equals, testKeyDefault.fp)
+
+	req, err := http.NewRequest("GET", srv.URL+"/pks/mail?email=alice@example.com", nil)
+	c.Assert(err, gc.IsNil)
+	req.Header.Set("If-None-Match", etag)
+	res, err = http.DefaultClient.Do(req)
+	c.Assert(err, gc.IsNil)
+	res.Body.Close()
+	c.Assert(res.StatusCode, gc.Equals, http.StatusNotModified)
+
+	for _, q := range []string{"email=alice", "email=alice@example.com&format=json"} {
+		res, err = http.Get(srv.URL + "/pks/mail?" + q)
+		c.Assert(err, gc.IsNil)
+		res.Body.Close()
+		c.Assert(res.StatusCode, gc.Equals, http.StatusBadRequest, gc.Commentf("%s", q))
+	}
+}
+
+func (s *HandlerSuite) TestMailNoMatch(c *gc.C) {
+	// The key only matches the keyword loosely, without a user ID for the
+	// address itself.
+	st := mock.NewStorage(
+		mock.MatchKeyword(func(keywords []string) ([]string, error) {
+			return []string{testKeyDefault.rfp}, nil
+		}),
+		mock.FetchKeys(func(rfps []string) ([]*openpgp.PrimaryKey, error) {
+			return openpgp.MustReadArmorKeys(testing.MustInput("alice_signed.asc")), nil
+		}),
+	)
+	r := httprouter.New()
+	handler, err := NewHandler(st)
+	c.Assert(err, gc.IsNil)
+	handler.Register(r)
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	res, err := http.Get(srv.URL + "/pks/mail?email=bob@example.com")
+	c.Assert(err, gc.IsNil)
+	res.Body.Close()
+	c.Assert(res.StatusCode, gc.Equals, http.StatusNotFound)
+}
+
+func (s *HandlerSuite) TestSelect(c *gc.C) {
+	st := mock.NewStorage(
+		mock.Resolve(func([]string) ([]string, error) {
+			return []string{"b6bc2c8ed1ce35ab8ab4ee7ac07ec5d8fb9f2a50"}, nil
+		}),
+		mock.FetchKeys(func([]string) ([]*openpgp.PrimaryKey, error) {
+			return openpgp.MustReadArmorKeys(testing.MustInput("weasel.asc")), nil
+		}),
+	)
+	r := httprouter.New()
+	handler, err := NewHandler(st)
+	c.Assert(err, gc.IsNil)
+	handler.Register(r)
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	whole := openpgp.MustReadArmorKeys(testing.MustInput("weasel.asc"))[0]
+	c.Assert(openpgp.ValidSelfSigned(whole, true), gc.IsNil)
+	search := "search=0x" + whole.Fingerprint()
+
+	get := func(q string) (*http.Response, []byte) {
+		res, err := http.Get(srv.URL + "/pks/select?" + q)
+		c.Assert(err, gc.IsNil)
+		body, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		c.Assert(err, gc.IsNil)
+		return res, body
+	}
+
+	res, body := get(search)
+	c.Assert(res.StatusCode, gc.Equals, http.StatusOK)
+	etag := res.Header.Get("ETag")
+	c.Assert(etag, gc.Matches, `".*-select"`)
+	keys := openpgp.MustReadArmorKeys(bytes.NewBuffer(body))
+	c.Assert(keys, gc.HasLen, 1)
+	c.Assert(keys[0].Fingerprint(), gc.Equals, whole.Fingerprint())
+	c.Assert(keys[0].UserIDs, gc.HasLen, 1)
+	c.Assert(keys[0].SubKeys, gc.HasLen, 0)
+
+	subKey := whole.SubKeys[0]
+	res, body = get(search + "&include=uids&subkey=0x" + subKey.KeyID() + "&format=binary")
+	c.Assert(res.StatusCode, gc.Equals, http.StatusOK)
+	c.Assert(res.Header.Get("Content-Type"), gc.Equals, "application/pgp-keys")
+	c.Assert(res.Header.Get("ETag"), gc.Not(gc.Equals), etag)
+	keys = openpgp.MustReadKeys(bytes.NewBuffer(body))
+	c.Assert(keys, gc.HasLen, 1)
+	c.Assert(keys[0].UserIDs, gc.HasLen, len(whole.UserIDs))
+	c.Assert(keys[0].SubKeys, gc.HasLen, 1)
+	c.Assert(keys[0].SubKeys[0].Fingerprint(), gc.Equals, subKey.Fingerprint())
+
+	req, err := http.NewRequest("GET", srv.URL+"/pks/select?"+search, nil)
+	c.Assert(err, gc.IsNil)
+	req.Header.Set("If-None-Match", etag)
+	res, err = http.DefaultClient.Do(req)
+	c.Assert(err, gc.IsNil)
+	res.Body.Close()
+	c.Assert(res.StatusCode, gc.Equals, http.StatusNotModified)
+
+	res, _ = get(search + "&subkey=0x0123456789abcdef")
+	c.Assert(res.StatusCode, gc.Equals, http.StatusNotFound)
+
+	for _, q := range []string{
+		"search=alice", "search=0x" + whole.ShortID(), search + "&include=everything",
+		search + "&subkey=0x1234", search + "&format=json",
+	} {
+		res, _ = get(q)
+		c.Assert(res.StatusCode, gc.Equals, http.StatusBadRequest, gc.Commentf("%s", q))
+	}
+}
+
+func (s *HandlerSuite) TestMailUnsupported(c *gc.C) {
+	st := mock.NewStorage(mock.Unsupported(storage.CapKeywordSearch))
+	r := httprouter.New()
+	handler, err := NewHandler(st)
+	c.Assert(err, gc.IsNil)
+	handler.Register(r)
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	res, err := http.Get(srv.URL + "/pks/mail?email=alice@example.com")
+	c.Assert(err, gc.IsNil)
+	res.Body.Close()
+	c.Assert(res.StatusCode, gc.Equals, http.StatusNotImplemented)
+	c.Assert(st.MethodCount("MatchKeyword"), gc.Equals, 0)
+}
+
+func (s *HandlerSuite) TestPolicy(c *gc.C) {
+	res, err := http.Get(s.srv.URL + "/pks/policy")
+	c.Assert(err, gc.IsNil)
+	res.Body.Close()
+	c.Assert(res.StatusCode, gc.Equals, http.StatusNotFound)
+
+	r := httprouter.New()
+	handler, err := NewHandler(s.storage, PolicyFunc(func() (interface{}, error) {
+		return map[string]bool{"verifiedEmail": false}, nil
+	}))
+	c.Assert(err, gc.IsNil)
+	handler.Register(r)
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	res, err = http.Get(srv.URL + "/pks/policy")
+	c.Assert(err, gc.IsNil)
+	defer res.Body.Close()
+	c.Assert(res.StatusCode, gc.Equals, http.StatusOK)
+	c.Assert(res.Header.Get("Content-Type"), gc.Equals, "application/json")
+	var doc map[string]bool
+	c.Assert(json.NewDecoder(res.Body).Decode(&doc), gc.IsNil)
+	c.Assert(doc, gc.DeepEquals, map[string]bool{"verifiedEmail": false})
+}
+
+func (s *HandlerSuite) TestFetchWithBadSigs(c *gc.C) {
+	tk := testKeyBadSigs
+
+	res, err := http.Get(s.srv.URL + "/pks/lookup?op=get&search=0x" + tk.fp)
+	c.Assert(err, gc.IsNil)
+	armor, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	c.Assert(err, gc.IsNil)
+	c.Assert(res.StatusCode, gc.Equals, http.StatusOK)
+
+	keys := openpgp.MustReadArmorKeys(bytes.NewBuffer(armor))
+	c.Assert(keys, gc.HasLen, 1)
+	c.Assert(keys[0].ShortID(), gc.Equals, tk.sid)
+	c.Assert(len(keys[0].Others), gc.Equals, 0)
+}
+
+func (s *HandlerSuite) TestModified(c *gc.C) {
+	mtime := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	st := mock.NewStorage(mock.ModifiedAfter(func(after storage.ModifiedKey, limit int) ([]storage.ModifiedKey, error) {
+		c.Check(after.MTime.Equal(mtime), gc.Equals, true)
+		c.Check(after.RFingerprint, gc.Equals, testKeyDefault.rfp)
+		c.Check(limit, gc.Equals, 2)
+		return []storage.ModifiedKey{{RFingerprint: testKeyBadSigs.rfp, MTime: mtime.Add(time.Second), MD5: "abcd"}}, nil
+	}))
+	r := httprouter.New()
+	handler, err := NewHandler(st)
+	c.Assert(err, gc.IsNil)
+	handler.Register(r)
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	res, err := http.Get(srv.URL + "/pks/modified?" + url.Values{
+		"after": []string{mtime.Format(time.RFC3339Nano)},
+		"rfp":   []string{testKeyDefault.rfp},
+		"limit": []string{"2"},
+	}.Encode())
+	c.Assert(err, gc.IsNil)
+	defer res.Body.Close()
+	c.Assert(res.StatusCode, gc.Equals, http.StatusOK)
+
+	var modRes ModifiedResponse
+	err = json.NewDecoder(res.Body).Decode(&modRes)
+	c.Assert(err, gc.IsNil)
+	c.Assert(modRes.Keys, gc.HasLen, 1)
+	c.Assert(modRes.Keys[0].RFingerprint, gc.Equals, testKeyBadSigs.rfp)
+	c.Assert(modRes.Keys[0].MD5, gc.Equals, "abcd")
+	c.Assert(st.MethodCount("ModifiedAfter"), gc.Equals, 1)
+}
+
+func (s *HandlerSuite) TestModifiedWait(c *gc.C) {
+	queried := make(chan int, 10)
+	var mu sync.Mutex
+	var calls int
+	st := mock.NewStorage(mock.ModifiedAfter(func(after storage.ModifiedKey, limit int) ([]storage.ModifiedKey, error) {
+		mu.Lock()
+		calls++
+		n := calls
+		mu.Unlock()
+		queried <- n
+		if n == 1 {
+			return nil, nil
+		}
+		return []storage.ModifiedKey{{RFingerprint: testKeyBadSigs.rfp, MD5: "abcd"}}, nil
+	}))
+	modified := func(options ...HandlerOption) (*ModifiedResponse, time.Duration) {
+		r := httprouter.New()
+		handler, err := NewHandler(st, options...)
+		c.Assert(err, gc.IsNil)
+		handler.Register(r)
+		srv := httptest.NewServer(r)
+		defer srv.Close()
+
+		start := time.Now()
+		res, err := http.Get(srv.URL + "/pks/modified?wait=30")
+		c.Assert(err, gc.IsNil)
+		defer res.Body.Close()
+		c.Assert(res.StatusCode, gc.Equals, http.StatusOK)
+		var modRes ModifiedResponse
+		err = json.NewDecoder(res.Body).Decode(&modRes)
+		c.Assert(err, gc.IsNil)
+		return &modRes, time.Since(start)
+	}
+
+	// A waiting request is woken by a key change, not by polling.
+	go func() {
+		<-queried
+		st.Notify(storage.KeyAdded{Digest: "abcd"})
+	}()
+	modRes, elapsed := modified()
+	c.Assert(modRes.Keys, gc.HasLen, 1)
+	c.Assert(elapsed < 10*time.Second, gc.Equals, true)
+	c.Assert(st.MethodCount("ModifiedAfter"), gc.Equals, 2)
+	<-queried
+
+	// Clients without a token are answered at once when waits need one.
+	mu.Lock()
+	calls = 0
+	mu.Unlock()
+	modRes, _ = modified(ModifiedWaitTokens(true))
+	c.Assert(modRes.Keys, gc.HasLen, 0)
+	c.Assert(st.MethodCount("ModifiedAfter"), gc.Equals, 3)
+}
+
+func (s *HandlerSuite) TestModifiedUnsupported(c *gc.C) {
+	st := mock.NewStorage(mock.Unsupported(storage.CapModifiedSince))
+	r := httprouter.New()
+	handler, err := NewHandler(st)
+	c.Assert(err, gc.IsNil)
+	handler.Register(r)
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	res, err := http.Get(srv.URL + "/pks/modified")
+	c.Assert(err, gc.IsNil)
+	res.Body.Close()
+	c.Assert(res.StatusCode, gc.Equals, http.StatusNotImplemented)
+	c.Assert(st.MethodCount("ModifiedAfter"), gc.Equals, 0)
+}
+
+func (s *HandlerSuite) TestHashQueryForward(c *gc.C) {
+	var forwarded string
+	stateful := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		forwarded = r.Method + " " + r.URL.Path + " " + string(body)
+		w.Header().Set("Content-Type", "pgp/keys")
+		w.Write([]byte{0, 0, 0, 0})
+	}))
+	defer stateful.Close()
+	u, err := url.Parse(stateful.URL)
+	c.Assert(err, gc.IsNil)
+
+	r := httprouter.New()
+	handler, err := NewHandler(s.storage, ForwardHashQuery(u))
+	c.Assert(err, gc.IsNil)
+	handler.Register(r)
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	res, err := http.Post(srv.URL+"/pks/hashquery", "sks/hashquery", bytes.NewBufferString("query"))
+	c.Assert(err, gc.IsNil)
+	doc, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	c.Assert(err, gc.IsNil)
+	c.Assert(res.StatusCode, gc.Equals, http.StatusOK)
+	c.Assert(doc, gc.DeepEquals, []byte{0, 0, 0, 0})
+	c.Assert(forwarded, gc.Equals, "POST /pks/hashquery query")
+	c.Assert(s.storage.MethodCount("MatchMD5"), gc.Equals, 0)
+}
+
+func (s *HandlerSuite) TestHashQueryDigestCache(c *gc.C) {
+	cache, err := digestcache.New(digestcache.DefaultSettings())
+	c.Assert(err, gc.IsNil)
+	r := httprouter.New()
+	handler, err := NewHandler(s.storage, DigestCache(cache))
+	c.Assert(err, gc.IsNil)
+	handler.Register(r)
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	hashQuery := func(digest string) int {
+		var body bytes.Buffer
+		hash, err := hex.DecodeString(digest)
+		c.Assert(err, gc.IsNil)
+		c.Assert(recon.WriteInt(&body, 1), gc.IsNil)
+		c.Assert(recon.WriteInt(&body, len(hash)), gc.IsNil)
+		body.Write(hash)
+		res, err := http.Post(srv.URL+"/pks/hashquery", "sks/hashquery", &body)
+		c.Assert(err, gc.IsNil)
+		defer res.Body.Close()
+		c.Assert(res.StatusCode, gc.Equals, http.StatusOK)
+		n, err := recon.ReadInt(res.Body)
+		c.Assert(err, gc.IsNil)
+		return n
+	}
+
+	// Lookups learn the digests of the keys they fetch.
+	res, err := http.Get(srv.URL + "/pks/lookup?op=get&search=0x" + testKeyDefault.fp)
+	c.Assert(err, gc.IsNil)
+	res.Body.Close()
+	c.Assert(res.StatusCode, gc.Equals, http.StatusOK)
+	key := openpgp.MustReadArmorKeys(testing.MustInput(testKeyDefault.file))[0]
+	digest, ok := cache.Digest(key.RFingerprint)
+	c.Assert(ok, gc.Equals, true)
+	c.Assert(digest, gc.Equals, key.MD5)
+
+	c.Assert(hashQuery(key.MD5), gc.Equals, 1)
+	c.Assert(s.storage.MethodCount("MatchMD5"), gc.Equals, 0)
+
+	// Digests not cached are resolved by storage.
+	hashQuery("00000000000000000000000000000000")
+	c.Assert(s.storage.MethodCount("MatchMD5"), gc.Equals, 1)
+
+	// So are digests of keys which have changed since they were cached.
+	cache.Put(cache.Generation(), key.RFingerprint, "00000000000000000000000000000001")
+	hashQuery("00000000000000000000000000000001")
+	c.Assert(s.storage.MethodCount("MatchMD5"), gc.Equals, 2)
+}
+
+func (s *HandlerSuite) TestGetResponseLimit(c *gc.C) {
+	st := mock.NewStorage(
+		mock.Resolve(func([]string) ([]string, error) {
+			return []string{"b6bc2c8ed1ce35ab8ab4ee7ac07ec5d8fb9f2a50"}, nil
+		}),
+		mock.FetchKeys(func([]string) ([]*openpgp.PrimaryKey, error) {
+			return openpgp.MustReadArmorKeys(testing.MustInput("weasel.asc")), nil
+		}),
+	)
+	for _, t := range []struct {
+		maxLength int
+		truncate  bool
+		status    int
+		truncated bool
+	}{
+		{0, false, http.StatusOK, false},
+		{1000000, false, http.StatusOK, false},
+		{100000, false, http.StatusUnprocessableEntity, false},
+		{100000, true, http.StatusOK, true},
+		{100, true, http.StatusUnprocessableEntity, false},
+	} {
+		r := httprouter.New()
+		handler, err := NewHandler(st, ResponseLimit(t.maxLength, t.truncate))
+		c.Assert(err, gc.IsNil)
+		handler.Register(r)
+		srv := httptest.NewServer(r)
+
+		res, err := http.Get(srv.URL + "/pks/lookup?op=get&search=0xc07ec5d8fb9f2a50")
+		c.Assert(err, gc.IsNil)
+		armor, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		srv.Close()
+		c.Assert(err, gc.IsNil)
+		comment := gc.Commentf("%+v", t)
+		c.Assert(res.StatusCode, gc.Equals, t.status, comment)
+		if t.status != http.StatusOK {
+			continue
+		}
+		keys := openpgp.MustReadArmorKeys(bytes.NewBuffer(armor))
+		c.Assert(keys, gc.HasLen, 1)
+		if t.truncated {
+			c.Assert(res.Header.Get("X-HKP-Truncated"), gc.Equals, keys[0].Fingerprint(), comment)
+			c.Assert(res.Header.Get("ETag"), gc.Matches, `".*-truncated"`, comment)
+			c.Assert(keys[0].SerializedLength() <= t.maxLength, gc.Equals, true, comment)
+		} else {
+			c.Assert(res.Header.Get("X-HKP-Truncated"), gc.Equals, "", comment)
+		}
+	}
+}
+
+func (s *HandlerSuite) TestGetSlim(c *gc.C) {
+	st := mock.NewStorage(
+		mock.Resolve(func([]string) ([]string, error) {
+			return []string{"1c9dc2eb12182820154687879a156a2aa63b42d0"}, nil
+		}),
+		mock.FetchKeys(func([]string) ([]*openpgp.PrimaryKey, error) {
+			return openpgp.MustReadArmorKeys(testing.MustInput("tails.asc")), nil
+		}),
+	)
+	get := func(query string, options ...HandlerOption) *openpgp.PrimaryKey {
+		r := httprouter.New()
+		handler, err := NewHandler(st, options...)
+		c.Assert(err, gc.IsNil)
+		handler.Register(r)
+		srv := httptest.NewServer(r)
+		defer srv.Close()
+
+		res, err := http.Get(srv.URL + "/pks/lookup?op=get&search=0x1202821cbe2cd9c1" + query)
+		c.Assert(err, gc.IsNil)
+		defer res.Body.Close()
+		c.Assert(res.StatusCode, gc.Equals, http.StatusOK)
+		keys := openpgp.MustReadArmorKeys(res.Body)
+		c.Assert(keys, gc.HasLen, 1)
+		return keys[0]
+	}
+
+	full := get("")
+	slim := get("&options=slim")
+	c.Assert(slim.Fingerprint(), gc.Equals, full.Fingerprint())
+	c.Assert(slim.SerializedLength() < full.SerializedLength(), gc.Equals, true)
+	c.Assert(slim.UserIDs, gc.HasLen, len(full.UserIDs))
+
+	c.Assert(get("", SlimKeys(true)).MD5, gc.Equals, slim.MD5)
+}
+
+func (s *HandlerSuite) TestGetAttested(c *gc.C) {
+	st := mock.NewStorage(
+		mock.Resolve(func([]string) ([]string, error) {
+			return []string{"7ac3e64c12d1317aa826bef4fab1afa0a57f282a"}, nil
+		}),
+		mock.FetchKeys(func([]string) ([]*openpgp.PrimaryKey, error) {
+			return openpgp.MustReadArmorKeys(testing.MustInput("attested.asc")), nil
+		}),
+	)
+	get := func(query string, options ...HandlerOption) (*openpgp.PrimaryKey, string) {
+		r := httprouter.New()
+		handler, err := NewHandler(st, options...)
+		c.Assert(err, gc.IsNil)
+		handler.Register(r)
+		srv := httptest.NewServer(r)
+		defer srv.Close()
+
+		res, err := http.Get(srv.URL + "/pks/lookup?op=get&search=0xfab1afa0a57f282a" + query)
+		c.Assert(err, gc.IsNil)
+		defer res.Body.Close()
+		c.Assert(res.StatusCode, gc.Equals, http.StatusOK)
+		keys := openpgp.MustReadArmorKeys(res.Body)
+		c.Assert(keys, gc.HasLen, 1)
+		return keys[0], res.Header.Get("ETag")
+	}
+
+	full, _ := get("")
+	c.Assert(full.UserIDs[0].Signatures, gc.HasLen, 4)
+	attested, etag := get("&options=attested")
+	c.Assert(attested.UserIDs[0].Signatures, gc.HasLen, 3)
+	_, others := attested.UserIDs[0].SigInfo(attested)
+	c.Assert(others, gc.HasLen, 1)
+	c.Assert(others[0].IssuerKeyID(), gc.Equals, "e0cdef71c04326c4")
+	c.Assert(etag, gc.Equals, `"`+full.MD5+`-attested"`)
+
+	always, _ := get("", AttestedOnly(true))
+	c.Assert(always.MD5, gc.Equals, attested.MD5)
+	_, etag = get("&options=slim", AttestedOnly(true))
+	c.Assert(etag, gc.Equals, `"`+full.MD5+`-attested-slim"`)
+}
+
+func (s *HandlerSuite) TestExcludeExpired(c *gc.C) {
+	st := mock.NewStorage(
+		mock.Resolve(func([]string) ([]string, error) {
+			return []string{"1c9dc2eb12182820154687879a156a2aa63b42d0"}, nil
+		}),
+		mock.FetchKeys(func([]string) ([]*openpgp.PrimaryKey, error) {
+			keys := openpgp.MustReadArmorKeys(testing.MustInput("tails.asc"))
+			return append(keys, openpgp.MustReadArmorKeys(testing.MustInput("alice_signed.asc"))...), nil
+		}),
+	)
+	lookup := func(query string, options ...HandlerOption) *http.Response {
+		r := httprouter.New()
+		handler, err := NewHandler(st, options...)
+		c.Assert(err, gc.IsNil)
+		handler.Register(r)
+		srv := httptest.NewServer(r)
+		defer srv.Close()
+
+		res, err := http.Get(srv.URL + "/pks/lookup?search=alice&" + query)
+		c.Assert(err, gc.IsNil)
+		return res
+	}
+	index := func(query string, options ...HandlerOption) []*jsonhkp.PrimaryKey {
+		res := lookup(query, options...)
+		defer res.Body.Close()
+		c.Assert(res.StatusCode, gc.Equals, http.StatusOK)
+		var result []*jsonhkp.PrimaryKey
+		err := json.NewDecoder(res.Body).Decode(&result)
+		c.Assert(err, gc.IsNil)
+		return result
+	}
+
+	all := index("op=index&options=json")
+	c.Assert(all, gc.HasLen, 2)
+	c.Assert(all[0].ExpiresAt, gc.Equals, "2015-02-05T09:04:59Z")
+	c.Assert(all[0].Expired, gc.Equals, true)
+	c.Assert(all[1].ExpiresAt, gc.Equals, "")
+	c.Assert(all[1].Expired, gc.Equals, false)
+
+	unexpired := index("op=index&options=json,exclude-expired")
+	c.Assert(unexpired, gc.HasLen, 1)
+	c.Assert(unexpired[0].Fingerprint, gc.Equals, all[1].Fingerprint)
+	c.Assert(index("op=index&options=json", ExcludeExpired(true)), gc.HasLen, 1)
+
+	res := lookup("op=get&options=exclude-expired")
+	defer res.Body.Close()
+	c.Assert(res.StatusCode, gc.Equals, http.StatusOK)
+	keys := openpgp.MustReadArmorKeys(res.Body)
+	c.Assert(keys, gc.HasLen, 1)
+	c.Assert(keys[0].Fingerprint(), gc.Equals, all[1].Fingerprint)
+}
+
+func (s *HandlerSuite) TestRefuseShortKeyIDs(c *gc.C) {
+	st := mock.NewStorage(
+		mock.Resolve(func([]string) ([]string, error) {
+			return []string{"ce353cf4"}, nil
+		}),
+		mock.FetchKeys(func([]string) ([]*openpgp.PrimaryKey, error) {
+			return openpgp.MustReadArmorKeys(testing.MustInput("sksdigest.asc")), nil
+		}),
+	)
+	r := httprouter.New()
+	handler, err := NewHandler(st, RefuseShortKeyIDs(true))
+	c.Assert(err, gc.IsNil)
+	handler.Register(r)
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	for _, op := range []string{"get", "index", "vindex"} {
+		res, err := http.Get(srv.URL + "/pks/lookup?op=" + op + "&search=0xce353cf4")
+		c.Assert(err, gc.IsNil)
+		body, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		c.Assert(err, gc.IsNil)
+		c.Assert(res.StatusCode, gc.Equals, http.StatusBadRequest)
+		c.Assert(res.Header.Get("X-HKP-Refused"), gc.Equals, "short-keyid")
+		c.Assert(string(body), gc.Matches, "lookups by 32-bit key ID are refused .*\n")
+	}
+	c.Assert(st.MethodCount("Resolve"), gc.Equals, 0)
+
+	for _, search := range []string{"0xcc5112bdce353cf4", "0x646ad4c90a2d13f62d9d1bf4cc5112bdce353cf4"} {
+		res, err := http.Get(srv.URL + "/pks/lookup?op=get&search=" + search)
+		c.Assert(err, gc.IsNil)
+		res.Body.Close()
+		c.Assert(res.StatusCode, gc.Equals, http.StatusOK, gc.Commentf("%s", search))
+		c.Assert(res.Header.Get("X-HKP-Refused"), gc.Equals, "")
+	}
+}
+
+func (s *HandlerSuite) TestAddRevocation(c *gc.C) {
+	var updated *openpgp.PrimaryKey
+	keyring := "test-key.asc"
+	st := mock.NewStorage(
+		mock.Resolve(func(keyIDs []string) ([]string, error) {
+			return []string{"f261e60a854033c7ea8477883122fb519958b4d2"}, nil
+		}),
+		mock.FetchKeys(func([]string) ([]*openpgp.PrimaryKey, error) {
+			return openpgp.MustReadArmorKeys(testing.MustInput(keyring)), nil
+		}),
+		mock.Update(func(key *openpgp.PrimaryKey, _, _ string) error {
+			updated = key
+			return nil
+		}),
+	)
+	r := httprouter.New()
+	handler, err := NewHandler(st)
+	c.Assert(err, gc.IsNil)
+	handler.Register(r)
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	revocation, err := ioutil.ReadAll(testing.MustInput("test-key-revoke.asc"))
+	c.Assert(err, gc.IsNil)
+	add := func() *http.Response {
+		res, err := http.PostForm(srv.URL+"/pks/add", url.Values{
+			"keytext": []string{string(revocation)},
+		})
+		c.Assert(err, gc.IsNil)
+		return res
+	}
+
+	res := add()
+	doc, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	c.Assert(err, gc.IsNil)
+	c.Assert(res.StatusCode, gc.Equals, http.StatusOK, gc.Commentf("%s", doc))
+	var addRes AddResponse
+	err = json.Unmarshal(doc, &addRes)
+	c.Assert(err, gc.IsNil)
+	c.Assert(addRes.Updated, gc.DeepEquals, []string{"rsa3072/2d4b859915bf2213880748ae7c330458a06e162f"})
+	c.Assert(updated, gc.NotNil)
+	c.Assert(updated.Revoked(), gc.Equals, true)
+
+	// Resubmitting the revocation changes nothing.
+	keyring = "test-key-revoked.asc"
+	res = add()
+	res.Body.Close()
+	c.Assert(res.StatusCode, gc.Equals, http.StatusOK)
+	c.Assert(st.MethodCount("Update"), gc.Equals, 1)
+
+	// The revocation must be made by the stored key.
+	keyring = "alice_signed.asc"
+	res = add()
+	res.Body.Close()
+	c.Assert(res.StatusCode, gc.Equals, http.StatusNotFound)
+}
+
+func armoredEntity(c *gc.C, e *xopenpgp.Entity) string {
+	// Serializing the private key makes the self-signatures.
+	c.Assert(e.SerializePrivate(ioutil.Discard, nil), gc.IsNil)
+	var buf bytes.Buffer
+	w, err := armor.Encode(&buf, xopenpgp.PublicKeyType, nil)
+	c.Assert(err, gc.IsNil)
+	c.Assert(e.Serialize(w), gc.IsNil)
+	c.Assert(w.Close(), gc.IsNil)
+	return buf.String()
+}
+
+func signChallenge(c *gc.C, e *xopenpgp.Entity, challenge string) string {
+	var buf bytes.Buffer
+	err := xopenpgp.ArmoredDetachSign(&buf, e, strings.NewReader(challenge), nil)
+	c.Assert(err, gc.IsNil)
+	return buf.String()
+}
+
+func (s *HandlerSuite) TestProvenance(c *gc.C) {
+	config := &packet.Config{Algorithm: packet.PubKeyAlgoRSA, RSABits: 2048}
+	holder, err := xopenpgp.NewEntity("Holder", "", "holder@example.com", config)
+	c.Assert(err, gc.IsNil)
+	other, err := xopenpgp.NewEntity("Other", "", "other@example.com", config)
+	c.Assert(err, gc.IsNil)
+	fp := hex.EncodeToString(holder.PrimaryKey.Fingerprint[:])
+
+	var stored []*openpgp.PrimaryKey
+	proven := map[string]time.Time{}
+	st := mock.NewStorage(
+		mock.Resolve(func([]string) ([]string, error) {
+			return []string{fp}, nil
+		}),
+		mock.FetchKeys(func([]string) ([]*openpgp.PrimaryKey, error) {
+			return stored, nil
+		}),
+		mock.Insert(func(keys []*openpgp.PrimaryKey) (int, error) {
+			stored = keys
+			return len(keys), nil
+		}),
+		mock.RecordProvenance(func(rfps []string) error {
+			for _, rfp := range rfps {
+				proven[rfp] = time.Now()
+			}
+			return nil
+		}),
+		mock.FetchProvenance(func([]string) (map[string]time.Time, error) {
+			return proven, nil
+		}),
+	)
+	p := DefaultProvenance()
+	p.Enabled = true
+	p.Secret = "secret"
+	r := httprouter.New()
+	handler, err := NewHandler(st, KeyProvenance(p))
+	c.Assert(err, gc.IsNil)
+	clk := clock.NewFake(time.Now())
+	handler.provenance.clock = clk
+	handler.Register(r)
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	challenge := func() string {
+		res, err := http.Get(srv.URL + "/pks/challenge")
+		c.Assert(err, gc.IsNil)
+		defer res.Body.Close()
+		c.Assert(res.StatusCode, gc.Equals, http.StatusOK)
+		c.Assert(res.Header.Get("Cache-Control"), gc.Equals, "no-store")
+		doc, err := ioutil.ReadAll(res.Body)
+		c.Assert(err, gc.IsNil)
+		return string(doc)
+	}
+	keytext := armoredEntity(c, holder)
+	add := func(params url.Values) (int, *AddResponse) {
+		params.Set("keytext", keytext)
+		res, err := http.PostForm(srv.URL+"/pks/add", params)
+		c.Assert(err, gc.IsNil)
+		defer res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			return res.StatusCode, nil
+		}
+		var addRes AddResponse
+		c.Assert(json.NewDecoder(res.Body).Decode(&addRes), gc.IsNil)
+		return res.StatusCode, &addRes
+	}
+	provenance := func() string {
+		res, err := http.Get(srv.URL + "/pks/lookup?op=index&options=json&search=0x" + fp)
+		c.Assert(err, gc.IsNil)
+		defer res.Body.Close()
+		c.Assert(res.StatusCode, gc.Equals, http.StatusOK)
+		var result []*jsonhkp.PrimaryKey
+		c.Assert(json.NewDecoder(res.Body).Decode(&result), gc.IsNil)
+		c.Assert(result, gc.HasLen, 1)
+		return result[0].Provenance
+	}
+
+	// Keys submitted without proof are accepted, but unverified.
+	status, addRes := add(url.Values{})
+	c.Assert(status, gc.Equals, http.StatusOK)
+	c.Assert(addRes.Inserted, gc.HasLen, 1)
+	c.Assert(addRes.Proven, gc.HasLen, 0)
+	c.Assert(provenance(), gc.Equals, ProvenanceUnverified)
+
+	// Proof must be signed by the key submitted, over a challenge issued
+	// by the server.
+	ch := challenge()
+	for _, params := range []url.Values{
+		{"challenge": {ch}},
+		{"challenge": {ch}, "keysig": {signChallenge(c, other, ch)}},
+		{"challenge": {ch + "0"}, "keysig": {signChallenge(c, holder, ch+"0")}},
+	} {
+		status, _ = add(params)
+		c.Assert(status, gc.Equals, http.StatusBadRequest)
+	}
+	c.Assert(st.MethodCount("RecordProvenance"), gc.Equals, 0)
+
+	status, addRes = add(url.Values{"challenge": {ch}, "keysig": {signChallenge(c, holder, ch)}})
+	c.Assert(status, gc.Equals, http.StatusOK)
+	c.Assert(addRes.Proven, gc.HasLen, 1)
+	c.Assert(proven, gc.HasLen, 1)
+	c.Assert(proven[openpgp.Reverse(fp)], gc.NotNil)
+	c.Assert(provenance(), gc.Equals, ProvenanceVerified)
+
+	// Challenges expire.
+	clk.Advance(time.Duration(p.ChallengeTTLSecs+1) * time.Second)
+	status, _ = add(url.Values{"challenge": {ch}, "keysig": {signChallenge(c, holder, ch)}})
+	c.Assert(status, gc.Equals, http.StatusBadRequest)
+}
+
+func (s *HandlerSuite) TestProvenanceDisabled(c *gc.C) {
+	res, err := http.Get(s.srv.URL + "/pks/challenge")
+	c.Assert(err, gc.IsNil)
+	res.Body.Close()
+	c.Assert(res.StatusCode, gc.Equals, http.StatusNotFound)
+
+	res, err = http.Get(s.srv.URL + "/pks/lookup?op=index&options=json&search=0x" + testKeyDefault.fp)
+	c.Assert(err, gc.IsNil)
+	defer res.Body.Close()
+	var result []*jsonhkp.PrimaryKey
+	c.Assert(json.NewDecoder(res.Body).Decode(&result), gc.IsNil)
+	c.Assert(result, gc.HasLen, 1)
+	c.Assert(result[0].Provenance, gc.Equals, "")
 }
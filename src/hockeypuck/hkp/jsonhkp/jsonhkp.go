@@ -107,6 +107,18 @@ type PrimaryKey struct {
 	SubKeys   []*SubKey        `json:"subKeys,omitempty"`
 	UserIDs   []*UserID        `json:"userIDs,omitempty"`
 	UserAttrs []*UserAttribute `json:"userAttrs,omitempty"`
+
+	// RedactedUserIDs is the number of user IDs omitted from the listing.
+	RedactedUserIDs int `json:"redactedUserIDs,omitempty"`
+
+	// ExpiresAt is when the key expires, taking the expiration of its
+	// primary user ID's latest self-signature into account.
+	ExpiresAt string `json:"expiresAt,omitempty"`
+	Expired   bool   `json:"expired,omitempty"`
+
+	// Provenance is whether the key was submitted with proof of possession
+	// by its holder, "verified" or "unverified", if the server checks.
+	Provenance string `json:"provenance,omitempty"`
 }
 
 func NewPrimaryKeys(froms []*openpgp.PrimaryKey) []*PrimaryKey {
@@ -123,11 +135,19 @@ func NewPrimaryKey(from *openpgp.PrimaryKey) *PrimaryKey {
 		MD5:       from.MD5,
 		Length:    from.Length,
 	}
+	if expiresAt, ok := from.ExpiresAt(); ok {
+		to.ExpiresAt = expiresAt.UTC().Format(time.RFC3339)
+		to.Expired = from.Expired()
+	}
 	for _, fromSubKey := range from.SubKeys {
 		to.SubKeys = append(to.SubKeys, NewSubKey(fromSubKey))
 	}
 	for _, fromUid := range from.UserIDs {
-		to.UserIDs = append(to.UserIDs, NewUserID(fromUid))
+		toUid := NewUserID(fromUid)
+		for _, uri := range fromUid.Proofs(from) {
+			toUid.Proofs = append(toUid.Proofs, &Proof{URI: uri})
+		}
+		to.UserIDs = append(to.UserIDs, toUid)
 	}
 	for _, fromUat := range from.UserAttributes {
 		to.UserAttrs = append(to.UserAttrs, NewUserAttribute(fromUat))
@@ -161,6 +181,17 @@ type UserID struct {
 	Packet      *Packet      `json:"packet,omitempty"`
 	Signatures  []*Signature `json:"signatures,omitempty"`
 	Unsupported []*Packet    `json:"unsupported,omitempty"`
+	Proofs      []*Proof     `json:"proofs,omitempty"`
+
+	// Redacted is whether email addresses were removed from the user ID.
+	Redacted bool `json:"redacted,omitempty"`
+}
+
+// Proof is an identity proof claimed by the self-signature of a user ID.
+// Status is set when the server verifies proofs.
+type Proof struct {
+	URI    string `json:"uri"`
+	Status string `json:"status,omitempty"`
 }
 
 func NewUserID(from *openpgp.UserID) *UserID {
@@ -226,6 +257,15 @@ type Signature struct {
 	Expiration   string  `json:"expiration,omitempty"`
 	NeverExpires bool    `json:"neverExpires,omitempty"`
 	Packet       *Packet `json:"packet,omitempty"`
+
+	Notations []*Notation `json:"notations,omitempty"`
+}
+
+// Notation is a notation in the hashed area of a signature.
+type Notation struct {
+	Name          string `json:"name"`
+	Value         string `json:"value"`
+	HumanReadable bool   `json:"humanReadable,omitempty"`
 }
 
 func NewSignature(from *openpgp.Signature) *Signature {
@@ -252,6 +292,16 @@ func NewSignature(from *openpgp.Signature) *Signature {
 		to.NeverExpires = true
 	}
 
+	// A signature with malformed subpackets is listed without notations.
+	notations, _ := from.Notations()
+	for _, n := range notations {
+		to.Notations = append(to.Notations, &Notation{
+			Name:          n.Name,
+			Value:         n.Value,
+			HumanReadable: n.HumanReadable,
+		})
+	}
+
 	return to
 }
 
@@ -280,6 +330,10 @@ func (pk *PublicKey) packets() []*Packet {
 }
 
 func (u *UserID) packets() []*Packet {
+	if u.Packet == nil {
+		// Redacted, so its signatures cannot be serialized either.
+		return nil
+	}
 	packets := []*Packet{u.Packet}
 	for _, s := range u.Signatures {
 		packets = append(packets, s.packets()...)
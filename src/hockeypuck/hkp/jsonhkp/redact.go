@@ -0,0 +1,74 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package jsonhkp
+
+import (
+	"regexp"
+
+	"github.com/pkg/errors"
+)
+
+// Redaction modes, which hide user IDs from key listings to make harvesting
+// addresses from the keyserver harder.
+const (
+	// RedactNone lists user IDs in full.
+	RedactNone = ""
+
+	// RedactEmail replaces the email addresses in user IDs.
+	RedactEmail = "email"
+
+	// RedactUserID omits user IDs entirely.
+	RedactUserID = "uid"
+)
+
+// RedactedAddress replaces email addresses in redacted user IDs.
+const RedactedAddress = "redacted"
+
+// CheckRedaction returns an error if mode is not a redaction mode.
+func CheckRedaction(mode string) error {
+	switch mode {
+	case RedactNone, RedactEmail, RedactUserID:
+		return nil
+	}
+	return errors.Errorf("unknown redaction mode %q", mode)
+}
+
+var addressPattern = regexp.MustCompile(`[^\s<>()"]+@[^\s<>()"]+`)
+
+// RedactAddresses replaces every email address in s.
+func RedactAddresses(s string) string {
+	return addressPattern.ReplaceAllLiteralString(s, RedactedAddress)
+}
+
+// Redact hides the user IDs of keys as mode requires. The packets of
+// redacted user IDs are removed, since they contain the user ID.
+func Redact(keys []*PrimaryKey, mode string) {
+	for _, key := range keys {
+		switch mode {
+		case RedactEmail:
+			for _, uid := range key.UserIDs {
+				uid.Keywords = RedactAddresses(uid.Keywords)
+				uid.Packet = nil
+				uid.Redacted = true
+			}
+		case RedactUserID:
+			key.RedactedUserIDs += len(key.UserIDs)
+			key.UserIDs = nil
+		}
+	}
+}
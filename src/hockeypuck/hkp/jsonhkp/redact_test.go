@@ -0,0 +1,44 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package jsonhkp
+
+import (
+	stdtesting "testing"
+
+	gc "gopkg.in/check.v1"
+)
+
+func Test(t *stdtesting.T) { gc.TestingT(t) }
+
+type RedactSuite struct{}
+
+var _ = gc.Suite(&RedactSuite{})
+
+func (s *RedactSuite) TestRedactAddresses(c *gc.C) {
+	for _, t := range []struct {
+		in, out string
+	}{
+		{"alice <alice@example.com>", "alice <redacted>"},
+		{"alice@example.com", "redacted"},
+		{"Bob (work, bob@example.org) <bob@example.com>", "Bob (work, redacted) <redacted>"},
+		{"Carol Smith", "Carol Smith"},
+		{"", ""},
+	} {
+		c.Check(RedactAddresses(t.in), gc.Equals, t.out, gc.Commentf("%q", t.in))
+	}
+}
@@ -0,0 +1,286 @@
+// Package keycache keeps recently looked up keys in memory, so that lookups
+// of a few very popular keys, such as the signing keys of Linux
+// distributions, do not each query storage.
+//
+// Keys are cached by the fingerprint or long key ID they were looked up by,
+// in a least recently used list bounded by their total length, together with
+// when they were last modified, if storage records it. Cached keys
+// expire after a time to live, and are evicted as soon as storage notifies
+// that they were replaced or removed. Short key IDs are not cached, since a
+// key added later may share one.
+package keycache
+
+import (
+	"bytes"
+	"container/list"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"hockeypuck/clock"
+	"hockeypuck/hkp/storage"
+	"hockeypuck/openpgp"
+)
+
+const (
+	DefaultTTLSecs = 300
+)
+
+type Settings struct {
+	// MaxBytes bounds the total length of the cached keys. Zero disables
+	// the cache.
+	MaxBytes int `toml:"maxBytes"`
+
+	// TTLSecs is how long a key is cached, bounding how stale a lookup may
+	// be after another server writes to shared storage.
+	TTLSecs int `toml:"ttlSecs"`
+}
+
+func DefaultSettings() *Settings {
+	return &Settings{
+		TTLSecs: DefaultTTLSecs,
+	}
+}
+
+// Enabled returns whether keys are cached.
+func (s *Settings) Enabled() bool {
+	return s != nil && s.MaxBytes > 0
+}
+
+// entry is a cached key. Keys are cached serialized, since lookups modify
+// the keys they serve.
+type entry struct {
+	rfp     string
+	md5     string
+	data    []byte
+	mtime   time.Time
+	expires time.Time
+	keyIDs  []string
+}
+
+// Cache is a read-through cache of keys looked up by key ID. It is safe for
+// concurrent use.
+type Cache struct {
+	maxBytes int
+	ttl      time.Duration
+	clock    clock.Clock
+
+	mu    sync.Mutex
+	lru   *list.List
+	keys  map[string]*list.Element
+	ids   map[string]*list.Element
+	md5s  map[string]*list.Element
+	size  int
+	epoch uint64
+}
+
+// New returns a cache with the given settings.
+func New(settings *Settings) (*Cache, error) {
+	if !settings.Enabled() {
+		return nil, errors.New("key cache size not set")
+	}
+	if settings.TTLSecs <= 0 {
+		return nil, errors.Errorf("invalid key cache TTL %d", settings.TTLSecs)
+	}
+	registerMetrics()
+	return &Cache{
+		maxBytes: settings.MaxBytes,
+		ttl:      time.Duration(settings.TTLSecs) * time.Second,
+		clock:    clock.Real(),
+		lru:      list.New(),
+		keys:     map[string]*list.Element{},
+		ids:      map[string]*list.Element{},
+		md5s:     map[string]*list.Element{},
+	}, nil
+}
+
+// Cacheable returns whether lookups of the reversed key ID are cached.
+func Cacheable(keyID string) bool {
+	return len(keyID) == 16 || len(keyID) == 40
+}
+
+// Lookup returns the keys matching a reversed key ID, from the cache or else
+// from st. Only a key ID resolving to exactly one key is cached.
+func (c *Cache) Lookup(st storage.Queryer, keyID string) ([]*openpgp.PrimaryKey, error) {
+	if !Cacheable(keyID) {
+		return c.fetch(st, keyID)
+	}
+	if key, ok := c.get(keyID); ok {
+		cacheMetrics.requests.WithLabelValues("hit").Inc()
+		return []*openpgp.PrimaryKey{key}, nil
+	}
+	cacheMetrics.requests.WithLabelValues("miss").Inc()
+
+	c.mu.Lock()
+	epoch := c.epoch
+	c.mu.Unlock()
+	keys, err := c.fetch(st, keyID)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if len(keys) == 1 {
+		var mtime time.Time
+		if fetcher, ok := st.(storage.ModTimeFetcher); ok {
+			// Fetched with the key, so that serving it from the cache does
+			// not query storage for its modification time either.
+			modTimes, err := fetcher.FetchModTimes([]string{keys[0].RFingerprint})
+			if err != nil {
+				return nil, errors.WithStack(err)
+			}
+			mtime = modTimes[keys[0].RFingerprint]
+		}
+		err = c.put(keyID, keys[0], mtime, epoch)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+	}
+	return keys, nil
+}
+
+func (c *Cache) fetch(st storage.Queryer, keyID string) ([]*openpgp.PrimaryKey, error) {
+	rfps, err := st.Resolve([]string{keyID})
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	keys, err := st.FetchKeys(rfps)
+	return keys, errors.WithStack(err)
+}
+
+// get returns a fresh copy of the key cached for keyID, if any.
+func (c *Cache) get(keyID string) (*openpgp.PrimaryKey, bool) {
+	c.mu.Lock()
+	elem, ok := c.ids[keyID]
+	if !ok {
+		c.mu.Unlock()
+		return nil, false
+	}
+	e := elem.Value.(*entry)
+	if !c.clock.Now().Before(e.expires) {
+		c.remove(elem)
+		c.mu.Unlock()
+		return nil, false
+	}
+	c.lru.MoveToFront(elem)
+	rfp, digest, data := e.rfp, e.md5, e.data
+	c.mu.Unlock()
+
+	// The cached key was digested when it was fetched.
+	keys, err := openpgp.NewKeyReader(bytes.NewReader(data), openpgp.KnownDigest(func(keyRFP string) (string, bool) {
+		return digest, keyRFP == rfp
+	})).Read()
+	if err != nil || len(keys) != 1 {
+		// Cached keys were written from parsed keys, so this is unexpected;
+		// look the key up again.
+		c.mu.Lock()
+		if elem, ok := c.ids[keyID]; ok {
+			c.remove(elem)
+		}
+		c.mu.Unlock()
+		return nil, false
+	}
+	return keys[0], true
+}
+
+// put caches key, last modified at mtime, for keyID, unless the cache was
+// invalidated since epoch, when the key was fetched.
+func (c *Cache) put(keyID string, key *openpgp.PrimaryKey, mtime time.Time, epoch uint64) error {
+	var buf bytes.Buffer
+	err := openpgp.WritePackets(&buf, key)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if buf.Len() > c.maxBytes {
+		return nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if epoch != c.epoch {
+		return nil
+	}
+	if elem, ok := c.keys[key.RFingerprint]; ok {
+		e := elem.Value.(*entry)
+		if e.md5 == key.MD5 {
+			if _, ok := c.ids[keyID]; !ok {
+				e.keyIDs = append(e.keyIDs, keyID)
+				c.ids[keyID] = elem
+			}
+			c.lru.MoveToFront(elem)
+			return nil
+		}
+		c.remove(elem)
+	}
+	e := &entry{
+		rfp:     key.RFingerprint,
+		md5:     key.MD5,
+		data:    buf.Bytes(),
+		mtime:   mtime,
+		expires: c.clock.Now().Add(c.ttl),
+		keyIDs:  []string{keyID},
+	}
+	elem := c.lru.PushFront(e)
+	c.keys[e.rfp] = elem
+	c.ids[keyID] = elem
+	c.md5s[e.md5] = elem
+	c.size += len(e.data)
+	for c.size > c.maxBytes {
+		c.remove(c.lru.Back())
+	}
+	c.updateMetrics()
+	return nil
+}
+
+// remove evicts a cached key. The caller must hold c.mu.
+func (c *Cache) remove(elem *list.Element) {
+	e := c.lru.Remove(elem).(*entry)
+	delete(c.keys, e.rfp)
+	delete(c.md5s, e.md5)
+	for _, keyID := range e.keyIDs {
+		delete(c.ids, keyID)
+	}
+	c.size -= len(e.data)
+	c.updateMetrics()
+}
+
+func (c *Cache) updateMetrics() {
+	cacheMetrics.keys.Set(float64(c.lru.Len()))
+	cacheMetrics.bytes.Set(float64(c.size))
+}
+
+// KeyChanged evicts keys which were replaced or removed. It is subscribed to
+// storage notifications.
+func (c *Cache) KeyChanged(kc storage.KeyChange) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.epoch++
+	for _, digest := range kc.RemoveDigests() {
+		if elem, ok := c.md5s[digest]; ok {
+			c.remove(elem)
+		}
+	}
+	return nil
+}
+
+// ModTime returns when the cached key with the given digest was last
+// modified, if it is cached and storage records it.
+func (c *Cache) ModTime(digest string) (time.Time, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.md5s[digest]
+	if !ok {
+		return time.Time{}, false
+	}
+	e := elem.Value.(*entry)
+	if e.mtime.IsZero() || !c.clock.Now().Before(e.expires) {
+		return time.Time{}, false
+	}
+	return e.mtime, true
+}
+
+// Len returns the number of cached keys.
+func (c *Cache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lru.Len()
+}
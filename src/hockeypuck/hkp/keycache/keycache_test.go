@@ -0,0 +1,196 @@
+package keycache
+
+import (
+	stdtesting "testing"
+	"time"
+
+	gc "gopkg.in/check.v1"
+
+	"hockeypuck/clock"
+	"hockeypuck/hkp/storage"
+	"hockeypuck/hkp/storage/mock"
+	"hockeypuck/openpgp"
+	"hockeypuck/testing"
+)
+
+func Test(t *stdtesting.T) { gc.TestingT(t) }
+
+type KeyCacheSuite struct {
+	keys    map[string]string
+	storage *mock.Storage
+	clock   *clock.Fake
+	cache   *Cache
+
+	// fetched is called when keys are fetched from storage.
+	fetched func()
+}
+
+var _ = gc.Suite(&KeyCacheSuite{})
+
+func (s *KeyCacheSuite) SetUpTest(c *gc.C) {
+	s.keys = map[string]string{}
+	for _, file := range []string{"alice_signed.asc", "a7400f5a_badsigs.asc"} {
+		key := openpgp.MustReadArmorKeys(testing.MustInput(file))[0]
+		s.keys[key.RFingerprint] = file
+	}
+	s.fetched = func() {}
+	s.storage = mock.NewStorage(
+		mock.Resolve(func(keyIDs []string) ([]string, error) {
+			var result []string
+			for rfp := range s.keys {
+				if len(rfp) >= len(keyIDs[0]) && rfp[:len(keyIDs[0])] == keyIDs[0] {
+					result = append(result, rfp)
+				}
+			}
+			return result, nil
+		}),
+		mock.FetchKeys(func(rfps []string) ([]*openpgp.PrimaryKey, error) {
+			s.fetched()
+			var result []*openpgp.PrimaryKey
+			for _, rfp := range rfps {
+				result = append(result, openpgp.MustReadArmorKeys(testing.MustInput(s.keys[rfp]))...)
+			}
+			return result, nil
+		}),
+	)
+	s.clock = clock.NewFake(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	s.cache = s.newCache(c, 1<<20)
+}
+
+func (s *KeyCacheSuite) newCache(c *gc.C, maxBytes int) *Cache {
+	cache, err := New(&Settings{MaxBytes: maxBytes, TTLSecs: 60})
+	c.Assert(err, gc.IsNil)
+	cache.clock = s.clock
+	return cache
+}
+
+const (
+	aliceRFP   = "accd0e320f1cb163a2aa9305257f384b1fc8ef01"
+	badSigsRFP = "46a4aa10053f9575b8368eec8b24bf84a5f0047a"
+)
+
+func (s *KeyCacheSuite) lookup(c *gc.C, keyID string) *openpgp.PrimaryKey {
+	keys, err := s.cache.Lookup(s.storage, keyID)
+	c.Assert(err, gc.IsNil)
+	c.Assert(keys, gc.HasLen, 1)
+	return keys[0]
+}
+
+func (s *KeyCacheSuite) TestLookup(c *gc.C) {
+	key := s.lookup(c, aliceRFP)
+	c.Assert(key.RFingerprint, gc.Equals, aliceRFP)
+	c.Assert(s.storage.MethodCount("FetchKeys"), gc.Equals, 1)
+
+	// Each hit is a copy, which may be modified.
+	key.UserIDs = nil
+	key = s.lookup(c, aliceRFP)
+	c.Assert(key.UserIDs, gc.Not(gc.HasLen), 0)
+	c.Assert(s.storage.MethodCount("FetchKeys"), gc.Equals, 1)
+
+	// The long key ID is cached separately, for the same key.
+	c.Assert(s.lookup(c, aliceRFP[:16]).RFingerprint, gc.Equals, aliceRFP)
+	c.Assert(s.lookup(c, aliceRFP[:16]).RFingerprint, gc.Equals, aliceRFP)
+	c.Assert(s.storage.MethodCount("FetchKeys"), gc.Equals, 2)
+	c.Assert(s.cache.Len(), gc.Equals, 1)
+
+	// Short key IDs are not cached.
+	s.lookup(c, aliceRFP[:8])
+	s.lookup(c, aliceRFP[:8])
+	c.Assert(s.storage.MethodCount("FetchKeys"), gc.Equals, 4)
+}
+
+func (s *KeyCacheSuite) TestNotFound(c *gc.C) {
+	for i := 0; i < 2; i++ {
+		keys, err := s.cache.Lookup(s.storage, "0123456789abcdef")
+		c.Assert(err, gc.IsNil)
+		c.Assert(keys, gc.HasLen, 0)
+	}
+	c.Assert(s.cache.Len(), gc.Equals, 0)
+}
+
+func (s *KeyCacheSuite) TestExpiry(c *gc.C) {
+	s.lookup(c, aliceRFP)
+	s.clock.Advance(59 * time.Second)
+	s.lookup(c, aliceRFP)
+	c.Assert(s.storage.MethodCount("FetchKeys"), gc.Equals, 1)
+	s.clock.Advance(time.Second)
+	s.lookup(c, aliceRFP)
+	c.Assert(s.storage.MethodCount("FetchKeys"), gc.Equals, 2)
+}
+
+func (s *KeyCacheSuite) TestKeyChanged(c *gc.C) {
+	key := s.lookup(c, aliceRFP)
+	s.lookup(c, aliceRFP[:16])
+	s.lookup(c, badSigsRFP)
+	c.Assert(s.cache.Len(), gc.Equals, 2)
+
+	err := s.cache.KeyChanged(storage.KeyAdded{Digest: "00000000000000000000000000000000"})
+	c.Assert(err, gc.IsNil)
+	c.Assert(s.cache.Len(), gc.Equals, 2)
+
+	err = s.cache.KeyChanged(storage.KeyReplaced{OldDigest: key.MD5, NewDigest: "00000000000000000000000000000000"})
+	c.Assert(err, gc.IsNil)
+	c.Assert(s.cache.Len(), gc.Equals, 1)
+	s.lookup(c, aliceRFP)
+	s.lookup(c, aliceRFP[:16])
+	c.Assert(s.storage.MethodCount("FetchKeys"), gc.Equals, 5)
+}
+
+func (s *KeyCacheSuite) TestChangedWhileFetching(c *gc.C) {
+	s.fetched = func() {
+		s.cache.KeyChanged(storage.KeyAdded{})
+	}
+	s.lookup(c, aliceRFP)
+	c.Assert(s.cache.Len(), gc.Equals, 0)
+}
+
+func (s *KeyCacheSuite) TestMaxBytes(c *gc.C) {
+	alice, badSigs := s.lookup(c, aliceRFP), s.lookup(c, badSigsRFP)
+	maxBytes := alice.SerializedLength()
+	if badSigs.SerializedLength() > maxBytes {
+		maxBytes = badSigs.SerializedLength()
+	}
+	s.cache = s.newCache(c, maxBytes)
+	s.lookup(c, aliceRFP)
+	s.lookup(c, badSigsRFP)
+	c.Assert(s.cache.Len(), gc.Equals, 1)
+	// The least recently used key was evicted.
+	s.lookup(c, badSigsRFP)
+	c.Assert(s.storage.MethodCount("FetchKeys"), gc.Equals, 4)
+	s.lookup(c, aliceRFP)
+	c.Assert(s.storage.MethodCount("FetchKeys"), gc.Equals, 5)
+}
+
+func (s *KeyCacheSuite) TestModTime(c *gc.C) {
+	mtime := time.Date(2019, 6, 1, 0, 0, 0, 0, time.UTC)
+	s.storage = mock.NewStorage(
+		mock.Resolve(s.storage.Resolve),
+		mock.FetchKeys(s.storage.FetchKeys),
+		mock.FetchModTimes(func(rfps []string) (map[string]time.Time, error) {
+			return map[string]time.Time{aliceRFP: mtime}, nil
+		}),
+	)
+	key := s.lookup(c, aliceRFP)
+	t, ok := s.cache.ModTime(key.MD5)
+	c.Assert(ok, gc.Equals, true)
+	c.Assert(t.Equal(mtime), gc.Equals, true)
+
+	// Keys without a recorded modification time, and expired keys, have
+	// none.
+	key = s.lookup(c, badSigsRFP)
+	_, ok = s.cache.ModTime(key.MD5)
+	c.Assert(ok, gc.Equals, false)
+	s.clock.Advance(time.Minute)
+	_, ok = s.cache.ModTime(s.lookup(c, aliceRFP).MD5)
+	c.Assert(ok, gc.Equals, true)
+	s.clock.Advance(time.Minute)
+	_, ok = s.cache.ModTime(key.MD5)
+	c.Assert(ok, gc.Equals, false)
+}
+
+func (s *KeyCacheSuite) TestInvalid(c *gc.C) {
+	_, err := New(DefaultSettings())
+	c.Assert(err, gc.ErrorMatches, "key cache size not set")
+	_, err = New(&Settings{MaxBytes: 1})
+	c.Assert(err, gc.ErrorMatches, "invalid key cache TTL 0")
+}
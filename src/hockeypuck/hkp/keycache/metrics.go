@@ -0,0 +1,46 @@
+package keycache
+
+import (
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var cacheMetrics = struct {
+	requests *prometheus.CounterVec
+	keys     prometheus.Gauge
+	bytes    prometheus.Gauge
+}{
+	requests: prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "hockeypuck",
+			Name:      "key_cache_requests",
+			Help:      "Cacheable key lookups since startup, by whether the key was cached",
+		},
+		[]string{"result"},
+	),
+	keys: prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: "hockeypuck",
+			Name:      "key_cache_keys",
+			Help:      "Keys currently cached",
+		},
+	),
+	bytes: prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: "hockeypuck",
+			Name:      "key_cache_bytes",
+			Help:      "Total length of the keys currently cached",
+		},
+	),
+}
+
+var metricsRegister sync.Once
+
+func registerMetrics() {
+	metricsRegister.Do(func() {
+		prometheus.MustRegister(cacheMetrics.requests)
+		prometheus.MustRegister(cacheMetrics.keys)
+		prometheus.MustRegister(cacheMetrics.bytes)
+	})
+}
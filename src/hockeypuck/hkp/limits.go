@@ -0,0 +1,256 @@
+package hkp
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/crypto/openpgp/packet"
+
+	"hockeypuck/logging"
+	log "hockeypuck/logrus"
+	"hockeypuck/openpgp"
+)
+
+const (
+	DefaultMaxSubmissionLength = 4 * 1024 * 1024
+	DefaultMaxPackets          = 20000
+	DefaultMaxUserIDs          = 200
+	DefaultMaxSubKeys          = 100
+)
+
+// Limits bound the keys accepted by /pks/add, so that a hostile submission
+// cannot exhaust memory while it is parsed. A zero limit is unlimited.
+type Limits struct {
+	// MaxLength limits the length of the key material in a submission,
+	// once armor is removed. The request itself may be twice this long, to
+	// allow for armor and form encoding.
+	MaxLength int `toml:"maxLength"`
+
+	// MaxPackets limits the number of packets in each submitted key.
+	MaxPackets int `toml:"maxPackets"`
+
+	// MaxUserIDs limits the number of user IDs on each submitted key.
+	MaxUserIDs int `toml:"maxUserIDs"`
+
+	// MaxSubKeys limits the number of subkeys on each submitted key.
+	MaxSubKeys int `toml:"maxSubKeys"`
+}
+
+func DefaultLimits() Limits {
+	return Limits{
+		MaxLength:  DefaultMaxSubmissionLength,
+		MaxPackets: DefaultMaxPackets,
+		MaxUserIDs: DefaultMaxUserIDs,
+		MaxSubKeys: DefaultMaxSubKeys,
+	}
+}
+
+// SubmissionLimits sets the limits on keys submitted to /pks/add.
+func SubmissionLimits(limits Limits) HandlerOption {
+	return func(h *Handler) error {
+		h.limits = limits
+		return nil
+	}
+}
+
+// Reasons a submission is rejected, as reported in metrics.
+const (
+	limitLength  = "length"
+	limitPackets = "packets"
+	limitUserIDs = "userids"
+	limitSubKeys = "subkeys"
+	limitSecret  = "secret"
+	limitBudget  = "budget"
+)
+
+const secretKeyMessage = "submission contains secret key material which could not be removed and was rejected; " +
+	"only public keys may be submitted, such as the output of gpg --armor --export"
+
+const secretKeyWarning = "submission contained secret key material, which was discarded and only the public keys stored; " +
+	"anyone who saw the submission may have your secret key, so consider revoking it. " +
+	"Only submit public keys, such as the output of gpg --armor --export"
+
+// limitError is returned when a submission exceeds a limit.
+type limitError struct {
+	status int
+	reason string
+	msg    string
+}
+
+func (e *limitError) Error() string {
+	return e.msg
+}
+
+func newLimitError(status int, reason, format string, args ...interface{}) *limitError {
+	return &limitError{status: status, reason: reason, msg: fmt.Sprintf(format, args...)}
+}
+
+// maxRequestLength returns the length of the longest request body accepted
+// by /pks/add, or zero if it is unlimited.
+func (l *Limits) maxRequestLength() int64 {
+	if l.MaxLength <= 0 {
+		return 0
+	}
+	return 2*int64(l.MaxLength) + 65536
+}
+
+// cappedBody is a request body which fails once more than remaining bytes
+// are read from it.
+type cappedBody struct {
+	io.ReadCloser
+	remaining int64
+	exceeded  bool
+}
+
+func (b *cappedBody) Read(p []byte) (int, error) {
+	if b.remaining <= 0 {
+		// Only fail if there is more to read.
+		var one [1]byte
+		n, err := b.ReadCloser.Read(one[:])
+		if n == 0 && err != nil {
+			return 0, err
+		}
+		b.exceeded = true
+		return 0, errors.New("request too large")
+	}
+	if int64(len(p)) > b.remaining {
+		p = p[:b.remaining]
+	}
+	n, err := b.ReadCloser.Read(p)
+	b.remaining -= int64(n)
+	return n, err
+}
+
+// readSubmission reads the key material from armored submission, checking
+// it against the limits before it is parsed. Secret key packets pasted by
+// mistake are replaced with their public keys; it returns how many were.
+func (l *Limits) readSubmission(r io.Reader) ([]byte, int, error) {
+	if l.MaxLength > 0 {
+		r = io.LimitReader(r, int64(l.MaxLength)+1)
+	}
+	var buf bytes.Buffer
+	_, err := io.Copy(&buf, r)
+	if err != nil {
+		return nil, 0, errors.WithStack(err)
+	}
+	if l.MaxLength > 0 && buf.Len() > l.MaxLength {
+		return nil, 0, newLimitError(http.StatusRequestEntityTooLarge, limitLength,
+			"key material exceeds the limit of %d bytes", l.MaxLength)
+	}
+	data, stripped, err := openpgp.StripSecretKeys(buf.Bytes())
+	if err != nil {
+		return nil, 0, newLimitError(http.StatusUnprocessableEntity, limitSecret, secretKeyMessage)
+	}
+	return data, stripped, l.checkPackets(data)
+}
+
+// checkPackets counts the packets of each key in data. Only packet headers
+// are read, so keys are checked cheaply before any are parsed. Malformed
+// data is left for the key reader to reject.
+func (l *Limits) checkPackets(data []byte) error {
+	var fp string
+	var packets, uids, subkeys int
+	or := packet.NewOpaqueReader(bytes.NewReader(data))
+	for op, err := or.Next(); err == nil; op, err = or.Next() {
+		switch op.Tag {
+		case 6: //packet.PacketTypePublicKey
+			fp, packets, uids, subkeys = "", 0, 0, 0
+			if pubkey, err := openpgp.ParsePrimaryKey(op); err == nil {
+				fp = pubkey.Fingerprint()
+			}
+		case 13: //packet.PacketTypeUserId
+			uids++
+		case 14: //packet.PacketTypePublicSubKey
+			subkeys++
+		}
+		packets++
+
+		switch {
+		case l.MaxPackets > 0 && packets > l.MaxPackets:
+			return newLimitError(http.StatusUnprocessableEntity, limitPackets,
+				"key %s has more than %d packets", fp, l.MaxPackets)
+		case l.MaxUserIDs > 0 && uids > l.MaxUserIDs:
+			return newLimitError(http.StatusUnprocessableEntity, limitUserIDs,
+				"key %s has more than %d user IDs", fp, l.MaxUserIDs)
+		case l.MaxSubKeys > 0 && subkeys > l.MaxSubKeys:
+			return newLimitError(http.StatusUnprocessableEntity, limitSubKeys,
+				"key %s has more than %d subkeys", fp, l.MaxSubKeys)
+		}
+	}
+	return nil
+}
+
+// rejectSubmission responds to a submission which exceeds a limit.
+func rejectSubmission(w http.ResponseWriter, r *http.Request, err *limitError) {
+	limitMetrics.rejected.WithLabelValues(err.reason).Inc()
+	logger.WithFields(logging.RequestFields(r)).WithFields(log.Fields{
+		"reason": err.reason,
+		"detail": err.msg,
+	}).Warning("add rejected")
+	http.Error(w, err.msg, err.status)
+}
+
+// Reasons a lookup is refused, as reported in the X-HKP-Refused header and
+// in metrics.
+const refusedShortKeyID = "short-keyid"
+
+const shortKeyIDMessage = "lookups by 32-bit key ID are refused because such IDs are trivially spoofed; " +
+	"search by 64-bit key ID or fingerprint instead, such as 0x followed by 16 or 40 hex digits"
+
+// refuseLookup responds to a lookup which the server does not serve by
+// policy, naming the reason in the X-HKP-Refused header for clients and
+// explaining it in the body for people.
+func refuseLookup(w http.ResponseWriter, r *http.Request, reason, msg string) {
+	limitMetrics.refused.WithLabelValues(reason).Inc()
+	logger.WithFields(logging.RequestFields(r)).WithFields(log.Fields{
+		"reason": reason,
+		"detail": msg,
+	}).Info("lookup refused")
+	w.Header().Set("X-HKP-Refused", reason)
+	http.Error(w, msg, http.StatusBadRequest)
+}
+
+var limitMetrics = struct {
+	rejected *prometheus.CounterVec
+	refused  *prometheus.CounterVec
+	stripped prometheus.Counter
+}{
+	rejected: prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "hockeypuck",
+			Name:      "submissions_rejected",
+			Help:      "Key submissions rejected for exceeding a limit or containing secret keys which could not be removed since startup",
+		},
+		[]string{"reason"},
+	),
+	refused: prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "hockeypuck",
+			Name:      "lookups_refused",
+			Help:      "Lookups refused by policy since startup, such as by short key ID",
+		},
+		[]string{"reason"},
+	),
+	stripped: prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: "hockeypuck",
+			Name:      "submissions_secret_stripped",
+			Help:      "Key submissions from which secret key material was discarded since startup",
+		},
+	),
+}
+
+var metricsRegister sync.Once
+
+func registerMetrics() {
+	metricsRegister.Do(func() {
+		prometheus.MustRegister(limitMetrics.rejected)
+		prometheus.MustRegister(limitMetrics.refused)
+		prometheus.MustRegister(limitMetrics.stripped)
+	})
+}
@@ -0,0 +1,186 @@
+// Package links serves stable links to keys and other operator-configured
+// redirects, so that an organization may publish links to its signing keys
+// on its keyserver which do not depend on the HKP lookup syntax:
+//
+//	/key/<fingerprint>  redirects to the lookup of the key
+//	/key/<nickname>     redirects to the lookup of the key configured for
+//	                    the nickname
+//	/<path>             redirects to the URL configured for the path
+//
+// Key redirects carry a Link header giving the canonical URL of the key,
+// /key/<fingerprint>, which does not change if the nickname is reassigned.
+package links
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/pkg/errors"
+)
+
+// KeyPath is the path under which keys are linked.
+const KeyPath = "/key/"
+
+type Settings struct {
+	// BaseURL is prefixed to canonical key URLs, such as
+	// "https://keys.example.com". If empty, they are given as paths on the
+	// server which serves them.
+	BaseURL string `toml:"baseURL"`
+
+	// Keys maps nicknames, such as "release", to the fingerprints of the
+	// keys they link to.
+	Keys map[string]string `toml:"keys"`
+
+	// Redirects maps single-segment paths on the server, such as
+	// "/signing-key", to the URLs or paths to which they redirect.
+	Redirects map[string]string `toml:"redirects"`
+}
+
+func DefaultSettings() *Settings {
+	return &Settings{}
+}
+
+// Enabled returns whether links are configured. Links to keys by
+// fingerprint are served once any setting is given.
+func (s *Settings) Enabled() bool {
+	return s != nil && (s.BaseURL != "" || len(s.Keys) > 0 || len(s.Redirects) > 0)
+}
+
+// Validate returns an error if a nickname, fingerprint or redirect is
+// invalid.
+func (s *Settings) Validate() error {
+	_, err := NewHandler(s, nil)
+	return err
+}
+
+// Handler serves key links and redirects.
+type Handler struct {
+	baseURL   string
+	keys      map[string]string
+	redirects map[string]string
+}
+
+// NewHandler returns a handler serving the configured links. If routes is
+// given, links may not take the path of a route already registered there.
+func NewHandler(settings *Settings, routes *httprouter.Router) (*Handler, error) {
+	h := &Handler{
+		keys:      map[string]string{},
+		redirects: map[string]string{},
+	}
+	if settings == nil {
+		return h, nil
+	}
+	if settings.BaseURL != "" {
+		u, err := url.Parse(settings.BaseURL)
+		if err != nil || u.Scheme == "" || u.Host == "" {
+			return nil, errors.Errorf("invalid links base URL %q", settings.BaseURL)
+		}
+		h.baseURL = strings.TrimSuffix(settings.BaseURL, "/")
+	}
+	for nickname, fp := range settings.Keys {
+		name := strings.ToLower(nickname)
+		if name == "" || strings.ContainsAny(name, "/?# ") {
+			return nil, errors.Errorf("invalid key nickname %q", nickname)
+		}
+		if Fingerprint(name) != "" {
+			return nil, errors.Errorf("key nickname %q is a fingerprint", nickname)
+		}
+		if _, ok := h.keys[name]; ok {
+			return nil, errors.Errorf("duplicate key nickname %q", nickname)
+		}
+		h.keys[name] = Fingerprint(fp)
+		if h.keys[name] == "" {
+			return nil, errors.Errorf("invalid fingerprint %q for key nickname %q", fp, nickname)
+		}
+	}
+	for path, target := range settings.Redirects {
+		if !strings.HasPrefix(path, "/") || len(path) < 2 || strings.ContainsAny(path[1:], "/:*?# ") {
+			return nil, errors.Errorf("invalid redirect path %q", path)
+		}
+		if path+"/" == KeyPath {
+			return nil, errors.Errorf("redirect path %q is reserved for keys", path)
+		}
+		if _, err := url.Parse(target); err != nil || target == "" {
+			return nil, errors.Errorf("invalid redirect target %q for path %q", target, path)
+		}
+		h.redirects[path] = target
+	}
+	if routes != nil {
+		if handle, _, _ := routes.Lookup("GET", KeyPath+"name"); handle != nil {
+			return nil, errors.Errorf("key path %q conflicts with a registered route", KeyPath)
+		}
+		for path := range h.redirects {
+			if handle, _, _ := routes.Lookup("GET", path); handle != nil {
+				return nil, errors.Errorf("redirect path %q conflicts with a registered route", path)
+			}
+		}
+	}
+	return h, nil
+}
+
+// Fingerprint returns s as an upper case hex key fingerprint, or "" if it
+// is not one. A leading "0x" and spaces, as fingerprints are often written,
+// are ignored.
+func Fingerprint(s string) string {
+	s = strings.ReplaceAll(s, " ", "")
+	if strings.HasPrefix(s, "0x") || strings.HasPrefix(s, "0X") {
+		s = s[2:]
+	}
+	if len(s) != 40 && len(s) != 64 {
+		return ""
+	}
+	if _, err := hex.DecodeString(s); err != nil {
+		return ""
+	}
+	return strings.ToUpper(s)
+}
+
+// KeyURL returns the canonical URL of the key with the given fingerprint.
+func (h *Handler) KeyURL(fp string) string {
+	return h.baseURL + KeyPath + Fingerprint(fp)
+}
+
+// Serves returns whether the handler serves a path, or paths under it,
+// which would conflict with a route for path.
+func (h *Handler) Serves(path string) bool {
+	path = "/" + strings.SplitN(strings.TrimPrefix(path, "/"), "/", 2)[0]
+	if path+"/" == KeyPath {
+		return true
+	}
+	_, ok := h.redirects[path]
+	return ok
+}
+
+func (h *Handler) Register(r *httprouter.Router) {
+	r.GET(KeyPath+":name", h.serveKey)
+	r.HEAD(KeyPath+":name", h.serveKey)
+	for path, target := range h.redirects {
+		serve := h.redirect(target)
+		r.GET(path, serve)
+		r.HEAD(path, serve)
+	}
+}
+
+func (h *Handler) serveKey(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	name := ps.ByName("name")
+	fp, ok := h.keys[strings.ToLower(name)]
+	if !ok {
+		fp = Fingerprint(name)
+	}
+	if fp == "" {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Link", fmt.Sprintf("<%s>; rel=\"canonical\"", h.KeyURL(fp)))
+	http.Redirect(w, r, "/pks/lookup?op=get&options=mr&search=0x"+fp, http.StatusFound)
+}
+
+func (h *Handler) redirect(target string) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		http.Redirect(w, r, target, http.StatusFound)
+	}
+}
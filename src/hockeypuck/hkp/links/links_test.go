@@ -0,0 +1,119 @@
+package links
+
+import (
+	"net/http"
+	"net/http/httptest"
+	stdtesting "testing"
+
+	"github.com/julienschmidt/httprouter"
+	gc "gopkg.in/check.v1"
+)
+
+func Test(t *stdtesting.T) { gc.TestingT(t) }
+
+type LinksSuite struct {
+	r *httprouter.Router
+}
+
+var _ = gc.Suite(&LinksSuite{})
+
+const testFingerprint = "ACCD0E320F1CB163A2AA9305257F384B1FC8EF01"
+
+func (s *LinksSuite) SetUpTest(c *gc.C) {
+	h, err := NewHandler(&Settings{
+		BaseURL: "https://keys.example.com/",
+		Keys: map[string]string{
+			"Release": "0xaccd 0e32 0f1c b163 a2aa  9305 257f 384b 1fc8 ef01",
+		},
+		Redirects: map[string]string{
+			"/signing-key": "/key/release",
+		},
+	}, nil)
+	c.Assert(err, gc.IsNil)
+	s.r = httprouter.New()
+	h.Register(s.r)
+}
+
+func (s *LinksSuite) get(path string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	s.r.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+	return rec
+}
+
+func (s *LinksSuite) TestKeyLinks(c *gc.C) {
+	for _, path := range []string{
+		"/key/release",
+		"/key/RELEASE",
+		"/key/" + testFingerprint,
+		"/key/0xaccd0e320f1cb163a2aa9305257f384b1fc8ef01",
+	} {
+		rec := s.get(path)
+		c.Assert(rec.Code, gc.Equals, http.StatusFound, gc.Commentf("%s", path))
+		c.Assert(rec.Header().Get("Location"), gc.Equals, "/pks/lookup?op=get&options=mr&search=0x"+testFingerprint)
+		c.Assert(rec.Header().Get("Link"), gc.Equals, `<https://keys.example.com/key/`+testFingerprint+`>; rel="canonical"`)
+	}
+
+	rec := s.get("/key/unknown")
+	c.Assert(rec.Code, gc.Equals, http.StatusNotFound)
+	rec = s.get("/key/257F384B1FC8EF01")
+	c.Assert(rec.Code, gc.Equals, http.StatusNotFound)
+}
+
+func (s *LinksSuite) TestRedirects(c *gc.C) {
+	rec := s.get("/signing-key")
+	c.Assert(rec.Code, gc.Equals, http.StatusFound)
+	c.Assert(rec.Header().Get("Location"), gc.Equals, "/key/release")
+}
+
+func (s *LinksSuite) TestServes(c *gc.C) {
+	h, err := NewHandler(&Settings{Redirects: map[string]string{"/docs": "https://example.com/"}}, nil)
+	c.Assert(err, gc.IsNil)
+	c.Assert(h.Serves("/key"), gc.Equals, true)
+	c.Assert(h.Serves("/docs"), gc.Equals, true)
+	c.Assert(h.Serves("/docs/index.html"), gc.Equals, true)
+	c.Assert(h.Serves("/index.html"), gc.Equals, false)
+	c.Assert(h.KeyURL("0x"+testFingerprint), gc.Equals, "/key/"+testFingerprint)
+}
+
+func (s *LinksSuite) TestValidate(c *gc.C) {
+	for _, test := range []struct {
+		settings Settings
+		err      string
+	}{{
+		Settings{BaseURL: "keys.example.com"},
+		`invalid links base URL "keys.example.com"`,
+	}, {
+		Settings{Keys: map[string]string{"release": "257F384B1FC8EF01"}},
+		`invalid fingerprint "257F384B1FC8EF01" for key nickname "release"`,
+	}, {
+		Settings{Keys: map[string]string{testFingerprint: testFingerprint}},
+		`key nickname ".*" is a fingerprint`,
+	}, {
+		Settings{Keys: map[string]string{"a/b": testFingerprint}},
+		`invalid key nickname "a/b"`,
+	}, {
+		Settings{Redirects: map[string]string{"/a/b": "/"}},
+		`invalid redirect path "/a/b"`,
+	}, {
+		Settings{Redirects: map[string]string{"/key": "/"}},
+		`redirect path "/key" is reserved for keys`,
+	}, {
+		Settings{Redirects: map[string]string{"/a": ""}},
+		`invalid redirect target "" for path "/a"`,
+	}} {
+		c.Assert(test.settings.Validate(), gc.ErrorMatches, test.err)
+	}
+
+	routes := httprouter.New()
+	routes.GET("/stats", func(http.ResponseWriter, *http.Request, httprouter.Params) {})
+	_, err := NewHandler(&Settings{Redirects: map[string]string{"/stats": "/pks/lookup?op=stats"}}, routes)
+	c.Assert(err, gc.ErrorMatches, `redirect path "/stats" conflicts with a registered route`)
+	_, err = NewHandler(&Settings{Redirects: map[string]string{"/docs": "/"}}, routes)
+	c.Assert(err, gc.IsNil)
+	routes.GET("/key/*rest", func(http.ResponseWriter, *http.Request, httprouter.Params) {})
+	_, err = NewHandler(&Settings{Redirects: map[string]string{"/docs": "/"}}, routes)
+	c.Assert(err, gc.ErrorMatches, `key path "/key/" conflicts with a registered route`)
+
+	c.Assert((&Settings{}).Enabled(), gc.Equals, false)
+	c.Assert((&Settings{Keys: map[string]string{"release": testFingerprint}}).Enabled(), gc.Equals, true)
+}
@@ -0,0 +1,277 @@
+// Package loadtest makes HKP requests against a keyserver and reports their
+// latency, so that operators can find how much traffic a server can take
+// before joining the public mesh.
+//
+// Requests are generated from a mix of lookups, adds and hashqueries of
+// synthetic keys, or replayed from a recorded access log. Each worker makes
+// one request at a time; the overall rate may be limited to measure latency
+// at a given load rather than the maximum throughput.
+package loadtest
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Runner makes requests against a target server.
+type Runner struct {
+	// Target is the base URL of the server, such as
+	// "http://localhost:11371".
+	Target string
+
+	// Client makes the requests. Defaults to http.DefaultClient.
+	Client *http.Client
+
+	// Workers is the number of concurrent requests. Defaults to 1.
+	Workers int
+
+	// Rate, if set, limits the requests made per second by all workers.
+	Rate float64
+
+	// Duration, if set, is how long to make requests for.
+	Duration time.Duration
+
+	// Requests, if set, is the number of requests to make.
+	Requests int
+
+	// Seed seeds the choice of requests made by each worker.
+	Seed int64
+}
+
+// Run makes requests from w until the context is done, or the runner's
+// duration or number of requests is reached.
+func (r *Runner) Run(ctx context.Context, w Workload) (*Report, error) {
+	if r.Duration <= 0 && r.Requests <= 0 {
+		return nil, errors.New("a duration or number of requests is required")
+	}
+	if r.Duration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, r.Duration)
+		defer cancel()
+	}
+	workers := r.Workers
+	if workers <= 0 {
+		workers = 1
+	}
+
+	var limit <-chan time.Time
+	if r.Rate > 0 {
+		ticker := time.NewTicker(time.Duration(float64(time.Second) / r.Rate))
+		defer ticker.Stop()
+		limit = ticker.C
+	}
+
+	var mu sync.Mutex
+	remaining := r.Requests
+	next := func() bool {
+		if limit != nil {
+			select {
+			case <-limit:
+			case <-ctx.Done():
+				return false
+			}
+		}
+		if ctx.Err() != nil {
+			return false
+		}
+		if r.Requests <= 0 {
+			return true
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if remaining == 0 {
+			return false
+		}
+		remaining--
+		return true
+	}
+
+	report := newReport()
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(rnd *rand.Rand) {
+			defer wg.Done()
+			for next() {
+				req := w.Next(rnd)
+				report.record(req.Op, r.do(ctx, req))
+			}
+		}(rand.New(rand.NewSource(r.Seed + int64(i))))
+	}
+	wg.Wait()
+	report.Elapsed = time.Since(start)
+	return report, nil
+}
+
+// Do makes each of reqs in turn, such as to preload keys before measuring.
+// It fails on the first request which does not succeed.
+func (r *Runner) Do(ctx context.Context, reqs []*Request) error {
+	for _, req := range reqs {
+		res := r.do(ctx, req)
+		if res.err != nil {
+			return errors.WithStack(res.err)
+		}
+		if res.status != http.StatusOK {
+			return errors.Errorf("%s %s: HTTP status %d", req.Method, req.Path, res.status)
+		}
+	}
+	return nil
+}
+
+type result struct {
+	status  int
+	latency time.Duration
+	err     error
+}
+
+func (r *Runner) do(ctx context.Context, req *Request) result {
+	var body io.Reader
+	if req.Body != nil {
+		body = bytes.NewReader(req.Body)
+	}
+	httpReq, err := http.NewRequest(req.Method, strings.TrimSuffix(r.Target, "/")+req.Path, body)
+	if err != nil {
+		return result{err: errors.WithStack(err)}
+	}
+	httpReq = httpReq.WithContext(ctx)
+	if req.ContentType != "" {
+		httpReq.Header.Set("Content-Type", req.ContentType)
+	}
+	client := r.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	start := time.Now()
+	resp, err := client.Do(httpReq)
+	if err != nil {
+		if ctx.Err() != nil {
+			// Requests cut short at the end of the run are not errors.
+			return result{}
+		}
+		return result{err: errors.WithStack(err)}
+	}
+	_, err = io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	latency := time.Since(start)
+	if err != nil && ctx.Err() == nil {
+		return result{err: errors.WithStack(err)}
+	}
+	return result{status: resp.StatusCode, latency: latency}
+}
+
+// Report summarizes the requests made by a run.
+type Report struct {
+	Elapsed time.Duration
+	Ops     map[string]*OpStats
+
+	mu sync.Mutex
+}
+
+// OpStats summarizes the requests made for one operation. Requests which
+// got an HTTP response, whatever its status, are timed; others are counted
+// as errors.
+type OpStats struct {
+	Requests  int
+	Errors    int
+	Statuses  map[int]int
+	latencies []time.Duration
+	sorted    bool
+}
+
+func newReport() *Report {
+	return &Report{Ops: map[string]*OpStats{}}
+}
+
+func (rp *Report) record(op string, res result) {
+	if res.err == nil && res.status == 0 {
+		return
+	}
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+	st, ok := rp.Ops[op]
+	if !ok {
+		st = &OpStats{Statuses: map[int]int{}}
+		rp.Ops[op] = st
+	}
+	st.Requests++
+	if res.err != nil {
+		st.Errors++
+		return
+	}
+	st.Statuses[res.status]++
+	st.latencies = append(st.latencies, res.latency)
+	st.sorted = false
+}
+
+// Percentile returns the latency below which p percent of timed requests
+// completed.
+func (st *OpStats) Percentile(p float64) time.Duration {
+	if len(st.latencies) == 0 {
+		return 0
+	}
+	if !st.sorted {
+		sort.Slice(st.latencies, func(i, j int) bool { return st.latencies[i] < st.latencies[j] })
+		st.sorted = true
+	}
+	i := int(p / 100 * float64(len(st.latencies)))
+	if i >= len(st.latencies) {
+		i = len(st.latencies) - 1
+	}
+	return st.latencies[i]
+}
+
+// WriteTo writes the report as a table, with a row per operation and a
+// total.
+func (rp *Report) WriteTo(w io.Writer) (int64, error) {
+	var buf bytes.Buffer
+	tw := tabwriter.NewWriter(&buf, 0, 8, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "op\trequests\terrors\treq/s\tp50\tp90\tp99\tmax\tstatuses\t")
+	total := &OpStats{Statuses: map[int]int{}}
+	var ops []string
+	for op, st := range rp.Ops {
+		ops = append(ops, op)
+		total.Requests += st.Requests
+		total.Errors += st.Errors
+		for status, n := range st.Statuses {
+			total.Statuses[status] += n
+		}
+		total.latencies = append(total.latencies, st.latencies...)
+	}
+	sort.Strings(ops)
+	for _, op := range ops {
+		rp.writeRow(tw, op, rp.Ops[op])
+	}
+	rp.writeRow(tw, "total", total)
+	tw.Flush()
+	return buf.WriteTo(w)
+}
+
+func (rp *Report) writeRow(w io.Writer, op string, st *OpStats) {
+	var rate float64
+	if secs := rp.Elapsed.Seconds(); secs > 0 {
+		rate = float64(st.Requests) / secs
+	}
+	var statuses []string
+	for status, n := range st.Statuses {
+		statuses = append(statuses, fmt.Sprintf("%d:%d", status, n))
+	}
+	sort.Strings(statuses)
+	round := func(d time.Duration) time.Duration { return d.Round(10 * time.Microsecond) }
+	fmt.Fprintf(w, "%s\t%d\t%d\t%.1f\t%v\t%v\t%v\t%v\t%s\t\n", op, st.Requests, st.Errors, rate,
+		round(st.Percentile(50)), round(st.Percentile(90)), round(st.Percentile(99)), round(st.Percentile(100)),
+		strings.Join(statuses, " "))
+}
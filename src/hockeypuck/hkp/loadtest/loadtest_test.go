@@ -0,0 +1,150 @@
+package loadtest
+
+import (
+	"bytes"
+	"context"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	stdtesting "testing"
+	"time"
+
+	gc "gopkg.in/check.v1"
+
+	"hockeypuck/hkp"
+)
+
+func Test(t *stdtesting.T) { gc.TestingT(t) }
+
+type LoadTestSuite struct{}
+
+var _ = gc.Suite(&LoadTestSuite{})
+
+func (s *LoadTestSuite) TestParseMix(c *gc.C) {
+	mix, err := ParseMix(DefaultMix)
+	c.Assert(err, gc.IsNil)
+	c.Assert(mix, gc.DeepEquals, Mix{OpGet: 70, OpIndex: 20, OpAdd: 5, OpHashQuery: 5})
+
+	mix, err = ParseMix(" get=1, get=2,add=0 ")
+	c.Assert(err, gc.IsNil)
+	c.Assert(mix, gc.DeepEquals, Mix{OpGet: 3, OpAdd: 0})
+
+	for _, t := range []struct {
+		mix, err string
+	}{
+		{"get", `invalid mix "get", expected op=weight`},
+		{"vindex=1", `unknown op "vindex" in mix`},
+		{"get=-1", `invalid weight "-1" for op "get"`},
+		{"add=0", `empty mix "add=0"`},
+	} {
+		_, err := ParseMix(t.mix)
+		c.Check(err, gc.ErrorMatches, t.err)
+	}
+}
+
+func (s *LoadTestSuite) TestGenerated(c *gc.C) {
+	w, err := NewGenerated(Mix{OpGet: 1, OpIndex: 1, OpAdd: 1, OpHashQuery: 1}, 3, 1)
+	c.Assert(err, gc.IsNil)
+	c.Assert(w.Preload(), gc.HasLen, 3)
+
+	again, err := NewGenerated(Mix{OpGet: 1, OpIndex: 1, OpAdd: 1, OpHashQuery: 1}, 3, 1)
+	c.Assert(err, gc.IsNil)
+	rnd1, rnd2 := rand.New(rand.NewSource(1)), rand.New(rand.NewSource(1))
+	ops := map[string]bool{}
+	for i := 0; i < 100; i++ {
+		req := w.Next(rnd1)
+		c.Assert(again.Next(rnd2), gc.DeepEquals, req)
+		ops[req.Op] = true
+
+		if req.Op == OpHashQuery {
+			httpReq := httptest.NewRequest(req.Method, req.Path, bytes.NewReader(req.Body))
+			hq, err := hkp.ParseHashQuery(httpReq)
+			c.Assert(err, gc.IsNil)
+			c.Assert(hq.Digests, gc.HasLen, 3)
+		}
+	}
+	c.Assert(ops, gc.HasLen, 4)
+}
+
+func (s *LoadTestSuite) TestReadAccessLog(c *gc.C) {
+	w, skipped, err := ReadAccessLog(strings.NewReader(`
+127.0.0.1 - - [10/Oct/2000:13:55:36 -0700] "GET /pks/lookup?op=get&search=0x1234 HTTP/1.1" 200 2326
+127.0.0.1 - - [10/Oct/2000:13:55:37 -0700] "POST /pks/add HTTP/1.1" 200 12
+127.0.0.1 - - [10/Oct/2000:13:55:38 -0700] "GET /stats HTTP/1.1" 200 800 "-" "curl/7.68.0"
+127.0.0.1 - - [10/Oct/2000:13:55:39 -0700] "GET /pks/hashquery HTTP/1.1" 405 0 "-" "curl/7.68.0"
+`))
+	c.Assert(err, gc.IsNil)
+	c.Assert(skipped, gc.Equals, 2)
+	c.Assert(w.Len(), gc.Equals, 2)
+	c.Assert(w.requests[0], gc.DeepEquals, &Request{Op: OpGet, Method: "GET", Path: "/pks/lookup?op=get&search=0x1234"})
+	c.Assert(w.requests[1].Op, gc.Equals, OpReplay)
+
+	_, _, err = ReadAccessLog(strings.NewReader("garbage\n"))
+	c.Assert(err, gc.ErrorMatches, "no replayable requests in access log")
+}
+
+func (s *LoadTestSuite) TestRun(c *gc.C) {
+	var mu sync.Mutex
+	var paths []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		paths = append(paths, r.URL.Path)
+		mu.Unlock()
+		if r.URL.Path == "/pks/hashquery" {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	w, err := NewGenerated(Mix{OpGet: 1, OpHashQuery: 1}, 5, 1)
+	c.Assert(err, gc.IsNil)
+	r := &Runner{Target: srv.URL, Workers: 4, Requests: 50}
+	report, err := r.Run(context.Background(), w)
+	c.Assert(err, gc.IsNil)
+	c.Assert(paths, gc.HasLen, 50)
+	get, hq := report.Ops[OpGet], report.Ops[OpHashQuery]
+	c.Assert(get.Requests+hq.Requests, gc.Equals, 50)
+	c.Assert(get.Statuses, gc.DeepEquals, map[int]int{http.StatusOK: get.Requests})
+	c.Assert(hq.Statuses, gc.DeepEquals, map[int]int{http.StatusNotFound: hq.Requests})
+
+	var out bytes.Buffer
+	_, err = report.WriteTo(&out)
+	c.Assert(err, gc.IsNil)
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	c.Assert(lines, gc.HasLen, 4)
+	c.Assert(strings.Fields(lines[3])[:3], gc.DeepEquals, []string{"total", "50", "0"})
+
+	err = r.Do(context.Background(), w.Preload())
+	c.Assert(err, gc.IsNil)
+	err = r.Do(context.Background(), []*Request{{Method: "POST", Path: "/pks/hashquery"}})
+	c.Assert(err, gc.ErrorMatches, "POST /pks/hashquery: HTTP status 404")
+}
+
+func (s *LoadTestSuite) TestRunDuration(c *gc.C) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+	w, err := NewGenerated(Mix{OpGet: 1}, 1, 1)
+	c.Assert(err, gc.IsNil)
+	r := &Runner{Target: srv.URL, Workers: 2, Rate: 100, Duration: 200 * time.Millisecond}
+	report, err := r.Run(context.Background(), w)
+	c.Assert(err, gc.IsNil)
+	// At most one request per tick of the rate limit.
+	c.Assert(report.Ops[OpGet].Requests <= 21, gc.Equals, true)
+	c.Assert(report.Ops[OpGet].Errors, gc.Equals, 0)
+
+	_, err = (&Runner{Target: srv.URL}).Run(context.Background(), w)
+	c.Assert(err, gc.ErrorMatches, "a duration or number of requests is required")
+}
+
+func (s *LoadTestSuite) TestPercentile(c *gc.C) {
+	st := &OpStats{}
+	c.Assert(st.Percentile(50), gc.Equals, time.Duration(0))
+	for i := 100; i > 0; i-- {
+		st.latencies = append(st.latencies, time.Duration(i)*time.Millisecond)
+	}
+	c.Assert(st.Percentile(50), gc.Equals, 51*time.Millisecond)
+	c.Assert(st.Percentile(99), gc.Equals, 100*time.Millisecond)
+	c.Assert(st.Percentile(100), gc.Equals, 100*time.Millisecond)
+}
@@ -0,0 +1,289 @@
+package loadtest
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"io"
+	"math/rand"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"hockeypuck/conflux/recon"
+	"hockeypuck/testing/keygen"
+)
+
+// Operations in a workload.
+const (
+	OpGet       = "get"
+	OpIndex     = "index"
+	OpAdd       = "add"
+	OpHashQuery = "hashquery"
+
+	// OpReplay is a request replayed from an access log without an op
+	// parameter. Replayed lookups are reported by their op.
+	OpReplay = "replay"
+)
+
+// DefaultMix is a read-heavy mix, like the traffic of a public keyserver.
+const DefaultMix = "get=70,index=20,add=5,hashquery=5"
+
+// hashQuerySize is the number of digests requested per hashquery.
+const hashQuerySize = 10
+
+// Request is an HTTP request to make against the target server.
+type Request struct {
+	Op          string
+	Method      string
+	Path        string
+	ContentType string
+	Body        []byte
+}
+
+// Workload chooses the requests to make. Workloads must be safe to call
+// concurrently, given a source of randomness per caller.
+type Workload interface {
+	Next(rnd *rand.Rand) *Request
+}
+
+// Mix is the relative weight of each operation.
+type Mix map[string]int
+
+// ParseMix parses a comma-separated list of op=weight pairs, such as
+// DefaultMix.
+func ParseMix(s string) (Mix, error) {
+	mix := Mix{}
+	for _, field := range strings.Split(s, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		parts := strings.SplitN(field, "=", 2)
+		if len(parts) != 2 {
+			return nil, errors.Errorf("invalid mix %q, expected op=weight", field)
+		}
+		op := strings.TrimSpace(parts[0])
+		switch op {
+		case OpGet, OpIndex, OpAdd, OpHashQuery:
+		default:
+			return nil, errors.Errorf("unknown op %q in mix", op)
+		}
+		weight, err := strconv.Atoi(strings.TrimSpace(parts[1]))
+		if err != nil || weight < 0 {
+			return nil, errors.Errorf("invalid weight %q for op %q", parts[1], op)
+		}
+		mix[op] += weight
+	}
+	var total int
+	for _, weight := range mix {
+		total += weight
+	}
+	if total == 0 {
+		return nil, errors.Errorf("empty mix %q", s)
+	}
+	return mix, nil
+}
+
+// poolKey is a generated key requested by a Generated workload.
+type poolKey struct {
+	fingerprint string
+	email       string
+	digest      []byte
+	keytext     string
+}
+
+// Generated is a workload of requests for a pool of generated keys. Lookups
+// find the keys once they have been added.
+type Generated struct {
+	ops     []string
+	weights []int
+	total   int
+	keys    []poolKey
+}
+
+// NewGenerated returns a workload with the given mix of requests for n keys
+// generated from seed.
+func NewGenerated(mix Mix, n int, seed int64) (*Generated, error) {
+	if n <= 0 {
+		return nil, errors.Errorf("invalid key pool size %d", n)
+	}
+	g, err := keygen.New(seed, nil)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	w := &Generated{}
+	for i := 0; i < n; i++ {
+		key, err := g.Key(i)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		keytext, err := g.Armored(i)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		digest, err := hex.DecodeString(key.MD5)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		w.keys = append(w.keys, poolKey{
+			fingerprint: key.Fingerprint(),
+			email:       keygen.Email(i, 0),
+			digest:      digest,
+			keytext:     keytext,
+		})
+	}
+	// Sort the ops so that the same seed chooses the same requests.
+	for op := range mix {
+		w.ops = append(w.ops, op)
+	}
+	sort.Strings(w.ops)
+	for _, op := range w.ops {
+		w.weights = append(w.weights, mix[op])
+		w.total += mix[op]
+	}
+	return w, nil
+}
+
+// Next implements Workload.
+func (w *Generated) Next(rnd *rand.Rand) *Request {
+	n := rnd.Intn(w.total)
+	op := w.ops[len(w.ops)-1]
+	for i, weight := range w.weights {
+		if n < weight {
+			op = w.ops[i]
+			break
+		}
+		n -= weight
+	}
+	key := &w.keys[rnd.Intn(len(w.keys))]
+	switch op {
+	case OpGet:
+		return lookup(OpGet, "0x"+key.fingerprint)
+	case OpIndex:
+		return lookup(OpIndex, key.email)
+	case OpAdd:
+		return addRequest(key)
+	default:
+		var body bytes.Buffer
+		count := hashQuerySize
+		if count > len(w.keys) {
+			count = len(w.keys)
+		}
+		recon.WriteInt(&body, count)
+		for i := 0; i < count; i++ {
+			digest := w.keys[rnd.Intn(len(w.keys))].digest
+			recon.WriteInt(&body, len(digest))
+			body.Write(digest)
+		}
+		return &Request{
+			Op:          OpHashQuery,
+			Method:      "POST",
+			Path:        "/pks/hashquery",
+			ContentType: "sks/hashquery",
+			Body:        body.Bytes(),
+		}
+	}
+}
+
+// Preload returns requests adding every key in the pool.
+func (w *Generated) Preload() []*Request {
+	var result []*Request
+	for i := range w.keys {
+		result = append(result, addRequest(&w.keys[i]))
+	}
+	return result
+}
+
+func addRequest(key *poolKey) *Request {
+	return &Request{
+		Op:          OpAdd,
+		Method:      "POST",
+		Path:        "/pks/add",
+		ContentType: "application/x-www-form-urlencoded",
+		Body:        []byte(url.Values{"keytext": []string{key.keytext}}.Encode()),
+	}
+}
+
+func lookup(op, search string) *Request {
+	return &Request{
+		Op:     op,
+		Method: "GET",
+		Path:   "/pks/lookup?" + url.Values{"op": []string{op}, "options": []string{"mr"}, "search": []string{search}}.Encode(),
+	}
+}
+
+// Replay is a workload of requests recorded in an access log, chosen at
+// random.
+type Replay struct {
+	requests []*Request
+}
+
+// ReadAccessLog reads the requests from an access log in Common or Combined
+// Log Format which can be replayed. Only GET requests under /pks/ are
+// replayed, since the bodies of other requests are not logged. It returns
+// the number of lines skipped.
+func ReadAccessLog(r io.Reader) (*Replay, int, error) {
+	var result Replay
+	var skipped int
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1024*1024)
+	for scanner.Scan() {
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+		req, ok := parseLogLine(scanner.Text())
+		if !ok {
+			skipped++
+			continue
+		}
+		result.requests = append(result.requests, req)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, skipped, errors.WithStack(err)
+	}
+	if len(result.requests) == 0 {
+		return nil, skipped, errors.New("no replayable requests in access log")
+	}
+	return &result, skipped, nil
+}
+
+// parseLogLine returns the request in a line such as
+//
+//	127.0.0.1 - - [10/Oct/2000:13:55:36 -0700] "GET /pks/lookup?op=get&search=0x1234 HTTP/1.1" 200 2326
+func parseLogLine(line string) (*Request, bool) {
+	start := strings.Index(line, `"`)
+	if start < 0 {
+		return nil, false
+	}
+	end := strings.Index(line[start+1:], `"`)
+	if end < 0 {
+		return nil, false
+	}
+	fields := strings.Fields(line[start+1 : start+1+end])
+	if len(fields) < 2 || fields[0] != "GET" || !strings.HasPrefix(fields[1], "/pks/") {
+		return nil, false
+	}
+	u, err := url.Parse(fields[1])
+	if err != nil {
+		return nil, false
+	}
+	op := u.Query().Get("op")
+	if op == "" {
+		op = OpReplay
+	}
+	return &Request{Op: op, Method: "GET", Path: fields[1]}, true
+}
+
+// Len returns the number of requests which may be replayed.
+func (w *Replay) Len() int {
+	return len(w.requests)
+}
+
+// Next implements Workload.
+func (w *Replay) Next(rnd *rand.Rand) *Request {
+	return w.requests[rnd.Intn(len(w.requests))]
+}
@@ -0,0 +1,144 @@
+package hkp
+
+import (
+	"bytes"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/pkg/errors"
+
+	"hockeypuck/hkp/storage"
+	"hockeypuck/logging"
+	log "hockeypuck/logrus"
+	"hockeypuck/openpgp"
+)
+
+// mailMaxAge is how long clients may cache a mail lookup response.
+const mailMaxAge = time.Hour
+
+// Mail responds with the best current key for an email address, for mail
+// servers encrypting to local recipients:
+//
+//	GET /pks/mail?email=alice@example.com[&format=binary]
+//
+// The key is armored unless format=binary is given. Responses carry an ETag
+// derived from the key digest, so clients can revalidate cheaply.
+func (h *Handler) Mail(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	addr := strings.ToLower(strings.TrimSpace(r.FormValue("email")))
+	if at := strings.LastIndex(addr, "@"); at < 1 || at == len(addr)-1 {
+		httpError(w, r, http.StatusBadRequest, errors.Errorf("invalid email %q", addr))
+		return
+	}
+	format := r.FormValue("format")
+	if format != "" && format != "armor" && format != "binary" {
+		httpError(w, r, http.StatusBadRequest, errors.Errorf("invalid format %q", format))
+		return
+	}
+	if h.fingerprintOnly || !storage.Supports(h.storage, storage.CapKeywordSearch) {
+		httpError(w, r, http.StatusNotImplemented, errors.WithStack(errKeywordSearchNotAvailable))
+		return
+	}
+
+	rfps, err := h.storage.MatchKeyword([]string{addr})
+	if err != nil {
+		httpError(w, r, http.StatusInternalServerError, errors.WithStack(err))
+		return
+	}
+	keys, err := h.storage.FetchKeys(rfps)
+	if err != nil {
+		httpError(w, r, http.StatusInternalServerError, errors.WithStack(err))
+		return
+	}
+	key := bestKeyForAddress(keys, addr)
+	if key == nil {
+		httpError(w, r, http.StatusNotFound, errors.Errorf("no key for %q", addr))
+		return
+	}
+	h.checkHoneypots(r, []*openpgp.PrimaryKey{key})
+	var variants []string
+	if format != "binary" && h.armorVariant != "" {
+		variants = append(variants, h.armorVariant)
+	}
+	etag := keysETag([]string{key.MD5}, variants...)
+
+	err = openpgp.ValidSelfSigned(key, h.selfSignedOnly)
+	if err != nil {
+		httpError(w, r, http.StatusInternalServerError, errors.WithStack(err))
+		return
+	}
+	var others []*openpgp.Packet
+	for _, other := range key.Others {
+		if !other.Malformed {
+			others = append(others, other)
+		}
+	}
+	key.Others = others
+
+	var buf bytes.Buffer
+	if format == "binary" {
+		w.Header().Set("Content-Type", "application/pgp-keys")
+		err = openpgp.WritePackets(&buf, key)
+	} else {
+		w.Header().Set("Content-Type", "text/plain")
+		err = openpgp.WriteArmoredPackets(&buf, []*openpgp.PrimaryKey{key}, h.keyWriterOptions...)
+		buf.WriteString("\n")
+	}
+	if err != nil {
+		httpError(w, r, http.StatusInternalServerError, errors.WithStack(err))
+		return
+	}
+	logger.WithFields(logging.RequestFields(r)).WithFields(log.Fields{
+		"email": addr,
+		"fp":    key.Fingerprint(),
+	}).Info("mail lookup")
+
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", "public, max-age="+strconv.Itoa(int(mailMaxAge.Seconds())))
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(buf.Bytes()))
+}
+
+// bestKeyForAddress returns the newest key which has a valid user ID with the
+// address, is neither revoked nor expired, and has a subkey which can
+// encrypt. It returns nil if no key qualifies.
+func bestKeyForAddress(keys []*openpgp.PrimaryKey, addr string) *openpgp.PrimaryKey {
+	var best *openpgp.PrimaryKey
+	for _, key := range keys {
+		if !usableForAddress(key, addr) {
+			continue
+		}
+		if best == nil || key.Creation.After(best.Creation) ||
+			(key.Creation.Equal(best.Creation) && key.RFingerprint < best.RFingerprint) {
+			best = key
+		}
+	}
+	return best
+}
+
+func usableForAddress(key *openpgp.PrimaryKey, addr string) bool {
+	if key.Revoked() || key.Expired() {
+		return false
+	}
+	var uidOk bool
+	for _, uid := range key.UserIDs {
+		if uid.Address() != addr {
+			continue
+		}
+		selfSigs, _ := uid.SigInfo(key)
+		if selfSigs.Valid() {
+			uidOk = true
+			break
+		}
+	}
+	if !uidOk {
+		return false
+	}
+	for _, subKey := range key.SubKeys {
+		if subKey.CanEncrypt(key) {
+			return true
+		}
+	}
+	return false
+}
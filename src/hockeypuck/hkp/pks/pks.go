@@ -27,12 +27,15 @@ import (
 	"github.com/pkg/errors"
 	"gopkg.in/tomb.v2"
 
+	"hockeypuck/logging"
 	log "hockeypuck/logrus"
 	"hockeypuck/openpgp"
 
 	"hockeypuck/hkp/storage"
 )
 
+var logger = logging.Module("pks")
+
 // Max delay backoff multiplier when there are SMTP errors.
 const maxDelay = 60
 
@@ -83,6 +86,9 @@ func NewSender(hkpStorage storage.Storage, pksStorage Storage, config *Config) (
 	if config == nil {
 		return nil, errors.New("PKS mail synchronization not configured")
 	}
+	if !storage.Supports(hkpStorage, storage.CapModifiedSince) {
+		return nil, errors.New("PKS mail synchronization requires storage support for ModifiedSince")
+	}
 
 	sender := &Sender{
 		config:     config,
@@ -133,10 +139,17 @@ func (sender *Sender) SendKeys(status Status) error {
 	}
 	for _, key := range keys {
 		// Send key email
-		log.Debugf("sending key %q to PKS %s", key.PrimaryKey.Fingerprint(), status.Addr)
+		logger.WithFields(log.Fields{
+			"fp":  key.PrimaryKey.Fingerprint(),
+			"pks": status.Addr,
+		}).Debug("sending key")
 		err = sender.SendKey(status.Addr, key.PrimaryKey)
 		if err != nil {
-			log.Errorf("error sending key to PKS %s: %v", status.Addr, err)
+			logger.WithFields(log.Fields{
+				"fp":    key.PrimaryKey.Fingerprint(),
+				"pks":   status.Addr,
+				"error": err,
+			}).Error("error sending key")
 			return errors.WithStack(err)
 		}
 		// Send successful, update the timestamp accordingly
@@ -171,7 +184,7 @@ func (sender *Sender) run() error {
 
 		statuses, err := sender.pksStorage.All()
 		if err != nil {
-			log.Errorf("failed to obtain PKS sync status: %v", err)
+			logger.WithField("error", err).Error("failed to obtain PKS sync status")
 			goto DELAY
 		}
 		for _, status := range statuses {
@@ -193,7 +206,7 @@ func (sender *Sender) run() error {
 		toSleep := time.Duration(delay) * time.Minute
 		if delay > 1 {
 			// log delay if we had an error
-			log.Debugf("PKS sleeping %d minute(s)", toSleep)
+			logger.WithField("delay", toSleep).Debug("PKS sleeping")
 		}
 		timer.Reset(toSleep)
 	}
@@ -0,0 +1,203 @@
+package hkp
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/pkg/errors"
+	xopenpgp "golang.org/x/crypto/openpgp"
+
+	"hockeypuck/clock"
+	"hockeypuck/hkp/jsonhkp"
+	"hockeypuck/hkp/storage"
+	"hockeypuck/openpgp"
+)
+
+const (
+	DefaultChallengeTTLSecs = 600
+
+	challengePrefix = "hockeypuck-challenge"
+
+	// challengeSkew is how far in the future a challenge may have been
+	// issued, allowing for clocks differing between servers sharing a
+	// secret.
+	challengeSkew = time.Minute
+
+	ProvenanceVerified   = "verified"
+	ProvenanceUnverified = "unverified"
+)
+
+// Provenance configures proof of possession for submissions. A submitter
+// fetches a challenge from /pks/challenge, signs it with the key submitted,
+// and includes the challenge and detached signature with the key as the
+// challenge and keysig parameters of /pks/add. Keys submitted without proof
+// are still accepted, but listed as unverified by index lookups, so that
+// third-party uploads of other people's keys can be told apart.
+type Provenance struct {
+	// Enabled issues challenges, verifies proofs, and lists the provenance
+	// of keys.
+	Enabled bool `toml:"enabled"`
+
+	// ChallengeTTLSecs is how long a challenge may be used for after it is
+	// issued.
+	ChallengeTTLSecs int `toml:"challengeTTL"`
+
+	// Secret authenticates challenges. Servers sharing storage behind a
+	// load balancer must share the secret; if empty, a random secret is
+	// chosen at startup.
+	Secret string `toml:"secret"`
+}
+
+func DefaultProvenance() Provenance {
+	return Provenance{
+		ChallengeTTLSecs: DefaultChallengeTTLSecs,
+	}
+}
+
+type provenance struct {
+	recorder storage.ProvenanceRecorder
+	secret   []byte
+	ttl      time.Duration
+	clock    clock.Clock
+}
+
+// KeyProvenance accepts proof of possession with submissions, recording and
+// listing which keys were proven. The storage must implement
+// storage.ProvenanceRecorder.
+func KeyProvenance(p Provenance) HandlerOption {
+	return func(h *Handler) error {
+		if !p.Enabled {
+			return nil
+		}
+		recorder, ok := h.storage.(storage.ProvenanceRecorder)
+		if !ok {
+			return errors.New("storage does not record key provenance")
+		}
+		if p.ChallengeTTLSecs <= 0 {
+			return errors.Errorf("invalid challenge TTL %d", p.ChallengeTTLSecs)
+		}
+		secret := []byte(p.Secret)
+		if len(secret) == 0 {
+			secret = make([]byte, 32)
+			_, err := rand.Read(secret)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+		}
+		h.provenance = &provenance{
+			recorder: recorder,
+			secret:   secret,
+			ttl:      time.Duration(p.ChallengeTTLSecs) * time.Second,
+			clock:    clock.Real(),
+		}
+		return nil
+	}
+}
+
+func (p *provenance) mac(issued, nonce string) string {
+	m := hmac.New(sha256.New, p.secret)
+	fmt.Fprintf(m, "%s:%s", issued, nonce)
+	return hex.EncodeToString(m.Sum(nil))
+}
+
+// challenge returns a new challenge, which is authenticated so that it
+// needn't be remembered.
+func (p *provenance) challenge() (string, error) {
+	nonce := make([]byte, 16)
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	issued := strconv.FormatInt(p.clock.Now().Unix(), 10)
+	nonceHex := hex.EncodeToString(nonce)
+	return strings.Join([]string{challengePrefix, issued, nonceHex, p.mac(issued, nonceHex)}, ":"), nil
+}
+
+// checkChallenge checks that a challenge was issued by a server sharing
+// the secret, and has not expired.
+func (p *provenance) checkChallenge(challenge string) error {
+	fields := strings.Split(challenge, ":")
+	if len(fields) != 4 || fields[0] != challengePrefix {
+		return errors.New("malformed challenge")
+	}
+	if !hmac.Equal([]byte(fields[3]), []byte(p.mac(fields[1], fields[2]))) {
+		return errors.New("challenge not issued by this server")
+	}
+	unix, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	issued := time.Unix(unix, 0)
+	now := p.clock.Now()
+	if issued.After(now.Add(challengeSkew)) || now.Sub(issued) > p.ttl {
+		return errors.New("challenge expired")
+	}
+	return nil
+}
+
+// prove checks that keysig is a signature of the challenge made by a key in
+// keytext, returning the fingerprint of the signing key.
+func (p *provenance) prove(keytext, challenge, keysig string) (string, error) {
+	err := p.checkChallenge(challenge)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	keyring, err := xopenpgp.ReadArmoredKeyRing(bytes.NewBufferString(keytext))
+	if err != nil {
+		return "", errors.Wrap(err, "invalid or unsupported keytext")
+	}
+	signingKey, err := xopenpgp.CheckArmoredDetachedSignature(
+		keyring, strings.NewReader(challenge), bytes.NewBufferString(keysig), nil)
+	if err != nil {
+		return "", errors.Wrap(err, "challenge not signed by the key submitted")
+	}
+	return hex.EncodeToString(signingKey.PrimaryKey.Fingerprint[:]), nil
+}
+
+// Challenge responds with a challenge to be signed by a key submitted with
+// proof of possession.
+func (h *Handler) Challenge(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	challenge, err := h.provenance.challenge()
+	if err != nil {
+		httpError(w, r, http.StatusInternalServerError, errors.WithStack(err))
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	w.Header().Set("Cache-Control", "no-store")
+	// Without a trailing newline, so that the response may be signed as it
+	// is saved.
+	fmt.Fprint(w, challenge)
+}
+
+// annotateProvenance sets whether each of keys was submitted with proof of
+// possession.
+func annotateProvenance(keys []*jsonhkp.PrimaryKey, rec storage.ProvenanceRecorder) {
+	if rec == nil || len(keys) == 0 {
+		return
+	}
+	var rfps []string
+	for _, key := range keys {
+		rfps = append(rfps, openpgp.Reverse(key.Fingerprint))
+	}
+	proven, err := rec.FetchProvenance(rfps)
+	if err != nil {
+		logger.WithField("error", err).Warning("failed to fetch key provenance")
+		return
+	}
+	for i, key := range keys {
+		if _, ok := proven[rfps[i]]; ok {
+			key.Provenance = ProvenanceVerified
+		} else {
+			key.Provenance = ProvenanceUnverified
+		}
+	}
+}
@@ -0,0 +1,37 @@
+package hkp
+
+import (
+	"net/http"
+	"time"
+
+	"hockeypuck/logging"
+	"hockeypuck/quarantine"
+)
+
+// Quarantine keeps submissions which contained secret key material, and
+// those rejected for exceeding the key processing budget, in dir, so that an
+// operator can review them and warn their owners. The files may hold secret
+// keys and are only readable by the server's user.
+func Quarantine(dir string) HandlerOption {
+	return func(h *Handler) error {
+		h.quarantineDir = dir
+		return nil
+	}
+}
+
+// quarantine writes a rejected submission to the quarantine directory, if
+// one is configured.
+func (h *Handler) quarantine(r *http.Request, keytext string) {
+	if h.quarantineDir == "" {
+		return
+	}
+	path, written, err := quarantine.Write(h.quarantineDir, quarantine.Armored, []byte(keytext), time.Now())
+	if err != nil {
+		logger.WithFields(logging.RequestFields(r)).WithField("error", err).Error("cannot quarantine submission")
+		return
+	} else if !written {
+		logger.WithFields(logging.RequestFields(r)).WithField("path", path).Debug("submission already quarantined")
+		return
+	}
+	logger.WithFields(logging.RequestFields(r)).WithField("path", path).Warning("submission quarantined for review")
+}
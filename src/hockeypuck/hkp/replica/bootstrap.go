@@ -0,0 +1,268 @@
+package replica
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"hockeypuck/hkp/storage"
+	log "hockeypuck/logrus"
+	"hockeypuck/openpgp"
+	"hockeypuck/tracing"
+)
+
+// manifestName is the manifest of a reproducible dump, listing the SHA-256
+// digest of each of its buckets.
+const manifestName = "SHA256SUMS"
+
+// manifestStarted prefixes the comment line of the manifest recording when
+// hockeypuck-dump started writing the dump.
+const manifestStarted = "# started "
+
+// bootstrapOverlap is how long before the bootstrap dump was published the
+// replica starts following the primary's feed, so that keyrings modified
+// while the dump was being written are not missed.
+const bootstrapOverlap = 24 * time.Hour
+
+// bootstrapClient fetches the buckets of the bootstrap dump, which may take
+// longer than any request to the primary's HKP service.
+var bootstrapClient = &http.Client{Transport: &tracing.Transport{}}
+
+// manifest lists the buckets of the bootstrap dump.
+type manifest struct {
+	buckets   []bucket
+	published time.Time
+	digest    string
+}
+
+type bucket struct {
+	name string
+	sum  string
+}
+
+// bootstrapping returns whether the bootstrap dump is yet to be loaded.
+func (f *Follower) bootstrapping() bool {
+	if f.settings.Bootstrap == "" {
+		return false
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return !f.bootstrapped && f.pos == storage.ModifiedKey{}
+}
+
+// bootstrapNext loads the next bucket of the bootstrap dump. Once all are
+// loaded, the follower follows the primary's feed from shortly before the
+// dump was published.
+func (f *Follower) bootstrapNext(ctx context.Context) error {
+	m, err := f.bootstrapManifest(ctx)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	for _, b := range m.buckets {
+		f.mu.Lock()
+		done := f.buckets[b.name]
+		f.mu.Unlock()
+		if done {
+			continue
+		}
+		n, err := f.loadBucket(ctx, b)
+		if err != nil {
+			// The dump may have been replaced since its manifest was
+			// fetched; fetch it again on the next attempt.
+			f.mu.Lock()
+			f.manifest = nil
+			f.mu.Unlock()
+			return errors.Wrapf(err, "cannot load bootstrap bucket %q", b.name)
+		}
+		f.mu.Lock()
+		f.buckets[b.name] = true
+		loaded := len(f.buckets)
+		f.mu.Unlock()
+		f.log().WithFields(log.Fields{
+			"bucket":  b.name,
+			"keys":    n,
+			"loaded":  loaded,
+			"buckets": len(m.buckets),
+		}).Info("bootstrap bucket loaded")
+		return f.writeState()
+	}
+
+	var pos storage.ModifiedKey
+	if !m.published.IsZero() {
+		pos.MTime = m.published.Add(-bootstrapOverlap)
+	}
+	f.mu.Lock()
+	f.pos = pos
+	f.bootstrapped = true
+	f.buckets = map[string]bool{}
+	f.manifest = nil
+	f.manifestDigest = ""
+	f.published = time.Time{}
+	f.mu.Unlock()
+	f.log().WithField("after", pos.MTime).Info("bootstrap complete, following primary")
+	return f.writeState()
+}
+
+func (f *Follower) bootstrapGet(ctx context.Context, name string) (*http.Response, error) {
+	req, err := http.NewRequest("GET", strings.TrimRight(f.settings.Bootstrap, "/")+"/"+name, nil)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if ctx != nil {
+		req = req.WithContext(ctx)
+	}
+	if f.userAgent != "" {
+		req.Header.Set("User-Agent", f.userAgent)
+	}
+	resp, err := bootstrapClient.Do(req)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+		return nil, errors.Errorf("%s request returned %s", name, resp.Status)
+	}
+	return resp, nil
+}
+
+// bootstrapManifest returns the manifest of the bootstrap dump, fetching it
+// the first time. The dump was published when hockeypuck-dump started
+// writing it or, if the manifest does not record that, when the manifest was
+// last modified. If the manifest differs from the one the loaded buckets
+// were listed in, the bootstrap starts over.
+func (f *Follower) bootstrapManifest(ctx context.Context) (*manifest, error) {
+	f.mu.Lock()
+	m := f.manifest
+	f.mu.Unlock()
+	if m != nil {
+		return m, nil
+	}
+
+	resp, err := f.bootstrapGet(ctx, manifestName)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	sum := sha256.Sum256(body)
+	m = &manifest{digest: hex.EncodeToString(sum[:])}
+	if t, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil {
+		m.published = t
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	for scanner.Scan() {
+		if strings.HasPrefix(scanner.Text(), manifestStarted) {
+			t, err := time.Parse(time.RFC3339, strings.TrimSpace(strings.TrimPrefix(scanner.Text(), manifestStarted)))
+			if err != nil {
+				return nil, errors.Errorf("invalid manifest line %q", scanner.Text())
+			}
+			m.published = t
+			continue
+		}
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) != 2 {
+			return nil, errors.Errorf("invalid manifest line %q", scanner.Text())
+		}
+		name := strings.TrimPrefix(fields[1], "*")
+		if path.Base(name) != name || name == "." || name == ".." {
+			return nil, errors.Errorf("invalid bucket name %q in manifest", name)
+		}
+		if sum, err := hex.DecodeString(fields[0]); err != nil || len(sum) != sha256.Size {
+			return nil, errors.Errorf("invalid digest for bucket %q in manifest", name)
+		}
+		m.buckets = append(m.buckets, bucket{name: name, sum: strings.ToLower(fields[0])})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	sort.Slice(m.buckets, func(i, j int) bool { return m.buckets[i].name < m.buckets[j].name })
+
+	f.mu.Lock()
+	changed := f.manifestDigest != m.digest
+	if changed {
+		if f.manifestDigest != "" {
+			f.log().WithField("loaded", len(f.buckets)).Warn("bootstrap dump changed, starting over")
+		}
+		f.buckets = map[string]bool{}
+		f.manifestDigest = m.digest
+		f.published = m.published
+	} else if !f.published.IsZero() {
+		// The manifest may have been copied since, changing when it was
+		// last modified but not when the dump was.
+		m.published = f.published
+	}
+	f.manifest = m
+	f.mu.Unlock()
+	f.log().WithFields(log.Fields{
+		"buckets":   len(m.buckets),
+		"published": m.published,
+	}).Info("bootstrapping from dump")
+	if changed {
+		err = f.writeState()
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+	}
+	return m, nil
+}
+
+// loadBucket fetches a bucket of the bootstrap dump, checks it against the
+// manifest and stores its keyrings, returning how many it held.
+func (f *Follower) loadBucket(ctx context.Context, b bucket) (int, error) {
+	resp, err := f.bootstrapGet(ctx, b.name)
+	if err != nil {
+		return 0, errors.WithStack(err)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return 0, errors.WithStack(err)
+	}
+	sum := sha256.Sum256(body)
+	if hex.EncodeToString(sum[:]) != b.sum {
+		return 0, errors.New("digest does not match manifest")
+	}
+
+	// Each keyring is stored separately, so that one over the key budget
+	// is quarantined alone.
+	okr, err := openpgp.NewOpaqueKeyReader(bytes.NewReader(body))
+	if err != nil {
+		return 0, errors.WithStack(err)
+	}
+	keyrings, err := okr.Read()
+	if err != nil {
+		return 0, errors.WithStack(err)
+	}
+	for _, kr := range keyrings {
+		var buf bytes.Buffer
+		for _, op := range kr.Packets {
+			err = op.Serialize(&buf)
+			if err != nil {
+				return 0, errors.WithStack(err)
+			}
+		}
+		err = f.store(ctx, buf.Bytes())
+		if err != nil {
+			return 0, errors.WithStack(err)
+		}
+	}
+	return len(keyrings), nil
+}
@@ -0,0 +1,46 @@
+package replica
+
+import (
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var replicaMetrics = struct {
+	keys     *prometheus.CounterVec
+	position prometheus.Gauge
+	lag      prometheus.Gauge
+}{
+	keys: prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "hockeypuck",
+			Name:      "replica_keys",
+			Help:      "Count of keys replicated from the primary since startup",
+		},
+		[]string{"result"},
+	),
+	position: prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: "hockeypuck",
+			Name:      "replica_position_timestamp_seconds",
+			Help:      "Modification time of the last key replicated from the primary",
+		},
+	),
+	lag: prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: "hockeypuck",
+			Name:      "replica_lag_seconds",
+			Help:      "How far behind the primary the last keys replicated were, or zero once caught up",
+		},
+	),
+}
+
+var metricsRegister sync.Once
+
+func registerMetrics() {
+	metricsRegister.Do(func() {
+		prometheus.MustRegister(replicaMetrics.keys)
+		prometheus.MustRegister(replicaMetrics.position)
+		prometheus.MustRegister(replicaMetrics.lag)
+	})
+}
@@ -0,0 +1,645 @@
+// Package replica keeps a read replica in step with a primary hockeypuck
+// server, without SKS recon.
+//
+// A Follower pages through the primary's /pks/modified feed, which lists
+// keyrings in the order they were modified along with their digests. Keyrings
+// whose digest is not already stored locally are fetched from the primary by
+// hashquery and stored as-is, so that the replica serves exactly what the
+// primary does. Key deletions on the primary are not replicated.
+//
+// With Merge set, keyrings are merged into the local copy instead, so that
+// two primaries, such as one in each region, may each follow the other.
+// Merging is commutative, so both converge on the union of the keys
+// submitted to either. Replication does not loop: a keyring merged from the
+// other primary only appears in the local feed if merging changed it, in
+// which case the other primary merges a superset of its own copy, and the
+// result has a digest which is already stored here and so is not fetched
+// again.
+//
+// With Bootstrap set, a new replica first loads a reproducible dump of the
+// primary, then follows the feed from shortly before the dump was
+// published, rather than fetching every keyring in the feed one page at a
+// time.
+package replica
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"gopkg.in/tomb.v2"
+
+	"hockeypuck/clock"
+	"hockeypuck/conflux/recon"
+	"hockeypuck/hkp"
+	"hockeypuck/hkp/storage"
+	"hockeypuck/ingest"
+	"hockeypuck/logging"
+	log "hockeypuck/logrus"
+	"hockeypuck/notify"
+	"hockeypuck/openpgp"
+	"hockeypuck/quarantine"
+	"hockeypuck/tracing"
+)
+
+var logger = logging.Module("replica")
+
+const (
+	DefaultWaitSecs     = 30
+	DefaultRetrySecs    = 10
+	DefaultIntervalSecs = 1
+	DefaultBatchSize    = 100
+
+	httpClientTimeout = 30
+)
+
+type Settings struct {
+	// Primary is the base URL of the primary's HKP service, such as
+	// http://primary.example.com:11371. Replication is disabled if empty.
+	Primary string `toml:"primary"`
+
+	// StateFile records the position in the primary's feed, so that a
+	// restarted replica carries on where it left off. If empty, the replica
+	// pages through the entire feed on every start.
+	StateFile string `toml:"stateFile"`
+
+	// BatchSize is the number of keyrings requested at a time.
+	BatchSize int `toml:"batchSize"`
+
+	// WaitSecs is how long the primary is asked to hold a request open when
+	// there are no new modifications.
+	WaitSecs int `toml:"waitSecs"`
+
+	// IntervalSecs is the delay between requests once the replica has
+	// caught up with the primary.
+	IntervalSecs int `toml:"intervalSecs"`
+
+	// RetrySecs is the delay before retrying after an error.
+	RetrySecs int `toml:"retrySecs"`
+
+	// Token is the API token presented to the primary, if it restricts
+	// its modified feed to token holders.
+	Token string `toml:"token"`
+
+	// Merge merges keyrings from the primary into local ones rather than
+	// replacing them, for replication between primaries which accept
+	// submissions and follow each other.
+	Merge bool `toml:"merge"`
+
+	// Bootstrap is the URL of a directory holding a dump of the primary,
+	// written by hockeypuck-dump -reproducible and published along with
+	// its SHA256SUMS manifest. A replica with no recorded position loads
+	// the dump before following the primary's feed.
+	Bootstrap string `toml:"bootstrap"`
+}
+
+func DefaultSettings() *Settings {
+	return &Settings{
+		BatchSize:    DefaultBatchSize,
+		WaitSecs:     DefaultWaitSecs,
+		IntervalSecs: DefaultIntervalSecs,
+		RetrySecs:    DefaultRetrySecs,
+	}
+}
+
+// Enabled returns whether replication from a primary is configured.
+func (s *Settings) Enabled() bool {
+	return s != nil && s.Primary != ""
+}
+
+// state records the position of the last keyring applied from the primary.
+type state struct {
+	Last storage.ModifiedKey `json:"last"`
+
+	// Bootstrapped records that the bootstrap dump has been loaded, and
+	// Buckets which of its buckets have been loaded until it is. Manifest
+	// is the SHA-256 digest of the manifest they were listed in, and
+	// Published when that dump was started.
+	Bootstrapped bool       `json:"bootstrapped,omitempty"`
+	Buckets      []string   `json:"buckets,omitempty"`
+	Manifest     string     `json:"manifest,omitempty"`
+	Published    *time.Time `json:"published,omitempty"`
+}
+
+// Follower replicates keyrings from a primary server.
+type Follower struct {
+	storage          storage.Storage
+	settings         Settings
+	primary          string
+	http             *http.Client
+	keyReaderOptions []openpgp.KeyReaderOption
+	userAgent        string
+	notifier         *notify.Dispatcher
+	ingest           *ingest.Scheduler
+	clock            clock.Clock
+	quarantineDir    string
+
+	mu     sync.Mutex
+	pos    storage.ModifiedKey
+	lag    time.Duration
+	paused bool
+
+	// Bootstrap progress, guarded by mu.
+	bootstrapped   bool
+	buckets        map[string]bool
+	manifest       *manifest
+	manifestDigest string
+	published      time.Time
+
+	// busy is held while a page of modifications is applied.
+	busy sync.Mutex
+
+	t tomb.Tomb
+}
+
+// NewFollower returns a follower which replicates from the primary described
+// by settings into st.
+func NewFollower(st storage.Storage, settings *Settings, opts []openpgp.KeyReaderOption, userAgent string) (*Follower, error) {
+	if !settings.Enabled() {
+		return nil, errors.New("no primary configured")
+	}
+	u, err := url.Parse(settings.Primary)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid primary URL %q", settings.Primary)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, errors.Errorf("invalid primary URL %q: scheme must be http or https", settings.Primary)
+	}
+	if settings.Bootstrap != "" {
+		u, err := url.Parse(settings.Bootstrap)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			return nil, errors.Errorf("invalid bootstrap URL %q", settings.Bootstrap)
+		}
+	}
+	f := &Follower{
+		storage:  st,
+		settings: *settings,
+		primary:  strings.TrimRight(settings.Primary, "/"),
+		http: &http.Client{
+			Timeout:   (httpClientTimeout + time.Duration(settings.WaitSecs)) * time.Second,
+			Transport: &tracing.Transport{},
+		},
+		keyReaderOptions: opts,
+		userAgent:        userAgent,
+		clock:            clock.Real(),
+		buckets:          map[string]bool{},
+	}
+	if f.settings.BatchSize <= 0 {
+		f.settings.BatchSize = DefaultBatchSize
+	}
+	if f.settings.RetrySecs <= 0 {
+		f.settings.RetrySecs = DefaultRetrySecs
+	}
+	err = f.readState()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	registerMetrics()
+	return f, nil
+}
+
+// SetClock sets the clock used to schedule requests. It must be called
+// before Start.
+func (f *Follower) SetClock(c clock.Clock) {
+	f.clock = c
+}
+
+// SetNotifier sets the dispatcher which publishes keys replicated from the
+// primary.
+func (f *Follower) SetNotifier(d *notify.Dispatcher) {
+	f.notifier = d
+}
+
+// SetIngestScheduler sets the scheduler which shares storage writes fairly
+// between replication and other sources of key updates. It must be called
+// before Start.
+func (f *Follower) SetIngestScheduler(s *ingest.Scheduler) {
+	f.ingest = s
+}
+
+// SetQuarantine keeps keys from the primary which exceed the key budget in
+// dir, for operator review. It must be called before Start.
+func (f *Follower) SetQuarantine(dir string) {
+	f.quarantineDir = dir
+}
+
+// quarantine skips a key over the key budget, writing its binary packets to
+// the quarantine directory if one is configured, so that it does not hold
+// up replication of the keys after it.
+func (f *Follower) quarantine(data []byte, cause error) {
+	replicaMetrics.keys.WithLabelValues("quarantined").Inc()
+	f.log().WithField("error", cause).Warning("key over budget skipped")
+	if f.quarantineDir == "" {
+		return
+	}
+	path, written, err := quarantine.Write(f.quarantineDir, quarantine.Binary, data, f.clock.Now())
+	if err != nil {
+		f.log().WithField("error", err).Error("cannot quarantine key")
+		return
+	} else if !written {
+		f.log().WithField("path", path).Debug("key already quarantined")
+		return
+	}
+	f.log().WithField("path", path).Warning("key quarantined for review")
+}
+
+func (f *Follower) log() *log.Entry {
+	return logger.WithFields(log.Fields{"label": "replica", "primary": f.primary})
+}
+
+// Position returns the position of the last keyring applied from the
+// primary.
+func (f *Follower) Position() storage.ModifiedKey {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.pos
+}
+
+// Lag returns how far the follower was behind the primary when it last
+// applied modifications, or zero if it has caught up.
+func (f *Follower) Lag() time.Duration {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.lag
+}
+
+func (f *Follower) setLag(lag time.Duration) {
+	f.mu.Lock()
+	f.lag = lag
+	f.mu.Unlock()
+	replicaMetrics.lag.Set(lag.Seconds())
+}
+
+func (f *Follower) readState() error {
+	if f.settings.StateFile == "" {
+		return nil
+	}
+	buf, err := ioutil.ReadFile(f.settings.StateFile)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return errors.WithStack(err)
+	}
+	var st state
+	err = json.Unmarshal(buf, &st)
+	if err != nil {
+		return errors.Wrapf(err, "invalid state file %q", f.settings.StateFile)
+	}
+	f.pos = st.Last
+	f.bootstrapped = st.Bootstrapped
+	for _, name := range st.Buckets {
+		f.buckets[name] = true
+	}
+	f.manifestDigest = st.Manifest
+	if st.Published != nil {
+		f.published = *st.Published
+	}
+	return nil
+}
+
+func (f *Follower) writeState() error {
+	if f.settings.StateFile == "" {
+		return nil
+	}
+	f.mu.Lock()
+	st := state{Last: f.pos, Bootstrapped: f.bootstrapped, Manifest: f.manifestDigest}
+	for name := range f.buckets {
+		st.Buckets = append(st.Buckets, name)
+	}
+	if !f.published.IsZero() {
+		published := f.published
+		st.Published = &published
+	}
+	f.mu.Unlock()
+	sort.Strings(st.Buckets)
+	buf, err := json.Marshal(&st)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	tmp := f.settings.StateFile + ".tmp"
+	err = ioutil.WriteFile(tmp, buf, 0644)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(os.Rename(tmp, f.settings.StateFile))
+}
+
+// Start following the primary.
+func (f *Follower) Start() {
+	f.t.Go(f.run)
+}
+
+// Stop following the primary.
+func (f *Follower) Stop() {
+	f.log().Info("replica: stopping")
+	f.t.Kill(nil)
+	err := f.t.Wait()
+	if err != nil {
+		f.log().Errorf("%+v", err)
+	}
+	f.log().Info("replica: stopped")
+}
+
+// Pause stops applying modifications from the primary, waiting for a page
+// in progress to be applied.
+func (f *Follower) Pause() {
+	f.mu.Lock()
+	f.paused = true
+	f.mu.Unlock()
+	f.busy.Lock()
+	f.busy.Unlock()
+	f.log().Info("replica: paused")
+}
+
+// Resume following the primary after Pause.
+func (f *Follower) Resume() {
+	f.mu.Lock()
+	f.paused = false
+	f.mu.Unlock()
+	f.log().Info("replica: resumed")
+}
+
+var errPaused = errors.New("replication paused")
+
+// syncUnlessPaused calls Sync, or loads the next bucket of the bootstrap
+// dump while bootstrapping, unless the follower is paused.
+func (f *Follower) syncUnlessPaused(ctx context.Context) (int, error) {
+	f.busy.Lock()
+	defer f.busy.Unlock()
+	f.mu.Lock()
+	paused := f.paused
+	f.mu.Unlock()
+	if paused {
+		return 0, errPaused
+	}
+	if f.bootstrapping() {
+		err := f.bootstrapNext(ctx)
+		if err != nil {
+			return 0, errors.WithStack(err)
+		}
+		// Carry on without delay.
+		return f.settings.BatchSize, nil
+	}
+	return f.Sync(ctx)
+}
+
+func (f *Follower) run() error {
+	for {
+		n, err := f.syncUnlessPaused(f.t.Context(nil))
+		var delay time.Duration
+		if err == errPaused {
+			delay = time.Duration(f.settings.RetrySecs) * time.Second
+		} else if err != nil {
+			f.log().Errorf("replication failed: %v", err)
+			delay = time.Duration(f.settings.RetrySecs) * time.Second
+		} else if n < f.settings.BatchSize {
+			delay = time.Duration(f.settings.IntervalSecs) * time.Second
+		}
+		if delay <= 0 {
+			if !f.t.Alive() {
+				return nil
+			}
+			continue
+		}
+		timer := f.clock.NewTimer(delay)
+		select {
+		case <-f.t.Dying():
+			timer.Stop()
+			return nil
+		case <-timer.C():
+		}
+	}
+}
+
+// Sync requests the next page of modifications from the primary and applies
+// them, returning the number of modified keyrings listed.
+func (f *Follower) Sync(ctx context.Context) (int, error) {
+	ctx, span := tracing.StartSpan(ctx, "replica.sync")
+	defer span.End()
+	pos := f.Position()
+	keys, err := f.modified(ctx, pos)
+	if err != nil {
+		return 0, errors.WithStack(err)
+	}
+	if len(keys) == 0 {
+		f.setLag(0)
+		return 0, nil
+	}
+
+	var digests []string
+	for _, mk := range keys {
+		if mk.MD5 == "" {
+			return 0, errors.Errorf("primary did not provide a digest for %q", mk.RFingerprint)
+		}
+		rfps, err := f.storage.MatchMD5([]string{mk.MD5})
+		if err != nil {
+			return 0, errors.WithStack(err)
+		}
+		if len(rfps) == 0 {
+			digests = append(digests, mk.MD5)
+		}
+	}
+	if len(digests) > 0 {
+		err = f.fetch(ctx, digests)
+		if err != nil {
+			return 0, errors.WithStack(err)
+		}
+	}
+	replicaMetrics.keys.WithLabelValues("unchanged").Add(float64(len(keys) - len(digests)))
+
+	last := keys[len(keys)-1]
+	f.mu.Lock()
+	f.pos = last
+	f.mu.Unlock()
+	replicaMetrics.position.Set(float64(last.MTime.Unix()))
+	if len(keys) < f.settings.BatchSize {
+		f.setLag(0)
+	} else {
+		f.setLag(f.clock.Now().Sub(last.MTime))
+	}
+	err = f.writeState()
+	if err != nil {
+		return 0, errors.WithStack(err)
+	}
+	return len(keys), nil
+}
+
+func (f *Follower) newRequest(ctx context.Context, method, path string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequest(method, f.primary+path, body)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if ctx != nil {
+		req = req.WithContext(ctx)
+	}
+	if f.userAgent != "" {
+		req.Header.Set("User-Agent", f.userAgent)
+	}
+	if f.settings.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+f.settings.Token)
+	}
+	return req, nil
+}
+
+// modified requests the keyrings modified after pos from the primary.
+func (f *Follower) modified(ctx context.Context, pos storage.ModifiedKey) ([]storage.ModifiedKey, error) {
+	q := url.Values{}
+	if !pos.MTime.IsZero() {
+		q.Set("after", pos.MTime.UTC().Format(time.RFC3339Nano))
+	}
+	if pos.RFingerprint != "" {
+		q.Set("rfp", pos.RFingerprint)
+	}
+	// The digest distinguishes rows of a fingerprint stored more than once
+	// with the same modification time, which may fall either side of a
+	// page boundary.
+	if pos.MD5 != "" {
+		q.Set("md5", pos.MD5)
+	}
+	q.Set("limit", fmt.Sprint(f.settings.BatchSize))
+	if f.settings.WaitSecs > 0 {
+		q.Set("wait", fmt.Sprint(f.settings.WaitSecs))
+	}
+	req, err := f.newRequest(ctx, "GET", "/pks/modified?"+q.Encode(), nil)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	resp, err := f.http.Do(req)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		io.Copy(ioutil.Discard, resp.Body)
+		return nil, errors.Errorf("modified request returned %s", resp.Status)
+	}
+	var modRes hkp.ModifiedResponse
+	err = json.NewDecoder(resp.Body).Decode(&modRes)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid modified response")
+	}
+	return modRes.Keys, nil
+}
+
+// fetch requests the keyrings with the given digests from the primary by
+// hashquery and stores them.
+func (f *Follower) fetch(ctx context.Context, digests []string) error {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	var hqBuf bytes.Buffer
+	err := recon.WriteInt(&hqBuf, len(digests))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	for _, digest := range digests {
+		buf, err := hex.DecodeString(digest)
+		if err != nil {
+			return errors.Wrapf(err, "invalid digest %q", digest)
+		}
+		err = recon.WriteInt(&hqBuf, len(buf))
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		hqBuf.Write(buf)
+	}
+
+	req, err := f.newRequest(ctx, "POST", "/pks/hashquery", &hqBuf)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	req.Header.Set("Content-Type", "sks/hashquery")
+	resp, err := f.http.Do(req)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	// Read the whole response so that the connection does not time out
+	// while keys are being stored.
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return errors.Errorf("hashquery request returned %s", resp.Status)
+	}
+
+	r := bytes.NewReader(body)
+	nkeys, err := recon.ReadInt(r)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	for i := 0; i < nkeys; i++ {
+		keyLen, err := recon.ReadInt(r)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		keyBuf := make([]byte, keyLen)
+		_, err = io.ReadFull(r, keyBuf)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		err = f.store(ctx, keyBuf)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	return nil
+}
+
+// store replaces the local copy of each key in buf with the primary's, or
+// merges it into the local copy if the follower merges. Keys over the key
+// budget are quarantined and skipped.
+func (f *Follower) store(ctx context.Context, buf []byte) error {
+	kr := openpgp.NewKeyReader(bytes.NewReader(buf), f.keyReaderOptions...)
+	keys, err := kr.ReadContext(ctx)
+	if errors.Is(err, openpgp.ErrBudgetExceeded) {
+		f.quarantine(buf, err)
+		return nil
+	} else if err != nil {
+		return errors.WithStack(err)
+	}
+	release, err := f.ingest.Acquire(ctx, ingest.ClassReplica)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer release()
+	for _, key := range keys {
+		var change storage.KeyChange
+		if f.settings.Merge {
+			change, err = storage.UpsertKey(f.storage, key, f.keyReaderOptions...)
+		} else {
+			change, err = storage.ReplaceKey(f.storage, key)
+		}
+		if errors.Is(err, openpgp.ErrBudgetExceeded) {
+			f.quarantine(buf, err)
+			continue
+		} else if err != nil {
+			replicaMetrics.keys.WithLabelValues("failure").Inc()
+			return errors.WithStack(err)
+		}
+		f.log().Debug(change)
+		f.notifier.Publish(key.Fingerprint(), change, notify.SourceReplica)
+		switch change.(type) {
+		case storage.KeyAdded:
+			replicaMetrics.keys.WithLabelValues("inserted").Inc()
+		case storage.KeyReplaced:
+			replicaMetrics.keys.WithLabelValues("updated").Inc()
+		case storage.KeyNotChanged:
+			replicaMetrics.keys.WithLabelValues("unchanged").Inc()
+		}
+	}
+	return nil
+}
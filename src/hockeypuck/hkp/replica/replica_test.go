@@ -0,0 +1,349 @@
+package replica
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	stdtesting "testing"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	gc "gopkg.in/check.v1"
+
+	"hockeypuck/clock"
+	"hockeypuck/hkp"
+	"hockeypuck/hkp/storage"
+	"hockeypuck/hkp/storage/mock"
+	"hockeypuck/openpgp"
+	"hockeypuck/testing"
+)
+
+func Test(t *stdtesting.T) { gc.TestingT(t) }
+
+type ReplicaSuite struct {
+	key     *openpgp.PrimaryKey
+	mtime   time.Time
+	primary *mock.Storage
+	srv     *httptest.Server
+}
+
+var _ = gc.Suite(&ReplicaSuite{})
+
+func (s *ReplicaSuite) SetUpTest(c *gc.C) {
+	s.key = openpgp.MustReadArmorKeys(testing.MustInput("alice_signed.asc"))[0]
+	s.mtime = time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	s.primary = mock.NewStorage(
+		mock.ModifiedAfter(func(after storage.ModifiedKey, limit int) ([]storage.ModifiedKey, error) {
+			if !after.MTime.Before(s.mtime) {
+				return nil, nil
+			}
+			return []storage.ModifiedKey{{RFingerprint: s.key.RFingerprint, MTime: s.mtime, MD5: s.key.MD5}}, nil
+		}),
+		mock.MatchMD5(func(md5s []string) ([]string, error) {
+			c.Check(md5s, gc.DeepEquals, []string{s.key.MD5})
+			return []string{s.key.RFingerprint}, nil
+		}),
+		mock.FetchKeys(func(rfps []string) ([]*openpgp.PrimaryKey, error) {
+			return []*openpgp.PrimaryKey{s.key}, nil
+		}),
+	)
+	r := httprouter.New()
+	h, err := hkp.NewHandler(s.primary)
+	c.Assert(err, gc.IsNil)
+	h.Register(r)
+	s.srv = httptest.NewServer(r)
+}
+
+func (s *ReplicaSuite) TearDownTest(c *gc.C) {
+	s.srv.Close()
+}
+
+func (s *ReplicaSuite) TestSync(c *gc.C) {
+	var replaced []*openpgp.PrimaryKey
+	local := mock.NewStorage(mock.Replace(func(key *openpgp.PrimaryKey) (string, error) {
+		replaced = append(replaced, key)
+		return "", nil
+	}))
+	stateFile := filepath.Join(c.MkDir(), "replica.json")
+	settings := &Settings{Primary: s.srv.URL, StateFile: stateFile}
+	f, err := NewFollower(local, settings, nil, "")
+	c.Assert(err, gc.IsNil)
+
+	n, err := f.Sync(context.Background())
+	c.Assert(err, gc.IsNil)
+	c.Assert(n, gc.Equals, 1)
+	c.Assert(replaced, gc.HasLen, 1)
+	c.Assert(replaced[0].MD5, gc.Equals, s.key.MD5)
+	c.Assert(f.Position().RFingerprint, gc.Equals, s.key.RFingerprint)
+	c.Assert(f.Position().MTime.Equal(s.mtime), gc.Equals, true)
+
+	n, err = f.Sync(context.Background())
+	c.Assert(err, gc.IsNil)
+	c.Assert(n, gc.Equals, 0)
+	c.Assert(replaced, gc.HasLen, 1)
+
+	// A restarted follower carries on from the recorded position.
+	f, err = NewFollower(local, settings, nil, "")
+	c.Assert(err, gc.IsNil)
+	c.Assert(f.Position().RFingerprint, gc.Equals, s.key.RFingerprint)
+	n, err = f.Sync(context.Background())
+	c.Assert(err, gc.IsNil)
+	c.Assert(n, gc.Equals, 0)
+}
+
+func (s *ReplicaSuite) TestSyncPageBoundary(c *gc.C) {
+	// Two rows of the same fingerprint share a modification time, as after
+	// a bulk load, and are listed on separate pages.
+	rows := []storage.ModifiedKey{
+		{RFingerprint: s.key.RFingerprint, MTime: s.mtime, MD5: strings.Repeat("1", 32)},
+		{RFingerprint: s.key.RFingerprint, MTime: s.mtime, MD5: strings.Repeat("2", 32)},
+	}
+	var afters []storage.ModifiedKey
+	primary := mock.NewStorage(mock.ModifiedAfter(func(after storage.ModifiedKey, limit int) ([]storage.ModifiedKey, error) {
+		afters = append(afters, after)
+		for _, row := range rows {
+			if row.MTime.After(after.MTime) || row.RFingerprint > after.RFingerprint ||
+				(row.RFingerprint == after.RFingerprint && after.MD5 != "" && row.MD5 > after.MD5) {
+				return []storage.ModifiedKey{row}, nil
+			}
+		}
+		return nil, nil
+	}))
+	r := httprouter.New()
+	h, err := hkp.NewHandler(primary)
+	c.Assert(err, gc.IsNil)
+	h.Register(r)
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	local := mock.NewStorage(mock.MatchMD5(func(md5s []string) ([]string, error) {
+		return []string{s.key.RFingerprint}, nil
+	}))
+	f, err := NewFollower(local, &Settings{Primary: srv.URL, BatchSize: 1}, nil, "")
+	c.Assert(err, gc.IsNil)
+	for i := 0; i < 3; i++ {
+		_, err = f.Sync(context.Background())
+		c.Assert(err, gc.IsNil)
+	}
+	c.Assert(afters, gc.HasLen, 3)
+	c.Assert(afters[1].MD5, gc.Equals, rows[0].MD5)
+	c.Assert(afters[2].MD5, gc.Equals, rows[1].MD5)
+	c.Assert(local.MethodCount("MatchMD5"), gc.Equals, 2)
+}
+
+func (s *ReplicaSuite) TestSyncMerge(c *gc.C) {
+	var updated []*openpgp.PrimaryKey
+	localKey := openpgp.MustReadArmorKeys(testing.MustInput("alice_unsigned.asc"))[0]
+	c.Assert(localKey.MD5, gc.Not(gc.Equals), s.key.MD5)
+	local := mock.NewStorage(
+		mock.FetchKeys(func([]string) ([]*openpgp.PrimaryKey, error) {
+			return []*openpgp.PrimaryKey{localKey}, nil
+		}),
+		mock.Update(func(key *openpgp.PrimaryKey, _, _ string) error {
+			updated = append(updated, key)
+			return nil
+		}),
+	)
+	f, err := NewFollower(local, &Settings{Primary: s.srv.URL, Merge: true}, nil, "")
+	c.Assert(err, gc.IsNil)
+
+	n, err := f.Sync(context.Background())
+	c.Assert(err, gc.IsNil)
+	c.Assert(n, gc.Equals, 1)
+	c.Assert(local.MethodCount("Replace"), gc.Equals, 0)
+	c.Assert(updated, gc.HasLen, 1)
+	c.Assert(updated[0].MD5, gc.Equals, s.key.MD5)
+
+	// Merging a keyring which adds nothing leaves the local copy alone, so
+	// that it does not reappear in the local feed.
+	localKey = openpgp.MustReadArmorKeys(testing.MustInput("alice_signed.asc"))[0]
+	f, err = NewFollower(local, &Settings{Primary: s.srv.URL, Merge: true}, nil, "")
+	c.Assert(err, gc.IsNil)
+	n, err = f.Sync(context.Background())
+	c.Assert(err, gc.IsNil)
+	c.Assert(n, gc.Equals, 1)
+	c.Assert(updated, gc.HasLen, 1)
+}
+
+func (s *ReplicaSuite) TestLag(c *gc.C) {
+	f, err := NewFollower(mock.NewStorage(), &Settings{Primary: s.srv.URL, BatchSize: 1}, nil, "")
+	c.Assert(err, gc.IsNil)
+	f.SetClock(clock.NewFake(s.mtime.Add(time.Hour)))
+
+	// A full page may not be the last.
+	_, err = f.Sync(context.Background())
+	c.Assert(err, gc.IsNil)
+	c.Assert(f.Lag(), gc.Equals, time.Hour)
+
+	_, err = f.Sync(context.Background())
+	c.Assert(err, gc.IsNil)
+	c.Assert(f.Lag(), gc.Equals, time.Duration(0))
+}
+
+func (s *ReplicaSuite) TestPause(c *gc.C) {
+	local := mock.NewStorage()
+	f, err := NewFollower(local, &Settings{Primary: s.srv.URL}, nil, "")
+	c.Assert(err, gc.IsNil)
+
+	f.Pause()
+	_, err = f.syncUnlessPaused(context.Background())
+	c.Assert(err, gc.Equals, errPaused)
+	c.Assert(local.MethodCount("Replace"), gc.Equals, 0)
+
+	f.Resume()
+	n, err := f.syncUnlessPaused(context.Background())
+	c.Assert(err, gc.IsNil)
+	c.Assert(n, gc.Equals, 1)
+	c.Assert(local.MethodCount("Replace"), gc.Equals, 1)
+}
+
+func (s *ReplicaSuite) TestSyncUnchanged(c *gc.C) {
+	local := mock.NewStorage(mock.MatchMD5(func(md5s []string) ([]string, error) {
+		return []string{s.key.RFingerprint}, nil
+	}))
+	f, err := NewFollower(local, &Settings{Primary: s.srv.URL}, nil, "")
+	c.Assert(err, gc.IsNil)
+
+	n, err := f.Sync(context.Background())
+	c.Assert(err, gc.IsNil)
+	c.Assert(n, gc.Equals, 1)
+	c.Assert(local.MethodCount("Replace"), gc.Equals, 0)
+	c.Assert(s.primary.MethodCount("MatchMD5"), gc.Equals, 0)
+	c.Assert(f.Position().RFingerprint, gc.Equals, s.key.RFingerprint)
+}
+
+func (s *ReplicaSuite) TestSyncUnsupported(c *gc.C) {
+	primary := mock.NewStorage(mock.Unsupported(storage.CapModifiedSince))
+	r := httprouter.New()
+	h, err := hkp.NewHandler(primary)
+	c.Assert(err, gc.IsNil)
+	h.Register(r)
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	f, err := NewFollower(mock.NewStorage(), &Settings{Primary: srv.URL}, nil, "")
+	c.Assert(err, gc.IsNil)
+	_, err = f.Sync(context.Background())
+	c.Assert(err, gc.ErrorMatches, ".*501 Not Implemented")
+	c.Assert(f.Position(), gc.Equals, storage.ModifiedKey{})
+}
+
+// dumpServer serves a dump holding the suite's key, as written by
+// hockeypuck-dump -reproducible, started at the given time and published
+// an hour later.
+func (s *ReplicaSuite) dumpServer(c *gc.C, published time.Time, sum string) *httptest.Server {
+	var buf bytes.Buffer
+	err := openpgp.WritePackets(&buf, s.key)
+	c.Assert(err, gc.IsNil)
+	if sum == "" {
+		digest := sha256.Sum256(buf.Bytes())
+		sum = hex.EncodeToString(digest[:])
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/dump/SHA256SUMS", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Last-Modified", published.Add(time.Hour).Format(http.TimeFormat))
+		fmt.Fprintf(w, "# started %s\n", published.UTC().Format(time.RFC3339))
+		fmt.Fprintf(w, "%s  hkp-dump-8a.pgp\n", sum)
+	})
+	mux.HandleFunc("/dump/hkp-dump-8a.pgp", func(w http.ResponseWriter, r *http.Request) {
+		w.Write(buf.Bytes())
+	})
+	return httptest.NewServer(mux)
+}
+
+func (s *ReplicaSuite) TestBootstrap(c *gc.C) {
+	published := s.mtime.Add(12 * time.Hour)
+	dump := s.dumpServer(c, published, "")
+	defer dump.Close()
+
+	var replaced []*openpgp.PrimaryKey
+	local := mock.NewStorage(mock.Replace(func(key *openpgp.PrimaryKey) (string, error) {
+		replaced = append(replaced, key)
+		return "", nil
+	}))
+	stateFile := filepath.Join(c.MkDir(), "replica.json")
+	settings := &Settings{Primary: s.srv.URL, StateFile: stateFile, Bootstrap: dump.URL + "/dump/"}
+	f, err := NewFollower(local, settings, nil, "")
+	c.Assert(err, gc.IsNil)
+	c.Assert(f.bootstrapping(), gc.Equals, true)
+
+	// The bucket is loaded, then the feed followed from before the dump
+	// was published.
+	_, err = f.syncUnlessPaused(context.Background())
+	c.Assert(err, gc.IsNil)
+	c.Assert(replaced, gc.HasLen, 1)
+	c.Assert(replaced[0].MD5, gc.Equals, s.key.MD5)
+	c.Assert(s.primary.MethodCount("ModifiedAfter"), gc.Equals, 0)
+	c.Assert(f.bootstrapping(), gc.Equals, true)
+
+	_, err = f.syncUnlessPaused(context.Background())
+	c.Assert(err, gc.IsNil)
+	c.Assert(f.bootstrapping(), gc.Equals, false)
+	c.Assert(f.Position().MTime.Equal(published.Add(-bootstrapOverlap)), gc.Equals, true)
+
+	n, err := f.syncUnlessPaused(context.Background())
+	c.Assert(err, gc.IsNil)
+	c.Assert(n, gc.Equals, 1)
+	c.Assert(f.Position().RFingerprint, gc.Equals, s.key.RFingerprint)
+
+	// A restarted follower does not bootstrap again.
+	f, err = NewFollower(local, settings, nil, "")
+	c.Assert(err, gc.IsNil)
+	c.Assert(f.bootstrapping(), gc.Equals, false)
+}
+
+func (s *ReplicaSuite) TestBootstrapManifestChanged(c *gc.C) {
+	dump := s.dumpServer(c, s.mtime, "")
+	defer dump.Close()
+
+	// The bucket was loaded from an earlier dump, so it is loaded again.
+	stateFile := filepath.Join(c.MkDir(), "replica.json")
+	err := ioutil.WriteFile(stateFile, []byte(`{"buckets":["hkp-dump-8a.pgp"],"manifest":"00"}`), 0644)
+	c.Assert(err, gc.IsNil)
+	local := mock.NewStorage()
+	settings := &Settings{Primary: s.srv.URL, StateFile: stateFile, Bootstrap: dump.URL + "/dump"}
+	f, err := NewFollower(local, settings, nil, "")
+	c.Assert(err, gc.IsNil)
+	_, err = f.syncUnlessPaused(context.Background())
+	c.Assert(err, gc.IsNil)
+	c.Assert(local.MethodCount("Replace"), gc.Equals, 1)
+
+	// A restarted follower resumes the same dump.
+	f, err = NewFollower(local, settings, nil, "")
+	c.Assert(err, gc.IsNil)
+	c.Assert(f.bootstrapping(), gc.Equals, true)
+	_, err = f.syncUnlessPaused(context.Background())
+	c.Assert(err, gc.IsNil)
+	c.Assert(local.MethodCount("Replace"), gc.Equals, 1)
+	c.Assert(f.bootstrapping(), gc.Equals, false)
+	c.Assert(f.Position().MTime.Equal(s.mtime.Add(-bootstrapOverlap)), gc.Equals, true)
+}
+
+func (s *ReplicaSuite) TestBootstrapDigestMismatch(c *gc.C) {
+	dump := s.dumpServer(c, s.mtime, strings.Repeat("00", sha256.Size))
+	defer dump.Close()
+
+	local := mock.NewStorage()
+	f, err := NewFollower(local, &Settings{Primary: s.srv.URL, Bootstrap: dump.URL + "/dump"}, nil, "")
+	c.Assert(err, gc.IsNil)
+	_, err = f.syncUnlessPaused(context.Background())
+	c.Assert(err, gc.ErrorMatches, `.*bucket "hkp-dump-8a.pgp": digest does not match manifest`)
+	c.Assert(local.MethodCount("Replace"), gc.Equals, 0)
+	c.Assert(f.bootstrapping(), gc.Equals, true)
+}
+
+func (s *ReplicaSuite) TestInvalidPrimary(c *gc.C) {
+	_, err := NewFollower(mock.NewStorage(), &Settings{}, nil, "")
+	c.Assert(err, gc.ErrorMatches, "no primary configured")
+	_, err = NewFollower(mock.NewStorage(), &Settings{Primary: "hkp://example.com"}, nil, "")
+	c.Assert(err, gc.ErrorMatches, ".*scheme must be http or https")
+	_, err = NewFollower(mock.NewStorage(), &Settings{Primary: "http://example.com", Bootstrap: "/dump"}, nil, "")
+	c.Assert(err, gc.ErrorMatches, `invalid bootstrap URL "/dump"`)
+}
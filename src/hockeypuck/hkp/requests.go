@@ -19,15 +19,18 @@ package hkp
 
 import (
 	"bytes"
+	"crypto/md5"
 	"encoding/hex"
 	"io/ioutil"
 	"net/http"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/pkg/errors"
 
 	"hockeypuck/conflux/recon"
+	"hockeypuck/hkp/storage"
 )
 
 // Operation enumerates the supported HKP operations (op parameter) in the request.
@@ -58,6 +61,9 @@ const (
 	OptionMachineReadable = Option("mr")
 	OptionJSON            = Option("json")
 	OptionNotModifiable   = Option("nm")
+	OptionSlim            = Option("slim")
+	OptionAttested        = Option("attested")
+	OptionExcludeExpired  = Option("exclude-expired")
 )
 
 type OptionSet map[Option]bool
@@ -81,6 +87,61 @@ type Lookup struct {
 	Fingerprint bool
 	Exact       bool
 	Hash        bool
+
+	// Range restricts the keys found to those created and expiring within
+	// a time window. Index lookups may give a range without a search, to
+	// enumerate the keys in it.
+	Range storage.TimeRange
+}
+
+// ExactKeyID returns whether the lookup searches for a long key ID or a
+// fingerprint. Short key IDs are not exact, since they are easily
+// enumerated.
+func (l *Lookup) ExactKeyID() bool {
+	if !strings.HasPrefix(l.Search, "0x") {
+		return false
+	}
+	switch len(l.Search) - 2 {
+	case longKeyIDLen, fingerprintKeyIDLen:
+		return true
+	}
+	return false
+}
+
+// parseDate parses a date lookup parameter, either as a date or as an RFC
+// 3339 time. An empty parameter gives the zero time.
+func parseDate(name, s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse("2006-01-02", s); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return time.Time{}, errors.Errorf("invalid %s %q: expected YYYY-MM-DD or RFC 3339 time", name, s)
+	}
+	return t, nil
+}
+
+func parseTimeRange(req *http.Request) (storage.TimeRange, error) {
+	var r storage.TimeRange
+	for _, param := range []struct {
+		name string
+		t    *time.Time
+	}{
+		{"created_after", &r.CreatedAfter},
+		{"created_before", &r.CreatedBefore},
+		{"expires_after", &r.ExpiresAfter},
+		{"expires_before", &r.ExpiresBefore},
+	} {
+		t, err := parseDate(param.name, req.Form.Get(param.name))
+		if err != nil {
+			return r, err
+		}
+		*param.t = t
+	}
+	return r, nil
 }
 
 func ParseLookup(req *http.Request) (*Lookup, error) {
@@ -97,10 +158,16 @@ func ParseLookup(req *http.Request) (*Lookup, error) {
 		return nil, errors.Errorf("invalid operation %q", req.Form.Get("op"))
 	}
 
+	l.Range, err = parseTimeRange(req)
+	if err != nil {
+		return nil, err
+	}
+
 	if l.Op != OperationStats {
 		// OpenPGP HTTP Keyserver Protocol (HKP), Section 3.1.1
 		l.Search = req.Form.Get("search")
-		if l.Search == "" {
+		enumerate := !l.Range.IsZero() && (l.Op == OperationIndex || l.Op == OperationVIndex)
+		if l.Search == "" && !enumerate {
 			return nil, errors.Errorf("missing required parameter: search")
 		}
 	}
@@ -125,6 +192,10 @@ type Add struct {
 	Keysig  string
 	Replace bool
 	Options OptionSet
+
+	// Challenge, if set, is a challenge from /pks/challenge which Keysig
+	// signs, proving possession of the key submitted.
+	Challenge string
 }
 
 func ParseAdd(req *http.Request) (*Add, error) {
@@ -144,6 +215,10 @@ func ParseAdd(req *http.Request) (*Add, error) {
 		return nil, errors.Errorf("missing required parameter: keytext")
 	}
 	add.Keysig = req.Form.Get("keysig")
+	add.Challenge = req.Form.Get("challenge")
+	if add.Challenge != "" && add.Keysig == "" {
+		return nil, errors.Errorf("missing required parameter: keysig")
+	}
 	add.Replace, _ = strconv.ParseBool(req.Form.Get("replace"))
 
 	add.Options = ParseOptionSet(req.Form.Get("options"))
@@ -210,6 +285,78 @@ func ParseDelete(req *http.Request) (*Delete, error) {
 	return &del, nil
 }
 
+// Modified represents a valid /pks/modified request, which pages through
+// keyrings in the order they were modified.
+type Modified struct {
+	// After is the position of the last keyring already seen.
+	After storage.ModifiedKey
+
+	// Limit is the maximum number of keyrings to return.
+	Limit int
+
+	// Wait is how long to wait for a modification when there are none
+	// after the position.
+	Wait time.Duration
+}
+
+const (
+	DefaultModifiedLimit = 100
+	MaxModifiedLimit     = 1000
+	MaxModifiedWait      = time.Minute
+)
+
+func ParseModified(req *http.Request) (*Modified, error) {
+	if req.Method != "GET" {
+		return nil, errors.Errorf("invalid HTTP method: %s", req.Method)
+	}
+	err := req.ParseForm()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	m := Modified{Limit: DefaultModifiedLimit}
+	if s := req.Form.Get("after"); s != "" {
+		m.After.MTime, err = time.Parse(time.RFC3339Nano, s)
+		if err != nil {
+			return nil, errors.Errorf("invalid after: %q", s)
+		}
+	}
+	if s := req.Form.Get("rfp"); s != "" {
+		_, err = hex.DecodeString(s)
+		if err != nil {
+			return nil, errors.Errorf("invalid rfp: %q", s)
+		}
+		m.After.RFingerprint = strings.ToLower(s)
+	}
+	if s := req.Form.Get("md5"); s != "" {
+		digest, err := hex.DecodeString(s)
+		if err != nil || len(digest) != md5.Size {
+			return nil, errors.Errorf("invalid md5: %q", s)
+		}
+		m.After.MD5 = strings.ToLower(s)
+	}
+	if s := req.Form.Get("limit"); s != "" {
+		m.Limit, err = strconv.Atoi(s)
+		if err != nil || m.Limit <= 0 {
+			return nil, errors.Errorf("invalid limit: %q", s)
+		}
+		if m.Limit > MaxModifiedLimit {
+			m.Limit = MaxModifiedLimit
+		}
+	}
+	if s := req.Form.Get("wait"); s != "" {
+		secs, err := strconv.Atoi(s)
+		if err != nil || secs < 0 {
+			return nil, errors.Errorf("invalid wait: %q", s)
+		}
+		m.Wait = time.Duration(secs) * time.Second
+		if m.Wait > MaxModifiedWait {
+			m.Wait = MaxModifiedWait
+		}
+	}
+	return &m, nil
+}
+
 type HashQuery struct {
 	Digests []string
 }
@@ -21,6 +21,7 @@ import (
 	"bytes"
 	"net/http"
 	"net/url"
+	"time"
 
 	gc "gopkg.in/check.v1"
 )
@@ -103,6 +104,22 @@ func (s *RequestsSuite) TestMissingSearch(c *gc.C) {
 	c.Assert(err, gc.NotNil)
 }
 
+func (s *RequestsSuite) TestTimeRange(c *gc.C) {
+	testUrl, err := url.Parse("/pks/lookup?op=index&created_after=2020-01-01&expires_before=2025-01-01T12:00:00Z")
+	c.Assert(err, gc.IsNil)
+	lookup, err := ParseLookup(&http.Request{Method: "GET", URL: testUrl})
+	c.Assert(err, gc.IsNil)
+	c.Assert(lookup.Search, gc.Equals, "")
+	c.Assert(lookup.Range.CreatedAfter, gc.Equals, time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	c.Assert(lookup.Range.CreatedBefore.IsZero(), gc.Equals, true)
+	c.Assert(lookup.Range.ExpiresBefore, gc.Equals, time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC))
+
+	testUrl, err = url.Parse("/pks/lookup?op=index&search=alice&expires_after=2020-13-01")
+	c.Assert(err, gc.IsNil)
+	_, err = ParseLookup(&http.Request{Method: "GET", URL: testUrl})
+	c.Assert(err, gc.ErrorMatches, `invalid expires_after "2020-13-01".*`)
+}
+
 func (s *RequestsSuite) TestNoSuchOp(c *gc.C) {
 	// hockeypuck does not know how to do a barrel roll
 	testUrl, err := url.Parse("/pks/lookup?op=barrelroll")
@@ -158,3 +175,30 @@ func (s *RequestsSuite) TestAddMissingKey(c *gc.C) {
 	// error without keytext
 	c.Assert(err, gc.NotNil)
 }
+
+func (s *RequestsSuite) TestModified(c *gc.C) {
+	testUrl, err := url.Parse("/pks/modified?after=2020-01-01T00:00:00.5Z&rfp=ABCD&md5=0123456789ABCDEF0123456789ABCDEF&limit=5000&wait=3600")
+	c.Assert(err, gc.IsNil)
+	req := &http.Request{
+		Method: "GET",
+		URL:    testUrl}
+	m, err := ParseModified(req)
+	c.Assert(err, gc.IsNil)
+	c.Assert(m.After.MTime.UnixNano()%1e9, gc.Equals, int64(5e8))
+	c.Assert(m.After.RFingerprint, gc.Equals, "abcd")
+	c.Assert(m.After.MD5, gc.Equals, "0123456789abcdef0123456789abcdef")
+	c.Assert(m.Limit, gc.Equals, MaxModifiedLimit)
+	c.Assert(m.Wait, gc.Equals, MaxModifiedWait)
+}
+
+func (s *RequestsSuite) TestModifiedInvalid(c *gc.C) {
+	for _, query := range []string{"after=yesterday", "rfp=xyz", "md5=abcd", "limit=0", "wait=-1"} {
+		testUrl, err := url.Parse("/pks/modified?" + query)
+		c.Assert(err, gc.IsNil)
+		req := &http.Request{
+			Method: "GET",
+			URL:    testUrl}
+		_, err = ParseModified(req)
+		c.Assert(err, gc.NotNil, gc.Commentf("%s", query))
+	}
+}
@@ -0,0 +1,95 @@
+package hkp
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/openpgp/packet"
+
+	"hockeypuck/hkp/storage"
+	"hockeypuck/logging"
+	"hockeypuck/notify"
+	"hockeypuck/openpgp"
+)
+
+// revocationOnly returns whether a submission starts with a signature
+// rather than a key, as a revocation certificate does.
+func revocationOnly(keytext []byte) bool {
+	op, err := packet.NewOpaqueReader(bytes.NewReader(keytext)).Next()
+	return err == nil && op.Tag == 2 //packet.PacketTypeSignature
+}
+
+// addRevocations attaches standalone revocation certificates to the stored
+// keys which made them, so that a key can be revoked without resubmitting
+// it.
+func (h *Handler) addRevocations(w http.ResponseWriter, r *http.Request, keytext []byte) {
+	revs, err := openpgp.ReadRevocations(bytes.NewReader(keytext))
+	if err != nil {
+		httpError(w, r, http.StatusBadRequest, errors.WithStack(err))
+		return
+	}
+	release, ok := h.acquireIngest(w, r)
+	if !ok {
+		return
+	}
+	defer release()
+	var result AddResponse
+	for _, rev := range revs {
+		key, err := h.revokedKey(rev)
+		if storage.IsNotFound(err) {
+			httpError(w, r, http.StatusNotFound, errors.Errorf("key 0x%s not found", rev.IssuerKeyID()))
+			return
+		} else if err != nil {
+			httpError(w, r, http.StatusInternalServerError, errors.WithStack(err))
+			return
+		}
+		err = openpgp.AddRevocation(key, rev)
+		if err != nil {
+			httpError(w, r, http.StatusUnprocessableEntity, errors.WithStack(err))
+			return
+		}
+
+		change, err := storage.UpsertKey(h.storage, key, h.keyReaderOptions...)
+		if err != nil {
+			httpError(w, r, http.StatusInternalServerError, errors.WithStack(err))
+			return
+		}
+		h.publish(key.Fingerprint(), change, notify.SourceAdd)
+
+		fp := key.QualifiedFingerprint()
+		switch change.(type) {
+		case storage.KeyReplaced:
+			result.Updated = append(result.Updated, fp)
+		case storage.KeyNotChanged:
+			result.Ignored = append(result.Ignored, fp)
+		}
+	}
+	logger.WithFields(logging.RequestFields(r)).WithField("updated", result.Updated).Info("add revocation")
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	enc := json.NewEncoder(w)
+	enc.Encode(&result)
+}
+
+// revokedKey returns the stored key which issued rev.
+func (h *Handler) revokedKey(rev *openpgp.Revocation) (*openpgp.PrimaryKey, error) {
+	rfps, err := h.storage.Resolve([]string{rev.RIssuerKeyID})
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	keys, err := h.storage.FetchKeys(rfps)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	// The key ID may also match a subkey of another key.
+	for _, key := range keys {
+		if strings.HasPrefix(key.RFingerprint, rev.RIssuerKeyID) {
+			return key, nil
+		}
+	}
+	return nil, storage.ErrKeyNotFound
+}
@@ -0,0 +1,165 @@
+package hkp
+
+import (
+	"bytes"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/pkg/errors"
+
+	"hockeypuck/logging"
+	log "hockeypuck/logrus"
+	"hockeypuck/openpgp"
+)
+
+// Components of a key which may be included in a select response.
+const (
+	includeUserIDs        = "uids"
+	includeUserAttributes = "uats"
+	includeCertifications = "certs"
+	includeSubKeys        = "subkeys"
+)
+
+// Select responds with chosen components of a key, assembled into a minimal
+// certificate, for clients which cannot afford to fetch the whole key:
+//
+//	GET /pks/select?search=0x<fingerprint>[&include=uids,uats,certs,subkeys][&subkey=0x<id>...][&format=binary]
+//
+// The primary key with its self-signatures and its primary user ID are
+// always included, each component with only its revocations and latest
+// self-signature. The include parameter adds every user ID, the user
+// attributes, the certifications by other keys and every subkey. Each subkey
+// parameter adds the subkey with that fingerprint or long key ID; a key
+// without it is not found.
+func (h *Handler) Select(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	l := &Lookup{Op: OperationGet, Search: strings.ToLower(r.FormValue("search"))}
+	if !l.ExactKeyID() {
+		httpError(w, r, http.StatusBadRequest, errors.Errorf("invalid search %q: expected a fingerprint or long key ID", l.Search))
+		return
+	}
+	sel, variants, err := parseSelection(r)
+	if err != nil {
+		httpError(w, r, http.StatusBadRequest, err)
+		return
+	}
+	format := r.FormValue("format")
+	if format != "" && format != "armor" && format != "binary" {
+		httpError(w, r, http.StatusBadRequest, errors.Errorf("invalid format %q", format))
+		return
+	}
+
+	keys, err := h.keys(r, l)
+	if err != nil {
+		httpError(w, r, http.StatusInternalServerError, errors.WithStack(err))
+		return
+	}
+	if len(keys) == 0 {
+		httpError(w, r, http.StatusNotFound, errors.New("not found"))
+		return
+	}
+	h.checkHoneypots(r, keys)
+	if h.attestedOnly {
+		variants = append(variants, "attested")
+	}
+	tagVariants := variants
+	if format != "binary" && h.armorVariant != "" {
+		tagVariants = append(append([]string(nil), variants...), h.armorVariant)
+	}
+	etag := keysETag(keyDigests(keys), tagVariants...)
+	modTime := h.modTime(keys)
+
+	var length int
+	for _, key := range keys {
+		if h.attestedOnly {
+			err = openpgp.AttestedOnly(key)
+			if err != nil {
+				httpError(w, r, http.StatusInternalServerError, errors.WithStack(err))
+				return
+			}
+		}
+		length += key.SerializedLength()
+		err = openpgp.Select(key, sel)
+		if errors.Cause(err) == openpgp.ErrSubKeyNotFound {
+			httpError(w, r, http.StatusNotFound, errors.WithStack(err))
+			return
+		} else if err != nil {
+			httpError(w, r, http.StatusInternalServerError, errors.WithStack(err))
+			return
+		}
+	}
+
+	var buf bytes.Buffer
+	if format == "binary" {
+		w.Header().Set("Content-Type", "application/pgp-keys")
+		for _, key := range keys {
+			err = openpgp.WritePackets(&buf, key)
+			if err != nil {
+				break
+			}
+		}
+	} else {
+		w.Header().Set("Content-Type", "text/plain")
+		err = openpgp.WriteArmoredPackets(&buf, keys, h.keyWriterOptions...)
+		buf.WriteString("\n")
+	}
+	if err != nil {
+		httpError(w, r, http.StatusInternalServerError, errors.WithStack(err))
+		return
+	}
+	logger.WithFields(logging.RequestFields(r)).WithFields(log.Fields{
+		"search":   l.Search,
+		"include":  variants,
+		"length":   length,
+		"selected": buf.Len(),
+	}).Info("select")
+
+	w.Header().Set("ETag", etag)
+	http.ServeContent(w, r, "", modTime, bytes.NewReader(buf.Bytes()))
+}
+
+// parseSelection returns the components of a key chosen by a select
+// request, and the variants they make of the response, in a canonical
+// order.
+func parseSelection(r *http.Request) (*openpgp.Selection, []string, error) {
+	sel := &openpgp.Selection{}
+	var variants []string
+	for _, include := range r.Form["include"] {
+		for _, name := range strings.Split(include, ",") {
+			switch name = strings.TrimSpace(strings.ToLower(name)); name {
+			case includeUserIDs:
+				sel.UserIDs = true
+			case includeUserAttributes:
+				sel.UserAttributes = true
+			case includeCertifications:
+				sel.Certifications = true
+			case includeSubKeys:
+				sel.SubKeys = true
+			case "":
+				continue
+			default:
+				return nil, nil, errors.Errorf("invalid include %q", name)
+			}
+			variants = append(variants, name)
+		}
+	}
+	for _, id := range r.Form["subkey"] {
+		id = strings.ToLower(strings.TrimSpace(id))
+		switch len(strings.TrimPrefix(id, "0x")) {
+		case longKeyIDLen, fingerprintKeyIDLen:
+		default:
+			return nil, nil, errors.Errorf("invalid subkey %q: expected a fingerprint or long key ID", id)
+		}
+		sel.SubKeyIDs = append(sel.SubKeyIDs, id)
+		variants = append(variants, "subkey:"+strings.TrimPrefix(id, "0x"))
+	}
+	sort.Strings(variants)
+	var unique []string
+	for i, variant := range variants {
+		if i == 0 || variant != variants[i-1] {
+			unique = append(unique, variant)
+		}
+	}
+	return sel, append([]string{"select"}, unique...), nil
+}
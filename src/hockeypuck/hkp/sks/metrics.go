@@ -0,0 +1,126 @@
+package sks
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var sksMetrics = struct {
+	hashqueryFailure   *prometheus.CounterVec
+	keysRecovered      *prometheus.CounterVec
+	recoveryThrottled  *prometheus.CounterVec
+	recoveryPending    prometheus.Gauge
+	recoveryChunkSize  prometheus.Gauge
+	selfCheckDiffs     *prometheus.GaugeVec
+	selfCheckTimestamp prometheus.Gauge
+}{
+	hashqueryFailure: prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "hockeypuck",
+			Name:      "recovery_hashquery_failure",
+			Help:      "Count of failed hashquery requests to recon partners since startup",
+		},
+		[]string{"peer"},
+	),
+	keysRecovered: prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "hockeypuck",
+			Name:      "recovery_keys",
+			Help:      "Count of keys recovered from recon partners since startup",
+		},
+		[]string{"peer", "result"},
+	),
+	recoveryThrottled: prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "hockeypuck",
+			Name:      "recovery_throttled_seconds",
+			Help:      "Time spent waiting by recovery from recon partners to keep within its rate limits",
+		},
+		[]string{"peer"},
+	),
+	recoveryPending: prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: "hockeypuck",
+			Name:      "recovery_pending_keys",
+			Help:      "Keys the recovery in progress has yet to request from the recon partner",
+		},
+	),
+	recoveryChunkSize: prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: "hockeypuck",
+			Name:      "recovery_chunk_size",
+			Help:      "Keys requested in the last hashquery to a recon partner",
+		},
+	),
+	selfCheckDiffs: prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "hockeypuck",
+			Name:      "selfcheck_differences",
+			Help:      "Digests found missing from the prefix tree or storage by the last self check",
+		},
+		[]string{"missing_from"},
+	),
+	selfCheckTimestamp: prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: "hockeypuck",
+			Name:      "selfcheck_timestamp_seconds",
+			Help:      "Time the last self check of the prefix tree against storage finished",
+		},
+	),
+}
+
+var metricsRegister sync.Once
+
+func registerMetrics() {
+	metricsRegister.Do(func() {
+		prometheus.MustRegister(sksMetrics.hashqueryFailure)
+		prometheus.MustRegister(sksMetrics.keysRecovered)
+		prometheus.MustRegister(sksMetrics.recoveryThrottled)
+		prometheus.MustRegister(sksMetrics.recoveryPending)
+		prometheus.MustRegister(sksMetrics.recoveryChunkSize)
+		prometheus.MustRegister(sksMetrics.selfCheckDiffs)
+		prometheus.MustRegister(sksMetrics.selfCheckTimestamp)
+	})
+}
+
+func hostFromPeer(peer net.Addr) string {
+	if h, _, err := net.SplitHostPort(peer.String()); err == nil {
+		return h
+	}
+	return "unknown"
+}
+
+func recordHashqueryFailure(peer net.Addr) {
+	sksMetrics.hashqueryFailure.WithLabelValues(hostFromPeer(peer)).Inc()
+}
+
+func recordKeysRecovered(peer net.Addr, result *upsertResult) {
+	host := hostFromPeer(peer)
+	sksMetrics.keysRecovered.WithLabelValues(host, "inserted").Add(float64(result.inserted))
+	sksMetrics.keysRecovered.WithLabelValues(host, "updated").Add(float64(result.updated))
+	sksMetrics.keysRecovered.WithLabelValues(host, "unchanged").Add(float64(result.unchanged))
+	sksMetrics.keysRecovered.WithLabelValues(host, "rejected").Add(float64(result.rejected))
+}
+
+func recordRecoveryThrottled(peer net.Addr, waited time.Duration) {
+	if waited > 0 {
+		sksMetrics.recoveryThrottled.WithLabelValues(hostFromPeer(peer)).Add(waited.Seconds())
+	}
+}
+
+func recordRecoveryPending(n int) {
+	sksMetrics.recoveryPending.Set(float64(n))
+}
+
+func recordRecoveryChunkSize(n int) {
+	sksMetrics.recoveryChunkSize.Set(float64(n))
+}
+
+func recordSelfCheck(report *SelfCheckReport) {
+	sksMetrics.selfCheckDiffs.WithLabelValues("ptree").Set(float64(len(report.MissingFromPrefixTree)))
+	sksMetrics.selfCheckDiffs.WithLabelValues("storage").Set(float64(len(report.MissingFromStorage)))
+	sksMetrics.selfCheckTimestamp.SetToCurrentTime()
+}
@@ -19,35 +19,54 @@ package sks
 
 import (
 	"bytes"
+	"crypto/md5"
 	"encoding/hex"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"math/big"
 	"net"
 	"net/http"
 	"os"
 	"path/filepath"
+	"sync"
 	"time"
 
 	"github.com/hashicorp/golang-lru"
 	"github.com/pkg/errors"
 	"gopkg.in/tomb.v2"
 
+	"hockeypuck/clock"
 	cf "hockeypuck/conflux"
 	"hockeypuck/conflux/recon"
 	"hockeypuck/conflux/recon/leveldb"
+	"hockeypuck/hkp/digestcache"
 	"hockeypuck/hkp/storage"
+	"hockeypuck/ingest"
+	"hockeypuck/logging"
 	log "hockeypuck/logrus"
+	"hockeypuck/notify"
 	"hockeypuck/openpgp"
+	"hockeypuck/quarantine"
+	"hockeypuck/tracing"
 )
 
+var logger = logging.Module("recon")
+
 const (
 	RECON                  = "recon"
 	httpClientTimeout      = 30
 	maxKeyRecoveryAttempts = 10
-	maxRequestChunkSize    = 100
 	minRequestChunkSize    = 1
 	seenCacheSize          = 16384
+
+	// maxDeferredRecoverySize limits the bytes of recovered keys held back
+	// while the rest of a recovery is fetched.
+	maxDeferredRecoverySize = 64 << 20
+
+	// reconStallLimit is the least time for which recon may make no
+	// progress before the server is reported not ready.
+	reconStallLimit = 10 * time.Minute
 )
 
 type keyRecoveryCounter map[string]int
@@ -60,22 +79,39 @@ type Peer struct {
 	http             *http.Client
 	keyReaderOptions []openpgp.KeyReaderOption
 	userAgent        string
+	notifier         *notify.Dispatcher
+	ingest           *ingest.Scheduler
+	clock            clock.Clock
 
 	// Adaptive request size
 	requestChunkSize int
 	slowStart        bool
+	throttle         *recoveryThrottle
 
 	seenCache *lru.Cache
 
 	path  string
 	stats *Stats
 
-	t tomb.Tomb
+	selfCheck     selfCheckState
+	digestCache   *digestcache.Cache
+	quarantineDir string
+	rejected      rejectedRecovered
+
+	// muDie keeps goroutines from being started on the tomb once it is
+	// killed, which would panic after it has finished.
+	muDie sync.Mutex
+	t     tomb.Tomb
 }
 
 func NewPrefixTree(path string, s *recon.Settings) (recon.PrefixTree, error) {
+	// Keys are reconciled by their MD5 digests, which the field must
+	// represent.
+	if n := cf.DigestLen(s.Field.P()); n != md5.Size {
+		return nil, errors.Errorf("recon field holds %d-byte digests, keys have %d-byte MD5 digests", n, md5.Size)
+	}
 	if _, err := os.Stat(path); os.IsNotExist(err) {
-		log.Debugf("creating prefix tree at: %q", path)
+		logger.WithField("path", path).Debug("creating prefix tree")
 		err = os.MkdirAll(path, 0755)
 		if err != nil {
 			return nil, errors.WithStack(err)
@@ -110,31 +146,60 @@ func NewPeer(st storage.Storage, path string, s *recon.Settings, opts []openpgp.
 		settings: s,
 		ptree:    ptree,
 		http: &http.Client{
-			Timeout: httpClientTimeout * time.Second,
+			Timeout:   httpClientTimeout * time.Second,
+			Transport: &tracing.Transport{},
 		},
 		requestChunkSize: minRequestChunkSize,
 		slowStart:        true,
+		throttle:         newRecoveryThrottle(s.RecoveryBytesPerSec, s.RecoveryKeysPerSec),
 		seenCache:        cache,
 		keyReaderOptions: opts,
 		userAgent:        userAgent,
 		path:             path,
+		clock:            clock.Real(),
 	}
+	registerMetrics()
 	sksPeer.readStats()
 	st.Subscribe(sksPeer.updateDigests)
 	return sksPeer, nil
 }
 
+// SetClock sets the clock used for recon scheduling and statistics. It must
+// be called before Start.
+func (p *Peer) SetClock(c clock.Clock) {
+	p.clock = c
+	p.stats.SetClock(c)
+	p.peer.SetClock(c)
+}
+
+// SetNotifier sets the dispatcher which publishes keys added or updated by
+// recovery. It must be called before Start.
+func (p *Peer) SetNotifier(d *notify.Dispatcher) {
+	p.notifier = d
+}
+
+// SetIngestScheduler sets the scheduler which shares storage writes fairly
+// between recovery and other sources of key updates. It must be called
+// before Start.
+func (p *Peer) SetIngestScheduler(s *ingest.Scheduler) {
+	p.ingest = s
+}
+
 func (p *Peer) log(label string) *log.Entry {
 	return p.logFields(label, log.Fields{})
 }
 
 func (p *Peer) logAddr(label string, addr net.Addr) *log.Entry {
-	return p.logFields(label, log.Fields{"remoteAddr": addr})
+	fields := log.Fields{"remoteAddr": addr}
+	if name := p.peer.PartnerName(addr); name != "" {
+		fields["partner"] = name
+	}
+	return p.logFields(label, fields)
 }
 
 func (p *Peer) logFields(label string, fields log.Fields) *log.Entry {
 	fields["label"] = fmt.Sprintf("%s %s", label, p.settings.ReconAddr)
-	return log.WithFields(fields)
+	return logger.WithFields(fields)
 }
 
 func StatsFilename(path string) string {
@@ -170,12 +235,12 @@ func (p *Peer) writeStats() {
 }
 
 func (p *Peer) pruneStats() error {
-	timer := time.NewTimer(time.Hour)
+	timer := p.clock.NewTimer(time.Hour)
 	for {
 		select {
 		case <-p.t.Dying():
 			return nil
-		case <-timer.C:
+		case <-timer.C():
 			p.stats.prune()
 			timer.Reset(time.Hour)
 		}
@@ -186,15 +251,108 @@ func (r *Peer) Stats() *Stats {
 	return r.stats.clone()
 }
 
+// SetDigestCache checks the digests of key changes made by other servers
+// against c before querying storage, and evicts the digests they remove from
+// it. It must be called before Start.
+func (r *Peer) SetDigestCache(c *digestcache.Cache) {
+	r.digestCache = c
+}
+
+// SetQuarantine keeps keys recovered from recon partners which exceed the
+// key budget in dir, for operator review. It must be called before Start.
+func (r *Peer) SetQuarantine(dir string) {
+	r.quarantineDir = dir
+}
+
+// quarantine writes the binary packets of a key over the key budget to the
+// quarantine directory, if one is configured.
+func (r *Peer) quarantine(rcvr *recon.Recover, data []byte) {
+	if r.quarantineDir == "" {
+		return
+	}
+	path, written, err := quarantine.Write(r.quarantineDir, quarantine.Binary, data, r.clock.Now())
+	if err != nil {
+		r.logAddr(RECON, rcvr.RemoteAddr).WithField("error", err).Error("cannot quarantine key")
+		return
+	} else if !written {
+		r.logAddr(RECON, rcvr.RemoteAddr).WithField("path", path).Debug("key already quarantined")
+		return
+	}
+	r.logAddr(RECON, rcvr.RemoteAddr).WithField("path", path).Warning("key quarantined for review")
+}
+
+// CheckPrefixTree returns an error if the prefix tree cannot be read.
+func (r *Peer) CheckPrefixTree() error {
+	_, err := r.ptree.Root()
+	return errors.WithStack(err)
+}
+
+// CheckRecon returns an error if recon has made no progress for
+// reconStallLimit, or three gossip intervals if that is longer.
+func (r *Peer) CheckRecon() error {
+	limit := reconStallLimit
+	if gossip := 3 * time.Duration(r.settings.GossipIntervalSecs) * time.Second; gossip > limit {
+		limit = gossip
+	}
+	return errors.WithStack(r.peer.CheckProgress(limit))
+}
+
+// SetPartners replaces the recon partners of the running peer.
+func (r *Peer) SetPartners(partners recon.PartnerMap, allowCIDRs []string) error {
+	return errors.WithStack(r.peer.SetPartners(partners, allowCIDRs))
+}
+
+// Partners returns the currently configured recon partners.
+func (r *Peer) Partners() recon.PartnerMap {
+	return r.peer.Partners()
+}
+
+// PartnerStatus returns the status of recon with each configured partner,
+// by name.
+func (r *Peer) PartnerStatus() map[string]recon.PartnerStatus {
+	return r.peer.PartnerStatus()
+}
+
+// PTreeStats returns the prefix tree statistics collected by the last node
+// count, or nil if the nodes have not yet been counted.
+func (r *Peer) PTreeStats() *recon.PTreeStats {
+	return r.peer.PTreeStats()
+}
+
+// Audits returns the report of the last recon session with each partner
+// configured for audit, by name.
+func (r *Peer) Audits() map[string]recon.AuditReport {
+	return r.peer.Audits()
+}
+
+// Pause stops recon with partners, waiting for sessions in progress to
+// finish.
+func (r *Peer) Pause() {
+	r.log(RECON).Info("recon: pausing")
+	r.peer.Pause()
+	r.log(RECON).Info("recon: paused")
+}
+
+// Resume recon with partners after Pause.
+func (r *Peer) Resume() {
+	r.peer.Resume()
+	r.log(RECON).Info("recon: resumed")
+}
+
 func (r *Peer) Start() {
 	r.t.Go(r.handleRecovery)
 	r.t.Go(r.pruneStats)
+	if r.selfCheck.settings.Enabled() {
+		r.t.Go(r.selfCheckLoop)
+	}
 	r.peer.Start()
 }
 
 func (r *Peer) Stop() {
 	r.log(RECON).Info("recon processing: stopping")
+	r.muDie.Lock()
 	r.t.Kill(nil)
+	r.muDie.Unlock()
 	err := r.t.Wait()
 	if err != nil {
 		r.log(RECON).Errorf("%+v", err)
@@ -217,29 +375,36 @@ func (r *Peer) Stop() {
 }
 
 func DigestZp(digest string, zp *cf.Zp) error {
+	return DigestZpIn(cf.P_SKS, digest, zp)
+}
+
+// DigestZpIn sets zp to the element of the finite field p representing a key
+// digest.
+func DigestZpIn(p *big.Int, digest string, zp *cf.Zp) error {
 	buf, err := hex.DecodeString(digest)
 	if err != nil {
 		return errors.WithStack(err)
 	}
-	buf = recon.PadSksElement(buf)
-	zp.In(cf.P_SKS).SetBytes(buf)
-	zp.Norm()
-	return nil
+	return errors.WithStack(zp.In(p).SetDigestBytes(buf))
 }
 
 func (r *Peer) updateDigests(change storage.KeyChange) error {
 	r.stats.Update(change)
-	for _, digest := range change.InsertDigests() {
+	return r.applyDigests(change.InsertDigests(), change.RemoveDigests())
+}
+
+func (r *Peer) applyDigests(insert, remove []string) error {
+	for _, digest := range insert {
 		toInsert := make([]cf.Zp, 1)
-		err := DigestZp(digest, &toInsert[0])
+		err := DigestZpIn(r.settings.Field.P(), digest, &toInsert[0])
 		if err != nil {
 			return errors.Wrapf(err, "bad digest %q", digest)
 		}
 		r.peer.Insert(toInsert...)
 	}
-	for _, digest := range change.RemoveDigests() {
+	for _, digest := range remove {
 		toRemove := make([]cf.Zp, 1)
-		err := DigestZp(digest, &toRemove[0])
+		err := DigestZpIn(r.settings.Field.P(), digest, &toRemove[0])
 		if err != nil {
 			return errors.Wrapf(err, "bad digest %q", digest)
 		}
@@ -248,7 +413,50 @@ func (r *Peer) updateDigests(change storage.KeyChange) error {
 	return nil
 }
 
+// SyncChange updates the prefix tree for a key change made by another
+// server sharing the storage, such as a front end. Each digest is checked
+// against the storage, so that digests are only inserted if the storage
+// has them and only removed if it does not. Changes may therefore be
+// reported late, out of order or more than once. The digest cache is not
+// trusted for this, since a digest it holds may have been removed by a
+// change not yet reported.
+func (r *Peer) SyncChange(change storage.KeyChange) error {
+	var insert, remove []string
+	if r.digestCache != nil {
+		err := r.digestCache.KeyChanged(change)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	for _, digest := range change.InsertDigests() {
+		rfps, err := r.storage.MatchMD5([]string{digest})
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if len(rfps) > 0 {
+			insert = append(insert, digest)
+		}
+	}
+	for _, digest := range change.RemoveDigests() {
+		rfps, err := r.storage.MatchMD5([]string{digest})
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if len(rfps) == 0 {
+			remove = append(remove, digest)
+		}
+	}
+	if len(insert) == 0 && len(remove) == 0 {
+		return nil
+	}
+	if len(insert) == len(change.InsertDigests()) {
+		r.stats.Update(change)
+	}
+	return r.applyDigests(insert, remove)
+}
+
 func (r *Peer) handleRecovery() error {
+	r.resumeRecovery()
 	for {
 		select {
 		case <-r.t.Dying():
@@ -264,36 +472,134 @@ func (r *Peer) handleRecovery() error {
 	}
 }
 
+// unseenRemoteElements returns the elements to recover which have not lately
+// been recovered, nor rejected by the recovery policy of the partner.
 func (r *Peer) unseenRemoteElements(rcvr *recon.Recover) []cf.Zp {
 	unseenElements := make([]cf.Zp, 0)
 	for _, v := range rcvr.RemoteElements {
-		_, found := r.seenCache.Get(v.FullKeyHash())
-		if !found {
+		digest := v.FullKeyHash()
+		_, found := r.seenCache.Get(digest)
+		if !found && !r.rejectedDigest(rcvr.RemoteAddr, digest) {
 			unseenElements = append(unseenElements, v)
 		}
 	}
 	if len(unseenElements) < len(rcvr.RemoteElements) {
-		log.Infof("recovering %d instead of %d due to seenCache(%d)",
-			len(unseenElements), len(rcvr.RemoteElements), r.seenCache.Len())
+		r.logAddr(RECON, rcvr.RemoteAddr).WithFields(log.Fields{
+			"unseen":    len(unseenElements),
+			"remote":    len(rcvr.RemoteElements),
+			"seenCache": r.seenCache.Len(),
+		}).Info("skipping recently seen or rejected elements")
 	}
 	return unseenElements
 }
 
+// recoveryQueue holds recovered keys without revocations until the rest of
+// a recovery has been fetched, so that revocations propagate before the bulk
+// of a large backlog.
+type recoveryQueue struct {
+	keys []*openpgp.PrimaryKey
+	size int
+}
+
+func (q *recoveryQueue) add(keys []*openpgp.PrimaryKey, size int) {
+	q.keys = append(q.keys, keys...)
+	q.size += size
+}
+
+// flush merges the keys held in q.
+func (r *Peer) flush(rcvr *recon.Recover, q *recoveryQueue) {
+	if len(q.keys) == 0 {
+		return
+	}
+	summary := &upsertResult{}
+	for _, key := range q.keys {
+		err := r.upsertKey(rcvr, key, summary)
+		if err != nil {
+			r.logAddr(RECON, rcvr.RemoteAddr).WithFields(log.Fields{
+				"fp":    key.Fingerprint(),
+				"error": err,
+			}).Error("cannot upsert")
+		}
+	}
+	fields := r.logAddr(RECON, rcvr.RemoteAddr)
+	fields.Data["inserted"] = summary.inserted
+	fields.Data["updated"] = summary.updated
+	fields.Data["unchanged"] = summary.unchanged
+	fields.Infof("upsert deferred")
+	recordKeysRecovered(rcvr.RemoteAddr, summary)
+	q.keys, q.size = nil, 0
+}
+
 func (r *Peer) requestRecovered(rcvr *recon.Recover) error {
 	items := r.unseenRemoteElements(rcvr)
 	errCount := 0
+	deferred := &recoveryQueue{}
+	defer r.flush(rcvr, deferred)
+	maxChunkSize := r.settings.RecoveryChunkSize
+	if maxChunkSize < minRequestChunkSize {
+		maxChunkSize = recon.DefaultRecoveryChunkSize
+	}
+
+	// Recoveries of more than one chunk are saved as they progress, so
+	// that they carry on after a restart.
+	var saved time.Time
+	if len(items) > maxChunkSize {
+		r.logAddr(RECON, rcvr.RemoteAddr).WithField("keys", len(items)).Info("recovering")
+		r.checkpointRecovery(rcvr, items, deferred)
+		saved = r.clock.Now()
+		defer func() {
+			if !saved.IsZero() {
+				r.removeRecovery()
+			}
+		}()
+	}
+	defer recordRecoveryPending(0)
+	// interrupted leaves the rest of a saved recovery for after the restart.
+	interrupted := func() error {
+		if !saved.IsZero() {
+			r.checkpointRecovery(rcvr, items, deferred)
+			saved = time.Time{}
+		}
+		return nil
+	}
 	// Chunk requests to keep the hashquery message size and peer load reasonable.
 	// Using additive increase, multiplicative decrease (AIMD) to adapt chunk size,
 	// similar to TCP, including "slow start" (exponential increase at start when
 	// not yet in AIMD mode).
 	for len(items) > 0 {
+		recordRecoveryPending(len(items))
+		if !saved.IsZero() && r.clock.Now().Sub(saved) >= recoverySaveInterval {
+			r.checkpointRecovery(rcvr, items, deferred)
+			saved = r.clock.Now()
+		}
+		waited, ok := r.throttle.wait(r.clock, r.t.Dying())
+		if !ok || !r.t.Alive() {
+			return interrupted()
+		}
+		recordRecoveryThrottled(rcvr.RemoteAddr, waited)
+
 		chunksize := r.requestChunkSize
+		if chunksize > maxChunkSize {
+			chunksize = maxChunkSize
+		}
+		if max := r.throttle.maxKeys(); max > 0 && chunksize > max {
+			chunksize = max
+		}
 		if chunksize > len(items) {
 			chunksize = len(items)
 		}
 		chunk := items[:chunksize]
+		recordRecoveryChunkSize(chunksize)
 
-		err := r.requestChunk(rcvr, chunk)
+		err := r.requestChunk(rcvr, chunk, deferred)
+		if !r.t.Alive() {
+			// Keys of the chunk may have been dropped as the server
+			// stopped, so it is requested again after the restart.
+			return interrupted()
+		}
+		if deferred.size > maxDeferredRecoverySize {
+			r.flush(rcvr, deferred)
+		}
 		if err == nil || chunksize <= minRequestChunkSize {
 			// Advance chunk window if successful or already at minimum size.
 			// (If it failed, we will retry with a smaller chunk size.)
@@ -307,6 +613,7 @@ func (r *Peer) requestRecovered(rcvr *recon.Recover) error {
 				r.requestChunkSize = minRequestChunkSize
 			}
 			r.logAddr(RECON, rcvr.RemoteAddr).Errorf("failed to request chunk of %d keys, shrinking: %v", len(chunk), err)
+			recordHashqueryFailure(rcvr.RemoteAddr)
 			errCount += 1
 		} else {
 			if r.slowStart {
@@ -314,8 +621,8 @@ func (r *Peer) requestRecovered(rcvr *recon.Recover) error {
 			} else {
 				r.requestChunkSize += 1
 			}
-			if r.requestChunkSize > maxRequestChunkSize {
-				r.requestChunkSize = maxRequestChunkSize
+			if r.requestChunkSize > maxChunkSize {
+				r.requestChunkSize = maxChunkSize
 			}
 			for _, v := range chunk {
 				r.seenCache.Add(v.FullKeyHash(), nil)
@@ -329,7 +636,9 @@ func (r *Peer) requestRecovered(rcvr *recon.Recover) error {
 	return nil
 }
 
-func (r *Peer) requestChunk(rcvr *recon.Recover, chunk []cf.Zp) error {
+// requestChunk fetches the keys in chunk, merging those with revocations and
+// adding the rest to deferred.
+func (r *Peer) requestChunk(rcvr *recon.Recover, chunk []cf.Zp, deferred *recoveryQueue) error {
 	var remoteAddr string
 	remoteAddr, err := rcvr.HkpAddr()
 	if err != nil {
@@ -343,10 +652,7 @@ func (r *Peer) requestChunk(rcvr *recon.Recover, chunk []cf.Zp) error {
 		return errors.WithStack(err)
 	}
 	for i := range chunk {
-		zb := chunk[i].Bytes()
-		zb = recon.PadSksElement(zb)
-		// Hashquery elements are 16 bytes (length_of(P_SKS)-1)
-		zb = zb[:len(zb)-1]
+		zb := chunk[i].DigestBytes()
 		err = recon.WriteInt(hqBuf, len(zb))
 		if err != nil {
 			return errors.WithStack(err)
@@ -357,11 +663,18 @@ func (r *Peer) requestChunk(rcvr *recon.Recover, chunk []cf.Zp) error {
 		}
 	}
 
+	// Each hashquery is a span within the recon round which found the keys,
+	// whose trace is passed on so that the partner's logs of it may be
+	// matched with ours.
+	ctx, span := tracing.StartSpan(rcvr.Context, "recon.hashquery")
+	defer span.End()
+	span.SetAttribute("recon.keys", len(chunk))
 	url := fmt.Sprintf("http://%s/pks/hashquery", remoteAddr)
 	req, err := http.NewRequest("POST", url, bytes.NewReader(hqBuf.Bytes()))
 	if err != nil {
 		return errors.WithStack(err)
 	}
+	req = req.WithContext(ctx)
 	req.Header.Set("Content-type", "sks/hashquery")
 	if r.userAgent != "" {
 		req.Header.Set("User-agent", r.userAgent)
@@ -375,6 +688,7 @@ func (r *Peer) requestChunk(rcvr *recon.Recover, chunk []cf.Zp) error {
 	// read directly from it while loading.
 	var body *bytes.Buffer
 	bodyBuf, err := ioutil.ReadAll(resp.Body)
+	r.throttle.take(r.clock.Now(), len(bodyBuf), len(chunk))
 	if err != nil {
 		return errors.WithStack(err)
 	}
@@ -390,14 +704,17 @@ func (r *Peer) requestChunk(rcvr *recon.Recover, chunk []cf.Zp) error {
 	if err != nil {
 		return errors.WithStack(err)
 	}
-	r.logAddr(RECON, rcvr.RemoteAddr).Debugf("hashquery response from %q: %d keys found", remoteAddr, nkeys)
+	r.logAddr(RECON, rcvr.RemoteAddr).WithFields(tracing.Fields(ctx)).Debugf("hashquery response from %q: %d keys found", remoteAddr, nkeys)
 	summary := &upsertResult{}
+	policy := r.recoveryPolicy(rcvr.RemoteAddr)
 	defer func() {
 		fields := r.logAddr(RECON, rcvr.RemoteAddr)
 		fields.Data["inserted"] = summary.inserted
 		fields.Data["updated"] = summary.updated
 		fields.Data["unchanged"] = summary.unchanged
+		fields.Data["rejected"] = summary.rejected
 		fields.Infof("upsert")
+		recordKeysRecovered(rcvr.RemoteAddr, summary)
 	}()
 	for i := 0; i < nkeys; i++ {
 		keyLen, err = recon.ReadInt(body)
@@ -410,13 +727,46 @@ func (r *Peer) requestChunk(rcvr *recon.Recover, chunk []cf.Zp) error {
 			return errors.WithStack(err)
 		}
 		r.logAddr(RECON, rcvr.RemoteAddr).Debugf("key# %d: %d bytes", i+1, keyLen)
-		// Merge locally
-		res, err := r.upsertKeys(rcvr, keyBuf.Bytes())
+		keyData := keyBuf.Bytes()
+		keys, err := openpgp.NewKeyReader(keyBuf, r.keyReaderOptions...).ReadContext(r.t.Context(nil))
 		if err != nil {
-			r.logAddr(RECON, rcvr.RemoteAddr).Errorf("cannot upsert: %v", err)
+			r.logAddr(RECON, rcvr.RemoteAddr).WithField("error", err).Error("cannot read key")
+			if errors.Is(err, openpgp.ErrBudgetExceeded) {
+				r.quarantine(rcvr, keyData)
+			}
 			continue
 		}
-		summary.add(res)
+		// Merge revocations locally now, the rest once the recovery has
+		// been fetched.
+		var rest []*openpgp.PrimaryKey
+		for _, key := range keys {
+			digest := key.MD5
+			reason, err := rejectRecovered(policy, key)
+			if reason != "" {
+				r.rejectDigest(rcvr.RemoteAddr, digest)
+			}
+			if err != nil || reason != "" {
+				r.logAddr(RECON, rcvr.RemoteAddr).WithFields(log.Fields{
+					"fp":     key.Fingerprint(),
+					"reason": reason,
+					"error":  err,
+				}).Warning("rejected key from partner")
+				summary.rejected++
+				continue
+			}
+			if !openpgp.HasRevocation(key) {
+				rest = append(rest, key)
+				continue
+			}
+			err = r.upsertKey(rcvr, key, summary)
+			if err != nil {
+				r.logAddr(RECON, rcvr.RemoteAddr).WithFields(log.Fields{
+					"fp":    key.Fingerprint(),
+					"error": err,
+				}).Error("cannot upsert")
+			}
+		}
+		deferred.add(rest, keyLen)
 	}
 	// Read last two bytes (CRLF, why?), or SKS will complain.
 	body.Read(make([]byte, 2))
@@ -427,39 +777,44 @@ type upsertResult struct {
 	inserted  int
 	updated   int
 	unchanged int
+	rejected  int
 }
 
-func (r *upsertResult) add(r2 *upsertResult) {
-	r.inserted += r2.inserted
-	r.updated += r2.updated
-	r.unchanged += r2.unchanged
-}
-
-func (r *Peer) upsertKeys(rcvr *recon.Recover, buf []byte) (*upsertResult, error) {
-	kr := openpgp.NewKeyReader(bytes.NewBuffer(buf), r.keyReaderOptions...)
-	keys, err := kr.Read()
+// upsertKey merges a recovered key into storage. Keys which exceed the key
+// budget are quarantined.
+func (r *Peer) upsertKey(rcvr *recon.Recover, key *openpgp.PrimaryKey, result *upsertResult) (err error) {
+	defer func() {
+		if errors.Is(err, openpgp.ErrBudgetExceeded) {
+			var buf bytes.Buffer
+			if openpgp.WritePackets(&buf, key) == nil {
+				r.quarantine(rcvr, buf.Bytes())
+			}
+		}
+	}()
+	ctx, cancel := openpgp.WithKeyBudget(r.t.Context(nil), r.keyReaderOptions...)
+	err = openpgp.DropDuplicatesContext(ctx, key)
+	cancel()
 	if err != nil {
-		return nil, errors.WithStack(err)
+		return errors.WithStack(err)
 	}
-	result := &upsertResult{}
-	for _, key := range keys {
-		err := openpgp.DropDuplicates(key)
-		if err != nil {
-			return nil, errors.WithStack(err)
-		}
-		keyChange, err := storage.UpsertKey(r.storage, key)
-		if err != nil {
-			return nil, errors.WithStack(err)
-		}
-		r.logAddr(RECON, rcvr.RemoteAddr).Debug(keyChange)
-		switch keyChange.(type) {
-		case storage.KeyAdded:
-			result.inserted++
-		case storage.KeyReplaced:
-			result.updated++
-		case storage.KeyNotChanged:
-			result.unchanged++
-		}
+	release, err := r.ingest.Acquire(r.t.Context(nil), ingest.ClassRecon)
+	if err != nil {
+		return errors.WithStack(err)
 	}
-	return result, nil
+	keyChange, err := storage.UpsertKey(r.storage, key, r.keyReaderOptions...)
+	release()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	r.logAddr(RECON, rcvr.RemoteAddr).WithField("fp", key.Fingerprint()).Debug(keyChange)
+	r.notifier.Publish(key.Fingerprint(), keyChange, notify.SourceRecon)
+	switch keyChange.(type) {
+	case storage.KeyAdded:
+		result.inserted++
+	case storage.KeyReplaced:
+		result.updated++
+	case storage.KeyNotChanged:
+		result.unchanged++
+	}
+	return nil
 }
@@ -18,14 +18,30 @@
 package sks
 
 import (
+	"bytes"
+	"crypto/md5"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
 
 	gc "gopkg.in/check.v1"
 
+	"hockeypuck/clock"
+	cf "hockeypuck/conflux"
 	"hockeypuck/conflux/recon"
+	"hockeypuck/hkp/digestcache"
 	"hockeypuck/hkp/storage"
 	"hockeypuck/hkp/storage/mock"
+	"hockeypuck/openpgp"
+	hkptesting "hockeypuck/testing"
 )
 
 func Test(t *testing.T) { gc.TestingT(t) }
@@ -46,12 +62,13 @@ func (s *SksSuite) SetUpTest(c *gc.C) {
 }
 
 func (s *SksSuite) TestPeerStats(c *gc.C) {
+	now := time.Date(2020, 6, 1, 12, 59, 59, 0, time.UTC)
+	s.peer.SetClock(clock.NewFake(now))
 	s.peer.Start()
 	s.peer.updateDigests(storage.KeyAdded{Digest: "decafbad"})
 	s.peer.Stop()
-	// TODO: patchable time.Now to test boundaries.
-	thisHour := time.Now().UTC().Truncate(time.Hour)
-	thisDay := time.Now().UTC().Truncate(24 * time.Hour)
+	thisHour := now.Truncate(time.Hour)
+	thisDay := now.Truncate(24 * time.Hour)
 	c.Assert(s.peer.stats.Total, gc.Equals, 1)
 	c.Assert(s.peer.stats.Hourly, gc.HasLen, 1)
 	c.Assert(s.peer.stats.Daily, gc.HasLen, 1)
@@ -67,3 +84,400 @@ func (s *SksSuite) TestPeerStats(c *gc.C) {
 	c.Assert(s.peer.stats.Daily[thisDay].Inserted, gc.Equals, 1)
 	c.Assert(s.peer.stats.Daily[thisDay].Updated, gc.Equals, 1)
 }
+
+func (s *SksSuite) TestSelfCheckAfterStop(c *gc.C) {
+	s.peer.Start()
+	s.peer.Stop()
+	// Starting a check once the peer has stopped would panic its tomb.
+	c.Assert(s.peer.StartSelfCheck(false), gc.Equals, false)
+	c.Assert(s.peer.LastSelfCheck(), gc.IsNil)
+}
+
+func (s *SksSuite) TestSyncChange(c *gc.C) {
+	stored := map[string]bool{"decafbaddecafbaddecafbaddecafbad": true}
+	st := mock.NewStorage(mock.MatchMD5(func(digests []string) ([]string, error) {
+		if stored[digests[0]] {
+			return []string{"rfp"}, nil
+		}
+		return nil, nil
+	}))
+	peer, err := NewPeer(st, c.MkDir(), recon.DefaultSettings(), nil, "")
+	c.Assert(err, gc.IsNil)
+
+	err = peer.SyncChange(storage.KeyAdded{Digest: "decafbaddecafbaddecafbaddecafbad"})
+	c.Assert(err, gc.IsNil)
+	c.Assert(peer.stats.Total, gc.Equals, 1)
+
+	// Not in storage, as when an addition is reported after the key was
+	// replaced.
+	err = peer.SyncChange(storage.KeyAdded{Digest: "cafebabecafebabecafebabecafebabe"})
+	c.Assert(err, gc.IsNil)
+	c.Assert(peer.stats.Total, gc.Equals, 1)
+
+	// Still in storage, so the old digest is kept.
+	err = peer.SyncChange(storage.KeyReplaced{OldDigest: "decafbaddecafbaddecafbaddecafbad", NewDigest: "cafebabecafebabecafebabecafebabe"})
+	c.Assert(err, gc.IsNil)
+	c.Assert(peer.stats.Total, gc.Equals, 1)
+	c.Assert(st.MethodCount("MatchMD5"), gc.Equals, 4)
+
+	err = peer.SyncChange(storage.KeyAdded{Digest: "not hex"})
+	c.Assert(err, gc.IsNil)
+	stored["not hex"] = true
+	err = peer.SyncChange(storage.KeyAdded{Digest: "not hex"})
+	c.Assert(err, gc.ErrorMatches, `bad digest "not hex".*`)
+}
+
+func (s *SksSuite) TestSyncChangeDigestCache(c *gc.C) {
+	st := mock.NewStorage(mock.MatchMD5(func(digests []string) ([]string, error) {
+		return nil, nil
+	}))
+	peer, err := NewPeer(st, c.MkDir(), recon.DefaultSettings(), nil, "")
+	c.Assert(err, gc.IsNil)
+	cache, err := digestcache.New(digestcache.DefaultSettings())
+	c.Assert(err, gc.IsNil)
+	peer.SetDigestCache(cache)
+
+	// Cached digests are still checked against storage, which may have
+	// removed them since.
+	cache.Put(cache.Generation(), "rfp", "decafbaddecafbaddecafbaddecafbad")
+	err = peer.SyncChange(storage.KeyAdded{Digest: "decafbaddecafbaddecafbaddecafbad"})
+	c.Assert(err, gc.IsNil)
+	c.Assert(peer.stats.Total, gc.Equals, 0)
+	c.Assert(st.MethodCount("MatchMD5"), gc.Equals, 1)
+
+	// Digests removed by the change are evicted.
+	err = peer.SyncChange(storage.KeyRemoved{Digest: "decafbaddecafbaddecafbaddecafbad"})
+	c.Assert(err, gc.IsNil)
+	c.Assert(cache.Len(), gc.Equals, 0)
+	c.Assert(st.MethodCount("MatchMD5"), gc.Equals, 2)
+}
+
+func (s *SksSuite) TestPeerStatsBoundaries(c *gc.C) {
+	start := time.Date(2020, 6, 1, 23, 59, 59, 0, time.UTC)
+	fake := clock.NewFake(start)
+	s.peer.SetClock(fake)
+
+	s.peer.updateDigests(storage.KeyAdded{Digest: "decafbad"})
+	fake.Advance(time.Second)
+	s.peer.updateDigests(storage.KeyAdded{Digest: "cafebabe"})
+	stats := s.peer.Stats()
+	c.Assert(stats.Hourly, gc.HasLen, 2)
+	c.Assert(stats.Daily, gc.HasLen, 2)
+	c.Assert(stats.Hourly[start.Truncate(time.Hour)].Inserted, gc.Equals, 1)
+	c.Assert(stats.Daily[start.Add(time.Second)].Inserted, gc.Equals, 1)
+
+	// Hourly statistics are kept for a day and daily statistics for a week.
+	fake.Advance(24 * time.Hour)
+	s.peer.stats.prune()
+	stats = s.peer.Stats()
+	c.Assert(stats.Hourly, gc.HasLen, 1)
+	c.Assert(stats.Daily, gc.HasLen, 2)
+
+	fake.Advance(time.Hour)
+	s.peer.stats.prune()
+	stats = s.peer.Stats()
+	c.Assert(stats.Hourly, gc.HasLen, 0)
+	c.Assert(stats.Daily, gc.HasLen, 2)
+
+	fake.Advance(7 * 24 * time.Hour)
+	s.peer.stats.prune()
+	c.Assert(s.peer.Stats().Daily, gc.HasLen, 0)
+}
+
+func mustInputKey(name string) *openpgp.PrimaryKey {
+	return openpgp.MustReadArmorKeys(hkptesting.MustInput(name))[0]
+}
+
+func (s *SksSuite) TestRecoverRevocationsFirst(c *gc.C) {
+	// The partner answers the first hashquery with a key without
+	// revocations and the second with a revoked key.
+	var responses [][]byte
+	for _, name := range []string{"alice_signed.asc", "test-key-revoked.asc"} {
+		var keyBuf, resp bytes.Buffer
+		c.Assert(openpgp.WritePackets(&keyBuf, mustInputKey(name)), gc.IsNil)
+		c.Assert(recon.WriteInt(&resp, 1), gc.IsNil)
+		c.Assert(recon.WriteInt(&resp, keyBuf.Len()), gc.IsNil)
+		resp.Write(keyBuf.Bytes())
+		resp.WriteString("\r\n")
+		responses = append(responses, resp.Bytes())
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(responses[0])
+		responses = responses[1:]
+	}))
+	defer srv.Close()
+	addr := srv.Listener.Addr().(*net.TCPAddr)
+
+	st := mock.NewStorage()
+	s.peer.storage = st
+	s.peer.requestChunkSize = 1
+	s.peer.slowStart = false
+	err := s.peer.requestRecovered(&recon.Recover{
+		RemoteAddr:     addr,
+		RemoteConfig:   &recon.Config{HTTPPort: addr.Port},
+		RemoteElements: []cf.Zp{*cf.Zi(cf.P_SKS, 1), *cf.Zi(cf.P_SKS, 2)},
+	})
+	c.Assert(err, gc.IsNil)
+
+	var inserted []string
+	for _, call := range st.Calls {
+		if call.Name == "Insert" {
+			keys := call.Args[0].([]*openpgp.PrimaryKey)
+			inserted = append(inserted, keys[0].ShortID())
+		}
+	}
+	c.Assert(inserted, gc.HasLen, 2)
+	c.Assert(inserted[0], gc.Equals, mustInputKey("test-key-revoked.asc").ShortID())
+	c.Assert(inserted[1], gc.Equals, mustInputKey("alice_signed.asc").ShortID())
+}
+
+func (s *SksSuite) TestRecoveryResume(c *gc.C) {
+	key := mustInputKey("alice_signed.asc")
+	var keyBuf, resp bytes.Buffer
+	c.Assert(openpgp.WritePackets(&keyBuf, key), gc.IsNil)
+	c.Assert(recon.WriteInt(&resp, 1), gc.IsNil)
+	c.Assert(recon.WriteInt(&resp, keyBuf.Len()), gc.IsNil)
+	resp.Write(keyBuf.Bytes())
+	resp.WriteString("\r\n")
+	var requests int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if requests == 1 {
+			s.peer.t.Kill(nil)
+		}
+		w.Write(resp.Bytes())
+	}))
+	defer srv.Close()
+	addr := srv.Listener.Addr().(*net.TCPAddr)
+	elements := []cf.Zp{*cf.Zi(cf.P_SKS, 1), *cf.Zi(cf.P_SKS, 2), *cf.Zi(cf.P_SKS, 3)}
+
+	// The server stops as the first chunk is fetched.
+	s.peer.settings.RecoveryChunkSize = 1
+	err := s.peer.requestRecovered(&recon.Recover{
+		RemoteAddr:     addr,
+		RemoteConfig:   &recon.Config{HTTPPort: addr.Port},
+		RemoteElements: elements,
+	})
+	c.Assert(err, gc.IsNil)
+	c.Assert(requests, gc.Equals, 1)
+
+	rcvr, err := s.peer.savedRecovery()
+	c.Assert(err, gc.IsNil)
+	c.Assert(rcvr, gc.NotNil)
+	c.Assert(rcvr.RemoteAddr.String(), gc.Equals, addr.String())
+	c.Assert(rcvr.RemoteConfig.HTTPPort, gc.Equals, addr.Port)
+	var digests []string
+	for _, zp := range rcvr.RemoteElements {
+		digests = append(digests, zp.FullKeyHash())
+	}
+	c.Assert(digests, gc.DeepEquals, []string{elements[0].FullKeyHash(), elements[1].FullKeyHash(), elements[2].FullKeyHash()})
+
+	// The restarted server carries on where it left off.
+	c.Assert(s.peer.ptree.Close(), gc.IsNil)
+	settings := recon.DefaultSettings()
+	settings.RecoveryChunkSize = 1
+	peer, err := NewPeer(mock.NewStorage(), s.peer.path, settings, nil, "")
+	c.Assert(err, gc.IsNil)
+	peer.resumeRecovery()
+	c.Assert(requests, gc.Equals, 4)
+	rcvr, err = peer.savedRecovery()
+	c.Assert(err, gc.IsNil)
+	c.Assert(rcvr, gc.IsNil)
+
+	// Keys fetched but not yet stored are requested again.
+	deferred := &recoveryQueue{}
+	deferred.add([]*openpgp.PrimaryKey{key}, keyBuf.Len())
+	err = peer.saveRecovery(&recon.Recover{
+		RemoteAddr:   addr,
+		RemoteConfig: &recon.Config{HTTPPort: addr.Port},
+	}, elements[2:], deferred)
+	c.Assert(err, gc.IsNil)
+	rcvr, err = peer.savedRecovery()
+	c.Assert(err, gc.IsNil)
+	c.Assert(rcvr.RemoteElements, gc.HasLen, 2)
+	c.Assert(rcvr.RemoteElements[0].FullKeyHash(), gc.Equals, key.MD5)
+	c.Assert(rcvr.RemoteElements[1].FullKeyHash(), gc.Equals, elements[2].FullKeyHash())
+	c.Assert(peer.ptree.Close(), gc.IsNil)
+}
+
+func (s *SksSuite) TestRecoveryPolicy(c *gc.C) {
+	names := []string{"alice_signed.asc", "badselfsig.asc", "test-key-revoked.asc"}
+	var resp bytes.Buffer
+	c.Assert(recon.WriteInt(&resp, len(names)), gc.IsNil)
+	for _, name := range names {
+		var keyBuf bytes.Buffer
+		c.Assert(openpgp.WritePackets(&keyBuf, mustInputKey(name)), gc.IsNil)
+		c.Assert(recon.WriteInt(&resp, keyBuf.Len()), gc.IsNil)
+		resp.Write(keyBuf.Bytes())
+	}
+	resp.WriteString("\r\n")
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(resp.Bytes())
+	}))
+	defer srv.Close()
+	addr := srv.Listener.Addr().(*net.TCPAddr)
+
+	err := s.peer.SetPartners(recon.PartnerMap{
+		"mallory": recon.Partner{
+			HTTPAddr:  srv.Listener.Addr().String(),
+			ReconAddr: net.JoinHostPort(addr.IP.String(), "11370"),
+			Recovery: recon.RecoveryPolicy{
+				Blacklist:       []string{strings.ToUpper(mustInputKey("test-key-revoked.asc").Fingerprint())},
+				RequireSelfSigs: true,
+			},
+		},
+	}, nil)
+	c.Assert(err, gc.IsNil)
+	st := mock.NewStorage()
+	s.peer.storage = st
+	s.peer.requestChunkSize = 3
+	err = s.peer.requestRecovered(&recon.Recover{
+		RemoteAddr:     addr,
+		RemoteConfig:   &recon.Config{HTTPPort: addr.Port},
+		RemoteElements: []cf.Zp{*cf.Zi(cf.P_SKS, 1), *cf.Zi(cf.P_SKS, 2), *cf.Zi(cf.P_SKS, 3)},
+	})
+	c.Assert(err, gc.IsNil)
+
+	var inserted []string
+	for _, call := range st.Calls {
+		if call.Name == "Insert" {
+			keys := call.Args[0].([]*openpgp.PrimaryKey)
+			inserted = append(inserted, keys[0].ShortID())
+		}
+	}
+	c.Assert(inserted, gc.DeepEquals, []string{mustInputKey("alice_signed.asc").ShortID()})
+
+	// Rejected keys are not requested from the partner again.
+	c.Assert(s.peer.rejectedDigest(addr, mustInputKey("badselfsig.asc").MD5), gc.Equals, true)
+	c.Assert(s.peer.rejectedDigest(addr, mustInputKey("test-key-revoked.asc").MD5), gc.Equals, true)
+	c.Assert(s.peer.rejectedDigest(addr, mustInputKey("alice_signed.asc").MD5), gc.Equals, false)
+}
+
+func (s *SksSuite) TestRejectedDigestExpiry(c *gc.C) {
+	fake := clock.NewFake(time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC))
+	s.peer.SetClock(fake)
+	err := s.peer.SetPartners(recon.PartnerMap{
+		"mallory": recon.Partner{HTTPAddr: "147.26.10.11:11371", ReconAddr: "147.26.10.11:11370"},
+	}, nil)
+	c.Assert(err, gc.IsNil)
+	mallory := &net.TCPAddr{IP: net.ParseIP("147.26.10.11"), Port: 11370}
+	other := &net.TCPAddr{IP: net.ParseIP("147.26.10.12"), Port: 11370}
+
+	s.peer.rejectDigest(mallory, "decafbad")
+	s.peer.rejectDigest(other, "deadbeef")
+	c.Assert(s.peer.rejectedDigest(mallory, "decafbad"), gc.Equals, true)
+	c.Assert(s.peer.rejectedDigest(other, "decafbad"), gc.Equals, false)
+	// Peers which are not partners have no recovery policy.
+	c.Assert(s.peer.rejectedDigest(other, "deadbeef"), gc.Equals, false)
+
+	fake.Advance(rejectedRecoveryTTL)
+	c.Assert(s.peer.rejectedDigest(mallory, "decafbad"), gc.Equals, false)
+}
+
+func (s *SksSuite) TestRejectRecoveredLength(c *gc.C) {
+	key := mustInputKey("alice_signed.asc")
+	n := key.SerializedLength()
+	reason, err := rejectRecovered(recon.RecoveryPolicy{MaxKeyLength: n}, key)
+	c.Assert(err, gc.IsNil)
+	c.Assert(reason, gc.Equals, "")
+	reason, err = rejectRecovered(recon.RecoveryPolicy{MaxKeyLength: n - 1}, key)
+	c.Assert(err, gc.IsNil)
+	c.Assert(reason, gc.Equals, fmt.Sprintf("key length %d exceeds %d", n, n-1))
+}
+
+func (s *SksSuite) TestRecoveryThrottle(c *gc.C) {
+	now := time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC)
+	fake := clock.NewFake(now)
+	t := newRecoveryThrottle(1000, 10)
+	c.Assert(t.maxKeys(), gc.Equals, 10)
+
+	// The first chunk is not delayed.
+	waited, ok := t.wait(fake, nil)
+	c.Assert(ok, gc.Equals, true)
+	c.Assert(waited, gc.Equals, time.Duration(0))
+
+	// 20 keys take longer than 500 bytes, and delays accumulate.
+	t.take(now, 500, 20)
+	c.Assert(t.ready, gc.Equals, now.Add(2*time.Second))
+	t.take(now, 3000, 1)
+	c.Assert(t.ready, gc.Equals, now.Add(5*time.Second))
+
+	dying := make(chan struct{})
+	close(dying)
+	_, ok = t.wait(fake, dying)
+	c.Assert(ok, gc.Equals, false)
+
+	// Time spent since counts towards the delay, but does not accumulate.
+	fake.Advance(10 * time.Second)
+	waited, ok = t.wait(fake, nil)
+	c.Assert(ok, gc.Equals, true)
+	c.Assert(waited, gc.Equals, time.Duration(0))
+	t.take(fake.Now(), 100, 1)
+	c.Assert(t.ready, gc.Equals, now.Add(10*time.Second+100*time.Millisecond))
+}
+
+func (s *SksSuite) TestSelfCheck(c *gc.C) {
+	var rows []storage.ModifiedKey
+	stored := map[string]bool{}
+	mtime := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 200; i++ {
+		digest := fmt.Sprintf("%x", md5.Sum([]byte(strconv.Itoa(i))))
+		rows = append(rows, storage.ModifiedKey{RFingerprint: strconv.Itoa(i), MTime: mtime, MD5: digest})
+		stored[digest] = true
+	}
+	// Stored after the walk, so not a difference.
+	late := fmt.Sprintf("%x", md5.Sum([]byte("late")))
+	stored[late] = true
+	st := mock.NewStorage(
+		mock.ModifiedAfter(func(after storage.ModifiedKey, limit int) ([]storage.ModifiedKey, error) {
+			if !after.MTime.IsZero() {
+				return nil, nil
+			}
+			return rows, nil
+		}),
+		mock.MatchMD5(func(digests []string) ([]string, error) {
+			if stored[digests[0]] {
+				return []string{"rfp"}, nil
+			}
+			return nil, nil
+		}),
+	)
+	peer, err := NewPeer(st, filepath.Join(c.MkDir(), "ptree"), recon.DefaultSettings(), nil, "")
+	c.Assert(err, gc.IsNil)
+	defer peer.ptree.Close()
+
+	stray := []string{
+		fmt.Sprintf("%x", md5.Sum([]byte("stray1"))),
+		fmt.Sprintf("%x", md5.Sum([]byte("stray2"))),
+	}
+	var insert []string
+	for _, row := range rows[2:] {
+		insert = append(insert, row.MD5)
+	}
+	insert = append(insert, late)
+	insert = append(insert, stray...)
+	c.Assert(peer.applyDigests(insert, nil), gc.IsNil)
+	peer.peer.Flush()
+
+	report, err := peer.SelfCheck(false)
+	c.Assert(err, gc.IsNil)
+	c.Assert(report.Keys, gc.Equals, 200)
+	missing := []string{rows[0].MD5, rows[1].MD5}
+	sort.Strings(missing)
+	sort.Strings(stray)
+	c.Assert(report.MissingFromPrefixTree, gc.DeepEquals, missing)
+	c.Assert(report.MissingFromStorage, gc.DeepEquals, stray)
+	c.Assert(report.Repaired, gc.Equals, false)
+
+	report, err = peer.SelfCheck(true)
+	c.Assert(err, gc.IsNil)
+	c.Assert(report.Repaired, gc.Equals, true)
+	peer.peer.Flush()
+
+	report, err = peer.SelfCheck(false)
+	c.Assert(err, gc.IsNil)
+	c.Assert(report.MissingFromPrefixTree, gc.HasLen, 0)
+	c.Assert(report.MissingFromStorage, gc.HasLen, 0)
+	_, err = os.Stat(selfCheckPath(peer.path))
+	c.Assert(os.IsNotExist(err), gc.Equals, true)
+}
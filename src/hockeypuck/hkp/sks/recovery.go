@@ -0,0 +1,242 @@
+package sks
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	cf "hockeypuck/conflux"
+	"hockeypuck/conflux/recon"
+	log "hockeypuck/logrus"
+	"hockeypuck/openpgp"
+)
+
+const (
+	// recoverySaveInterval is how often the digests a large recovery has
+	// yet to fetch are saved.
+	recoverySaveInterval = 30 * time.Second
+
+	// rejectedRecoveryTTL is how long keys rejected by a partner's recovery
+	// policy are not requested from it again. The partner keeps offering
+	// them in every recon session meanwhile.
+	rejectedRecoveryTTL = 24 * time.Hour
+
+	// maxRejectedRecovered limits how many rejected digests are kept for
+	// each partner.
+	maxRejectedRecovered = 65536
+)
+
+// rejectedRecovered holds the digests of keys rejected by each partner's
+// recovery policy, with when they may be requested again.
+type rejectedRecovered struct {
+	mu        sync.Mutex
+	byPartner map[string]map[string]time.Time
+}
+
+// rejectDigest records that the key with digest, recovered from the partner
+// at addr, was rejected by its recovery policy.
+func (r *Peer) rejectDigest(addr net.Addr, digest string) {
+	name := r.peer.PartnerName(addr)
+	if name == "" {
+		return
+	}
+	now := r.clock.Now()
+	r.rejected.mu.Lock()
+	defer r.rejected.mu.Unlock()
+	if r.rejected.byPartner == nil {
+		r.rejected.byPartner = map[string]map[string]time.Time{}
+	}
+	digests, ok := r.rejected.byPartner[name]
+	if !ok {
+		digests = map[string]time.Time{}
+		r.rejected.byPartner[name] = digests
+	}
+	if len(digests) >= maxRejectedRecovered {
+		for digest, until := range digests {
+			if !now.Before(until) {
+				delete(digests, digest)
+			}
+		}
+		if len(digests) >= maxRejectedRecovered {
+			return
+		}
+	}
+	digests[digest] = now.Add(rejectedRecoveryTTL)
+}
+
+// rejectedDigest returns whether the key with digest was lately rejected by
+// the recovery policy of the partner at addr.
+func (r *Peer) rejectedDigest(addr net.Addr, digest string) bool {
+	r.rejected.mu.Lock()
+	defer r.rejected.mu.Unlock()
+	digests, ok := r.rejected.byPartner[r.peer.PartnerName(addr)]
+	if !ok {
+		return false
+	}
+	until, ok := digests[digest]
+	if !ok {
+		return false
+	} else if !r.clock.Now().Before(until) {
+		delete(digests, digest)
+		return false
+	}
+	return true
+}
+
+// recoveryPolicy returns the policy for keys recovered from the partner at
+// addr. Keys recovered from peers which are not partners are only subject
+// to the server's ingest policy.
+func (r *Peer) recoveryPolicy(addr net.Addr) recon.RecoveryPolicy {
+	partner, ok := r.peer.Partners()[r.peer.PartnerName(addr)]
+	if !ok {
+		return recon.RecoveryPolicy{}
+	}
+	return partner.Recovery
+}
+
+// rejectRecovered returns why policy rejects a recovered key, or "" if it
+// does not. The key may be altered in checking its self-signatures, but
+// only if it is rejected.
+func rejectRecovered(policy recon.RecoveryPolicy, key *openpgp.PrimaryKey) (string, error) {
+	if n := key.SerializedLength(); policy.MaxKeyLength > 0 && n > policy.MaxKeyLength {
+		return fmt.Sprintf("key length %d exceeds %d", n, policy.MaxKeyLength), nil
+	}
+	for _, fp := range policy.Blacklist {
+		if strings.EqualFold(fp, key.Fingerprint()) {
+			return "blacklisted", nil
+		}
+	}
+	if policy.RequireSelfSigs {
+		changes, err := openpgp.ApplyPolicy(key, openpgp.PolicyVerifySelfSigs, openpgp.DropUnverified)
+		if err != nil {
+			return "", err
+		}
+		if len(changes) > 0 {
+			return "missing valid self-signatures", nil
+		}
+	}
+	return "", nil
+}
+
+// recoveryState is the digests a recovery has yet to fetch, saved so that a
+// large recovery interrupted by a restart carries on where it left off
+// rather than waiting for recon to find the same keys again.
+type recoveryState struct {
+	RemoteAddr string   `json:"remoteAddr"`
+	HTTPPort   int      `json:"httpPort"`
+	Digests    []string `json:"digests"`
+}
+
+func recoveryFilename(path string) string {
+	dir, base := filepath.Dir(path), filepath.Base(path)
+	return filepath.Join(dir, "."+base+".recovery")
+}
+
+// saveRecovery saves the digests of items and of the keys held in deferred,
+// which have not yet been stored.
+func (r *Peer) saveRecovery(rcvr *recon.Recover, items []cf.Zp, deferred *recoveryQueue) error {
+	st := recoveryState{
+		RemoteAddr: rcvr.RemoteAddr.String(),
+		HTTPPort:   rcvr.RemoteConfig.HTTPPort,
+	}
+	for _, key := range deferred.keys {
+		st.Digests = append(st.Digests, key.MD5)
+	}
+	for i := range items {
+		st.Digests = append(st.Digests, items[i].FullKeyHash())
+	}
+	buf, err := json.Marshal(&st)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	fn := recoveryFilename(r.path)
+	err = ioutil.WriteFile(fn+".tmp", buf, 0644)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(os.Rename(fn+".tmp", fn))
+}
+
+// checkpointRecovery saves the progress of a recovery, logging it.
+func (r *Peer) checkpointRecovery(rcvr *recon.Recover, items []cf.Zp, deferred *recoveryQueue) {
+	err := r.saveRecovery(rcvr, items, deferred)
+	if err != nil {
+		r.logAddr(RECON, rcvr.RemoteAddr).Warningf("cannot save recovery state: %v", err)
+		return
+	}
+	r.logAddr(RECON, rcvr.RemoteAddr).WithFields(log.Fields{
+		"remaining": len(items),
+		"deferred":  len(deferred.keys),
+	}).Info("recovery progress")
+}
+
+func (r *Peer) removeRecovery() {
+	err := os.Remove(recoveryFilename(r.path))
+	if err != nil && !os.IsNotExist(err) {
+		r.log(RECON).Warningf("cannot remove recovery state: %v", err)
+	}
+}
+
+// savedRecovery returns the recovery interrupted by the last shutdown, if
+// any.
+func (r *Peer) savedRecovery() (*recon.Recover, error) {
+	buf, err := ioutil.ReadFile(recoveryFilename(r.path))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	var st recoveryState
+	err = json.Unmarshal(buf, &st)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid recovery state")
+	}
+	addr, err := net.ResolveTCPAddr("tcp", st.RemoteAddr)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid recovery remote address %q", st.RemoteAddr)
+	}
+	rcvr := &recon.Recover{
+		RemoteAddr:   addr,
+		RemoteConfig: &recon.Config{HTTPPort: st.HTTPPort},
+		Done:         make(chan struct{}),
+		Context:      context.Background(),
+	}
+	for _, digest := range st.Digests {
+		var zp cf.Zp
+		err = DigestZpIn(r.settings.Field.P(), digest, &zp)
+		if err != nil {
+			return nil, errors.Wrapf(err, "bad digest %q", digest)
+		}
+		rcvr.RemoteElements = append(rcvr.RemoteElements, zp)
+	}
+	return rcvr, nil
+}
+
+// resumeRecovery carries on with the recovery interrupted by the last
+// shutdown, if any.
+func (r *Peer) resumeRecovery() {
+	rcvr, err := r.savedRecovery()
+	if err != nil {
+		r.log(RECON).Errorf("cannot resume recovery: %v", err)
+		r.removeRecovery()
+		return
+	} else if rcvr == nil {
+		return
+	}
+	// The recovery is saved again if it is still large.
+	r.removeRecovery()
+	r.logAddr(RECON, rcvr.RemoteAddr).WithField("remaining", len(rcvr.RemoteElements)).Info("resuming recovery")
+	defer close(rcvr.Done)
+	if err := r.requestRecovered(rcvr); err != nil {
+		r.logAddr(RECON, rcvr.RemoteAddr).Errorf("recovery completed with errors: %v", err)
+	}
+}
@@ -0,0 +1,328 @@
+package sks
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	cf "hockeypuck/conflux"
+	"hockeypuck/conflux/recon"
+	"hockeypuck/conflux/recon/leveldb"
+	"hockeypuck/hkp/storage"
+	log "hockeypuck/logrus"
+)
+
+const SELFCHECK = "selfcheck"
+
+// selfCheckPageSize is how many stored keys are read at a time by a self
+// check.
+const selfCheckPageSize = 1000
+
+// SelfCheckSettings schedules a periodic check that the prefix tree agrees
+// with the key storage.
+type SelfCheckSettings struct {
+	// IntervalSecs is the time between checks. Checks are only run on
+	// request if it is zero.
+	IntervalSecs int `toml:"intervalSecs"`
+
+	// Repair inserts the digests of stored keys missing from the prefix
+	// tree, and removes those of keys no longer stored.
+	Repair bool `toml:"repair"`
+}
+
+func DefaultSelfCheckSettings() *SelfCheckSettings {
+	return &SelfCheckSettings{}
+}
+
+// Enabled returns whether checks are run periodically.
+func (s *SelfCheckSettings) Enabled() bool {
+	return s != nil && s.IntervalSecs > 0
+}
+
+// SelfCheckReport is the result of a self check.
+type SelfCheckReport struct {
+	Started  time.Time `json:"started"`
+	Finished time.Time `json:"finished"`
+
+	// Keys is the number of digests read from storage.
+	Keys int `json:"keys"`
+
+	// MissingFromPrefixTree are the digests of stored keys which recon
+	// partners are not offered.
+	MissingFromPrefixTree []string `json:"missingFromPrefixTree"`
+
+	// MissingFromStorage are the digests in the prefix tree of keys which
+	// are not stored, so that recon partners cannot fetch them.
+	MissingFromStorage []string `json:"missingFromStorage"`
+
+	Repaired bool   `json:"repaired"`
+	Error    string `json:"error,omitempty"`
+}
+
+type selfCheckState struct {
+	settings *SelfCheckSettings
+
+	mu      sync.Mutex
+	running bool
+	paused  bool
+	last    *SelfCheckReport
+}
+
+// SetSelfCheck sets the schedule of self checks. It must be called before
+// Start.
+func (r *Peer) SetSelfCheck(settings *SelfCheckSettings) {
+	r.selfCheck.settings = settings
+}
+
+// LastSelfCheck returns the report of the last self check, or nil if none
+// has finished.
+func (r *Peer) LastSelfCheck() *SelfCheckReport {
+	r.selfCheck.mu.Lock()
+	defer r.selfCheck.mu.Unlock()
+	return r.selfCheck.last
+}
+
+// StartSelfCheck runs a self check in the background, repairing the
+// differences found if repair is set. It returns false if a check is
+// already running, or the peer is stopping.
+func (r *Peer) StartSelfCheck(repair bool) bool {
+	r.muDie.Lock()
+	defer r.muDie.Unlock()
+	if !r.t.Alive() {
+		return false
+	}
+	if !r.acquireSelfCheck() {
+		return false
+	}
+	r.t.Go(func() error {
+		r.runSelfCheck(repair)
+		return nil
+	})
+	return true
+}
+
+// PauseSelfChecks skips scheduled self checks until ResumeSelfChecks. A
+// check in progress carries on, and checks may still be started on request.
+func (r *Peer) PauseSelfChecks() {
+	r.selfCheck.mu.Lock()
+	defer r.selfCheck.mu.Unlock()
+	r.selfCheck.paused = true
+}
+
+// ResumeSelfChecks runs scheduled self checks again after PauseSelfChecks.
+func (r *Peer) ResumeSelfChecks() {
+	r.selfCheck.mu.Lock()
+	defer r.selfCheck.mu.Unlock()
+	r.selfCheck.paused = false
+}
+
+func (r *Peer) selfCheckPaused() bool {
+	r.selfCheck.mu.Lock()
+	defer r.selfCheck.mu.Unlock()
+	return r.selfCheck.paused
+}
+
+func (r *Peer) acquireSelfCheck() bool {
+	r.selfCheck.mu.Lock()
+	defer r.selfCheck.mu.Unlock()
+	if r.selfCheck.running {
+		return false
+	}
+	r.selfCheck.running = true
+	return true
+}
+
+func (r *Peer) selfCheckLoop() error {
+	interval := time.Duration(r.selfCheck.settings.IntervalSecs) * time.Second
+	timer := r.clock.NewTimer(interval)
+	for {
+		select {
+		case <-r.t.Dying():
+			return nil
+		case <-timer.C():
+			if r.selfCheckPaused() {
+				r.log(SELFCHECK).Info("scheduled self check skipped, paused")
+			} else if r.acquireSelfCheck() {
+				r.runSelfCheck(r.selfCheck.settings.Repair)
+			}
+			timer.Reset(interval)
+		}
+	}
+}
+
+// runSelfCheck runs a self check acquired by acquireSelfCheck, logging and
+// recording its report.
+func (r *Peer) runSelfCheck(repair bool) {
+	started := r.clock.Now()
+	report, err := r.SelfCheck(repair)
+	if err != nil {
+		report = &SelfCheckReport{Error: err.Error()}
+		r.log(SELFCHECK).Errorf("self check failed: %+v", err)
+	} else {
+		entry := r.logFields(SELFCHECK, log.Fields{
+			"keys":               report.Keys,
+			"missingFromPtree":   len(report.MissingFromPrefixTree),
+			"missingFromStorage": len(report.MissingFromStorage),
+			"repaired":           report.Repaired,
+			"duration":           r.clock.Now().Sub(started).String(),
+		})
+		if len(report.MissingFromPrefixTree) > 0 || len(report.MissingFromStorage) > 0 {
+			entry.Warning("prefix tree differs from storage")
+		} else {
+			entry.Info("prefix tree agrees with storage")
+		}
+		recordSelfCheck(report)
+	}
+	report.Started = started
+	report.Finished = r.clock.Now()
+
+	r.selfCheck.mu.Lock()
+	r.selfCheck.running = false
+	r.selfCheck.last = report
+	r.selfCheck.mu.Unlock()
+}
+
+// SelfCheck reconciles the prefix tree with a tree of the digests in
+// storage, built from a walk of every stored key, as a recon partner
+// holding exactly the stored keys would. This exercises the whole of recon
+// short of the network, and finds digests missing from either side.
+//
+// Keys may change while storage is walked, so each difference is checked
+// against storage again before it is reported. The differences are
+// repaired if repair is set. Storage must support storage.CapModifiedSince.
+func (r *Peer) SelfCheck(repair bool) (*SelfCheckReport, error) {
+	if !storage.Supports(r.storage, storage.CapModifiedSince) {
+		return nil, errors.New("storage cannot list every key")
+	}
+	path := selfCheckPath(r.path)
+	err := os.RemoveAll(path)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	tree, err := leveldb.New(r.settings.PTreeConfig, path)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	err = tree.Create()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer func() {
+		tree.Close()
+		os.RemoveAll(path)
+	}()
+
+	report := &SelfCheckReport{
+		MissingFromPrefixTree: []string{},
+		MissingFromStorage:    []string{},
+	}
+	report.Keys, err = r.buildStoredTree(tree)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	localOnly, storedOnly, err := r.peer.Compare(tree)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	for _, digest := range zsetDigests(localOnly) {
+		rfps, err := r.storage.MatchMD5([]string{digest})
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		if len(rfps) == 0 {
+			report.MissingFromStorage = append(report.MissingFromStorage, digest)
+		}
+	}
+	for _, digest := range zsetDigests(storedOnly) {
+		rfps, err := r.storage.MatchMD5([]string{digest})
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		if len(rfps) > 0 {
+			report.MissingFromPrefixTree = append(report.MissingFromPrefixTree, digest)
+		}
+	}
+	if repair && (len(report.MissingFromPrefixTree) > 0 || len(report.MissingFromStorage) > 0) {
+		err = r.applyDigests(report.MissingFromPrefixTree, report.MissingFromStorage)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		report.Repaired = true
+	}
+	return report, nil
+}
+
+// buildStoredTree inserts the digest of every stored key into tree,
+// returning how many were read.
+func (r *Peer) buildStoredTree(tree recon.PrefixTree) (int, error) {
+	batcher, batching := tree.(recon.Batcher)
+	var n int
+	var after storage.ModifiedKey
+	for {
+		select {
+		case <-r.t.Dying():
+			return 0, errors.New("self check stopped")
+		default:
+		}
+		page, err := r.storage.ModifiedAfter(after, selfCheckPageSize)
+		if err != nil {
+			return 0, errors.WithStack(err)
+		}
+		if len(page) == 0 {
+			return n, nil
+		}
+		if batching {
+			err = batcher.Begin()
+			if err != nil {
+				return 0, errors.WithStack(err)
+			}
+		}
+		for _, mk := range page {
+			var z cf.Zp
+			err = DigestZpIn(r.settings.Field.P(), mk.MD5, &z)
+			if err != nil {
+				r.logFields(SELFCHECK, log.Fields{
+					"digest": mk.MD5,
+					"error":  err,
+				}).Warning("bad digest in storage")
+				continue
+			}
+			err = tree.Insert(&z)
+			if errors.Is(err, leveldb.ErrDuplicate) {
+				// Keys with the same content have the same digest.
+				continue
+			} else if err != nil {
+				return 0, errors.WithStack(err)
+			}
+			n++
+		}
+		if batching {
+			err = batcher.Commit()
+			if err != nil {
+				return 0, errors.WithStack(err)
+			}
+		}
+		after = page[len(page)-1]
+	}
+}
+
+// selfCheckPath returns where the tree of stored digests is built, beside
+// the prefix tree.
+func selfCheckPath(path string) string {
+	dir, base := filepath.Dir(path), filepath.Base(path)
+	return filepath.Join(dir, "."+base+".selfcheck")
+}
+
+func zsetDigests(zs *cf.ZSet) []string {
+	var digests []string
+	for _, z := range zs.Items() {
+		digests = append(digests, z.FullKeyHash())
+	}
+	sort.Strings(digests)
+	return digests
+}
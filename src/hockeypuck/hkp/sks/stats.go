@@ -24,6 +24,7 @@ import (
 	"time"
 
 	"github.com/pkg/errors"
+	"hockeypuck/clock"
 	"hockeypuck/hkp/storage"
 )
 
@@ -78,15 +79,25 @@ type Stats struct {
 	mu     sync.Mutex
 	Hourly LoadStatMap
 	Daily  LoadStatMap
+
+	clock clock.Clock
 }
 
 func NewStats() *Stats {
 	return &Stats{
 		Hourly: LoadStatMap{},
 		Daily:  LoadStatMap{},
+		clock:  clock.Real(),
 	}
 }
 
+// SetClock sets the clock used to bucket and expire statistics.
+func (s *Stats) SetClock(c clock.Clock) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.clock = c
+}
+
 // reset resets statistics. The caller must hold s.mu.
 func (s *Stats) reset() {
 	s.Total = 0
@@ -98,8 +109,9 @@ func (s *Stats) prune() {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	yesterday := time.Now().UTC().Add(-24 * time.Hour)
-	lastWeek := time.Now().UTC().Add(-24 * 7 * time.Hour)
+	now := s.clock.Now().UTC()
+	yesterday := now.Add(-24 * time.Hour)
+	lastWeek := now.Add(-24 * 7 * time.Hour)
 	for k := range s.Hourly {
 		if k.Before(yesterday) {
 			delete(s.Hourly, k)
@@ -116,8 +128,9 @@ func (s *Stats) Update(kc storage.KeyChange) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	s.Hourly.update(time.Now().UTC().Truncate(time.Hour), kc)
-	s.Daily.update(time.Now().UTC().Truncate(24*time.Hour), kc)
+	now := s.clock.Now().UTC()
+	s.Hourly.update(now.Truncate(time.Hour), kc)
+	s.Daily.update(now.Truncate(24*time.Hour), kc)
 	switch kc.(type) {
 	case storage.KeyAdded:
 		s.Total++
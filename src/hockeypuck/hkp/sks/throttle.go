@@ -0,0 +1,64 @@
+package sks
+
+import (
+	"time"
+
+	"hockeypuck/clock"
+)
+
+// recoveryThrottle paces the hashqueries of recovery to limit the rate, in
+// bytes and keys per second, at which keys are fetched from partners. Each
+// chunk is fetched at once, and the next delayed until the last would have
+// been fetched within the limits.
+type recoveryThrottle struct {
+	bytesPerSec int
+	keysPerSec  int
+
+	// ready is the time at which the next chunk may be requested.
+	ready time.Time
+}
+
+func newRecoveryThrottle(bytesPerSec, keysPerSec int) *recoveryThrottle {
+	return &recoveryThrottle{bytesPerSec: bytesPerSec, keysPerSec: keysPerSec}
+}
+
+// maxKeys returns the most keys which should be requested at once, so that
+// a single hashquery does not exceed a second's worth of keys, or zero if
+// keys are not limited.
+func (t *recoveryThrottle) maxKeys() int {
+	return t.keysPerSec
+}
+
+// take accounts for a chunk of keys fetched at now.
+func (t *recoveryThrottle) take(now time.Time, bytes, keys int) {
+	var delay time.Duration
+	if t.bytesPerSec > 0 {
+		delay = time.Duration(bytes) * time.Second / time.Duration(t.bytesPerSec)
+	}
+	if t.keysPerSec > 0 {
+		if d := time.Duration(keys) * time.Second / time.Duration(t.keysPerSec); d > delay {
+			delay = d
+		}
+	}
+	if t.ready.Before(now) {
+		t.ready = now
+	}
+	t.ready = t.ready.Add(delay)
+}
+
+// wait blocks until the next chunk may be requested, returning how long it
+// waited, or false if dying was closed first.
+func (t *recoveryThrottle) wait(c clock.Clock, dying <-chan struct{}) (time.Duration, bool) {
+	d := t.ready.Sub(c.Now())
+	if d <= 0 {
+		return 0, true
+	}
+	timer := c.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C():
+		return d, true
+	case <-dying:
+		return 0, false
+	}
+}
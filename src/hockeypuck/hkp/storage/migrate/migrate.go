@@ -0,0 +1,178 @@
+// Package migrate copies keys from one storage backend to another, so that
+// operators can change databases without going through dump files.
+//
+// Keys are copied in the order they were last modified, so that the
+// position reached is a resumable State. Keys modified in the source while
+// a migration runs are copied again once it reaches them, so running the
+// migration again just before switching over copies the latest changes.
+// Deleted keys are not copied.
+//
+// Each copied key is verified by looking up its digest in the destination.
+// Keys which the destination already holds with another digest are
+// replaced.
+package migrate
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+
+	"hockeypuck/hkp/storage"
+	log "hockeypuck/logrus"
+	"hockeypuck/openpgp"
+)
+
+const DefaultPageSize = 1000
+
+// progressInterval is the least time between progress reports.
+const progressInterval = 30 * time.Second
+
+// State records the progress of a migration.
+type State struct {
+	// Last is the position of the last key copied.
+	Last storage.ModifiedKey `json:"last"`
+
+	// Keys is the number of keys copied.
+	Keys int `json:"keys"`
+
+	// Replaced is the number of keys which the destination held with
+	// another digest, and which were replaced.
+	Replaced int `json:"replaced"`
+
+	// Failed is the number of keys which the destination did not hold
+	// with the source digest once copied.
+	Failed int `json:"failed"`
+}
+
+// Migration copies keys from one storage backend to another.
+type Migration struct {
+	From storage.Storage
+	To   storage.Storage
+
+	// PageSize is the number of keys copied at a time. If zero,
+	// DefaultPageSize is used.
+	PageSize int
+
+	// Checkpoint, if set, is called with the state after each page of keys
+	// is copied, such as to save it for resuming the migration.
+	Checkpoint func(*State) error
+}
+
+// Run copies the keys modified after the position in state, updating it as
+// it goes.
+func (m *Migration) Run(state *State) error {
+	if !storage.Supports(m.From, storage.CapModifiedSince) {
+		return errors.New("source storage cannot list every key")
+	}
+	pageSize := m.PageSize
+	if pageSize <= 0 {
+		pageSize = DefaultPageSize
+	}
+	start, lastReport := time.Now(), time.Now()
+	startKeys := state.Keys
+	for {
+		page, err := m.From.ModifiedAfter(state.Last, pageSize)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if len(page) == 0 {
+			break
+		}
+		err = m.copyPage(page, state)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		state.Last = page[len(page)-1]
+		if m.Checkpoint != nil {
+			err = m.Checkpoint(state)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+		}
+		if time.Since(lastReport) >= progressInterval {
+			lastReport = time.Now()
+			rate := float64(state.Keys-startKeys) / time.Since(start).Seconds()
+			log.Infof("migrate: %d keys copied, %.0f keys/s, at %s",
+				state.Keys, rate, state.Last.MTime.UTC().Format(time.RFC3339))
+		}
+	}
+	log.Infof("migrate: %d keys copied, %d replaced, %d failed verification",
+		state.Keys, state.Replaced, state.Failed)
+	return nil
+}
+
+func (m *Migration) copyPage(page []storage.ModifiedKey, state *State) error {
+	var rfps []string
+	for _, mk := range page {
+		rfps = append(rfps, mk.RFingerprint)
+	}
+	keys, err := m.From.FetchKeys(rfps)
+	if err != nil {
+		return errors.Wrapf(err, "cannot fetch keys modified after %s", state.Last.MTime.UTC().Format(time.RFC3339))
+	}
+	var batch []*openpgp.PrimaryKey
+	for _, key := range keys {
+		if key != nil {
+			batch = append(batch, key)
+		}
+	}
+	_, err = m.To.Insert(batch)
+	if insertErr, ok := err.(storage.InsertError); ok {
+		for _, err := range insertErr.Errors {
+			log.Warningf("migrate: insert failed: %v", err)
+		}
+	} else if err != nil {
+		return errors.WithStack(err)
+	}
+
+	// Keys which were not inserted, whether already present or not, are
+	// found by their digests.
+	missing, err := m.missing(batch)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	for _, key := range missing {
+		_, err := m.To.Replace(key)
+		if err != nil {
+			log.Warningf("migrate: cannot replace key %s: %v", key.Fingerprint(), err)
+		}
+	}
+	failed, err := m.missing(missing)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	for _, key := range failed {
+		log.Warningf("migrate: key %s not found with digest %s after copying", key.Fingerprint(), key.MD5)
+	}
+	state.Keys += len(batch)
+	state.Replaced += len(missing) - len(failed)
+	state.Failed += len(failed)
+	return nil
+}
+
+// missing returns the keys which the destination does not hold with the
+// same digest.
+func (m *Migration) missing(keys []*openpgp.PrimaryKey) ([]*openpgp.PrimaryKey, error) {
+	if len(keys) == 0 {
+		return nil, nil
+	}
+	var digests []string
+	for _, key := range keys {
+		digests = append(digests, key.MD5)
+	}
+	rfps, err := m.To.MatchMD5(digests)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	found := map[string]bool{}
+	for _, rfp := range rfps {
+		found[rfp] = true
+	}
+	var result []*openpgp.PrimaryKey
+	for _, key := range keys {
+		if !found[key.RFingerprint] {
+			result = append(result, key)
+		}
+	}
+	return result, nil
+}
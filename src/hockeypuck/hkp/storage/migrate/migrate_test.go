@@ -0,0 +1,157 @@
+package migrate
+
+import (
+	stdtesting "testing"
+	"time"
+
+	gc "gopkg.in/check.v1"
+
+	"hockeypuck/hkp/storage"
+	"hockeypuck/hkp/storage/mock"
+	"hockeypuck/openpgp"
+	"hockeypuck/testing"
+)
+
+func Test(t *stdtesting.T) { gc.TestingT(t) }
+
+type MigrateSuite struct {
+	keys []*openpgp.PrimaryKey
+	rows []storage.ModifiedKey
+	from *mock.Storage
+	dest map[string]*openpgp.PrimaryKey
+	to   *mock.Storage
+	drop string
+}
+
+var _ = gc.Suite(&MigrateSuite{})
+
+func readKey(name string) *openpgp.PrimaryKey {
+	return openpgp.MustReadArmorKeys(testing.MustInput(name))[0]
+}
+
+func (s *MigrateSuite) SetUpTest(c *gc.C) {
+	s.keys = []*openpgp.PrimaryKey{readKey("alice_signed.asc"), readKey("tails.asc"), readKey("sksdigest.asc")}
+	s.rows = nil
+	for i, key := range s.keys {
+		s.rows = append(s.rows, storage.ModifiedKey{
+			RFingerprint: key.RFingerprint,
+			MTime:        time.Date(2020, 1, 1+i, 0, 0, 0, 0, time.UTC),
+			MD5:          key.MD5,
+		})
+	}
+	s.from = mock.NewStorage(
+		mock.ModifiedAfter(func(after storage.ModifiedKey, limit int) ([]storage.ModifiedKey, error) {
+			var result []storage.ModifiedKey
+			for _, row := range s.rows {
+				if row.MTime.After(after.MTime) && len(result) < limit {
+					result = append(result, row)
+				}
+			}
+			return result, nil
+		}),
+		mock.FetchKeys(func(rfps []string) ([]*openpgp.PrimaryKey, error) {
+			var result []*openpgp.PrimaryKey
+			for _, key := range s.keys {
+				for _, rfp := range rfps {
+					if key.RFingerprint == rfp {
+						result = append(result, key)
+					}
+				}
+			}
+			return result, nil
+		}),
+	)
+
+	// The destination already holds an older copy of the first key.
+	stale := readKey("alice_signed.asc")
+	stale.MD5 = "00112233445566778899aabbccddeeff"
+	s.dest = map[string]*openpgp.PrimaryKey{stale.RFingerprint: stale}
+	s.drop = ""
+	s.to = mock.NewStorage(
+		mock.Insert(func(keys []*openpgp.PrimaryKey) (int, error) {
+			var n int
+			var insertErr storage.InsertError
+			for _, key := range keys {
+				if _, ok := s.dest[key.RFingerprint]; ok {
+					insertErr.Duplicates = append(insertErr.Duplicates, key)
+				} else if key.RFingerprint != s.drop {
+					s.dest[key.RFingerprint] = key
+					n++
+				}
+			}
+			if len(insertErr.Duplicates) > 0 {
+				return n, insertErr
+			}
+			return n, nil
+		}),
+		mock.Replace(func(key *openpgp.PrimaryKey) (string, error) {
+			if key.RFingerprint != s.drop {
+				s.dest[key.RFingerprint] = key
+			}
+			return "", nil
+		}),
+		mock.MatchMD5(func(digests []string) ([]string, error) {
+			var result []string
+			for _, digest := range digests {
+				for rfp, key := range s.dest {
+					if key.MD5 == digest {
+						result = append(result, rfp)
+					}
+				}
+			}
+			return result, nil
+		}),
+	)
+}
+
+func (s *MigrateSuite) migration(states *[]State) *Migration {
+	return &Migration{
+		From:     s.from,
+		To:       s.to,
+		PageSize: 2,
+		Checkpoint: func(state *State) error {
+			*states = append(*states, *state)
+			return nil
+		},
+	}
+}
+
+func (s *MigrateSuite) TestRun(c *gc.C) {
+	var states []State
+	var state State
+	err := s.migration(&states).Run(&state)
+	c.Assert(err, gc.IsNil)
+	c.Assert(state, gc.DeepEquals, State{Last: s.rows[2], Keys: 3, Replaced: 1})
+	c.Assert(states, gc.DeepEquals, []State{
+		{Last: s.rows[1], Keys: 2, Replaced: 1},
+		{Last: s.rows[2], Keys: 3, Replaced: 1},
+	})
+	c.Assert(s.dest, gc.HasLen, 3)
+	for _, key := range s.keys {
+		c.Assert(s.dest[key.RFingerprint].MD5, gc.Equals, key.MD5)
+	}
+
+	// Resuming copies only keys modified since.
+	s.rows[0].MTime = time.Date(2020, 2, 1, 0, 0, 0, 0, time.UTC)
+	states = nil
+	err = s.migration(&states).Run(&state)
+	c.Assert(err, gc.IsNil)
+	c.Assert(state, gc.DeepEquals, State{Last: s.rows[0], Keys: 4, Replaced: 1})
+	c.Assert(states, gc.HasLen, 1)
+	c.Assert(s.to.MethodCount("Replace"), gc.Equals, 1)
+}
+
+func (s *MigrateSuite) TestVerify(c *gc.C) {
+	s.drop = s.keys[1].RFingerprint
+	var state State
+	err := (&Migration{From: s.from, To: s.to}).Run(&state)
+	c.Assert(err, gc.IsNil)
+	c.Assert(state, gc.DeepEquals, State{Last: s.rows[2], Keys: 3, Replaced: 1, Failed: 1})
+	c.Assert(s.dest[s.drop], gc.IsNil)
+}
+
+func (s *MigrateSuite) TestUnsupported(c *gc.C) {
+	from := mock.NewStorage(mock.Unsupported(storage.CapModifiedSince))
+	err := (&Migration{From: from, To: s.to}).Run(&State{})
+	c.Assert(err, gc.ErrorMatches, "source storage cannot list every key")
+}
@@ -51,8 +51,15 @@ func (m *Recorder) MethodCount(name string) int {
 type closeFunc func() error
 type resolverFunc func([]string) ([]string, error)
 type modifiedSinceFunc func(time.Time) ([]string, error)
+type modifiedAfterFunc func(storage.ModifiedKey, int) ([]storage.ModifiedKey, error)
+type matchTimeRangeFunc func(storage.TimeRange, int) ([]string, error)
+type matchDomainFunc func(string, string, int) ([]string, error)
 type fetchKeysFunc func([]string) ([]*openpgp.PrimaryKey, error)
+type fetchKeyByMD5Func func(string) (*openpgp.PrimaryKey, error)
 type fetchKeyringsFunc func([]string) ([]*storage.Keyring, error)
+type fetchModTimesFunc func([]string) (map[string]time.Time, error)
+type recordProvenanceFunc func([]string) error
+type fetchProvenanceFunc func([]string) (map[string]time.Time, error)
 type insertFunc func([]*openpgp.PrimaryKey) (int, error)
 type replaceFunc func(*openpgp.PrimaryKey) (string, error)
 type updateFunc func(*openpgp.PrimaryKey, string, string) error
@@ -61,18 +68,26 @@ type renotifyAllFunc func() error
 
 type Storage struct {
 	Recorder
-	close_        closeFunc
-	matchMD5      resolverFunc
-	resolve       resolverFunc
-	matchKeyword  resolverFunc
-	modifiedSince modifiedSinceFunc
-	fetchKeys     fetchKeysFunc
-	fetchKeyrings fetchKeyringsFunc
-	insert        insertFunc
-	replace       replaceFunc
-	update        updateFunc
-	delete        deleteFunc
-	renotifyAll   renotifyAllFunc
+	close_         closeFunc
+	matchMD5       resolverFunc
+	resolve        resolverFunc
+	matchKeyword   resolverFunc
+	modifiedSince  modifiedSinceFunc
+	modifiedAfter  modifiedAfterFunc
+	matchTimeRange matchTimeRangeFunc
+	matchDomain    matchDomainFunc
+	fetchKeys      fetchKeysFunc
+	fetchKeyByMD5  fetchKeyByMD5Func
+	fetchKeyrings  fetchKeyringsFunc
+	fetchModTimes  fetchModTimesFunc
+	recordProv     recordProvenanceFunc
+	fetchProv      fetchProvenanceFunc
+	insert         insertFunc
+	replace        replaceFunc
+	update         updateFunc
+	delete         deleteFunc
+	renotifyAll    renotifyAllFunc
+	unsupported    map[storage.Capability]bool
 
 	notified []func(storage.KeyChange) error
 }
@@ -88,14 +103,44 @@ func MatchKeyword(f resolverFunc) Option {
 func ModifiedSince(f modifiedSinceFunc) Option {
 	return func(m *Storage) { m.modifiedSince = f }
 }
+func ModifiedAfter(f modifiedAfterFunc) Option {
+	return func(m *Storage) { m.modifiedAfter = f }
+}
+func MatchTimeRange(f matchTimeRangeFunc) Option {
+	return func(m *Storage) { m.matchTimeRange = f }
+}
+func MatchDomain(f matchDomainFunc) Option {
+	return func(m *Storage) { m.matchDomain = f }
+}
 func FetchKeys(f fetchKeysFunc) Option { return func(m *Storage) { m.fetchKeys = f } }
+func FetchKeyByMD5(f fetchKeyByMD5Func) Option {
+	return func(m *Storage) { m.fetchKeyByMD5 = f }
+}
 func FetchKeyrings(f fetchKeyringsFunc) Option {
 	return func(m *Storage) { m.fetchKeyrings = f }
 }
+func FetchModTimes(f fetchModTimesFunc) Option {
+	return func(m *Storage) { m.fetchModTimes = f }
+}
+func RecordProvenance(f recordProvenanceFunc) Option {
+	return func(m *Storage) { m.recordProv = f }
+}
+func FetchProvenance(f fetchProvenanceFunc) Option {
+	return func(m *Storage) { m.fetchProv = f }
+}
 func Insert(f insertFunc) Option           { return func(m *Storage) { m.insert = f } }
 func Replace(f replaceFunc) Option         { return func(m *Storage) { m.replace = f } }
 func Update(f updateFunc) Option           { return func(m *Storage) { m.update = f } }
+func Delete(f deleteFunc) Option           { return func(m *Storage) { m.delete = f } }
 func RenotifyAll(f renotifyAllFunc) Option { return func(m *Storage) { m.renotifyAll = f } }
+func Unsupported(caps ...storage.Capability) Option {
+	return func(m *Storage) {
+		m.unsupported = map[storage.Capability]bool{}
+		for _, c := range caps {
+			m.unsupported[c] = true
+		}
+	}
+}
 
 func NewStorage(options ...Option) *Storage {
 	m := &Storage{}
@@ -105,6 +150,9 @@ func NewStorage(options ...Option) *Storage {
 	return m
 }
 
+func (m *Storage) Supports(c storage.Capability) bool {
+	return !m.unsupported[c]
+}
 func (m *Storage) Close() error {
 	m.record("Close")
 	if m.close_ != nil {
@@ -140,6 +188,27 @@ func (m *Storage) ModifiedSince(t time.Time) ([]string, error) {
 	}
 	return nil, nil
 }
+func (m *Storage) ModifiedAfter(after storage.ModifiedKey, limit int) ([]storage.ModifiedKey, error) {
+	m.record("ModifiedAfter", after, limit)
+	if m.modifiedAfter != nil {
+		return m.modifiedAfter(after, limit)
+	}
+	return nil, nil
+}
+func (m *Storage) MatchTimeRange(r storage.TimeRange, limit int) ([]string, error) {
+	m.record("MatchTimeRange", r, limit)
+	if m.matchTimeRange != nil {
+		return m.matchTimeRange(r, limit)
+	}
+	return nil, nil
+}
+func (m *Storage) MatchDomain(domain string, after string, limit int) ([]string, error) {
+	m.record("MatchDomain", domain, after, limit)
+	if m.matchDomain != nil {
+		return m.matchDomain(domain, after, limit)
+	}
+	return nil, nil
+}
 func (m *Storage) FetchKeys(s []string) ([]*openpgp.PrimaryKey, error) {
 	m.record("FetchKeys", s)
 	if m.fetchKeys != nil {
@@ -147,6 +216,13 @@ func (m *Storage) FetchKeys(s []string) ([]*openpgp.PrimaryKey, error) {
 	}
 	return nil, nil
 }
+func (m *Storage) FetchKeyByMD5(digest string) (*openpgp.PrimaryKey, error) {
+	m.record("FetchKeyByMD5", digest)
+	if m.fetchKeyByMD5 != nil {
+		return m.fetchKeyByMD5(digest)
+	}
+	return nil, storage.ErrKeyNotFound
+}
 func (m *Storage) FetchKeyrings(s []string) ([]*storage.Keyring, error) {
 	m.record("FetchKeyrings", s)
 	if m.fetchKeyrings != nil {
@@ -154,6 +230,27 @@ func (m *Storage) FetchKeyrings(s []string) ([]*storage.Keyring, error) {
 	}
 	return nil, nil
 }
+func (m *Storage) FetchModTimes(s []string) (map[string]time.Time, error) {
+	m.record("FetchModTimes", s)
+	if m.fetchModTimes != nil {
+		return m.fetchModTimes(s)
+	}
+	return nil, nil
+}
+func (m *Storage) RecordProvenance(s []string) error {
+	m.record("RecordProvenance", s)
+	if m.recordProv != nil {
+		return m.recordProv(s)
+	}
+	return nil
+}
+func (m *Storage) FetchProvenance(s []string) (map[string]time.Time, error) {
+	m.record("FetchProvenance", s)
+	if m.fetchProv != nil {
+		return m.fetchProv(s)
+	}
+	return nil, nil
+}
 func (m *Storage) Insert(keys []*openpgp.PrimaryKey) (int, error) {
 	m.record("Insert", keys)
 	if m.insert != nil {
@@ -18,6 +18,7 @@
 package storage
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"time"
@@ -33,6 +34,106 @@ func IsNotFound(err error) bool {
 	return errors.Is(err, ErrKeyNotFound)
 }
 
+// ErrNotSupported is returned by storage backends for optional operations
+// they do not implement.
+var ErrNotSupported = fmt.Errorf("operation not supported by storage backend")
+
+// UnparseableError is returned by storage backends when a stored key cannot
+// be read back, so that it can be reported as corrupt rather than missing.
+type UnparseableError struct {
+	Digest string
+	Err    error
+}
+
+func (err *UnparseableError) Error() string {
+	return fmt.Sprintf("stored key %q cannot be parsed: %v", err.Digest, err.Err)
+}
+
+func (err *UnparseableError) Unwrap() error {
+	return err.Err
+}
+
+// IsUnparseable returns whether err is or wraps an UnparseableError.
+func IsUnparseable(err error) bool {
+	var unparseable *UnparseableError
+	return errors.As(err, &unparseable)
+}
+
+// Capability identifies an optional storage operation.
+type Capability string
+
+const (
+	// CapKeywordSearch indicates that MatchKeyword is supported.
+	CapKeywordSearch = Capability("keyword-search")
+
+	// CapModifiedSince indicates that ModifiedSince and ModifiedAfter are
+	// supported.
+	CapModifiedSince = Capability("modified-since")
+
+	// CapTimeRange indicates that MatchTimeRange is supported.
+	CapTimeRange = Capability("time-range")
+)
+
+// CapabilityReporter may be implemented by storage backends which do not
+// support every optional operation. Unsupported operations should return
+// ErrNotSupported, and the server will disable the HKP features which
+// depend on them.
+type CapabilityReporter interface {
+	Supports(Capability) bool
+}
+
+// Supports returns whether the storage backend st supports the given
+// capability. Backends which do not implement CapabilityReporter are
+// assumed to support everything.
+func Supports(st interface{}, c Capability) bool {
+	if cr, ok := st.(CapabilityReporter); ok {
+		return cr.Supports(c)
+	}
+	return true
+}
+
+// ModifiedKey identifies a keyring, the time it was last modified and its
+// digest at that time.
+type ModifiedKey struct {
+	RFingerprint string    `json:"rfingerprint"`
+	MTime        time.Time `json:"mtime"`
+	MD5          string    `json:"md5,omitempty"`
+}
+
+// TimeRange restricts a search to keys created and expiring within a time
+// window. Zero bounds are open.
+type TimeRange struct {
+	CreatedAfter  time.Time
+	CreatedBefore time.Time
+	ExpiresAfter  time.Time
+	ExpiresBefore time.Time
+}
+
+// IsZero returns whether the range is unbounded.
+func (r TimeRange) IsZero() bool {
+	return r.CreatedAfter.IsZero() && r.CreatedBefore.IsZero() &&
+		r.ExpiresAfter.IsZero() && r.ExpiresBefore.IsZero()
+}
+
+// Match returns whether key was created and expires within the range. Keys
+// which do not expire are considered to expire after any time.
+func (r TimeRange) Match(key *openpgp.PrimaryKey) bool {
+	if !r.CreatedAfter.IsZero() && !key.Creation.After(r.CreatedAfter) {
+		return false
+	}
+	if !r.CreatedBefore.IsZero() && !key.Creation.Before(r.CreatedBefore) {
+		return false
+	}
+	expiresAt, expires := key.ExpiresAt()
+	if !r.ExpiresAfter.IsZero() && expires && !expiresAt.After(r.ExpiresAfter) {
+		return false
+	}
+	if !r.ExpiresBefore.IsZero() && (!expires || !expiresAt.Before(r.ExpiresBefore)) {
+		return false
+	}
+	return true
+}
+
 type Keyring struct {
 	*openpgp.PrimaryKey
 
@@ -71,6 +172,18 @@ type Queryer interface {
 	// since the given time.
 	ModifiedSince(time.Time) ([]string, error)
 
+	// ModifiedAfter returns up to limit keyrings modified after the given
+	// position, ordered by modification time, RFingerprint and then MD5.
+	// Passing the last result of one call as the position for the next pages
+	// through every modification, even of a fingerprint stored more than
+	// once. A position without an MD5 is after every keyring with its
+	// modification time and RFingerprint.
+	ModifiedAfter(after ModifiedKey, limit int) ([]ModifiedKey, error)
+
+	// MatchTimeRange returns up to limit RFingerprint IDs of keys created and
+	// expiring within the given range, ordered by creation time.
+	MatchTimeRange(r TimeRange, limit int) ([]string, error)
+
 	// FetchKeys returns the public key material matching the given RFingerprint slice.
 	FetchKeys([]string) ([]*openpgp.PrimaryKey, error)
 
@@ -86,6 +199,15 @@ type Inserter interface {
 	Insert([]*openpgp.PrimaryKey) (int, error)
 }
 
+// BatchInserter may be implemented by storage backends which can insert many
+// keys at once more efficiently than Insert, such as for bulk loading.
+type BatchInserter interface {
+	// InsertBatch inserts new keys like Insert, but inserts all of them
+	// together. Keys which cannot be inserted together are inserted
+	// individually, so that the result is the same as from Insert.
+	InsertBatch([]*openpgp.PrimaryKey) (int, error)
+}
+
 // Updater defines the storage API for writing key material.
 type Updater interface {
 	Inserter
@@ -106,6 +228,30 @@ type Deleter interface {
 	Delete(fp string) (string, error)
 }
 
+// Maintenance tasks run by a Maintainer.
+const (
+	// MaintainVacuum compacts the tables, reclaiming the space of deleted
+	// and replaced keys.
+	MaintainVacuum = "vacuum"
+
+	// MaintainReindex rebuilds the indexes.
+	MaintainReindex = "reindex"
+
+	// MaintainBackfill fills in what is recorded of each key by this
+	// version for keys stored by an earlier one. It does not lock out
+	// writes, and is run in the background when the server starts.
+	MaintainBackfill = "backfill"
+)
+
+// Maintainer may be implemented by storage backends which support heavy
+// maintenance tasks. Tasks may lock out writes, or all queries, until they
+// are done.
+type Maintainer interface {
+	// Maintain runs the named task, returning ErrNotSupported if the
+	// backend has no such task.
+	Maintain(ctx context.Context, task string) error
+}
+
 type Notifier interface {
 	// Subscribe registers a key change callback function.
 	Subscribe(func(KeyChange) error)
@@ -118,6 +264,62 @@ type Notifier interface {
 	RenotifyAll() error
 }
 
+// Renotifier may be implemented by storage backends which can notify keys in
+// a stable order, so that a long renotification may be resumed.
+type Renotifier interface {
+	// RenotifyAfter invokes all registered callbacks with KeyAdded
+	// notifications for each key whose digest sorts after the given one,
+	// in digest order. An empty digest notifies every key.
+	RenotifyAfter(digest string) error
+}
+
+// ModTimeFetcher may be implemented by storage backends which record when
+// each key was last modified.
+type ModTimeFetcher interface {
+	// FetchModTimes returns the modification times of the keys matching the
+	// given RFingerprint slice, by RFingerprint.
+	FetchModTimes([]string) (map[string]time.Time, error)
+}
+
+// DigestFetcher may be implemented by storage backends which can fetch a key
+// by its digest, so that the rows of a fingerprint stored more than once can
+// be told apart.
+type DigestFetcher interface {
+	// FetchKeyByMD5 returns the key stored with the given digest. It returns
+	// ErrKeyNotFound if there is no such key, and an *UnparseableError if
+	// it fails to parse.
+	FetchKeyByMD5(md5 string) (*openpgp.PrimaryKey, error)
+}
+
+// DomainMatcher may be implemented by storage backends which can list every
+// key with an address in a mail domain. Unlike MatchKeyword, which caps its
+// results, it pages through all of them.
+type DomainMatcher interface {
+	// MatchDomain returns up to limit RFingerprint IDs of keys with a user
+	// ID address in domain, ordered by RFingerprint and starting after the
+	// given one. An empty RFingerprint starts from the first.
+	MatchDomain(domain string, after string, limit int) ([]string, error)
+}
+
+// Pinger may be implemented by storage backends which can check that their
+// database is reachable.
+type Pinger interface {
+	PingContext(ctx context.Context) error
+}
+
+// ProvenanceRecorder may be implemented by storage backends which record
+// which keys were submitted with proof of possession by their holder.
+type ProvenanceRecorder interface {
+	// RecordProvenance records that the keys matching the given
+	// RFingerprint slice were proven by their holder, as of now.
+	RecordProvenance([]string) error
+
+	// FetchProvenance returns when each of the keys matching the given
+	// RFingerprint slice was last proven, by RFingerprint. Keys never
+	// proven are omitted.
+	FetchProvenance([]string) (map[string]time.Time, error)
+}
+
 type KeyChange interface {
 	InsertDigests() []string
 	RemoveDigests() []string
@@ -215,7 +417,11 @@ func firstMatch(results []*openpgp.PrimaryKey, match string) (*openpgp.PrimaryKe
 	return nil, ErrKeyNotFound
 }
 
-func UpsertKey(storage Storage, pubkey *openpgp.PrimaryKey) (kc KeyChange, err error) {
+// UpsertKey inserts pubkey, or merges it into the stored copy of the key.
+// The user attribute filters among options are applied to the merged key,
+// and the merge fails with openpgp.ErrBudgetExceeded if it takes longer than
+// the key budget among them.
+func UpsertKey(storage Storage, pubkey *openpgp.PrimaryKey, options ...openpgp.KeyReaderOption) (kc KeyChange, err error) {
 	var lastKey *openpgp.PrimaryKey
 	lastKeys, err := storage.FetchKeys([]string{pubkey.RFingerprint})
 	if err == nil {
@@ -237,7 +443,13 @@ func UpsertKey(storage Storage, pubkey *openpgp.PrimaryKey) (kc KeyChange, err e
 	}
 	lastID := lastKey.KeyID()
 	lastMD5 := lastKey.MD5
-	err = openpgp.Merge(lastKey, pubkey)
+	ctx, cancel := openpgp.WithKeyBudget(context.Background(), options...)
+	err = openpgp.MergeContext(ctx, lastKey, pubkey)
+	cancel()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	err = openpgp.FilterUserAttributes(lastKey, options...)
 	if err != nil {
 		return nil, errors.WithStack(err)
 	}
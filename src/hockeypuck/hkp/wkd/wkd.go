@@ -0,0 +1,261 @@
+// Package wkd serves the OpenPGP Web Key Directory for local mail domains
+// from the key database, so that an organizational keyserver can answer WKD
+// lookups without a separate service.
+//
+// Both the direct method, where the domain is taken from the Host header,
+// and the advanced method, where it is given in the path and the server is
+// reached as openpgpkey.<domain>, are supported:
+//
+//	/.well-known/openpgpkey/hu/<hash>?l=<local-part>
+//	/.well-known/openpgpkey/<domain>/hu/<hash>?l=<local-part>
+//	/.well-known/openpgpkey/policy
+//	/.well-known/openpgpkey/<domain>/policy
+package wkd
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/pkg/errors"
+
+	"hockeypuck/hkp/storage"
+	"hockeypuck/logging"
+	log "hockeypuck/logrus"
+	"hockeypuck/openpgp"
+)
+
+var logger = logging.Module("wkd")
+
+type Settings struct {
+	// Domains are the mail domains for which keys are served. WKD is
+	// disabled if empty.
+	Domains []string `toml:"domains"`
+
+	// Policy is the content of the policy file, such as "mailbox-only".
+	// It is empty by default.
+	Policy string `toml:"policy"`
+}
+
+func DefaultSettings() *Settings {
+	return &Settings{}
+}
+
+// Enabled returns whether any WKD domains are configured.
+func (s *Settings) Enabled() bool {
+	return s != nil && len(s.Domains) > 0
+}
+
+// Handler answers WKD requests.
+type Handler struct {
+	storage storage.Storage
+	domains map[string]bool
+	policy  string
+}
+
+// NewHandler returns a handler serving keys from st for the configured
+// domains.
+func NewHandler(st storage.Storage, settings *Settings) (*Handler, error) {
+	if !settings.Enabled() {
+		return nil, errors.New("no WKD domains configured")
+	}
+	h := &Handler{
+		storage: st,
+		domains: map[string]bool{},
+		policy:  settings.Policy,
+	}
+	for _, domain := range settings.Domains {
+		domain = strings.ToLower(strings.TrimSpace(domain))
+		if domain == "" || strings.ContainsAny(domain, "@/ ") {
+			return nil, errors.Errorf("invalid WKD domain %q", domain)
+		}
+		h.domains[domain] = true
+	}
+	return h, nil
+}
+
+func (h *Handler) Register(r *httprouter.Router) {
+	r.GET("/.well-known/openpgpkey/*path", h.serve)
+	r.HEAD("/.well-known/openpgpkey/*path", h.serve)
+}
+
+func (h *Handler) serve(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	// WKD is fetched by web clients on other origins, such as webmail.
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	parts := strings.Split(strings.Trim(ps.ByName("path"), "/"), "/")
+	domain := hostDomain(r.Host)
+	if len(parts) == 2 && parts[1] == "policy" || len(parts) == 3 && parts[1] == "hu" {
+		// Advanced method; the domain is the first element of the path.
+		domain, parts = strings.ToLower(parts[0]), parts[1:]
+	}
+	if !h.domains[domain] {
+		http.NotFound(w, r)
+		return
+	}
+	switch {
+	case len(parts) == 1 && parts[0] == "policy":
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte(h.policy))
+	case len(parts) == 2 && parts[0] == "hu":
+		h.serveKey(w, r, domain, parts[1])
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// hostDomain returns the domain of a request Host header, without the
+// openpgpkey subdomain of the advanced method or a port.
+func hostDomain(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.TrimPrefix(strings.ToLower(host), "openpgpkey.")
+}
+
+func (h *Handler) serveKey(w http.ResponseWriter, r *http.Request, domain, hash string) {
+	if !storage.Supports(h.storage, storage.CapKeywordSearch) {
+		http.Error(w, http.StatusText(http.StatusNotImplemented), http.StatusNotImplemented)
+		return
+	}
+	// Clients give the local part so that it need not be recovered from
+	// the hash; without it, every key in the domain is searched, which
+	// keyword search alone caps.
+	var keys []*openpgp.PrimaryKey
+	var err error
+	search := domain
+	if local := strings.ToLower(r.FormValue("l")); local != "" && HashLocalPart(local) == hash {
+		search = local + "@" + domain
+		keys, err = h.matchKeyword(search, domain, hash)
+	} else if dm, ok := h.storage.(storage.DomainMatcher); ok {
+		keys, err = h.matchDomain(dm, domain, hash)
+	} else {
+		keys, err = h.matchKeyword(search, domain, hash)
+	}
+	if err != nil {
+		logger.WithFields(logging.RequestFields(r)).WithFields(log.Fields{
+			"search": search,
+			"error":  fmt.Sprintf("%+v", err),
+		}).Error("wkd lookup failed")
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	if len(keys) == 0 {
+		http.NotFound(w, r)
+		return
+	}
+
+	var buf bytes.Buffer
+	for _, key := range keys {
+		err = openpgp.WritePackets(&buf, key)
+		if err != nil {
+			logger.WithFields(logging.RequestFields(r)).WithFields(log.Fields{
+				"search": search,
+				"error":  fmt.Sprintf("%+v", err),
+			}).Error("wkd lookup failed")
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Write(buf.Bytes())
+}
+
+// matchKeyword returns the keys found by a keyword search with an address
+// in domain matching hash.
+func (h *Handler) matchKeyword(search, domain, hash string) ([]*openpgp.PrimaryKey, error) {
+	rfps, err := h.storage.MatchKeyword([]string{search})
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return h.fetchMatching(rfps, domain, hash)
+}
+
+// domainPageSize is the number of keys fetched at a time when searching a
+// whole domain.
+const domainPageSize = 100
+
+// matchDomain returns every key with an address in domain matching hash,
+// paging through all the keys in the domain.
+func (h *Handler) matchDomain(dm storage.DomainMatcher, domain, hash string) ([]*openpgp.PrimaryKey, error) {
+	var result []*openpgp.PrimaryKey
+	var after string
+	for {
+		rfps, err := dm.MatchDomain(domain, after, domainPageSize)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		keys, err := h.fetchMatching(rfps, domain, hash)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		result = append(result, keys...)
+		if len(rfps) < domainPageSize {
+			return result, nil
+		}
+		after = rfps[len(rfps)-1]
+	}
+}
+
+// fetchMatching fetches the keys rfps, minimized to their addresses in
+// domain matching hash, and drops those without any.
+func (h *Handler) fetchMatching(rfps []string, domain, hash string) ([]*openpgp.PrimaryKey, error) {
+	if len(rfps) == 0 {
+		return nil, nil
+	}
+	keys, err := h.storage.FetchKeys(rfps)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	var result []*openpgp.PrimaryKey
+	for _, key := range keys {
+		if keepAddress(key, domain, hash) {
+			result = append(result, key)
+		}
+	}
+	return result, nil
+}
+
+// keepAddress reduces key to its self-signed user IDs with an address in
+// domain whose local part has the given hash, and returns whether any
+// remain. Revoked and expired keys are kept, so that WKD clients learn of
+// the revocation.
+func keepAddress(key *openpgp.PrimaryKey, domain, hash string) bool {
+	ok, err := openpgp.Minimize(key, func(uid *openpgp.UserID) bool {
+		addr := uid.Address()
+		at := strings.LastIndex(addr, "@")
+		return at >= 0 && addr[at+1:] == domain && HashLocalPart(addr[:at]) == hash
+	})
+	if err != nil {
+		logger.WithFields(log.Fields{
+			"fp":    key.Fingerprint(),
+			"error": fmt.Sprintf("%+v", err),
+		}).Error("wkd key check failed")
+		return false
+	}
+	return ok
+}
+
+const zbase32Alphabet = "ybndrfg8ejkmcpqxot1uwisza345h769"
+
+// HashLocalPart returns the WKD hash of the local part of an address: the
+// z-base-32 encoded SHA-1 digest of the local part in lower case.
+func HashLocalPart(local string) string {
+	digest := sha1.Sum([]byte(strings.ToLower(local)))
+	var result []byte
+	var acc uint
+	var bits uint
+	for _, b := range digest {
+		acc = acc<<8 | uint(b)
+		bits += 8
+		for bits >= 5 {
+			bits -= 5
+			result = append(result, zbase32Alphabet[(acc>>bits)&0x1f])
+		}
+	}
+	return string(result)
+}
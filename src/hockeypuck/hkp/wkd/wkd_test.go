@@ -0,0 +1,176 @@
+package wkd
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	stdtesting "testing"
+
+	"github.com/julienschmidt/httprouter"
+	gc "gopkg.in/check.v1"
+
+	"hockeypuck/hkp/storage"
+	"hockeypuck/hkp/storage/mock"
+	"hockeypuck/openpgp"
+	"hockeypuck/testing"
+)
+
+func Test(t *stdtesting.T) { gc.TestingT(t) }
+
+type WKDSuite struct {
+	storage *mock.Storage
+	srv     *httptest.Server
+}
+
+var _ = gc.Suite(&WKDSuite{})
+
+func (s *WKDSuite) SetUpTest(c *gc.C) {
+	s.storage = mock.NewStorage(
+		mock.MatchKeyword(func(keywords []string) ([]string, error) {
+			return []string{"accd0e320f1cb163a2aa9305257f384b1fc8ef01"}, nil
+		}),
+		mock.MatchDomain(func(domain, after string, limit int) ([]string, error) {
+			return []string{"accd0e320f1cb163a2aa9305257f384b1fc8ef01"}, nil
+		}),
+		mock.FetchKeys(func(rfps []string) ([]*openpgp.PrimaryKey, error) {
+			return openpgp.MustReadArmorKeys(testing.MustInput("alice_signed.asc")), nil
+		}),
+	)
+	h, err := NewHandler(s.storage, &Settings{
+		Domains: []string{"Example.com"},
+		Policy:  "mailbox-only\n",
+	})
+	c.Assert(err, gc.IsNil)
+	r := httprouter.New()
+	h.Register(r)
+	s.srv = httptest.NewServer(r)
+}
+
+func (s *WKDSuite) TearDownTest(c *gc.C) {
+	s.srv.Close()
+}
+
+func (s *WKDSuite) get(c *gc.C, host, path string) (*http.Response, []byte) {
+	req, err := http.NewRequest("GET", s.srv.URL+path, nil)
+	c.Assert(err, gc.IsNil)
+	req.Host = host
+	resp, err := http.DefaultClient.Do(req)
+	c.Assert(err, gc.IsNil)
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	c.Assert(err, gc.IsNil)
+	return resp, body
+}
+
+func (s *WKDSuite) TestHashLocalPart(c *gc.C) {
+	// Example from the Web Key Directory draft.
+	c.Assert(HashLocalPart("Joe.Doe"), gc.Equals, "iy9q119eutrkn8s1mk4r39qejnbu3n5q")
+}
+
+func (s *WKDSuite) TestDirect(c *gc.C) {
+	hash := HashLocalPart("alice")
+	for _, path := range []string{
+		"/.well-known/openpgpkey/hu/" + hash + "?l=alice",
+		"/.well-known/openpgpkey/hu/" + hash,
+	} {
+		resp, body := s.get(c, "example.com", path)
+		c.Assert(resp.StatusCode, gc.Equals, http.StatusOK, gc.Commentf("%s", path))
+		c.Assert(resp.Header.Get("Access-Control-Allow-Origin"), gc.Equals, "*")
+		keys := openpgp.MustReadKeys(bytes.NewBuffer(body))
+		c.Assert(keys, gc.HasLen, 1)
+		c.Assert(keys[0].UserIDs, gc.HasLen, 1)
+		c.Assert(keys[0].UserIDs[0].Address(), gc.Equals, "alice@example.com")
+		for _, sig := range keys[0].UserIDs[0].Signatures {
+			c.Assert(sig.RIssuerKeyID, gc.Equals, keys[0].RKeyID)
+		}
+	}
+	c.Assert(s.storage.Calls[0].Args, gc.DeepEquals, []interface{}{[]string{"alice@example.com"}})
+	c.Assert(s.storage.Calls[2].Name, gc.Equals, "MatchDomain")
+	c.Assert(s.storage.Calls[2].Args, gc.DeepEquals, []interface{}{"example.com", "", domainPageSize})
+}
+
+func (s *WKDSuite) TestDomainPages(c *gc.C) {
+	var afters []string
+	st := mock.NewStorage(
+		mock.MatchDomain(func(domain, after string, limit int) ([]string, error) {
+			afters = append(afters, after)
+			if after != "" {
+				return []string{"accd0e320f1cb163a2aa9305257f384b1fc8ef01"}, nil
+			}
+			// A full page of keys without a matching address.
+			rfps := make([]string, limit)
+			for i := range rfps {
+				rfps[i] = fmt.Sprintf("%040x", i)
+			}
+			return rfps, nil
+		}),
+		mock.FetchKeys(func(rfps []string) ([]*openpgp.PrimaryKey, error) {
+			if len(rfps) > 1 {
+				return nil, nil
+			}
+			return openpgp.MustReadArmorKeys(testing.MustInput("alice_signed.asc")), nil
+		}),
+	)
+	h, err := NewHandler(st, &Settings{Domains: []string{"example.com"}})
+	c.Assert(err, gc.IsNil)
+	r := httprouter.New()
+	h.Register(r)
+	s.srv.Close()
+	s.srv = httptest.NewServer(r)
+
+	resp, body := s.get(c, "example.com", "/.well-known/openpgpkey/hu/"+HashLocalPart("alice"))
+	c.Assert(resp.StatusCode, gc.Equals, http.StatusOK)
+	c.Assert(openpgp.MustReadKeys(bytes.NewBuffer(body)), gc.HasLen, 1)
+	c.Assert(afters, gc.DeepEquals, []string{"", fmt.Sprintf("%040x", domainPageSize-1)})
+}
+
+func (s *WKDSuite) TestAdvanced(c *gc.C) {
+	hash := HashLocalPart("alice")
+	resp, body := s.get(c, "openpgpkey.example.com", "/.well-known/openpgpkey/example.com/hu/"+hash+"?l=alice")
+	c.Assert(resp.StatusCode, gc.Equals, http.StatusOK)
+	c.Assert(body, gc.Not(gc.HasLen), 0)
+
+	resp, body = s.get(c, "openpgpkey.example.com", "/.well-known/openpgpkey/example.com/policy")
+	c.Assert(resp.StatusCode, gc.Equals, http.StatusOK)
+	c.Assert(string(body), gc.Equals, "mailbox-only\n")
+}
+
+func (s *WKDSuite) TestNotFound(c *gc.C) {
+	for _, t := range []struct{ host, path string }{
+		// Unknown local part.
+		{"example.com", "/.well-known/openpgpkey/hu/" + HashLocalPart("bob") + "?l=bob"},
+		// Domain not served.
+		{"example.org", "/.well-known/openpgpkey/hu/" + HashLocalPart("alice") + "?l=alice"},
+		{"example.org", "/.well-known/openpgpkey/example.org/hu/" + HashLocalPart("alice")},
+		{"example.org", "/.well-known/openpgpkey/policy"},
+		{"example.com", "/.well-known/openpgpkey/submission-address"},
+	} {
+		resp, _ := s.get(c, t.host, t.path)
+		c.Assert(resp.StatusCode, gc.Equals, http.StatusNotFound, gc.Commentf("%s %s", t.host, t.path))
+	}
+}
+
+func (s *WKDSuite) TestUnsupported(c *gc.C) {
+	h, err := NewHandler(mock.NewStorage(mock.Unsupported(storage.CapKeywordSearch)), &Settings{
+		Domains: []string{"example.com"},
+	})
+	c.Assert(err, gc.IsNil)
+	r := httprouter.New()
+	h.Register(r)
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/.well-known/openpgpkey/example.com/hu/" + HashLocalPart("alice"))
+	c.Assert(err, gc.IsNil)
+	resp.Body.Close()
+	c.Assert(resp.StatusCode, gc.Equals, http.StatusNotImplemented)
+}
+
+func (s *WKDSuite) TestSettings(c *gc.C) {
+	_, err := NewHandler(s.storage, &Settings{})
+	c.Assert(err, gc.NotNil)
+	_, err = NewHandler(s.storage, &Settings{Domains: []string{"alice@example.com"}})
+	c.Assert(err, gc.ErrorMatches, `invalid WKD domain .*`)
+}
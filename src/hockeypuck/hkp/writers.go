@@ -29,20 +29,34 @@ import (
 	"github.com/pkg/errors"
 
 	"hockeypuck/hkp/jsonhkp"
+	"hockeypuck/hkp/storage"
 	"hockeypuck/openpgp"
+	"hockeypuck/proofs"
 )
 
 type IndexFormat interface {
 	Write(w http.ResponseWriter, l *Lookup, keys []*openpgp.PrimaryKey) error
 }
 
-type JSONFormat struct{}
+type JSONFormat struct {
+	// Proofs, if set, verifies the identity proofs listed.
+	Proofs *proofs.Verifier
 
-var jsonFormat = &JSONFormat{}
+	// Provenance, if set, lists whether keys were submitted with proof of
+	// possession.
+	Provenance storage.ProvenanceRecorder
 
-func (*JSONFormat) Write(w http.ResponseWriter, _ *Lookup, keys []*openpgp.PrimaryKey) error {
+	// Redact is the redaction mode applied to lookups other than by exact
+	// key ID.
+	Redact string
+}
+
+func (f *JSONFormat) Write(w http.ResponseWriter, l *Lookup, keys []*openpgp.PrimaryKey) error {
 	w.Header().Set("Content-Type", "application/json")
 	wireKeys := jsonhkp.NewPrimaryKeys(keys)
+	annotateProofs(wireKeys, f.Proofs)
+	annotateProvenance(wireKeys, f.Provenance)
+	jsonhkp.Redact(wireKeys, redaction(f.Redact, l))
 	out, err := json.MarshalIndent(wireKeys, "", "\t")
 	if err != nil {
 		return errors.WithStack(err)
@@ -51,12 +65,15 @@ func (*JSONFormat) Write(w http.ResponseWriter, _ *Lookup, keys []*openpgp.Prima
 	return errors.WithStack(err)
 }
 
-type MRFormat struct{}
-
-var mrFormat = &MRFormat{}
+type MRFormat struct {
+	// Redact is the redaction mode applied to lookups other than by exact
+	// key ID.
+	Redact string
+}
 
-func (*MRFormat) Write(w http.ResponseWriter, l *Lookup, keys []*openpgp.PrimaryKey) error {
+func (f *MRFormat) Write(w http.ResponseWriter, l *Lookup, keys []*openpgp.PrimaryKey) error {
 	w.Header().Set("Content-Type", "text/plain")
+	redact := redaction(f.Redact, l)
 
 	fmt.Fprintf(w, "info:1:%d\n", len(keys))
 	for _, key := range keys {
@@ -78,14 +95,21 @@ func (*MRFormat) Write(w http.ResponseWriter, l *Lookup, keys []*openpgp.Primary
 		fmt.Fprintf(w, "pub:%s:%d:%d:%d:%s:\n", keyID, key.Algorithm, key.BitLen,
 			key.Creation.Unix(), mrTimeString(expiresAt))
 
+		if redact == jsonhkp.RedactUserID {
+			continue
+		}
 		for _, uid := range key.UserIDs {
 			selfsigs, _ := uid.SigInfo(key)
 			validSince, ok := selfsigs.ValidSince()
 			if !ok {
 				continue
 			}
+			keywords := uid.Keywords
+			if redact == jsonhkp.RedactEmail {
+				keywords = jsonhkp.RedactAddresses(keywords)
+			}
 			expiresAt, _ := selfsigs.ExpiresAt()
-			fmt.Fprintf(w, "uid:%s:%d:%s:\n", strings.Replace(uid.Keywords, ":", "%3a", -1),
+			fmt.Fprintf(w, "uid:%s:%d:%s:\n", strings.Replace(keywords, ":", "%3a", -1),
 				validSince.Unix(), mrTimeString(expiresAt))
 		}
 	}
@@ -94,6 +118,17 @@ func (*MRFormat) Write(w http.ResponseWriter, l *Lookup, keys []*openpgp.Primary
 
 type HTMLFormat struct {
 	t *template.Template
+
+	// Proofs, if set, verifies the identity proofs listed.
+	Proofs *proofs.Verifier
+
+	// Provenance, if set, lists whether keys were submitted with proof of
+	// possession.
+	Provenance storage.ProvenanceRecorder
+
+	// Redact is the redaction mode applied to lookups other than by exact
+	// key ID.
+	Redact string
 }
 
 func NewHTMLFormat(path string, extra []string) (*HTMLFormat, error) {
@@ -119,8 +154,35 @@ func NewHTMLFormat(path string, extra []string) (*HTMLFormat, error) {
 func (f *HTMLFormat) Write(w http.ResponseWriter, l *Lookup, keys []*openpgp.PrimaryKey) error {
 	w.Header().Set("Content-Type", "text/html")
 	wireKeys := jsonhkp.NewPrimaryKeys(keys)
+	annotateProofs(wireKeys, f.Proofs)
+	annotateProvenance(wireKeys, f.Provenance)
+	jsonhkp.Redact(wireKeys, redaction(f.Redact, l))
 	return errors.WithStack(f.t.Execute(w, struct {
 		Keys  []*jsonhkp.PrimaryKey
 		Query *Lookup
 	}{wireKeys, l}))
 }
+
+// redaction returns the redaction mode applied to a lookup. Keys looked up
+// by exact key ID are listed in full, since whoever made the lookup already
+// knew which key they wanted.
+func redaction(mode string, l *Lookup) string {
+	if l.ExactKeyID() {
+		return jsonhkp.RedactNone
+	}
+	return mode
+}
+
+// annotateProofs sets the status of each identity proof listed in keys.
+func annotateProofs(keys []*jsonhkp.PrimaryKey, v *proofs.Verifier) {
+	if v == nil {
+		return
+	}
+	for _, key := range keys {
+		for _, uid := range key.UserIDs {
+			for _, proof := range uid.Proofs {
+				proof.Status = v.Status(key.Fingerprint, proof.URI)
+			}
+		}
+	}
+}
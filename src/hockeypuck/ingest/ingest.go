@@ -0,0 +1,242 @@
+// Package ingest schedules the writing of keys to storage fairly between the
+// sources of key updates, so that bulk recon recovery cannot starve
+// interactive submissions to /pks/add, and a flood of submissions cannot
+// stall recon.
+//
+// A fixed number of workers may write to storage at once. Each class of
+// source may hold at most its quota of them, so that the others always have
+// workers to spare. Writes waiting for a worker are queued by class, and
+// freed workers go to each class with writes waiting in turn.
+package ingest
+
+import (
+	"context"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// Classes of key update source.
+const (
+	// ClassSubmission is keys submitted to /pks/add.
+	ClassSubmission = "submission"
+
+	// ClassRecon is keys recovered from SKS recon peers.
+	ClassRecon = "recon"
+
+	// ClassReplica is keys replicated from a primary server.
+	ClassReplica = "replica"
+)
+
+var classes = []string{ClassSubmission, ClassRecon, ClassReplica}
+
+const (
+	DefaultWorkers             = 8
+	DefaultSubmissionWorkers   = 6
+	DefaultSubmissionQueueSize = 100
+	DefaultBulkWorkers         = 4
+)
+
+type Settings struct {
+	// Workers is the number of writes which may be made at once. Zero
+	// disables scheduling, so that every write is made immediately.
+	Workers int `toml:"workers"`
+
+	Submission ClassSettings `toml:"submission"`
+	Recon      ClassSettings `toml:"recon"`
+	Replica    ClassSettings `toml:"replica"`
+}
+
+type ClassSettings struct {
+	// MaxWorkers is the quota of workers the class may hold at once. Zero
+	// allows it all of them.
+	MaxWorkers int `toml:"maxWorkers"`
+
+	// MaxQueue is the number of writes of the class which may wait for a
+	// worker, beyond which writes are refused with ErrQueueFull. Zero is
+	// unlimited.
+	MaxQueue int `toml:"maxQueue"`
+}
+
+func DefaultSettings() *Settings {
+	return &Settings{
+		Workers: DefaultWorkers,
+		Submission: ClassSettings{
+			MaxWorkers: DefaultSubmissionWorkers,
+			MaxQueue:   DefaultSubmissionQueueSize,
+		},
+		Recon: ClassSettings{
+			MaxWorkers: DefaultBulkWorkers,
+		},
+		Replica: ClassSettings{
+			MaxWorkers: DefaultBulkWorkers,
+		},
+	}
+}
+
+// ErrQueueFull is returned when too many writes of a class are waiting for a
+// worker.
+var ErrQueueFull = errors.New("ingest queue full")
+
+type class struct {
+	name       string
+	maxWorkers int
+	maxQueue   int
+	active     int
+	waiting    []chan struct{}
+}
+
+func (c *class) runnable() bool {
+	return c.maxWorkers <= 0 || c.active < c.maxWorkers
+}
+
+// Scheduler hands out workers to writes of each class.
+type Scheduler struct {
+	mu      sync.Mutex
+	workers int
+	active  int
+	classes map[string]*class
+	next    int
+}
+
+// NewScheduler returns a scheduler configured by settings, or nil if
+// scheduling is disabled. A nil scheduler makes every write immediately.
+func NewScheduler(settings *Settings) *Scheduler {
+	if settings == nil || settings.Workers <= 0 {
+		return nil
+	}
+	registerMetrics()
+	s := &Scheduler{
+		workers: settings.Workers,
+		classes: map[string]*class{},
+	}
+	for name, cs := range map[string]ClassSettings{
+		ClassSubmission: settings.Submission,
+		ClassRecon:      settings.Recon,
+		ClassReplica:    settings.Replica,
+	} {
+		s.classes[name] = &class{name: name, maxWorkers: cs.MaxWorkers, maxQueue: cs.MaxQueue}
+	}
+	return s
+}
+
+// Acquire waits for a worker to write keys of the given class, returning a
+// function which frees it once the write is done. It fails with
+// ErrQueueFull if too many writes of the class are waiting, or with the
+// context's error if the context is done first. It may be called on a nil
+// scheduler.
+func (s *Scheduler) Acquire(ctx context.Context, className string) (func(), error) {
+	if s == nil {
+		return func() {}, nil
+	}
+	s.mu.Lock()
+	c, ok := s.classes[className]
+	if !ok {
+		s.mu.Unlock()
+		return nil, errors.Errorf("unknown ingest class %q", className)
+	}
+	if len(c.waiting) == 0 && s.active < s.workers && c.runnable() {
+		s.start(c)
+		s.mu.Unlock()
+		return s.releaser(c), nil
+	}
+	if c.maxQueue > 0 && len(c.waiting) >= c.maxQueue {
+		s.mu.Unlock()
+		ingestMetrics.rejected.WithLabelValues(c.name).Inc()
+		return nil, errors.WithStack(ErrQueueFull)
+	}
+	ready := make(chan struct{})
+	c.waiting = append(c.waiting, ready)
+	ingestMetrics.queued.WithLabelValues(c.name).Inc()
+	s.mu.Unlock()
+
+	select {
+	case <-ready:
+		return s.releaser(c), nil
+	case <-ctx.Done():
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := range c.waiting {
+		if c.waiting[i] == ready {
+			c.waiting = append(c.waiting[:i], c.waiting[i+1:]...)
+			ingestMetrics.queued.WithLabelValues(c.name).Dec()
+			return nil, errors.WithStack(ctx.Err())
+		}
+	}
+	// The worker was handed over just as the context was done.
+	s.stop(c)
+	return nil, errors.WithStack(ctx.Err())
+}
+
+func (s *Scheduler) start(c *class) {
+	s.active++
+	c.active++
+	ingestMetrics.active.WithLabelValues(c.name).Inc()
+}
+
+// stop frees a worker held by c and hands it on. s.mu must be held.
+func (s *Scheduler) stop(c *class) {
+	s.active--
+	c.active--
+	ingestMetrics.active.WithLabelValues(c.name).Dec()
+	s.dispatch()
+}
+
+func (s *Scheduler) releaser(c *class) func() {
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			s.stop(c)
+		})
+	}
+}
+
+// dispatch hands free workers to waiting writes, taking each class in turn.
+// s.mu must be held.
+func (s *Scheduler) dispatch() {
+	for s.active < s.workers {
+		var c *class
+		for i := 0; i < len(classes); i++ {
+			candidate := s.classes[classes[(s.next+i)%len(classes)]]
+			if len(candidate.waiting) > 0 && candidate.runnable() {
+				c = candidate
+				s.next = (s.next + i + 1) % len(classes)
+				break
+			}
+		}
+		if c == nil {
+			return
+		}
+		ready := c.waiting[0]
+		c.waiting = c.waiting[1:]
+		ingestMetrics.queued.WithLabelValues(c.name).Dec()
+		s.start(c)
+		close(ready)
+	}
+}
+
+// Status describes the workers held and writes waiting for each class.
+type Status struct {
+	Class   string `json:"class"`
+	Active  int    `json:"active"`
+	Waiting int    `json:"waiting"`
+}
+
+// Status returns the current state of each class.
+func (s *Scheduler) Status() []Status {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var result []Status
+	for _, name := range classes {
+		c := s.classes[name]
+		result = append(result, Status{Class: name, Active: c.active, Waiting: len(c.waiting)})
+	}
+	return result
+}
@@ -0,0 +1,138 @@
+package ingest
+
+import (
+	"context"
+	stdtesting "testing"
+	"time"
+
+	"github.com/pkg/errors"
+	gc "gopkg.in/check.v1"
+)
+
+func Test(t *stdtesting.T) { gc.TestingT(t) }
+
+type IngestSuite struct{}
+
+var _ = gc.Suite(&IngestSuite{})
+
+func (s *IngestSuite) acquire(c *gc.C, sched *Scheduler, class string) func() {
+	release, err := sched.Acquire(context.Background(), class)
+	c.Assert(err, gc.IsNil)
+	return release
+}
+
+// acquireAsync starts waiting for a worker, returning a channel which
+// receives the release function once one is handed over.
+func (s *IngestSuite) acquireAsync(c *gc.C, sched *Scheduler, class string) chan func() {
+	ch := make(chan func(), 1)
+	go func() {
+		release, err := sched.Acquire(context.Background(), class)
+		c.Check(err, gc.IsNil)
+		ch <- release
+	}()
+	for i := 0; i < 100; i++ {
+		for _, st := range sched.Status() {
+			if st.Class == class && st.Waiting > 0 {
+				return ch
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Fatalf("%s write did not wait", class)
+	return nil
+}
+
+func (s *IngestSuite) TestQuota(c *gc.C) {
+	sched := NewScheduler(&Settings{
+		Workers: 3,
+		Recon:   ClassSettings{MaxWorkers: 2},
+	})
+	s.acquire(c, sched, ClassRecon)
+	release := s.acquire(c, sched, ClassRecon)
+
+	// Recon has used its quota, leaving a worker for submissions.
+	waiting := s.acquireAsync(c, sched, ClassRecon)
+	s.acquire(c, sched, ClassSubmission)
+
+	release()
+	release() // Releasing twice has no effect.
+	select {
+	case <-waiting:
+	case <-time.After(5 * time.Second):
+		c.Fatal("recon write was not handed a worker")
+	}
+	c.Assert(sched.Status(), gc.DeepEquals, []Status{
+		{Class: ClassSubmission, Active: 1},
+		{Class: ClassRecon, Active: 2},
+		{Class: ClassReplica},
+	})
+}
+
+func (s *IngestSuite) TestFairness(c *gc.C) {
+	sched := NewScheduler(&Settings{Workers: 1})
+	release := s.acquire(c, sched, ClassRecon)
+
+	recon1 := s.acquireAsync(c, sched, ClassRecon)
+	recon2 := s.acquireAsync(c, sched, ClassRecon)
+	submission := s.acquireAsync(c, sched, ClassSubmission)
+
+	// Each class with writes waiting is served in turn, however many
+	// writes the others have queued.
+	release()
+	var order []string
+	for len(order) < 3 {
+		var next func()
+		select {
+		case next = <-recon1:
+			order = append(order, "recon1")
+		case next = <-recon2:
+			order = append(order, "recon2")
+		case next = <-submission:
+			order = append(order, "submission")
+		case <-time.After(5 * time.Second):
+			c.Fatalf("writes not handed workers after %v", order)
+		}
+		next()
+	}
+	c.Assert(order, gc.DeepEquals, []string{"submission", "recon1", "recon2"})
+}
+
+func (s *IngestSuite) TestQueueFull(c *gc.C) {
+	sched := NewScheduler(&Settings{
+		Workers:    1,
+		Submission: ClassSettings{MaxQueue: 1},
+	})
+	release := s.acquire(c, sched, ClassRecon)
+	waiting := s.acquireAsync(c, sched, ClassSubmission)
+
+	_, err := sched.Acquire(context.Background(), ClassSubmission)
+	c.Assert(errors.Is(err, ErrQueueFull), gc.Equals, true)
+
+	release()
+	(<-waiting)()
+}
+
+func (s *IngestSuite) TestCancel(c *gc.C) {
+	sched := NewScheduler(&Settings{Workers: 1})
+	release := s.acquire(c, sched, ClassRecon)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err := sched.Acquire(ctx, ClassSubmission)
+	c.Assert(errors.Is(err, context.DeadlineExceeded), gc.Equals, true)
+	c.Assert(sched.Status()[0], gc.DeepEquals, Status{Class: ClassSubmission})
+
+	release()
+	s.acquire(c, sched, ClassSubmission)
+}
+
+func (s *IngestSuite) TestDisabled(c *gc.C) {
+	sched := NewScheduler(&Settings{})
+	c.Assert(sched, gc.IsNil)
+	release := s.acquire(c, sched, ClassSubmission)
+	release()
+	c.Assert(sched.Status(), gc.IsNil)
+
+	_, err := NewScheduler(DefaultSettings()).Acquire(context.Background(), "bogus")
+	c.Assert(err, gc.ErrorMatches, `unknown ingest class "bogus"`)
+}
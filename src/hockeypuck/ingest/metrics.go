@@ -0,0 +1,48 @@
+package ingest
+
+import (
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var ingestMetrics = struct {
+	active   *prometheus.GaugeVec
+	queued   *prometheus.GaugeVec
+	rejected *prometheus.CounterVec
+}{
+	active: prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "hockeypuck",
+			Name:      "ingest_active",
+			Help:      "Key writes in progress, by source class",
+		},
+		[]string{"class"},
+	),
+	queued: prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "hockeypuck",
+			Name:      "ingest_queued",
+			Help:      "Key writes waiting for a worker, by source class",
+		},
+		[]string{"class"},
+	),
+	rejected: prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "hockeypuck",
+			Name:      "ingest_rejected",
+			Help:      "Key writes refused because the queue of their source class was full since startup",
+		},
+		[]string{"class"},
+	),
+}
+
+var metricsRegister sync.Once
+
+func registerMetrics() {
+	metricsRegister.Do(func() {
+		prometheus.MustRegister(ingestMetrics.active)
+		prometheus.MustRegister(ingestMetrics.queued)
+		prometheus.MustRegister(ingestMetrics.rejected)
+	})
+}
@@ -0,0 +1,9 @@
+// Package integration contains end-to-end tests which run pairs of complete
+// Hockeypuck servers, each with its own PostgreSQL database, reconciling
+// with each other.
+//
+// The tests require PostgreSQL binaries on the PATH of pg_config, and a Go
+// toolchain for building the commands under test. Run them with:
+//
+//	go test -tags=integration hockeypuck/integration
+package integration
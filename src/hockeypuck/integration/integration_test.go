@@ -0,0 +1,278 @@
+//go:build integration
+// +build integration
+
+package integration
+
+import (
+	"database/sql"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	stdtesting "testing"
+	"time"
+
+	_ "github.com/lib/pq"
+	gc "gopkg.in/check.v1"
+
+	"hockeypuck/openpgp"
+	"hockeypuck/pgtest"
+	"hockeypuck/server"
+	"hockeypuck/testing"
+	"hockeypuck/testing/keygen"
+)
+
+func Test(t *stdtesting.T) { gc.TestingT(t) }
+
+const convergeTimeout = 60 * time.Second
+
+// instance is a running Hockeypuck server and its configuration.
+type instance struct {
+	name       string
+	configFile string
+	httpAddr   string
+	reconAddr  string
+	srv        *server.Server
+}
+
+type S struct {
+	pgtest.PGSuite
+	dir       string
+	instances []*instance
+}
+
+var _ = gc.Suite(&S{})
+
+func (s *S) SetUpTest(c *gc.C) {
+	s.PGSuite.SetUpTest(c)
+	s.dir = c.MkDir()
+
+	db, err := sql.Open("postgres", s.URL)
+	c.Assert(err, gc.IsNil)
+	defer db.Close()
+
+	ports := freePorts(c, 6)
+	s.instances = []*instance{{
+		name:      "hkp1",
+		httpAddr:  fmt.Sprintf("127.0.0.1:%d", ports[0]),
+		reconAddr: fmt.Sprintf("127.0.0.1:%d", ports[1]),
+	}, {
+		name:      "hkp2",
+		httpAddr:  fmt.Sprintf("127.0.0.1:%d", ports[2]),
+		reconAddr: fmt.Sprintf("127.0.0.1:%d", ports[3]),
+	}}
+	for i, inst := range s.instances {
+		_, err = db.Exec("CREATE DATABASE " + inst.name)
+		c.Assert(err, gc.IsNil)
+
+		partner := s.instances[1-i]
+		config := fmt.Sprintf(`
+[hockeypuck]
+loglevel="WARNING"
+
+[hockeypuck.hkp]
+bind=%q
+
+[hockeypuck.metrics]
+metricsAddr="127.0.0.1:%d"
+
+[hockeypuck.openpgp.db]
+driver="postgres-jsonb"
+dsn="host=%s dbname=%s sslmode=disable"
+
+[hockeypuck.conflux.recon]
+httpAddr=%q
+reconAddr=%q
+allowCIDRs=["127.0.0.0/8"]
+gossipIntervalSecs=1
+
+[hockeypuck.conflux.recon.leveldb]
+path=%q
+
+[hockeypuck.conflux.recon.partner.%s]
+httpAddr=%q
+reconAddr=%q
+`, inst.httpAddr, ports[4+i], s.Dir, inst.name, inst.httpAddr, inst.reconAddr,
+			filepath.Join(s.dir, inst.name+".recon"), partner.name, partner.httpAddr, partner.reconAddr)
+		inst.configFile = filepath.Join(s.dir, inst.name+".conf")
+		err = ioutil.WriteFile(inst.configFile, []byte(config), 0644)
+		c.Assert(err, gc.IsNil)
+	}
+}
+
+func (s *S) TearDownTest(c *gc.C) {
+	for _, inst := range s.instances {
+		if inst.srv != nil {
+			inst.srv.Stop()
+			inst.srv = nil
+		}
+	}
+	s.PGSuite.TearDownTest(c)
+}
+
+func freePorts(c *gc.C, n int) []int {
+	var ports []int
+	var listeners []net.Listener
+	for i := 0; i < n; i++ {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		c.Assert(err, gc.IsNil)
+		listeners = append(listeners, l)
+		ports = append(ports, l.Addr().(*net.TCPAddr).Port)
+	}
+	for _, l := range listeners {
+		c.Assert(l.Close(), gc.IsNil)
+	}
+	return ports
+}
+
+func (s *S) start(c *gc.C, inst *instance) {
+	buf, err := ioutil.ReadFile(inst.configFile)
+	c.Assert(err, gc.IsNil)
+	settings, err := server.ParseSettings(string(buf))
+	c.Assert(err, gc.IsNil)
+	inst.srv, err = server.NewServer(settings)
+	c.Assert(err, gc.IsNil)
+	c.Assert(inst.srv.Start(), gc.IsNil)
+
+	for i := 0; i < 50; i++ {
+		if conn, err := net.Dial("tcp", inst.httpAddr); err == nil {
+			conn.Close()
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	c.Fatalf("timeout waiting for %s to start", inst.name)
+}
+
+func (s *S) startAll(c *gc.C) {
+	for _, inst := range s.instances {
+		s.start(c, inst)
+	}
+}
+
+func readKey(c *gc.C, name string) (string, *openpgp.PrimaryKey) {
+	keytext, err := ioutil.ReadAll(testing.MustInput(name))
+	c.Assert(err, gc.IsNil)
+	keys := openpgp.MustReadArmorKeys(strings.NewReader(string(keytext)))
+	c.Assert(keys, gc.HasLen, 1)
+	return string(keytext), keys[0]
+}
+
+func addKey(c *gc.C, inst *instance, keytext string) {
+	resp, err := http.PostForm(fmt.Sprintf("http://%s/pks/add", inst.httpAddr), url.Values{
+		"keytext": []string{keytext},
+	})
+	c.Assert(err, gc.IsNil)
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	c.Assert(resp.StatusCode, gc.Equals, http.StatusOK, gc.Commentf("%s", body))
+}
+
+// lookupKey returns the HTTP status of a get request for the key on inst.
+func lookupKey(c *gc.C, inst *instance, key *openpgp.PrimaryKey) int {
+	resp, err := http.Get(fmt.Sprintf("http://%s/pks/lookup?op=get&search=0x%s",
+		inst.httpAddr, key.Fingerprint()))
+	c.Assert(err, gc.IsNil)
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return resp.StatusCode
+	}
+	keys, err := openpgp.ReadArmorKeys(resp.Body)
+	c.Assert(err, gc.IsNil)
+	c.Assert(keys, gc.HasLen, 1)
+	c.Assert(keys[0].Fingerprint(), gc.Equals, key.Fingerprint())
+	return resp.StatusCode
+}
+
+func waitForKey(c *gc.C, inst *instance, key *openpgp.PrimaryKey) {
+	deadline := time.Now().Add(convergeTimeout)
+	for time.Now().Before(deadline) {
+		if lookupKey(c, inst, key) == http.StatusOK {
+			return
+		}
+		time.Sleep(time.Second)
+	}
+	c.Fatalf("timeout waiting for key %s on %s", key.Fingerprint(), inst.name)
+}
+
+func (s *S) TestAddLookup(c *gc.C) {
+	s.startAll(c)
+	hkp1 := s.instances[0]
+
+	keytext, key := readKey(c, "alice_signed.asc")
+	c.Assert(lookupKey(c, hkp1, key), gc.Equals, http.StatusNotFound)
+	addKey(c, hkp1, keytext)
+	c.Assert(lookupKey(c, hkp1, key), gc.Equals, http.StatusOK)
+}
+
+func (s *S) TestConvergence(c *gc.C) {
+	s.startAll(c)
+	hkp1, hkp2 := s.instances[0], s.instances[1]
+
+	keytext1, key1 := readKey(c, "alice_signed.asc")
+	keytext2, key2 := readKey(c, "e68e311d.asc")
+	keytext3, key3 := readKey(c, "fece664e.asc")
+	addKey(c, hkp1, keytext1)
+	addKey(c, hkp1, keytext3)
+	addKey(c, hkp2, keytext2)
+	addKey(c, hkp2, keytext3)
+
+	waitForKey(c, hkp2, key1)
+	waitForKey(c, hkp1, key2)
+	c.Assert(lookupKey(c, hkp1, key3), gc.Equals, http.StatusOK)
+	c.Assert(lookupKey(c, hkp2, key3), gc.Equals, http.StatusOK)
+}
+
+func (s *S) TestConvergenceGenerated(c *gc.C) {
+	s.startAll(c)
+
+	// Half of the keys are added to each server.
+	g, err := keygen.New(1, &keygen.Spec{UserIDs: 2, SubKeys: 1, Certifications: 3})
+	c.Assert(err, gc.IsNil)
+	keys := g.MustKeys(20)
+	for i := range keys {
+		keytext, err := g.Armored(i)
+		c.Assert(err, gc.IsNil)
+		addKey(c, s.instances[i%2], keytext)
+	}
+	for i, key := range keys {
+		waitForKey(c, s.instances[1-i%2], key)
+	}
+}
+
+func (s *S) TestDumpLoad(c *gc.C) {
+	hkp1, hkp2 := s.instances[0], s.instances[1]
+	s.start(c, hkp1)
+
+	keytext1, key1 := readKey(c, "alice_signed.asc")
+	keytext2, key2 := readKey(c, "e68e311d.asc")
+	addKey(c, hkp1, keytext1)
+	addKey(c, hkp1, keytext2)
+
+	dumpDir := c.MkDir()
+	s.run(c, "hockeypuck-dump", "-config", hkp1.configFile, "-path", dumpDir)
+	dumps, err := filepath.Glob(filepath.Join(dumpDir, "*.pgp"))
+	c.Assert(err, gc.IsNil)
+	c.Assert(dumps, gc.Not(gc.HasLen), 0)
+
+	s.run(c, "hockeypuck-load", "-config", hkp2.configFile, filepath.Join(dumpDir, "*.pgp"))
+	s.start(c, hkp2)
+	c.Assert(lookupKey(c, hkp2, key1), gc.Equals, http.StatusOK)
+	c.Assert(lookupKey(c, hkp2, key2), gc.Equals, http.StatusOK)
+}
+
+// run builds and runs one of the Hockeypuck commands.
+func (s *S) run(c *gc.C, command string, args ...string) {
+	bin := filepath.Join(s.dir, command)
+	if _, err := os.Stat(bin); os.IsNotExist(err) {
+		out, err := exec.Command("go", "build", "-o", bin, "hockeypuck/server/cmd/"+command).CombinedOutput()
+		c.Assert(err, gc.IsNil, gc.Commentf("building %s: %s", command, out))
+	}
+	out, err := exec.Command(bin, args...).CombinedOutput()
+	c.Assert(err, gc.IsNil, gc.Commentf("%s: %s", command, out))
+}
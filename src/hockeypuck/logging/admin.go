@@ -0,0 +1,67 @@
+package logging
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// Register adds the admin API for adjusting log levels at runtime:
+//
+//	GET    /log/levels          lists the level of each module
+//	PUT    /log/levels/:module  sets a module's level, as {"level": "debug"}
+//	DELETE /log/levels/:module  returns a module to the default level
+//
+// The module named "default" sets the default level. Levels set here last
+// until the settings are next loaded.
+func Register(r *httprouter.Router) {
+	r.GET("/log/levels", getLevels)
+	r.PUT("/log/levels/:module", putLevel)
+	r.DELETE("/log/levels/:module", deleteLevel)
+}
+
+func writeLevels(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(Levels())
+}
+
+func getLevels(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	writeLevels(w)
+}
+
+func putLevel(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	var req struct {
+		Level string `json:"level"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		http.Error(w, "invalid request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	level, err := ParseLevel(req.Level)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	err = SetLevel(ps.ByName("module"), level)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	writeLevels(w)
+}
+
+func deleteLevel(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	name := ps.ByName("module")
+	if name == DefaultModule {
+		http.Error(w, "the default level cannot be reset", http.StatusBadRequest)
+		return
+	}
+	err := ResetLevel(name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	writeLevels(w)
+}
@@ -0,0 +1,231 @@
+// Package logging gives each subsystem of the server a logger of its own, so
+// that its level may be set apart from the others, such as to debug recon
+// without the noise of every lookup.
+//
+// Module loggers share the output and formatter of the standard logger, and
+// add a "module" field to every entry. A hook set with SetHook, such as a log
+// sink, is passed the entries of every logger. Modules without a level
+// of their own follow the default level, which is also that of the standard
+// logger.
+package logging
+
+import (
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+
+	log "hockeypuck/logrus"
+)
+
+// DefaultModule names the default level in level settings.
+const DefaultModule = "default"
+
+type module struct {
+	logger *log.Logger
+	level  log.Level
+	set    bool
+}
+
+var (
+	mu           sync.RWMutex
+	modules                = map[string]*module{}
+	defaultLevel           = log.InfoLevel
+	out          io.Writer = os.Stderr
+	hook         log.Hook
+)
+
+func init() {
+	// Hooks are added once, before any entry is logged, as logrus does not
+	// guard them against concurrent use. Others are set with SetHook.
+	log.AddHook(forward{})
+}
+
+var allLevels = []log.Level{
+	log.PanicLevel,
+	log.FatalLevel,
+	log.ErrorLevel,
+	log.WarnLevel,
+	log.InfoLevel,
+	log.DebugLevel,
+}
+
+// forward passes entries to the hook set with SetHook.
+type forward struct{}
+
+func (forward) Levels() []log.Level { return allLevels }
+
+func (forward) Fire(entry *log.Entry) error {
+	mu.RLock()
+	h := hook
+	mu.RUnlock()
+	if h == nil {
+		return nil
+	}
+	for _, level := range h.Levels() {
+		if level == entry.Level {
+			return h.Fire(entry)
+		}
+	}
+	return nil
+}
+
+// SetHook sets the hook passed the entries of every logger, replacing any
+// set before. A nil hook removes it.
+func SetHook(h log.Hook) {
+	mu.Lock()
+	hook = h
+	mu.Unlock()
+}
+
+// output passes entries written by module loggers to the current output.
+type output struct{}
+
+func (output) Write(p []byte) (int, error) {
+	mu.RLock()
+	w := out
+	mu.RUnlock()
+	return w.Write(p)
+}
+
+// Module returns the logger for the named subsystem. It is meant to be
+// called once for each, when the package is initialized.
+func Module(name string) *log.Entry {
+	mu.Lock()
+	defer mu.Unlock()
+	m, ok := modules[name]
+	if !ok {
+		std := log.StandardLogger()
+		m = &module{
+			logger: &log.Logger{
+				Out:       output{},
+				Formatter: std.Formatter,
+				Hooks:     map[log.Level][]log.Hook{},
+				Level:     defaultLevel,
+			},
+			level: defaultLevel,
+		}
+		// The logger has hooks of its own, so that hooks added to the
+		// standard logger do not race with it firing them.
+		m.logger.Hooks.Add(forward{})
+		modules[name] = m
+	}
+	return log.NewEntry(m.logger).WithField("module", name)
+}
+
+// SetOutput sets the output of the standard logger and every module logger.
+func SetOutput(w io.Writer) {
+	mu.Lock()
+	out = w
+	mu.Unlock()
+	log.SetOutput(w)
+}
+
+// ParseLevel parses a level name, in any case.
+func ParseLevel(name string) (log.Level, error) {
+	level, err := log.ParseLevel(strings.ToLower(name))
+	return level, errors.WithStack(err)
+}
+
+// SetDefaultLevel sets the level of the standard logger, and of the modules
+// without a level of their own.
+func SetDefaultLevel(level log.Level) {
+	mu.Lock()
+	defer mu.Unlock()
+	defaultLevel = level
+	log.SetLevel(level)
+	for _, m := range modules {
+		if !m.set {
+			m.level = level
+			m.logger.Level = level
+		}
+	}
+}
+
+// SetLevel sets the level of the named module. DefaultModule sets the
+// default level.
+func SetLevel(name string, level log.Level) error {
+	if name == DefaultModule {
+		SetDefaultLevel(level)
+		return nil
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	m, ok := modules[name]
+	if !ok {
+		return errors.Errorf("unknown log module %q", name)
+	}
+	m.level, m.set = level, true
+	m.logger.Level = level
+	return nil
+}
+
+// ResetLevel returns the named module to the default level.
+func ResetLevel(name string) error {
+	mu.Lock()
+	defer mu.Unlock()
+	m, ok := modules[name]
+	if !ok {
+		return errors.Errorf("unknown log module %q", name)
+	}
+	m.level, m.set = defaultLevel, false
+	m.logger.Level = defaultLevel
+	return nil
+}
+
+// Configure sets the default level, and the levels of the modules named in
+// levels, returning the others to the default. Levels are given by name;
+// nothing is changed if any is invalid.
+func Configure(defaultName string, levels map[string]string) error {
+	def, err := ParseLevel(defaultName)
+	if err != nil {
+		return errors.Wrapf(err, "invalid default log level %q", defaultName)
+	}
+	parsed := map[string]log.Level{}
+	for name, levelName := range levels {
+		level, err := ParseLevel(levelName)
+		if err != nil {
+			return errors.Wrapf(err, "invalid log level %q for %q", levelName, name)
+		}
+		parsed[name] = level
+	}
+
+	mu.RLock()
+	var names []string
+	for name := range modules {
+		names = append(names, name)
+	}
+	mu.RUnlock()
+
+	SetDefaultLevel(def)
+	for _, name := range names {
+		if _, ok := parsed[name]; !ok {
+			ResetLevel(name)
+		}
+	}
+	var unknown []string
+	for name, level := range parsed {
+		if SetLevel(name, level) != nil {
+			unknown = append(unknown, name)
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		log.WithField("modules", unknown).Warning("log levels set for unknown modules")
+	}
+	return nil
+}
+
+// Levels returns the level of each module, and the default level, by name.
+func Levels() map[string]string {
+	mu.RLock()
+	defer mu.RUnlock()
+	result := map[string]string{DefaultModule: defaultLevel.String()}
+	for name, m := range modules {
+		result[name] = m.level.String()
+	}
+	return result
+}
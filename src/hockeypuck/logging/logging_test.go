@@ -0,0 +1,191 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	stdtesting "testing"
+
+	"github.com/julienschmidt/httprouter"
+	gc "gopkg.in/check.v1"
+
+	log "hockeypuck/logrus"
+)
+
+func Test(t *stdtesting.T) { gc.TestingT(t) }
+
+type LoggingSuite struct {
+	buf bytes.Buffer
+}
+
+var _ = gc.Suite(&LoggingSuite{})
+
+var (
+	moduleA = Module("test-a")
+	moduleB = Module("test-b")
+)
+
+func (s *LoggingSuite) SetUpTest(c *gc.C) {
+	s.buf.Reset()
+	SetOutput(&s.buf)
+	c.Assert(Configure("info", nil), gc.IsNil)
+}
+
+func (s *LoggingSuite) TearDownTest(c *gc.C) {
+	SetOutput(os.Stderr)
+	c.Assert(Configure("info", nil), gc.IsNil)
+}
+
+func (s *LoggingSuite) TestModuleLevels(c *gc.C) {
+	c.Assert(SetLevel("test-a", log.DebugLevel), gc.IsNil)
+	moduleA.Debug("debugging a")
+	moduleB.Debug("debugging b")
+	c.Assert(s.buf.String(), gc.Matches, `(?s).*debugging a.*`)
+	c.Assert(s.buf.String(), gc.Matches, `(?s).*module=test-a.*`)
+	c.Assert(strings.Contains(s.buf.String(), "debugging b"), gc.Equals, false)
+
+	s.buf.Reset()
+	c.Assert(ResetLevel("test-a"), gc.IsNil)
+	moduleA.Debug("debugging a")
+	c.Assert(s.buf.String(), gc.Equals, "")
+
+	// Modules without a level follow the default.
+	SetDefaultLevel(log.DebugLevel)
+	moduleB.Debug("debugging b")
+	c.Assert(s.buf.String(), gc.Matches, `(?s).*debugging b.*`)
+
+	c.Assert(SetLevel("no-such-module", log.DebugLevel), gc.ErrorMatches, `unknown log module "no-such-module"`)
+	c.Assert(ResetLevel("no-such-module"), gc.NotNil)
+}
+
+func (s *LoggingSuite) TestConfigure(c *gc.C) {
+	err := Configure("warning", map[string]string{"test-a": "DEBUG"})
+	c.Assert(err, gc.IsNil)
+	levels := Levels()
+	c.Assert(levels[DefaultModule], gc.Equals, "warning")
+	c.Assert(levels["test-a"], gc.Equals, "debug")
+	c.Assert(levels["test-b"], gc.Equals, "warning")
+	c.Assert(log.GetLevel(), gc.Equals, log.WarnLevel)
+
+	// Modules not named return to the default.
+	err = Configure("info", map[string]string{"test-b": "error"})
+	c.Assert(err, gc.IsNil)
+	levels = Levels()
+	c.Assert(levels["test-a"], gc.Equals, "info")
+	c.Assert(levels["test-b"], gc.Equals, "error")
+
+	// Nothing is changed if a level is invalid.
+	err = Configure("debug", map[string]string{"test-a": "loud"})
+	c.Assert(err, gc.ErrorMatches, `invalid log level "loud" for "test-a".*`)
+	c.Assert(Levels()[DefaultModule], gc.Equals, "info")
+	c.Assert(Levels()["test-b"], gc.Equals, "error")
+	c.Assert(Configure("loud", nil), gc.NotNil)
+
+	// Unknown modules are warned about, but not an error.
+	err = Configure("info", map[string]string{"no-such-module": "debug"})
+	c.Assert(err, gc.IsNil)
+	_, ok := Levels()["no-such-module"]
+	c.Assert(ok, gc.Equals, false)
+}
+
+type recordHook struct {
+	messages []string
+}
+
+func (h *recordHook) Levels() []log.Level { return []log.Level{log.InfoLevel} }
+
+func (h *recordHook) Fire(entry *log.Entry) error {
+	h.messages = append(h.messages, entry.Message)
+	return nil
+}
+
+func (s *LoggingSuite) TestSetHook(c *gc.C) {
+	h := &recordHook{}
+	SetHook(h)
+	moduleA.Info("from a")
+	log.Info("from std")
+	moduleA.Warning("not hooked")
+	SetHook(nil)
+	moduleA.Info("after removal")
+	c.Assert(h.messages, gc.DeepEquals, []string{"from a", "from std"})
+}
+
+func (s *LoggingSuite) TestRequestID(c *gc.C) {
+	var fields log.Fields
+	h := RequestID(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fields = RequestFields(r)
+	}))
+
+	req := httptest.NewRequest("GET", "/pks/lookup", nil)
+	req.RemoteAddr = "192.0.2.1:12345"
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	id := w.Header().Get(RequestIDHeader)
+	c.Assert(id, gc.Matches, `[0-9a-f]{16}`)
+	c.Assert(fields["request-id"], gc.Equals, id)
+	c.Assert(fields["client"], gc.Equals, "192.0.2.1")
+
+	// IDs chosen by a proxy are kept.
+	req = httptest.NewRequest("GET", "/pks/lookup", nil)
+	req.Header.Set(RequestIDHeader, "proxy-chosen-id")
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	c.Assert(w.Header().Get(RequestIDHeader), gc.Equals, "proxy-chosen-id")
+	c.Assert(fields["request-id"], gc.Equals, "proxy-chosen-id")
+
+	// Unless they are unfit for logs.
+	for _, bad := range []string{"with space", "line\nbreak", strings.Repeat("x", 65)} {
+		req = httptest.NewRequest("GET", "/pks/lookup", nil)
+		req.Header.Set(RequestIDHeader, bad)
+		w = httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		c.Assert(w.Header().Get(RequestIDHeader), gc.Matches, `[0-9a-f]{16}`)
+	}
+}
+
+func (s *LoggingSuite) TestAdmin(c *gc.C) {
+	r := httprouter.New()
+	Register(r)
+
+	do := func(method, path, body string) (int, map[string]string) {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		var levels map[string]string
+		if w.Code == http.StatusOK {
+			c.Assert(json.NewDecoder(w.Body).Decode(&levels), gc.IsNil)
+		}
+		return w.Code, levels
+	}
+
+	code, levels := do("GET", "/log/levels", "")
+	c.Assert(code, gc.Equals, http.StatusOK)
+	c.Assert(levels["test-a"], gc.Equals, "info")
+
+	code, levels = do("PUT", "/log/levels/test-a", `{"level":"debug"}`)
+	c.Assert(code, gc.Equals, http.StatusOK)
+	c.Assert(levels["test-a"], gc.Equals, "debug")
+	c.Assert(levels["test-b"], gc.Equals, "info")
+
+	code, levels = do("PUT", "/log/levels/default", `{"level":"warning"}`)
+	c.Assert(code, gc.Equals, http.StatusOK)
+	c.Assert(levels[DefaultModule], gc.Equals, "warning")
+	c.Assert(levels["test-a"], gc.Equals, "debug")
+	c.Assert(levels["test-b"], gc.Equals, "warning")
+
+	code, levels = do("DELETE", "/log/levels/test-a", "")
+	c.Assert(code, gc.Equals, http.StatusOK)
+	c.Assert(levels["test-a"], gc.Equals, "warning")
+
+	code, _ = do("PUT", "/log/levels/test-a", `{"level":"loud"}`)
+	c.Assert(code, gc.Equals, http.StatusBadRequest)
+	code, _ = do("PUT", "/log/levels/no-such-module", `{"level":"debug"}`)
+	c.Assert(code, gc.Equals, http.StatusNotFound)
+	code, _ = do("DELETE", "/log/levels/no-such-module", "")
+	c.Assert(code, gc.Equals, http.StatusNotFound)
+	code, _ = do("DELETE", "/log/levels/default", "")
+	c.Assert(code, gc.Equals, http.StatusBadRequest)
+}
@@ -0,0 +1,75 @@
+package logging
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net"
+	"net/http"
+
+	log "hockeypuck/logrus"
+	"hockeypuck/tracing"
+)
+
+// RequestIDHeader carries the ID of a request, which a proxy in front of the
+// server may have chosen already.
+const RequestIDHeader = "X-Request-Id"
+
+// maxRequestIDLength is the longest request ID accepted from a client.
+const maxRequestIDLength = 64
+
+type requestIDKey struct{}
+
+// RequestID is middleware which gives each request an ID, echoed in the
+// response, by which its log entries may be found. An ID given by the
+// client is kept if it is short and printable.
+func RequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(RequestIDHeader)
+		if !validRequestID(id) {
+			var b [8]byte
+			rand.Read(b[:])
+			id = hex.EncodeToString(b[:])
+		}
+		w.Header().Set(RequestIDHeader, id)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id)))
+	})
+}
+
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] < 0x21 || id[i] > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+// RequestIDFromContext returns the ID of the request whose context ctx is.
+func RequestIDFromContext(ctx context.Context) (string, bool) {
+	id, ok := ctx.Value(requestIDKey{}).(string)
+	return id, ok
+}
+
+// RequestFields returns the fields which identify a request in log entries:
+// its ID, the client address, and its trace.
+func RequestFields(r *http.Request) log.Fields {
+	fields := log.Fields{}
+	if id, ok := RequestIDFromContext(r.Context()); ok {
+		fields["request-id"] = id
+	}
+	client := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(client); err == nil {
+		client = host
+	}
+	if client != "" {
+		fields["client"] = client
+	}
+	for k, v := range tracing.Fields(r.Context()) {
+		fields[k] = v
+	}
+	return fields
+}
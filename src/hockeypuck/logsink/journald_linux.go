@@ -0,0 +1,166 @@
+package logsink
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/pkg/errors"
+
+	log "hockeypuck/logrus"
+)
+
+// journalSocket is where journald receives entries over its native
+// protocol.
+var journalSocket = "/run/systemd/journal/socket"
+
+type journaldSink struct {
+	tag string
+
+	mu     sync.Mutex
+	conn   *net.UnixConn
+	addr   *net.UnixAddr
+	closed bool
+}
+
+func dialJournald(tag string) (*journaldSink, error) {
+	// Check that journald is running, so that a misconfigured sink fails at
+	// startup rather than losing every entry.
+	fi, err := os.Stat(journalSocket)
+	if err != nil {
+		return nil, errors.Wrap(err, "journald is not running")
+	}
+	if fi.Mode()&os.ModeSocket == 0 {
+		return nil, errors.Errorf("%q is not a socket", journalSocket)
+	}
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Net: "unixgram"})
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return &journaldSink{
+		tag:  tag,
+		conn: conn,
+		addr: &net.UnixAddr{Name: journalSocket, Net: "unixgram"},
+	}, nil
+}
+
+func (s *journaldSink) Levels() []log.Level {
+	return allLevels
+}
+
+func (s *journaldSink) Fire(entry *log.Entry) error {
+	msg := s.format(entry)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil
+	}
+	_, err := s.conn.WriteToUnix(msg, s.addr)
+	if err == nil {
+		return nil
+	}
+	if opErr, ok := err.(*net.OpError); !ok || !isMsgSize(opErr.Err) {
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(s.sendFile(msg))
+}
+
+func isMsgSize(err error) bool {
+	if se, ok := err.(*os.SyscallError); ok {
+		err = se.Err
+	}
+	return err == syscall.EMSGSIZE || err == syscall.ENOBUFS
+}
+
+// sendFile sends an entry too large for a datagram as the contents of an
+// unlinked temporary file, passing its descriptor as journald expects.
+func (s *journaldSink) sendFile(msg []byte) error {
+	f, err := ioutil.TempFile("/dev/shm", "hockeypuck-journal-")
+	if err != nil {
+		f, err = ioutil.TempFile("", "hockeypuck-journal-")
+		if err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	defer f.Close()
+	err = os.Remove(f.Name())
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	_, err = f.Write(msg)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	_, _, err = s.conn.WriteMsgUnix(nil, syscall.UnixRights(int(f.Fd())), s.addr)
+	return errors.WithStack(err)
+}
+
+// format returns an entry in journald's native protocol. The message is
+// followed by the fields of the entry in text, which is all journalctl shows
+// by default, and each field is also a journal field of its own.
+func (s *journaldSink) format(entry *log.Entry) []byte {
+	var b bytes.Buffer
+	appendJournalField(&b, "MESSAGE", textMessage(entry))
+	appendJournalField(&b, "PRIORITY", strconv.Itoa(severity(entry.Level)))
+	appendJournalField(&b, "SYSLOG_IDENTIFIER", s.tag)
+	for _, name := range sortedFields(entry.Data) {
+		appendJournalField(&b, journalFieldName(name), fieldValue(entry.Data[name]))
+	}
+	return b.Bytes()
+}
+
+// appendJournalField appends a field as NAME=value, or in the binary form
+// if the value spans lines.
+func appendJournalField(b *bytes.Buffer, name, value string) {
+	b.WriteString(name)
+	if !strings.Contains(value, "\n") {
+		b.WriteByte('=')
+		b.WriteString(value)
+		b.WriteByte('\n')
+		return
+	}
+	b.WriteByte('\n')
+	binary.Write(b, binary.LittleEndian, uint64(len(value)))
+	b.WriteString(value)
+	b.WriteByte('\n')
+}
+
+// journalFieldName returns a field name as a journal field name, which has
+// only uppercase letters, digits and underscores, and does not start with an
+// underscore or digit. Fields which would name a journal field set by
+// hockeypuck are prefixed to keep them apart.
+func journalFieldName(name string) string {
+	b := []byte(strings.ToUpper(name))
+	for i, c := range b {
+		if !(c >= 'A' && c <= 'Z' || c >= '0' && c <= '9') {
+			b[i] = '_'
+		}
+	}
+	result := strings.TrimLeft(string(b), "_")
+	switch {
+	case result == "" || result[0] >= '0' && result[0] <= '9',
+		result == "MESSAGE" || result == "PRIORITY" || result == "SYSLOG_IDENTIFIER":
+		result = "FIELD_" + result
+	}
+	if len(result) > 64 {
+		result = result[:64]
+	}
+	return result
+}
+
+func (s *journaldSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	return errors.WithStack(s.conn.Close())
+}
@@ -0,0 +1,128 @@
+package logsink
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	gc "gopkg.in/check.v1"
+
+	log "hockeypuck/logrus"
+)
+
+type JournaldSuite struct {
+	conn          *net.UnixConn
+	journalSocket string
+}
+
+var _ = gc.Suite(&JournaldSuite{})
+
+func (s *JournaldSuite) SetUpTest(c *gc.C) {
+	path := filepath.Join(c.MkDir(), "socket")
+	s.journalSocket = journalSocket
+	var err error
+	s.conn, err = net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	c.Assert(err, gc.IsNil)
+	journalSocket = path
+}
+
+func (s *JournaldSuite) TearDownTest(c *gc.C) {
+	s.conn.Close()
+	journalSocket = s.journalSocket
+}
+
+// read returns the fields of an entry received by the fake journald.
+func (s *JournaldSuite) read(c *gc.C) map[string]string {
+	buf := make([]byte, 1<<20)
+	oob := make([]byte, 1024)
+	n, oobn, _, _, err := s.conn.ReadMsgUnix(buf, oob)
+	c.Assert(err, gc.IsNil)
+	data := buf[:n]
+	if oobn > 0 {
+		msgs, err := syscall.ParseSocketControlMessage(oob[:oobn])
+		c.Assert(err, gc.IsNil)
+		c.Assert(msgs, gc.HasLen, 1)
+		fds, err := syscall.ParseUnixRights(&msgs[0])
+		c.Assert(err, gc.IsNil)
+		c.Assert(fds, gc.HasLen, 1)
+		f := os.NewFile(uintptr(fds[0]), "memfd")
+		defer f.Close()
+		_, err = f.Seek(0, 0)
+		c.Assert(err, gc.IsNil)
+		data, err = ioutil.ReadAll(f)
+		c.Assert(err, gc.IsNil)
+	}
+
+	fields := map[string]string{}
+	for len(data) > 0 {
+		i := bytes.IndexAny(data, "=\n")
+		c.Assert(i > 0, gc.Equals, true)
+		name := string(data[:i])
+		if data[i] == '=' {
+			end := bytes.IndexByte(data, '\n')
+			fields[name] = string(data[i+1 : end])
+			data = data[end+1:]
+			continue
+		}
+		length := binary.LittleEndian.Uint64(data[i+1 : i+9])
+		fields[name] = string(data[i+9 : i+9+int(length)])
+		c.Assert(data[i+9+int(length)], gc.Equals, byte('\n'))
+		data = data[i+10+int(length):]
+	}
+	return fields
+}
+
+func (s *JournaldSuite) TestFire(c *gc.C) {
+	sink, err := Open(&Settings{Sink: SinkJournald})
+	c.Assert(err, gc.IsNil)
+	defer sink.Close()
+
+	c.Assert(sink.Fire(testEntry), gc.IsNil)
+	c.Assert(s.read(c), gc.DeepEquals, map[string]string{
+		"MESSAGE":           textMessage(testEntry),
+		"PRIORITY":          "4",
+		"SYSLOG_IDENTIFIER": "hockeypuck",
+		"FP":                "10fe8cf1b483f7525039aa2a361bc1f023e0dcca",
+		"LENGTH":            "2048",
+		"SEARCH":            `"quoted]"`,
+	})
+
+	c.Assert(sink.Fire(&log.Entry{Level: log.ErrorLevel, Message: "line one\nline two"}), gc.IsNil)
+	fields := s.read(c)
+	c.Assert(fields["MESSAGE"], gc.Equals, "line one\nline two")
+	c.Assert(fields["PRIORITY"], gc.Equals, "3")
+}
+
+func (s *JournaldSuite) TestFireLarge(c *gc.C) {
+	sink, err := Open(&Settings{Sink: SinkJournald})
+	c.Assert(err, gc.IsNil)
+	defer sink.Close()
+
+	message := strings.Repeat("x", 512*1024)
+	c.Assert(sink.Fire(&log.Entry{Level: log.InfoLevel, Message: message}), gc.IsNil)
+	c.Assert(s.read(c)["MESSAGE"], gc.Equals, message)
+}
+
+func (s *JournaldSuite) TestNotRunning(c *gc.C) {
+	journalSocket = filepath.Join(c.MkDir(), "missing")
+	_, err := Open(&Settings{Sink: SinkJournald})
+	c.Assert(err, gc.ErrorMatches, "journald is not running: .*")
+}
+
+func (s *JournaldSuite) TestFieldNames(c *gc.C) {
+	for name, expect := range map[string]string{
+		"fp":          "FP",
+		"status-code": "STATUS_CODE",
+		"_pid":        "PID",
+		"2fa":         "FIELD_2FA",
+		"message":     "FIELD_MESSAGE",
+		"GET":         "GET",
+	} {
+		c.Check(journalFieldName(name), gc.Equals, expect)
+	}
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+// +build !linux
+
+package logsink
+
+import (
+	"github.com/pkg/errors"
+)
+
+func dialJournald(tag string) (Sink, error) {
+	return nil, errors.New("journald is only available on Linux")
+}
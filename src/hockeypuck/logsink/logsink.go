@@ -0,0 +1,168 @@
+// Package logsink sends the server's logs to syslog or journald, rather than
+// to a log file, keeping the level and fields of each entry.
+//
+// Syslog messages are formatted as in RFC 5424, with the fields of an entry
+// as structured data, and sent to the local syslog socket or to a remote
+// server over UDP or TCP. Journald entries are sent over its native
+// protocol, with each field as a journal field.
+package logsink
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	log "hockeypuck/logrus"
+)
+
+// Sinks.
+const (
+	SinkFile     = "file"
+	SinkSyslog   = "syslog"
+	SinkJournald = "journald"
+)
+
+const DefaultTag = "hockeypuck"
+
+type Settings struct {
+	// Sink is where logs are written: "file" for the log file or standard
+	// error, "syslog" or "journald".
+	Sink string `toml:"sink"`
+
+	// Tag identifies the server's logs, as the syslog APP-NAME or the
+	// journal SYSLOG_IDENTIFIER.
+	Tag string `toml:"tag"`
+
+	Syslog SyslogSettings `toml:"syslog"`
+}
+
+type SyslogSettings struct {
+	// Network is "udp" or "tcp" to send logs to a remote server, or empty
+	// to send them to the local syslog socket.
+	Network string `toml:"network"`
+
+	// Addr is the host:port of the remote server.
+	Addr string `toml:"addr"`
+
+	// Facility is the syslog facility, such as "daemon" or "local0".
+	Facility string `toml:"facility"`
+}
+
+func DefaultSettings() *Settings {
+	return &Settings{
+		Sink: SinkFile,
+		Tag:  DefaultTag,
+		Syslog: SyslogSettings{
+			Facility: "daemon",
+		},
+	}
+}
+
+// Enabled returns whether logs are sent to a sink other than the log file.
+func (s *Settings) Enabled() bool {
+	return s != nil && s.Sink != "" && s.Sink != SinkFile
+}
+
+// Sink is a log hook which sends every entry to syslog or journald. Entries
+// fired after it is closed are dropped.
+type Sink interface {
+	log.Hook
+	io.Closer
+}
+
+// Open connects to the sink described by settings.
+func Open(settings *Settings) (Sink, error) {
+	tag := settings.Tag
+	if tag == "" {
+		tag = DefaultTag
+	}
+	switch settings.Sink {
+	case SinkSyslog:
+		s, err := dialSyslog(&settings.Syslog, tag)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		return s, nil
+	case SinkJournald:
+		s, err := dialJournald(tag)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		return s, nil
+	}
+	return nil, errors.Errorf("invalid log sink %q, expected %q, %q or %q",
+		settings.Sink, SinkFile, SinkSyslog, SinkJournald)
+}
+
+// allLevels are the levels sent to a sink. The logger's level decides which
+// of them are logged.
+var allLevels = []log.Level{
+	log.PanicLevel,
+	log.FatalLevel,
+	log.ErrorLevel,
+	log.WarnLevel,
+	log.InfoLevel,
+	log.DebugLevel,
+}
+
+// Syslog severities, which journald also uses as priorities.
+const (
+	sevCrit    = 2
+	sevErr     = 3
+	sevWarning = 4
+	sevInfo    = 6
+	sevDebug   = 7
+)
+
+func severity(level log.Level) int {
+	switch level {
+	case log.PanicLevel, log.FatalLevel:
+		return sevCrit
+	case log.ErrorLevel:
+		return sevErr
+	case log.WarnLevel:
+		return sevWarning
+	case log.InfoLevel:
+		return sevInfo
+	}
+	return sevDebug
+}
+
+// sortedFields returns the names of the fields of an entry in order.
+func sortedFields(fields log.Fields) []string {
+	var names []string
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// fieldValue formats the value of a field as the text formatter does.
+func fieldValue(v interface{}) string {
+	if err, ok := v.(error); ok {
+		return err.Error()
+	}
+	return fmt.Sprint(v)
+}
+
+// textMessage returns the message of an entry followed by its fields, for
+// readers which only show the message.
+func textMessage(entry *log.Entry) string {
+	var b strings.Builder
+	b.WriteString(entry.Message)
+	for _, name := range sortedFields(entry.Data) {
+		if b.Len() > 0 {
+			b.WriteByte(' ')
+		}
+		value := fieldValue(entry.Data[name])
+		if strings.ContainsAny(value, " \"=\n") || value == "" {
+			value = fmt.Sprintf("%q", value)
+		}
+		fmt.Fprintf(&b, "%s=%s", name, value)
+	}
+	return b.String()
+}
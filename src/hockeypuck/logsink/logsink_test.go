@@ -0,0 +1,141 @@
+package logsink
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"path/filepath"
+	"strconv"
+	"strings"
+	stdtesting "testing"
+	"time"
+
+	gc "gopkg.in/check.v1"
+
+	log "hockeypuck/logrus"
+)
+
+func Test(t *stdtesting.T) { gc.TestingT(t) }
+
+type LogSinkSuite struct{}
+
+var _ = gc.Suite(&LogSinkSuite{})
+
+var testEntry = &log.Entry{
+	Time:    time.Date(2003, 10, 11, 22, 14, 15, 3000000, time.UTC),
+	Level:   log.WarnLevel,
+	Message: "key exceeds the response limit",
+	Data: log.Fields{
+		"fp":     "10fe8cf1b483f7525039aa2a361bc1f023e0dcca",
+		"length": 2048,
+		"search": `"quoted]"`,
+	},
+}
+
+func (s *LogSinkSuite) TestOpenInvalid(c *gc.C) {
+	for _, t := range []struct {
+		settings Settings
+		err      string
+	}{
+		{Settings{Sink: "eventlog"}, `invalid log sink "eventlog", expected "file", "syslog" or "journald"`},
+		{Settings{Sink: SinkSyslog, Syslog: SyslogSettings{Facility: "local9"}}, `unknown syslog facility "local9"`},
+		{Settings{Sink: SinkSyslog, Syslog: SyslogSettings{Network: "udp"}}, `syslog address required for network "udp"`},
+		{Settings{Sink: SinkSyslog, Syslog: SyslogSettings{Network: "tls", Addr: "localhost:6514"}},
+			`invalid syslog network "tls", .*`},
+	} {
+		_, err := Open(&t.settings)
+		c.Check(err, gc.ErrorMatches, t.err)
+	}
+	c.Assert(DefaultSettings().Enabled(), gc.Equals, false)
+}
+
+func (s *LogSinkSuite) TestSyslogFormat(c *gc.C) {
+	sink := &syslogSink{facility: facilities["daemon"], tag: "hockeypuck", hostname: "keys.example.com", pid: 1234}
+	c.Assert(string(sink.format(testEntry)), gc.Equals,
+		`<28>1 2003-10-11T22:14:15.003000Z keys.example.com hockeypuck 1234 - `+
+			`[fields@32473 fp="10fe8cf1b483f7525039aa2a361bc1f023e0dcca" length="2048" search="\"quoted\]\""] `+
+			`key exceeds the response limit`)
+
+	sink.facility = facilities["local0"]
+	c.Assert(string(sink.format(&log.Entry{Time: testEntry.Time, Level: log.InfoLevel})), gc.Equals,
+		`<134>1 2003-10-11T22:14:15.003000Z keys.example.com hockeypuck 1234 - -`)
+}
+
+func (s *LogSinkSuite) TestSyslogLocal(c *gc.C) {
+	path := filepath.Join(c.MkDir(), "log")
+	l, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	c.Assert(err, gc.IsNil)
+	defer l.Close()
+	defer func(sockets []string) { localSyslogSockets = sockets }(localSyslogSockets)
+	localSyslogSockets = []string{filepath.Join(c.MkDir(), "missing"), path}
+
+	sink, err := Open(&Settings{Sink: SinkSyslog, Tag: "hkp"})
+	c.Assert(err, gc.IsNil)
+	c.Assert(sink.Fire(testEntry), gc.IsNil)
+	buf := make([]byte, 4096)
+	n, err := l.Read(buf)
+	c.Assert(err, gc.IsNil)
+	c.Assert(string(buf[:n]), gc.Matches, `<28>1 2003-10-11T22:14:15.003000Z \S+ hkp \d+ - \[fields@32473 .*\] key exceeds the response limit`)
+
+	c.Assert(sink.Close(), gc.IsNil)
+	c.Assert(sink.Fire(testEntry), gc.IsNil)
+}
+
+func (s *LogSinkSuite) TestSyslogQueueFull(c *gc.C) {
+	// Without a writer, the queue fills and Fire drops entries rather than
+	// waiting.
+	sink := &syslogSink{tag: "hockeypuck", queue: make(chan []byte, 1)}
+	c.Assert(sink.Fire(testEntry), gc.IsNil)
+	c.Assert(sink.Fire(testEntry), gc.IsNil)
+	c.Assert(sink.queue, gc.HasLen, 1)
+	c.Assert(sink.dropped, gc.Equals, 1)
+}
+
+func (s *LogSinkSuite) TestSyslogUDP(c *gc.C) {
+	l, err := net.ListenPacket("udp", "127.0.0.1:0")
+	c.Assert(err, gc.IsNil)
+	defer l.Close()
+
+	sink, err := Open(&Settings{Sink: SinkSyslog, Syslog: SyslogSettings{Network: "udp", Addr: l.LocalAddr().String()}})
+	c.Assert(err, gc.IsNil)
+	defer sink.Close()
+	c.Assert(sink.Fire(testEntry), gc.IsNil)
+	buf := make([]byte, 4096)
+	n, _, err := l.ReadFrom(buf)
+	c.Assert(err, gc.IsNil)
+	c.Assert(string(buf[:n]), gc.Matches, `<28>1 .* hockeypuck .* key exceeds the response limit`)
+}
+
+func (s *LogSinkSuite) TestSyslogTCP(c *gc.C) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, gc.IsNil)
+	defer l.Close()
+
+	sink, err := Open(&Settings{Sink: SinkSyslog, Syslog: SyslogSettings{Network: "tcp", Addr: l.Addr().String()}})
+	c.Assert(err, gc.IsNil)
+	defer sink.Close()
+	conn, err := l.Accept()
+	c.Assert(err, gc.IsNil)
+	defer conn.Close()
+
+	c.Assert(sink.Fire(testEntry), gc.IsNil)
+	c.Assert(sink.Fire(&log.Entry{Time: testEntry.Time, Level: log.ErrorLevel, Message: "second"}), gc.IsNil)
+	r := bufio.NewReader(conn)
+	for _, expect := range []string{"key exceeds the response limit", "second"} {
+		length, err := r.ReadString(' ')
+		c.Assert(err, gc.IsNil)
+		n, err := strconv.Atoi(strings.TrimSpace(length))
+		c.Assert(err, gc.IsNil)
+		msg := make([]byte, n)
+		_, err = io.ReadFull(r, msg)
+		c.Assert(err, gc.IsNil)
+		c.Assert(strings.HasSuffix(string(msg), expect), gc.Equals, true, gc.Commentf("%q", msg))
+	}
+}
+
+func (s *LogSinkSuite) TestTextMessage(c *gc.C) {
+	c.Assert(textMessage(testEntry), gc.Equals,
+		`key exceeds the response limit fp=10fe8cf1b483f7525039aa2a361bc1f023e0dcca length=2048 search="\"quoted]\""`)
+	c.Assert(textMessage(&log.Entry{Data: log.Fields{"GET": "/pks/lookup", "from": ""}}), gc.Equals,
+		`GET=/pks/lookup from=""`)
+}
@@ -0,0 +1,287 @@
+package logsink
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	log "hockeypuck/logrus"
+)
+
+// sdID names the structured data element holding the fields of an entry.
+// 32473 is the private enterprise number reserved for documentation by
+// RFC 5612.
+const sdID = "fields@32473"
+
+// localSyslogSockets are where the local syslog daemon listens.
+var localSyslogSockets = []string{"/dev/log", "/var/run/syslog", "/var/run/log"}
+
+// syslogQueueSize is how many entries may wait to be written before
+// further entries are dropped.
+const syslogQueueSize = 1024
+
+// syslogWriteTimeout bounds each write, so that an unresponsive server
+// cannot hold up closing the sink.
+const syslogWriteTimeout = 5 * time.Second
+
+var facilities = map[string]int{
+	"kern": 0, "user": 1, "mail": 2, "daemon": 3, "auth": 4, "syslog": 5,
+	"lpr": 6, "news": 7, "uucp": 8, "cron": 9, "authpriv": 10, "ftp": 11,
+	"local0": 16, "local1": 17, "local2": 18, "local3": 19,
+	"local4": 20, "local5": 21, "local6": 22, "local7": 23,
+}
+
+type syslogSink struct {
+	network  string
+	addr     string
+	facility int
+	tag      string
+	hostname string
+	pid      int
+
+	// conn is only used by the writer, once the sink is shared.
+	conn net.Conn
+
+	mu      sync.Mutex
+	queue   chan []byte
+	dropped int
+	closed  bool
+	done    chan struct{}
+}
+
+func dialSyslog(settings *SyslogSettings, tag string) (*syslogSink, error) {
+	facility, ok := facilities[strings.ToLower(settings.Facility)]
+	if settings.Facility == "" {
+		facility, ok = facilities["daemon"], true
+	}
+	if !ok {
+		return nil, errors.Errorf("unknown syslog facility %q", settings.Facility)
+	}
+	switch settings.Network {
+	case "":
+	case "udp", "tcp":
+		if settings.Addr == "" {
+			return nil, errors.Errorf("syslog address required for network %q", settings.Network)
+		}
+	default:
+		return nil, errors.Errorf("invalid syslog network %q, expected \"udp\", \"tcp\" or none for the local socket",
+			settings.Network)
+	}
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		hostname = "-"
+	}
+	s := &syslogSink{
+		network:  settings.Network,
+		addr:     settings.Addr,
+		facility: facility,
+		tag:      tag,
+		hostname: hostname,
+		pid:      os.Getpid(),
+	}
+	err = s.connect()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	s.queue = make(chan []byte, syslogQueueSize)
+	s.done = make(chan struct{})
+	go s.run()
+	return s, nil
+}
+
+// connect dials the syslog server.
+func (s *syslogSink) connect() error {
+	if s.network != "" {
+		conn, err := net.Dial(s.network, s.addr)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		s.conn = conn
+		return nil
+	}
+	var err error
+	for _, path := range localSyslogSockets {
+		for _, network := range []string{"unixgram", "unix"} {
+			var conn net.Conn
+			conn, err = net.Dial(network, path)
+			if err == nil {
+				s.conn = conn
+				return nil
+			}
+		}
+	}
+	return errors.Wrap(err, "cannot connect to the local syslog socket")
+}
+
+func (s *syslogSink) Levels() []log.Level {
+	return allLevels
+}
+
+// Fire queues an entry to be written, so that logging does not wait on the
+// syslog server. Entries are dropped while the queue is full.
+func (s *syslogSink) Fire(entry *log.Entry) error {
+	s.enqueue(s.format(entry))
+	return nil
+}
+
+func (s *syslogSink) enqueue(msg []byte) {
+	if s.network == "tcp" {
+		// Octet counting framing, as in RFC 6587.
+		msg = append([]byte(strconv.Itoa(len(msg))+" "), msg...)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return
+	}
+	select {
+	case s.queue <- msg:
+	default:
+		s.dropped++
+	}
+}
+
+// run writes queued entries until the sink is closed.
+func (s *syslogSink) run() {
+	defer close(s.done)
+	for msg := range s.queue {
+		err := s.write(msg)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to write to syslog: %v\n", err)
+		}
+		s.mu.Lock()
+		dropped := s.dropped
+		s.dropped = 0
+		s.mu.Unlock()
+		if dropped > 0 {
+			s.enqueue(s.format(&log.Entry{
+				Time:    time.Now(),
+				Level:   log.WarnLevel,
+				Message: "log entries dropped while syslog was slow",
+				Data:    log.Fields{"dropped": dropped},
+			}))
+		}
+	}
+	if s.conn != nil {
+		s.conn.Close()
+	}
+}
+
+func (s *syslogSink) write(msg []byte) error {
+	if s.conn != nil {
+		s.conn.SetWriteDeadline(time.Now().Add(syslogWriteTimeout))
+		if _, err := s.conn.Write(msg); err == nil {
+			return nil
+		}
+		s.conn.Close()
+		s.conn = nil
+	}
+	// Reconnect once, such as after the syslog daemon restarted.
+	err := s.connect()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	s.conn.SetWriteDeadline(time.Now().Add(syslogWriteTimeout))
+	_, err = s.conn.Write(msg)
+	return errors.WithStack(err)
+}
+
+// format returns an entry as an RFC 5424 message, such as
+//
+//	<30>1 2003-10-11T22:14:15.003000Z host hockeypuck 1234 - [fields@32473 fp="..."] lookup
+func (s *syslogSink) format(entry *log.Entry) []byte {
+	var b []byte
+	b = append(b, '<')
+	b = strconv.AppendInt(b, int64(s.facility*8+severity(entry.Level)), 10)
+	b = append(b, ">1 "...)
+	b = entry.Time.AppendFormat(b, "2006-01-02T15:04:05.000000Z07:00")
+	b = append(b, ' ')
+	b = append(b, headerField(s.hostname, 255)...)
+	b = append(b, ' ')
+	b = append(b, headerField(s.tag, 48)...)
+	b = append(b, ' ')
+	b = strconv.AppendInt(b, int64(s.pid), 10)
+	b = append(b, " - "...)
+	if len(entry.Data) == 0 {
+		b = append(b, '-')
+	} else {
+		b = append(b, '[')
+		b = append(b, sdID...)
+		for _, name := range sortedFields(entry.Data) {
+			b = append(b, ' ')
+			b = append(b, sdName(name)...)
+			b = append(b, "=\""...)
+			b = appendSDValue(b, fieldValue(entry.Data[name]))
+			b = append(b, '"')
+		}
+		b = append(b, ']')
+	}
+	if entry.Message != "" {
+		b = append(b, ' ')
+		b = append(b, entry.Message...)
+	}
+	return b
+}
+
+// headerField returns s as a header field of printable ASCII, of at most
+// max characters.
+func headerField(s string, max int) string {
+	if s == "" {
+		return "-"
+	}
+	b := []byte(s)
+	for i, c := range b {
+		if c <= ' ' || c > '~' {
+			b[i] = '_'
+		}
+	}
+	if len(b) > max {
+		b = b[:max]
+	}
+	return string(b)
+}
+
+// sdName returns a field name as a structured data parameter name, which is
+// printable ASCII other than '=', ' ', ']' and '"', of at most 32
+// characters.
+func sdName(s string) string {
+	b := []byte(headerField(s, 32))
+	for i, c := range b {
+		switch c {
+		case '=', ']', '"':
+			b[i] = '_'
+		}
+	}
+	return string(b)
+}
+
+func appendSDValue(b []byte, s string) []byte {
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '"', '\\', ']':
+			b = append(b, '\\')
+		}
+		b = append(b, s[i])
+	}
+	return b
+}
+
+// Close writes the entries already queued and closes the connection.
+func (s *syslogSink) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	close(s.queue)
+	s.mu.Unlock()
+	<-s.done
+	return nil
+}
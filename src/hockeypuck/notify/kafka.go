@@ -0,0 +1,109 @@
+package notify
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	DefaultKafkaTopic       = "hockeypuck.keys"
+	DefaultKafkaTimeoutSecs = 10
+
+	kafkaContentType = "application/vnd.kafka.json.v2+json"
+)
+
+type KafkaSettings struct {
+	// URL of a Kafka REST proxy, such as http://localhost:8082.
+	URL string `toml:"url"`
+
+	// Topic to which events are produced.
+	Topic string `toml:"topic"`
+
+	// TimeoutSecs limits how long a single delivery may take.
+	TimeoutSecs int `toml:"timeoutSecs"`
+
+	// Changes lists the types of change delivered. The default is all
+	// changes.
+	Changes []string `toml:"changes"`
+}
+
+// Kafka is a sink which produces each event to a Kafka topic through the
+// REST proxy API. Records are keyed by fingerprint, so that all changes to a
+// key land in the same partition and are consumed in order.
+type Kafka struct {
+	url     string
+	client  *http.Client
+	changes changeSet
+}
+
+// NewKafka returns a Kafka sink.
+func NewKafka(settings *KafkaSettings) (*Kafka, error) {
+	u, err := url.Parse(settings.URL)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid Kafka REST proxy URL %q", settings.URL)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, errors.Errorf("invalid Kafka REST proxy URL %q: scheme must be http or https", settings.URL)
+	}
+	topic := settings.Topic
+	if topic == "" {
+		topic = DefaultKafkaTopic
+	}
+	changes, err := newChangeSet(settings.Changes, ChangeAdded, ChangeUpdated, ChangeRemoved)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid Kafka sink %q", settings.URL)
+	}
+	timeout := settings.TimeoutSecs
+	if timeout <= 0 {
+		timeout = DefaultKafkaTimeoutSecs
+	}
+	return &Kafka{
+		url:     strings.TrimRight(settings.URL, "/") + "/topics/" + url.PathEscape(topic),
+		client:  &http.Client{Timeout: time.Duration(timeout) * time.Second},
+		changes: changes,
+	}, nil
+}
+
+func (ks *Kafka) Name() string {
+	return ks.url
+}
+
+func (ks *Kafka) Accepts(ev *Event) bool {
+	return ks.changes.accepts(ev)
+}
+
+type kafkaRecord struct {
+	Key   string `json:"key"`
+	Value *Event `json:"value"`
+}
+
+type kafkaProduceRequest struct {
+	Records []kafkaRecord `json:"records"`
+}
+
+func (ks *Kafka) Send(ev *Event) error {
+	body, err := json.Marshal(&kafkaProduceRequest{
+		Records: []kafkaRecord{{Key: ev.Fingerprint, Value: ev}},
+	})
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	resp, err := ks.client.Post(ks.url, kafkaContentType, bytes.NewReader(body))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return errors.Errorf("Kafka REST proxy %q returned %s", ks.url, resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,37 @@
+package notify
+
+import (
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var notifyMetrics = struct {
+	dropped prometheus.Counter
+	events  *prometheus.CounterVec
+}{
+	dropped: prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: "hockeypuck",
+			Name:      "notify_dropped",
+			Help:      "Key change events dropped because the notification queue was full",
+		},
+	),
+	events: prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "hockeypuck",
+			Name:      "notify_events",
+			Help:      "Key change events delivered to notification sinks since startup",
+		},
+		[]string{"sink", "result"},
+	),
+}
+
+var metricsRegister sync.Once
+
+func registerMetrics() {
+	metricsRegister.Do(func() {
+		prometheus.MustRegister(notifyMetrics.dropped)
+		prometheus.MustRegister(notifyMetrics.events)
+	})
+}
@@ -0,0 +1,214 @@
+package notify
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	DefaultNATSSubject     = "hockeypuck.keys"
+	DefaultNATSTimeoutSecs = 10
+)
+
+type NATSSettings struct {
+	// URL of the NATS server, such as nats://localhost:4222.
+	URL string `toml:"url"`
+
+	// Subject on which events are published.
+	Subject string `toml:"subject"`
+
+	// TimeoutSecs limits how long connecting or publishing may take.
+	TimeoutSecs int `toml:"timeoutSecs"`
+
+	// Changes lists the types of change delivered. The default is all
+	// changes.
+	Changes []string `toml:"changes"`
+}
+
+// NATS is a sink which publishes each event as a JSON message on a NATS
+// subject.
+//
+// Only the core publish protocol is used, so delivery is at most once. The
+// connection is opened on the first event and reopened after any error.
+type NATS struct {
+	addr    string
+	subject string
+	timeout time.Duration
+	changes changeSet
+
+	mu   sync.Mutex
+	conn net.Conn
+	rd   *bufio.Reader
+}
+
+// NewNATS returns a NATS sink.
+func NewNATS(settings *NATSSettings) (*NATS, error) {
+	u, err := url.Parse(settings.URL)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid NATS URL %q", settings.URL)
+	}
+	if u.Scheme != "nats" || u.Host == "" {
+		return nil, errors.Errorf("invalid NATS URL %q: expected nats://host:port", settings.URL)
+	}
+	addr := u.Host
+	if u.Port() == "" {
+		addr = net.JoinHostPort(u.Hostname(), "4222")
+	}
+	subject := settings.Subject
+	if subject == "" {
+		subject = DefaultNATSSubject
+	}
+	if strings.ContainsAny(subject, " \t\r\n") {
+		return nil, errors.Errorf("invalid NATS subject %q", subject)
+	}
+	changes, err := newChangeSet(settings.Changes, ChangeAdded, ChangeUpdated, ChangeRemoved)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid NATS sink %q", settings.URL)
+	}
+	timeout := settings.TimeoutSecs
+	if timeout <= 0 {
+		timeout = DefaultNATSTimeoutSecs
+	}
+	return &NATS{
+		addr:    addr,
+		subject: subject,
+		timeout: time.Duration(timeout) * time.Second,
+		changes: changes,
+	}, nil
+}
+
+func (ns *NATS) Name() string {
+	return "nats://" + ns.addr + "/" + ns.subject
+}
+
+func (ns *NATS) Accepts(ev *Event) bool {
+	return ns.changes.accepts(ev)
+}
+
+func (ns *NATS) Send(ev *Event) error {
+	body, err := json.Marshal(ev)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+	if ns.conn == nil {
+		err = ns.connect()
+		if err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	err = ns.publish(body)
+	if err != nil {
+		ns.close()
+		return errors.WithStack(err)
+	}
+	return nil
+}
+
+// Close closes the connection to the server, if open.
+func (ns *NATS) Close() {
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+	ns.close()
+}
+
+// connect opens a connection and completes the protocol handshake. The
+// caller must hold ns.mu.
+func (ns *NATS) connect() error {
+	conn, err := net.DialTimeout("tcp", ns.addr, ns.timeout)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	ns.conn = conn
+	ns.rd = bufio.NewReader(conn)
+	conn.SetDeadline(time.Now().Add(ns.timeout))
+
+	line, err := ns.readLine()
+	if err != nil {
+		ns.close()
+		return errors.WithStack(err)
+	}
+	if !strings.HasPrefix(line, "INFO ") {
+		ns.close()
+		return errors.Errorf("unexpected NATS greeting %q", line)
+	}
+	_, err = fmt.Fprintf(conn, "CONNECT {\"verbose\":false,\"pedantic\":false,\"name\":\"hockeypuck\"}\r\n")
+	if err != nil {
+		ns.close()
+		return errors.WithStack(err)
+	}
+	err = ns.ping()
+	if err != nil {
+		ns.close()
+		return errors.WithStack(err)
+	}
+	return nil
+}
+
+// publish sends a message and waits for the server to acknowledge it with a
+// PONG, so that errors such as permission violations are reported. The
+// caller must hold ns.mu.
+func (ns *NATS) publish(body []byte) error {
+	ns.conn.SetDeadline(time.Now().Add(ns.timeout))
+	_, err := fmt.Fprintf(ns.conn, "PUB %s %d\r\n%s\r\n", ns.subject, len(body), body)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return ns.ping()
+}
+
+// ping sends a PING and reads until the matching PONG, answering any PING
+// from the server along the way. The caller must hold ns.mu.
+func (ns *NATS) ping() error {
+	_, err := fmt.Fprintf(ns.conn, "PING\r\n")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	for {
+		line, err := ns.readLine()
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		switch {
+		case line == "PONG":
+			return nil
+		case line == "PING":
+			_, err = fmt.Fprintf(ns.conn, "PONG\r\n")
+			if err != nil {
+				return errors.WithStack(err)
+			}
+		case line == "+OK", strings.HasPrefix(line, "INFO "):
+		case strings.HasPrefix(line, "-ERR"):
+			return errors.Errorf("NATS server error: %s", strings.TrimSpace(line[4:]))
+		default:
+			return errors.Errorf("unexpected NATS response %q", line)
+		}
+	}
+}
+
+func (ns *NATS) readLine() (string, error) {
+	line, err := ns.rd.ReadString('\n')
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// close discards the connection. The caller must hold ns.mu.
+func (ns *NATS) close() {
+	if ns.conn != nil {
+		ns.conn.Close()
+	}
+	ns.conn = nil
+	ns.rd = nil
+}
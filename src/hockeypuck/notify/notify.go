@@ -0,0 +1,295 @@
+// Package notify publishes key change events to external subscribers, such
+// as webhooks and event streams, so that they can react to key changes
+// without polling the keyserver.
+//
+// Events are queued and delivered asynchronously. If the queue is full,
+// events are dropped rather than holding up key submission or recon, so
+// changes which must all be delivered are published elsewhere.
+package notify
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"gopkg.in/tomb.v2"
+
+	"hockeypuck/hkp/storage"
+	"hockeypuck/logging"
+	log "hockeypuck/logrus"
+)
+
+var logger = logging.Module("notify")
+
+// Types of key change.
+const (
+	ChangeAdded   = "added"
+	ChangeUpdated = "updated"
+	ChangeRemoved = "removed"
+)
+
+// Sources of key changes.
+const (
+	SourceAdd     = "add"
+	SourceReplace = "replace"
+	SourceDelete  = "delete"
+	SourceRecon   = "recon"
+	SourceReplica = "replica"
+)
+
+const DefaultQueueSize = 1000
+
+type Settings struct {
+	// QueueSize is the number of events which may be waiting for delivery
+	// before further events are dropped.
+	QueueSize int `toml:"queueSize"`
+
+	Webhooks []WebhookSettings `toml:"webhook"`
+	NATS     []NATSSettings    `toml:"nats"`
+	Kafka    []KafkaSettings   `toml:"kafka"`
+}
+
+func DefaultSettings() *Settings {
+	return &Settings{
+		QueueSize: DefaultQueueSize,
+	}
+}
+
+// Event describes a change to a key.
+type Event struct {
+	Fingerprint string `json:"fingerprint"`
+
+	// Digest is the SKS digest of the key material after the change, or of
+	// the removed key.
+	Digest string `json:"md5"`
+
+	// OldDigest is the digest of the key material replaced by an update.
+	OldDigest string `json:"oldMd5,omitempty"`
+
+	Change string    `json:"change"`
+	Source string    `json:"source"`
+	Time   time.Time `json:"time"`
+}
+
+// NewEvent returns the event to publish for a change to the key with the
+// given fingerprint. It returns false if the change is not published.
+func NewEvent(fingerprint string, change storage.KeyChange, source string) (*Event, bool) {
+	ev := &Event{
+		Fingerprint: fingerprint,
+		Source:      source,
+		Time:        time.Now().UTC(),
+	}
+	switch kc := change.(type) {
+	case storage.KeyAdded:
+		ev.Change = ChangeAdded
+		ev.Digest = kc.Digest
+	case storage.KeyReplaced:
+		ev.Change = ChangeUpdated
+		ev.Digest = kc.NewDigest
+		ev.OldDigest = kc.OldDigest
+	case storage.KeyRemoved:
+		ev.Change = ChangeRemoved
+		ev.Digest = kc.Digest
+	default:
+		return nil, false
+	}
+	return ev, true
+}
+
+// Publisher is told of key changes as they are made. Dispatcher is a
+// Publisher.
+type Publisher interface {
+	Publish(fingerprint string, change storage.KeyChange, source string)
+}
+
+// Sink delivers events to a subscriber.
+type Sink interface {
+	// Name identifies the sink in logs and metrics.
+	Name() string
+
+	// Accepts returns whether the sink wants the event.
+	Accepts(ev *Event) bool
+
+	// Send delivers an event.
+	Send(ev *Event) error
+}
+
+// changeSet selects the types of change delivered to a sink.
+type changeSet map[string]bool
+
+// newChangeSet returns the set of the given changes, or of defaults if none
+// are given.
+func newChangeSet(changes []string, defaults ...string) (changeSet, error) {
+	if len(changes) == 0 {
+		changes = defaults
+	}
+	cs := changeSet{}
+	for _, change := range changes {
+		switch change {
+		case ChangeAdded, ChangeUpdated, ChangeRemoved:
+			cs[change] = true
+		default:
+			return nil, errors.Errorf("unknown change type %q", change)
+		}
+	}
+	return cs, nil
+}
+
+func (cs changeSet) accepts(ev *Event) bool {
+	return cs[ev.Change]
+}
+
+// Dispatcher queues events and delivers them to each configured sink.
+type Dispatcher struct {
+	sinks []Sink
+	queue chan *Event
+	t     tomb.Tomb
+
+	// resumed is closed when delivery resumes after Pause. It is nil
+	// unless paused.
+	mu      sync.Mutex
+	resumed chan struct{}
+}
+
+// NewDispatcher returns a dispatcher for the sinks described by settings.
+func NewDispatcher(settings *Settings) (*Dispatcher, error) {
+	registerMetrics()
+	if settings == nil {
+		settings = DefaultSettings()
+	}
+	queueSize := settings.QueueSize
+	if queueSize <= 0 {
+		queueSize = DefaultQueueSize
+	}
+	d := &Dispatcher{
+		queue: make(chan *Event, queueSize),
+	}
+	for i := range settings.Webhooks {
+		wh, err := NewWebhook(&settings.Webhooks[i])
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		d.sinks = append(d.sinks, wh)
+	}
+	for i := range settings.NATS {
+		ns, err := NewNATS(&settings.NATS[i])
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		d.sinks = append(d.sinks, ns)
+	}
+	for i := range settings.Kafka {
+		ks, err := NewKafka(&settings.Kafka[i])
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		d.sinks = append(d.sinks, ks)
+	}
+	return d, nil
+}
+
+// AddSink adds a sink to the dispatcher. It must be called before Start.
+func (d *Dispatcher) AddSink(sink Sink) {
+	d.sinks = append(d.sinks, sink)
+}
+
+// Enabled returns whether the dispatcher has any sinks.
+func (d *Dispatcher) Enabled() bool {
+	return d != nil && len(d.sinks) > 0
+}
+
+// Publish queues an event for a change to the key with the given
+// fingerprint, if the change is one which is published. It may be called on
+// a nil dispatcher.
+func (d *Dispatcher) Publish(fingerprint string, change storage.KeyChange, source string) {
+	if !d.Enabled() {
+		return
+	}
+	ev, ok := NewEvent(fingerprint, change, source)
+	if !ok {
+		return
+	}
+	select {
+	case d.queue <- ev:
+	default:
+		notifyMetrics.dropped.Inc()
+		logger.WithFields(log.Fields{
+			"fingerprint": ev.Fingerprint,
+			"change":      ev.Change,
+		}).Warning("notification queue full, event dropped")
+	}
+}
+
+// Start delivering queued events.
+func (d *Dispatcher) Start() {
+	d.t.Go(d.run)
+}
+
+// Stop delivering events. Events still queued are discarded.
+func (d *Dispatcher) Stop() error {
+	d.t.Kill(nil)
+	return d.t.Wait()
+}
+
+// Pause stops delivering events once the event being delivered, if any, is
+// sent. Events are queued meanwhile, and dropped if the queue fills.
+func (d *Dispatcher) Pause() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.resumed == nil {
+		d.resumed = make(chan struct{})
+	}
+}
+
+// Resume delivering events after Pause.
+func (d *Dispatcher) Resume() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.resumed != nil {
+		close(d.resumed)
+		d.resumed = nil
+	}
+}
+
+// Paused returns whether delivery is paused.
+func (d *Dispatcher) Paused() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.resumed != nil
+}
+
+func (d *Dispatcher) run() error {
+	for {
+		d.mu.Lock()
+		resumed := d.resumed
+		d.mu.Unlock()
+		if resumed != nil {
+			select {
+			case <-d.t.Dying():
+				return nil
+			case <-resumed:
+			}
+			continue
+		}
+		select {
+		case <-d.t.Dying():
+			return nil
+		case ev := <-d.queue:
+			for _, sink := range d.sinks {
+				if !sink.Accepts(ev) {
+					continue
+				}
+				err := sink.Send(ev)
+				if err != nil {
+					notifyMetrics.events.WithLabelValues(sink.Name(), "failure").Inc()
+					logger.WithFields(log.Fields{
+						"sink":        sink.Name(),
+						"fingerprint": ev.Fingerprint,
+					}).Errorf("notification failed: %v", err)
+					continue
+				}
+				notifyMetrics.events.WithLabelValues(sink.Name(), "success").Inc()
+			}
+		}
+	}
+}
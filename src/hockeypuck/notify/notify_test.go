@@ -0,0 +1,218 @@
+package notify
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	stdtesting "testing"
+	"time"
+
+	gc "gopkg.in/check.v1"
+
+	"hockeypuck/hkp/storage"
+)
+
+func Test(t *stdtesting.T) { gc.TestingT(t) }
+
+type NotifySuite struct{}
+
+var _ = gc.Suite(&NotifySuite{})
+
+const testFp = "0123456789abcdef0123456789abcdef01234567"
+
+func (s *NotifySuite) TestWebhook(c *gc.C) {
+	events := make(chan *Event, 2)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.Check(r.Method, gc.Equals, "POST")
+		c.Check(r.Header.Get("Content-Type"), gc.Equals, "application/json")
+		var ev Event
+		c.Check(json.NewDecoder(r.Body).Decode(&ev), gc.IsNil)
+		events <- &ev
+	}))
+	defer srv.Close()
+
+	d, err := NewDispatcher(&Settings{
+		Webhooks: []WebhookSettings{{URL: srv.URL}},
+	})
+	c.Assert(err, gc.IsNil)
+	c.Assert(d.Enabled(), gc.Equals, true)
+	d.Start()
+	defer d.Stop()
+
+	d.Publish(testFp, storage.KeyNotChanged{}, SourceAdd)
+	// Webhooks do not receive removals by default.
+	d.Publish(testFp, storage.KeyRemoved{Digest: "old"}, SourceDelete)
+	d.Publish(testFp, storage.KeyReplaced{OldDigest: "old", NewDigest: "new"}, SourceRecon)
+
+	select {
+	case ev := <-events:
+		c.Assert(ev.Fingerprint, gc.Equals, testFp)
+		c.Assert(ev.Digest, gc.Equals, "new")
+		c.Assert(ev.OldDigest, gc.Equals, "old")
+		c.Assert(ev.Change, gc.Equals, ChangeUpdated)
+		c.Assert(ev.Source, gc.Equals, SourceRecon)
+	case <-time.After(5 * time.Second):
+		c.Fatal("timeout waiting for webhook")
+	}
+	select {
+	case ev := <-events:
+		c.Fatalf("unexpected event: %+v", ev)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func (s *NotifySuite) TestPause(c *gc.C) {
+	events := make(chan *Event, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var ev Event
+		c.Check(json.NewDecoder(r.Body).Decode(&ev), gc.IsNil)
+		events <- &ev
+	}))
+	defer srv.Close()
+
+	d, err := NewDispatcher(&Settings{
+		Webhooks: []WebhookSettings{{URL: srv.URL}},
+	})
+	c.Assert(err, gc.IsNil)
+	d.Pause()
+	c.Assert(d.Paused(), gc.Equals, true)
+	d.Start()
+	defer d.Stop()
+
+	// Events are queued while paused.
+	d.Publish(testFp, storage.KeyAdded{ID: testFp, Digest: "new"}, SourceAdd)
+	select {
+	case ev := <-events:
+		c.Fatalf("unexpected event while paused: %+v", ev)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	d.Resume()
+	c.Assert(d.Paused(), gc.Equals, false)
+	select {
+	case ev := <-events:
+		c.Assert(ev.Change, gc.Equals, ChangeAdded)
+	case <-time.After(5 * time.Second):
+		c.Fatal("timeout waiting for webhook")
+	}
+}
+
+func (s *NotifySuite) TestInvalidWebhook(c *gc.C) {
+	_, err := NewDispatcher(&Settings{
+		Webhooks: []WebhookSettings{{URL: "ftp://example.com/hook"}},
+	})
+	c.Assert(err, gc.ErrorMatches, ".*scheme must be http or https")
+}
+
+func (s *NotifySuite) TestNilDispatcher(c *gc.C) {
+	var d *Dispatcher
+	c.Assert(d.Enabled(), gc.Equals, false)
+	d.Publish(testFp, storage.KeyAdded{}, SourceAdd)
+}
+
+func (s *NotifySuite) TestInvalidChanges(c *gc.C) {
+	_, err := NewDispatcher(&Settings{
+		NATS: []NATSSettings{{URL: "nats://localhost", Changes: []string{"deleted"}}},
+	})
+	c.Assert(err, gc.ErrorMatches, `.*unknown change type "deleted"`)
+}
+
+func (s *NotifySuite) TestKafka(c *gc.C) {
+	reqs := make(chan *kafkaProduceRequest, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.Check(r.Method, gc.Equals, "POST")
+		c.Check(r.URL.Path, gc.Equals, "/topics/keys")
+		c.Check(r.Header.Get("Content-Type"), gc.Equals, kafkaContentType)
+		var req kafkaProduceRequest
+		c.Check(json.NewDecoder(r.Body).Decode(&req), gc.IsNil)
+		reqs <- &req
+	}))
+	defer srv.Close()
+
+	ks, err := NewKafka(&KafkaSettings{URL: srv.URL + "/", Topic: "keys"})
+	c.Assert(err, gc.IsNil)
+	ev, ok := NewEvent(testFp, storage.KeyRemoved{Digest: "old"}, SourceDelete)
+	c.Assert(ok, gc.Equals, true)
+	c.Assert(ks.Accepts(ev), gc.Equals, true)
+	c.Assert(ks.Send(ev), gc.IsNil)
+
+	req := <-reqs
+	c.Assert(req.Records, gc.HasLen, 1)
+	c.Assert(req.Records[0].Key, gc.Equals, testFp)
+	c.Assert(req.Records[0].Value.Change, gc.Equals, ChangeRemoved)
+	c.Assert(req.Records[0].Value.Digest, gc.Equals, "old")
+}
+
+// fakeNATS accepts a single client connection and records the payloads
+// published to it.
+func fakeNATS(c *gc.C, l net.Listener, msgs chan<- string) {
+	conn, err := l.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	fmt.Fprintf(conn, "INFO {\"server_id\":\"test\"}\r\n")
+	rd := bufio.NewReader(conn)
+	for {
+		line, err := rd.ReadString('\n')
+		if err != nil {
+			return
+		}
+		var subject string
+		var n int
+		switch {
+		case strings.HasPrefix(line, "PING"):
+			fmt.Fprintf(conn, "PONG\r\n")
+		case strings.HasPrefix(line, "PUB "):
+			_, err = fmt.Sscanf(line, "PUB %s %d\r\n", &subject, &n)
+			c.Check(err, gc.IsNil)
+			c.Check(subject, gc.Equals, "test.keys")
+			buf := make([]byte, n+2)
+			_, err = io.ReadFull(rd, buf)
+			c.Check(err, gc.IsNil)
+			msgs <- string(buf[:n])
+		}
+	}
+}
+
+func (s *NotifySuite) TestNATS(c *gc.C) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, gc.IsNil)
+	defer l.Close()
+	msgs := make(chan string, 2)
+	go fakeNATS(c, l, msgs)
+
+	ns, err := NewNATS(&NATSSettings{
+		URL:     "nats://" + l.Addr().String(),
+		Subject: "test.keys",
+		Changes: []string{ChangeAdded},
+	})
+	c.Assert(err, gc.IsNil)
+	defer ns.Close()
+
+	removed, _ := NewEvent(testFp, storage.KeyRemoved{}, SourceDelete)
+	c.Assert(ns.Accepts(removed), gc.Equals, false)
+
+	for i := 0; i < 2; i++ {
+		ev, ok := NewEvent(testFp, storage.KeyAdded{Digest: fmt.Sprint(i)}, SourceAdd)
+		c.Assert(ok, gc.Equals, true)
+		c.Assert(ns.Accepts(ev), gc.Equals, true)
+		c.Assert(ns.Send(ev), gc.IsNil)
+	}
+	for i := 0; i < 2; i++ {
+		var ev Event
+		c.Assert(json.Unmarshal([]byte(<-msgs), &ev), gc.IsNil)
+		c.Assert(ev.Fingerprint, gc.Equals, testFp)
+		c.Assert(ev.Digest, gc.Equals, fmt.Sprint(i))
+	}
+}
+
+func (s *NotifySuite) TestInvalidNATS(c *gc.C) {
+	_, err := NewNATS(&NATSSettings{URL: "http://localhost:4222"})
+	c.Assert(err, gc.ErrorMatches, ".*expected nats://host:port")
+}
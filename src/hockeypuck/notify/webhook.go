@@ -0,0 +1,83 @@
+package notify
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const DefaultWebhookTimeoutSecs = 10
+
+type WebhookSettings struct {
+	// URL to which events are POSTed as JSON.
+	URL string `toml:"url"`
+
+	// TimeoutSecs limits how long a single delivery may take.
+	TimeoutSecs int `toml:"timeoutSecs"`
+
+	// Changes lists the types of change delivered. The default is added
+	// and updated keys.
+	Changes []string `toml:"changes"`
+}
+
+// Webhook is a sink which POSTs each event as a JSON document to a URL.
+type Webhook struct {
+	url     string
+	client  *http.Client
+	changes changeSet
+}
+
+// NewWebhook returns a webhook sink.
+func NewWebhook(settings *WebhookSettings) (*Webhook, error) {
+	u, err := url.Parse(settings.URL)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid webhook URL %q", settings.URL)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, errors.Errorf("invalid webhook URL %q: scheme must be http or https", settings.URL)
+	}
+	changes, err := newChangeSet(settings.Changes, ChangeAdded, ChangeUpdated)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid webhook %q", settings.URL)
+	}
+	timeout := settings.TimeoutSecs
+	if timeout <= 0 {
+		timeout = DefaultWebhookTimeoutSecs
+	}
+	return &Webhook{
+		url:     settings.URL,
+		client:  &http.Client{Timeout: time.Duration(timeout) * time.Second},
+		changes: changes,
+	}, nil
+}
+
+func (wh *Webhook) Name() string {
+	return wh.url
+}
+
+func (wh *Webhook) Accepts(ev *Event) bool {
+	return wh.changes.accepts(ev)
+}
+
+func (wh *Webhook) Send(ev *Event) error {
+	body, err := json.Marshal(ev)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	resp, err := wh.client.Post(wh.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return errors.Errorf("webhook %q returned %s", wh.url, resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,185 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package openpgp
+
+import (
+	"bufio"
+	"encoding/base64"
+	"io"
+	"sort"
+	"sync"
+)
+
+const (
+	// armorLineLength is the number of base64 characters on each line of
+	// armored data, as written by golang.org/x/crypto/openpgp/armor.
+	armorLineLength = 64
+
+	// armorLineBytes is the number of bytes encoded on each line.
+	armorLineBytes = armorLineLength / 4 * 3
+
+	// armorBufferSize is the size of the buffer between an armor encoder
+	// and the writer it writes to.
+	armorBufferSize = 32 * 1024
+)
+
+// armorEncoder encodes data in OpenPGP armor. Its output is that of
+// golang.org/x/crypto/openpgp/armor, with headers in sorted order, but
+// encoders and their output buffers are pooled and reused, so that writing
+// a large key does not allocate in proportion to its size.
+type armorEncoder struct {
+	out       *bufio.Writer
+	blockType string
+	crc       uint32
+
+	// pending holds data not yet encoded on a full line.
+	pending  [armorLineBytes]byte
+	nPending int
+
+	// line holds an encoded line, after the newline ending the line before
+	// it.
+	line      [1 + armorLineLength]byte
+	wroteLine bool
+}
+
+var armorEncoders = sync.Pool{
+	New: func() interface{} {
+		return &armorEncoder{out: bufio.NewWriterSize(nil, armorBufferSize)}
+	},
+}
+
+// newArmorEncoder writes the armor header to w and returns an encoder for
+// the data which follows. The encoder must be closed, or released if
+// writing fails.
+func newArmorEncoder(w io.Writer, blockType string, headers map[string]string) (*armorEncoder, error) {
+	e := armorEncoders.Get().(*armorEncoder)
+	e.out.Reset(w)
+	e.blockType = blockType
+	e.crc = crc24Init
+	e.nPending = 0
+	e.wroteLine = false
+	e.line[0] = '\n'
+
+	e.out.WriteString("-----BEGIN ")
+	e.out.WriteString(blockType)
+	e.out.WriteString("-----\n")
+	keys := make([]string, 0, len(headers))
+	for k := range headers {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		e.out.WriteString(k)
+		e.out.WriteString(": ")
+		e.out.WriteString(headers[k])
+		e.out.WriteByte('\n')
+	}
+	err := e.out.WriteByte('\n')
+	if err != nil {
+		e.release()
+		return nil, err
+	}
+	return e, nil
+}
+
+func (e *armorEncoder) Write(p []byte) (int, error) {
+	n := len(p)
+	e.crc = crc24(e.crc, p)
+	for len(p) > 0 {
+		if e.nPending == 0 && len(p) >= armorLineBytes {
+			if err := e.writeLine(p[:armorLineBytes]); err != nil {
+				return 0, err
+			}
+			p = p[armorLineBytes:]
+			continue
+		}
+		copied := copy(e.pending[e.nPending:], p)
+		e.nPending += copied
+		p = p[copied:]
+		if e.nPending == armorLineBytes {
+			e.nPending = 0
+			if err := e.writeLine(e.pending[:]); err != nil {
+				return 0, err
+			}
+		}
+	}
+	return n, nil
+}
+
+// writeLine encodes data on a line of its own.
+func (e *armorEncoder) writeLine(data []byte) error {
+	n := base64.StdEncoding.EncodedLen(len(data))
+	base64.StdEncoding.Encode(e.line[1:], data)
+	line := e.line[:1+n]
+	if !e.wroteLine {
+		line = line[1:]
+		e.wroteLine = true
+	}
+	_, err := e.out.Write(line)
+	return err
+}
+
+// Close writes the checksum and armor trailer, and releases the encoder.
+func (e *armorEncoder) Close() error {
+	defer e.release()
+	if e.nPending > 0 {
+		e.writeLine(e.pending[:e.nPending])
+	}
+	checksum := [3]byte{byte(e.crc >> 16), byte(e.crc >> 8), byte(e.crc)}
+	var encoded [4]byte
+	base64.StdEncoding.Encode(encoded[:], checksum[:])
+	e.out.WriteString("\n=")
+	e.out.Write(encoded[:])
+	e.out.WriteString("\n-----END ")
+	e.out.WriteString(e.blockType)
+	e.out.WriteString("-----")
+	return e.out.Flush()
+}
+
+// release returns the encoder to the pool without writing anything more.
+func (e *armorEncoder) release() {
+	e.out.Reset(nil)
+	armorEncoders.Put(e)
+}
+
+const (
+	crc24Init = 0xb704ce
+	crc24Poly = 0x1864cfb
+)
+
+var crc24Table = func() (table [256]uint32) {
+	for i := range table {
+		crc := uint32(i) << 16
+		for j := 0; j < 8; j++ {
+			crc <<= 1
+			if crc&0x1000000 != 0 {
+				crc ^= crc24Poly
+			}
+		}
+		table[i] = crc & 0xffffff
+	}
+	return
+}()
+
+// crc24 updates the OpenPGP checksum of RFC 4880, section 6.1, with d.
+func crc24(crc uint32, d []byte) uint32 {
+	for _, b := range d {
+		crc = (crc<<8 ^ crc24Table[byte(crc>>16)^b]) & 0xffffff
+	}
+	return crc
+}
@@ -0,0 +1,156 @@
+package openpgp
+
+import (
+	"bytes"
+	"crypto"
+	"encoding/binary"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Attestation key signatures (1PA3PC) are made by the holder of a key over a
+// user ID or user attribute, listing digests of the certifications by other
+// keys which the holder wants published. The latest attestation supersedes
+// any earlier one, so an attestation listing nothing withdraws them all.
+const (
+	sigTypeAttestation = 0x16
+
+	subpacketCritical               = 0x80
+	subpacketAttestedCertifications = 37
+)
+
+// AttestedCertifications returns the digests of the certifications listed by
+// an attestation signature, and the hash function which made them.
+func (sig *Signature) AttestedCertifications() ([][]byte, crypto.Hash, error) {
+	if sig.SigType != sigTypeAttestation {
+		return nil, 0, errors.Errorf("not an attestation signature: 0x%02x", sig.SigType)
+	}
+	s, err := sig.signaturePacket()
+	if err != nil {
+		return nil, 0, errors.WithStack(err)
+	}
+	if !s.Hash.Available() {
+		return nil, 0, errors.Errorf("unsupported hash function: %v", s.Hash)
+	}
+	op, err := sig.opaquePacket()
+	if err != nil {
+		return nil, 0, errors.WithStack(err)
+	}
+	subpackets, err := hashedSubpackets(op.Contents)
+	if err != nil {
+		return nil, 0, errors.WithStack(err)
+	}
+	size := s.Hash.Size()
+	var result [][]byte
+	for _, sp := range subpackets {
+		if sp.body[0]&^subpacketCritical != subpacketAttestedCertifications {
+			continue
+		}
+		data := sp.body[1:]
+		if len(data)%size != 0 {
+			return nil, 0, errors.New("invalid attested certifications length")
+		}
+		for len(data) > 0 {
+			result = append(result, data[:size])
+			data = data[size:]
+		}
+	}
+	return result, s.Hash, nil
+}
+
+// attestationDigest returns the digest by which an attestation lists a
+// certification: the hash of the signature packet with an old format header
+// and without its unhashed subpackets, which anyone may change.
+func (sig *Signature) attestationDigest(h crypto.Hash) ([]byte, error) {
+	op, err := sig.opaquePacket()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	buf := op.Contents
+	if len(buf) < 6 || buf[0] != 4 {
+		return nil, errors.New("only version 4 signatures may be attested")
+	}
+	hashedEnd := 6 + int(binary.BigEndian.Uint16(buf[4:6]))
+	if len(buf) < hashedEnd+2 {
+		return nil, errors.New("truncated signature subpackets")
+	}
+	unhashedEnd := hashedEnd + 2 + int(binary.BigEndian.Uint16(buf[hashedEnd:hashedEnd+2]))
+	if len(buf) < unhashedEnd {
+		return nil, errors.New("truncated signature subpackets")
+	}
+	var body bytes.Buffer
+	body.Write(buf[:hashedEnd])
+	body.Write([]byte{0, 0})
+	body.Write(buf[unhashedEnd:])
+
+	d := h.New()
+	var header [5]byte
+	header[0] = 0x88
+	binary.BigEndian.PutUint32(header[1:], uint32(body.Len()))
+	d.Write(header[:])
+	d.Write(body.Bytes())
+	return d.Sum(nil), nil
+}
+
+// isCertification returns whether sig certifies a user ID or user attribute.
+func (sig *Signature) isCertification() bool {
+	return sig.SigType >= 0x10 && sig.SigType <= 0x13
+}
+
+// AttestedOnly reduces the certifications by other keys on the user IDs and
+// user attributes of key to those attested by the latest valid attestation
+// signature of each, dropping them all from those without one. Revocations
+// by other keys are kept if their issuer made an attested certification.
+// Self-signatures are unchanged.
+func AttestedOnly(key *PrimaryKey) error {
+	for _, uid := range key.UserIDs {
+		ss, _ := uid.SigInfo(key)
+		uid.Signatures = attestedSigs(key, uid.Signatures, ss)
+	}
+	for _, uat := range key.UserAttributes {
+		ss, _ := uat.SigInfo(key)
+		uat.Signatures = attestedSigs(key, uat.Signatures, ss)
+	}
+	return key.updateMD5()
+}
+
+func attestedSigs(key *PrimaryKey, sigs []*Signature, ss *SelfSigs) []*Signature {
+	digests := map[string]bool{}
+	var h crypto.Hash
+	if len(ss.Attestations) > 0 {
+		attested, hash, err := ss.Attestations[0].Signature.AttestedCertifications()
+		if err == nil {
+			h = hash
+			for _, digest := range attested {
+				digests[string(digest)] = true
+			}
+		}
+	}
+
+	isSelf := func(sig *Signature) bool {
+		return strings.HasPrefix(key.UUID, sig.RIssuerKeyID)
+	}
+	issuers := map[string]bool{}
+	var result []*Signature
+	for _, sig := range sigs {
+		if isSelf(sig) {
+			result = append(result, sig)
+			continue
+		}
+		if len(digests) == 0 || !sig.isCertification() {
+			continue
+		}
+		digest, err := sig.attestationDigest(h)
+		if err == nil && digests[string(digest)] {
+			issuers[sig.RIssuerKeyID] = true
+			result = append(result, sig)
+		}
+	}
+	for _, sig := range sigs {
+		if !isSelf(sig) && sig.SigType == 0x30 && issuers[sig.RIssuerKeyID] {
+			result = append(result, sig)
+		}
+	}
+	return result
+}
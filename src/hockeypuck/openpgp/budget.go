@@ -0,0 +1,48 @@
+package openpgp
+
+import (
+	"context"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ErrBudgetExceeded is returned when parsing, verifying or merging a key
+// takes longer than the budget set by KeyBudget, as it may for hostile packet
+// structures which defeat deduplication or carry many signatures.
+var ErrBudgetExceeded = errors.New("key processing budget exceeded")
+
+// KeyBudget limits how long each key may take to parse and verify as it is
+// read, and to merge wherever the same options are given, as to
+// storage.UpsertKey. Keys which take longer fail with ErrBudgetExceeded. Zero
+// is no limit.
+func KeyBudget(budget time.Duration) KeyReaderOption {
+	return func(or *OpaqueKeyReader) error {
+		or.keyBudget = budget
+		return nil
+	}
+}
+
+// WithKeyBudget returns a context for processing a single key, which is done
+// once the budget set by KeyBudget among options has passed.
+func WithKeyBudget(ctx context.Context, options ...KeyReaderOption) (context.Context, context.CancelFunc) {
+	okr, err := NewOpaqueKeyReader(nil, options...)
+	if err != nil || okr.keyBudget <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, okr.keyBudget)
+}
+
+// checkBudget returns ErrBudgetExceeded if the deadline of ctx has passed,
+// or the error of ctx if it was otherwise cancelled.
+func checkBudget(ctx context.Context) error {
+	select {
+	case <-ctx.Done():
+	default:
+		return nil
+	}
+	if ctx.Err() == context.DeadlineExceeded {
+		return errors.WithStack(ErrBudgetExceeded)
+	}
+	return errors.WithStack(ctx.Err())
+}
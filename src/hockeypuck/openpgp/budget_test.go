@@ -0,0 +1,86 @@
+package openpgp
+
+import (
+	"context"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/openpgp/armor"
+	gc "gopkg.in/check.v1"
+
+	"hockeypuck/testing"
+)
+
+type BudgetSuite struct{}
+
+var _ = gc.Suite(&BudgetSuite{})
+
+func (s *BudgetSuite) TestReadContext(c *gc.C) {
+	read := func(ctx context.Context) ([]*PrimaryKey, error) {
+		block, err := armor.Decode(testing.MustInput("alice_signed.asc"))
+		c.Assert(err, gc.IsNil)
+		return NewKeyReader(block.Body).ReadContext(ctx)
+	}
+
+	keys, err := read(context.Background())
+	c.Assert(err, gc.IsNil)
+	c.Assert(keys, gc.HasLen, 1)
+	fp := keys[0].Fingerprint()
+
+	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancel()
+	_, err = read(ctx)
+	c.Assert(errors.Is(err, ErrBudgetExceeded), gc.Equals, true)
+	c.Assert(err, gc.ErrorMatches, "key "+fp+": key processing budget exceeded")
+
+	// Keys are not over budget if the caller gives up on them.
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	_, err = read(ctx)
+	c.Assert(errors.Is(err, ErrBudgetExceeded), gc.Equals, false)
+	c.Assert(errors.Is(err, context.Canceled), gc.Equals, true)
+}
+
+func (s *BudgetSuite) TestMergeContext(c *gc.C) {
+	unsigned := MustInputAscKey("alice_unsigned.asc")
+	signed := MustInputAscKey("alice_signed.asc")
+
+	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancel()
+	err := MergeContext(ctx, unsigned, signed)
+	c.Assert(errors.Is(err, ErrBudgetExceeded), gc.Equals, true)
+	err = DropDuplicatesContext(ctx, signed)
+	c.Assert(errors.Is(err, ErrBudgetExceeded), gc.Equals, true)
+
+	err = MergeContext(context.Background(), MustInputAscKey("alice_unsigned.asc"), signed)
+	c.Assert(err, gc.IsNil)
+}
+
+func (s *BudgetSuite) TestVerifyContext(c *gc.C) {
+	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancel()
+	err := ValidSelfSignedContext(ctx, MustInputAscKey("alice_signed.asc"), false)
+	c.Assert(errors.Is(err, ErrBudgetExceeded), gc.Equals, true)
+	err = DropUnverifiedContext(ctx, MustInputAscKey("alice_signed.asc"))
+	c.Assert(errors.Is(err, ErrBudgetExceeded), gc.Equals, true)
+
+	key := MustInputAscKey("alice_signed.asc")
+	err = ValidSelfSignedContext(context.Background(), key, false)
+	c.Assert(err, gc.IsNil)
+	c.Assert(key.UserIDs, gc.Not(gc.HasLen), 0)
+	err = DropUnverifiedContext(context.Background(), key)
+	c.Assert(err, gc.IsNil)
+}
+
+func (s *BudgetSuite) TestWithKeyBudget(c *gc.C) {
+	ctx, cancel := WithKeyBudget(context.Background())
+	defer cancel()
+	_, ok := ctx.Deadline()
+	c.Assert(ok, gc.Equals, false)
+
+	ctx, cancel = WithKeyBudget(context.Background(), MaxPacketLen(8192), KeyBudget(time.Minute))
+	defer cancel()
+	deadline, ok := ctx.Deadline()
+	c.Assert(ok, gc.Equals, true)
+	c.Assert(time.Until(deadline) <= time.Minute, gc.Equals, true)
+}
@@ -0,0 +1,119 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package openpgp
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// SKS ingest filter names. Keyservers declare the filters applied to keys
+// on ingest when they reconcile, since keys processed by different filters
+// hash to different digests.
+const (
+	// FilterDedup removes duplicate packets from keys. Always in effect.
+	FilterDedup = "yminsky.dedup"
+
+	// FilterMerge merges updates into the stored copy of a key. Always in
+	// effect.
+	FilterMerge = "yminsky.merge"
+
+	// FilterDropUATs discards all user attributes and their signatures.
+	FilterDropUATs = "drop-uats"
+
+	// FilterDropPhotos discards user attributes containing images and their
+	// signatures.
+	FilterDropPhotos = "drop-photos"
+
+	// FilterVerifySelfSigs discards self-signatures which fail
+	// verification, and user IDs, user attributes and subkeys left without
+	// a self-signature.
+	FilterVerifySelfSigs = "verify-self-sigs"
+)
+
+var requiredFilters = []string{FilterDedup, FilterMerge}
+
+var knownFilters = map[string]bool{
+	FilterDedup:          true,
+	FilterMerge:          true,
+	FilterDropUATs:       true,
+	FilterDropPhotos:     true,
+	FilterVerifySelfSigs: true,
+}
+
+// ResolveFilters validates a configured set of ingest filter names and
+// returns the set in effect: the configured filters plus those which are
+// always applied, sorted and without duplicates.
+func ResolveFilters(filters []string) ([]string, error) {
+	set := map[string]bool{}
+	for _, f := range requiredFilters {
+		set[f] = true
+	}
+	for _, f := range filters {
+		f = strings.TrimSpace(f)
+		if !knownFilters[f] {
+			return nil, errors.Errorf("unknown ingest filter %q", f)
+		}
+		set[f] = true
+	}
+	var result []string
+	for f := range set {
+		result = append(result, f)
+	}
+	sort.Strings(result)
+	return result, nil
+}
+
+// filterMaxUserAttributeLength declares the limit set by
+// MaxUserAttributeLen. It is not configured as a filter, but declared along
+// with them, because it changes the digests of keys it applies to as one
+// does.
+const filterMaxUserAttributeLength = "max-uat-length"
+
+// DeclareMaxUserAttributeLength adds the limit on the length of user
+// attributes, if there is one, to a resolved set of filters, so that recon
+// peers which do not apply the same limit notice.
+func DeclareMaxUserAttributeLength(filters []string, n int) []string {
+	if n <= 0 {
+		return filters
+	}
+	result := append([]string{fmt.Sprintf("%s=%d", filterMaxUserAttributeLength, n)}, filters...)
+	sort.Strings(result)
+	return result
+}
+
+// FilterOptions returns the key reader options which implement the given
+// ingest filters. Filters which are applied elsewhere, such as
+// FilterDedup, have no corresponding option.
+func FilterOptions(filters []string) []KeyReaderOption {
+	var opts []KeyReaderOption
+	for _, f := range filters {
+		switch strings.TrimSpace(f) {
+		case FilterDropUATs:
+			opts = append(opts, DropUserAttributes())
+		case FilterDropPhotos:
+			opts = append(opts, DropPhotos())
+		case FilterVerifySelfSigs:
+			opts = append(opts, VerifySelfSigs())
+		}
+	}
+	return opts
+}
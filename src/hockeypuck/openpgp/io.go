@@ -18,6 +18,7 @@
 package openpgp
 
 import (
+	"context"
 	"crypto/md5"
 	"encoding/binary"
 	"encoding/hex"
@@ -27,6 +28,7 @@ import (
 	"os"
 	"sort"
 	"strings"
+	"time"
 
 	"github.com/pkg/errors"
 	"golang.org/x/crypto/openpgp"
@@ -34,9 +36,12 @@ import (
 	pgperrors "golang.org/x/crypto/openpgp/errors"
 	"golang.org/x/crypto/openpgp/packet"
 
+	"hockeypuck/logging"
 	log "hockeypuck/logrus"
 )
 
+var logger = logging.Module("openpgp")
+
 var ErrMissingSignature = fmt.Errorf("Key material missing an expected signature")
 
 type ArmoredKeyWriter struct {
@@ -56,6 +61,15 @@ func NewArmoredKeyWriter(options ...KeyWriterOption) (*ArmoredKeyWriter, error)
 	return okw, nil
 }
 
+// Headers returns the armor headers written, by name.
+func (ow *ArmoredKeyWriter) Headers() map[string]string {
+	result := map[string]string{}
+	for name, value := range ow.headers {
+		result[name] = value
+	}
+	return result
+}
+
 func ArmorHeaderComment(comment string) KeyWriterOption {
 	return func(ow *ArmoredKeyWriter) error {
 		ow.headers["Comment"] = comment
@@ -72,7 +86,17 @@ func ArmorHeaderVersion(version string) KeyWriterOption {
 
 func WritePackets(w io.Writer, key *PrimaryKey) error {
 	for _, node := range key.contents() {
-		op, err := newOpaquePacket(node.packet().Packet)
+		buf := node.packet().Packet
+		if serialized(buf) {
+			// Write the packet as it is, rather than parsing a copy only to
+			// serialize it the same way again.
+			_, err := w.Write(buf)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+			continue
+		}
+		op, err := newOpaquePacket(buf)
 		if err != nil {
 			return errors.WithStack(err)
 		}
@@ -84,23 +108,54 @@ func WritePackets(w io.Writer, key *PrimaryKey) error {
 	return nil
 }
 
+// serialized returns whether buf is a single packet exactly as
+// packet.OpaquePacket serializes it: a new format header with the shortest
+// definite length encoding, followed by that many bytes of contents.
+func serialized(buf []byte) bool {
+	if len(buf) < 2 || buf[0]&0xc0 != 0xc0 {
+		return false
+	}
+	var length, header int
+	switch l := int(buf[1]); {
+	case l < 192:
+		length, header = l, 2
+	case l < 224:
+		if len(buf) < 3 {
+			return false
+		}
+		length, header = (l-192)<<8+int(buf[2])+192, 3
+	case l == 255:
+		if len(buf) < 6 {
+			return false
+		}
+		length, header = int(buf[2])<<24|int(buf[3])<<16|int(buf[4])<<8|int(buf[5]), 6
+		if length < 8384 {
+			return false
+		}
+	default:
+		// Partial body lengths are joined when the packet is parsed.
+		return false
+	}
+	return len(buf) == header+length
+}
+
 func WriteArmoredPackets(w io.Writer, roots []*PrimaryKey, options ...KeyWriterOption) error {
 	akwr, err := NewArmoredKeyWriter(options...)
 	if err != nil {
 		return errors.WithStack(err)
 	}
-	armw, err := armor.Encode(w, openpgp.PublicKeyType, akwr.headers)
+	armw, err := newArmorEncoder(w, openpgp.PublicKeyType, akwr.headers)
 	if err != nil {
 		return errors.WithStack(err)
 	}
-	defer armw.Close()
 	for _, node := range roots {
 		err = WritePackets(armw, node)
 		if err != nil {
+			armw.release()
 			return errors.WithStack(err)
 		}
 	}
-	return nil
+	return errors.WithStack(armw.Close())
 }
 
 type OpaqueKeyring struct {
@@ -110,6 +165,10 @@ type OpaqueKeyring struct {
 	Sha256       string
 	Error        error
 	Position     int64
+
+	// altered is set if packets of the keyring were dropped as it was read,
+	// so that its digest differs from that of the keyring as written.
+	altered bool
 }
 
 func (okr *OpaqueKeyring) setPosition(r io.Reader) {
@@ -125,11 +184,21 @@ func (okr *OpaqueKeyring) setPosition(r io.Reader) {
 }
 
 func (ok *OpaqueKeyring) Parse() (*PrimaryKey, error) {
+	return ok.parse(context.Background(), nil)
+}
+
+// parse parses the keyring, taking its digest from knownDigest if that
+// returns one for its reversed fingerprint. It fails if ctx is done before
+// the keyring is parsed.
+func (ok *OpaqueKeyring) parse(ctx context.Context, knownDigest func(rfp string) (string, bool)) (*PrimaryKey, error) {
 	var err error
 	var pubkey *PrimaryKey
 	var signablePacket signable
 	var length int
 	for _, opkt := range ok.Packets {
+		if err := checkBudget(ctx); err != nil {
+			return nil, err
+		}
 		length += len(opkt.Contents)
 		var badPacket *packet.OpaquePacket
 		if opkt.Tag == 6 { //packet.PacketTypePublicKey:
@@ -147,7 +216,7 @@ func (ok *OpaqueKeyring) Parse() (*PrimaryKey, error) {
 				signablePacket = nil
 				subkey, err := ParseSubKey(opkt)
 				if err != nil {
-					log.Debugf("unreadable subkey packet in key 0x%s: %v", pubkey.KeyID(), err)
+					logger.WithFields(log.Fields{"keyid": pubkey.KeyID(), "error": err}).Debug("unreadable subkey packet")
 					badPacket = opkt
 				} else {
 					pubkey.SubKeys = append(pubkey.SubKeys, subkey)
@@ -157,7 +226,7 @@ func (ok *OpaqueKeyring) Parse() (*PrimaryKey, error) {
 				signablePacket = nil
 				uid, err := ParseUserID(opkt, pubkey.UUID)
 				if err != nil {
-					log.Debugf("unreadable user id packet in key 0x%s: %v", pubkey.KeyID(), err)
+					logger.WithFields(log.Fields{"keyid": pubkey.KeyID(), "error": err}).Debug("unreadable user id packet")
 					badPacket = opkt
 				} else {
 					pubkey.UserIDs = append(pubkey.UserIDs, uid)
@@ -167,7 +236,7 @@ func (ok *OpaqueKeyring) Parse() (*PrimaryKey, error) {
 				signablePacket = nil
 				uat, err := ParseUserAttribute(opkt, pubkey.UUID)
 				if err != nil {
-					log.Debugf("unreadable user attribute packet in key 0x%s: %v", pubkey.KeyID(), err)
+					logger.WithFields(log.Fields{"keyid": pubkey.KeyID(), "error": err}).Debug("unreadable user attribute packet")
 					badPacket = opkt
 				} else {
 					pubkey.UserAttributes = append(pubkey.UserAttributes, uat)
@@ -175,12 +244,12 @@ func (ok *OpaqueKeyring) Parse() (*PrimaryKey, error) {
 				}
 			case 2: //packet.PacketTypeSignature:
 				if signablePacket == nil {
-					log.Debugf("signature out of context")
+					logger.WithField("keyid", pubkey.KeyID()).Debug("signature out of context")
 					badPacket = opkt
 				} else {
 					sig, err := ParseSignature(opkt, pubkey.Creation, pubkey.UUID, signablePacket.uuid())
 					if err != nil {
-						log.Debugf("unreadable signature packet in key 0x%s: %v", pubkey.KeyID(), err)
+						logger.WithFields(log.Fields{"keyid": pubkey.KeyID(), "error": err}).Debug("unreadable signature packet")
 						badPacket = opkt
 					} else {
 						signablePacket.appendSignature(sig)
@@ -203,7 +272,7 @@ func (ok *OpaqueKeyring) Parse() (*PrimaryKey, error) {
 				}
 				_, isStructuralError := badPacket.Reason.(pgperrors.StructuralError)
 				if badPacket.Reason == io.ErrUnexpectedEOF || isStructuralError {
-					log.Debugf("malformed packet in key 0x%s: %v", pubkey.KeyID(), badPacket.Reason)
+					logger.WithFields(log.Fields{"keyid": pubkey.KeyID(), "error": badPacket.Reason}).Debug("malformed packet")
 					other.Malformed = true
 				}
 				pubkey.Others = append(pubkey.Others, other)
@@ -213,9 +282,15 @@ func (ok *OpaqueKeyring) Parse() (*PrimaryKey, error) {
 	if pubkey == nil {
 		return nil, errors.New("primary public key not found")
 	}
-	pubkey.MD5, err = SksDigest(pubkey, md5.New())
-	if err != nil {
-		return nil, err
+	var known bool
+	if knownDigest != nil && !ok.altered {
+		pubkey.MD5, known = knownDigest(pubkey.RFingerprint)
+	}
+	if !known {
+		pubkey.MD5, err = SksDigest(pubkey, md5.New())
+		if err != nil {
+			return nil, err
+		}
 	}
 	pubkey.Length = length
 	return pubkey, nil
@@ -226,6 +301,14 @@ type OpaqueKeyReader struct {
 	maxKeyLen    int
 	maxPacketLen int
 	blacklist    map[string]bool
+	dropUATs     bool
+	dropPhotos   bool
+	maxUATLen    int
+	knownDigest  func(rfp string) (string, bool)
+	keyBudget    time.Duration
+	report       func(PolicyChange)
+
+	verifySelfSigs bool
 }
 
 type KeyReaderOption func(*OpaqueKeyReader) error
@@ -264,6 +347,104 @@ func Blacklist(blacklist []string) KeyReaderOption {
 	}
 }
 
+// DropUserAttributes discards all user attribute packets and their
+// signatures from keys as they are read.
+func DropUserAttributes() KeyReaderOption {
+	return func(or *OpaqueKeyReader) error {
+		or.dropUATs = true
+		return nil
+	}
+}
+
+// DropPhotos discards user attribute packets containing images, along with
+// their signatures, from keys as they are read.
+func DropPhotos() KeyReaderOption {
+	return func(or *OpaqueKeyReader) error {
+		or.dropPhotos = true
+		return nil
+	}
+}
+
+// MaxUserAttributeLen discards user attribute packets longer than
+// maxUATLen, along with their signatures, from keys as they are read. Large
+// photo IDs are otherwise a cheap way to bloat the database.
+func MaxUserAttributeLen(maxUATLen int) KeyReaderOption {
+	return func(or *OpaqueKeyReader) error {
+		or.maxUATLen = maxUATLen
+		return nil
+	}
+}
+
+// VerifySelfSigs verifies the self-signatures of keys as they are read,
+// discarding those which fail and the components left without any, as
+// DropUnverified does.
+func VerifySelfSigs() KeyReaderOption {
+	return func(or *OpaqueKeyReader) error {
+		or.verifySelfSigs = true
+		return nil
+	}
+}
+
+// KnownDigest takes the digests of keys as they are read from knownDigest,
+// by reversed fingerprint, rather than calculating them again. It is for
+// keys read back from storage, whose digests were calculated when they were
+// written. Keys which other options alter as they are read are still
+// digested.
+func KnownDigest(knownDigest func(rfp string) (string, bool)) KeyReaderOption {
+	return func(or *OpaqueKeyReader) error {
+		or.knownDigest = knownDigest
+		return nil
+	}
+}
+
+// dropUserAttribute returns the policy by which the given user attribute
+// packet should be discarded, or an empty string if it should be kept.
+func (r *OpaqueKeyReader) dropUserAttribute(op *packet.OpaquePacket) string {
+	if r.dropUATs {
+		return PolicyDropUATs
+	}
+	if r.maxUATLen > 0 && len(op.Contents) > r.maxUATLen {
+		return PolicyMaxUserAttributeLength
+	}
+	if !r.dropPhotos {
+		return ""
+	}
+	p, err := op.Parse()
+	if err != nil {
+		return ""
+	}
+	if uat, ok := p.(*packet.UserAttribute); ok && len(uat.ImageData()) > 0 {
+		return PolicyDropPhotos
+	}
+	return ""
+}
+
+// FilterUserAttributes discards the user attributes of key which options
+// would have discarded as it was read. Keys stored before the options were
+// configured are filtered this way when updates are merged into them, so that
+// the merged key is the same as if it had been read with the options.
+func FilterUserAttributes(key *PrimaryKey, options ...KeyReaderOption) error {
+	okr, err := NewOpaqueKeyReader(nil, options...)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	var uats []*UserAttribute
+	for _, uat := range key.UserAttributes {
+		op, err := newOpaquePacket(uat.Packet.Packet)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if okr.dropUserAttribute(op) == "" {
+			uats = append(uats, uat)
+		}
+	}
+	if len(uats) == len(key.UserAttributes) {
+		return nil
+	}
+	key.UserAttributes = uats
+	return key.updateMD5()
+}
+
 func (r *OpaqueKeyReader) Read() ([]*OpaqueKeyring, error) {
 	or := packet.NewOpaqueReader(r.r)
 	var op *packet.OpaquePacket
@@ -272,18 +453,55 @@ func (r *OpaqueKeyReader) Read() ([]*OpaqueKeyring, error) {
 	var current *OpaqueKeyring
 	var currentKeyLen int
 	var currentFingerprint string
+	// dropping is set while skipping a filtered user attribute and the
+	// signatures which follow it.
+	var dropping bool
 PARSE:
 	for op, err = or.Next(); err == nil; op, err = or.Next() {
 		packetLen := len(op.Contents)
 		if r.maxPacketLen > 0 {
 			if packetLen > r.maxPacketLen {
-				log.WithFields(log.Fields{
+				logger.WithFields(log.Fields{
 					"length": packetLen,
 					"max":    r.maxPacketLen,
 				}).Warn("dropped packet")
+				if current != nil {
+					current.altered = true
+				}
+				r.reportChange(PolicyChange{
+					Fingerprint: currentFingerprint,
+					Policy:      PolicyMaxPacketLength,
+					Dropped:     "packet",
+					Count:       1,
+					Detail:      fmt.Sprintf("%d bytes exceeds the limit of %d", packetLen, r.maxPacketLen),
+				})
 				continue
 			}
 		}
+		if op.Tag == 2 && dropping { //packet.PacketTypeSignature
+			continue
+		}
+		var policy string
+		if op.Tag == 17 { //packet.PacketTypeUserAttribute
+			policy = r.dropUserAttribute(op)
+		}
+		dropping = policy != ""
+		if dropping {
+			if current != nil {
+				current.altered = true
+			}
+			change := PolicyChange{
+				Fingerprint: currentFingerprint,
+				Policy:      policy,
+				Dropped:     "user attribute",
+				Count:       1,
+			}
+			if policy == PolicyMaxUserAttributeLength {
+				change.Detail = fmt.Sprintf("%d bytes exceeds the limit of %d", packetLen, r.maxUATLen)
+			}
+			r.reportChange(change)
+			continue
+		}
 		switch op.Tag {
 		case 6: //packet.PacketTypePublicKey:
 			if current != nil {
@@ -300,13 +518,19 @@ PARSE:
 			fp := pubkey.Fingerprint()
 			if len(r.blacklist) > 0 {
 				if r.blacklist[fp] {
-					log.WithFields(log.Fields{
+					logger.WithFields(log.Fields{
 						"fp": fp,
 					}).Warn("blacklisted key")
+					r.reportChange(PolicyChange{
+						Fingerprint: fp,
+						Policy:      PolicyBlacklist,
+						Dropped:     "key",
+						Count:       1,
+					})
 					continue PARSE
 				}
 			}
-			current = &OpaqueKeyring{}
+			current = &OpaqueKeyring{RFingerprint: Reverse(fp)}
 			current.setPosition(r.r)
 			currentKeyLen = 0
 			currentFingerprint = fp
@@ -323,11 +547,18 @@ PARSE:
 		if current != nil {
 			currentKeyLen += packetLen
 			if r.maxKeyLen > 0 && currentKeyLen > r.maxKeyLen {
-				log.WithFields(log.Fields{
+				logger.WithFields(log.Fields{
 					"length": currentKeyLen,
 					"max":    r.maxKeyLen,
 					"fp":     currentFingerprint,
 				}).Warn("dropped key, max length exceeded")
+				r.reportChange(PolicyChange{
+					Fingerprint: currentFingerprint,
+					Policy:      PolicyMaxKeyLength,
+					Dropped:     "key",
+					Count:       1,
+					Detail:      fmt.Sprintf("exceeds the limit of %d bytes", r.maxKeyLen),
+				})
 				current = nil
 				currentKeyLen = 0
 				currentFingerprint = ""
@@ -360,29 +591,57 @@ func MustReadOpaqueKeys(r io.Reader, options ...KeyReaderOption) []*OpaqueKeyrin
 // a given primary public key, using the same ordering as SKS, the
 // Synchronizing Key Server. Use MD5 for matching digest values with SKS.
 func SksDigest(key *PrimaryKey, h hash.Hash) (string, error) {
-	var fail string
+	err := SksCanonical(h, key)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// SksCanonical writes the packets of key to w exactly as SKS digests them:
+// sorted by tag and then by contents, each written as its tag and the
+// length of its contents, as 32-bit big-endian integers, followed by the
+// contents. The order in which the packets were read, and the packet header
+// format, make no difference. SksDigest hashes this canonical form, so
+// keyservers whose digests of a key disagree can compare it to find the
+// packets which differ.
+func SksCanonical(w io.Writer, key *PrimaryKey) error {
 	var packets opaquePacketSlice
 	for _, node := range key.contents() {
 		op, err := newOpaquePacket(node.packet().Packet)
 		if err != nil {
-			return fail, errors.WithStack(err)
+			return errors.WithStack(err)
 		}
 		packets = append(packets, op)
 	}
 	if len(packets) == 0 {
-		return fail, errors.New("no packets found")
+		return errors.New("no packets found")
 	}
-	return sksDigestOpaque(packets, h), nil
+	return errors.WithStack(writeSksCanonical(w, packets))
 }
 
 func sksDigestOpaque(packets []*packet.OpaquePacket, h hash.Hash) string {
+	writeSksCanonical(h, packets)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func writeSksCanonical(w io.Writer, packets []*packet.OpaquePacket) error {
 	sort.Sort(opaquePacketSlice(packets))
 	for _, opkt := range packets {
-		binary.Write(h, binary.BigEndian, int32(opkt.Tag))
-		binary.Write(h, binary.BigEndian, int32(len(opkt.Contents)))
-		h.Write(opkt.Contents)
+		err := binary.Write(w, binary.BigEndian, int32(opkt.Tag))
+		if err != nil {
+			return err
+		}
+		err = binary.Write(w, binary.BigEndian, int32(len(opkt.Contents)))
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(opkt.Contents)
+		if err != nil {
+			return err
+		}
 	}
-	return hex.EncodeToString(h.Sum(nil))
+	return nil
 }
 
 type KeyReader struct {
@@ -395,10 +654,16 @@ func NewKeyReader(r io.Reader, options ...KeyReaderOption) *KeyReader {
 }
 
 func (r *KeyReader) Read() ([]*PrimaryKey, error) {
-	return r.readKeys()
+	return r.readKeys(context.Background())
 }
 
-func (r *KeyReader) readKeys() ([]*PrimaryKey, error) {
+// ReadContext reads keys as Read does, failing if ctx is done before they
+// are parsed.
+func (r *KeyReader) ReadContext(ctx context.Context) ([]*PrimaryKey, error) {
+	return r.readKeys(ctx)
+}
+
+func (r *KeyReader) readKeys(ctx context.Context) ([]*PrimaryKey, error) {
 	okr, err := NewOpaqueKeyReader(r.r, r.options...)
 	if err != nil {
 		return nil, err
@@ -409,7 +674,7 @@ func (r *KeyReader) readKeys() ([]*PrimaryKey, error) {
 	}
 	result := make([]*PrimaryKey, len(opkrs))
 	for i := range opkrs {
-		result[i], err = opkrs[i].Parse()
+		result[i], err = okr.parse(ctx, opkrs[i])
 		if err != nil {
 			return nil, err
 		}
@@ -417,6 +682,32 @@ func (r *KeyReader) readKeys() ([]*PrimaryKey, error) {
 	return result, nil
 }
 
+// parse parses a keyring, and verifies its self-signatures if the reader
+// does so, within the key budget.
+func (okr *OpaqueKeyReader) parse(ctx context.Context, opkr *OpaqueKeyring) (*PrimaryKey, error) {
+	if okr.keyBudget > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, okr.keyBudget)
+		defer cancel()
+	}
+	key, err := opkr.parse(ctx, okr.knownDigest)
+	if err == nil && okr.verifySelfSigs {
+		var changes []PolicyChange
+		changes, err = ApplyPolicy(key, PolicyVerifySelfSigs, func(key *PrimaryKey) error {
+			return DropUnverifiedContext(ctx, key)
+		})
+		for _, change := range changes {
+			okr.reportChange(change)
+		}
+	}
+	if errors.Is(err, ErrBudgetExceeded) {
+		return nil, errors.Wrapf(err, "key %s", Reverse(opkr.RFingerprint))
+	} else if err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
 func MustReadKeys(r io.Reader, options ...KeyReaderOption) []*PrimaryKey {
 	kr := NewKeyReader(r, options...)
 	keys, err := kr.Read()
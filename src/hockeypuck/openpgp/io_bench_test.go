@@ -0,0 +1,60 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package openpgp
+
+import (
+	"io/ioutil"
+	stdtesting "testing"
+)
+
+// poisonedKey returns weasel.asc flooded with copies of its certifications
+// until its packets exceed size bytes, like the keys poisoned by
+// certificate flooding.
+func poisonedKey(size int) *PrimaryKey {
+	key := MustInputAscKey("weasel.asc")
+	uid := key.UserIDs[0]
+	certs := uid.Signatures
+	for key.Length < size {
+		for _, sig := range certs {
+			uid.Signatures = append(uid.Signatures, sig)
+			key.Length += len(sig.Packet.Packet)
+		}
+	}
+	return key
+}
+
+func benchmarkWriteArmoredPackets(b *stdtesting.B, key *PrimaryKey) {
+	b.SetBytes(int64(key.Length))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		err := WriteArmoredPackets(ioutil.Discard, []*PrimaryKey{key}, ArmorHeaderComment("benchmark"))
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkWriteArmoredPackets(b *stdtesting.B) {
+	b.Run("weasel", func(b *stdtesting.B) {
+		benchmarkWriteArmoredPackets(b, MustInputAscKey("weasel.asc"))
+	})
+	b.Run("poisoned", func(b *stdtesting.B) {
+		benchmarkWriteArmoredPackets(b, poisonedKey(8*1024*1024))
+	})
+}
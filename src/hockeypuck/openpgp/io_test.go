@@ -49,6 +49,77 @@ func (s *SamplePacketSuite) TestVerifyUserAttributeSig(c *gc.C) {
 	// TODO: check contents
 }
 
+func (s *SamplePacketSuite) TestDropUserAttributes(c *gc.C) {
+	for _, opt := range []KeyReaderOption{DropUserAttributes(), DropPhotos()} {
+		keys, err := ReadArmorKeys(testing.MustInput("uat.asc"), opt)
+		c.Assert(err, gc.IsNil)
+		c.Assert(keys, gc.HasLen, 1)
+		key := keys[0]
+		c.Assert(key.UserAttributes, gc.HasLen, 0)
+		c.Assert(key.UserIDs, gc.Not(gc.HasLen), 0)
+
+		// The digest must match that of the same key with its user
+		// attributes removed after parsing, as another server applying the
+		// same filter would calculate.
+		expect := MustInputAscKey("uat.asc")
+		expect.UserAttributes = nil
+		c.Assert(expect.updateMD5(), gc.IsNil)
+		c.Assert(key.MD5, gc.Equals, expect.MD5)
+	}
+}
+
+func (s *SamplePacketSuite) TestMaxUserAttributeLen(c *gc.C) {
+	full := MustInputAscKey("uat.asc")
+	c.Assert(full.UserAttributes, gc.HasLen, 1)
+	uatLen := len(full.UserAttributes[0].Packet.Packet)
+
+	keys, err := ReadArmorKeys(testing.MustInput("uat.asc"), MaxUserAttributeLen(uatLen))
+	c.Assert(err, gc.IsNil)
+	c.Assert(keys[0].UserAttributes, gc.HasLen, 1)
+	c.Assert(keys[0].MD5, gc.Equals, full.MD5)
+
+	keys, err = ReadArmorKeys(testing.MustInput("uat.asc"), MaxUserAttributeLen(uatLen/2))
+	c.Assert(err, gc.IsNil)
+	c.Assert(keys[0].UserAttributes, gc.HasLen, 0)
+	c.Assert(keys[0].MD5, gc.Not(gc.Equals), full.MD5)
+
+	// Filtering a key already read gives the same key, so that merging
+	// into a key stored without the limit gives the same digest as peers
+	// which applied it on ingest.
+	err = FilterUserAttributes(full, MaxUserAttributeLen(uatLen))
+	c.Assert(err, gc.IsNil)
+	c.Assert(full.UserAttributes, gc.HasLen, 1)
+	err = FilterUserAttributes(full, MaxUserAttributeLen(uatLen/2))
+	c.Assert(err, gc.IsNil)
+	c.Assert(full.UserAttributes, gc.HasLen, 0)
+	c.Assert(full.MD5, gc.Equals, keys[0].MD5)
+}
+
+func (s *SamplePacketSuite) TestKnownDigest(c *gc.C) {
+	full := MustInputAscKey("uat.asc")
+	known := func(rfp string) (string, bool) {
+		if rfp == full.RFingerprint {
+			return "known", true
+		}
+		return "", false
+	}
+
+	keys, err := ReadArmorKeys(testing.MustInput("uat.asc"), KnownDigest(known))
+	c.Assert(err, gc.IsNil)
+	c.Assert(keys[0].MD5, gc.Equals, "known")
+
+	// Keys altered as they are read are digested again.
+	keys, err = ReadArmorKeys(testing.MustInput("uat.asc"), KnownDigest(known), DropUserAttributes())
+	c.Assert(err, gc.IsNil)
+	c.Assert(keys[0].UserAttributes, gc.HasLen, 0)
+	c.Assert(keys[0].MD5, gc.Not(gc.Equals), "known")
+	c.Assert(keys[0].MD5, gc.Not(gc.Equals), full.MD5)
+
+	keys, err = ReadArmorKeys(testing.MustInput("uat.asc"), KnownDigest(func(string) (string, bool) { return "", false }))
+	c.Assert(err, gc.IsNil)
+	c.Assert(keys[0].MD5, gc.Equals, full.MD5)
+}
+
 func (s *SamplePacketSuite) TestSksDigest(c *gc.C) {
 	key := MustInputAscKey("sksdigest.asc")
 	md5, err := SksDigest(key, md5.New())
@@ -358,3 +429,72 @@ func (s *SamplePacketSuite) TestWriteArmorHeaders(c *gc.C) {
 	c.Assert(strings.Contains(b.String(), "Comment: HKP\n"), gc.Equals, true)
 	c.Assert(strings.Contains(b.String(), "Version: Hockeypuck 2.1.0\n"), gc.Equals, true)
 }
+
+func (s *SamplePacketSuite) TestArmorEncoder(c *gc.C) {
+	headers := map[string]string{"Comment": "HKP"}
+	data := make([]byte, 1000)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	for _, n := range []int{0, 1, 47, 48, 49, 96, 100, 1000} {
+		var expect, got bytes.Buffer
+		w, err := armor.Encode(&expect, "PGP PUBLIC KEY BLOCK", headers)
+		c.Assert(err, gc.IsNil)
+		_, err = w.Write(data[:n])
+		c.Assert(err, gc.IsNil)
+		c.Assert(w.Close(), gc.IsNil)
+
+		e, err := newArmorEncoder(&got, "PGP PUBLIC KEY BLOCK", headers)
+		c.Assert(err, gc.IsNil)
+		// Write in uneven pieces, to cross line boundaries.
+		for i := 0; i < n; i += 13 {
+			end := i + 13
+			if end > n {
+				end = n
+			}
+			_, err = e.Write(data[i:end])
+			c.Assert(err, gc.IsNil)
+		}
+		c.Assert(e.Close(), gc.IsNil)
+		c.Assert(got.String(), gc.Equals, expect.String(), gc.Commentf("%d bytes", n))
+	}
+}
+
+func (s *SamplePacketSuite) TestWriteArmoredPacketsUnchanged(c *gc.C) {
+	key := MustInputAscKey("weasel.asc")
+	var expect bytes.Buffer
+	w, err := armor.Encode(&expect, "PGP PUBLIC KEY BLOCK", nil)
+	c.Assert(err, gc.IsNil)
+	for _, node := range key.contents() {
+		op, err := newOpaquePacket(node.packet().Packet)
+		c.Assert(err, gc.IsNil)
+		c.Assert(op.Serialize(w), gc.IsNil)
+	}
+	c.Assert(w.Close(), gc.IsNil)
+
+	var got bytes.Buffer
+	err = WriteArmoredPackets(&got, []*PrimaryKey{key})
+	c.Assert(err, gc.IsNil)
+	c.Assert(got.String(), gc.Equals, expect.String())
+}
+
+func (s *SamplePacketSuite) TestSerialized(c *gc.C) {
+	long := make([]byte, 6+8384)
+	copy(long, []byte{0xc2, 0xff, 0, 0, 0x20, 0xc0})
+	for _, t := range []struct {
+		buf  []byte
+		want bool
+	}{
+		{[]byte{0xcd, 0x01, 'a'}, true},
+		{[]byte{0xcd, 0x02, 'a'}, false},
+		// Old format header.
+		{[]byte{0xb4, 0x01, 'a'}, false},
+		// Five octet length which fits in one.
+		{[]byte{0xcd, 0xff, 0, 0, 0, 1, 'a'}, false},
+		// Partial body length.
+		{[]byte{0xcd, 0xe0, 'a'}, false},
+		{long, true},
+	} {
+		c.Check(serialized(t.buf), gc.Equals, t.want, gc.Commentf("% x", t.buf[:3]))
+	}
+}
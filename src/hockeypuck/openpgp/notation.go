@@ -0,0 +1,99 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package openpgp
+
+import (
+	"encoding/binary"
+
+	"github.com/pkg/errors"
+)
+
+// Notation names of identity proofs, which link a key to accounts elsewhere.
+// The value of each is a URI of a resource containing the key's fingerprint.
+const (
+	NotationProof       = "proof@ariadne.id"
+	NotationProofLegacy = "proof@metacode.biz"
+)
+
+// Notation is a notation data subpacket of a signature.
+type Notation struct {
+	Name          string
+	Value         string
+	HumanReadable bool
+}
+
+const (
+	subpacketNotationData = 20
+	notationHumanReadable = 0x80
+)
+
+// Notations returns the notations in the hashed area of a version 4
+// signature. Notations in the unhashed area are not covered by the
+// signature, so anyone could have added them, and are ignored.
+func (sig *Signature) Notations() ([]Notation, error) {
+	op, err := sig.opaquePacket()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	subpackets, err := hashedSubpackets(op.Contents)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	var result []Notation
+	for _, sp := range subpackets {
+		if sp.body[0]&^subpacketCritical != subpacketNotationData {
+			continue
+		}
+		data := sp.body[1:]
+		if len(data) < 8 {
+			return nil, errors.New("truncated notation")
+		}
+		nameLen := int(binary.BigEndian.Uint16(data[4:6]))
+		valueLen := int(binary.BigEndian.Uint16(data[6:8]))
+		if len(data) < 8+nameLen+valueLen {
+			return nil, errors.New("truncated notation")
+		}
+		result = append(result, Notation{
+			Name:          string(data[8 : 8+nameLen]),
+			Value:         string(data[8+nameLen : 8+nameLen+valueLen]),
+			HumanReadable: data[0]&notationHumanReadable != 0,
+		})
+	}
+	return result, nil
+}
+
+// Proofs returns the identity proof URIs in the latest valid
+// self-certification of the user ID.
+func (uid *UserID) Proofs(pubkey *PrimaryKey) []string {
+	selfSigs, _ := uid.SigInfo(pubkey)
+	if len(selfSigs.Certifications) == 0 {
+		return nil
+	}
+	notations, err := selfSigs.Certifications[0].Signature.Notations()
+	if err != nil {
+		return nil
+	}
+	var result []string
+	for _, n := range notations {
+		if n.Name == NotationProof || n.Name == NotationProofLegacy {
+			result = append(result, n.Value)
+		}
+	}
+	return result
+}
@@ -0,0 +1,161 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package openpgp
+
+import (
+	"bytes"
+	"math/rand"
+	"reflect"
+	"testing/quick"
+
+	"golang.org/x/crypto/openpgp/armor"
+	"golang.org/x/crypto/openpgp/packet"
+	gc "gopkg.in/check.v1"
+
+	"hockeypuck/testing"
+)
+
+// MergePropertySuite checks that merging revisions of a key behaves as a set
+// union: idempotent, commutative and associative, with a result that does
+// not depend on how the revisions were combined.
+type MergePropertySuite struct{}
+
+var _ = gc.Suite(&MergePropertySuite{})
+
+var quickConfig = &quick.Config{MaxCount: 100}
+
+// revisionPackets are the packets of the key from which revisions are
+// generated.
+var revisionPackets []*packet.OpaquePacket
+
+func (s *MergePropertySuite) SetUpSuite(c *gc.C) {
+	// A key with user IDs, a user attribute, subkeys and certifications.
+	f := testing.MustInput("uat.asc")
+	defer f.Close()
+	block, err := armor.Decode(f)
+	c.Assert(err, gc.IsNil)
+	keyrings := MustReadOpaqueKeys(block.Body)
+	c.Assert(keyrings, gc.HasLen, 1)
+	revisionPackets = keyrings[0].Packets
+}
+
+// revision selects a subset of revisionPackets, as a keyserver might have
+// seen the key at some point: the primary key, some of its user IDs, user
+// attributes and subkeys, and some of the signatures on each.
+type revision []bool
+
+func (revision) Generate(r *rand.Rand, size int) reflect.Value {
+	rev := make(revision, len(revisionPackets))
+	keepGroup := true
+	for i, op := range revisionPackets {
+		switch op.Tag {
+		case 6:
+			keepGroup = true
+			rev[i] = true
+		case 2:
+			rev[i] = keepGroup && r.Intn(10) < 7
+		default:
+			keepGroup = r.Intn(10) < 7
+			rev[i] = keepGroup
+		}
+	}
+	return reflect.ValueOf(rev)
+}
+
+func (rev revision) union(other revision) revision {
+	result := make(revision, len(rev))
+	for i := range rev {
+		result[i] = rev[i] || other[i]
+	}
+	return result
+}
+
+// key parses a fresh copy of the revision, since merging modifies keys.
+func (rev revision) key() *PrimaryKey {
+	var okr OpaqueKeyring
+	for i, op := range revisionPackets {
+		if rev[i] {
+			okr.Packets = append(okr.Packets, op)
+		}
+	}
+	key, err := okr.Parse()
+	if err != nil {
+		panic(err)
+	}
+	return key
+}
+
+func merged(keys ...*PrimaryKey) *PrimaryKey {
+	for _, key := range keys[1:] {
+		err := Merge(keys[0], key)
+		if err != nil {
+			panic(err)
+		}
+	}
+	return keys[0]
+}
+
+func (s *MergePropertySuite) TestIdempotent(c *gc.C) {
+	idempotent := func(a revision) bool {
+		return merged(a.key(), a.key()).MD5 == a.key().MD5
+	}
+	c.Assert(quick.Check(idempotent, quickConfig), gc.IsNil)
+}
+
+func (s *MergePropertySuite) TestCommutative(c *gc.C) {
+	commutative := func(a, b revision) bool {
+		return merged(a.key(), b.key()).MD5 == merged(b.key(), a.key()).MD5
+	}
+	c.Assert(quick.Check(commutative, quickConfig), gc.IsNil)
+}
+
+func (s *MergePropertySuite) TestAssociative(c *gc.C) {
+	associative := func(a, b, d revision) bool {
+		lhs := merged(merged(a.key(), b.key()), d.key())
+		rhs := merged(a.key(), merged(b.key(), d.key()))
+		return lhs.MD5 == rhs.MD5
+	}
+	c.Assert(quick.Check(associative, quickConfig), gc.IsNil)
+}
+
+func (s *MergePropertySuite) TestUnion(c *gc.C) {
+	// Merging revisions gives the same key as one parsed from the union of
+	// their packets.
+	union := func(a, b revision) bool {
+		return merged(a.key(), b.key()).MD5 == a.union(b).key().MD5
+	}
+	c.Assert(quick.Check(union, quickConfig), gc.IsNil)
+}
+
+func (s *MergePropertySuite) TestRoundTrip(c *gc.C) {
+	// A merged key serializes to packets which parse back to the same key.
+	roundTrip := func(a, b revision) bool {
+		key := merged(a.key(), b.key())
+		var buf bytes.Buffer
+		err := WritePackets(&buf, key)
+		if err != nil {
+			return false
+		}
+		keys, err := NewKeyReader(&buf).Read()
+		if err != nil || len(keys) != 1 {
+			return false
+		}
+		return keys[0].MD5 == key.MD5
+	}
+	c.Assert(quick.Check(roundTrip, quickConfig), gc.IsNil)
+}
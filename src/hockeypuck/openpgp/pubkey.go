@@ -329,6 +329,46 @@ func (pubkey *PrimaryKey) SigInfo() (*SelfSigs, []*Signature) {
 	return selfSigs, otherSigs
 }
 
+// ExpiresAt returns when the key expires and true, or false if it does not
+// expire. The expiration of a version 4 key is taken from the self-signatures
+// of its first self-certified user ID, which is the primary user ID once the
+// key is sorted.
+func (pubkey *PrimaryKey) ExpiresAt() (time.Time, bool) {
+	if !pubkey.Expiration.IsZero() {
+		return pubkey.Expiration, true
+	}
+	for _, uid := range pubkey.UserIDs {
+		selfSigs, _ := uid.SigInfo(pubkey)
+		if len(selfSigs.Certifications) == 0 {
+			continue
+		}
+		return selfSigs.ExpiresAt()
+	}
+	return zeroTime, false
+}
+
+// Revoked returns whether the key has a valid revocation self-signature.
+func (pubkey *PrimaryKey) Revoked() bool {
+	selfSigs, _ := pubkey.SigInfo()
+	return len(selfSigs.Revocations) > 0
+}
+
+// Expired returns whether the key has expired.
+func (pubkey *PrimaryKey) Expired() bool {
+	expiresAt, ok := pubkey.ExpiresAt()
+	return ok && !expiresAt.After(clk.Now())
+}
+
+// SerializedLength returns the length of the key's packets as they are
+// stored, which is how long they are when written by WritePackets.
+func (pubkey *PrimaryKey) SerializedLength() int {
+	var length int
+	for _, node := range pubkey.contents() {
+		length += len(node.packet().Packet)
+	}
+	return length
+}
+
 func (pubkey *PrimaryKey) updateMD5() error {
 	digest, err := SksDigest(pubkey, md5.New())
 	if err != nil {
@@ -0,0 +1,114 @@
+package openpgp
+
+// Ingest policies which may drop or alter keys as they are read, as named
+// in a PolicyChange. Those configured as ingest filters share their filter
+// names.
+const (
+	PolicyMaxKeyLength           = "maxKeyLength"
+	PolicyMaxPacketLength        = "maxPacketLength"
+	PolicyMaxUserAttributeLength = "maxUserAttributeLength"
+	PolicyBlacklist              = "blacklist"
+	PolicyDropUATs               = FilterDropUATs
+	PolicyDropPhotos             = FilterDropPhotos
+	PolicyVerifySelfSigs         = FilterVerifySelfSigs
+)
+
+// PolicyChange describes what ingest policy dropped from a key, so that
+// whoever submitted it can tell why the key served differs from the key
+// they sent.
+type PolicyChange struct {
+	// Fingerprint is that of the key changed. It is empty for packets
+	// dropped before any key was read.
+	Fingerprint string `json:"fingerprint,omitempty"`
+
+	// Policy names the policy which made the change.
+	Policy string `json:"policy"`
+
+	// Dropped is what was dropped: the whole "key", or some number of its
+	// "packet", "user ID", "user attribute", "subkey" or "signature"
+	// components. Handlers may report other changes, such as secret key
+	// material stripped from a submission.
+	Dropped string `json:"dropped"`
+
+	// Count is the number of components dropped.
+	Count int `json:"count"`
+
+	// Detail explains the change, such as the limit which was exceeded.
+	Detail string `json:"detail,omitempty"`
+}
+
+// ReportChanges calls report with each change ingest policy makes to keys as
+// they are read.
+func ReportChanges(report func(PolicyChange)) KeyReaderOption {
+	return func(or *OpaqueKeyReader) error {
+		or.report = report
+		return nil
+	}
+}
+
+func (r *OpaqueKeyReader) reportChange(change PolicyChange) {
+	if r.report != nil {
+		r.report(change)
+	}
+}
+
+// ApplyPolicy applies the named policy to key with apply, returning the
+// changes it made by dropping components of the key.
+func ApplyPolicy(key *PrimaryKey, policy string, apply func(*PrimaryKey) error) ([]PolicyChange, error) {
+	before := countComponents(key)
+	err := apply(key)
+	if err != nil {
+		return nil, err
+	}
+	return before.dropped(key.Fingerprint(), policy, countComponents(key)), nil
+}
+
+// componentCounts counts the components of a key which policy may drop.
+type componentCounts struct {
+	userIDs        int
+	userAttributes int
+	subKeys        int
+	signatures     int
+}
+
+func countComponents(key *PrimaryKey) componentCounts {
+	var c componentCounts
+	for _, node := range key.contents() {
+		switch node.(type) {
+		case *UserID:
+			c.userIDs++
+		case *UserAttribute:
+			c.userAttributes++
+		case *SubKey:
+			c.subKeys++
+		case *Signature:
+			c.signatures++
+		}
+	}
+	return c
+}
+
+// dropped returns the changes made by policy, in going from the counts c
+// to after.
+func (c componentCounts) dropped(fp, policy string, after componentCounts) []PolicyChange {
+	var changes []PolicyChange
+	for _, d := range []struct {
+		what          string
+		before, after int
+	}{
+		{"user ID", c.userIDs, after.userIDs},
+		{"user attribute", c.userAttributes, after.userAttributes},
+		{"subkey", c.subKeys, after.subKeys},
+		{"signature", c.signatures, after.signatures},
+	} {
+		if d.before > d.after {
+			changes = append(changes, PolicyChange{
+				Fingerprint: fp,
+				Policy:      policy,
+				Dropped:     d.what,
+				Count:       d.before - d.after,
+			})
+		}
+	}
+	return changes
+}
@@ -0,0 +1,89 @@
+package openpgp
+
+import (
+	gc "gopkg.in/check.v1"
+
+	"hockeypuck/testing"
+)
+
+func (s *SamplePacketSuite) TestReportChanges(c *gc.C) {
+	const fp = "81279eee7ec89fb781702adaf79362da44a2d1db"
+	read := func(opts ...KeyReaderOption) ([]*PrimaryKey, []PolicyChange) {
+		var changes []PolicyChange
+		opts = append(opts, ReportChanges(func(change PolicyChange) {
+			changes = append(changes, change)
+		}))
+		keys, err := ReadArmorKeys(testing.MustInput("uat.asc"), opts...)
+		c.Assert(err, gc.IsNil)
+		return keys, changes
+	}
+
+	keys, changes := read()
+	c.Assert(keys, gc.HasLen, 1)
+	c.Assert(changes, gc.HasLen, 0)
+
+	keys, changes = read(Blacklist([]string{fp}))
+	c.Assert(keys, gc.HasLen, 0)
+	c.Assert(changes, gc.DeepEquals, []PolicyChange{{
+		Fingerprint: fp, Policy: PolicyBlacklist, Dropped: "key", Count: 1,
+	}})
+
+	keys, changes = read(MaxKeyLen(2048))
+	c.Assert(keys, gc.HasLen, 0)
+	c.Assert(changes, gc.HasLen, 1)
+	c.Assert(changes[0].Policy, gc.Equals, PolicyMaxKeyLength)
+	c.Assert(changes[0].Dropped, gc.Equals, "key")
+	c.Assert(changes[0].Fingerprint, gc.Equals, fp)
+
+	keys, changes = read(MaxPacketLen(2048))
+	c.Assert(keys, gc.HasLen, 1)
+	c.Assert(changes, gc.HasLen, 1)
+	c.Assert(changes[0].Policy, gc.Equals, PolicyMaxPacketLength)
+	c.Assert(changes[0].Dropped, gc.Equals, "packet")
+	c.Assert(changes[0].Fingerprint, gc.Equals, fp)
+	c.Assert(changes[0].Detail, gc.Matches, `\d+ bytes exceeds the limit of 2048`)
+
+	for _, t := range []struct {
+		opt    KeyReaderOption
+		policy string
+	}{
+		{DropUserAttributes(), PolicyDropUATs},
+		{DropPhotos(), PolicyDropPhotos},
+		{MaxUserAttributeLen(16), PolicyMaxUserAttributeLength},
+	} {
+		keys, changes = read(t.opt)
+		c.Assert(keys, gc.HasLen, 1)
+		c.Assert(keys[0].UserAttributes, gc.HasLen, 0)
+		c.Assert(changes, gc.HasLen, 1)
+		c.Assert(changes[0], gc.Equals, PolicyChange{
+			Fingerprint: fp, Policy: t.policy, Dropped: "user attribute", Count: 1, Detail: changes[0].Detail,
+		})
+	}
+}
+
+func (s *SamplePacketSuite) TestApplyPolicy(c *gc.C) {
+	key := MustInputAscKey("alice_signed.asc")
+	var thirdParty int
+	for _, uid := range key.UserIDs {
+		for _, sig := range uid.Signatures {
+			if sig.RIssuerKeyID != key.RKeyID {
+				thirdParty++
+			}
+		}
+	}
+	c.Assert(thirdParty > 0, gc.Equals, true)
+
+	changes, err := ApplyPolicy(key, "self-signed", func(key *PrimaryKey) error {
+		return ValidSelfSigned(key, true)
+	})
+	c.Assert(err, gc.IsNil)
+	c.Assert(changes, gc.DeepEquals, []PolicyChange{{
+		Fingerprint: key.Fingerprint(), Policy: "self-signed", Dropped: "signature", Count: thirdParty,
+	}})
+
+	changes, err = ApplyPolicy(key, "self-signed", func(key *PrimaryKey) error {
+		return ValidSelfSigned(key, true)
+	})
+	c.Assert(err, gc.IsNil)
+	c.Assert(changes, gc.HasLen, 0)
+}
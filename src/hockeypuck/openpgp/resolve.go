@@ -18,18 +18,31 @@
 package openpgp
 
 import (
+	"context"
 	"crypto/md5"
 	"encoding/hex"
+	"strings"
+	"time"
 
 	"github.com/pkg/errors"
 )
 
 func ValidSelfSigned(key *PrimaryKey, selfSignedOnly bool) error {
+	return ValidSelfSignedContext(context.Background(), key, selfSignedOnly)
+}
+
+// ValidSelfSignedContext drops components without a valid self-signature as
+// ValidSelfSigned does, failing if ctx is done before their signatures are
+// verified.
+func ValidSelfSignedContext(ctx context.Context, key *PrimaryKey, selfSignedOnly bool) error {
 	var userIDs []*UserID
 	var userAttributes []*UserAttribute
 	var subKeys []*SubKey
 	for _, uid := range key.UserIDs {
-		ss, others := uid.SigInfo(key)
+		ss, others, err := uid.sigInfo(ctx, key)
+		if err != nil {
+			return err
+		}
 		var certs []*Signature
 		for _, cert := range ss.Certifications {
 			if cert.Error == nil {
@@ -39,13 +52,17 @@ func ValidSelfSigned(key *PrimaryKey, selfSignedOnly bool) error {
 		if len(certs) > 0 {
 			uid.Signatures = certs
 			if !selfSignedOnly {
+				uid.Signatures = append(uid.Signatures, attestations(ss)...)
 				uid.Signatures = append(uid.Signatures, others...)
 			}
 			userIDs = append(userIDs, uid)
 		}
 	}
 	for _, uat := range key.UserAttributes {
-		ss, others := uat.SigInfo(key)
+		ss, others, err := uat.sigInfo(ctx, key)
+		if err != nil {
+			return err
+		}
 		var certs []*Signature
 		for _, cert := range ss.Certifications {
 			if cert.Error == nil {
@@ -55,13 +72,17 @@ func ValidSelfSigned(key *PrimaryKey, selfSignedOnly bool) error {
 		if len(certs) > 0 {
 			uat.Signatures = certs
 			if !selfSignedOnly {
+				uat.Signatures = append(uat.Signatures, attestations(ss)...)
 				uat.Signatures = append(uat.Signatures, others...)
 			}
 			userAttributes = append(userAttributes, uat)
 		}
 	}
 	for _, subKey := range key.SubKeys {
-		ss, others := subKey.SigInfo(key)
+		ss, others, err := subKey.sigInfo(ctx, key)
+		if err != nil {
+			return err
+		}
 		var certs []*Signature
 		for _, cert := range ss.Revocations {
 			if cert.Error == nil {
@@ -87,8 +108,269 @@ func ValidSelfSigned(key *PrimaryKey, selfSignedOnly bool) error {
 	return key.updateMD5()
 }
 
+// attestations returns the attestation signatures in ss, which are kept
+// along with the certifications by other keys they attest.
+func attestations(ss *SelfSigs) []*Signature {
+	var result []*Signature
+	for _, checkSig := range ss.Attestations {
+		result = append(result, checkSig.Signature)
+	}
+	return result
+}
+
+// DropUnverified removes self-signatures on user IDs, user attributes and
+// subkeys which fail verification, and the components left without any
+// self-signature. Unlike ValidSelfSigned, it keeps revocations, and the
+// revoked or expired components they apply to, and certifications made by
+// other keys.
+func DropUnverified(key *PrimaryKey) error {
+	return DropUnverifiedContext(context.Background(), key)
+}
+
+// DropUnverifiedContext drops unverified self-signatures as DropUnverified
+// does, failing if ctx is done before they are verified.
+func DropUnverifiedContext(ctx context.Context, key *PrimaryKey) error {
+	var err error
+	var userIDs []*UserID
+	for _, uid := range key.UserIDs {
+		var ok bool
+		uid.Signatures, ok, err = key.verifiedSelfSigs(ctx, uid.Signatures, func(sig *Signature) error {
+			return key.verifyUserIDSelfSig(uid, sig)
+		})
+		if err != nil {
+			return err
+		} else if ok {
+			userIDs = append(userIDs, uid)
+		}
+	}
+	var userAttributes []*UserAttribute
+	for _, uat := range key.UserAttributes {
+		var ok bool
+		uat.Signatures, ok, err = key.verifiedSelfSigs(ctx, uat.Signatures, func(sig *Signature) error {
+			return key.verifyUserAttrSelfSig(uat, sig)
+		})
+		if err != nil {
+			return err
+		} else if ok {
+			userAttributes = append(userAttributes, uat)
+		}
+	}
+	var subKeys []*SubKey
+	for _, subKey := range key.SubKeys {
+		var ok bool
+		subKey.Signatures, ok, err = key.verifiedSelfSigs(ctx, subKey.Signatures, func(sig *Signature) error {
+			return key.verifyPublicKeySelfSig(&subKey.PublicKey, sig)
+		})
+		if err != nil {
+			return err
+		} else if ok {
+			subKeys = append(subKeys, subKey)
+		}
+	}
+	key.UserIDs = userIDs
+	key.UserAttributes = userAttributes
+	key.SubKeys = subKeys
+	return key.updateMD5()
+}
+
+// verifiedSelfSigs returns sigs without the self-signatures which fail
+// verify, and whether any self-signatures remain. It fails if ctx is done
+// before they are verified.
+func (key *PrimaryKey) verifiedSelfSigs(ctx context.Context, sigs []*Signature, verify func(*Signature) error) ([]*Signature, bool, error) {
+	var result []*Signature
+	var verified bool
+	for _, sig := range sigs {
+		if strings.HasPrefix(key.UUID, sig.RIssuerKeyID) {
+			if err := checkBudget(ctx); err != nil {
+				return nil, false, err
+			}
+			if verify(sig) != nil {
+				continue
+			}
+			verified = true
+		}
+		result = append(result, sig)
+	}
+	return result, verified, nil
+}
+
+// Minimize reduces key to its self-signed user IDs for which keep returns
+// true, dropping user attributes and certifications made by other keys, as
+// for publishing a key for a single address. It returns whether any user IDs
+// remain.
+func Minimize(key *PrimaryKey, keep func(uid *UserID) bool) (bool, error) {
+	err := ValidSelfSigned(key, true)
+	if err != nil {
+		return false, errors.WithStack(err)
+	}
+	var userIDs []*UserID
+	for _, uid := range key.UserIDs {
+		if keep(uid) {
+			userIDs = append(userIDs, uid)
+		}
+	}
+	key.UserIDs = userIDs
+	key.UserAttributes = nil
+	return len(userIDs) > 0, key.updateMD5()
+}
+
+// Truncate reduces key to its primary key with its self-signatures, and its
+// self-signed user IDs and subkeys with only their latest binding or their
+// revocation. Revoked user IDs keep their revocations, so that clients learn
+// of them. Certifications by other keys, user attributes and unknown packets
+// are dropped. It is for serving a key too large to serve whole.
+func Truncate(key *PrimaryKey) error {
+	// ValidSelfSigned drops revoked user IDs, so they are put back after.
+	userIDs := key.UserIDs
+	revoked := map[*UserID][]*Signature{}
+	for _, uid := range userIDs {
+		ss, _ := uid.SigInfo(key)
+		if len(ss.Revocations) == 0 {
+			continue
+		}
+		var sigs []*Signature
+		for _, rev := range ss.Revocations {
+			sigs = append(sigs, rev.Signature)
+		}
+		if cert := latestUserIDCert(key, uid); cert != nil {
+			sigs = append(sigs, cert)
+		}
+		revoked[uid] = sigs
+	}
+	err := ValidSelfSigned(key, true)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	var sigs []*Signature
+	for _, sig := range key.Signatures {
+		if !strings.HasPrefix(key.UUID, sig.RIssuerKeyID) {
+			continue
+		}
+		if key.verifyPublicKeySelfSig(&key.PublicKey, sig) == nil {
+			sigs = append(sigs, sig)
+		}
+	}
+	key.Signatures = sigs
+	key.Others = nil
+	key.UserAttributes = nil
+	// ValidSelfSigned leaves the latest certification of each user ID, and
+	// the first revocation or else the latest binding of each subkey, first.
+	valid := map[*UserID]bool{}
+	for _, uid := range key.UserIDs {
+		valid[uid] = true
+	}
+	key.UserIDs = nil
+	for _, uid := range userIDs {
+		if sigs, ok := revoked[uid]; ok {
+			uid.Signatures = sigs
+		} else if valid[uid] {
+			uid.Signatures = uid.Signatures[:1]
+		} else {
+			continue
+		}
+		uid.Others = nil
+		key.UserIDs = append(key.UserIDs, uid)
+	}
+	for _, subKey := range key.SubKeys {
+		subKey.Signatures = subKey.Signatures[:1]
+		subKey.Others = nil
+	}
+	return key.updateMD5()
+}
+
+// latestUserIDCert returns the latest valid self-certification of uid, even
+// if it has been revoked.
+func latestUserIDCert(key *PrimaryKey, uid *UserID) *Signature {
+	var latest *Signature
+	for _, sig := range uid.Signatures {
+		if !strings.HasPrefix(key.UUID, sig.RIssuerKeyID) || sig.SigType < 0x10 || sig.SigType > 0x13 {
+			continue
+		}
+		if latest != nil && !sig.Creation.After(latest.Creation) {
+			continue
+		}
+		if key.verifyUserIDSelfSig(uid, sig) == nil {
+			latest = sig
+		}
+	}
+	return latest
+}
+
+// Slim reduces the signatures on key to those a client needs: the
+// revocations, latest certification and latest attestation of each user ID,
+// user attribute and subkey, and the certifications by other keys which have
+// not expired.
+// Self-signatures superseded by a later one are dropped, as are components
+// left without a valid self-signature.
+func Slim(key *PrimaryKey) error {
+	now := clk.Now()
+	var sigs []*Signature
+	for _, sig := range key.Signatures {
+		if strings.HasPrefix(key.UUID, sig.RIssuerKeyID) || !sig.expired(now) {
+			sigs = append(sigs, sig)
+		}
+	}
+	key.Signatures = sigs
+	var userIDs []*UserID
+	for _, uid := range key.UserIDs {
+		ss, others := uid.SigInfo(key)
+		if uid.Signatures = slimSigs(ss, others, now); len(uid.Signatures) > 0 {
+			userIDs = append(userIDs, uid)
+		}
+	}
+	var userAttributes []*UserAttribute
+	for _, uat := range key.UserAttributes {
+		ss, others := uat.SigInfo(key)
+		if uat.Signatures = slimSigs(ss, others, now); len(uat.Signatures) > 0 {
+			userAttributes = append(userAttributes, uat)
+		}
+	}
+	var subKeys []*SubKey
+	for _, subKey := range key.SubKeys {
+		ss, others := subKey.SigInfo(key)
+		if subKey.Signatures = slimSigs(ss, others, now); len(subKey.Signatures) > 0 {
+			subKeys = append(subKeys, subKey)
+		}
+	}
+	key.UserIDs = userIDs
+	key.UserAttributes = userAttributes
+	key.SubKeys = subKeys
+	return key.updateMD5()
+}
+
+// slimSigs returns the revocations and latest certification in ss, followed
+// by its latest attestation and the unexpired signatures in others, or
+// nothing if ss has neither a revocation nor a certification.
+func slimSigs(ss *SelfSigs, others []*Signature, now time.Time) []*Signature {
+	var result []*Signature
+	for _, checkSig := range ss.Revocations {
+		result = append(result, checkSig.Signature)
+	}
+	if len(ss.Certifications) > 0 {
+		result = append(result, ss.Certifications[0].Signature)
+	}
+	if len(result) == 0 {
+		return nil
+	}
+	if len(ss.Attestations) > 0 {
+		result = append(result, ss.Attestations[0].Signature)
+	}
+	for _, sig := range others {
+		if !sig.expired(now) {
+			result = append(result, sig)
+		}
+	}
+	return result
+}
+
 func DropDuplicates(key *PrimaryKey) error {
-	err := dedup(key, nil)
+	return DropDuplicatesContext(context.Background(), key)
+}
+
+// DropDuplicatesContext drops duplicate packets as DropDuplicates does,
+// failing if ctx is done first.
+func DropDuplicatesContext(ctx context.Context, key *PrimaryKey) error {
+	err := dedup(ctx, key, nil)
 	if err != nil {
 		return errors.WithStack(err)
 	}
@@ -96,7 +378,7 @@ func DropDuplicates(key *PrimaryKey) error {
 }
 
 func CollectDuplicates(key *PrimaryKey) error {
-	err := dedup(key, func(primary, _ packetNode) {
+	err := dedup(context.Background(), key, func(primary, _ packetNode) {
 		primary.packet().Count++
 	})
 	if err != nil {
@@ -106,13 +388,19 @@ func CollectDuplicates(key *PrimaryKey) error {
 }
 
 func Merge(dst, src *PrimaryKey) error {
+	return MergeContext(context.Background(), dst, src)
+}
+
+// MergeContext merges src into dst as Merge does, failing if ctx is done
+// first. Keys with many duplicate packets can take a long time to merge.
+func MergeContext(ctx context.Context, dst, src *PrimaryKey) error {
 	dst.UserIDs = append(dst.UserIDs, src.UserIDs...)
 	dst.UserAttributes = append(dst.UserAttributes, src.UserAttributes...)
 	dst.SubKeys = append(dst.SubKeys, src.SubKeys...)
 	dst.Others = append(dst.Others, src.Others...)
 	dst.Signatures = append(dst.Signatures, src.Signatures...)
 
-	err := dedup(dst, func(primary, duplicate packetNode) {
+	err := dedup(ctx, dst, func(primary, duplicate packetNode) {
 		primaryPacket := primary.packet()
 		duplicatePacket := duplicate.packet()
 		if duplicatePacket.Count > primaryPacket.Count {
@@ -130,10 +418,13 @@ func hexmd5(b []byte) string {
 	return hex.EncodeToString(d[:])
 }
 
-func dedup(root packetNode, handleDuplicate func(primary, duplicate packetNode)) error {
+func dedup(ctx context.Context, root packetNode, handleDuplicate func(primary, duplicate packetNode)) error {
 	nodes := map[string]packetNode{}
 
 	for _, node := range root.contents() {
+		if err := checkBudget(ctx); err != nil {
+			return err
+		}
 		uuid := node.uuid() + "_" + hexmd5(node.packet().Packet)
 		primary, ok := nodes[uuid]
 		if ok {
@@ -142,7 +433,7 @@ func dedup(root packetNode, handleDuplicate func(primary, duplicate packetNode))
 				return errors.WithStack(err)
 			}
 
-			err = dedup(primary, nil)
+			err = dedup(ctx, primary, nil)
 			if err != nil {
 				return errors.WithStack(err)
 			}
@@ -18,6 +18,7 @@
 package openpgp
 
 import (
+	"bytes"
 	"crypto/md5"
 	"encoding/binary"
 	"encoding/hex"
@@ -25,10 +26,12 @@ import (
 	"strings"
 	"time"
 
+	"github.com/pkg/errors"
 	"golang.org/x/crypto/openpgp/armor"
 	"golang.org/x/crypto/openpgp/packet"
 	gc "gopkg.in/check.v1"
 
+	"hockeypuck/clock"
 	"hockeypuck/testing"
 )
 
@@ -86,11 +89,9 @@ func (s *ResolveSuite) TestRoundTripSksDigest(c *gc.C) {
 }
 
 func patchNow(t time.Time) func() {
-	now = func() time.Time {
-		return t
-	}
+	clk = clock.NewFake(t)
 	return func() {
-		now = time.Now
+		clk = clock.Real()
 	}
 }
 
@@ -135,6 +136,52 @@ func (s *ResolveSuite) TestSortUserIDs(c *gc.C) {
 	}
 }
 
+func (s *ResolveSuite) TestCanonicalOrder(c *gc.C) {
+	key := MustInputAscKey("lp1195901.asc")
+	err := DropDuplicates(key)
+	c.Assert(err, gc.IsNil)
+	CanonicalOrder(key)
+	var expect bytes.Buffer
+	err = WritePackets(&expect, key)
+	c.Assert(err, gc.IsNil)
+
+	// Reverse the order of user IDs, subkeys and signatures.
+	for i, j := 0, len(key.UserIDs)-1; i < j; i, j = i+1, j-1 {
+		key.UserIDs[i], key.UserIDs[j] = key.UserIDs[j], key.UserIDs[i]
+	}
+	for i, j := 0, len(key.SubKeys)-1; i < j; i, j = i+1, j-1 {
+		key.SubKeys[i], key.SubKeys[j] = key.SubKeys[j], key.SubKeys[i]
+	}
+	for _, uid := range key.UserIDs {
+		sigs := uid.Signatures
+		for i, j := 0, len(sigs)-1; i < j; i, j = i+1, j-1 {
+			sigs[i], sigs[j] = sigs[j], sigs[i]
+		}
+	}
+	var reordered bytes.Buffer
+	err = WritePackets(&reordered, key)
+	c.Assert(err, gc.IsNil)
+	c.Assert(reordered.Bytes(), gc.Not(gc.DeepEquals), expect.Bytes())
+
+	CanonicalOrder(key)
+	var actual bytes.Buffer
+	err = WritePackets(&actual, key)
+	c.Assert(err, gc.IsNil)
+	c.Assert(actual.Bytes(), gc.DeepEquals, expect.Bytes())
+}
+
+func (s *ResolveSuite) TestLessPacketIgnoresHeader(c *gc.C) {
+	// Old and new format headers for packets of the same tag.
+	oldFormat := &Packet{Packet: []byte{0x88, 0x01, 0x05}}
+	newFormat := &Packet{Packet: []byte{0xc2, 0x01, 0x04}}
+	c.Assert(lessPacket(newFormat, oldFormat), gc.Equals, true)
+	c.Assert(lessPacket(oldFormat, newFormat), gc.Equals, false)
+
+	// Packets are ordered by tag first.
+	userID := &Packet{Packet: []byte{0xcd, 0x01, 0x00}}
+	c.Assert(lessPacket(oldFormat, userID), gc.Equals, true)
+}
+
 func (s *ResolveSuite) TestKeyExpiration(c *gc.C) {
 	defer patchNow(time.Date(2013, time.January, 1, 0, 0, 0, 0, time.UTC))()
 
@@ -258,6 +305,72 @@ func (s *ResolveSuite) TestSelfSignedOnly_BadSigs(c *gc.C) {
 	}
 }
 
+func (s *ResolveSuite) TestDropUnverified(c *gc.C) {
+	f := testing.MustInput("badselfsig.asc")
+	defer f.Close()
+	keys, err := ReadArmorKeys(f, VerifySelfSigs())
+	c.Assert(err, gc.IsNil)
+	c.Assert(keys, gc.HasLen, 1)
+	key := keys[0]
+	// The forged user IDs are dropped, but certifications by other keys
+	// are kept.
+	c.Assert(key.UserIDs, gc.HasLen, 2)
+	for _, uid := range key.UserIDs {
+		if strings.Contains(uid.Keywords, "gazzang") {
+			c.Assert(uid.Signatures, gc.HasLen, 5)
+		} else {
+			c.Assert(uid.Signatures, gc.HasLen, 1)
+		}
+	}
+	c.Assert(key.SubKeys, gc.HasLen, 3)
+
+	// Subkeys bound without a valid back-signature are dropped.
+	key = MustInputAscKey("crosscert.asc")
+	c.Assert(key.SubKeys, gc.HasLen, 4)
+	c.Assert(DropUnverified(key), gc.IsNil)
+	var keyIDs []string
+	for _, subKey := range key.SubKeys {
+		keyIDs = append(keyIDs, subKey.KeyID())
+	}
+	sort.Strings(keyIDs)
+	c.Assert(keyIDs, gc.DeepEquals, []string{"45e917004ee20987", "92467c043fc1ecb4"})
+}
+
+func (s *ResolveSuite) TestSlim(c *gc.C) {
+	t := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	clk = clock.NewFake(t)
+	defer func() {
+		clk = clock.Real()
+	}()
+
+	key := MustInputAscKey("tails.asc")
+	before := len(key.contents())
+	c.Assert(Slim(key), gc.IsNil)
+	// Each user ID has a superseded self-signature and five expired
+	// certifications.
+	c.Assert(len(key.contents()), gc.Equals, before-12)
+	c.Assert(key.UserIDs, gc.Not(gc.HasLen), 0)
+	for _, uid := range key.UserIDs {
+		ss, others := uid.SigInfo(key)
+		c.Assert(ss.Errors, gc.HasLen, 0)
+		c.Assert(len(ss.Revocations)+len(ss.Certifications), gc.Equals, len(uid.Signatures)-len(others))
+		c.Assert(len(ss.Certifications) <= 1, gc.Equals, true)
+		for _, sig := range others {
+			c.Assert(sig.Expiration.IsZero() || sig.Expiration.After(t), gc.Equals, true)
+		}
+	}
+	for _, subKey := range key.SubKeys {
+		ss, _ := subKey.SigInfo(key)
+		c.Assert(ss.Errors, gc.HasLen, 0)
+		c.Assert(len(ss.Certifications) <= 1, gc.Equals, true)
+	}
+
+	// Slimming is idempotent.
+	md5 := key.MD5
+	c.Assert(Slim(key), gc.IsNil)
+	c.Assert(key.MD5, gc.Equals, md5)
+}
+
 func (s *ResolveSuite) TestSelfSignedOnly_V3SigDropped(c *gc.C) {
 	key := MustInputAscKey("0ff16c87.asc")
 	c.Assert(key.UserIDs, gc.HasLen, 9)
@@ -272,6 +385,60 @@ func (s *ResolveSuite) TestSelfSignedOnly_V3SigDropped(c *gc.C) {
 	c.Assert(key.SubKeys, gc.HasLen, 0)
 }
 
+func (s *ResolveSuite) TestCrossCertification(c *gc.C) {
+	key := MustInputAscKey("crosscert.asc")
+	c.Assert(key.SubKeys, gc.HasLen, 4)
+
+	c.Assert(ValidSelfSigned(key, false), gc.IsNil)
+	var keyIDs []string
+	for _, subKey := range key.SubKeys {
+		keyIDs = append(keyIDs, subKey.KeyID())
+	}
+	sort.Strings(keyIDs)
+	c.Assert(keyIDs, gc.DeepEquals, []string{
+		// Encryption subkey, which needs no back-signature.
+		"45e917004ee20987",
+		// Signing subkey bound without key flags, with a back-signature.
+		"92467c043fc1ecb4",
+	})
+	// Dropped are a signing subkey whose back-signature was removed, and
+	// one bound without key flags or a back-signature.
+}
+
+func (s *ResolveSuite) TestTruncate(c *gc.C) {
+	key := MustInputAscKey("weasel.asc")
+	length := key.SerializedLength()
+
+	valid := MustInputAscKey("weasel.asc")
+	c.Assert(ValidSelfSigned(valid, true), gc.IsNil)
+
+	c.Assert(Truncate(key), gc.IsNil)
+	c.Assert(key.SerializedLength() < length/10, gc.Equals, true)
+	c.Assert(key.UserIDs, gc.HasLen, len(valid.UserIDs))
+	for _, uid := range key.UserIDs {
+		c.Assert(uid.Signatures, gc.HasLen, 1)
+	}
+	c.Assert(key.UserAttributes, gc.HasLen, 0)
+	c.Assert(key.SubKeys, gc.HasLen, len(valid.SubKeys))
+	for _, subKey := range key.SubKeys {
+		c.Assert(subKey.Signatures, gc.HasLen, 1)
+	}
+}
+
+func (s *ResolveSuite) TestTruncateRevokedUserID(c *gc.C) {
+	key := MustInputAscKey("uid_revoked.asc")
+	c.Assert(Truncate(key), gc.IsNil)
+	c.Assert(key.UserIDs, gc.HasLen, 2)
+	kept, revoked := key.UserIDs[0], key.UserIDs[1]
+	c.Assert(kept.Keywords, gc.Equals, "Revoked UID Test <kept@example.com>")
+	c.Assert(kept.Signatures, gc.HasLen, 1)
+	c.Assert(revoked.Keywords, gc.Equals, "Revoked UID Test <revoked@example.com>")
+	c.Assert(revoked.Signatures, gc.HasLen, 2)
+	ss, _ := revoked.SigInfo(key)
+	_, isRevoked := ss.RevokedSince()
+	c.Assert(isRevoked, gc.Equals, true)
+}
+
 func (s *ResolveSuite) TestFakeNews(c *gc.C) {
 	key := MustInputAscKey("fakenews.asc")
 	c.Assert(key.UserAttributes, gc.HasLen, 1)
@@ -290,3 +457,214 @@ func (s *ResolveSuite) TestResolveRootSignatures(c *gc.C) {
 	c.Assert(key1.Signatures, gc.HasLen, 1)
 	c.Assert(key2.Signatures, gc.HasLen, 1)
 }
+
+func (s *ResolveSuite) TestAddRevocation(c *gc.C) {
+	f := testing.MustInput("test-key-revoke.asc")
+	defer f.Close()
+	block, err := armor.Decode(f)
+	c.Assert(err, gc.IsNil)
+	revs, err := ReadRevocations(block.Body)
+	c.Assert(err, gc.IsNil)
+	c.Assert(revs, gc.HasLen, 1)
+	c.Assert(revs[0].IssuerKeyID(), gc.Equals, "7c330458a06e162f")
+
+	key := MustInputAscKey("test-key.asc")
+	c.Assert(AddRevocation(key, revs[0]), gc.IsNil)
+	c.Assert(key.Revoked(), gc.Equals, true)
+	c.Assert(key.MD5, gc.Equals, MustInputAscKey("test-key-revoked.asc").MD5)
+
+	// Adding it again changes nothing.
+	c.Assert(AddRevocation(key, revs[0]), gc.IsNil)
+	c.Assert(key.Signatures, gc.HasLen, 1)
+
+	err = AddRevocation(MustInputAscKey("alice_signed.asc"), revs[0])
+	c.Assert(err, gc.ErrorMatches, "revocation issued by 0x7c330458a06e162f, not .*")
+
+	// A tampered revocation does not verify.
+	revs[0].op.Contents[len(revs[0].op.Contents)-1] ^= 0xff
+	key = MustInputAscKey("test-key.asc")
+	err = AddRevocation(key, revs[0])
+	c.Assert(err, gc.ErrorMatches, "revocation does not verify against key 0x7c330458a06e162f.*")
+	c.Assert(key.Signatures, gc.HasLen, 0)
+}
+
+func (s *ResolveSuite) TestReadRevocations(c *gc.C) {
+	for _, name := range []string{"test-key.asc", "alice_signed.asc"} {
+		f := testing.MustInput(name)
+		block, err := armor.Decode(f)
+		c.Assert(err, gc.IsNil)
+		_, err = ReadRevocations(block.Body)
+		c.Assert(err, gc.NotNil)
+		f.Close()
+	}
+}
+
+func (s *ResolveSuite) TestHasRevocation(c *gc.C) {
+	c.Assert(HasRevocation(MustInputAscKey("test-key.asc")), gc.Equals, false)
+	c.Assert(HasRevocation(MustInputAscKey("test-key-revoked.asc")), gc.Equals, true)
+	c.Assert(HasRevocation(MustInputAscKey("lp1195901.asc")), gc.Equals, true)
+}
+
+func (s *ResolveSuite) TestRevoked(c *gc.C) {
+	c.Assert(MustInputAscKey("test-key.asc").Revoked(), gc.Equals, false)
+	c.Assert(MustInputAscKey("test-key-revoked.asc").Revoked(), gc.Equals, true)
+}
+
+func (s *ResolveSuite) TestExpired(c *gc.C) {
+	key := MustInputAscKey("test-key.asc")
+	restore := patchNow(time.Date(2020, time.January, 1, 0, 0, 0, 0, time.UTC))
+	c.Assert(key.Expired(), gc.Equals, false)
+	restore()
+	defer patchNow(time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC))()
+	c.Assert(key.Expired(), gc.Equals, true)
+}
+
+func (s *ResolveSuite) TestUserIDAddress(c *gc.C) {
+	for _, t := range []struct{ uid, addr string }{
+		{"Alice <Alice@Example.com>", "alice@example.com"},
+		{"alice@example.com", "alice@example.com"},
+		{"Alice (work) < alice@example.com >", "alice@example.com"},
+		{"Alice", ""},
+		{"Alice alice@example.com", ""},
+		{"Alice <alice>", ""},
+		{"<@example.com>", ""},
+	} {
+		uid := &UserID{Keywords: t.uid}
+		c.Assert(uid.Address(), gc.Equals, t.addr, gc.Commentf("%q", t.uid))
+	}
+}
+
+func (s *ResolveSuite) TestSubKeyCanEncrypt(c *gc.C) {
+	for _, key := range MustInputAscKeys("ecc_keys.asc") {
+		c.Assert(key.SubKeys, gc.Not(gc.HasLen), 0)
+		for _, subKey := range key.SubKeys {
+			c.Assert(subKey.CanEncrypt(key), gc.Equals, true)
+		}
+	}
+	// The subkeys of this key expired in 2015.
+	key := MustInputAscKey("e68e311d.asc")
+	for _, subKey := range key.SubKeys {
+		c.Assert(subKey.CanEncrypt(key), gc.Equals, false)
+	}
+}
+
+func (s *ResolveSuite) TestNotations(c *gc.C) {
+	key := MustInputAscKey("ariadne_proof.asc")
+	c.Assert(key.UserIDs[0].Signatures, gc.HasLen, 1)
+	notations, err := key.UserIDs[0].Signatures[0].Notations()
+	c.Assert(err, gc.IsNil)
+	c.Assert(notations, gc.DeepEquals, []Notation{
+		{Name: NotationProofLegacy, Value: "dns:example.org?type=TXT", HumanReadable: true},
+		{Name: NotationProof, Value: "https://example.org/proof", HumanReadable: true},
+	})
+	c.Assert(key.UserIDs[0].Proofs(key), gc.DeepEquals, []string{
+		"dns:example.org?type=TXT",
+		"https://example.org/proof",
+	})
+
+	key = MustInputAscKey("alice_signed.asc")
+	for _, sig := range key.UserIDs[0].Signatures {
+		notations, err := sig.Notations()
+		c.Assert(err, gc.IsNil)
+		c.Assert(notations, gc.HasLen, 0)
+	}
+	c.Assert(key.UserIDs[0].Proofs(key), gc.HasLen, 0)
+}
+
+func (s *ResolveSuite) TestResolveFilters(c *gc.C) {
+	filters, err := ResolveFilters(nil)
+	c.Assert(err, gc.IsNil)
+	c.Assert(filters, gc.DeepEquals, []string{FilterDedup, FilterMerge})
+
+	filters, err = ResolveFilters([]string{FilterMerge, " yminsky.dedup"})
+	c.Assert(err, gc.IsNil)
+	c.Assert(filters, gc.DeepEquals, []string{FilterDedup, FilterMerge})
+
+	filters, err = ResolveFilters([]string{FilterVerifySelfSigs})
+	c.Assert(err, gc.IsNil)
+	c.Assert(filters, gc.DeepEquals, []string{FilterVerifySelfSigs, FilterDedup, FilterMerge})
+	c.Assert(FilterOptions(filters), gc.HasLen, 1)
+
+	_, err = ResolveFilters([]string{"bogus"})
+	c.Assert(err, gc.ErrorMatches, `unknown ingest filter "bogus"`)
+
+	filters = DeclareMaxUserAttributeLength([]string{FilterDedup, FilterMerge}, 65536)
+	c.Assert(filters, gc.DeepEquals, []string{"max-uat-length=65536", FilterDedup, FilterMerge})
+	c.Assert(FilterOptions(filters), gc.HasLen, 0)
+	filters = DeclareMaxUserAttributeLength([]string{FilterDedup, FilterMerge}, 0)
+	c.Assert(filters, gc.DeepEquals, []string{FilterDedup, FilterMerge})
+}
+
+func (s *ResolveSuite) TestAttestedOnly(c *gc.C) {
+	key := MustInputAscKey("attested.asc")
+	c.Assert(key.Others, gc.HasLen, 0)
+	c.Assert(key.UserIDs, gc.HasLen, 1)
+	uid := key.UserIDs[0]
+	c.Assert(uid.Signatures, gc.HasLen, 4)
+
+	ss, others := uid.SigInfo(key)
+	c.Assert(ss.Errors, gc.HasLen, 0)
+	c.Assert(ss.Certifications, gc.HasLen, 1)
+	c.Assert(ss.Attestations, gc.HasLen, 1)
+	c.Assert(others, gc.HasLen, 2)
+	digests, _, err := ss.Attestations[0].Signature.AttestedCertifications()
+	c.Assert(err, gc.IsNil)
+	c.Assert(digests, gc.HasLen, 1)
+
+	// Slimming keeps the attestation.
+	c.Assert(Slim(key), gc.IsNil)
+	c.Assert(uid.Signatures, gc.HasLen, 4)
+
+	c.Assert(AttestedOnly(key), gc.IsNil)
+	c.Assert(uid.Signatures, gc.HasLen, 3)
+	ss, others = uid.SigInfo(key)
+	c.Assert(ss.Certifications, gc.HasLen, 1)
+	c.Assert(ss.Attestations, gc.HasLen, 1)
+	c.Assert(others, gc.HasLen, 1)
+	c.Assert(others[0].IssuerKeyID(), gc.Equals, "e0cdef71c04326c4")
+
+	// Without an attestation, no certifications by other keys are kept.
+	uid.Signatures = []*Signature{ss.Certifications[0].Signature, others[0]}
+	c.Assert(AttestedOnly(key), gc.IsNil)
+	c.Assert(uid.Signatures, gc.DeepEquals, []*Signature{ss.Certifications[0].Signature})
+}
+
+func (s *ResolveSuite) TestSelect(c *gc.C) {
+	valid := MustInputAscKey("weasel.asc")
+	c.Assert(ValidSelfSigned(valid, true), gc.IsNil)
+	c.Assert(len(valid.UserIDs) > 1, gc.Equals, true)
+	c.Assert(len(valid.SubKeys) > 1, gc.Equals, true)
+
+	// By default, only the primary user ID is kept, without certifications
+	// by other keys.
+	key := MustInputAscKey("weasel.asc")
+	length := key.SerializedLength()
+	c.Assert(Select(key, &Selection{}), gc.IsNil)
+	c.Assert(key.SerializedLength() < length/10, gc.Equals, true)
+	c.Assert(key.UserIDs, gc.HasLen, 1)
+	c.Assert(key.UserIDs[0].Keywords, gc.Equals, valid.UserIDs[0].Keywords)
+	for _, sig := range key.UserIDs[0].Signatures {
+		c.Assert(strings.HasPrefix(key.UUID, sig.RIssuerKeyID), gc.Equals, true)
+	}
+	c.Assert(key.UserAttributes, gc.HasLen, 0)
+	c.Assert(key.SubKeys, gc.HasLen, 0)
+
+	key = MustInputAscKey("weasel.asc")
+	c.Assert(Select(key, &Selection{UserIDs: true, SubKeys: true}), gc.IsNil)
+	c.Assert(key.UserIDs, gc.HasLen, len(valid.UserIDs))
+	c.Assert(key.SubKeys, gc.HasLen, len(valid.SubKeys))
+
+	// Subkeys are named by fingerprint or long key ID.
+	want := valid.SubKeys[1]
+	for _, id := range []string{want.Fingerprint(), "0x" + strings.ToUpper(want.KeyID())} {
+		key = MustInputAscKey("weasel.asc")
+		c.Assert(Select(key, &Selection{SubKeyIDs: []string{id}}), gc.IsNil)
+		c.Assert(key.SubKeys, gc.HasLen, 1)
+		c.Assert(key.SubKeys[0].RFingerprint, gc.Equals, want.RFingerprint)
+		c.Assert(key.SubKeys[0].Signatures, gc.HasLen, 1)
+	}
+
+	key = MustInputAscKey("weasel.asc")
+	err := Select(key, &Selection{SubKeyIDs: []string{"0123456789abcdef"}})
+	c.Assert(errors.Cause(err), gc.Equals, ErrSubKeyNotFound)
+}
@@ -0,0 +1,98 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package openpgp
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/openpgp/packet"
+)
+
+// Revocation is a key revocation signature submitted without the key it
+// revokes, such as the certificate made by gpg --gen-revoke.
+type Revocation struct {
+	RIssuerKeyID string
+
+	op *packet.OpaquePacket
+}
+
+// IssuerKeyID returns the long key ID of the key which made the revocation.
+func (rev *Revocation) IssuerKeyID() string {
+	return Reverse(rev.RIssuerKeyID)
+}
+
+// ReadRevocations reads bare key revocation signatures. It fails unless r
+// holds only key revocations.
+func ReadRevocations(r io.Reader) ([]*Revocation, error) {
+	var result []*Revocation
+	or := packet.NewOpaqueReader(r)
+	for {
+		op, err := or.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		p, err := op.Parse()
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		s, ok := p.(*packet.Signature)
+		if !ok {
+			return nil, errors.Errorf("expected a signature packet, got %T", p)
+		}
+		if s.SigType != packet.SigTypeKeyRevocation {
+			return nil, errors.Errorf("expected a key revocation, got signature type 0x%02x", s.SigType)
+		}
+		if s.IssuerKeyId == nil {
+			return nil, errors.New("missing issuer key ID")
+		}
+		var issuerKeyID [8]byte
+		binary.BigEndian.PutUint64(issuerKeyID[:], *s.IssuerKeyId)
+		result = append(result, &Revocation{
+			RIssuerKeyID: Reverse(hex.EncodeToString(issuerKeyID[:])),
+			op:           op,
+		})
+	}
+	if len(result) == 0 {
+		return nil, errors.New("no revocations found")
+	}
+	return result, nil
+}
+
+// AddRevocation adds rev to key, if key made it. Revocations which do not
+// verify against the primary key are refused.
+func AddRevocation(key *PrimaryKey, rev *Revocation) error {
+	if !strings.HasPrefix(key.UUID, rev.RIssuerKeyID) {
+		return errors.Errorf("revocation issued by 0x%s, not 0x%s", rev.IssuerKeyID(), key.KeyID())
+	}
+	sig, err := ParseSignature(rev.op, key.Creation, key.UUID, key.UUID)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	err = key.verifyPublicKeySelfSig(&key.PublicKey, sig)
+	if err != nil {
+		return errors.Wrapf(err, "revocation does not verify against key 0x%s", key.KeyID())
+	}
+	key.Signatures = append(key.Signatures, sig)
+	return DropDuplicates(key)
+}
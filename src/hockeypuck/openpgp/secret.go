@@ -0,0 +1,132 @@
+package openpgp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/openpgp/packet"
+)
+
+// StripSecretKeys replaces the secret key and subkey packets in data with
+// the public key and subkey packets they contain, so that keys exported
+// with their secrets by mistake may still be stored without them. It
+// returns the result and the number of secret packets replaced. If there
+// are none, data is returned unchanged. It fails only if a secret packet
+// cannot be replaced: malformed data after the last packet read is passed
+// through, for the key reader to reject.
+func StripSecretKeys(data []byte) ([]byte, int, error) {
+	var buf bytes.Buffer
+	var stripped int
+	r := bytes.NewReader(data)
+	or := packet.NewOpaqueReader(r)
+	for {
+		offset := len(data) - r.Len()
+		op, err := or.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			buf.Write(data[offset:])
+			break
+		}
+		switch op.Tag {
+		case 5, 7: //packet.PacketTypePrivateKey, packet.PacketTypePrivateSubkey
+			n, err := publicKeyLength(op.Contents)
+			if err != nil {
+				return nil, 0, errors.WithStack(err)
+			}
+			if op.Tag == 5 {
+				op.Tag = 6 //packet.PacketTypePublicKey
+			} else {
+				op.Tag = 14 //packet.PacketTypePublicSubKey
+			}
+			op.Contents = op.Contents[:n]
+			stripped++
+		}
+		err = op.Serialize(&buf)
+		if err != nil {
+			return nil, 0, errors.WithStack(err)
+		}
+	}
+	if stripped == 0 {
+		return data, 0, nil
+	}
+	return buf.Bytes(), stripped, nil
+}
+
+// publicKeyLength returns the length of the public key at the start of the
+// body of a secret key packet, as laid out in RFC 4880 section 5.5.2.
+func publicKeyLength(body []byte) (int, error) {
+	if len(body) < 1 {
+		return 0, errors.New("empty secret key packet")
+	}
+	var n int
+	switch version := body[0]; version {
+	case 2, 3:
+		n = 8 // version, creation time, validity, algorithm
+	case 4:
+		n = 6 // version, creation time, algorithm
+	default:
+		return 0, errors.Errorf("unsupported secret key version %d", version)
+	}
+	if len(body) < n {
+		return 0, errors.New("truncated secret key packet")
+	}
+	algo := body[n-1]
+
+	var mpis int
+	var oid, kdf bool
+	switch packet.PublicKeyAlgorithm(algo) {
+	case packet.PubKeyAlgoRSA, packet.PubKeyAlgoRSAEncryptOnly, packet.PubKeyAlgoRSASignOnly:
+		mpis = 2
+	case packet.PubKeyAlgoDSA:
+		mpis = 4
+	case packet.PubKeyAlgoElGamal, 20: // ElGamal encrypt or sign
+		mpis = 3
+	case packet.PubKeyAlgoECDSA, packet.PubKeyAlgoEdDSA:
+		oid, mpis = true, 1
+	case packet.PubKeyAlgoECDH:
+		oid, mpis, kdf = true, 1, true
+	default:
+		return 0, errors.Errorf("unsupported secret key algorithm %d", algo)
+	}
+
+	// field skips a field led by its length in size octets, counted in bits
+	// if bits is set.
+	field := func(size int, bits bool) error {
+		if len(body) < n+size {
+			return errors.New("truncated secret key packet")
+		}
+		var length int
+		if size == 1 {
+			length = int(body[n])
+		} else {
+			length = int(binary.BigEndian.Uint16(body[n:]))
+		}
+		if bits {
+			length = (length + 7) / 8
+		}
+		n += size + length
+		if len(body) < n {
+			return errors.New("truncated secret key packet")
+		}
+		return nil
+	}
+	if oid {
+		if err := field(1, false); err != nil {
+			return 0, err
+		}
+	}
+	for i := 0; i < mpis; i++ {
+		if err := field(2, true); err != nil {
+			return 0, err
+		}
+	}
+	if kdf {
+		if err := field(1, false); err != nil {
+			return 0, err
+		}
+	}
+	return n, nil
+}
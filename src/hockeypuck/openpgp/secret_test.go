@@ -0,0 +1,69 @@
+package openpgp
+
+import (
+	"bytes"
+	"io/ioutil"
+
+	"golang.org/x/crypto/openpgp/armor"
+	gc "gopkg.in/check.v1"
+
+	"hockeypuck/testing"
+)
+
+type SecretSuite struct{}
+
+var _ = gc.Suite(&SecretSuite{})
+
+func (s *SecretSuite) TestStripSecretKeys(c *gc.C) {
+	block, err := armor.Decode(testing.MustInput("careless_secret.asc"))
+	c.Assert(err, gc.IsNil)
+	secret, err := ioutil.ReadAll(block.Body)
+	c.Assert(err, gc.IsNil)
+
+	public, stripped, err := StripSecretKeys(secret)
+	c.Assert(err, gc.IsNil)
+	c.Assert(stripped, gc.Equals, 2)
+	keys, err := NewKeyReader(bytes.NewReader(public)).Read()
+	c.Assert(err, gc.IsNil)
+	c.Assert(keys, gc.HasLen, 1)
+	key := keys[0]
+	c.Assert(key.KeyID(), gc.Equals, "6a096b530c3f5386")
+	c.Assert(key.SubKeys, gc.HasLen, 1)
+	c.Assert(key.SubKeys[0].KeyID(), gc.Equals, "950ff3c9b8492cb0")
+	c.Assert(key.UserIDs, gc.HasLen, 1)
+	c.Assert(ValidSelfSigned(key, false), gc.IsNil)
+
+	// Public keys are left alone.
+	again, stripped, err := StripSecretKeys(public)
+	c.Assert(err, gc.IsNil)
+	c.Assert(stripped, gc.Equals, 0)
+	c.Assert(again, gc.DeepEquals, public)
+}
+
+func (s *SecretSuite) TestStripSecretKeysTruncated(c *gc.C) {
+	// A version 4 EdDSA secret key whose curve OID runs past the packet.
+	_, _, err := StripSecretKeys([]byte{0xc5, 0x08, 4, 0, 0, 0, 0, 22, 9, 0x2b})
+	c.Assert(err, gc.ErrorMatches, ".*truncated secret key packet")
+}
+
+func (s *SecretSuite) TestStripSecretKeysMalformed(c *gc.C) {
+	block, err := armor.Decode(testing.MustInput("careless_secret.asc"))
+	c.Assert(err, gc.IsNil)
+	secret, err := ioutil.ReadAll(block.Body)
+	c.Assert(err, gc.IsNil)
+	public, _, err := StripSecretKeys(secret)
+	c.Assert(err, gc.IsNil)
+
+	// A packet header running past the end of the data is left for the
+	// key reader, after the secret packets before it are stripped.
+	trailer := []byte{0xc2, 0x20, 4}
+	result, stripped, err := StripSecretKeys(append(secret, trailer...))
+	c.Assert(err, gc.IsNil)
+	c.Assert(stripped, gc.Equals, 2)
+	c.Assert(result, gc.DeepEquals, append(public, trailer...))
+
+	result, stripped, err = StripSecretKeys(trailer)
+	c.Assert(err, gc.IsNil)
+	c.Assert(stripped, gc.Equals, 0)
+	c.Assert(result, gc.DeepEquals, trailer)
+}
@@ -0,0 +1,131 @@
+package openpgp
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var ErrSubKeyNotFound = fmt.Errorf("Subkey not found")
+
+// Selection names the components of a key kept by Select. The primary key
+// with its self-signatures, and its primary user ID, are always kept, so that
+// the result is a valid certificate.
+type Selection struct {
+	// UserIDs keeps every self-signed user ID, not only the primary one.
+	UserIDs bool
+
+	// UserAttributes keeps the self-signed user attributes.
+	UserAttributes bool
+
+	// Certifications keeps the unexpired certifications by other keys of the
+	// user IDs and user attributes kept, and their latest attestations.
+	Certifications bool
+
+	// SubKeys keeps every self-signed subkey.
+	SubKeys bool
+
+	// SubKeyIDs keeps the subkeys with these fingerprints or long key IDs, in
+	// hex with an optional 0x prefix.
+	SubKeyIDs []string
+}
+
+// Select reduces key to the components chosen by sel, each with only its
+// revocations and latest self-signature, and certifications by other keys
+// if chosen. Unknown packets are dropped. It returns ErrSubKeyNotFound if a
+// subkey named in sel has no valid binding in key.
+func Select(key *PrimaryKey, sel *Selection) error {
+	wanted := map[string]bool{}
+	for _, id := range sel.SubKeyIDs {
+		wanted[strings.TrimPrefix(strings.ToLower(id), "0x")] = false
+	}
+
+	now := clk.Now()
+	var sigs []*Signature
+	for _, sig := range key.Signatures {
+		if !strings.HasPrefix(key.UUID, sig.RIssuerKeyID) {
+			continue
+		}
+		if key.verifyPublicKeySelfSig(&key.PublicKey, sig) == nil {
+			sigs = append(sigs, sig)
+		}
+	}
+	key.Signatures = sigs
+	key.Others = nil
+
+	// The primary user ID sorts first.
+	sort.Sort(&uidSorter{key})
+	var userIDs []*UserID
+	for _, uid := range key.UserIDs {
+		ss, others := uid.SigInfo(key)
+		if uid.Signatures = selectSigs(ss, others, sel.Certifications, now); len(uid.Signatures) == 0 {
+			continue
+		}
+		uid.Others = nil
+		userIDs = append(userIDs, uid)
+		if !sel.UserIDs {
+			break
+		}
+	}
+	var userAttributes []*UserAttribute
+	if sel.UserAttributes {
+		for _, uat := range key.UserAttributes {
+			ss, others := uat.SigInfo(key)
+			if uat.Signatures = selectSigs(ss, others, sel.Certifications, now); len(uat.Signatures) > 0 {
+				uat.Others = nil
+				userAttributes = append(userAttributes, uat)
+			}
+		}
+	}
+	var subKeys []*SubKey
+	for _, subKey := range key.SubKeys {
+		fp, keyID := subKey.Fingerprint(), subKey.KeyID()
+		_, byFP := wanted[fp]
+		_, byKeyID := wanted[keyID]
+		if !sel.SubKeys && !byFP && !byKeyID {
+			continue
+		}
+		ss, _ := subKey.SigInfo(key)
+		if subKey.Signatures = selectSigs(ss, nil, false, now); len(subKey.Signatures) == 0 {
+			continue
+		}
+		subKey.Others = nil
+		subKeys = append(subKeys, subKey)
+		if byFP {
+			wanted[fp] = true
+		}
+		if byKeyID {
+			wanted[keyID] = true
+		}
+	}
+	for id, found := range wanted {
+		if !found {
+			return errors.Wrapf(ErrSubKeyNotFound, "%s", id)
+		}
+	}
+	key.UserIDs = userIDs
+	key.UserAttributes = userAttributes
+	key.SubKeys = subKeys
+	return key.updateMD5()
+}
+
+// selectSigs returns the revocations and latest certification in ss, and if
+// certs is true, its latest attestation and the unexpired signatures in
+// others. It returns nothing if ss has neither a revocation nor a
+// certification.
+func selectSigs(ss *SelfSigs, others []*Signature, certs bool, now time.Time) []*Signature {
+	if certs {
+		return slimSigs(ss, others, now)
+	}
+	var result []*Signature
+	for _, checkSig := range ss.Revocations {
+		result = append(result, checkSig.Signature)
+	}
+	if len(ss.Certifications) > 0 {
+		result = append(result, ss.Certifications[0].Signature)
+	}
+	return result
+}
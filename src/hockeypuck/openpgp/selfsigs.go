@@ -20,9 +20,12 @@ package openpgp
 import (
 	"sort"
 	"time"
+
+	"hockeypuck/clock"
 )
 
-var now = time.Now
+// clk is the clock against which signature and key expiry is checked.
+var clk = clock.Real()
 
 // CheckSig represents the result of checking a self-signature.
 type CheckSig struct {
@@ -40,6 +43,10 @@ type SelfSigs struct {
 	Primaries      []*CheckSig
 	Errors         []*CheckSig
 
+	// Attestations are the attestation signatures on user IDs and user
+	// attributes, latest first.
+	Attestations []*CheckSig
+
 	target packetNode
 }
 
@@ -92,6 +99,7 @@ func (s *SelfSigs) resolve() {
 	sort.Sort(checkSigCreationDesc(s.Certifications))
 	sort.Sort(checkSigExpirationDesc(s.Expirations))
 	sort.Sort(checkSigCreationDesc(s.Primaries))
+	sort.Sort(checkSigCreationDesc(s.Attestations))
 }
 
 var zeroTime time.Time
@@ -116,7 +124,7 @@ func (s *SelfSigs) Valid() bool {
 	_, okValid := s.ValidSince()
 	return (!revoked && // target has no revocations
 		// target does not expire or hasn't expired yet
-		(!okExpiration || expiration.Unix() > now().Unix()) &&
+		(!okExpiration || expiration.Unix() > clk.Now().Unix()) &&
 		// target has non-expired self-signatures
 		okValid)
 }
@@ -131,7 +139,7 @@ func (s *SelfSigs) ValidSince() (time.Time, bool) {
 	for _, checkSig := range s.Certifications {
 		// Return the first non-expired self-signature creation time.
 		expiresAt := checkSig.Signature.Expiration
-		if expiresAt.IsZero() || expiresAt.Unix() > now().Unix() {
+		if expiresAt.IsZero() || expiresAt.Unix() > clk.Now().Unix() {
 			return checkSig.Signature.Creation, true
 		}
 	}
@@ -144,7 +152,7 @@ func (s *SelfSigs) PrimarySince() (time.Time, bool) {
 	}
 	for _, checkSig := range s.Primaries {
 		expiresAt := checkSig.Signature.Expiration
-		if expiresAt.IsZero() || expiresAt.Unix() > now().Unix() {
+		if expiresAt.IsZero() || expiresAt.Unix() > clk.Now().Unix() {
 			return checkSig.Signature.Creation, true
 		}
 	}
@@ -99,7 +99,7 @@ func ParseSignature(op *packet.OpaquePacket, keyCreationTime time.Time, pubkeyUU
 }
 
 func (sig *Signature) parse(op *packet.OpaquePacket, keyCreationTime time.Time) error {
-	p, err := op.Parse()
+	p, err := parseSignaturePacket(op)
 	if err != nil {
 		return errors.WithStack(err)
 	}
@@ -160,7 +160,7 @@ func (sig *Signature) signaturePacket() (*packet.Signature, error) {
 	if err != nil {
 		return nil, errors.WithStack(err)
 	}
-	p, err := op.Parse()
+	p, err := parseSignaturePacket(op)
 	if err != nil {
 		return nil, errors.WithStack(err)
 	}
@@ -187,6 +187,129 @@ func (sig *Signature) signatureV3Packet() (*packet.SignatureV3, error) {
 	return s, nil
 }
 
+// subpacket is a signature subpacket, starting with its type, found at
+// offset in the signature packet contents.
+type subpacket struct {
+	offset int
+	body   []byte
+}
+
+// hashedSubpackets returns the subpackets in the hashed area of the contents
+// of a version 4 signature packet, or nothing for other versions.
+func hashedSubpackets(buf []byte) ([]subpacket, error) {
+	if len(buf) < 6 || buf[0] != 4 {
+		return nil, nil
+	}
+	hashedLen := int(binary.BigEndian.Uint16(buf[4:6]))
+	if len(buf) < 6+hashedLen {
+		return nil, errors.New("truncated signature subpackets")
+	}
+	subpackets := buf[6 : 6+hashedLen]
+	offset := 6
+
+	var result []subpacket
+	for len(subpackets) > 0 {
+		var length, header int
+		switch {
+		case subpackets[0] < 192:
+			length, header = int(subpackets[0]), 1
+		case subpackets[0] < 255:
+			if len(subpackets) < 2 {
+				return nil, errors.New("truncated subpacket length")
+			}
+			length = (int(subpackets[0])-192)<<8 + int(subpackets[1]) + 192
+			header = 2
+		default:
+			if len(subpackets) < 5 {
+				return nil, errors.New("truncated subpacket length")
+			}
+			length = int(binary.BigEndian.Uint32(subpackets[1:5]))
+			header = 5
+		}
+		subpackets = subpackets[header:]
+		offset += header
+		if length < 1 || length > len(subpackets) {
+			return nil, errors.New("invalid subpacket length")
+		}
+		result = append(result, subpacket{offset: offset, body: subpackets[:length]})
+		subpackets = subpackets[length:]
+		offset += length
+	}
+	return result, nil
+}
+
+// parseSignaturePacket parses a signature packet. Attestation signatures
+// mark their attested certifications subpacket critical, which the packet
+// parser does not know and so would refuse; it is parsed as if it were not
+// critical, without changing the data which the signature covers.
+func parseSignaturePacket(op *packet.OpaquePacket) (packet.Packet, error) {
+	if len(op.Contents) < 2 || op.Contents[1] != sigTypeAttestation {
+		return op.Parse()
+	}
+	subpackets, err := hashedSubpackets(op.Contents)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	contents := append([]byte(nil), op.Contents...)
+	var patched []int
+	for _, sp := range subpackets {
+		if sp.body[0] == subpacketAttestedCertifications|subpacketCritical {
+			contents[sp.offset] &^= subpacketCritical
+			patched = append(patched, sp.offset)
+		}
+	}
+	p, err := (&packet.OpaquePacket{Tag: op.Tag, Contents: contents}).Parse()
+	if err != nil {
+		return nil, err
+	}
+	if s, ok := p.(*packet.Signature); ok {
+		// The hash suffix begins with the packet contents up to the end of
+		// the hashed subpackets.
+		for _, offset := range patched {
+			s.HashSuffix[offset] = op.Contents[offset]
+		}
+	}
+	return p, nil
+}
+
 func (sig *Signature) IssuerKeyID() string {
 	return Reverse(sig.RIssuerKeyID)
 }
+
+// expired returns whether sig expired before now.
+func (sig *Signature) expired(now time.Time) bool {
+	return !sig.Expiration.IsZero() && !sig.Expiration.After(now)
+}
+
+// HasRevocation returns whether key carries a key, subkey or certification
+// revocation signature. The signatures are not verified.
+func HasRevocation(key *PrimaryKey) bool {
+	isRevocation := func(sigs []*Signature) bool {
+		for _, sig := range sigs {
+			switch sig.SigType {
+			case 0x20, 0x28, 0x30: // packet.SigTypeKeyRevocation, SubkeyRevocation, CertRevocation
+				return true
+			}
+		}
+		return false
+	}
+	if isRevocation(key.Signatures) {
+		return true
+	}
+	for _, subKey := range key.SubKeys {
+		if isRevocation(subKey.Signatures) {
+			return true
+		}
+	}
+	for _, uid := range key.UserIDs {
+		if isRevocation(uid.Signatures) {
+			return true
+		}
+	}
+	for _, uat := range key.UserAttributes {
+		if isRevocation(uat.Signatures) {
+			return true
+		}
+	}
+	return false
+}
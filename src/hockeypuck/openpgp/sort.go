@@ -17,7 +17,10 @@
 
 package openpgp
 
-import "sort"
+import (
+	"bytes"
+	"sort"
+)
 
 func lessSelfSigs(i, j *SelfSigs) (bool, bool) {
 	iValid := i.Valid()
@@ -149,3 +152,55 @@ func Sort(pubkey *PrimaryKey) {
 		}
 	}
 }
+
+// lessPacket orders packets by their tags and bodies, so that the order does
+// not depend on how their headers happen to encode the length. Packets which
+// cannot be parsed are ordered by their serialized contents.
+func lessPacket(a, b packetNode) bool {
+	aop, aerr := a.packet().opaquePacket()
+	bop, berr := b.packet().opaquePacket()
+	if aerr != nil || berr != nil {
+		return bytes.Compare(a.packet().Packet, b.packet().Packet) < 0
+	}
+	if aop.Tag != bop.Tag {
+		return aop.Tag < bop.Tag
+	}
+	if n := bytes.Compare(aop.Contents, bop.Contents); n != 0 {
+		return n < 0
+	}
+	return bytes.Compare(a.packet().Packet, b.packet().Packet) < 0
+}
+
+func sortSigs(sigs []*Signature) {
+	sort.Slice(sigs, func(i, j int) bool { return lessPacket(sigs[i], sigs[j]) })
+}
+
+func sortOthers(others []*Packet) {
+	sort.Slice(others, func(i, j int) bool { return lessPacket(others[i], others[j]) })
+}
+
+// CanonicalOrder reorders the key material by the contents of its packets
+// alone, so that keys with the same packets are written the same way
+// wherever they are stored. Unlike Sort, the order does not depend on
+// signature validity or on the current time.
+func CanonicalOrder(pubkey *PrimaryKey) {
+	for _, node := range pubkey.contents() {
+		switch p := node.(type) {
+		case *PrimaryKey:
+			sortSigs(p.Signatures)
+			sortOthers(p.Others)
+			sort.Slice(p.UserIDs, func(i, j int) bool { return lessPacket(p.UserIDs[i], p.UserIDs[j]) })
+			sort.Slice(p.UserAttributes, func(i, j int) bool { return lessPacket(p.UserAttributes[i], p.UserAttributes[j]) })
+			sort.Slice(p.SubKeys, func(i, j int) bool { return lessPacket(p.SubKeys[i], p.SubKeys[j]) })
+		case *SubKey:
+			sortSigs(p.Signatures)
+			sortOthers(p.Others)
+		case *UserID:
+			sortSigs(p.Signatures)
+			sortOthers(p.Others)
+		case *UserAttribute:
+			sortSigs(p.Signatures)
+			sortOthers(p.Others)
+		}
+	}
+}
@@ -19,6 +19,7 @@ package openpgp
 
 import (
 	"bytes"
+	"context"
 	"strings"
 
 	"github.com/pkg/errors"
@@ -97,6 +98,13 @@ func (ss subkeySlice) without(target *SubKey) []*SubKey {
 }
 
 func (subkey *SubKey) SigInfo(pubkey *PrimaryKey) (*SelfSigs, []*Signature) {
+	selfSigs, otherSigs, _ := subkey.sigInfo(context.Background(), pubkey)
+	return selfSigs, otherSigs
+}
+
+// sigInfo verifies the signatures as SigInfo does, failing if ctx is done
+// before they are verified.
+func (subkey *SubKey) sigInfo(ctx context.Context, pubkey *PrimaryKey) (*SelfSigs, []*Signature, error) {
 	selfSigs := &SelfSigs{target: subkey}
 	var otherSigs []*Signature
 	for _, sig := range subkey.Signatures {
@@ -105,6 +113,9 @@ func (subkey *SubKey) SigInfo(pubkey *PrimaryKey) (*SelfSigs, []*Signature) {
 			otherSigs = append(otherSigs, sig)
 			continue
 		}
+		if err := checkBudget(ctx); err != nil {
+			return nil, nil, err
+		}
 		checkSig := &CheckSig{
 			PrimaryKey: pubkey,
 			Signature:  sig,
@@ -125,5 +136,28 @@ func (subkey *SubKey) SigInfo(pubkey *PrimaryKey) (*SelfSigs, []*Signature) {
 		}
 	}
 	selfSigs.resolve()
-	return selfSigs, otherSigs
+	return selfSigs, otherSigs, nil
+}
+
+// CanEncrypt returns whether the subkey is validly bound to pubkey, neither
+// revoked nor expired, and usable for encryption. Usage is taken from the key
+// flags of the latest binding signature, or from the key algorithm if the
+// signature has none.
+func (subkey *SubKey) CanEncrypt(pubkey *PrimaryKey) bool {
+	selfSigs, _ := subkey.SigInfo(pubkey)
+	if !selfSigs.Valid() || len(selfSigs.Certifications) == 0 {
+		return false
+	}
+	s, err := selfSigs.Certifications[0].Signature.signaturePacket()
+	if err != nil {
+		return false
+	}
+	if s.FlagsValid {
+		return s.FlagEncryptCommunications || s.FlagEncryptStorage
+	}
+	switch packet.PublicKeyAlgorithm(subkey.Algorithm) {
+	case packet.PubKeyAlgoRSA, packet.PubKeyAlgoRSAEncryptOnly, packet.PubKeyAlgoElGamal, packet.PubKeyAlgoECDH:
+		return true
+	}
+	return false
 }
@@ -19,6 +19,7 @@ package openpgp
 
 import (
 	"bytes"
+	"context"
 	"strings"
 
 	"github.com/pkg/errors"
@@ -121,6 +122,13 @@ func (uat *UserAttribute) userAttributePacket() (*packet.UserAttribute, error) {
 }
 
 func (uat *UserAttribute) SigInfo(pubkey *PrimaryKey) (*SelfSigs, []*Signature) {
+	selfSigs, otherSigs, _ := uat.sigInfo(context.Background(), pubkey)
+	return selfSigs, otherSigs
+}
+
+// sigInfo verifies the signatures as SigInfo does, failing if ctx is done
+// before they are verified.
+func (uat *UserAttribute) sigInfo(ctx context.Context, pubkey *PrimaryKey) (*SelfSigs, []*Signature, error) {
 	selfSigs := &SelfSigs{target: uat}
 	var otherSigs []*Signature
 	for _, sig := range uat.Signatures {
@@ -129,6 +137,9 @@ func (uat *UserAttribute) SigInfo(pubkey *PrimaryKey) (*SelfSigs, []*Signature)
 			otherSigs = append(otherSigs, sig)
 			continue
 		}
+		if err := checkBudget(ctx); err != nil {
+			return nil, nil, err
+		}
 		checkSig := &CheckSig{
 			PrimaryKey: pubkey,
 			Signature:  sig,
@@ -141,6 +152,8 @@ func (uat *UserAttribute) SigInfo(pubkey *PrimaryKey) (*SelfSigs, []*Signature)
 		switch sig.SigType {
 		case 0x30: // packet.SigTypeCertRevocation
 			selfSigs.Revocations = append(selfSigs.Revocations, checkSig)
+		case sigTypeAttestation:
+			selfSigs.Attestations = append(selfSigs.Attestations, checkSig)
 		case 0x10, 0x11, 0x12, 0x13:
 			selfSigs.Certifications = append(selfSigs.Certifications, checkSig)
 			if !sig.Expiration.IsZero() {
@@ -152,5 +165,5 @@ func (uat *UserAttribute) SigInfo(pubkey *PrimaryKey) (*SelfSigs, []*Signature)
 		}
 	}
 	selfSigs.resolve()
-	return selfSigs, otherSigs
+	return selfSigs, otherSigs, nil
 }
@@ -19,6 +19,7 @@ package openpgp
 
 import (
 	"bytes"
+	"context"
 	"strings"
 	"unicode/utf8"
 
@@ -133,6 +134,24 @@ func (uid *UserID) setUserID(u *packet.UserId) error {
 	return nil
 }
 
+// Address returns the email address in the user ID, in lower case, or "" if
+// it has none. The address is taken from between angle brackets, or is the
+// whole user ID if that is a bare address.
+func (uid *UserID) Address() string {
+	s := strings.ToLower(strings.TrimSpace(uid.Keywords))
+	lbr, rbr := strings.Index(s, "<"), strings.LastIndex(s, ">")
+	if lbr != -1 && rbr > lbr {
+		s = strings.TrimSpace(s[lbr+1 : rbr])
+	} else if strings.ContainsAny(s, " \t<>") {
+		return ""
+	}
+	at := strings.LastIndex(s, "@")
+	if at < 1 || at == len(s)-1 {
+		return ""
+	}
+	return s
+}
+
 func cleanUtf8(s string) string {
 	var runes []rune
 	for _, r := range s {
@@ -148,6 +167,13 @@ func cleanUtf8(s string) string {
 }
 
 func (uid *UserID) SigInfo(pubkey *PrimaryKey) (*SelfSigs, []*Signature) {
+	selfSigs, otherSigs, _ := uid.sigInfo(context.Background(), pubkey)
+	return selfSigs, otherSigs
+}
+
+// sigInfo verifies the signatures as SigInfo does, failing if ctx is done
+// before they are verified.
+func (uid *UserID) sigInfo(ctx context.Context, pubkey *PrimaryKey) (*SelfSigs, []*Signature, error) {
 	selfSigs := &SelfSigs{target: uid}
 	var otherSigs []*Signature
 	for _, sig := range uid.Signatures {
@@ -156,6 +182,9 @@ func (uid *UserID) SigInfo(pubkey *PrimaryKey) (*SelfSigs, []*Signature) {
 			otherSigs = append(otherSigs, sig)
 			continue
 		}
+		if err := checkBudget(ctx); err != nil {
+			return nil, nil, err
+		}
 		checkSig := &CheckSig{
 			PrimaryKey: pubkey,
 			Signature:  sig,
@@ -168,6 +197,8 @@ func (uid *UserID) SigInfo(pubkey *PrimaryKey) (*SelfSigs, []*Signature) {
 		switch sig.SigType {
 		case 0x30: // packet.SigTypeCertRevocation
 			selfSigs.Revocations = append(selfSigs.Revocations, checkSig)
+		case sigTypeAttestation:
+			selfSigs.Attestations = append(selfSigs.Attestations, checkSig)
 		case 0x10, 0x11, 0x12, 0x13:
 			selfSigs.Certifications = append(selfSigs.Certifications, checkSig)
 			if !sig.Expiration.IsZero() {
@@ -179,5 +210,5 @@ func (uid *UserID) SigInfo(pubkey *PrimaryKey) (*SelfSigs, []*Signature) {
 		}
 	}
 	selfSigs.resolve()
-	return selfSigs, otherSigs
+	return selfSigs, otherSigs, nil
 }
@@ -37,10 +37,21 @@ func (pubkey *PrimaryKey) verifyPublicKeySelfSig(signed *PublicKey, sig *Signatu
 		if err != nil {
 			return errors.WithStack(err)
 		}
+		if signed == &pubkey.PublicKey && s.SigType == packet.SigTypeKeyRevocation {
+			// A key revocation is over the primary key alone.
+			return errors.WithStack(pk.VerifyRevocationSignature(s))
+		}
 		signedPk, err := signed.publicKeyPacket()
 		if err != nil {
 			return errors.WithStack(err)
 		}
+		if s.SigType == packet.SigTypeSubkeyBinding && !s.FlagsValid && signOnly(signedPk.PubKeyAlgo) {
+			// Without key flags, a subkey is usable for whatever its
+			// algorithm allows. A subkey which can only sign needs a
+			// back-signature, which is checked for subkeys flagged for
+			// signing.
+			s.FlagSign = true
+		}
 		return errors.WithStack(pk.VerifyKeySignature(signedPk, s))
 	case *packet.PublicKeyV3:
 		s, err := sig.signatureV3Packet()
@@ -56,6 +67,17 @@ func (pubkey *PrimaryKey) verifyPublicKeySelfSig(signed *PublicKey, sig *Signatu
 	return ErrInvalidPacketType
 }
 
+// signOnly returns whether keys of the algorithm can sign but not encrypt.
+// RSA keys can do both, and legacy keys often bind RSA encryption subkeys
+// without key flags, so they are not required to have back-signatures.
+func signOnly(algo packet.PublicKeyAlgorithm) bool {
+	switch algo {
+	case packet.PubKeyAlgoRSASignOnly, packet.PubKeyAlgoDSA, packet.PubKeyAlgoECDSA, packet.PubKeyAlgoEdDSA:
+		return true
+	}
+	return false
+}
+
 func (pubkey *PrimaryKey) verifyUserIDSelfSig(uid *UserID, sig *Signature) error {
 	u, err := uid.userIDPacket()
 	if err != nil {
@@ -73,7 +95,7 @@ func (pubkey *PrimaryKey) verifyUserIDSelfSig(uid *UserID, sig *Signature) error
 		if err != nil {
 			return errors.WithStack(err)
 		}
-		sParsed, err := sOpaque.Parse()
+		sParsed, err := parseSignaturePacket(sOpaque)
 		if err != nil {
 			return errors.WithStack(err)
 		}
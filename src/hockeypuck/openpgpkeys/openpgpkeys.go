@@ -0,0 +1,192 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+// Package openpgpkeys parses, merges and canonicalizes OpenPGP public keys
+// exactly as hockeypuck does when storing them, for use by tools outside of
+// the keyserver such as dump sanitizers and migration scripts. It has no
+// storage dependencies.
+//
+// Keys are passed as blobs of OpenPGP packets, either binary or ASCII
+// armored. Results are always binary. A canonical key has duplicate packets
+// removed and its packets in the order in which hockeypuck serves them, so
+// that equivalent keys have identical canonical forms.
+package openpgpkeys
+
+import (
+	"bytes"
+	"io"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/openpgp/armor"
+
+	"hockeypuck/openpgp"
+)
+
+var (
+	// ErrNoKey is returned when a blob does not contain a public key.
+	ErrNoKey = errors.New("no public key found")
+
+	// ErrMultipleKeys is returned when a blob expected to contain a single
+	// public key contains several.
+	ErrMultipleKeys = errors.New("more than one public key found")
+
+	// ErrFingerprintMismatch is returned when merging keys with different
+	// primary fingerprints.
+	ErrFingerprintMismatch = errors.New("keys have different fingerprints")
+)
+
+// Option limits the keys accepted when parsing a blob, as configured for
+// the keyserver with openpgp.MaxKeyLen, openpgp.Blacklist and so on.
+type Option = openpgp.KeyReaderOption
+
+// Parse returns the canonical form of each public key in blob. Duplicate
+// packets are removed and each key's MD5 is its SKS digest.
+func Parse(blob []byte, options ...Option) ([]*openpgp.PrimaryKey, error) {
+	r, err := packets(blob)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	keys, err := openpgp.NewKeyReader(r, options...).Read()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	for _, key := range keys {
+		err = openpgp.DropDuplicates(key)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		openpgp.Sort(key)
+	}
+	return keys, nil
+}
+
+// Split returns the canonical binary form of each public key in blob, such
+// as a keyring or a keydump file.
+func Split(blob []byte, options ...Option) ([][]byte, error) {
+	keys, err := Parse(blob, options...)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	result := make([][]byte, len(keys))
+	for i, key := range keys {
+		result[i], err = serialize(key)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+	}
+	return result, nil
+}
+
+// Canonicalize returns the canonical binary form of the single public key in
+// blob.
+func Canonicalize(blob []byte, options ...Option) ([]byte, error) {
+	key, err := parseKey(blob, options...)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return serialize(key)
+}
+
+// Merge returns the canonical binary form of the union of two revisions of
+// the same public key, as the keyserver stores when a key is resubmitted or
+// received from a recon peer.
+func Merge(a, b []byte, options ...Option) ([]byte, error) {
+	dst, err := parseKey(a, options...)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	src, err := parseKey(b, options...)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if dst.RFingerprint != src.RFingerprint {
+		return nil, errors.Wrapf(ErrFingerprintMismatch, "cannot merge %s into %s", src.Fingerprint(), dst.Fingerprint())
+	}
+	err = openpgp.Merge(dst, src)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	openpgp.Sort(dst)
+	return serialize(dst)
+}
+
+// Digest returns the SKS digest of the single public key in blob: the hex
+// MD5 by which keys are reconciled with other keyservers. Duplicate packets
+// do not affect the digest.
+func Digest(blob []byte, options ...Option) (string, error) {
+	key, err := parseKey(blob, options...)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	return key.MD5, nil
+}
+
+// SksCanonical returns the form in which SKS digests the single public key
+// in blob, as written by openpgp.SksCanonical: its packets sorted by tag and
+// contents, each preceded by its tag and length. The MD5 of the result is
+// the key's digest. It is not a valid keyring, but comparing it between
+// keyservers shows which packets account for a difference in digests.
+func SksCanonical(blob []byte, options ...Option) ([]byte, error) {
+	key, err := parseKey(blob, options...)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	var buf bytes.Buffer
+	err = openpgp.SksCanonical(&buf, key)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return buf.Bytes(), nil
+}
+
+func parseKey(blob []byte, options ...Option) (*openpgp.PrimaryKey, error) {
+	keys, err := Parse(blob, options...)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	switch len(keys) {
+	case 0:
+		return nil, errors.WithStack(ErrNoKey)
+	case 1:
+		return keys[0], nil
+	default:
+		return nil, errors.WithStack(ErrMultipleKeys)
+	}
+}
+
+// packets returns the binary packets of blob, removing any ASCII armor.
+// Binary OpenPGP data always starts with a packet tag, which has its most
+// significant bit set.
+func packets(blob []byte) (io.Reader, error) {
+	if len(blob) == 0 || blob[0]&0x80 != 0 {
+		return bytes.NewReader(blob), nil
+	}
+	block, err := armor.Decode(bytes.NewReader(blob))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return block.Body, nil
+}
+
+func serialize(key *openpgp.PrimaryKey) ([]byte, error) {
+	var buf bytes.Buffer
+	err := openpgp.WritePackets(&buf, key)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return buf.Bytes(), nil
+}
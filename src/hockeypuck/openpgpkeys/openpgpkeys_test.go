@@ -0,0 +1,167 @@
+/*
+   Hockeypuck - OpenPGP key server
+   Copyright (C) 2012-2014  Casey Marshall
+
+   This program is free software: you can redistribute it and/or modify
+   it under the terms of the GNU Affero General Public License as published by
+   the Free Software Foundation, version 3.
+
+   This program is distributed in the hope that it will be useful,
+   but WITHOUT ANY WARRANTY; without even the implied warranty of
+   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+   GNU Affero General Public License for more details.
+
+   You should have received a copy of the GNU Affero General Public License
+   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package openpgpkeys
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/binary"
+	"encoding/hex"
+	"io/ioutil"
+	stdtesting "testing"
+
+	"github.com/pkg/errors"
+	gc "gopkg.in/check.v1"
+
+	"hockeypuck/openpgp"
+	"hockeypuck/testing"
+)
+
+func Test(t *stdtesting.T) { gc.TestingT(t) }
+
+type KeysSuite struct{}
+
+var _ = gc.Suite(&KeysSuite{})
+
+func mustInput(c *gc.C, name string) []byte {
+	f := testing.MustInput(name)
+	defer f.Close()
+	buf, err := ioutil.ReadAll(f)
+	c.Assert(err, gc.IsNil)
+	return buf
+}
+
+func (s *KeysSuite) TestDigest(c *gc.C) {
+	digest, err := Digest(mustInput(c, "sksdigest.asc"))
+	c.Assert(err, gc.IsNil)
+	c.Assert(digest, gc.Equals, "da84f40d830a7be2a3c0b7f2e146bfaa")
+
+	// The digest of the binary form is the same.
+	canonical, err := Canonicalize(mustInput(c, "sksdigest.asc"))
+	c.Assert(err, gc.IsNil)
+	digest, err = Digest(canonical)
+	c.Assert(err, gc.IsNil)
+	c.Assert(digest, gc.Equals, "da84f40d830a7be2a3c0b7f2e146bfaa")
+}
+
+// sksDigests are digests which SKS keyservers gave for test keys, which
+// hockeypuck must calculate exactly as SKS does to reconcile with it. They
+// are not hockeypuck's own output, so that a change to the canonical form
+// cannot go unnoticed.
+var sksDigests = []struct {
+	name   string
+	digest string
+}{
+	{"sksdigest.asc", "da84f40d830a7be2a3c0b7f2e146bfaa"},
+	{"252B8B37.dupsig.asc", "6d57b48c83d6322076d634059bb3b94b"},
+	{"0xd46b7c827be290fe4d1f9291b1ebc61a.asc", "0005127a8b7da8c32998d7e81dc92540"},
+}
+
+func (s *KeysSuite) TestSksCanonical(c *gc.C) {
+	for _, vec := range sksDigests {
+		comment := gc.Commentf("%s", vec.name)
+		blob := mustInput(c, vec.name)
+		digest, err := Digest(blob)
+		c.Assert(err, gc.IsNil, comment)
+		c.Check(digest, gc.Equals, vec.digest, comment)
+
+		sksForm, err := SksCanonical(blob)
+		c.Assert(err, gc.IsNil, comment)
+		sum := md5.Sum(sksForm)
+		c.Check(hex.EncodeToString(sum[:]), gc.Equals, vec.digest, comment)
+
+		// Packets are ordered by tag, then by contents.
+		var lastTag uint32
+		var lastContents []byte
+		for r := sksForm; len(r) > 0; {
+			c.Assert(len(r) >= 8, gc.Equals, true, comment)
+			tag := binary.BigEndian.Uint32(r)
+			n := binary.BigEndian.Uint32(r[4:])
+			contents := r[8 : 8+n]
+			c.Assert(tag > lastTag || (tag == lastTag && bytes.Compare(contents, lastContents) >= 0),
+				gc.Equals, true, comment)
+			lastTag, lastContents = tag, contents
+			r = r[8+n:]
+		}
+
+		// The order in which packets are read makes no difference.
+		canonical, err := Canonicalize(blob)
+		c.Assert(err, gc.IsNil, comment)
+		again, err := SksCanonical(canonical)
+		c.Assert(err, gc.IsNil, comment)
+		c.Check(again, gc.DeepEquals, sksForm, comment)
+	}
+}
+
+func (s *KeysSuite) TestCanonicalize(c *gc.C) {
+	blob := mustInput(c, "alice_signed.asc")
+	canonical, err := Canonicalize(blob)
+	c.Assert(err, gc.IsNil)
+
+	again, err := Canonicalize(canonical)
+	c.Assert(err, gc.IsNil)
+	c.Assert(again, gc.DeepEquals, canonical)
+
+	// Repeated packets do not change the canonical form.
+	keys := openpgp.MustReadOpaqueKeys(bytes.NewReader(canonical))
+	c.Assert(keys, gc.HasLen, 1)
+	var buf bytes.Buffer
+	for _, op := range append(keys[0].Packets, keys[0].Packets[1:]...) {
+		c.Assert(op.Serialize(&buf), gc.IsNil)
+	}
+	again, err = Canonicalize(buf.Bytes())
+	c.Assert(err, gc.IsNil)
+	c.Assert(again, gc.DeepEquals, canonical)
+}
+
+func (s *KeysSuite) TestMerge(c *gc.C) {
+	unsigned := mustInput(c, "alice_unsigned.asc")
+	signed := mustInput(c, "alice_signed.asc")
+	signedDigest, err := Digest(signed)
+	c.Assert(err, gc.IsNil)
+
+	for _, pair := range [][2][]byte{{unsigned, signed}, {signed, unsigned}, {signed, signed}} {
+		merged, err := Merge(pair[0], pair[1])
+		c.Assert(err, gc.IsNil)
+		digest, err := Digest(merged)
+		c.Assert(err, gc.IsNil)
+		c.Assert(digest, gc.Equals, signedDigest)
+	}
+}
+
+func (s *KeysSuite) TestMergeMismatch(c *gc.C) {
+	_, err := Merge(mustInput(c, "alice_signed.asc"), mustInput(c, "uat.asc"))
+	c.Assert(errors.Is(err, ErrFingerprintMismatch), gc.Equals, true)
+}
+
+func (s *KeysSuite) TestSplit(c *gc.C) {
+	var keyring []byte
+	for _, name := range []string{"alice_signed.asc", "uat.asc"} {
+		canonical, err := Canonicalize(mustInput(c, name))
+		c.Assert(err, gc.IsNil)
+		keyring = append(keyring, canonical...)
+	}
+	blobs, err := Split(keyring)
+	c.Assert(err, gc.IsNil)
+	c.Assert(blobs, gc.HasLen, 2)
+
+	_, err = Digest(keyring)
+	c.Assert(errors.Is(err, ErrMultipleKeys), gc.Equals, true)
+	_, err = Digest(nil)
+	c.Assert(errors.Is(err, ErrNoKey), gc.Equals, true)
+}
@@ -0,0 +1,212 @@
+package pghkp
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
+
+	hkpstorage "hockeypuck/hkp/storage"
+	log "hockeypuck/logrus"
+	"hockeypuck/openpgp"
+)
+
+var _ hkpstorage.BatchInserter = (*storage)(nil)
+
+const (
+	// copyBatchSize is the number of keys above which a batch is copied
+	// into a temporary table, rather than inserted with one statement.
+	copyBatchSize = 100
+
+	// subkeyBatchSize is the number of subkeys inserted per statement,
+	// keeping the number of parameters well within PostgreSQL's limit.
+	subkeyBatchSize = 1000
+)
+
+// InsertBatch implements storage.BatchInserter. The keys are inserted in one
+// transaction, with a multi-row INSERT for small batches and COPY for large
+// ones. If the transaction fails, such as on a key which conflicts with a
+// stored key other than by fingerprint, the keys are inserted one at a time
+// to find which of them failed.
+func (st *storage) InsertBatch(keys []*openpgp.PrimaryKey) (int, error) {
+	var result hkpstorage.InsertError
+	var rows []*keyRow
+	for _, key := range keys {
+		row, err := st.newKeyRow(key)
+		if err != nil {
+			result.Errors = append(result.Errors, err)
+			continue
+		}
+		rows = append(rows, row)
+	}
+	if len(rows) == 0 {
+		if len(result.Errors) > 0 {
+			return 0, result
+		}
+		return 0, nil
+	}
+
+	inserted, err := st.insertBatch(rows)
+	if err != nil {
+		logger.WithFields(log.Fields{
+			"keys":  len(rows),
+			"error": err,
+		}).Warning("cannot insert batch, inserting keys individually")
+		return st.Insert(keys)
+	}
+
+	var n int
+	for _, row := range rows {
+		if !inserted[row.key.RFingerprint] {
+			result.Duplicates = append(result.Duplicates, row.key)
+			continue
+		}
+		st.Notify(hkpstorage.KeyAdded{
+			ID:     row.key.KeyID(),
+			Digest: row.key.MD5,
+		})
+		n++
+	}
+	if len(result.Duplicates) > 0 || len(result.Errors) > 0 {
+		return n, result
+	}
+	return n, nil
+}
+
+// insertBatch inserts rows in one transaction, returning the fingerprints of
+// the keys which were inserted or gained a subkey. As with insertKey, other
+// keys are duplicates.
+func (st *storage) insertBatch(rows []*keyRow) (_ map[string]bool, retErr error) {
+	tx, err := st.Begin()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer func() {
+		if retErr != nil {
+			tx.Rollback()
+		} else {
+			retErr = tx.Commit()
+		}
+	}()
+
+	now := time.Now().UTC()
+	var inserted map[string]bool
+	if len(rows) > copyBatchSize {
+		inserted, err = copyKeysTx(tx, rows, now)
+	} else {
+		inserted, err = insertKeysTx(tx, rows, now)
+	}
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	err = insertSubkeysTx(tx, rows, inserted)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return inserted, nil
+}
+
+// insertKeysTx inserts rows with a multi-row INSERT.
+func insertKeysTx(tx *sql.Tx, rows []*keyRow, now time.Time) (map[string]bool, error) {
+	var values []string
+	var args []interface{}
+	for _, row := range rows {
+		n := len(args)
+		values = append(values, fmt.Sprintf("($%d::TEXT, $%d::TIMESTAMP, $%d::TIMESTAMP, $%d::TEXT, $%d::JSONB, "+
+			"to_tsvector($%d), $%d::TIMESTAMPTZ, $%d::TIMESTAMPTZ)", n+1, n+2, n+2, n+3, n+4, n+5, n+6, n+7))
+		args = append(args, row.key.RFingerprint, now, row.key.MD5, row.doc, row.keywords, row.kctime, row.kexpiry)
+	}
+	return queryRFingerprints(tx, "INSERT INTO keys (rfingerprint, ctime, mtime, md5, doc, keywords, kctime, kexpiry) "+
+		"VALUES "+strings.Join(values, ", ")+" ON CONFLICT (rfingerprint) DO NOTHING RETURNING rfingerprint", args...)
+}
+
+// copyKeysTx copies rows into a temporary table, from which those not
+// already stored are inserted.
+func copyKeysTx(tx *sql.Tx, rows []*keyRow, now time.Time) (map[string]bool, error) {
+	_, err := tx.Exec("CREATE TEMPORARY TABLE keys_batch (" +
+		"rfingerprint TEXT, md5 TEXT, doc JSONB, keywords TEXT, kctime TIMESTAMPTZ, kexpiry TIMESTAMPTZ" +
+		") ON COMMIT DROP")
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	stmt, err := tx.Prepare(pq.CopyIn("keys_batch", "rfingerprint", "md5", "doc", "keywords", "kctime", "kexpiry"))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	for _, row := range rows {
+		_, err = stmt.Exec(row.key.RFingerprint, row.key.MD5, row.doc, row.keywords, row.kctime, row.kexpiry)
+		if err != nil {
+			stmt.Close()
+			return nil, errors.Wrapf(err, "cannot copy rfp=%q", row.key.RFingerprint)
+		}
+	}
+	_, err = stmt.Exec()
+	if err != nil {
+		stmt.Close()
+		return nil, errors.WithStack(err)
+	}
+	err = stmt.Close()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return queryRFingerprints(tx, "INSERT INTO keys (rfingerprint, ctime, mtime, md5, doc, keywords, kctime, kexpiry) "+
+		"SELECT rfingerprint, $1::TIMESTAMP, $1::TIMESTAMP, md5, doc, to_tsvector(keywords), kctime, kexpiry "+
+		"FROM keys_batch ON CONFLICT (rfingerprint) DO NOTHING RETURNING rfingerprint", now)
+}
+
+// insertSubkeysTx inserts the subkeys of rows which are not already stored,
+// adding the fingerprints of their primary keys to inserted.
+func insertSubkeysTx(tx *sql.Tx, rows []*keyRow, inserted map[string]bool) error {
+	var values []string
+	var args []interface{}
+	flush := func() error {
+		if len(values) == 0 {
+			return nil
+		}
+		rfps, err := queryRFingerprints(tx, "INSERT INTO subkeys (rfingerprint, rsubfp) "+
+			"VALUES "+strings.Join(values, ", ")+" ON CONFLICT (rsubfp) DO NOTHING RETURNING rfingerprint", args...)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		for rfp := range rfps {
+			inserted[rfp] = true
+		}
+		values, args = nil, nil
+		return nil
+	}
+	for _, row := range rows {
+		for _, subKey := range row.key.SubKeys {
+			n := len(args)
+			values = append(values, fmt.Sprintf("($%d::TEXT, $%d::TEXT)", n+1, n+2))
+			args = append(args, row.key.RFingerprint, subKey.RFingerprint)
+			if len(values) == subkeyBatchSize {
+				err := flush()
+				if err != nil {
+					return errors.WithStack(err)
+				}
+			}
+		}
+	}
+	return errors.WithStack(flush())
+}
+
+func queryRFingerprints(tx *sql.Tx, query string, args ...interface{}) (map[string]bool, error) {
+	rows, err := tx.Query(query, args...)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer rows.Close()
+	result := make(map[string]bool)
+	for rows.Next() {
+		var rfp string
+		err = rows.Scan(&rfp)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		result[rfp] = true
+	}
+	return result, errors.WithStack(rows.Err())
+}
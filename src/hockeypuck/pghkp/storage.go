@@ -19,6 +19,7 @@ package pghkp
 
 import (
 	"bytes"
+	"context"
 	"database/sql"
 	"encoding/hex"
 	"encoding/json"
@@ -29,15 +30,18 @@ import (
 	"unicode"
 	"unicode/utf8"
 
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 	"github.com/pkg/errors"
 
 	"hockeypuck/hkp/jsonhkp"
 	hkpstorage "hockeypuck/hkp/storage"
+	"hockeypuck/logging"
 	log "hockeypuck/logrus"
 	"hockeypuck/openpgp"
 )
 
+var logger = logging.Module("storage")
+
 const (
 	maxInsertErrors = 100
 )
@@ -46,12 +50,24 @@ type storage struct {
 	*sql.DB
 	dbName  string
 	options []openpgp.KeyReaderOption
+	search  SearchOptions
 
 	mu        sync.Mutex
 	listeners []func(hkpstorage.KeyChange) error
+
+	cacheStmts bool
+	muStmts    sync.Mutex
+	stmts      map[string]*sql.Stmt
 }
 
 var _ hkpstorage.Storage = (*storage)(nil)
+var _ hkpstorage.Maintainer = (*storage)(nil)
+var _ hkpstorage.Renotifier = (*storage)(nil)
+var _ hkpstorage.ModTimeFetcher = (*storage)(nil)
+var _ hkpstorage.ProvenanceRecorder = (*storage)(nil)
+var _ hkpstorage.Pinger = (*storage)(nil)
+var _ hkpstorage.DomainMatcher = (*storage)(nil)
+var _ hkpstorage.DigestFetcher = (*storage)(nil)
 
 var crTablesSQL = []string{
 	`CREATE TABLE IF NOT EXISTS keys (
@@ -62,12 +78,23 @@ mtime TIMESTAMP WITH TIME ZONE NOT NULL,
 md5 TEXT NOT NULL UNIQUE,
 keywords tsvector
 )`,
+	`ALTER TABLE keys ADD COLUMN IF NOT EXISTS kctime TIMESTAMP WITH TIME ZONE`,
+	`ALTER TABLE keys ADD COLUMN IF NOT EXISTS kexpiry TIMESTAMP WITH TIME ZONE`,
+	// kunparsed marks keys whose times could not be backfilled, so that
+	// they are not parsed again each time the backfill runs.
+	`ALTER TABLE keys ADD COLUMN IF NOT EXISTS kunparsed BOOLEAN`,
 	`CREATE TABLE IF NOT EXISTS subkeys (
 rfingerprint TEXT NOT NULL,
 rsubfp TEXT NOT NULL PRIMARY KEY,
 FOREIGN KEY (rfingerprint) REFERENCES keys(rfingerprint)
 )
 `,
+	// Provenance outlives replacement of the key, so it does not refer to
+	// the keys table.
+	`CREATE TABLE IF NOT EXISTS provenance (
+rfingerprint TEXT NOT NULL PRIMARY KEY,
+ptime TIMESTAMP WITH TIME ZONE NOT NULL
+)`,
 }
 
 var crIndexesSQL = []string{
@@ -75,6 +102,8 @@ var crIndexesSQL = []string{
 	`CREATE INDEX IF NOT EXISTS keys_ctime ON keys(ctime);`,
 	`CREATE INDEX IF NOT EXISTS keys_mtime ON keys(mtime);`,
 	`CREATE INDEX IF NOT EXISTS keys_keywords ON keys USING gin(keywords);`,
+	`CREATE INDEX IF NOT EXISTS keys_kctime ON keys(kctime);`,
+	`CREATE INDEX IF NOT EXISTS keys_kexpiry ON keys(kexpiry);`,
 	`CREATE INDEX IF NOT EXISTS subkeys_rfp ON subkeys(rsubfp text_pattern_ops);`,
 }
 
@@ -85,27 +114,93 @@ var drConstraintsSQL = []string{
 	`DROP INDEX keys_ctime;`,
 	`DROP INDEX keys_mtime;`,
 	`DROP INDEX keys_keywords;`,
+	`DROP INDEX keys_kctime;`,
+	`DROP INDEX keys_kexpiry;`,
 
 	`ALTER TABLE subkeys DROP CONSTRAINT subkeys_pk;`,
 	`ALTER TABLE subkeys DROP CONSTRAINT subkeys_fk;`,
 	`DROP INDEX subkeys_rfp;`,
 }
 
+// SearchOptions controls how keyword searches match user IDs.
+type SearchOptions struct {
+	// Prefix matches each search term as a prefix of the indexed keywords,
+	// so that "jenn" finds "jennyo@transient.net".
+	Prefix bool
+
+	// DomainComponents indexes the parent domains of email addresses, so
+	// that a search for "@example.com" also finds addresses at
+	// "mail.example.com". It applies to keys as they are next written.
+	DomainComponents bool
+}
+
+// Option configures PostgreSQL storage.
+type Option func(*storage)
+
+// WithSearch sets how keyword searches match user IDs.
+func WithSearch(search SearchOptions) Option {
+	return func(st *storage) {
+		st.search = search
+	}
+}
+
+// PoolOptions limits the connections held open to the database. Zero
+// values leave the database/sql defaults.
+type PoolOptions struct {
+	// MaxOpenConns limits the number of connections in use and idle.
+	MaxOpenConns int
+
+	// MaxIdleConns limits the number of idle connections kept for reuse.
+	MaxIdleConns int
+
+	// ConnMaxLifetime is how long a connection may be reused before it is
+	// closed, so that connections are rebalanced after a failover.
+	ConnMaxLifetime time.Duration
+}
+
+// WithPool sets the limits of the connection pool.
+func WithPool(pool PoolOptions) Option {
+	return func(st *storage) {
+		if pool.MaxOpenConns > 0 {
+			st.SetMaxOpenConns(pool.MaxOpenConns)
+		}
+		if pool.MaxIdleConns > 0 {
+			st.SetMaxIdleConns(pool.MaxIdleConns)
+		}
+		if pool.ConnMaxLifetime > 0 {
+			st.SetConnMaxLifetime(pool.ConnMaxLifetime)
+		}
+	}
+}
+
+// WithStatementCache keeps the statements of frequent queries prepared for
+// the life of the storage, rather than preparing them for each call. It
+// should not be used through a connection pooler which does not support
+// prepared statements, such as PgBouncer in transaction pooling mode.
+func WithStatementCache() Option {
+	return func(st *storage) {
+		st.cacheStmts = true
+	}
+}
+
 // Dial returns PostgreSQL storage connected to the given database URL.
-func Dial(url string, options []openpgp.KeyReaderOption) (hkpstorage.Storage, error) {
+func Dial(url string, options []openpgp.KeyReaderOption, opts ...Option) (hkpstorage.Storage, error) {
 	db, err := sql.Open("postgres", url)
 	if err != nil {
 		return nil, errors.WithStack(err)
 	}
-	return New(db, options)
+	return New(db, options, opts...)
 }
 
 // New returns a PostgreSQL storage implementation for an HKP service.
-func New(db *sql.DB, options []openpgp.KeyReaderOption) (hkpstorage.Storage, error) {
+func New(db *sql.DB, options []openpgp.KeyReaderOption, opts ...Option) (hkpstorage.Storage, error) {
 	st := &storage{
 		DB:      db,
 		options: options,
 	}
+	for _, opt := range opts {
+		opt(st)
+	}
 	err := st.createTables()
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to create tables")
@@ -117,6 +212,43 @@ func New(db *sql.DB, options []openpgp.KeyReaderOption) (hkpstorage.Storage, err
 	return st, nil
 }
 
+// prepare returns a prepared statement for query, and a function to call
+// when done with it. Cached statements are kept until the storage is closed.
+func (st *storage) prepare(query string) (*sql.Stmt, func(), error) {
+	if !st.cacheStmts {
+		stmt, err := st.Prepare(query)
+		if err != nil {
+			return nil, nil, errors.WithStack(err)
+		}
+		return stmt, func() { stmt.Close() }, nil
+	}
+	st.muStmts.Lock()
+	defer st.muStmts.Unlock()
+	if stmt, ok := st.stmts[query]; ok {
+		return stmt, func() {}, nil
+	}
+	stmt, err := st.Prepare(query)
+	if err != nil {
+		return nil, nil, errors.WithStack(err)
+	}
+	if st.stmts == nil {
+		st.stmts = map[string]*sql.Stmt{}
+	}
+	st.stmts[query] = stmt
+	return stmt, func() {}, nil
+}
+
+// Close closes any cached statements and the database.
+func (st *storage) Close() error {
+	st.muStmts.Lock()
+	for query, stmt := range st.stmts {
+		stmt.Close()
+		delete(st.stmts, query)
+	}
+	st.muStmts.Unlock()
+	return errors.WithStack(st.DB.Close())
+}
+
 func (st *storage) createTables() error {
 	for _, crTableSQL := range crTablesSQL {
 		_, err := st.Exec(crTableSQL)
@@ -137,6 +269,146 @@ func (st *storage) createIndexes() error {
 	return nil
 }
 
+// backfillPageSize is the number of keys read at a time when filling in the
+// creation and expiration times of keys stored before they were recorded.
+const backfillPageSize = 1000
+
+// backfillKeyTimes fills in kctime and kexpiry for keys stored before these
+// columns were added, so that MatchTimeRange finds them. It pages through
+// the keys still missing them in rfingerprint order, and does nothing once
+// every key has been filled in. Keys which fail to parse are marked as
+// such and not tried again; they are filled in when they are next written.
+func (st *storage) backfillKeyTimes(ctx context.Context) error {
+	var after string
+	var filled, skipped int
+	start := time.Now()
+	for {
+		rows, err := st.QueryContext(ctx, "SELECT rfingerprint, md5, doc FROM keys "+
+			"WHERE kctime IS NULL AND kunparsed IS NOT TRUE AND rfingerprint > $1 ORDER BY rfingerprint LIMIT $2",
+			after, backfillPageSize)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		var page []*openpgp.PrimaryKey
+		var unparsed []string
+		var n int
+		for rows.Next() {
+			var rfp, digest, bufStr string
+			err = rows.Scan(&rfp, &digest, &bufStr)
+			if err != nil {
+				rows.Close()
+				return errors.WithStack(err)
+			}
+			n++
+			after = rfp
+			var pk jsonhkp.PrimaryKey
+			err = json.Unmarshal([]byte(bufStr), &pk)
+			if err != nil {
+				logger.Warningf("cannot backfill times of key %q: %v", rfp, err)
+				unparsed = append(unparsed, rfp)
+				continue
+			}
+			key, err := readOneKey(pk.Bytes(), rfp, digest)
+			if err != nil || key == nil {
+				logger.Warningf("cannot backfill times of key %q: %v", rfp, err)
+				unparsed = append(unparsed, rfp)
+				continue
+			}
+			page = append(page, key)
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if n == 0 {
+			break
+		}
+		err = st.updateKeyTimes(ctx, page, unparsed)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		filled += len(page)
+		skipped += len(unparsed)
+		logger.Infof("backfilled times of %d keys", filled)
+	}
+	if filled > 0 || skipped > 0 {
+		logger.WithFields(log.Fields{
+			"filled":   filled,
+			"skipped":  skipped,
+			"duration": time.Since(start).String(),
+		}).Info("backfilled key creation and expiration times")
+	}
+	return nil
+}
+
+// updateKeyTimes sets the creation and expiration times of keys, without
+// touching their modification times, and marks those with the unparsed
+// fingerprints. Keys written since they were read already have their times,
+// and are left alone.
+func (st *storage) updateKeyTimes(ctx context.Context, keys []*openpgp.PrimaryKey, unparsed []string) error {
+	tx, err := st.BeginTx(ctx, nil)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	stmt, err := tx.Prepare("UPDATE keys SET kctime = $1, kexpiry = $2 WHERE rfingerprint = $3 AND kctime IS NULL")
+	if err != nil {
+		tx.Rollback()
+		return errors.WithStack(err)
+	}
+	defer stmt.Close()
+	for _, key := range keys {
+		kctime, kexpiry := keyTimes(key)
+		_, err = stmt.Exec(kctime, kexpiry, key.RFingerprint)
+		if err != nil {
+			tx.Rollback()
+			return errors.WithStack(err)
+		}
+	}
+	for _, rfp := range unparsed {
+		_, err = tx.Exec("UPDATE keys SET kunparsed = TRUE WHERE rfingerprint = $1 AND kctime IS NULL", rfp)
+		if err != nil {
+			tx.Rollback()
+			return errors.WithStack(err)
+		}
+	}
+	return errors.WithStack(tx.Commit())
+}
+
+var maintenanceSQL = map[string][]string{
+	hkpstorage.MaintainVacuum: {
+		`VACUUM (FULL, ANALYZE) keys`,
+		`VACUUM (FULL, ANALYZE) subkeys`,
+	},
+	hkpstorage.MaintainReindex: {
+		`REINDEX TABLE keys`,
+		`REINDEX TABLE subkeys`,
+	},
+}
+
+// Maintain runs a maintenance task. Vacuuming locks the tables until it is
+// done, and reindexing blocks writes. Backfilling does neither.
+func (st *storage) Maintain(ctx context.Context, task string) error {
+	if task == hkpstorage.MaintainBackfill {
+		return errors.Wrap(st.backfillKeyTimes(ctx), "failed to backfill key times")
+	}
+	stmts, ok := maintenanceSQL[task]
+	if !ok {
+		return errors.Wrapf(hkpstorage.ErrNotSupported, "maintenance task %q", task)
+	}
+	for _, stmt := range stmts {
+		start := time.Now()
+		_, err := st.ExecContext(ctx, stmt)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		logger.WithFields(log.Fields{
+			"duration": time.Since(start).String(),
+		}).Info(stmt)
+	}
+	return nil
+}
+
 type keyDoc struct {
 	RFingerprint string
 	CTime        time.Time
@@ -186,12 +458,11 @@ func (st *storage) MatchMD5(md5s []string) ([]string, error) {
 // currently won't match.
 func (st *storage) Resolve(keyids []string) (_ []string, retErr error) {
 	var result []string
-	sqlStr := "SELECT rfingerprint FROM keys WHERE rfingerprint LIKE $1 || '%'"
-	stmt, err := st.Prepare(sqlStr)
+	stmt, done, err := st.prepare("SELECT rfingerprint FROM keys WHERE rfingerprint LIKE $1 || '%'")
 	if err != nil {
 		return nil, errors.WithStack(err)
 	}
-	defer stmt.Close()
+	defer done()
 
 	var subKeyIDs []string
 	for _, keyid := range keyids {
@@ -220,12 +491,11 @@ func (st *storage) Resolve(keyids []string) (_ []string, retErr error) {
 
 func (st *storage) resolveSubKeys(keyids []string) ([]string, error) {
 	var result []string
-	sqlStr := "SELECT rfingerprint FROM subkeys WHERE rsubfp LIKE $1 || '%'"
-	stmt, err := st.Prepare(sqlStr)
+	stmt, done, err := st.prepare("SELECT rfingerprint FROM subkeys WHERE rsubfp LIKE $1 || '%'")
 	if err != nil {
 		return nil, errors.WithStack(err)
 	}
-	defer stmt.Close()
+	defer done()
 
 	for _, keyid := range keyids {
 		keyid = strings.ToLower(keyid)
@@ -243,13 +513,23 @@ func (st *storage) resolveSubKeys(keyids []string) ([]string, error) {
 
 func (st *storage) MatchKeyword(search []string) ([]string, error) {
 	var result []string
-	stmt, err := st.Prepare("SELECT rfingerprint FROM keys WHERE keywords @@ plainto_tsquery($1) LIMIT $2")
+	query := "SELECT rfingerprint FROM keys WHERE keywords @@ plainto_tsquery($1) LIMIT $2"
+	if st.search.Prefix {
+		query = "SELECT rfingerprint FROM keys WHERE keywords @@ to_tsquery($1) LIMIT $2"
+	}
+	stmt, done, err := st.prepare(query)
 	if err != nil {
 		return nil, errors.WithStack(err)
 	}
-	defer stmt.Close()
+	defer done()
 
 	for _, term := range search {
+		if st.search.Prefix {
+			term = prefixTSQuery(term)
+			if term == "" {
+				continue
+			}
+		}
 		err = func() error {
 			rows, err := stmt.Query(term, 100)
 			if err != nil {
@@ -299,6 +579,117 @@ func (st *storage) ModifiedSince(t time.Time) ([]string, error) {
 	return result, nil
 }
 
+func (st *storage) ModifiedAfter(after hkpstorage.ModifiedKey, limit int) ([]hkpstorage.ModifiedKey, error) {
+	var result []hkpstorage.ModifiedKey
+	// Fingerprints are unique, except after a bulk load, so the digest is
+	// only needed to page through the rows of duplicate fingerprints.
+	query := "SELECT rfingerprint, mtime, md5 FROM keys " +
+		"WHERE mtime > $1 OR (mtime = $1 AND rfingerprint > $2) " +
+		"ORDER BY mtime, rfingerprint, md5 LIMIT $3"
+	args := []interface{}{after.MTime.UTC(), after.RFingerprint, limit}
+	if after.MD5 != "" {
+		query = "SELECT rfingerprint, mtime, md5 FROM keys " +
+			"WHERE mtime > $1 OR (mtime = $1 AND (rfingerprint > $2 OR (rfingerprint = $2 AND md5 > $4))) " +
+			"ORDER BY mtime, rfingerprint, md5 LIMIT $3"
+		args = append(args, after.MD5)
+	}
+	rows, err := st.Query(query, args...)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var mk hkpstorage.ModifiedKey
+		err = rows.Scan(&mk.RFingerprint, &mk.MTime, &mk.MD5)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		result = append(result, mk)
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return result, nil
+}
+
+// MatchDomain returns keys with an address in domain, which is stored as a
+// keyword of its own.
+func (st *storage) MatchDomain(domain string, after string, limit int) ([]string, error) {
+	stmt, done, err := st.prepare("SELECT rfingerprint FROM keys WHERE keywords @@ plainto_tsquery($1) " +
+		"AND rfingerprint > $2 ORDER BY rfingerprint LIMIT $3")
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer done()
+	rows, err := stmt.Query(strings.ToLower(domain), after, limit)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer rows.Close()
+	var result []string
+	for rows.Next() {
+		var rfp string
+		err = rows.Scan(&rfp)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		result = append(result, rfp)
+	}
+	return result, errors.WithStack(rows.Err())
+}
+
+// MatchTimeRange returns keys by their creation and expiration times. Keys
+// stored before these times were recorded are filled in when the storage is
+// opened, except for any which could not be parsed.
+func (st *storage) MatchTimeRange(r hkpstorage.TimeRange, limit int) ([]string, error) {
+	conds := []string{"kctime IS NOT NULL"}
+	var args []interface{}
+	where := func(cond string, t time.Time) {
+		args = append(args, t.UTC())
+		conds = append(conds, fmt.Sprintf(cond, len(args)))
+	}
+	if !r.CreatedAfter.IsZero() {
+		where("kctime > $%d", r.CreatedAfter)
+	}
+	if !r.CreatedBefore.IsZero() {
+		where("kctime < $%d", r.CreatedBefore)
+	}
+	if !r.ExpiresAfter.IsZero() {
+		where("(kexpiry IS NULL OR kexpiry > $%d)", r.ExpiresAfter)
+	}
+	if !r.ExpiresBefore.IsZero() {
+		where("kexpiry < $%d", r.ExpiresBefore)
+	}
+	args = append(args, limit)
+	rows, err := st.Query(fmt.Sprintf("SELECT rfingerprint FROM keys WHERE %s "+
+		"ORDER BY kctime, rfingerprint LIMIT $%d", strings.Join(conds, " AND "), len(args)), args...)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer rows.Close()
+	var result []string
+	for rows.Next() {
+		var rfp string
+		err = rows.Scan(&rfp)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		result = append(result, rfp)
+	}
+	return result, errors.WithStack(rows.Err())
+}
+
+// keyTimes returns the creation and expiration times of key to store, with
+// nil for a key which does not expire.
+func keyTimes(key *openpgp.PrimaryKey) (ctime time.Time, expiry *time.Time) {
+	if expiresAt, ok := key.ExpiresAt(); ok {
+		expiresAt = expiresAt.UTC()
+		expiry = &expiresAt
+	}
+	return key.Creation.UTC(), expiry
+}
+
 func (st *storage) FetchKeys(rfps []string) ([]*openpgp.PrimaryKey, error) {
 	if len(rfps) == 0 {
 		return nil, nil
@@ -310,18 +701,23 @@ func (st *storage) FetchKeys(rfps []string) ([]*openpgp.PrimaryKey, error) {
 		if err != nil {
 			return nil, errors.Wrapf(err, "invalid rfingerprint %q", rfp)
 		}
-		rfpIn = append(rfpIn, "'"+strings.ToLower(rfp)+"'")
+		rfpIn = append(rfpIn, strings.ToLower(rfp))
 	}
-	sqlStr := fmt.Sprintf("SELECT doc FROM keys WHERE rfingerprint IN (%s)", strings.Join(rfpIn, ","))
-	rows, err := st.Query(sqlStr)
+	stmt, done, err := st.prepare("SELECT md5, doc FROM keys WHERE rfingerprint = ANY($1)")
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer done()
+	rows, err := stmt.Query(pq.Array(rfpIn))
 	if err != nil {
 		return nil, errors.WithStack(err)
 	}
+	defer rows.Close()
 
 	var result []*openpgp.PrimaryKey
 	for rows.Next() {
-		var bufStr string
-		err = rows.Scan(&bufStr)
+		var digest, bufStr string
+		err = rows.Scan(&digest, &bufStr)
 		if err != nil && err != sql.ErrNoRows {
 			return nil, errors.WithStack(err)
 		}
@@ -332,7 +728,7 @@ func (st *storage) FetchKeys(rfps []string) ([]*openpgp.PrimaryKey, error) {
 		}
 
 		rfp := openpgp.Reverse(pk.Fingerprint)
-		key, err := readOneKey(pk.Bytes(), rfp)
+		key, err := readOneKey(pk.Bytes(), rfp, digest)
 		if err != nil {
 			return nil, errors.WithStack(err)
 		}
@@ -346,6 +742,28 @@ func (st *storage) FetchKeys(rfps []string) ([]*openpgp.PrimaryKey, error) {
 	return result, nil
 }
 
+func (st *storage) FetchKeyByMD5(digest string) (*openpgp.PrimaryKey, error) {
+	var rfp, bufStr string
+	err := st.QueryRow("SELECT rfingerprint, doc FROM keys WHERE md5 = $1", strings.ToLower(digest)).Scan(&rfp, &bufStr)
+	if err == sql.ErrNoRows {
+		return nil, errors.WithStack(hkpstorage.ErrKeyNotFound)
+	} else if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	var pk jsonhkp.PrimaryKey
+	err = json.Unmarshal([]byte(bufStr), &pk)
+	if err != nil {
+		return nil, errors.WithStack(&hkpstorage.UnparseableError{Digest: digest, Err: err})
+	}
+	key, err := readOneKey(pk.Bytes(), rfp, strings.ToLower(digest))
+	if err != nil {
+		return nil, errors.WithStack(&hkpstorage.UnparseableError{Digest: digest, Err: err})
+	} else if key == nil {
+		return nil, errors.WithStack(&hkpstorage.UnparseableError{Digest: digest, Err: errors.New("no key in document")})
+	}
+	return key, nil
+}
+
 func (st *storage) FetchKeyrings(rfps []string) ([]*hkpstorage.Keyring, error) {
 	var rfpIn []string
 	for _, rfp := range rfps {
@@ -376,7 +794,7 @@ func (st *storage) FetchKeyrings(rfps []string) ([]*hkpstorage.Keyring, error) {
 		}
 
 		rfp := openpgp.Reverse(pk.Fingerprint)
-		key, err := readOneKey(pk.Bytes(), rfp)
+		key, err := readOneKey(pk.Bytes(), rfp, "")
 		if err != nil {
 			return nil, errors.WithStack(err)
 		}
@@ -391,8 +809,123 @@ func (st *storage) FetchKeyrings(rfps []string) ([]*hkpstorage.Keyring, error) {
 	return result, nil
 }
 
-func readOneKey(b []byte, rfingerprint string) (*openpgp.PrimaryKey, error) {
-	kr := openpgp.NewKeyReader(bytes.NewBuffer(b))
+func (st *storage) FetchModTimes(rfps []string) (map[string]time.Time, error) {
+	if len(rfps) == 0 {
+		return nil, nil
+	}
+
+	rfpIn, err := rfingerprintsIn(rfps)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	stmt, done, err := st.prepare("SELECT rfingerprint, mtime FROM keys WHERE rfingerprint = ANY($1)")
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer done()
+	rows, err := stmt.Query(pq.Array(rfpIn))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer rows.Close()
+
+	result := map[string]time.Time{}
+	for rows.Next() {
+		var rfp string
+		var mtime time.Time
+		err = rows.Scan(&rfp, &mtime)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		result[rfp] = mtime
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return result, nil
+}
+
+// rfingerprintsIn checks and normalizes rfingerprints to be matched with
+// ANY.
+func rfingerprintsIn(rfps []string) ([]string, error) {
+	var rfpIn []string
+	for _, rfp := range rfps {
+		_, err := hex.DecodeString(rfp)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid rfingerprint %q", rfp)
+		}
+		rfpIn = append(rfpIn, strings.ToLower(rfp))
+	}
+	return rfpIn, nil
+}
+
+func (st *storage) RecordProvenance(rfps []string) error {
+	if len(rfps) == 0 {
+		return nil
+	}
+	rfpIn, err := rfingerprintsIn(rfps)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	stmt, done, err := st.prepare("INSERT INTO provenance (rfingerprint, ptime) " +
+		"SELECT unnest($1::text[]), now() " +
+		"ON CONFLICT (rfingerprint) DO UPDATE SET ptime = EXCLUDED.ptime")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer done()
+	_, err = stmt.Exec(pq.Array(rfpIn))
+	return errors.WithStack(err)
+}
+
+func (st *storage) FetchProvenance(rfps []string) (map[string]time.Time, error) {
+	if len(rfps) == 0 {
+		return nil, nil
+	}
+	rfpIn, err := rfingerprintsIn(rfps)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	stmt, done, err := st.prepare("SELECT rfingerprint, ptime FROM provenance WHERE rfingerprint = ANY($1)")
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer done()
+	rows, err := stmt.Query(pq.Array(rfpIn))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer rows.Close()
+
+	result := map[string]time.Time{}
+	for rows.Next() {
+		var rfp string
+		var ptime time.Time
+		err = rows.Scan(&rfp, &ptime)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		result[rfp] = ptime
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return result, nil
+}
+
+// readOneKey parses a stored key. If digest is set, it is taken as the
+// digest of the key, which was calculated when the key was stored, rather
+// than digesting it again.
+func readOneKey(b []byte, rfingerprint, digest string) (*openpgp.PrimaryKey, error) {
+	var options []openpgp.KeyReaderOption
+	if digest != "" {
+		options = append(options, openpgp.KnownDigest(func(rfp string) (string, bool) {
+			return digest, rfp == rfingerprint
+		}))
+	}
+	kr := openpgp.NewKeyReader(bytes.NewBuffer(b), options...)
 	keys, err := kr.Read()
 	if err != nil {
 		return nil, errors.WithStack(err)
@@ -424,9 +957,36 @@ func (st *storage) insertKey(key *openpgp.PrimaryKey) (isDuplicate bool, retErr
 	return st.insertKeyTx(tx, key)
 }
 
+// keyRow is a key as it is inserted into the keys table.
+type keyRow struct {
+	key      *openpgp.PrimaryKey
+	doc      string
+	keywords string
+	kctime   time.Time
+	kexpiry  *time.Time
+}
+
+func (st *storage) newKeyRow(key *openpgp.PrimaryKey) (*keyRow, error) {
+	openpgp.Sort(key)
+
+	jsonKey := jsonhkp.NewPrimaryKey(key)
+	jsonBuf, err := json.Marshal(jsonKey)
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot serialize rfp=%q", key.RFingerprint)
+	}
+	kctime, kexpiry := keyTimes(key)
+	return &keyRow{
+		key:      key,
+		doc:      string(jsonBuf),
+		keywords: st.keywordsTSVector(key),
+		kctime:   kctime,
+		kexpiry:  kexpiry,
+	}, nil
+}
+
 func (st *storage) insertKeyTx(tx *sql.Tx, key *openpgp.PrimaryKey) (isDuplicate bool, retErr error) {
-	stmt, err := tx.Prepare("INSERT INTO keys (rfingerprint, ctime, mtime, md5, doc, keywords) " +
-		"SELECT $1::TEXT, $2::TIMESTAMP, $3::TIMESTAMP, $4::TEXT, $5::JSONB, to_tsvector($6) " +
+	stmt, err := tx.Prepare("INSERT INTO keys (rfingerprint, ctime, mtime, md5, doc, keywords, kctime, kexpiry) " +
+		"SELECT $1::TEXT, $2::TIMESTAMP, $3::TIMESTAMP, $4::TEXT, $5::JSONB, to_tsvector($6), $7::TIMESTAMPTZ, $8::TIMESTAMPTZ " +
 		"WHERE NOT EXISTS (SELECT 1 FROM keys WHERE rfingerprint = $1)")
 	if err != nil {
 		return false, errors.WithStack(err)
@@ -440,18 +1000,12 @@ func (st *storage) insertKeyTx(tx *sql.Tx, key *openpgp.PrimaryKey) (isDuplicate
 	}
 	defer subStmt.Close()
 
-	openpgp.Sort(key)
-
-	now := time.Now().UTC()
-	jsonKey := jsonhkp.NewPrimaryKey(key)
-	jsonBuf, err := json.Marshal(jsonKey)
+	row, err := st.newKeyRow(key)
 	if err != nil {
-		return false, errors.Wrapf(err, "cannot serialize rfp=%q", key.RFingerprint)
+		return false, errors.WithStack(err)
 	}
-
-	jsonStr := string(jsonBuf)
-	keywords := keywordsTSVector(key)
-	result, err := stmt.Exec(&key.RFingerprint, &now, &now, &key.MD5, &jsonStr, &keywords)
+	now := time.Now().UTC()
+	result, err := stmt.Exec(&key.RFingerprint, &now, &now, &key.MD5, &row.doc, &row.keywords, row.kctime, row.kexpiry)
 	if err != nil {
 		return false, errors.Wrapf(err, "cannot insert rfp=%q", key.RFingerprint)
 	}
@@ -548,6 +1102,10 @@ func (st *storage) Delete(fp string) (_ string, retErr error) {
 	if err != nil {
 		return "", errors.WithStack(err)
 	}
+	_, err = tx.Exec("DELETE FROM provenance WHERE rfingerprint = $1", openpgp.Reverse(fp))
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
 	return md5, nil
 }
 
@@ -589,10 +1147,11 @@ func (st *storage) Update(key *openpgp.PrimaryKey, lastID string, lastMD5 string
 	if err != nil {
 		return errors.Wrapf(err, "cannot serialize rfp=%q", key.RFingerprint)
 	}
-	keywords := keywordsTSVector(key)
-	_, err = tx.Exec("UPDATE keys SET mtime = $1, md5 = $2, keywords = to_tsvector($3), doc = $4 "+
-		"WHERE rfingerprint = $5",
-		&now, &key.MD5, &keywords, jsonBuf, &key.RFingerprint)
+	keywords := st.keywordsTSVector(key)
+	kctime, kexpiry := keyTimes(key)
+	_, err = tx.Exec("UPDATE keys SET mtime = $1, md5 = $2, keywords = to_tsvector($3), doc = $4, "+
+		"kctime = $6, kexpiry = $7 WHERE rfingerprint = $5",
+		&now, &key.MD5, &keywords, jsonBuf, &key.RFingerprint, kctime, kexpiry)
 	if err != nil {
 		return errors.WithStack(err)
 	}
@@ -614,8 +1173,8 @@ func (st *storage) Update(key *openpgp.PrimaryKey, lastID string, lastMD5 string
 	return nil
 }
 
-func keywordsTSVector(key *openpgp.PrimaryKey) string {
-	keywords := keywordsFromKey(key)
+func (st *storage) keywordsTSVector(key *openpgp.PrimaryKey) string {
+	keywords := keywordsFromKey(key, st.search.DomainComponents)
 	tsv, err := keywordsToTSVector(keywords)
 	if err != nil {
 		// In this case we've found a key that generated
@@ -625,7 +1184,10 @@ func keywordsTSVector(key *openpgp.PrimaryKey) string {
 		// In the future we should catch this earlier and
 		// reject it as a bad key, but for now we just skip
 		// storing keyword information.
-		log.Warningf("keywords for rfp=%q exceeds limit, ignoring: %v", key.RFingerprint, err)
+		logger.WithFields(log.Fields{
+			"fp":    key.Fingerprint(),
+			"error": err,
+		}).Warning("keywords exceed limit, ignoring")
 		return ""
 	}
 	return tsv
@@ -654,10 +1216,36 @@ func keywordsToTSVector(keywords []string) (string, error) {
 	return tsv, nil
 }
 
+// prefixTSQuery converts a keyword search to a PostgreSQL
+// tsquery matching each of its terms as a prefix.
+func prefixTSQuery(search string) string {
+	var terms []string
+	for _, field := range strings.Fields(strings.ToLower(search)) {
+		field = strings.Replace(field, `\`, `\\`, -1)
+		field = strings.Replace(field, "'", "''", -1)
+		terms = append(terms, "'"+field+"':*")
+	}
+	return strings.Join(terms, " & ")
+}
+
+// domainComponents returns the parent domains of domain
+// which still have at least two components, so that
+// "a.b.example.com" yields "b.example.com" and
+// "example.com".
+func domainComponents(domain string) []string {
+	var result []string
+	labels := strings.Split(domain, ".")
+	for i := 1; i < len(labels)-1; i++ {
+		result = append(result, strings.Join(labels[i:], "."))
+	}
+	return result
+}
+
 // keywordsFromKey returns a slice of searchable tokens
 // extracted from the UserID packets keywords string of
-// the given key.
-func keywordsFromKey(key *openpgp.PrimaryKey) []string {
+// the given key. If domains is set, the parent domains of
+// email addresses are included.
+func keywordsFromKey(key *openpgp.PrimaryKey, domains bool) []string {
 	m := make(map[string]bool)
 	for _, uid := range key.UserIDs {
 		s := strings.ToLower(uid.Keywords)
@@ -671,6 +1259,11 @@ func keywordsFromKey(key *openpgp.PrimaryKey) []string {
 				username, domain := parts[0], parts[1]
 				m[username] = true
 				m[domain] = true
+				if domains {
+					for _, parent := range domainComponents(domain) {
+						m[parent] = true
+					}
+				}
 			}
 		}
 		if lbr != -1 {
@@ -712,7 +1305,7 @@ func (st *storage) Subscribe(f func(hkpstorage.KeyChange) error) {
 func (st *storage) Notify(change hkpstorage.KeyChange) error {
 	st.mu.Lock()
 	defer st.mu.Unlock()
-	log.Debugf("%v", change)
+	logger.Debug(change)
 	for _, f := range st.listeners {
 		// TODO: log error notifying listener?
 		f(change)
@@ -726,7 +1319,18 @@ func (st *storage) RenotifyAll() error {
 	if err != nil {
 		return errors.WithStack(err)
 	}
+	return st.renotify(rows)
+}
+
+func (st *storage) RenotifyAfter(digest string) error {
+	rows, err := st.Query("SELECT md5 FROM keys WHERE md5 > $1 ORDER BY md5", digest)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return st.renotify(rows)
+}
 
+func (st *storage) renotify(rows *sql.Rows) error {
 	defer rows.Close()
 	for rows.Next() {
 		var md5 string
@@ -740,6 +1344,6 @@ func (st *storage) RenotifyAll() error {
 		}
 		st.Notify(hkpstorage.KeyAdded{Digest: md5})
 	}
-	err = rows.Err()
+	err := rows.Err()
 	return errors.WithStack(err)
 }
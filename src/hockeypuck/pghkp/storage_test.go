@@ -19,6 +19,7 @@ package pghkp
 
 import (
 	"bytes"
+	"context"
 	"database/sql"
 	"encoding/json"
 	"io/ioutil"
@@ -27,15 +28,19 @@ import (
 	"net/url"
 	"os"
 	stdtesting "testing"
+	"time"
 
 	"hockeypuck/pgtest"
 	"hockeypuck/testing"
+	"hockeypuck/testing/keygen"
 
 	"github.com/julienschmidt/httprouter"
+	"github.com/pkg/errors"
 	gc "gopkg.in/check.v1"
 
 	"hockeypuck/hkp"
 	"hockeypuck/hkp/jsonhkp"
+	hkpstorage "hockeypuck/hkp/storage"
 	"hockeypuck/openpgp"
 )
 
@@ -167,6 +172,53 @@ func (s *S) TestAddDuplicates(c *gc.C) {
 	c.Assert(keyDocs[0].MD5, gc.Equals, "da84f40d830a7be2a3c0b7f2e146bfaa")
 }
 
+func (s *S) TestModifiedAfter(c *gc.C) {
+	s.addKey(c, "sksdigest.asc")
+	s.addKey(c, "alice_signed.asc")
+	keyDocs := s.queryAllKeys(c)
+	c.Assert(keyDocs, gc.HasLen, 2)
+
+	var seen []string
+	var after hkpstorage.ModifiedKey
+	for {
+		page, err := s.storage.ModifiedAfter(after, 1)
+		c.Assert(err, gc.IsNil)
+		if len(page) == 0 {
+			break
+		}
+		c.Assert(page, gc.HasLen, 1)
+		c.Assert(page[0].MD5, gc.Not(gc.Equals), "")
+		seen = append(seen, page[0].RFingerprint)
+		after = page[0]
+	}
+	c.Assert(seen, gc.HasLen, 2)
+	c.Assert(seen[0], gc.Not(gc.Equals), seen[1])
+}
+
+func (s *S) TestRenotifyAfter(c *gc.C) {
+	s.addKey(c, "sksdigest.asc")
+	s.addKey(c, "alice_signed.asc")
+
+	var digests []string
+	s.storage.Subscribe(func(kc hkpstorage.KeyChange) error {
+		if ka, ok := kc.(hkpstorage.KeyAdded); ok {
+			digests = append(digests, ka.Digest)
+		}
+		return nil
+	})
+	err := s.storage.RenotifyAfter("")
+	c.Assert(err, gc.IsNil)
+	c.Assert(digests, gc.HasLen, 2)
+	c.Assert(digests[0] < digests[1], gc.Equals, true)
+
+	// Resuming after the first key notifies only the second.
+	all := digests
+	digests = nil
+	err = s.storage.RenotifyAfter(all[0])
+	c.Assert(err, gc.IsNil)
+	c.Assert(digests, gc.DeepEquals, all[1:])
+}
+
 func (s *S) TestResolve(c *gc.C) {
 	res, err := http.Get(s.srv.URL + "/pks/lookup?op=get&search=0x44a2d1db")
 	c.Assert(err, gc.IsNil)
@@ -228,6 +280,69 @@ func (s *S) TestResolve(c *gc.C) {
 	}
 }
 
+func (s *S) TestStatementCache(c *gc.C) {
+	s.storage.cacheStmts = true
+	s.addKey(c, "uat.asc")
+
+	for i := 0; i < 2; i++ {
+		rfps, err := s.storage.Resolve([]string{"44a2d1db", "cdb9ad53"})
+		c.Assert(err, gc.IsNil)
+		c.Assert(rfps, gc.DeepEquals, []string{
+			"bd1d2a44ad26397fada207187bf98ce7eee97218",
+			"bd1d2a44ad26397fada207187bf98ce7eee97218",
+		})
+		keys, err := s.storage.FetchKeys(rfps[:1])
+		c.Assert(err, gc.IsNil)
+		c.Assert(keys, gc.HasLen, 1)
+		c.Assert(keys[0].RFingerprint, gc.Equals, rfps[0])
+	}
+	c.Assert(s.storage.stmts, gc.HasLen, 3)
+}
+
+func (s *S) TestPool(c *gc.C) {
+	st, err := New(s.db, nil, WithPool(PoolOptions{MaxOpenConns: 3}))
+	c.Assert(err, gc.IsNil)
+	c.Assert(st.(*storage).Stats().MaxOpenConnections, gc.Equals, 3)
+}
+
+func (s *S) TestResolvePrefix(c *gc.C) {
+	s.storage.search = SearchOptions{Prefix: true}
+	s.addKey(c, "uat.asc")
+
+	// Should match
+	for _, search := range []string{
+		"cas", "marsh", "casey+marsh", "casey.marsh", "gmail.co", "casey",
+		"Casey+Marshall+<casey.marshall@gmail.com>"} {
+		comment := gc.Commentf("search=%s", search)
+		res, err := http.Get(s.srv.URL + "/pks/lookup?op=get&search=" + search)
+		c.Assert(err, gc.IsNil, comment)
+		armor, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		c.Assert(err, gc.IsNil, comment)
+		c.Assert(res.StatusCode, gc.Equals, http.StatusOK, comment)
+
+		keys := openpgp.MustReadArmorKeys(bytes.NewBuffer(armor))
+		c.Assert(keys, gc.HasLen, 1)
+		c.Assert(keys[0].ShortID(), gc.Equals, "44a2d1db")
+	}
+
+	// Shouldn't match any of these
+	for _, search := range []string{"asey", "arshall", "bob", "casey+bob", "it's"} {
+		comment := gc.Commentf("search=%s", search)
+		res, err := http.Get(s.srv.URL + "/pks/lookup?op=get&search=" + search)
+		c.Assert(err, gc.IsNil, comment)
+		res.Body.Close()
+		c.Assert(res.StatusCode, gc.Equals, http.StatusNotFound, comment)
+	}
+}
+
+func (s *S) TestDomainComponents(c *gc.C) {
+	c.Assert(domainComponents("a.b.example.com"), gc.DeepEquals, []string{"b.example.com", "example.com"})
+	c.Assert(domainComponents("example.com"), gc.HasLen, 0)
+	c.Assert(prefixTSQuery("Casey  o'Marshall"), gc.Equals, `'casey':* & 'o''marshall':*`)
+	c.Assert(prefixTSQuery(" "), gc.Equals, "")
+}
+
 func (s *S) TestResolveWithHyphen(c *gc.C) {
 	res, err := http.Get(s.srv.URL + "/pks/lookup?op=get&search=0x2632c2c3")
 	c.Assert(err, gc.IsNil)
@@ -509,3 +624,94 @@ func (s *S) TestDeleteNotSelfSig(c *gc.C) {
 	s.assertKey(c, "0xB3836BA47C8CFE0CEBD000CBF30F9BABFDD1F1EC", "forgetme", true)
 
 }
+
+func (s *S) TestMaintain(c *gc.C) {
+	s.addKey(c, "sksdigest.asc")
+	for _, task := range []string{hkpstorage.MaintainVacuum, hkpstorage.MaintainReindex} {
+		err := s.storage.Maintain(context.Background(), task)
+		c.Assert(err, gc.IsNil)
+	}
+	err := s.storage.Maintain(context.Background(), "defrag")
+	c.Assert(errors.Is(err, hkpstorage.ErrNotSupported), gc.Equals, true)
+
+	s.assertKey(c, "0x646AD4C90A2D13F62D9D1BF4CC5112BDCE353CF4", "Jenny Ondioline <jennyo@transient.net>", true)
+}
+
+func (s *S) TestBackfillKeyTimes(c *gc.C) {
+	s.addKey(c, "sksdigest.asc")
+	_, err := s.db.Exec("UPDATE keys SET kctime = NULL, kexpiry = NULL")
+	c.Assert(err, gc.IsNil)
+	rfps, err := s.storage.MatchTimeRange(hkpstorage.TimeRange{CreatedAfter: time.Unix(1, 0)}, 10)
+	c.Assert(err, gc.IsNil)
+	c.Assert(rfps, gc.HasLen, 0)
+
+	err = s.storage.Maintain(context.Background(), hkpstorage.MaintainBackfill)
+	c.Assert(err, gc.IsNil)
+	rfps, err = s.storage.MatchTimeRange(hkpstorage.TimeRange{CreatedAfter: time.Unix(1, 0)}, 10)
+	c.Assert(err, gc.IsNil)
+	c.Assert(rfps, gc.DeepEquals, []string{openpgp.Reverse("646ad4c90a2d13f62d9d1bf4cc5112bdce353cf4")})
+
+	// A key which cannot be parsed is marked, and not tried again.
+	_, err = s.db.Exec("UPDATE keys SET kctime = NULL, kexpiry = NULL, doc = '{}'")
+	c.Assert(err, gc.IsNil)
+	err = s.storage.Maintain(context.Background(), hkpstorage.MaintainBackfill)
+	c.Assert(err, gc.IsNil)
+	var unparsed int
+	err = s.db.QueryRow("SELECT COUNT(*) FROM keys WHERE kunparsed").Scan(&unparsed)
+	c.Assert(err, gc.IsNil)
+	c.Assert(unparsed, gc.Equals, 1)
+	var pending int
+	err = s.db.QueryRow("SELECT COUNT(*) FROM keys WHERE kctime IS NULL AND kunparsed IS NOT TRUE").Scan(&pending)
+	c.Assert(err, gc.IsNil)
+	c.Assert(pending, gc.Equals, 0)
+}
+
+func (s *S) TestInsertBatch(c *gc.C) {
+	var added []string
+	s.storage.Subscribe(func(kc hkpstorage.KeyChange) error {
+		added = append(added, kc.InsertDigests()...)
+		return nil
+	})
+
+	// Small batches are inserted with one statement, and large batches
+	// are copied.
+	for _, size := range []int{5, copyBatchSize + 1} {
+		g, err := keygen.New(int64(size), &keygen.Spec{SubKeys: 1})
+		c.Assert(err, gc.IsNil)
+		keys := g.MustKeys(size)
+		added = nil
+		n, err := s.storage.InsertBatch(append(keys, keys[0]))
+		c.Assert(n, gc.Equals, size)
+		c.Assert(hkpstorage.Duplicates(err), gc.HasLen, 1)
+		c.Assert(added, gc.HasLen, size)
+
+		n, err = s.storage.InsertBatch(keys)
+		c.Assert(n, gc.Equals, 0)
+		c.Assert(hkpstorage.Duplicates(err), gc.HasLen, size)
+
+		fps, err := s.storage.Resolve([]string{keys[size-1].SubKeys[0].KeyID()})
+		c.Assert(err, gc.IsNil)
+		c.Assert(fps, gc.DeepEquals, []string{keys[size-1].RFingerprint})
+	}
+	c.Assert(s.queryAllKeys(c), gc.HasLen, 5+copyBatchSize+1)
+}
+
+func (s *S) TestInsertBatchFallback(c *gc.C) {
+	g, err := keygen.New(1, nil)
+	c.Assert(err, gc.IsNil)
+	keys := g.MustKeys(3)
+	n, err := s.storage.Insert(keys[:1])
+	c.Assert(err, gc.IsNil)
+	c.Assert(n, gc.Equals, 1)
+
+	// A key with a stored digest under another fingerprint fails the batch,
+	// so the keys are inserted one at a time.
+	conflict := g.MustKeys(1)[0]
+	conflict.RFingerprint = keys[2].RFingerprint
+	n, err = s.storage.InsertBatch([]*openpgp.PrimaryKey{keys[1], conflict})
+	c.Assert(n, gc.Equals, 1)
+	insertErr, ok := err.(hkpstorage.InsertError)
+	c.Assert(ok, gc.Equals, true)
+	c.Assert(insertErr.Errors, gc.HasLen, 1)
+	c.Assert(s.queryAllKeys(c), gc.HasLen, 2)
+}
@@ -0,0 +1,37 @@
+package proofs
+
+import (
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var proofMetrics = struct {
+	checks  *prometheus.CounterVec
+	dropped prometheus.Counter
+}{
+	checks: prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "hockeypuck",
+			Name:      "proof_checks",
+			Help:      "Identity proofs checked since startup",
+		},
+		[]string{"status"},
+	),
+	dropped: prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: "hockeypuck",
+			Name:      "proof_checks_dropped",
+			Help:      "Identity proof checks not queued because the queue was full",
+		},
+	),
+}
+
+var metricsRegister sync.Once
+
+func registerMetrics() {
+	metricsRegister.Do(func() {
+		prometheus.MustRegister(proofMetrics.checks)
+		prometheus.MustRegister(proofMetrics.dropped)
+	})
+}
@@ -0,0 +1,374 @@
+// Package proofs verifies identity proofs: notations on a user ID's
+// self-signature naming a resource elsewhere, such as a web page or a DNS
+// record, which in turn names the key's fingerprint. A proof is verified
+// when the resource it names contains "openpgp4fpr:" followed by the
+// fingerprint.
+//
+// Proofs are checked in the background, so that key lookups are never held
+// up by a slow or unreachable resource. Results are cached; until a proof
+// has been checked its status is pending.
+package proofs
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+	"gopkg.in/tomb.v2"
+
+	"hockeypuck/clock"
+	"hockeypuck/logging"
+	log "hockeypuck/logrus"
+)
+
+var logger = logging.Module("proofs")
+
+// Statuses of a proof.
+const (
+	StatusVerified    = "verified"
+	StatusFailed      = "failed"
+	StatusUnsupported = "unsupported"
+	StatusPending     = "pending"
+)
+
+const (
+	DefaultCacheTTLSecs   = 86400
+	DefaultFailureTTLSecs = 3600
+	DefaultWorkers        = 2
+	DefaultTimeoutSecs    = 10
+	DefaultQueueSize      = 1000
+
+	// maxBodySize limits how much of a proof resource is read.
+	maxBodySize = 1 << 20
+)
+
+type Settings struct {
+	// Enabled is whether proofs are verified. Proofs are listed without a
+	// status when verification is disabled.
+	Enabled bool `toml:"enabled"`
+
+	// CacheTTLSecs is how long a verified or unsupported proof is trusted
+	// before it is checked again.
+	CacheTTLSecs int `toml:"cacheTTLSecs"`
+
+	// FailureTTLSecs is how long a failed proof is cached before it is
+	// checked again.
+	FailureTTLSecs int `toml:"failureTTLSecs"`
+
+	// Workers is the number of proofs checked at once.
+	Workers int `toml:"workers"`
+
+	// TimeoutSecs limits how long a single check may take.
+	TimeoutSecs int `toml:"timeoutSecs"`
+
+	// QueueSize is the number of proofs which may be waiting to be checked
+	// before further proofs are left pending until they are next looked up.
+	QueueSize int `toml:"queueSize"`
+}
+
+func DefaultSettings() *Settings {
+	return &Settings{
+		CacheTTLSecs:   DefaultCacheTTLSecs,
+		FailureTTLSecs: DefaultFailureTTLSecs,
+		Workers:        DefaultWorkers,
+		TimeoutSecs:    DefaultTimeoutSecs,
+		QueueSize:      DefaultQueueSize,
+	}
+}
+
+type proof struct {
+	fingerprint string
+	uri         string
+}
+
+type result struct {
+	status  string
+	expires time.Time
+}
+
+// Verifier checks proofs in the background and caches the results.
+type Verifier struct {
+	cacheTTL   time.Duration
+	failureTTL time.Duration
+	workers    int
+
+	client    *http.Client
+	lookupTXT func(name string) ([]string, error)
+	clock     clock.Clock
+
+	mu      sync.Mutex
+	results map[proof]result
+	pending map[proof]bool
+
+	queue chan proof
+	t     tomb.Tomb
+}
+
+// NewVerifier returns a verifier configured by settings.
+func NewVerifier(settings *Settings) *Verifier {
+	registerMetrics()
+	if settings == nil {
+		settings = DefaultSettings()
+	}
+	v := &Verifier{
+		cacheTTL:   secondsOr(settings.CacheTTLSecs, DefaultCacheTTLSecs),
+		failureTTL: secondsOr(settings.FailureTTLSecs, DefaultFailureTTLSecs),
+		workers:    settings.Workers,
+		lookupTXT:  net.LookupTXT,
+		clock:      clock.Real(),
+		results:    map[proof]result{},
+		pending:    map[proof]bool{},
+	}
+	if v.workers <= 0 {
+		v.workers = DefaultWorkers
+	}
+	queueSize := settings.QueueSize
+	if queueSize <= 0 {
+		queueSize = DefaultQueueSize
+	}
+	v.queue = make(chan proof, queueSize)
+	v.client = newClient(secondsOr(settings.TimeoutSecs, DefaultTimeoutSecs))
+	return v
+}
+
+func secondsOr(secs, def int) time.Duration {
+	if secs <= 0 {
+		secs = def
+	}
+	return time.Duration(secs) * time.Second
+}
+
+// SetClock sets the clock used to expire cached results.
+func (v *Verifier) SetClock(c clock.Clock) {
+	v.clock = c
+}
+
+// SetClient sets the HTTP client used to fetch proof resources. The default
+// client refuses to connect to private and loopback addresses.
+func (v *Verifier) SetClient(client *http.Client) {
+	v.client = client
+}
+
+// SetLookupTXT sets the function used to look up DNS TXT records.
+func (v *Verifier) SetLookupTXT(f func(name string) ([]string, error)) {
+	v.lookupTXT = f
+}
+
+// Status returns the status of the proof at uri for the key with the given
+// fingerprint. If the proof has not been checked recently, it is queued to
+// be checked and its status is pending. It may be called on a nil
+// verifier, which returns an empty status.
+func (v *Verifier) Status(fingerprint, uri string) string {
+	if v == nil {
+		return ""
+	}
+	p := proof{fingerprint: strings.ToLower(fingerprint), uri: uri}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if r, ok := v.results[p]; ok && v.clock.Now().Before(r.expires) {
+		return r.status
+	}
+	if v.pending[p] {
+		return StatusPending
+	}
+	select {
+	case v.queue <- p:
+		v.pending[p] = true
+	default:
+		proofMetrics.dropped.Inc()
+	}
+	return StatusPending
+}
+
+// Start checking queued proofs.
+func (v *Verifier) Start() {
+	for i := 0; i < v.workers; i++ {
+		v.t.Go(v.run)
+	}
+}
+
+// Stop checking proofs. Proofs still queued are discarded.
+func (v *Verifier) Stop() error {
+	v.t.Kill(nil)
+	return v.t.Wait()
+}
+
+func (v *Verifier) run() error {
+	for {
+		select {
+		case <-v.t.Dying():
+			return nil
+		case p := <-v.queue:
+			v.check(p)
+		}
+	}
+}
+
+func (v *Verifier) check(p proof) {
+	status, err := v.Check(p.fingerprint, p.uri)
+	if err != nil {
+		logger.WithFields(log.Fields{
+			"fingerprint": p.fingerprint,
+			"uri":         p.uri,
+		}).Debugf("proof failed: %v", err)
+	}
+	proofMetrics.checks.WithLabelValues(status).Inc()
+
+	ttl := v.cacheTTL
+	if status == StatusFailed {
+		ttl = v.failureTTL
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	delete(v.pending, p)
+	v.results[p] = result{status: status, expires: v.clock.Now().Add(ttl)}
+	v.expire()
+}
+
+// expire removes expired results. The caller must hold v.mu.
+func (v *Verifier) expire() {
+	now := v.clock.Now()
+	for p, r := range v.results {
+		if !now.Before(r.expires) {
+			delete(v.results, p)
+		}
+	}
+}
+
+// Check fetches the resource named by uri and returns whether it names the
+// fingerprint. The error, if any, explains why a proof failed.
+func (v *Verifier) Check(fingerprint, uri string) (string, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return StatusUnsupported, errors.WithStack(err)
+	}
+	var contents [][]byte
+	switch u.Scheme {
+	case "https":
+		body, err := v.fetch(u)
+		if err != nil {
+			return StatusFailed, errors.WithStack(err)
+		}
+		contents = append(contents, body)
+	case "dns":
+		name := u.Opaque
+		if name == "" {
+			name = strings.TrimPrefix(u.Path, "/")
+		}
+		if name == "" {
+			return StatusUnsupported, errors.Errorf("no domain in %q", uri)
+		}
+		records, err := v.lookupTXT(name)
+		if err != nil {
+			return StatusFailed, errors.WithStack(err)
+		}
+		for _, record := range records {
+			contents = append(contents, []byte(record))
+		}
+	default:
+		return StatusUnsupported, errors.Errorf("unsupported proof scheme %q", u.Scheme)
+	}
+
+	claim := []byte("openpgp4fpr:" + strings.ToLower(fingerprint))
+	for _, content := range contents {
+		if bytes.Contains(bytes.ToLower(content), claim) {
+			return StatusVerified, nil
+		}
+	}
+	return StatusFailed, errors.Errorf("%q does not name the key", uri)
+}
+
+func (v *Verifier) fetch(u *url.URL) ([]byte, error) {
+	resp, err := v.client.Get(u.String())
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		io.Copy(ioutil.Discard, io.LimitReader(resp.Body, maxBodySize))
+		return nil, errors.Errorf("%q returned %s", u, resp.Status)
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxBodySize))
+	return body, errors.WithStack(err)
+}
+
+// newClient returns an HTTP client which only follows redirects to https
+// URLs and only connects to public addresses, so that proofs cannot be used
+// to probe the keyserver's own network.
+func newClient(timeout time.Duration) *http.Client {
+	dialer := &net.Dialer{
+		Timeout: timeout,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return errors.WithStack(err)
+			}
+			ip := net.ParseIP(host)
+			if ip == nil || !isPublic(ip) {
+				return errors.Errorf("refusing to connect to %s", host)
+			}
+			return nil
+		},
+	}
+	return &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			Proxy:               nil,
+			DialContext:         dialer.DialContext,
+			TLSHandshakeTimeout: timeout,
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 5 {
+				return errors.New("too many redirects")
+			}
+			if req.URL.Scheme != "https" {
+				return errors.Errorf("refusing to follow redirect to %q", req.URL)
+			}
+			return nil
+		},
+	}
+}
+
+var privateNets []*net.IPNet
+
+func init() {
+	for _, cidr := range []string{
+		"0.0.0.0/8",
+		"10.0.0.0/8",
+		"100.64.0.0/10",
+		"127.0.0.0/8",
+		"169.254.0.0/16",
+		"172.16.0.0/12",
+		"192.168.0.0/16",
+		"::1/128",
+		"fc00::/7",
+		"fe80::/10",
+	} {
+		_, ipnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		privateNets = append(privateNets, ipnet)
+	}
+}
+
+func isPublic(ip net.IP) bool {
+	if ip.IsUnspecified() || ip.IsMulticast() {
+		return false
+	}
+	for _, ipnet := range privateNets {
+		if ipnet.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,117 @@
+package proofs
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	stdtesting "testing"
+	"time"
+
+	"github.com/pkg/errors"
+	gc "gopkg.in/check.v1"
+
+	"hockeypuck/clock"
+)
+
+func Test(t *stdtesting.T) { gc.TestingT(t) }
+
+type ProofsSuite struct {
+	srv *httptest.Server
+	v   *Verifier
+	clk *clock.Fake
+}
+
+var _ = gc.Suite(&ProofsSuite{})
+
+const testFingerprint = "a570a845348680f050f4e5c4774dceb75012b4b8"
+
+func (s *ProofsSuite) SetUpTest(c *gc.C) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/good", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "My key is openpgp4fpr:A570A845348680F050F4E5C4774DCEB75012B4B8")
+	})
+	mux.HandleFunc("/other", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "My key is openpgp4fpr:10fe8cf1b483f7525039aa2a361bc1f023e0dcca")
+	})
+	s.srv = httptest.NewTLSServer(mux)
+
+	s.clk = clock.NewFake(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	s.v = NewVerifier(DefaultSettings())
+	s.v.SetClient(s.srv.Client())
+	s.v.SetClock(s.clk)
+	s.v.SetLookupTXT(func(name string) ([]string, error) {
+		if name == "example.org" {
+			return []string{"v=spf1 -all", "openpgp4fpr:" + testFingerprint}, nil
+		}
+		return nil, errors.New("no such host")
+	})
+}
+
+func (s *ProofsSuite) TearDownTest(c *gc.C) {
+	s.srv.Close()
+}
+
+func (s *ProofsSuite) TestCheck(c *gc.C) {
+	for _, t := range []struct {
+		uri, status string
+	}{
+		{s.srv.URL + "/good", StatusVerified},
+		{s.srv.URL + "/other", StatusFailed},
+		{s.srv.URL + "/missing", StatusFailed},
+		{"dns:example.org?type=TXT", StatusVerified},
+		{"dns:example.com?type=TXT", StatusFailed},
+		{"dns:?type=TXT", StatusUnsupported},
+		{"xmpp:alice@example.org", StatusUnsupported},
+		{"http://example.org/proof", StatusUnsupported},
+	} {
+		status, _ := s.v.Check(testFingerprint, t.uri)
+		c.Check(status, gc.Equals, t.status, gc.Commentf("%s", t.uri))
+	}
+}
+
+func (s *ProofsSuite) TestStatus(c *gc.C) {
+	var nilVerifier *Verifier
+	c.Assert(nilVerifier.Status(testFingerprint, s.srv.URL+"/good"), gc.Equals, "")
+
+	uri := s.srv.URL + "/good"
+	c.Assert(s.v.Status(testFingerprint, uri), gc.Equals, StatusPending)
+	c.Assert(s.v.Status(testFingerprint, uri), gc.Equals, StatusPending)
+	c.Assert(s.v.queue, gc.HasLen, 1)
+
+	s.v.Start()
+	defer s.v.Stop()
+	status := StatusPending
+	for i := 0; i < 100 && status == StatusPending; i++ {
+		time.Sleep(10 * time.Millisecond)
+		status = s.v.Status(testFingerprint, uri)
+	}
+	c.Assert(status, gc.Equals, StatusVerified)
+
+	// Results expire and are checked again.
+	s.clk.Advance(DefaultCacheTTLSecs * time.Second)
+	c.Assert(s.v.Status(testFingerprint, uri), gc.Equals, StatusPending)
+}
+
+func (s *ProofsSuite) TestRefusePrivate(c *gc.C) {
+	v := NewVerifier(DefaultSettings())
+	status, err := v.Check(testFingerprint, s.srv.URL+"/good")
+	c.Assert(status, gc.Equals, StatusFailed)
+	c.Assert(err, gc.ErrorMatches, ".*refusing to connect to 127.0.0.1.*")
+
+	for _, t := range []struct {
+		ip     string
+		public bool
+	}{
+		{"93.184.216.34", true},
+		{"2606:2800:220:1::", true},
+		{"10.1.2.3", false},
+		{"192.168.0.1", false},
+		{"169.254.169.254", false},
+		{"::1", false},
+		{"fd00::1", false},
+		{"0.0.0.0", false},
+	} {
+		c.Check(isPublic(net.ParseIP(t.ip)), gc.Equals, t.public, gc.Commentf("%s", t.ip))
+	}
+}
@@ -0,0 +1,287 @@
+// Package proxyproto accepts PROXY protocol headers, as sent by load
+// balancers such as haproxy and AWS NLB, so that the address of the client
+// rather than that of the load balancer is seen by the server.
+//
+// Both the text (v1) and binary (v2) forms of the header are accepted, but
+// only from trusted networks, since anyone able to send a header can claim
+// any address. Connections from trusted networks without a header are
+// passed through unchanged, so that load balancer health checks still work.
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// HeaderTimeout limits the time spent waiting for a PROXY protocol header.
+var HeaderTimeout = 10 * time.Second
+
+const (
+	v1Prefix    = "PROXY "
+	v1MaxLength = 107
+
+	v2Signature = "\r\n\r\n\x00\r\nQUIT\n"
+	v2HeaderLen = 16
+)
+
+// Trusted is a set of networks from which PROXY protocol headers are
+// accepted. An empty set accepts no headers.
+type Trusted struct {
+	nets []*net.IPNet
+}
+
+// ParseTrusted returns the set of networks in cidrs, given in CIDR notation
+// or as single IP addresses.
+func ParseTrusted(cidrs []string) (*Trusted, error) {
+	t := &Trusted{}
+	for _, cidr := range cidrs {
+		if !strings.Contains(cidr, "/") {
+			ip := net.ParseIP(cidr)
+			if ip == nil {
+				return nil, errors.Errorf("invalid PROXY protocol source %q", cidr)
+			}
+			t.nets = append(t.nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(len(ip)*8, len(ip)*8)})
+			continue
+		}
+		_, ipnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid PROXY protocol source %q", cidr)
+		}
+		t.nets = append(t.nets, ipnet)
+	}
+	return t, nil
+}
+
+// Enabled returns whether any network is trusted.
+func (t *Trusted) Enabled() bool {
+	return t != nil && len(t.nets) > 0
+}
+
+func (t *Trusted) contains(addr net.Addr) bool {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for _, ipnet := range t.nets {
+		if ipnet.Contains(tcpAddr.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// Conn returns conn, accepting a PROXY protocol header on it if it is from
+// a trusted network.
+func (t *Trusted) Conn(conn net.Conn) net.Conn {
+	if !t.Enabled() || !t.contains(conn.RemoteAddr()) {
+		return conn
+	}
+	return &Conn{Conn: conn, r: bufio.NewReader(conn)}
+}
+
+// Listener returns a listener which accepts PROXY protocol headers on
+// connections from trusted networks.
+func (t *Trusted) Listener(ln net.Listener) net.Listener {
+	if !t.Enabled() {
+		return ln
+	}
+	return &listener{Listener: ln, trusted: t}
+}
+
+type listener struct {
+	net.Listener
+	trusted *Trusted
+}
+
+// Accept implements net.Listener.
+func (ln *listener) Accept() (net.Conn, error) {
+	conn, err := ln.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return ln.trusted.Conn(conn), nil
+}
+
+// Conn is a connection from a trusted network which may begin with a PROXY
+// protocol header. The header is read on first use rather than when the
+// connection is accepted, so that a slow client cannot hold up the accept
+// loop.
+type Conn struct {
+	net.Conn
+
+	r      *bufio.Reader
+	once   sync.Once
+	remote net.Addr
+	err    error
+}
+
+// Read implements net.Conn.
+func (c *Conn) Read(b []byte) (int, error) {
+	c.once.Do(c.readHeader)
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.r.Read(b)
+}
+
+// RemoteAddr returns the client address given by the PROXY protocol header,
+// or the address of the peer if there was none.
+func (c *Conn) RemoteAddr() net.Addr {
+	c.once.Do(c.readHeader)
+	if c.remote != nil {
+		return c.remote
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// Err returns the error, if any, in reading the PROXY protocol header.
+func (c *Conn) Err() error {
+	c.once.Do(c.readHeader)
+	return c.err
+}
+
+// SetDeadline implements net.Conn.
+func (c *Conn) SetDeadline(t time.Time) error {
+	c.once.Do(c.readHeader)
+	return c.Conn.SetDeadline(t)
+}
+
+// SetReadDeadline implements net.Conn.
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.once.Do(c.readHeader)
+	return c.Conn.SetReadDeadline(t)
+}
+
+func (c *Conn) readHeader() {
+	c.Conn.SetReadDeadline(time.Now().Add(HeaderTimeout))
+	defer c.Conn.SetReadDeadline(time.Time{})
+
+	c.remote, c.err = readHeader(c.r)
+	if c.err != nil {
+		c.err = errors.Wrapf(c.err, "invalid PROXY protocol header from %v", c.Conn.RemoteAddr())
+	}
+}
+
+// readHeader reads a PROXY protocol header, if there is one, returning the
+// client address it gives. A nil address is returned if there is no header
+// or the header does not give an address, as in health checks.
+func readHeader(r *bufio.Reader) (net.Addr, error) {
+	first, err := r.Peek(1)
+	if err != nil {
+		// Leave any error to be found by the server.
+		return nil, nil
+	}
+	switch first[0] {
+	case v1Prefix[0]:
+		prefix, _ := r.Peek(len(v1Prefix))
+		if string(prefix) == v1Prefix {
+			return readV1(r)
+		}
+	case v2Signature[0]:
+		sig, _ := r.Peek(len(v2Signature))
+		if string(sig) == v2Signature {
+			return readV2(r)
+		}
+	}
+	return nil, nil
+}
+
+// readV1 reads a text header, such as:
+//
+//	PROXY TCP4 192.0.2.1 198.51.100.1 56324 11371\r\n
+func readV1(r *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+		if len(line) >= v1MaxLength {
+			return nil, errors.New("header too long")
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errors.New("header not terminated by CRLF")
+	}
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if len(fields) < 2 {
+		return nil, errors.Errorf("malformed header %q", line)
+	}
+	switch fields[1] {
+	case "UNKNOWN":
+		return nil, nil
+	case "TCP4", "TCP6":
+	default:
+		return nil, errors.Errorf("unsupported protocol %q", fields[1])
+	}
+	if len(fields) != 6 {
+		return nil, errors.Errorf("malformed header %q", line)
+	}
+	ip := net.ParseIP(fields[2])
+	if ip == nil || (fields[1] == "TCP4") != (ip.To4() != nil) {
+		return nil, errors.Errorf("invalid source address %q", fields[2])
+	}
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if err != nil {
+		return nil, errors.Errorf("invalid source port %q", fields[4])
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// readV2 reads a binary header.
+func readV2(r *bufio.Reader) (net.Addr, error) {
+	var hdr [v2HeaderLen]byte
+	_, err := io.ReadFull(r, hdr[:])
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if version := hdr[12] >> 4; version != 2 {
+		return nil, errors.Errorf("unsupported version %d", version)
+	}
+	body := make([]byte, binary.BigEndian.Uint16(hdr[14:16]))
+	_, err = io.ReadFull(r, body)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	switch command := hdr[12] & 0x0f; command {
+	case 0x0:
+		// LOCAL connections are made by the proxy itself.
+		return nil, nil
+	case 0x1:
+	default:
+		return nil, errors.Errorf("unsupported command %d", command)
+	}
+
+	var ipLen int
+	switch family := hdr[13] >> 4; family {
+	case 0x1:
+		ipLen = net.IPv4len
+	case 0x2:
+		ipLen = net.IPv6len
+	default:
+		// Unspecified and unix socket addresses are not useful to servers
+		// which see clients by IP address.
+		return nil, nil
+	}
+	if len(body) < 2*ipLen+4 {
+		return nil, errors.Errorf("address block too short: %d bytes", len(body))
+	}
+	ip := make(net.IP, ipLen)
+	copy(ip, body[:ipLen])
+	port := binary.BigEndian.Uint16(body[2*ipLen:])
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
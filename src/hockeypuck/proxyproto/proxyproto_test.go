@@ -0,0 +1,136 @@
+package proxyproto
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	stdtesting "testing"
+
+	gc "gopkg.in/check.v1"
+)
+
+func Test(t *stdtesting.T) { gc.TestingT(t) }
+
+type ProxySuite struct{}
+
+var _ = gc.Suite(&ProxySuite{})
+
+// accept sends data over a loopback connection accepted through a listener
+// trusting cidrs, returning the accepted connection.
+func accept(c *gc.C, cidrs []string, data []byte) net.Conn {
+	trusted, err := ParseTrusted(cidrs)
+	c.Assert(err, gc.IsNil)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, gc.IsNil)
+	defer ln.Close()
+	ln = trusted.Listener(ln)
+
+	client, err := net.Dial("tcp", ln.Addr().String())
+	c.Assert(err, gc.IsNil)
+	_, err = client.Write(data)
+	c.Assert(err, gc.IsNil)
+	c.Assert(client.Close(), gc.IsNil)
+
+	conn, err := ln.Accept()
+	c.Assert(err, gc.IsNil)
+	return conn
+}
+
+func v2Header(command, family byte, addrs []byte) []byte {
+	hdr := []byte(v2Signature)
+	hdr = append(hdr, 0x20|command, family, 0, 0)
+	binary.BigEndian.PutUint16(hdr[14:], uint16(len(addrs)))
+	return append(hdr, addrs...)
+}
+
+func (s *ProxySuite) TestV1(c *gc.C) {
+	conn := accept(c, []string{"127.0.0.0/8"}, []byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324 11371\r\nGET / HTTP/1.0\r\n\r\n"))
+	defer conn.Close()
+	c.Assert(conn.RemoteAddr().String(), gc.Equals, "192.0.2.1:56324")
+	buf, err := ioutil.ReadAll(conn)
+	c.Assert(err, gc.IsNil)
+	c.Assert(string(buf), gc.Equals, "GET / HTTP/1.0\r\n\r\n")
+}
+
+func (s *ProxySuite) TestV1IPv6(c *gc.C) {
+	conn := accept(c, []string{"127.0.0.1"}, []byte("PROXY TCP6 2001:db8::1 2001:db8::2 56324 11370\r\n"))
+	defer conn.Close()
+	c.Assert(conn.RemoteAddr().String(), gc.Equals, "[2001:db8::1]:56324")
+}
+
+func (s *ProxySuite) TestV1Unknown(c *gc.C) {
+	conn := accept(c, []string{"127.0.0.0/8"}, []byte("PROXY UNKNOWN\r\nhello"))
+	defer conn.Close()
+	c.Assert(conn.RemoteAddr().(*net.TCPAddr).IP.IsLoopback(), gc.Equals, true)
+	buf, err := ioutil.ReadAll(conn)
+	c.Assert(err, gc.IsNil)
+	c.Assert(string(buf), gc.Equals, "hello")
+}
+
+func (s *ProxySuite) TestV2(c *gc.C) {
+	addrs := []byte{192, 0, 2, 1, 198, 51, 100, 1, 0xdc, 0x04, 0x2c, 0x6b}
+	conn := accept(c, []string{"127.0.0.0/8"}, append(v2Header(0x1, 0x11, addrs), "hello"...))
+	defer conn.Close()
+	c.Assert(conn.RemoteAddr().String(), gc.Equals, "192.0.2.1:56324")
+	buf, err := ioutil.ReadAll(conn)
+	c.Assert(err, gc.IsNil)
+	c.Assert(string(buf), gc.Equals, "hello")
+}
+
+func (s *ProxySuite) TestV2Local(c *gc.C) {
+	conn := accept(c, []string{"127.0.0.0/8"}, append(v2Header(0x0, 0x00, nil), "hello"...))
+	defer conn.Close()
+	c.Assert(conn.RemoteAddr().(*net.TCPAddr).IP.IsLoopback(), gc.Equals, true)
+	buf, err := ioutil.ReadAll(conn)
+	c.Assert(err, gc.IsNil)
+	c.Assert(string(buf), gc.Equals, "hello")
+}
+
+func (s *ProxySuite) TestNoHeader(c *gc.C) {
+	conn := accept(c, []string{"127.0.0.0/8"}, []byte("POST /pks/add HTTP/1.0\r\n\r\n"))
+	defer conn.Close()
+	c.Assert(conn.RemoteAddr().(*net.TCPAddr).IP.IsLoopback(), gc.Equals, true)
+	buf, err := ioutil.ReadAll(conn)
+	c.Assert(err, gc.IsNil)
+	c.Assert(string(buf), gc.Equals, "POST /pks/add HTTP/1.0\r\n\r\n")
+}
+
+func (s *ProxySuite) TestUntrusted(c *gc.C) {
+	// Headers from untrusted networks are not interpreted.
+	header := "PROXY TCP4 192.0.2.1 198.51.100.1 56324 11371\r\n"
+	conn := accept(c, []string{"192.0.2.0/24"}, []byte(header))
+	defer conn.Close()
+	c.Assert(conn.RemoteAddr().(*net.TCPAddr).IP.IsLoopback(), gc.Equals, true)
+	buf, err := ioutil.ReadAll(conn)
+	c.Assert(err, gc.IsNil)
+	c.Assert(string(buf), gc.Equals, header)
+}
+
+func (s *ProxySuite) TestInvalid(c *gc.C) {
+	for i, header := range []string{
+		"PROXY TCP4 192.0.2.1 198.51.100.1 56324\r\n",
+		"PROXY TCP4 2001:db8::1 198.51.100.1 56324 11371\r\n",
+		"PROXY TCP4 192.0.2.1 198.51.100.1 65536 11371\r\n",
+		"PROXY UDP4 192.0.2.1 198.51.100.1 56324 11371\r\n",
+		"PROXY TCP4 192.0.2.1 198.51.100.1 56324 11371\n",
+		string(v2Header(0x1, 0x11, []byte{192, 0, 2, 1})),
+	} {
+		c.Logf("test#%d: %q", i, header)
+		conn := accept(c, []string{"127.0.0.0/8"}, []byte(header))
+		c.Assert(conn.(*Conn).Err(), gc.NotNil)
+		_, err := conn.Read(make([]byte, 1))
+		c.Assert(err, gc.ErrorMatches, "invalid PROXY protocol header.*")
+		conn.Close()
+	}
+}
+
+func (s *ProxySuite) TestParseTrusted(c *gc.C) {
+	t, err := ParseTrusted(nil)
+	c.Assert(err, gc.IsNil)
+	c.Assert(t.Enabled(), gc.Equals, false)
+
+	_, err = ParseTrusted([]string{"10.0.0.0/33"})
+	c.Assert(err, gc.ErrorMatches, `invalid PROXY protocol source "10.0.0.0/33".*`)
+	_, err = ParseTrusted([]string{"localhost"})
+	c.Assert(err, gc.ErrorMatches, `invalid PROXY protocol source "localhost"`)
+}
@@ -0,0 +1,47 @@
+// Package quarantine keeps key material rejected by the server in a
+// directory, so that an operator can review it. The files may hold secret
+// keys, and are only readable by the server's user.
+package quarantine
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Extensions of quarantined files, by the encoding of their contents.
+const (
+	Armored = ".asc"
+	Binary  = ".pgp"
+)
+
+// Write writes data to a new file in dir, named for the time and a hash of
+// data, and returns its path. ext is Armored or Binary. Data which has
+// already been quarantined in dir is not written again: the path of its
+// earlier file is returned, and written is false.
+func Write(dir, ext string, data []byte, now time.Time) (path string, written bool, err error) {
+	err = os.MkdirAll(dir, 0700)
+	if err != nil {
+		return "", false, errors.WithStack(err)
+	}
+	sum := sha256.Sum256(data)
+	suffix := "-" + hex.EncodeToString(sum[:8]) + ext
+	earlier, err := filepath.Glob(filepath.Join(dir, "*"+suffix))
+	if err != nil {
+		return "", false, errors.WithStack(err)
+	}
+	if len(earlier) > 0 {
+		return earlier[0], false, nil
+	}
+	path = filepath.Join(dir, now.UTC().Format("20060102T150405Z")+suffix)
+	err = ioutil.WriteFile(path, data, 0600)
+	if err != nil {
+		return "", false, errors.WithStack(err)
+	}
+	return path, true, nil
+}
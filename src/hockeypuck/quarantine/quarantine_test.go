@@ -0,0 +1,58 @@
+package quarantine
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	gc "gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { gc.TestingT(t) }
+
+type QuarantineSuite struct{}
+
+var _ = gc.Suite(&QuarantineSuite{})
+
+func (s *QuarantineSuite) TestWrite(c *gc.C) {
+	dir := filepath.Join(c.MkDir(), "quarantine")
+	now := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	path, written, err := Write(dir, Binary, []byte("key"), now)
+	c.Assert(err, gc.IsNil)
+	c.Assert(written, gc.Equals, true)
+	c.Assert(filepath.Dir(path), gc.Equals, dir)
+	c.Assert(filepath.Base(path), gc.Matches, `20200102T030405Z-[0-9a-f]{16}\.pgp`)
+
+	data, err := ioutil.ReadFile(path)
+	c.Assert(err, gc.IsNil)
+	c.Assert(string(data), gc.Equals, "key")
+	fi, err := os.Stat(path)
+	c.Assert(err, gc.IsNil)
+	c.Assert(fi.Mode().Perm(), gc.Equals, os.FileMode(0600))
+}
+
+func (s *QuarantineSuite) TestWriteDuplicate(c *gc.C) {
+	dir := filepath.Join(c.MkDir(), "quarantine")
+	now := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	path, written, err := Write(dir, Binary, []byte("key"), now)
+	c.Assert(err, gc.IsNil)
+	c.Assert(written, gc.Equals, true)
+
+	again, written, err := Write(dir, Binary, []byte("key"), now.Add(time.Hour))
+	c.Assert(err, gc.IsNil)
+	c.Assert(written, gc.Equals, false)
+	c.Assert(again, gc.Equals, path)
+
+	_, written, err = Write(dir, Armored, []byte("key"), now.Add(time.Hour))
+	c.Assert(err, gc.IsNil)
+	c.Assert(written, gc.Equals, true)
+	_, written, err = Write(dir, Binary, []byte("other key"), now.Add(time.Hour))
+	c.Assert(err, gc.IsNil)
+	c.Assert(written, gc.Equals, true)
+
+	files, err := ioutil.ReadDir(dir)
+	c.Assert(err, gc.IsNil)
+	c.Assert(files, gc.HasLen, 3)
+}
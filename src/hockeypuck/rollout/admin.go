@@ -0,0 +1,53 @@
+package rollout
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// Register adds the admin API for inspecting and overriding flags:
+//
+//	GET    /rollout                  lists every flag and its rollout
+//	PUT    /rollout/:flag?percent=N  overrides a flag's percentage
+//	DELETE /rollout/:flag            returns a flag to its configured percentage
+func (f *Flags) Register(r *httprouter.Router) {
+	r.GET("/rollout", f.list)
+	r.PUT("/rollout/:flag", f.override)
+	r.DELETE("/rollout/:flag", f.clearOverride)
+}
+
+func (f *Flags) list(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(f.Status())
+}
+
+func (f *Flags) override(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	name := ps.ByName("flag")
+	if !knownFlags[name] {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+	percent, err := strconv.ParseFloat(r.FormValue("percent"), 64)
+	if err != nil {
+		http.Error(w, "invalid percent", http.StatusBadRequest)
+		return
+	}
+	err = f.Override(name, percent)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	f.list(w, r, ps)
+}
+
+func (f *Flags) clearOverride(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	err := f.ClearOverride(ps.ByName("flag"))
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+	f.list(w, r, ps)
+}
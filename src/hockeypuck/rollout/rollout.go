@@ -0,0 +1,256 @@
+// Package rollout enables new ingest behaviors for a slice of keys at a
+// time, so that operators of large keyservers can canary a change on part of
+// their traffic before applying it everywhere.
+//
+// Each flag is enabled for a percentage of keys, chosen by a hash of the key
+// fingerprint. The same keys fall into the lowest percentiles for every
+// flag, so raising a flag's percentage only ever adds keys to its slice, and
+// a key in a 1% canary is also in every wider one.
+package rollout
+
+import (
+	"hash/fnv"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"hockeypuck/logging"
+	log "hockeypuck/logrus"
+)
+
+var logger = logging.Module("rollout")
+
+// Flags controlling new ingest behaviors.
+const (
+	// StripUnverified drops user IDs, user attributes and subkeys without a
+	// valid self-signature from keys submitted to /pks/add, rather than
+	// storing them and filtering them out of lookups.
+	StripUnverified = "strip-unverified"
+
+	// DropThirdPartySigs drops certifications made by other keys from keys
+	// submitted to /pks/add. It implies StripUnverified.
+	DropThirdPartySigs = "drop-third-party-sigs"
+)
+
+var knownFlags = map[string]bool{
+	StripUnverified:    true,
+	DropThirdPartySigs: true,
+}
+
+// Known returns the names of all flags, sorted.
+func Known() []string {
+	var names []string
+	for name := range knownFlags {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+type Settings struct {
+	// Flags maps flag names to the percentage of keys, from 0 to 100, for
+	// which they are enabled. Flags not listed are disabled.
+	Flags map[string]float64 `toml:"flags"`
+}
+
+func DefaultSettings() *Settings {
+	return &Settings{}
+}
+
+// Validate returns an error if a flag is unknown or its percentage is out of
+// range.
+func (s *Settings) Validate() error {
+	for name, percent := range s.Flags {
+		err := checkFlag(name, percent)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	return nil
+}
+
+func checkFlag(name string, percent float64) error {
+	if !knownFlags[name] {
+		return errors.Errorf("unknown rollout flag %q", name)
+	}
+	if percent < 0 || percent > 100 {
+		return errors.Errorf("rollout flag %q percentage %v not between 0 and 100", name, percent)
+	}
+	return nil
+}
+
+// buckets is the number of slices keys are hashed into, giving a resolution
+// of a hundredth of a percent.
+const buckets = 10000
+
+// FlagStatus describes the current rollout of a flag.
+type FlagStatus struct {
+	Name       string   `json:"name"`
+	Percent    float64  `json:"percent"`
+	Configured float64  `json:"configured"`
+	Override   *float64 `json:"override,omitempty"`
+}
+
+// Flags decides which flags are enabled for a key. A nil *Flags has every
+// flag disabled.
+type Flags struct {
+	mu         sync.RWMutex
+	configured map[string]float64
+	overrides  map[string]float64
+}
+
+// NewFlags returns flags rolled out as configured.
+func NewFlags(s *Settings) (*Flags, error) {
+	registerMetrics()
+	f := &Flags{
+		overrides: map[string]float64{},
+	}
+	err := f.SetSettings(s)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return f, nil
+}
+
+// SetSettings replaces the configured percentages. Overrides are kept, and
+// continue to take precedence.
+func (f *Flags) SetSettings(s *Settings) error {
+	if s == nil {
+		s = DefaultSettings()
+	}
+	err := s.Validate()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	configured := map[string]float64{}
+	for name, percent := range s.Flags {
+		configured[name] = percent
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.configured = configured
+	return nil
+}
+
+// Override sets the percentage for a flag until it is cleared or the server
+// restarts, regardless of configuration.
+func (f *Flags) Override(name string, percent float64) error {
+	err := checkFlag(name, percent)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.overrides[name] = percent
+	logger.WithFields(log.Fields{
+		"flag":    name,
+		"percent": percent,
+	}).Info("rollout: flag overridden")
+	return nil
+}
+
+// ClearOverride returns a flag to its configured percentage.
+func (f *Flags) ClearOverride(name string) error {
+	if !knownFlags[name] {
+		return errors.Errorf("unknown rollout flag %q", name)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.overrides, name)
+	logger.WithFields(log.Fields{
+		"flag":    name,
+		"percent": f.configured[name],
+	}).Info("rollout: flag override cleared")
+	return nil
+}
+
+// percent returns the effective percentage of a flag. The caller must hold
+// f.mu.
+func (f *Flags) percent(name string) float64 {
+	if percent, ok := f.overrides[name]; ok {
+		return percent
+	}
+	return f.configured[name]
+}
+
+// Enabled returns whether the named flag applies to the key with the given
+// fingerprint.
+func (f *Flags) Enabled(name, fingerprint string) bool {
+	if f == nil {
+		return false
+	}
+	f.mu.RLock()
+	percent := f.percent(name)
+	f.mu.RUnlock()
+
+	var enabled bool
+	switch {
+	case percent <= 0:
+	case percent >= 100:
+		enabled = true
+	default:
+		enabled = float64(bucket(fingerprint)) < percent*buckets/100
+	}
+	if enabled {
+		rolloutMetrics.decisions.WithLabelValues(name, "true").Inc()
+	} else {
+		rolloutMetrics.decisions.WithLabelValues(name, "false").Inc()
+	}
+	return enabled
+}
+
+// bucket returns the slice of keys into which a fingerprint falls.
+func bucket(fingerprint string) uint32 {
+	fp := strings.ToLower(strings.Replace(fingerprint, " ", "", -1))
+	fp = strings.TrimPrefix(fp, "0x")
+	h := fnv.New32a()
+	h.Write([]byte(fp))
+	return h.Sum32() % buckets
+}
+
+// Status returns the rollout of every known flag, sorted by name.
+func (f *Flags) Status() []FlagStatus {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	var result []FlagStatus
+	for _, name := range Known() {
+		status := FlagStatus{
+			Name:       name,
+			Percent:    f.percent(name),
+			Configured: f.configured[name],
+		}
+		if percent, ok := f.overrides[name]; ok {
+			status.Override = &percent
+		}
+		result = append(result, status)
+	}
+	return result
+}
+
+var rolloutMetrics = struct {
+	decisions *prometheus.CounterVec
+}{
+	decisions: prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "hockeypuck",
+			Name:      "rollout_decisions",
+			Help:      "Keys for which a rollout flag was checked since startup",
+		},
+		[]string{"flag", "enabled"},
+	),
+}
+
+var metricsRegister sync.Once
+
+func registerMetrics() {
+	metricsRegister.Do(func() {
+		prometheus.MustRegister(rolloutMetrics.decisions)
+	})
+}
@@ -0,0 +1,137 @@
+package rollout
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	stdtesting "testing"
+
+	"github.com/julienschmidt/httprouter"
+	gc "gopkg.in/check.v1"
+)
+
+func Test(t *stdtesting.T) { gc.TestingT(t) }
+
+type RolloutSuite struct{}
+
+var _ = gc.Suite(&RolloutSuite{})
+
+func fingerprints(n int) []string {
+	var fps []string
+	for i := 0; i < n; i++ {
+		fps = append(fps, fmt.Sprintf("%040x", i*7919))
+	}
+	return fps
+}
+
+func (s *RolloutSuite) TestPercentage(c *gc.C) {
+	f, err := NewFlags(&Settings{Flags: map[string]float64{StripUnverified: 25}})
+	c.Assert(err, gc.IsNil)
+
+	var enabled int
+	for _, fp := range fingerprints(4000) {
+		if f.Enabled(StripUnverified, fp) {
+			enabled++
+		}
+		c.Assert(f.Enabled(DropThirdPartySigs, fp), gc.Equals, false)
+	}
+	c.Assert(enabled > 800 && enabled < 1200, gc.Equals, true, gc.Commentf("enabled=%d", enabled))
+}
+
+func (s *RolloutSuite) TestSliceGrows(c *gc.C) {
+	f, err := NewFlags(&Settings{Flags: map[string]float64{
+		StripUnverified:    10,
+		DropThirdPartySigs: 50,
+	}})
+	c.Assert(err, gc.IsNil)
+
+	for _, fp := range fingerprints(1000) {
+		if f.Enabled(StripUnverified, fp) {
+			c.Assert(f.Enabled(DropThirdPartySigs, fp), gc.Equals, true)
+		}
+	}
+}
+
+func (s *RolloutSuite) TestFingerprintForm(c *gc.C) {
+	c.Assert(bucket("0xABCDEF0123"), gc.Equals, bucket("abcdef0123"))
+	c.Assert(bucket("ABCD EF01 23"), gc.Equals, bucket("abcdef0123"))
+}
+
+func (s *RolloutSuite) TestNil(c *gc.C) {
+	var f *Flags
+	c.Assert(f.Enabled(StripUnverified, "abcdef0123"), gc.Equals, false)
+}
+
+func (s *RolloutSuite) TestValidate(c *gc.C) {
+	_, err := NewFlags(&Settings{Flags: map[string]float64{"no-such-flag": 10}})
+	c.Assert(err, gc.ErrorMatches, `unknown rollout flag "no-such-flag"`)
+	_, err = NewFlags(&Settings{Flags: map[string]float64{StripUnverified: 101}})
+	c.Assert(err, gc.ErrorMatches, `.*not between 0 and 100`)
+}
+
+func (s *RolloutSuite) TestOverride(c *gc.C) {
+	f, err := NewFlags(&Settings{Flags: map[string]float64{StripUnverified: 0}})
+	c.Assert(err, gc.IsNil)
+	fp := "abcdef0123"
+
+	c.Assert(f.Override(StripUnverified, 100), gc.IsNil)
+	c.Assert(f.Enabled(StripUnverified, fp), gc.Equals, true)
+
+	// Overrides survive a reload.
+	c.Assert(f.SetSettings(&Settings{}), gc.IsNil)
+	c.Assert(f.Enabled(StripUnverified, fp), gc.Equals, true)
+
+	c.Assert(f.ClearOverride(StripUnverified), gc.IsNil)
+	c.Assert(f.Enabled(StripUnverified, fp), gc.Equals, false)
+
+	c.Assert(f.Override(StripUnverified, -1), gc.NotNil)
+	c.Assert(f.ClearOverride("no-such-flag"), gc.NotNil)
+}
+
+func (s *RolloutSuite) TestAdmin(c *gc.C) {
+	f, err := NewFlags(&Settings{Flags: map[string]float64{DropThirdPartySigs: 5}})
+	c.Assert(err, gc.IsNil)
+	r := httprouter.New()
+	f.Register(r)
+	srv := httptest.NewServer(r)
+	defer srv.Close()
+
+	do := func(method, path string) (int, []FlagStatus) {
+		req, err := http.NewRequest(method, srv.URL+path, nil)
+		c.Assert(err, gc.IsNil)
+		resp, err := http.DefaultClient.Do(req)
+		c.Assert(err, gc.IsNil)
+		defer resp.Body.Close()
+		var status []FlagStatus
+		if resp.StatusCode == http.StatusOK {
+			c.Assert(json.NewDecoder(resp.Body).Decode(&status), gc.IsNil)
+		}
+		return resp.StatusCode, status
+	}
+
+	code, status := do("PUT", "/rollout/"+StripUnverified+"?percent=12.5")
+	c.Assert(code, gc.Equals, http.StatusOK)
+	c.Assert(status, gc.HasLen, 2)
+	c.Assert(status[0].Name, gc.Equals, DropThirdPartySigs)
+	c.Assert(status[0].Percent, gc.Equals, 5.0)
+	c.Assert(status[0].Override, gc.IsNil)
+	c.Assert(status[1].Name, gc.Equals, StripUnverified)
+	c.Assert(status[1].Percent, gc.Equals, 12.5)
+	c.Assert(status[1].Configured, gc.Equals, 0.0)
+	c.Assert(*status[1].Override, gc.Equals, 12.5)
+
+	code, status = do("DELETE", "/rollout/"+StripUnverified)
+	c.Assert(code, gc.Equals, http.StatusOK)
+	c.Assert(status[1].Percent, gc.Equals, 0.0)
+	c.Assert(status[1].Override, gc.IsNil)
+
+	code, _ = do("PUT", "/rollout/"+StripUnverified+"?percent=200")
+	c.Assert(code, gc.Equals, http.StatusBadRequest)
+	code, _ = do("PUT", "/rollout/"+StripUnverified)
+	c.Assert(code, gc.Equals, http.StatusBadRequest)
+	code, _ = do("PUT", "/rollout/no-such-flag?percent=1")
+	c.Assert(code, gc.Equals, http.StatusNotFound)
+	code, _ = do("GET", "/rollout")
+	c.Assert(code, gc.Equals, http.StatusOK)
+}
@@ -0,0 +1,76 @@
+// Package sdnotify tells systemd about the state of the server, by the
+// sd_notify protocol: https://www.freedesktop.org/software/systemd/man/sd_notify.html
+//
+// Messages are only sent when the server was started by a unit with
+// Type=notify, which sets NOTIFY_SOCKET. Otherwise they are discarded, so
+// that the server runs the same under any other supervisor.
+package sdnotify
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// States sent to systemd.
+const (
+	// Ready is sent once the server has started.
+	Ready = "READY=1"
+
+	// Stopping is sent as the server begins to shut down.
+	Stopping = "STOPPING=1"
+
+	// Watchdog tells the service manager that the server is still alive.
+	Watchdog = "WATCHDOG=1"
+)
+
+// Notify sends state to the service manager, returning false if it is not
+// listening.
+func Notify(state string) (bool, error) {
+	name := os.Getenv("NOTIFY_SOCKET")
+	if name == "" {
+		return false, nil
+	}
+	addr := &net.UnixAddr{Name: name, Net: "unixgram"}
+	if name[0] == '@' {
+		// Abstract socket.
+		addr.Name = "\x00" + name[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, addr)
+	if err != nil {
+		return false, errors.WithStack(err)
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	if err != nil {
+		return false, errors.WithStack(err)
+	}
+	return true, nil
+}
+
+// Status returns the state which describes the server to the operator in
+// systemctl status.
+func Status(status string) string {
+	return "STATUS=" + status
+}
+
+// WatchdogInterval returns how often the service manager expects to be
+// told that the server is alive, or false if it is not watching this
+// process.
+func WatchdogInterval() (time.Duration, bool, error) {
+	usec := os.Getenv("WATCHDOG_USEC")
+	if usec == "" {
+		return 0, false, nil
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0, false, nil
+	}
+	n, err := strconv.ParseInt(usec, 10, 64)
+	if err != nil || n <= 0 {
+		return 0, false, errors.Errorf("invalid WATCHDOG_USEC %q", usec)
+	}
+	return time.Duration(n) * time.Microsecond, true, nil
+}
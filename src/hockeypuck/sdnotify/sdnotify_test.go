@@ -0,0 +1,79 @@
+package sdnotify
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	stdtesting "testing"
+	"time"
+
+	gc "gopkg.in/check.v1"
+)
+
+func Test(t *stdtesting.T) { gc.TestingT(t) }
+
+type NotifySuite struct{}
+
+var _ = gc.Suite(&NotifySuite{})
+
+func (s *NotifySuite) TearDownTest(c *gc.C) {
+	os.Unsetenv("NOTIFY_SOCKET")
+	os.Unsetenv("WATCHDOG_USEC")
+	os.Unsetenv("WATCHDOG_PID")
+}
+
+func (s *NotifySuite) TestNotify(c *gc.C) {
+	sent, err := Notify(Ready)
+	c.Assert(err, gc.IsNil)
+	c.Assert(sent, gc.Equals, false)
+
+	path := filepath.Join(c.MkDir(), "notify")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	c.Assert(err, gc.IsNil)
+	defer conn.Close()
+	os.Setenv("NOTIFY_SOCKET", path)
+
+	sent, err = Notify(Ready)
+	c.Assert(err, gc.IsNil)
+	c.Assert(sent, gc.Equals, true)
+	buf := make([]byte, 64)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, err := conn.Read(buf)
+	c.Assert(err, gc.IsNil)
+	c.Assert(string(buf[:n]), gc.Equals, "READY=1")
+
+	_, err = Notify(Status("serving"))
+	c.Assert(err, gc.IsNil)
+	n, err = conn.Read(buf)
+	c.Assert(err, gc.IsNil)
+	c.Assert(string(buf[:n]), gc.Equals, "STATUS=serving")
+}
+
+func (s *NotifySuite) TestWatchdogInterval(c *gc.C) {
+	_, ok, err := WatchdogInterval()
+	c.Assert(err, gc.IsNil)
+	c.Assert(ok, gc.Equals, false)
+
+	os.Setenv("WATCHDOG_USEC", "30000000")
+	interval, ok, err := WatchdogInterval()
+	c.Assert(err, gc.IsNil)
+	c.Assert(ok, gc.Equals, true)
+	c.Assert(interval, gc.Equals, 30*time.Second)
+
+	os.Setenv("WATCHDOG_PID", strconv.Itoa(os.Getpid()))
+	_, ok, err = WatchdogInterval()
+	c.Assert(err, gc.IsNil)
+	c.Assert(ok, gc.Equals, true)
+
+	// The watchdog is meant for another process.
+	os.Setenv("WATCHDOG_PID", strconv.Itoa(os.Getpid()+1))
+	_, ok, err = WatchdogInterval()
+	c.Assert(err, gc.IsNil)
+	c.Assert(ok, gc.Equals, false)
+
+	os.Unsetenv("WATCHDOG_PID")
+	os.Setenv("WATCHDOG_USEC", "soon")
+	_, _, err = WatchdogInterval()
+	c.Assert(err, gc.NotNil)
+}
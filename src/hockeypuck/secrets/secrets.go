@@ -0,0 +1,225 @@
+// Package secrets resolves references to secrets in configuration values,
+// so that credentials such as the database password need not be written
+// into the configuration file.
+//
+// A reference is written ${source:name} anywhere within a value:
+//
+//	${vault:path#field}	field of the Vault secret at path
+//	${file:/path}		contents of a file, less trailing whitespace
+//	${env:NAME}		value of an environment variable
+//
+// For example, a DSN may take dynamic database credentials from Vault with
+// "user=${vault:database/creds/hockeypuck#username}
+// password=${vault:database/creds/hockeypuck#password} ...". Each Vault
+// secret is read once, so fields of the same path come from the same lease.
+// Renewable leases are renewed in the background for as long as Vault
+// allows.
+package secrets
+
+import (
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"gopkg.in/tomb.v2"
+
+	"hockeypuck/clock"
+	log "hockeypuck/logrus"
+)
+
+type Settings struct {
+	Vault VaultSettings `toml:"vault"`
+}
+
+func DefaultSettings() *Settings {
+	return &Settings{
+		Vault: VaultSettings{
+			TimeoutSecs: DefaultVaultTimeoutSecs,
+		},
+	}
+}
+
+var referencePattern = regexp.MustCompile(`\$\{(vault|file|env):([^}]*)\}`)
+
+// Resolver expands secret references and keeps the Vault leases of the
+// secrets it has read alive.
+type Resolver struct {
+	vault *vaultClient
+	clock clock.Clock
+
+	mu      sync.Mutex
+	secrets map[string]*vaultSecret
+
+	t tomb.Tomb
+}
+
+// NewResolver returns a resolver configured by settings. Vault is only
+// contacted if a value refers to it.
+func NewResolver(settings *Settings) (*Resolver, error) {
+	if settings == nil {
+		settings = DefaultSettings()
+	}
+	vc, err := newVaultClient(&settings.Vault)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return &Resolver{
+		vault:   vc,
+		clock:   clock.Real(),
+		secrets: map[string]*vaultSecret{},
+	}, nil
+}
+
+// SetClock sets the clock used to schedule lease renewals.
+func (r *Resolver) SetClock(c clock.Clock) {
+	r.clock = c
+}
+
+// Expand returns s with every secret reference replaced by the secret.
+func (r *Resolver) Expand(s string) (string, error) {
+	var expandErr error
+	result := referencePattern.ReplaceAllStringFunc(s, func(ref string) string {
+		m := referencePattern.FindStringSubmatch(ref)
+		value, err := r.lookup(m[1], m[2])
+		if err != nil && expandErr == nil {
+			expandErr = errors.Wrapf(err, "cannot resolve %s", ref)
+		}
+		return value
+	})
+	if expandErr != nil {
+		return "", expandErr
+	}
+	return result, nil
+}
+
+func (r *Resolver) lookup(source, name string) (string, error) {
+	switch source {
+	case "file":
+		contents, err := ioutil.ReadFile(name)
+		if err != nil {
+			return "", errors.WithStack(err)
+		}
+		return strings.TrimRight(string(contents), " \t\r\n"), nil
+	case "env":
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			return "", errors.Errorf("environment variable %q not set", name)
+		}
+		return value, nil
+	case "vault":
+		hash := strings.LastIndex(name, "#")
+		if hash < 1 || hash == len(name)-1 {
+			return "", errors.Errorf("vault reference %q must be path#field", name)
+		}
+		secret, err := r.vaultSecret(name[:hash])
+		if err != nil {
+			return "", errors.WithStack(err)
+		}
+		return secret.field(name[hash+1:])
+	}
+	return "", errors.Errorf("unknown secret source %q", source)
+}
+
+func (r *Resolver) vaultSecret(path string) (*vaultSecret, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if secret, ok := r.secrets[path]; ok {
+		return secret, nil
+	}
+	if r.vault == nil {
+		return nil, errors.New("vault address not configured")
+	}
+	secret, err := r.vault.read(path)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	secret.renewAt = r.renewalTime(secret)
+	r.secrets[path] = secret
+	return secret, nil
+}
+
+// renewalTime returns when a lease should be renewed: two thirds of the way
+// through it, leaving time to retry. Leases which cannot be renewed give
+// the zero time.
+func (r *Resolver) renewalTime(secret *vaultSecret) time.Time {
+	if !secret.Renewable || secret.LeaseID == "" || secret.LeaseDuration <= 0 {
+		return time.Time{}
+	}
+	return r.clock.Now().Add(time.Duration(secret.LeaseDuration) * time.Second * 2 / 3)
+}
+
+// Start renewing leases.
+func (r *Resolver) Start() {
+	r.t.Go(r.run)
+}
+
+// Stop renewing leases. The leases are not revoked, so credentials remain
+// valid until they expire.
+func (r *Resolver) Stop() error {
+	r.t.Kill(nil)
+	return r.t.Wait()
+}
+
+func (r *Resolver) run() error {
+	for {
+		secret := r.nextRenewal()
+		if secret == nil {
+			<-r.t.Dying()
+			return nil
+		}
+		timer := r.clock.NewTimer(secret.renewAt.Sub(r.clock.Now()))
+		select {
+		case <-r.t.Dying():
+			timer.Stop()
+			return nil
+		case <-timer.C():
+		}
+		r.renew(secret)
+	}
+}
+
+// nextRenewal returns the secret whose lease is next due for renewal.
+func (r *Resolver) nextRenewal() *vaultSecret {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var next *vaultSecret
+	for _, secret := range r.secrets {
+		if secret.renewAt.IsZero() {
+			continue
+		}
+		if next == nil || secret.renewAt.Before(next.renewAt) {
+			next = secret
+		}
+	}
+	return next
+}
+
+func (r *Resolver) renew(secret *vaultSecret) {
+	duration, err := r.vault.renew(secret.LeaseID, secret.LeaseDuration)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err != nil {
+		log.WithFields(log.Fields{
+			"lease": secret.LeaseID,
+		}).Errorf("cannot renew lease, credentials will expire and hockeypuck must be restarted: %v", err)
+		secret.renewAt = time.Time{}
+		return
+	}
+	if duration < secret.LeaseDuration {
+		// The lease has reached its maximum TTL.
+		log.WithFields(log.Fields{
+			"lease":   secret.LeaseID,
+			"expires": r.clock.Now().Add(time.Duration(duration) * time.Second),
+		}).Warning("lease cannot be extended further, hockeypuck must be restarted before it expires")
+	}
+	secret.LeaseDuration = duration
+	secret.renewAt = r.renewalTime(secret)
+	log.WithFields(log.Fields{
+		"lease":    secret.LeaseID,
+		"duration": duration,
+	}).Debug("renewed lease")
+}
@@ -0,0 +1,186 @@
+package secrets
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	stdtesting "testing"
+	"time"
+
+	gc "gopkg.in/check.v1"
+
+	"hockeypuck/clock"
+)
+
+func Test(t *stdtesting.T) { gc.TestingT(t) }
+
+type SecretsSuite struct {
+	srv       *httptest.Server
+	dir       string
+	tokenFile string
+
+	mu       sync.Mutex
+	reads    map[string]int
+	renewals []map[string]interface{}
+}
+
+var _ = gc.Suite(&SecretsSuite{})
+
+func (s *SecretsSuite) SetUpTest(c *gc.C) {
+	s.reads = map[string]int{}
+	s.renewals = nil
+	s.srv = httptest.NewServer(http.HandlerFunc(s.vault))
+	s.dir = c.MkDir()
+	s.tokenFile = filepath.Join(s.dir, "token")
+	err := ioutil.WriteFile(s.tokenFile, []byte("s.test\n"), 0600)
+	c.Assert(err, gc.IsNil)
+}
+
+func (s *SecretsSuite) TearDownTest(c *gc.C) {
+	s.srv.Close()
+}
+
+// vault emulates the parts of the Vault HTTP API used by the resolver.
+func (s *SecretsSuite) vault(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("X-Vault-Token") != "s.test" {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte(`{"errors":["permission denied"]}`))
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var resp interface{}
+	switch {
+	case r.Method == "GET" && r.URL.Path == "/v1/secret/data/hockeypuck":
+		resp = map[string]interface{}{
+			"data": map[string]interface{}{
+				"data":     map[string]interface{}{"controlPassword": "hunter2"},
+				"metadata": map[string]interface{}{"version": 3},
+			},
+		}
+	case r.Method == "GET" && r.URL.Path == "/v1/database/creds/hockeypuck":
+		resp = map[string]interface{}{
+			"lease_id":       "database/creds/hockeypuck/abc",
+			"lease_duration": 3600,
+			"renewable":      true,
+			"data":           map[string]interface{}{"username": "v-hkp", "password": "p4ss"},
+		}
+	case r.Method == "PUT" && r.URL.Path == "/v1/sys/leases/renew":
+		var req map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&req)
+		s.renewals = append(s.renewals, req)
+		resp = map[string]interface{}{
+			"lease_id":       req["lease_id"],
+			"lease_duration": 3600,
+			"renewable":      true,
+		}
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"errors":[]}`))
+		return
+	}
+	s.reads[r.URL.Path]++
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (s *SecretsSuite) newResolver(c *gc.C) *Resolver {
+	r, err := NewResolver(&Settings{Vault: VaultSettings{
+		Address:   s.srv.URL,
+		TokenFile: s.tokenFile,
+	}})
+	c.Assert(err, gc.IsNil)
+	return r
+}
+
+func (s *SecretsSuite) TestExpand(c *gc.C) {
+	r := s.newResolver(c)
+
+	dsn, err := r.Expand("database=hkp user=${vault:database/creds/hockeypuck#username} password=${vault:database/creds/hockeypuck#password}")
+	c.Assert(err, gc.IsNil)
+	c.Assert(dsn, gc.Equals, "database=hkp user=v-hkp password=p4ss")
+	c.Assert(s.reads["/v1/database/creds/hockeypuck"], gc.Equals, 1)
+
+	password, err := r.Expand("${vault:secret/data/hockeypuck#controlPassword}")
+	c.Assert(err, gc.IsNil)
+	c.Assert(password, gc.Equals, "hunter2")
+
+	passFile := filepath.Join(s.dir, "pass")
+	err = ioutil.WriteFile(passFile, []byte("from-file\n"), 0600)
+	c.Assert(err, gc.IsNil)
+	value, err := r.Expand("${file:" + passFile + "}")
+	c.Assert(err, gc.IsNil)
+	c.Assert(value, gc.Equals, "from-file")
+
+	os.Setenv("HOCKEYPUCK_TEST_SECRET", "from-env")
+	defer os.Unsetenv("HOCKEYPUCK_TEST_SECRET")
+	value, err = r.Expand("x${env:HOCKEYPUCK_TEST_SECRET}x")
+	c.Assert(err, gc.IsNil)
+	c.Assert(value, gc.Equals, "xfrom-envx")
+
+	value, err = r.Expand("no $references {here}")
+	c.Assert(err, gc.IsNil)
+	c.Assert(value, gc.Equals, "no $references {here}")
+}
+
+func (s *SecretsSuite) TestExpandErrors(c *gc.C) {
+	r := s.newResolver(c)
+	for _, ref := range []string{
+		"${vault:secret/data/missing#password}",
+		"${vault:database/creds/hockeypuck#nosuchfield}",
+		"${vault:database/creds/hockeypuck}",
+		"${env:HOCKEYPUCK_TEST_UNSET}",
+		"${file:" + filepath.Join(s.dir, "missing") + "}",
+	} {
+		_, err := r.Expand(ref)
+		c.Check(err, gc.NotNil, gc.Commentf("%s", ref))
+	}
+
+	err := ioutil.WriteFile(s.tokenFile, []byte("s.wrong"), 0600)
+	c.Assert(err, gc.IsNil)
+	_, err = r.Expand("${vault:secret/data/hockeypuck#controlPassword}")
+	c.Assert(err, gc.ErrorMatches, ".*403 Forbidden: permission denied")
+
+	r, err = NewResolver(nil)
+	c.Assert(err, gc.IsNil)
+	if os.Getenv("VAULT_ADDR") == "" {
+		_, err = r.Expand("${vault:database/creds/hockeypuck#username}")
+		c.Assert(err, gc.ErrorMatches, ".*vault address not configured")
+	}
+}
+
+func (s *SecretsSuite) TestRenew(c *gc.C) {
+	clk := clock.NewFake(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	r := s.newResolver(c)
+	r.SetClock(clk)
+	_, err := r.Expand("${vault:database/creds/hockeypuck#username} ${vault:secret/data/hockeypuck#controlPassword}")
+	c.Assert(err, gc.IsNil)
+
+	r.Start()
+	defer r.Stop()
+	for i := 0; i < 2; i++ {
+		for j := 0; j < 100 && clk.Timers() == 0; j++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+		c.Assert(clk.Timers(), gc.Equals, 1)
+		clk.Advance(40 * time.Minute)
+		for j := 0; j < 100; j++ {
+			s.mu.Lock()
+			n := len(s.renewals)
+			s.mu.Unlock()
+			if n > i {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c.Assert(s.renewals, gc.HasLen, 2)
+	c.Assert(s.renewals[0]["lease_id"], gc.Equals, "database/creds/hockeypuck/abc")
+	c.Assert(s.renewals[0]["increment"], gc.Equals, float64(3600))
+}
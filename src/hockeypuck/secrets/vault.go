@@ -0,0 +1,170 @@
+package secrets
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const DefaultVaultTimeoutSecs = 10
+
+type VaultSettings struct {
+	// Address is the base URL of the Vault server. If empty, VAULT_ADDR is
+	// used.
+	Address string `toml:"address"`
+
+	// TokenFile holds the Vault token, such as the sink file of a Vault
+	// agent which keeps the token renewed. If empty, VAULT_TOKEN is used.
+	TokenFile string `toml:"tokenFile"`
+
+	// Namespace is the Vault Enterprise namespace of the secrets.
+	Namespace string `toml:"namespace"`
+
+	// TimeoutSecs limits how long a request to Vault may take.
+	TimeoutSecs int `toml:"timeoutSecs"`
+}
+
+type vaultClient struct {
+	address   string
+	tokenFile string
+	namespace string
+	client    *http.Client
+}
+
+// newVaultClient returns a client for the configured Vault server, or nil if
+// none is configured.
+func newVaultClient(settings *VaultSettings) (*vaultClient, error) {
+	address := settings.Address
+	if address == "" {
+		address = os.Getenv("VAULT_ADDR")
+	}
+	if address == "" {
+		return nil, nil
+	}
+	if !strings.HasPrefix(address, "http://") && !strings.HasPrefix(address, "https://") {
+		return nil, errors.Errorf("invalid vault address %q", address)
+	}
+	timeout := settings.TimeoutSecs
+	if timeout <= 0 {
+		timeout = DefaultVaultTimeoutSecs
+	}
+	return &vaultClient{
+		address:   strings.TrimSuffix(address, "/"),
+		tokenFile: settings.TokenFile,
+		namespace: settings.Namespace,
+		client:    &http.Client{Timeout: time.Duration(timeout) * time.Second},
+	}, nil
+}
+
+// token returns the current token. The token file is read on every request,
+// so that a token renewed or replaced by an agent is picked up.
+func (vc *vaultClient) token() (string, error) {
+	if vc.tokenFile == "" {
+		token := os.Getenv("VAULT_TOKEN")
+		if token == "" {
+			return "", errors.New("no vault token file configured and VAULT_TOKEN not set")
+		}
+		return token, nil
+	}
+	token, err := ioutil.ReadFile(vc.tokenFile)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	return strings.TrimSpace(string(token)), nil
+}
+
+// vaultSecret is the response to a Vault read.
+type vaultSecret struct {
+	LeaseID       string                 `json:"lease_id"`
+	LeaseDuration int                    `json:"lease_duration"`
+	Renewable     bool                   `json:"renewable"`
+	Data          map[string]interface{} `json:"data"`
+
+	// renewAt is when the lease is next renewed, or zero if it is not.
+	renewAt time.Time
+}
+
+func (s *vaultSecret) field(name string) (string, error) {
+	data := s.Data
+	// Version 2 of the key/value engine nests the secret and its metadata.
+	if inner, ok := data["data"].(map[string]interface{}); ok {
+		if _, ok := data["metadata"]; ok {
+			data = inner
+		}
+	}
+	value, ok := data[name]
+	if !ok {
+		return "", errors.Errorf("secret has no field %q", name)
+	}
+	if s, ok := value.(string); ok {
+		return s, nil
+	}
+	return fmt.Sprint(value), nil
+}
+
+func (vc *vaultClient) read(path string) (*vaultSecret, error) {
+	var secret vaultSecret
+	err := vc.do("GET", strings.TrimPrefix(path, "/"), nil, &secret)
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot read %q", path)
+	}
+	return &secret, nil
+}
+
+// renew extends a lease, returning its new duration in seconds.
+func (vc *vaultClient) renew(leaseID string, increment int) (int, error) {
+	var secret vaultSecret
+	err := vc.do("PUT", "sys/leases/renew", map[string]interface{}{
+		"lease_id":  leaseID,
+		"increment": increment,
+	}, &secret)
+	if err != nil {
+		return 0, errors.WithStack(err)
+	}
+	return secret.LeaseDuration, nil
+}
+
+func (vc *vaultClient) do(method, path string, body interface{}, result interface{}) error {
+	token, err := vc.token()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	var reqBody io.Reader
+	if body != nil {
+		buf, err := json.Marshal(body)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		reqBody = bytes.NewReader(buf)
+	}
+	req, err := http.NewRequest(method, vc.address+"/v1/"+path, reqBody)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	req.Header.Set("X-Vault-Token", token)
+	req.Header.Set("X-Vault-Request", "true")
+	if vc.namespace != "" {
+		req.Header.Set("X-Vault-Namespace", vc.namespace)
+	}
+	resp, err := vc.client.Do(req)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		var vaultErr struct {
+			Errors []string `json:"errors"`
+		}
+		json.NewDecoder(io.LimitReader(resp.Body, 65536)).Decode(&vaultErr)
+		return errors.Errorf("vault returned %s: %s", resp.Status, strings.Join(vaultErr.Errors, "; "))
+	}
+	return errors.WithStack(json.NewDecoder(resp.Body).Decode(result))
+}
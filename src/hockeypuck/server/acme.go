@@ -0,0 +1,104 @@
+package server
+
+import (
+	"crypto/tls"
+	"net/http"
+	"os"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+
+	"hockeypuck/proxyproto"
+)
+
+// newACMEManager returns a manager which obtains and renews the HKPS
+// certificate, if ACME is configured.
+func newACMEManager(settings *Settings) (*autocert.Manager, error) {
+	if settings.HKPS == nil || settings.HKPS.ACME == nil {
+		return nil, nil
+	}
+	config := settings.HKPS.ACME
+	hosts := config.Hosts
+	if len(hosts) == 0 && settings.Hostname != "" {
+		hosts = []string{settings.Hostname}
+	}
+	if len(hosts) == 0 {
+		return nil, errors.New("ACME requires hkps.acme.hosts or hostname to be set")
+	}
+	cacheDir := config.CacheDir
+	if cacheDir == "" {
+		cacheDir = DefaultACMECacheDir
+	}
+	err := os.MkdirAll(cacheDir, 0700)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		Cache:      autocert.DirCache(cacheDir),
+		HostPolicy: autocert.HostWhitelist(hosts...),
+		Email:      config.Email,
+		Client:     &acme.Client{DirectoryURL: config.DirectoryURL},
+	}, nil
+}
+
+// hkpsTLSConfig returns the TLS configuration for HKPS, with a certificate
+// either obtained by ACME or loaded from the configured files.
+func (s *Server) hkpsTLSConfig() (*tls.Config, error) {
+	config := &tls.Config{
+		NextProtos: []string{"http/1.1"},
+	}
+	if s.settings.HKP.HTTP.HTTP2 {
+		config.NextProtos = []string{"h2", "http/1.1"}
+	}
+	if s.acme != nil {
+		config.GetCertificate = s.acme.GetCertificate
+		return config, nil
+	}
+	cert, err := tls.LoadX509KeyPair(s.settings.HKPS.Cert, s.settings.HKPS.Key)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to load HKPS certificate=%q key=%q", s.settings.HKPS.Cert, s.settings.HKPS.Key)
+	}
+	config.Certificates = []tls.Certificate{cert}
+	return config, nil
+}
+
+// challengeBind returns the address of a separate listener for ACME HTTP-01
+// challenges, or "" if there is none.
+func (s *Server) challengeBind() string {
+	if s.acme == nil {
+		return ""
+	}
+	bind := s.settings.HKPS.ACME.ChallengeBind
+	if bind == "" {
+		bind = DefaultACMEChallengeBind
+	}
+	if bind == s.settings.HKP.Bind {
+		return ""
+	}
+	return bind
+}
+
+// hkpHandler returns the handler for HKP, which also answers ACME HTTP-01
+// challenges if they share its address.
+func (s *Server) hkpHandler() http.Handler {
+	if s.acme != nil && s.challengeBind() == "" {
+		return s.acme.HTTPHandler(s.middle)
+	}
+	return s.middle
+}
+
+// listenAndServeChallenge answers ACME HTTP-01 challenges, redirecting
+// other requests to HKPS.
+func (s *Server) listenAndServeChallenge() error {
+	trusted, err := proxyproto.ParseTrusted(s.settings.HKPS.ProxyProtocol)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	ln, err := newListener(s, s.challengeBind())
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return s.newHTTPServer(s.acme.HTTPHandler(nil)).Serve(trusted.Listener(ln))
+}
@@ -0,0 +1,115 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/pkg/errors"
+
+	"hockeypuck/logging"
+)
+
+// adminHandler returns the handler for the admin API.
+func (s *Server) adminHandler() http.Handler {
+	r := httprouter.New()
+	s.rollout.Register(r)
+	s.announcements.Register(r)
+	s.abuseScorer.Register(r)
+	s.registerMaintenance(r)
+	s.registerSubsystemsAdmin(r)
+	r.GET("/ingest", s.ingestStatus)
+	r.GET("/deprecations", s.deprecationUsage)
+	if s.sksPeer != nil {
+		r.GET("/recon/selfcheck", s.selfCheckStatus)
+		r.POST("/recon/selfcheck", s.startSelfCheck)
+		r.GET("/recon/audit", s.reconAudits)
+		r.GET("/recon/audit/:partner", s.reconAudit)
+		r.GET("/recon/partners", s.reconPartners)
+	}
+	logging.Register(r)
+	if s.tokens != nil {
+		s.tokens.Register(r)
+	}
+	return r
+}
+
+// deprecationUsage lists the clients still using each deprecated behavior.
+func (s *Server) deprecationUsage(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.deprecations.Usage())
+}
+
+// ingestStatus lists the storage writes in progress and waiting for each
+// source of key updates.
+func (s *Server) ingestStatus(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.ingest.Status())
+}
+
+// selfCheckStatus reports the last self check of the prefix tree against
+// storage.
+func (s *Server) selfCheckStatus(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	report := s.sksPeer.LastSelfCheck()
+	if report == nil {
+		http.Error(w, "no self check has finished", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
+
+// startSelfCheck starts a self check, repairing the differences found if
+// repair=true is given.
+func (s *Server) startSelfCheck(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	repair := r.FormValue("repair") == "true"
+	if !s.sksPeer.StartSelfCheck(repair) {
+		http.Error(w, "a self check is already running", http.StatusConflict)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// reconAudits lists the last recon session with each partner configured for
+// audit, with the digests of the keys which would have been recovered.
+func (s *Server) reconAudits(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.sksPeer.Audits())
+}
+
+// reconAudit reports the last recon session with an audited partner. With
+// format=text, only the digests are listed, one per line.
+func (s *Server) reconAudit(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	report, ok := s.sksPeer.Audits()[ps.ByName("partner")]
+	if !ok {
+		http.Error(w, "no audit of this partner", http.StatusNotFound)
+		return
+	}
+	if r.FormValue("format") == "text" {
+		w.Header().Set("Content-Type", "text/plain")
+		for _, digest := range report.Digests {
+			fmt.Fprintln(w, digest)
+		}
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
+
+// reconPartners reports the recent recon sessions with each partner, with
+// the errors which op=stats leaves out.
+func (s *Server) reconPartners(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.sksPeer.PartnerStatus())
+}
+
+// listenAndServeAdmin serves the admin API on its own address, apart from
+// the public HKP listeners.
+func (s *Server) listenAndServeAdmin() error {
+	ln, err := newListener(s, s.settings.Admin.Bind)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return http.Serve(ln, s.adminHandler())
+}
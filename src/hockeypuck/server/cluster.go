@@ -0,0 +1,456 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/pkg/errors"
+	"gopkg.in/tomb.v2"
+
+	"hockeypuck/abuse"
+	"hockeypuck/hkp/replica"
+	"hockeypuck/hkp/storage"
+	log "hockeypuck/logrus"
+	"hockeypuck/notify"
+)
+
+// changesPath is where front ends report key changes to the stateful server.
+const changesPath = "/pks/changes"
+
+// maxChangeLength limits the size of a reported key change.
+const maxChangeLength = 65536
+
+func (c *ClusterConfig) validate(rs *replica.Settings) error {
+	if c == nil {
+		return nil
+	}
+	if c.Stateful != "" {
+		_, err := c.statefulURL()
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if rs.Enabled() {
+			return errors.New("a cluster front end cannot also be a replica")
+		}
+	}
+	_, err := c.frontendNets()
+	return errors.WithStack(err)
+}
+
+func (c *ClusterConfig) statefulURL() (*url.URL, error) {
+	u, err := url.Parse(strings.TrimSuffix(c.Stateful, "/"))
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid stateful server URL %q", c.Stateful)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, errors.Errorf("invalid stateful server URL %q", c.Stateful)
+	}
+	return u, nil
+}
+
+func (c *ClusterConfig) frontendNets() ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, cidr := range c.FrontendCIDRs {
+		_, ipnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid front end CIDR %q", cidr)
+		}
+		nets = append(nets, ipnet)
+	}
+	return nets, nil
+}
+
+// Delays between attempts to deliver a change report.
+const (
+	reportRetryMin = time.Second
+	reportRetryMax = time.Minute
+)
+
+// maxReportDefer limits how long a front end waits before reporting again
+// when the stateful server asks it to, such as during maintenance.
+const maxReportDefer = 5 * time.Minute
+
+// reportTimeout limits how long a single change report may take.
+const reportTimeout = 30 * time.Second
+
+// maxPendingReports limits the change reports a front end without a spool
+// file holds in memory while the stateful server is unreachable.
+const maxPendingReports = 100000
+
+// spoolCompactAt is the number of acknowledged reports at the head of the
+// spool file after which it may be rewritten without them.
+const spoolCompactAt = 10000
+
+// changeReporter has a front end report the key changes it makes to the
+// stateful server, so that they are added to its prefix tree. Reports are
+// delivered in order, and each is retried until the stateful server
+// acknowledges it. If a spool file is configured, reports not yet
+// acknowledged are kept there, so that they are delivered after a restart.
+//
+// A report may be delivered more than once, such as after a restart; the
+// stateful server checks each against the storage, so this is harmless.
+type changeReporter struct {
+	url    string
+	client *http.Client
+	spool  string
+
+	mu      sync.Mutex
+	pending []*notify.Event
+	acked   int
+	f       *os.File
+	wake    chan struct{}
+
+	t tomb.Tomb
+}
+
+var _ notify.Publisher = (*changeReporter)(nil)
+
+func newChangeReporter(c *ClusterConfig) (*changeReporter, error) {
+	u, err := c.statefulURL()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	r := &changeReporter{
+		url:    u.String() + changesPath,
+		client: &http.Client{Timeout: reportTimeout},
+		spool:  c.ReportSpool,
+		wake:   make(chan struct{}, 1),
+	}
+	err = r.openSpool()
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot open change report spool %q", r.spool)
+	}
+	return r, nil
+}
+
+// openSpool reads the reports left in the spool file by a previous run,
+// and opens it to append new ones.
+func (r *changeReporter) openSpool() error {
+	if r.spool == "" {
+		return nil
+	}
+	f, err := os.Open(r.spool)
+	if err == nil {
+		dec := json.NewDecoder(f)
+		for {
+			var ev notify.Event
+			err = dec.Decode(&ev)
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				// The last report may have been cut short by a crash.
+				log.Warningf("ignoring the rest of change report spool %q: %v", r.spool, err)
+				break
+			}
+			r.pending = append(r.pending, &ev)
+		}
+		f.Close()
+	} else if !os.IsNotExist(err) {
+		return errors.WithStack(err)
+	}
+	if len(r.pending) > 0 {
+		log.Infof("%d key change reports to deliver from spool %q", len(r.pending), r.spool)
+	}
+	serverMetrics.clusterReportsPending.Set(float64(len(r.pending)))
+	// Rewrite the spool, dropping any partial report, so that new reports
+	// are appended after whole ones.
+	return r.rewriteSpool()
+}
+
+// rewriteSpool replaces the spool file with one holding only the pending
+// reports. It is called with mu held, or before the reporter starts.
+func (r *changeReporter) rewriteSpool() error {
+	tmp := r.spool + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	enc := json.NewEncoder(f)
+	for _, ev := range r.pending {
+		err = enc.Encode(ev)
+		if err != nil {
+			f.Close()
+			return errors.WithStack(err)
+		}
+	}
+	err = f.Close()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	err = os.Rename(tmp, r.spool)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if r.f != nil {
+		r.f.Close()
+	}
+	r.f, err = os.OpenFile(r.spool, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	r.acked = 0
+	return nil
+}
+
+// Publish queues a report of a key change.
+func (r *changeReporter) Publish(fingerprint string, change storage.KeyChange, source string) {
+	ev, ok := notify.NewEvent(fingerprint, change, source)
+	if !ok {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.f == nil && len(r.pending) >= maxPendingReports {
+		log.WithFields(log.Fields{
+			"fingerprint": ev.Fingerprint,
+			"change":      ev.Change,
+		}).Error("change report queue full, report dropped; run fsck -repair on the stateful server")
+		return
+	}
+	if r.f != nil {
+		err := json.NewEncoder(r.f).Encode(ev)
+		if err != nil {
+			// The report is still delivered unless the server restarts.
+			log.Errorf("cannot spool key change report: %v", err)
+		}
+	}
+	r.pending = append(r.pending, ev)
+	serverMetrics.clusterReportsPending.Set(float64(len(r.pending)))
+	select {
+	case r.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Start delivering reports.
+func (r *changeReporter) Start() {
+	r.t.Go(r.run)
+}
+
+// Stop delivering reports. Reports not yet delivered are left in the spool
+// file, if any, for the next run.
+func (r *changeReporter) Stop() error {
+	r.t.Kill(nil)
+	err := r.t.Wait()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.f != nil {
+		r.f.Close()
+		r.f = nil
+	} else if len(r.pending) > 0 {
+		log.Warningf("%d key change reports were not delivered; run fsck -repair on the stateful server", len(r.pending))
+	}
+	return errors.WithStack(err)
+}
+
+func (r *changeReporter) run() error {
+	retry := reportRetryMin
+	for {
+		r.mu.Lock()
+		var ev *notify.Event
+		if len(r.pending) > 0 {
+			ev = r.pending[0]
+		}
+		r.mu.Unlock()
+		if ev == nil {
+			select {
+			case <-r.t.Dying():
+				return nil
+			case <-r.wake:
+			}
+			continue
+		}
+
+		err := r.send(ev)
+		var rejected *reportRejectedError
+		var deferred *reportDeferredError
+		if errors.As(err, &deferred) {
+			// The stateful server is refusing writes for now, such as for
+			// maintenance, and has said when to try again.
+			log.WithFields(log.Fields{
+				"fingerprint": ev.Fingerprint,
+				"change":      ev.Change,
+			}).Infof("key change reports deferred for %s: %v", deferred.after, err)
+			select {
+			case <-r.t.Dying():
+				return nil
+			case <-time.After(deferred.after):
+			}
+			retry = reportRetryMin
+			continue
+		} else if errors.As(err, &rejected) {
+			// Sending it again would not help.
+			log.WithFields(log.Fields{
+				"fingerprint": ev.Fingerprint,
+				"change":      ev.Change,
+			}).Errorf("key change report rejected: %v", err)
+		} else if err != nil {
+			log.WithFields(log.Fields{
+				"fingerprint": ev.Fingerprint,
+				"change":      ev.Change,
+			}).Warningf("cannot report key change, retrying in %s: %v", retry, err)
+			select {
+			case <-r.t.Dying():
+				return nil
+			case <-time.After(retry):
+			}
+			retry *= 2
+			if retry > reportRetryMax {
+				retry = reportRetryMax
+			}
+			continue
+		}
+		retry = reportRetryMin
+		r.ack()
+	}
+}
+
+// ack removes the report at the head of the queue once it is delivered.
+func (r *changeReporter) ack() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.pending[0] = nil
+	r.pending = r.pending[1:]
+	serverMetrics.clusterReportsPending.Set(float64(len(r.pending)))
+	if r.f == nil {
+		return
+	}
+	r.acked++
+	// Rewriting the spool costs as much as the reports pending, so wait
+	// until at least as many have been acknowledged.
+	if len(r.pending) == 0 || r.acked >= spoolCompactAt && r.acked >= len(r.pending) {
+		err := r.rewriteSpool()
+		if err != nil {
+			log.Errorf("cannot rewrite change report spool %q: %v", r.spool, err)
+		}
+	}
+}
+
+// reportRejectedError is returned when the stateful server refuses a report
+// as invalid.
+type reportRejectedError struct {
+	status string
+}
+
+func (e *reportRejectedError) Error() string {
+	return "stateful server returned " + e.status
+}
+
+// reportDeferredError is returned when the stateful server is unavailable
+// and asks for the report to be sent again after a while.
+type reportDeferredError struct {
+	status string
+	after  time.Duration
+}
+
+func (e *reportDeferredError) Error() string {
+	return "stateful server returned " + e.status
+}
+
+// send delivers a report, returning nil once the stateful server has
+// acknowledged it.
+func (r *changeReporter) send(ev *notify.Event) error {
+	body, err := json.Marshal(ev)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	resp, err := r.client.Post(r.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode <= 299:
+		return nil
+	case resp.StatusCode == http.StatusBadRequest:
+		return errors.WithStack(&reportRejectedError{status: resp.Status})
+	case resp.StatusCode == http.StatusServiceUnavailable || resp.StatusCode == http.StatusTooManyRequests:
+		secs, err := strconv.Atoi(resp.Header.Get("Retry-After"))
+		if err == nil && secs > 0 {
+			after := time.Duration(secs) * time.Second
+			if after > maxReportDefer {
+				after = maxReportDefer
+			}
+			return errors.WithStack(&reportDeferredError{status: resp.Status, after: after})
+		}
+	}
+	return errors.Errorf("stateful server returned %s", resp.Status)
+}
+
+// registerChanges serves the endpoint to which front ends report key
+// changes, if any front ends are allowed to.
+func (s *Server) registerChanges(c *ClusterConfig) error {
+	if c == nil || len(c.FrontendCIDRs) == 0 {
+		return nil
+	}
+	nets, err := c.frontendNets()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	s.r.POST(changesPath, func(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+		ip := net.ParseIP(abuse.ClientAddr(r.RemoteAddr))
+		if !containsIP(nets, ip) {
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+		var ev notify.Event
+		err := json.NewDecoder(io.LimitReader(r.Body, maxChangeLength)).Decode(&ev)
+		if err != nil {
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+		change, err := eventChange(&ev)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		err = s.sksPeer.SyncChange(change)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"from":        r.RemoteAddr,
+				"fingerprint": ev.Fingerprint,
+			}).Errorf("cannot apply reported key change: %v", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	return nil
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, ipnet := range nets {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// eventChange returns the key change described by an event.
+func eventChange(ev *notify.Event) (storage.KeyChange, error) {
+	switch ev.Change {
+	case notify.ChangeAdded:
+		return storage.KeyAdded{Digest: ev.Digest}, nil
+	case notify.ChangeUpdated:
+		return storage.KeyReplaced{OldDigest: ev.OldDigest, NewDigest: ev.Digest}, nil
+	case notify.ChangeRemoved:
+		return storage.KeyRemoved{Digest: ev.Digest}, nil
+	}
+	return nil, errors.Errorf("unknown change type %q", ev.Change)
+}
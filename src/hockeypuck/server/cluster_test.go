@@ -0,0 +1,215 @@
+package server
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	stdtesting "testing"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/pkg/errors"
+	gc "gopkg.in/check.v1"
+
+	"hockeypuck/hkp/storage"
+	"hockeypuck/notify"
+)
+
+func Test(t *stdtesting.T) { gc.TestingT(t) }
+
+type ClusterSuite struct {
+	stateful *httptest.Server
+	statuses chan func(http.ResponseWriter)
+	received chan *notify.Event
+}
+
+var _ = gc.Suite(&ClusterSuite{})
+
+func (s *ClusterSuite) SetUpTest(c *gc.C) {
+	// Each report is answered by the next function sent on statuses, or
+	// acknowledged if there is none.
+	s.statuses = make(chan func(http.ResponseWriter), 10)
+	s.received = make(chan *notify.Event, 100)
+	s.stateful = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.Check(r.URL.Path, gc.Equals, changesPath)
+		var ev notify.Event
+		c.Check(json.NewDecoder(r.Body).Decode(&ev), gc.IsNil)
+		s.received <- &ev
+		select {
+		case status := <-s.statuses:
+			status(w)
+		default:
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+}
+
+func (s *ClusterSuite) TearDownTest(c *gc.C) {
+	s.stateful.Close()
+}
+
+func (s *ClusterSuite) reporter(c *gc.C, spool string) *changeReporter {
+	r, err := newChangeReporter(&ClusterConfig{Stateful: s.stateful.URL, ReportSpool: spool})
+	c.Assert(err, gc.IsNil)
+	return r
+}
+
+func (s *ClusterSuite) receive(c *gc.C) *notify.Event {
+	select {
+	case ev := <-s.received:
+		return ev
+	case <-time.After(10 * time.Second):
+		c.Fatal("timed out waiting for a change report")
+	}
+	return nil
+}
+
+// closeSpool closes the spool of a reporter which was not started.
+func closeSpool(r *changeReporter) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.f.Close()
+	r.f = nil
+}
+
+func publish(r *changeReporter, digests ...string) {
+	for _, digest := range digests {
+		r.Publish("fp-"+digest, storage.KeyAdded{Digest: digest}, "test")
+	}
+}
+
+func spoolLines(c *gc.C, path string) []string {
+	buf, err := ioutil.ReadFile(path)
+	c.Assert(err, gc.IsNil)
+	return strings.Fields(string(buf))
+}
+
+func (s *ClusterSuite) TestSpoolReplay(c *gc.C) {
+	spool := filepath.Join(c.MkDir(), "reports.json")
+	r := s.reporter(c, spool)
+	publish(r, "a", "b")
+	closeSpool(r)
+
+	// Reports not delivered before a restart are delivered after it, in
+	// order.
+	r = s.reporter(c, spool)
+	c.Assert(r.pending, gc.HasLen, 2)
+	r.Start()
+	defer r.Stop()
+	c.Assert(s.receive(c).Digest, gc.Equals, "a")
+	c.Assert(s.receive(c).Digest, gc.Equals, "b")
+}
+
+func (s *ClusterSuite) TestSpoolPartialReport(c *gc.C) {
+	spool := filepath.Join(c.MkDir(), "reports.json")
+	err := ioutil.WriteFile(spool, []byte(`{"fingerprint":"fp-a","md5":"a","change":"added"}`+"\n"+`{"fingerprint":"fp-b","md5"`), 0600)
+	c.Assert(err, gc.IsNil)
+
+	// A report cut short by a crash is dropped, and new reports are
+	// appended after the whole ones.
+	r := s.reporter(c, spool)
+	c.Assert(r.pending, gc.HasLen, 1)
+	publish(r, "c")
+	closeSpool(r)
+	r = s.reporter(c, spool)
+	defer closeSpool(r)
+	c.Assert(r.pending, gc.HasLen, 2)
+	c.Assert(r.pending[0].Digest, gc.Equals, "a")
+	c.Assert(r.pending[1].Digest, gc.Equals, "c")
+}
+
+func (s *ClusterSuite) TestDeferred(c *gc.C) {
+	s.statuses <- func(w http.ResponseWriter) {
+		w.Header().Set("Retry-After", "1")
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	r := s.reporter(c, "")
+	publish(r, "a")
+	r.Start()
+	defer r.Stop()
+
+	// The report is sent again once the stateful server said to.
+	start := time.Now()
+	c.Assert(s.receive(c).Digest, gc.Equals, "a")
+	c.Assert(s.receive(c).Digest, gc.Equals, "a")
+	c.Assert(time.Since(start) >= time.Second, gc.Equals, true)
+
+	// However long it asks for, the wait is capped.
+	s.statuses <- func(w http.ResponseWriter) {
+		w.Header().Set("Retry-After", "86400")
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	err := r.send(&notify.Event{Fingerprint: "fp-b", Digest: "b", Change: notify.ChangeAdded})
+	var deferred *reportDeferredError
+	c.Assert(errors.As(err, &deferred), gc.Equals, true)
+	c.Assert(deferred.after, gc.Equals, maxReportDefer)
+	s.receive(c)
+}
+
+func (s *ClusterSuite) TestRejected(c *gc.C) {
+	s.statuses <- func(w http.ResponseWriter) {
+		w.WriteHeader(http.StatusBadRequest)
+	}
+	r := s.reporter(c, "")
+	publish(r, "a", "b")
+	r.Start()
+	defer r.Stop()
+
+	// A rejected report is dropped rather than sent again.
+	c.Assert(s.receive(c).Digest, gc.Equals, "a")
+	c.Assert(s.receive(c).Digest, gc.Equals, "b")
+	select {
+	case ev := <-s.received:
+		c.Fatalf("unexpected report of %q", ev.Digest)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func (s *ClusterSuite) TestCompaction(c *gc.C) {
+	spool := filepath.Join(c.MkDir(), "reports.json")
+	r := s.reporter(c, spool)
+	defer closeSpool(r)
+	for i := 0; i <= spoolCompactAt; i++ {
+		publish(r, "a")
+	}
+
+	// The spool is rewritten once as many reports have been acknowledged
+	// as remain, and at least spoolCompactAt.
+	for i := 0; i < spoolCompactAt-1; i++ {
+		r.ack()
+	}
+	c.Assert(spoolLines(c, spool), gc.HasLen, spoolCompactAt+1)
+	r.ack()
+	c.Assert(spoolLines(c, spool), gc.HasLen, 1)
+	c.Assert(r.acked, gc.Equals, 0)
+
+	// And once every report has been acknowledged.
+	publish(r, "b")
+	r.ack()
+	c.Assert(spoolLines(c, spool), gc.HasLen, 2)
+	r.ack()
+	c.Assert(spoolLines(c, spool), gc.HasLen, 0)
+}
+
+func (s *ClusterSuite) TestChangesFrontendCIDRs(c *gc.C) {
+	srv := &Server{r: httprouter.New()}
+	err := srv.registerChanges(&ClusterConfig{FrontendCIDRs: []string{"192.0.2.0/24"}})
+	c.Assert(err, gc.IsNil)
+
+	for _, t := range []struct {
+		remoteAddr string
+		status     int
+	}{
+		{"198.51.100.1:1234", http.StatusForbidden},
+		{"192.0.2.1:1234", http.StatusBadRequest},
+	} {
+		req := httptest.NewRequest("POST", changesPath, strings.NewReader(`{"change":"frobbed"}`))
+		req.RemoteAddr = t.remoteAddr
+		w := httptest.NewRecorder()
+		srv.r.ServeHTTP(w, req)
+		c.Assert(w.Code, gc.Equals, t.status, gc.Commentf("%s", t.remoteAddr))
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"hockeypuck/hkp/storage"
+	"hockeypuck/server"
+)
+
+// dumpState records the position of the last incremental dump.
+type dumpState struct {
+	Last storage.ModifiedKey `json:"last"`
+}
+
+func readState(path string) (*dumpState, error) {
+	var state dumpState
+	buf, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return &state, nil
+	} else if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	err = json.Unmarshal(buf, &state)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid state file %q", path)
+	}
+	return &state, nil
+}
+
+func writeState(path string, state *dumpState) error {
+	buf, err := json.Marshal(state)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	tmp := path + ".tmp"
+	err = ioutil.WriteFile(tmp, buf, 0644)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(os.Rename(tmp, path))
+}
+
+// dumpIncremental writes the keys modified since the -since timestamp, or
+// since the position recorded in the -state file, to numbered dump files
+// which can be loaded with hockeypuck-load. Deleted keys are not recorded.
+func dumpIncremental(settings *server.Settings) error {
+	st, err := server.DialStorage(settings)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer st.Close()
+
+	if !storage.Supports(st, storage.CapModifiedSince) {
+		return errors.New("storage does not support incremental dumps")
+	}
+
+	state := &dumpState{}
+	if *stateFile != "" {
+		state, err = readState(*stateFile)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	if *since != "" {
+		t, err := time.Parse(time.RFC3339, *since)
+		if err != nil {
+			return errors.Wrapf(err, "invalid -since %q", *since)
+		}
+		state.Last = storage.ModifiedKey{MTime: t}
+	}
+
+	prefix := fmt.Sprintf("hkp-dump-%s", time.Now().UTC().Format("20060102T150405Z"))
+	var num, total int
+	var rfps []string
+	after := state.Last
+	for {
+		page, err := st.ModifiedAfter(after, *count-len(rfps))
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		for _, mk := range page {
+			rfps = append(rfps, mk.RFingerprint)
+		}
+		if len(page) > 0 {
+			after = page[len(page)-1]
+		}
+		if len(rfps) >= *count || (len(page) == 0 && len(rfps) > 0) {
+			err = writeFile(st, rfps, filepath.Join(*outputDir, fmt.Sprintf("%s-%04d.pgp", prefix, num)))
+			if err != nil {
+				return errors.WithStack(err)
+			}
+			total += len(rfps)
+			num++
+			rfps = nil
+		}
+		if len(page) == 0 {
+			break
+		}
+	}
+	log.Printf("dumped %d keys modified after %s to %d files",
+		total, state.Last.MTime.UTC().Format(time.RFC3339), num)
+
+	if *stateFile != "" {
+		state.Last = after
+		err = writeState(*stateFile, state)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	return nil
+}
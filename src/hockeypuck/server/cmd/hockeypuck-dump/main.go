@@ -29,11 +29,24 @@ var (
 	count      = flag.Int("count", 15000, "keys per file")
 	cpuProf    = flag.Bool("cpuprof", false, "enable CPU profiling")
 	memProf    = flag.Bool("memprof", false, "enable mem profiling")
+	since      = flag.String("since", "", "only dump keys modified after this RFC 3339 timestamp")
+	stateFile  = flag.String("state", "", "incremental dump state file; dump keys modified since the last dump recorded in it")
+
+	reproducible = flag.Bool("reproducible", false, "write a byte-reproducible dump in buckets of key digests, with a SHA256SUMS manifest")
+	bucketDigits = flag.Int("bucket-digits", 2, "hex digits of the key digest naming each bucket of a reproducible dump")
+	compare      = flag.Bool("compare", false, "compare two reproducible dumps, given as directories or manifests, bucket by bucket")
 )
 
 func main() {
 	flag.Parse()
 
+	if *compare {
+		if flag.NArg() != 2 {
+			cmd.Die(errors.New("-compare requires two dumps"))
+		}
+		cmd.Die(compareDumps(os.Stdout, flag.Arg(0), flag.Arg(1)))
+	}
+
 	var (
 		settings *server.Settings
 		err      error
@@ -47,6 +60,10 @@ func main() {
 		if err != nil {
 			cmd.Die(errors.WithStack(err))
 		}
+		_, err = server.ResolveSecrets(settings)
+		if err != nil {
+			cmd.Die(errors.WithStack(err))
+		}
 	}
 
 	cpuFile := cmd.StartCPUProf(*cpuProf, nil)
@@ -66,7 +83,13 @@ func main() {
 		}
 	}()
 
-	err = dump(settings)
+	if *reproducible {
+		err = dumpReproducible(settings)
+	} else if *since != "" || *stateFile != "" {
+		err = dumpIncremental(settings)
+	} else {
+		err = dump(settings)
+	}
 	cmd.Die(err)
 }
 
@@ -163,7 +186,11 @@ func writeKeys(st storage.Queryer, digests []string, num int) error {
 		return errors.WithStack(err)
 	}
 	log.Printf("matched %d fingerprints", len(rfps))
-	f, err := os.Create(filepath.Join(*outputDir, fmt.Sprintf("hkp-dump-%04d.pgp", num)))
+	return writeFile(st, rfps, filepath.Join(*outputDir, fmt.Sprintf("hkp-dump-%04d.pgp", num)))
+}
+
+func writeFile(st storage.Queryer, rfps []string, name string) error {
+	f, err := os.Create(name)
 	if err != nil {
 		return errors.WithStack(err)
 	}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"hockeypuck/hkp/sks"
+	"hockeypuck/hkp/storage"
+	"hockeypuck/openpgp"
+	"hockeypuck/server"
+)
+
+// manifestName is the file listing the SHA-256 digest of each bucket of a
+// reproducible dump, in the format of sha256sum, so that it may also be
+// checked with sha256sum -c.
+const manifestName = "SHA256SUMS"
+
+// manifestStarted prefixes the comment line of the manifest recording when
+// the dump was started. Keys modified after then may be missing from it, so
+// replicas bootstrapped from the dump follow the primary's feed from before
+// then. sha256sum -c ignores comment lines.
+const manifestStarted = "# started "
+
+// dumpReproducible writes every key to a file for the bucket of key
+// digests it falls in, named by the first -bucket-digits hex digits of the
+// digest. Within a bucket, keys are written in digest order, their packets
+// in canonical order and with canonical headers, so that servers holding
+// the same keys write the same bytes. Servers whose keys differ write
+// different files only for the buckets in which they differ; the manifest
+// also records when the dump was started, so it differs for each. The dump is
+// not compressed; compress it with fixed settings, such as gzip -n, to keep
+// it reproducible.
+func dumpReproducible(settings *server.Settings) error {
+	if *bucketDigits < 1 || *bucketDigits > 32 {
+		return errors.Errorf("invalid -bucket-digits %d", *bucketDigits)
+	}
+	started := time.Now().UTC()
+	st, err := server.DialStorage(settings)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer st.Close()
+
+	ptree, err := sks.NewPrefixTree(settings.Conflux.Recon.LevelDB.Path, &settings.Conflux.Recon.Settings)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	err = ptree.Create()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer ptree.Close()
+	root, err := ptree.Root()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	ch := make(chan string)
+	errc := make(chan error, 1)
+	go func() {
+		errc <- traverse(root, ch)
+	}()
+	var digests []string
+	for digest := range ch {
+		digests = append(digests, digest)
+	}
+	err = <-errc
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	sort.Strings(digests)
+
+	sums := map[string]string{}
+	for len(digests) > 0 {
+		prefix := digests[0][:*bucketDigits]
+		n := sort.Search(len(digests), func(i int) bool {
+			return digests[i][:*bucketDigits] > prefix
+		})
+		name := fmt.Sprintf("hkp-dump-%s.pgp", prefix)
+		sum, err := writeBucket(st, digests[:n], filepath.Join(*outputDir, name))
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		sums[name] = sum
+		digests = digests[n:]
+	}
+	log.Printf("dumped %d buckets", len(sums))
+	return writeManifest(filepath.Join(*outputDir, manifestName), started, sums)
+}
+
+// writeBucket writes the keys with the given digests, which are sorted, to
+// the file name, returning its SHA-256 digest.
+func writeBucket(st storage.Queryer, digests []string, name string) (_ string, err error) {
+	f, err := os.Create(name)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	defer func() {
+		// A failed close may have lost buffered writes, leaving a bucket
+		// which does not match its digest.
+		if cerr := f.Close(); cerr != nil && err == nil {
+			err = errors.WithStack(cerr)
+		}
+	}()
+	h := sha256.New()
+	w := bufio.NewWriter(io.MultiWriter(f, h))
+
+	for len(digests) > 0 {
+		chunk := digests
+		if len(chunk) > chunksize {
+			chunk = chunk[:chunksize]
+		}
+		digests = digests[len(chunk):]
+
+		rfps, err := st.MatchMD5(chunk)
+		if err != nil {
+			return "", errors.WithStack(err)
+		}
+		keys, err := st.FetchKeys(rfps)
+		if err != nil {
+			return "", errors.WithStack(err)
+		}
+		sort.Slice(keys, func(i, j int) bool { return keys[i].MD5 < keys[j].MD5 })
+		for _, key := range keys {
+			openpgp.CanonicalOrder(key)
+			err := openpgp.WritePackets(w, key)
+			if err != nil {
+				return "", errors.WithStack(err)
+			}
+		}
+	}
+	err = w.Flush()
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func writeManifest(path string, started time.Time, sums map[string]string) (err error) {
+	var names []string
+	for name := range sums {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	f, err := os.Create(path)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer func() {
+		if cerr := f.Close(); cerr != nil && err == nil {
+			err = errors.WithStack(cerr)
+		}
+	}()
+	_, err = fmt.Fprintf(f, "%s%s\n", manifestStarted, started.Format(time.RFC3339))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	for _, name := range names {
+		_, err = fmt.Fprintf(f, "%s  %s\n", sums[name], name)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	return nil
+}
+
+// readManifest returns the SHA-256 digest of each bucket of the dump at
+// path: a manifest, or a dump directory. The buckets of a directory without
+// a manifest are digested.
+func readManifest(path string) (map[string]string, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if fi.IsDir() {
+		manifest := filepath.Join(path, manifestName)
+		if _, err := os.Stat(manifest); err == nil {
+			return readManifest(manifest)
+		}
+		return digestBuckets(path)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer f.Close()
+	sums := map[string]string{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if strings.HasPrefix(scanner.Text(), "#") {
+			continue
+		}
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			return nil, errors.Errorf("invalid manifest line %q in %q", scanner.Text(), path)
+		}
+		sums[strings.TrimPrefix(fields[1], "*")] = fields[0]
+	}
+	return sums, errors.WithStack(scanner.Err())
+}
+
+func digestBuckets(dir string) (map[string]string, error) {
+	names, err := filepath.Glob(filepath.Join(dir, "hkp-dump-*.pgp"))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	sums := map[string]string{}
+	for _, name := range names {
+		f, err := os.Open(name)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		h := sha256.New()
+		_, err = io.Copy(h, f)
+		f.Close()
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		sums[filepath.Base(name)] = hex.EncodeToString(h.Sum(nil))
+	}
+	return sums, nil
+}
+
+// compareDumps compares two reproducible dumps bucket by bucket, listing
+// the buckets which differ or are missing from either. It fails if any do.
+func compareDumps(w io.Writer, a, b string) error {
+	sumsA, err := readManifest(a)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	sumsB, err := readManifest(b)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	names := map[string]bool{}
+	for name := range sumsA {
+		names[name] = true
+	}
+	for name := range sumsB {
+		names[name] = true
+	}
+	var sorted []string
+	for name := range names {
+		sorted = append(sorted, name)
+	}
+	sort.Strings(sorted)
+
+	var same, differ int
+	for _, name := range sorted {
+		sumA, inA := sumsA[name]
+		sumB, inB := sumsB[name]
+		switch {
+		case !inB:
+			fmt.Fprintf(w, "%s: only in %s\n", name, a)
+		case !inA:
+			fmt.Fprintf(w, "%s: only in %s\n", name, b)
+		case sumA != sumB:
+			fmt.Fprintf(w, "%s: differs\n", name)
+		default:
+			same++
+			continue
+		}
+		differ++
+	}
+	fmt.Fprintf(w, "%d buckets match, %d differ\n", same, differ)
+	if differ > 0 {
+		return errors.Errorf("dumps differ in %d buckets", differ)
+	}
+	return nil
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"hockeypuck/hkp/storage"
+	log "hockeypuck/logrus"
+	"hockeypuck/openpgp"
+)
+
+type loadFile struct {
+	name string
+	size int64
+}
+
+// loader imports key dump files into storage using a pool of workers, each
+// of which parses whole files and inserts their keys in batches. Each batch
+// is inserted in one transaction if the storage is a BatchInserter.
+type loader struct {
+	st               storage.Storage
+	keyReaderOptions []openpgp.KeyReaderOption
+	batchSize        int
+
+	start      time.Time
+	totalBytes int64
+	totalFiles int64
+
+	// Counters, updated atomically.
+	filesDone  int64
+	bytesDone  int64
+	keysRead   int64
+	inserted   int64
+	duplicates int64
+	errors     int64
+}
+
+func newLoader(st storage.Storage, opts []openpgp.KeyReaderOption, batchSize int) *loader {
+	if batchSize <= 0 {
+		batchSize = 1
+	}
+	return &loader{
+		st:               st,
+		keyReaderOptions: opts,
+		batchSize:        batchSize,
+	}
+}
+
+// files expands the glob patterns in args into the files to be loaded.
+func (l *loader) files(args []string) []loadFile {
+	var result []loadFile
+	for _, arg := range args {
+		matches, err := filepath.Glob(arg)
+		if err != nil {
+			log.Errorf("failed to match %q: %v", arg, err)
+			continue
+		}
+		for _, name := range matches {
+			fi, err := os.Stat(name)
+			if err != nil {
+				log.Errorf("failed to stat %q: %v", name, err)
+				continue
+			}
+			result = append(result, loadFile{name: name, size: fi.Size()})
+			l.totalBytes += fi.Size()
+		}
+	}
+	l.totalFiles = int64(len(result))
+	return result
+}
+
+func (l *loader) run(args []string, workers int, progressInterval time.Duration) error {
+	files := l.files(args)
+	l.start = time.Now()
+	log.Infof("loading %d files (%d bytes) with %d workers", len(files), l.totalBytes, workers)
+
+	ch := make(chan loadFile)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for f := range ch {
+				l.loadFile(f)
+			}
+		}()
+	}
+
+	done := make(chan struct{})
+	if progressInterval > 0 {
+		go func() {
+			ticker := time.NewTicker(progressInterval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-done:
+					return
+				case <-ticker.C:
+					l.logProgress()
+				}
+			}
+		}()
+	}
+
+	for _, f := range files {
+		ch <- f
+	}
+	close(ch)
+	wg.Wait()
+	close(done)
+
+	l.logSummary()
+	return nil
+}
+
+func (l *loader) loadFile(f loadFile) {
+	defer func() {
+		atomic.AddInt64(&l.filesDone, 1)
+		atomic.AddInt64(&l.bytesDone, f.size)
+	}()
+
+	log.Debugf("processing file %q...", f.name)
+	fh, err := os.Open(f.name)
+	if err != nil {
+		log.Errorf("failed to open %q for reading: %v", f.name, err)
+		atomic.AddInt64(&l.errors, 1)
+		return
+	}
+	defer fh.Close()
+
+	kr := openpgp.NewKeyReader(fh, l.keyReaderOptions...)
+	keys, err := kr.Read()
+	if err != nil {
+		log.Errorf("error reading keys from %q: %v", f.name, err)
+		atomic.AddInt64(&l.errors, 1)
+		return
+	}
+	atomic.AddInt64(&l.keysRead, int64(len(keys)))
+
+	for len(keys) > 0 {
+		n := l.batchSize
+		if n > len(keys) {
+			n = len(keys)
+		}
+		l.insert(f.name, keys[:n])
+		keys = keys[n:]
+	}
+}
+
+func (l *loader) insert(name string, keys []*openpgp.PrimaryKey) {
+	var n int
+	var err error
+	if bi, ok := l.st.(storage.BatchInserter); ok {
+		n, err = bi.InsertBatch(keys)
+	} else {
+		n, err = l.st.Insert(keys)
+	}
+	atomic.AddInt64(&l.inserted, int64(n))
+	if err == nil {
+		return
+	}
+	if hke, ok := err.(storage.InsertError); ok {
+		atomic.AddInt64(&l.duplicates, int64(len(hke.Duplicates)))
+		atomic.AddInt64(&l.errors, int64(len(hke.Errors)))
+		for _, err := range hke.Errors {
+			log.Errorf("insert error from %q: %v", name, err)
+		}
+		return
+	}
+	log.Errorf("some keys failed to insert from %q: %v", name, err)
+	atomic.AddInt64(&l.errors, 1)
+}
+
+func (l *loader) fields() log.Fields {
+	elapsed := time.Since(l.start)
+	keysRead := atomic.LoadInt64(&l.keysRead)
+	fields := log.Fields{
+		"files":      atomic.LoadInt64(&l.filesDone),
+		"totalFiles": l.totalFiles,
+		"read":       keysRead,
+		"inserted":   atomic.LoadInt64(&l.inserted),
+		"duplicates": atomic.LoadInt64(&l.duplicates),
+		"errors":     atomic.LoadInt64(&l.errors),
+		"elapsed":    elapsed.Truncate(time.Second).String(),
+	}
+	if secs := elapsed.Seconds(); secs > 0 {
+		fields["keysPerSec"] = int64(float64(keysRead) / secs)
+	}
+	return fields
+}
+
+func (l *loader) logProgress() {
+	fields := l.fields()
+	bytesDone := atomic.LoadInt64(&l.bytesDone)
+	if bytesDone > 0 && bytesDone < l.totalBytes {
+		elapsed := time.Since(l.start)
+		remaining := time.Duration(float64(elapsed) * float64(l.totalBytes-bytesDone) / float64(bytesDone))
+		fields["eta"] = remaining.Truncate(time.Second).String()
+	}
+	log.WithFields(fields).Info("load progress")
+}
+
+func (l *loader) logSummary() {
+	log.WithFields(l.fields()).Info("load complete")
+}
@@ -5,7 +5,7 @@ import (
 	"io/ioutil"
 	"os"
 	"os/signal"
-	"path/filepath"
+	"sync"
 	"syscall"
 	"time"
 
@@ -14,7 +14,6 @@ import (
 	"hockeypuck/hkp/sks"
 	"hockeypuck/hkp/storage"
 	log "hockeypuck/logrus"
-	"hockeypuck/openpgp"
 
 	"hockeypuck/server"
 	"hockeypuck/server/cmd"
@@ -24,6 +23,10 @@ var (
 	configFile = flag.String("config", "", "config file")
 	cpuProf    = flag.Bool("cpuprof", false, "enable CPU profiling")
 	memProf    = flag.Bool("memprof", false, "enable mem profiling")
+
+	nworkers         = flag.Int("workers", 0, "number of concurrent import workers (default: openpgp.nworkers setting)")
+	batchSize        = flag.Int("batch", 1000, "number of keys inserted per batch")
+	progressInterval = flag.Duration("progress", 30*time.Second, "interval between progress reports")
 )
 
 func main() {
@@ -42,6 +45,10 @@ func main() {
 		if err != nil {
 			cmd.Die(errors.WithStack(err))
 		}
+		_, err = server.ResolveSecrets(settings)
+		if err != nil {
+			cmd.Die(errors.WithStack(err))
+		}
 	}
 
 	cpuFile := cmd.StartCPUProf(*cpuProf, nil)
@@ -97,12 +104,17 @@ func load(settings *server.Settings, args []string) error {
 	}
 	defer stats.WriteFile(statsFilename)
 
+	// Workers insert concurrently; the prefix tree is not safe for
+	// concurrent updates.
+	var mu sync.Mutex
 	st.Subscribe(func(kc storage.KeyChange) error {
+		mu.Lock()
+		defer mu.Unlock()
 		stats.Update(kc)
 		ka, ok := kc.(storage.KeyAdded)
 		if ok {
 			var digestZp cf.Zp
-			err := sks.DigestZp(ka.Digest, &digestZp)
+			err := sks.DigestZpIn(settings.Conflux.Recon.Field.P(), ka.Digest, &digestZp)
 			if err != nil {
 				return errors.Wrapf(err, "bad digest %q", ka.Digest)
 			}
@@ -111,42 +123,13 @@ func load(settings *server.Settings, args []string) error {
 		return nil
 	})
 
-	keyReaderOptions := server.KeyReaderOptions(settings)
-
-	for _, arg := range args {
-		matches, err := filepath.Glob(arg)
-		if err != nil {
-			log.Errorf("failed to match %q: %v", arg, err)
-			continue
-		}
-		for _, file := range matches {
-			log.Infof("processing file %q...", file)
-			f, err := os.Open(file)
-			if err != nil {
-				log.Errorf("failed to open %q for reading: %v", file, err)
-			}
-			kr := openpgp.NewKeyReader(f, keyReaderOptions...)
-			keys, err := kr.Read()
-			if err != nil {
-				log.Errorf("error reading key: %v", err)
-				continue
-			}
-			log.Infof("found %d keys in %q...", len(keys), file)
-			t := time.Now()
-			n, err := st.Insert(keys)
-			if err != nil {
-				log.Errorf("some keys failed to insert from %q: %v", file, err)
-				if hke, ok := err.(storage.InsertError); ok {
-					for _, err := range hke.Errors {
-						log.Errorf("insert error: %v", err)
-					}
-				}
-			}
-			if n > 0 {
-				log.Infof("inserted %d keys from %q in %v", n, file, time.Since(t))
-			}
-		}
+	workers := *nworkers
+	if workers <= 0 {
+		workers = settings.OpenPGP.NWorkers
 	}
-
-	return nil
+	if workers <= 0 {
+		workers = 1
+	}
+	l := newLoader(st, server.KeyReaderOptions(settings), *batchSize)
+	return l.run(args, workers, *progressInterval)
 }
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"hockeypuck/hkp/loadtest"
+	log "hockeypuck/logrus"
+
+	"hockeypuck/server/cmd"
+)
+
+var (
+	target   = flag.String("target", "http://localhost:11371", "base URL of the keyserver under test")
+	workers  = flag.Int("workers", 8, "number of concurrent requests")
+	rate     = flag.Float64("rate", 0, "requests per second across all workers; 0 is unlimited")
+	duration = flag.Duration("duration", time.Minute, "how long to make requests for; 0 to stop after -n requests")
+	requests = flag.Int("n", 0, "number of requests to make; 0 to run for -duration")
+	timeout  = flag.Duration("timeout", 30*time.Second, "timeout of each request")
+	seed     = flag.Int64("seed", 1, "seed from which keys and requests are generated")
+
+	mix     = flag.String("mix", loadtest.DefaultMix, "relative weights of get, index, add and hashquery requests")
+	keys    = flag.Int("keys", 1000, "number of generated keys requested")
+	preload = flag.Bool("preload", false, "add the generated keys before making requests, so that lookups find them")
+	replay  = flag.String("replay", "", "access log in Common or Combined Log Format whose GET requests are replayed instead")
+)
+
+func main() {
+	flag.Parse()
+	err := run()
+	cmd.Die(err)
+}
+
+func run() error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-c
+		log.Info("interrupted, reporting requests made so far")
+		cancel()
+	}()
+
+	r := &loadtest.Runner{
+		Target:   *target,
+		Workers:  *workers,
+		Rate:     *rate,
+		Duration: *duration,
+		Requests: *requests,
+		Seed:     *seed,
+	}
+	if *requests > 0 && !isFlagSet("duration") {
+		r.Duration = 0
+	}
+	// Keep a connection open per worker, so that connection setup is not
+	// measured with each request.
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConnsPerHost = *workers
+	r.Client = &http.Client{Timeout: *timeout, Transport: transport}
+
+	var w loadtest.Workload
+	if *replay != "" {
+		f, err := os.Open(*replay)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		replayed, skipped, err := loadtest.ReadAccessLog(f)
+		f.Close()
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		log.Infof("replaying %d requests from %q, skipped %d lines", replayed.Len(), *replay, skipped)
+		w = replayed
+	} else {
+		m, err := loadtest.ParseMix(*mix)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		generated, err := loadtest.NewGenerated(m, *keys, *seed)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if *preload {
+			log.Infof("adding %d keys to %s", *keys, *target)
+			err = r.Do(ctx, generated.Preload())
+			if err != nil {
+				return errors.Wrap(err, "failed to preload keys")
+			}
+		}
+		w = generated
+	}
+
+	log.Infof("making requests to %s with %d workers", *target, r.Workers)
+	report, err := r.Run(ctx, w)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	_, err = report.WriteTo(os.Stdout)
+	return errors.WithStack(err)
+}
+
+func isFlagSet(name string) bool {
+	var set bool
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"hockeypuck/dane"
+	"hockeypuck/hkp/storage"
+	log "hockeypuck/logrus"
+
+	"hockeypuck/server"
+	"hockeypuck/server/cmd"
+)
+
+var (
+	configFile = flag.String("config", "", "config file")
+	domains    = flag.String("domains", "", "comma-separated mail domains to export; defaults to the WKD domains")
+	ttl        = flag.Int("ttl", 3600, "record TTL in seconds")
+	output     = flag.String("o", "", "output zone file; defaults to standard output")
+	batchSize  = flag.Int("batch", 1000, "keys fetched at a time")
+)
+
+func main() {
+	flag.Parse()
+
+	var (
+		settings *server.Settings
+		err      error
+	)
+	if configFile != nil {
+		conf, err := ioutil.ReadFile(*configFile)
+		if err != nil {
+			cmd.Die(errors.WithStack(err))
+		}
+		settings, err = server.ParseSettings(string(conf))
+		if err != nil {
+			cmd.Die(errors.WithStack(err))
+		}
+		_, err = server.ResolveSecrets(settings)
+		if err != nil {
+			cmd.Die(errors.WithStack(err))
+		}
+	}
+
+	err = export(settings)
+	cmd.Die(err)
+}
+
+// export writes OPENPGPKEY records for every key with a user ID in one of
+// the domains. Every stored key is examined, since keyword search results
+// are limited.
+func export(settings *server.Settings) error {
+	var exportDomains []string
+	if *domains != "" {
+		exportDomains = strings.Split(*domains, ",")
+	} else if settings.WKD.Enabled() {
+		exportDomains = settings.WKD.Domains
+	}
+	if len(exportDomains) == 0 {
+		return errors.New("no domains given")
+	}
+
+	st, err := server.DialStorage(settings)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer st.Close()
+	if !storage.Supports(st, storage.CapModifiedSince) {
+		return errors.New("storage does not support listing all keys")
+	}
+
+	out := os.Stdout
+	if *output != "" {
+		out, err = os.Create(*output)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		defer out.Close()
+	}
+	w := bufio.NewWriter(out)
+
+	var after storage.ModifiedKey
+	var keys, records int
+	for {
+		page, err := st.ModifiedAfter(after, *batchSize)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if len(page) == 0 {
+			break
+		}
+		after = page[len(page)-1]
+
+		var rfps []string
+		for _, mk := range page {
+			rfps = append(rfps, mk.RFingerprint)
+		}
+		fetched, err := st.FetchKeys(rfps)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		rrs, err := dane.Records(fetched, exportDomains)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		err = dane.WriteZone(w, rrs, *ttl)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		keys += len(fetched)
+		records += len(rrs)
+	}
+	log.Infof("examined %d keys, wrote %d records for %s", keys, records, strings.Join(exportDomains, ", "))
+	return errors.WithStack(w.Flush())
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+)
+
+// checkpoint records the progress of a prefix tree build, so that an
+// interrupted build can be resumed.
+type checkpoint struct {
+	// Last is the digest of the last key inserted. Keys are inserted in
+	// digest order.
+	Last string `json:"last"`
+
+	// Keys is the number of keys inserted so far.
+	Keys int `json:"keys"`
+}
+
+func checkpointFilename(path string) string {
+	dir, base := filepath.Dir(path), filepath.Base(path)
+	return filepath.Join(dir, "."+base+".pbuild")
+}
+
+func readCheckpoint(path string) (*checkpoint, error) {
+	var cp checkpoint
+	buf, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	err = json.Unmarshal(buf, &cp)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid checkpoint file %q", path)
+	}
+	return &cp, nil
+}
+
+func writeCheckpoint(path string, cp *checkpoint) error {
+	buf, err := json.Marshal(cp)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	tmp := path + ".tmp"
+	err = ioutil.WriteFile(tmp, buf, 0644)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(os.Rename(tmp, path))
+}
@@ -9,6 +9,8 @@ import (
 
 	"github.com/pkg/errors"
 	cf "hockeypuck/conflux"
+	"hockeypuck/conflux/recon"
+	"hockeypuck/conflux/recon/leveldb"
 	"hockeypuck/hkp/sks"
 	"hockeypuck/hkp/storage"
 	log "hockeypuck/logrus"
@@ -21,6 +23,9 @@ var (
 	configFile = flag.String("config", "", "config file")
 	cpuProf    = flag.Bool("cpuprof", false, "enable CPU profiling")
 	memProf    = flag.Bool("memprof", false, "enable mem profiling")
+
+	resume    = flag.Bool("resume", false, "resume an interrupted build from its checkpoint")
+	batchSize = flag.Int("batch", 5000, "number of keys inserted per prefix tree batch and checkpoint")
 )
 
 func main() {
@@ -39,6 +44,10 @@ func main() {
 		if err != nil {
 			cmd.Die(errors.WithStack(err))
 		}
+		_, err = server.ResolveSecrets(settings)
+		if err != nil {
+			cmd.Die(errors.WithStack(err))
+		}
 	}
 
 	cpuFile := cmd.StartCPUProf(*cpuProf, nil)
@@ -62,14 +71,48 @@ func main() {
 	cmd.Die(err)
 }
 
+// pbuild inserts the digest of every stored key into a new prefix tree.
+// Digests are inserted in batches. If the storage can notify keys in digest
+// order, a checkpoint is written after each batch, from which an interrupted
+// build can be resumed with -resume.
 func pbuild(settings *server.Settings) error {
+	if *batchSize <= 0 {
+		return errors.Errorf("invalid -batch %d", *batchSize)
+	}
+
 	st, err := server.DialStorage(settings)
 	if err != nil {
 		return errors.WithStack(err)
 	}
 	defer st.Close()
 
-	ptree, err := sks.NewPrefixTree(settings.Conflux.Recon.LevelDB.Path, &settings.Conflux.Recon.Settings)
+	path := settings.Conflux.Recon.LevelDB.Path
+	cpPath := checkpointFilename(path)
+	renotifier, checkpointing := st.(storage.Renotifier)
+
+	cp, err := readCheckpoint(cpPath)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if !*resume && cp != nil {
+		return errors.Errorf("found checkpoint %q of an interrupted build, "+
+			"run with -resume to continue it, or remove it and the prefix tree to start over", cpPath)
+	} else if *resume && !checkpointing {
+		return errors.New("storage does not support resuming a prefix tree build")
+	}
+	stats := sks.NewStats()
+	if cp == nil {
+		cp = &checkpoint{}
+	} else {
+		err = stats.ReadFile(sks.StatsFilename(path))
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		log.Infof("resuming after %d keys, from digest %q", cp.Keys, cp.Last)
+	}
+	resuming := cp.Last != ""
+
+	ptree, err := sks.NewPrefixTree(path, &settings.Conflux.Recon.Settings)
 	if err != nil {
 		return errors.WithStack(err)
 	}
@@ -79,38 +122,99 @@ func pbuild(settings *server.Settings) error {
 	}
 	defer ptree.Close()
 
-	stats := sks.NewStats()
+	batcher, batching := ptree.(recon.Batcher)
+	if batching {
+		err = batcher.Begin()
+		if err != nil {
+			return errors.WithStack(err)
+		}
+	}
 
-	var n int
-	st.Subscribe(func(kc storage.KeyChange) error {
-		ka, ok := kc.(storage.KeyAdded)
-		if ok {
-			var digestZp cf.Zp
-			err := sks.DigestZp(ka.Digest, &digestZp)
+	// flush commits the batch in progress and checkpoints it.
+	flush := func() error {
+		if batching {
+			err := batcher.Commit()
+			if err != nil {
+				return errors.WithStack(err)
+			}
+		}
+		if checkpointing {
+			err := stats.WriteFile(sks.StatsFilename(path))
 			if err != nil {
-				return errors.Wrapf(err, "bad digest %q", ka.Digest)
+				return errors.WithStack(err)
 			}
-			err = ptree.Insert(&digestZp)
+			err = writeCheckpoint(cpPath, cp)
 			if err != nil {
-				return errors.Wrapf(err, "failed to insert digest %q", ka.Digest)
+				return errors.WithStack(err)
 			}
+		}
+		if batching {
+			return errors.WithStack(batcher.Begin())
+		}
+		return nil
+	}
 
-			stats.Update(kc)
+	// Notification errors are not returned by the storage, so a failure to
+	// write the prefix tree is recorded here and stops the build.
+	var failed error
+	st.Subscribe(func(kc storage.KeyChange) error {
+		ka, ok := kc.(storage.KeyAdded)
+		if !ok || failed != nil {
+			return nil
+		}
+		var digestZp cf.Zp
+		err := sks.DigestZpIn(settings.Conflux.Recon.Field.P(), ka.Digest, &digestZp)
+		if err != nil {
+			log.Warningf("bad digest %q: %v", ka.Digest, err)
+			return nil
+		}
+		err = ptree.Insert(&digestZp)
+		// Keys inserted after the last checkpoint of an interrupted build
+		// are already in the tree.
+		if err != nil && !(resuming && errors.Is(err, leveldb.ErrDuplicate)) {
+			log.Warningf("failed to insert digest %q: %v", ka.Digest, err)
+			return nil
+		}
 
-			n++
-			if n%5000 == 0 {
-				log.Infof("%d keys added", n)
-			}
+		stats.Update(kc)
+		cp.Last = ka.Digest
+		cp.Keys++
+		if cp.Keys%*batchSize == 0 {
+			failed = flush()
+		}
+		if cp.Keys%5000 == 0 {
+			log.Infof("%d keys added", cp.Keys)
 		}
 		return nil
 	})
 
-	defer func() {
-		err := stats.WriteFile(sks.StatsFilename(settings.Conflux.Recon.LevelDB.Path))
+	if checkpointing {
+		err = renotifier.RenotifyAfter(cp.Last)
+	} else {
+		err = st.RenotifyAll()
+	}
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if failed != nil {
+		return errors.Wrapf(failed, "failed to write prefix tree after %q", cp.Last)
+	}
+	if batching {
+		err = batcher.Commit()
 		if err != nil {
-			log.Warningf("error writing stats: %v", err)
+			return errors.WithStack(err)
 		}
-	}()
-	err = st.RenotifyAll()
-	return errors.WithStack(err)
+	}
+	err = stats.WriteFile(sks.StatsFilename(path))
+	if err != nil {
+		log.Warningf("error writing stats: %v", err)
+	}
+	log.Infof("%d keys added", cp.Keys)
+	if checkpointing {
+		err = os.Remove(cpPath)
+		if err != nil && !os.IsNotExist(err) {
+			return errors.WithStack(err)
+		}
+	}
+	return nil
 }
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/pkg/errors"
+
+	"hockeypuck/hkp/fsck"
+	"hockeypuck/hkp/sks"
+	"hockeypuck/openpgp"
+	"hockeypuck/server"
+)
+
+// checkStorage cross-checks the key storage against the recon prefix tree,
+// printing each problem found. It fails if any problem remains unrepaired.
+// The server must be stopped, since it holds the prefix tree open.
+func checkStorage(settings *server.Settings, repair bool) error {
+	_, err := server.ResolveSecrets(settings)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	st, err := server.DialStorage(settings)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer st.Close()
+
+	path := settings.Conflux.Recon.LevelDB.Path
+	ptree, err := sks.NewPrefixTree(path, &settings.Conflux.Recon.Settings)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	err = ptree.Create()
+	if err != nil {
+		return errors.Wrapf(err, "cannot open prefix tree %q, is hockeypuck running?", path)
+	}
+	defer ptree.Close()
+
+	report, err := fsck.Check(st, ptree, repair)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	for _, p := range report.Problems {
+		status := "found"
+		if p.Repaired {
+			status = "repaired"
+		}
+		fmt.Printf("%-8s %-20s", status, p.Kind)
+		if p.RFingerprint != "" {
+			fmt.Printf(" fingerprint=%s", openpgp.Reverse(p.RFingerprint))
+		}
+		if p.Digest != "" {
+			fmt.Printf(" digest=%s", p.Digest)
+		}
+		if p.Detail != "" {
+			fmt.Printf(" (%s)", p.Detail)
+		}
+		fmt.Println()
+	}
+	fmt.Printf("%d keys stored, %d digests in prefix tree, %d problems, %d unrepaired\n",
+		report.Keys, report.Elements, len(report.Problems), report.Unrepaired())
+	if n := report.Unrepaired(); n > 0 && repair {
+		return errors.Errorf("%d problems could not be repaired", n)
+	} else if n > 0 {
+		return errors.Errorf("%d problems found, run with -repair to repair them", n)
+	}
+	return nil
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"os/signal"
@@ -9,6 +10,7 @@ import (
 
 	"github.com/pkg/errors"
 
+	log "hockeypuck/logrus"
 	"hockeypuck/server"
 	"hockeypuck/server/cmd"
 )
@@ -20,9 +22,34 @@ var (
 )
 
 func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags]\n", os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), "       %s [flags] peer probe <host[:port]>\n", os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), "       %s [flags] fsck [-repair]\n", os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), "       %s [flags] migrate [-from <driver>] [-from-dsn <dsn>] -to <driver> -to-dsn <dsn> [-state <file>]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
 	flag.Parse()
 
-	if len(flag.Args()) != 0 {
+	args := flag.Args()
+	probe := len(args) == 3 && args[0] == "peer" && args[1] == "probe"
+	check := len(args) > 0 && args[0] == "fsck"
+	fsckFlags := flag.NewFlagSet("fsck", flag.ExitOnError)
+	repair := fsckFlags.Bool("repair", false, "repair the problems found")
+	migrating := len(args) > 0 && args[0] == "migrate"
+	migrateFlags := flag.NewFlagSet("migrate", flag.ExitOnError)
+	var from, to server.DBConfig
+	migrateFlags.StringVar(&from.Driver, "from", "", "storage driver to copy keys from (default: openpgp.db.driver setting)")
+	migrateFlags.StringVar(&from.DSN, "from-dsn", "", "data source to copy keys from (default: openpgp.db.dsn setting)")
+	migrateFlags.StringVar(&to.Driver, "to", "", fmt.Sprintf("storage driver to copy keys to, one of %v", server.StorageDrivers()))
+	migrateFlags.StringVar(&to.DSN, "to-dsn", "", "data source to copy keys to")
+	stateFile := migrateFlags.String("state", "", "file recording the progress of the migration, from which it resumes")
+	if check {
+		fsckFlags.Parse(args[1:])
+	} else if migrating {
+		migrateFlags.Parse(args[1:])
+	}
+	if (len(args) != 0 && !probe && !check && !migrating) || fsckFlags.NArg() != 0 || migrateFlags.NArg() != 0 {
 		flag.Usage()
 		cmd.Die(errors.New("unexpected command line arguments"))
 	}
@@ -31,17 +58,26 @@ func main() {
 		settings *server.Settings
 		err      error
 	)
-	if configFile != nil {
-		conf, err := ioutil.ReadFile(*configFile)
-		if err != nil {
-			cmd.Die(errors.WithStack(err))
-		}
-		settings, err = server.ParseSettings(string(conf))
+	if probe && *configFile == "" {
+		defaults := server.DefaultSettings()
+		settings = &defaults
+	} else if configFile != nil {
+		settings, err = readSettings(*configFile)
 		if err != nil {
-			cmd.Die(errors.WithStack(err))
+			cmd.Die(err)
 		}
 	}
 
+	if probe {
+		cmd.Die(probePeer(settings, args[2]))
+	}
+	if check {
+		cmd.Die(checkStorage(settings, *repair))
+	}
+	if migrating {
+		cmd.Die(migrateStorage(settings, from, to, *stateFile))
+	}
+
 	cpuFile := cmd.StartCPUProf(*cpuProf, nil)
 
 	srv, err := server.NewServer(settings)
@@ -49,10 +85,13 @@ func main() {
 		cmd.Die(err)
 	}
 
-	srv.Start()
+	err = srv.Start()
+	if err != nil {
+		cmd.Die(err)
+	}
 
 	c := make(chan os.Signal)
-	signal.Notify(c, syscall.SIGINT, syscall.SIGTERM, syscall.SIGUSR1, syscall.SIGUSR2)
+	signal.Notify(c, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGUSR1, syscall.SIGUSR2)
 	go func() {
 		for {
 			select {
@@ -60,6 +99,8 @@ func main() {
 				switch sig {
 				case syscall.SIGINT, syscall.SIGTERM:
 					srv.Stop()
+				case syscall.SIGHUP:
+					reload(srv)
 				case syscall.SIGUSR1:
 					srv.LogRotate()
 				case syscall.SIGUSR2:
@@ -73,3 +114,31 @@ func main() {
 	err = srv.Wait()
 	cmd.Die(err)
 }
+
+func readSettings(path string) (*server.Settings, error) {
+	conf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	settings, err := server.ParseSettings(string(conf))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return settings, nil
+}
+
+func reload(srv *server.Server) {
+	if *configFile == "" {
+		log.Warning("SIGHUP ignored: no config file")
+		return
+	}
+	settings, err := readSettings(*configFile)
+	if err != nil {
+		log.Errorf("failed to reload config %q: %+v", *configFile, err)
+		return
+	}
+	err = srv.Reload(settings)
+	if err != nil {
+		log.Errorf("failed to apply config %q: %+v", *configFile, err)
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+
+	"github.com/pkg/errors"
+
+	"hockeypuck/hkp/storage/migrate"
+	log "hockeypuck/logrus"
+	"hockeypuck/server"
+)
+
+// migrateStorage copies every key from one storage backend to another. The
+// source defaults to the configured storage. If stateFile is set, progress
+// is recorded in it after each page of keys, and a migration is resumed
+// from it. The prefix tree needs no change, since the keys and so their
+// digests are the same.
+func migrateStorage(settings *server.Settings, from, to server.DBConfig, stateFile string) error {
+	r, err := server.ResolveSecrets(settings)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if from.Driver == "" {
+		from.Driver = settings.OpenPGP.DB.Driver
+	}
+	if from.DSN == "" {
+		from.DSN = settings.OpenPGP.DB.DSN
+	} else if from.DSN, err = r.Expand(from.DSN); err != nil {
+		return errors.WithStack(err)
+	}
+	if to.Driver == "" || to.DSN == "" {
+		return errors.New("missing -to driver or -to-dsn")
+	}
+	to.DSN, err = r.Expand(to.DSN)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if from.Driver == to.Driver && from.DSN == to.DSN {
+		return errors.New("cannot migrate storage to itself")
+	}
+	from.Search = settings.OpenPGP.DB.Search
+	to.Search = settings.OpenPGP.DB.Search
+
+	src, err := server.DialDB(settings, &from)
+	if err != nil {
+		return errors.Wrap(err, "cannot connect to source storage")
+	}
+	defer src.Close()
+	dst, err := server.DialDB(settings, &to)
+	if err != nil {
+		return errors.Wrap(err, "cannot connect to destination storage")
+	}
+	defer dst.Close()
+
+	state := &migrate.State{}
+	if stateFile != "" {
+		state, err = readMigrateState(stateFile)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if state.Keys > 0 {
+			log.Infof("resuming migration after %d keys", state.Keys)
+		}
+	}
+	m := &migrate.Migration{From: src, To: dst}
+	if stateFile != "" {
+		m.Checkpoint = func(state *migrate.State) error {
+			return writeMigrateState(stateFile, state)
+		}
+	}
+	err = m.Run(state)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if state.Failed > 0 {
+		return errors.Errorf("%d keys failed verification", state.Failed)
+	}
+	return nil
+}
+
+func readMigrateState(path string) (*migrate.State, error) {
+	var state migrate.State
+	buf, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return &state, nil
+	} else if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	err = json.Unmarshal(buf, &state)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid state file %q", path)
+	}
+	return &state, nil
+}
+
+func writeMigrateState(path string, state *migrate.State) error {
+	buf, err := json.Marshal(state)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	tmp := path + ".tmp"
+	err = ioutil.WriteFile(tmp, buf, 0644)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(os.Rename(tmp, path))
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"hockeypuck/conflux/recon"
+	"hockeypuck/server"
+)
+
+const defaultReconPort = "11370"
+
+// probePeer connects to a prospective recon partner, performs the config
+// handshake and reports what the partner declares, then checks that its
+// hashquery endpoint is reachable.
+func probePeer(settings *server.Settings, host string) error {
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		host = net.JoinHostPort(host, defaultReconPort)
+	}
+	addr, err := net.ResolveTCPAddr("tcp", host)
+	if err != nil {
+		return errors.Wrapf(err, "cannot resolve %q", host)
+	}
+
+	tree := &recon.MemPrefixTree{}
+	tree.Init()
+	peer := recon.NewPeer(&settings.Conflux.Recon.Settings, tree)
+	result, err := peer.Probe(addr)
+	if err != nil {
+		return errors.Wrapf(err, "cannot probe %q", host)
+	}
+
+	config := result.Config
+	fmt.Printf("recon address:  %s\n", addr)
+	fmt.Printf("version:        %s\n", config.Version)
+	fmt.Printf("http port:      %d\n", config.HTTPPort)
+	fmt.Printf("bitquantum:     %d\n", config.BitQuantum)
+	fmt.Printf("mbar:           %d\n", config.MBar)
+	fmt.Printf("filters:        %s\n", config.Filters)
+	if result.HandshakeErr != nil {
+		fmt.Printf("handshake:      failed: %v\n", errors.Cause(result.HandshakeErr))
+	} else {
+		fmt.Printf("handshake:      ok\n")
+	}
+	if result.Size >= 0 {
+		fmt.Printf("estimated keys: %d\n", result.Size)
+	} else {
+		fmt.Printf("estimated keys: unknown\n")
+	}
+
+	if config.HTTPPort == 0 {
+		fmt.Printf("hashquery:      unknown http port\n")
+	} else {
+		httpAddr := net.JoinHostPort(addr.IP.String(), strconv.Itoa(config.HTTPPort))
+		err = probeHashquery(httpAddr, settings.Software+"/"+settings.Version)
+		if err != nil {
+			fmt.Printf("hashquery:      failed: %v\n", err)
+		} else {
+			fmt.Printf("hashquery:      ok\n")
+		}
+	}
+
+	if result.HandshakeErr != nil {
+		return errors.Errorf("%s is not compatible", host)
+	}
+	return nil
+}
+
+// probeHashquery sends an empty hashquery to the HKP service at httpAddr.
+func probeHashquery(httpAddr, userAgent string) error {
+	var buf bytes.Buffer
+	err := recon.WriteInt(&buf, 0)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	req, err := http.NewRequest("POST", fmt.Sprintf("http://%s/pks/hashquery", httpAddr), &buf)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	req.Header.Set("Content-type", "sks/hashquery")
+	req.Header.Set("User-agent", userAgent)
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return errors.Errorf("%s: %s", resp.Status, bytes.TrimSpace(body))
+	}
+	return nil
+}
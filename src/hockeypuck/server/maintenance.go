@@ -0,0 +1,256 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/pkg/errors"
+
+	"hockeypuck/hkp/storage"
+	log "hockeypuck/logrus"
+)
+
+// maintenanceRetryAfter is how long clients are asked to wait before
+// retrying a submission refused during maintenance.
+const maintenanceRetryAfter = "300"
+
+// maintenanceReportRetryAfter is how long front ends are asked to wait
+// before reporting key changes again. They hold their reports meanwhile, so
+// it is shorter, to catch up soon after maintenance ends.
+const maintenanceReportRetryAfter = "60"
+
+// maintenanceWritePaths are the endpoints which write to storage, and are
+// refused during maintenance.
+var maintenanceWritePaths = map[string]bool{
+	"/pks/add":     true,
+	"/pks/replace": true,
+	"/pks/delete":  true,
+	changesPath:    true,
+}
+
+// maintenance tracks storage maintenance. While it is active, submissions
+// are refused and recon and replication are paused, unless stopped already,
+// so that heavy work such as VACUUM FULL does not contend with writes.
+type maintenance struct {
+	mu     sync.Mutex
+	status maintenanceStatus
+}
+
+type maintenanceStatus struct {
+	Active bool       `json:"active"`
+	Since  *time.Time `json:"since,omitempty"`
+	Reason string     `json:"reason,omitempty"`
+
+	// Task is the maintenance task running, if any.
+	Task string `json:"task,omitempty"`
+
+	// Last is the result of the last task run.
+	Last *maintenanceResult `json:"last,omitempty"`
+}
+
+type maintenanceResult struct {
+	Task     string    `json:"task"`
+	Started  time.Time `json:"started"`
+	Finished time.Time `json:"finished"`
+	Error    string    `json:"error,omitempty"`
+}
+
+func (m *maintenance) active() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.status.Active
+}
+
+func (m *maintenance) statusCopy() maintenanceStatus {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.status
+}
+
+// enterMaintenance refuses submissions and pauses recon and replication,
+// waiting for sessions in progress to finish. It returns false if the
+// server is already in maintenance.
+func (s *Server) enterMaintenance(reason, task string) bool {
+	s.maintenance.mu.Lock()
+	if s.maintenance.status.Active {
+		s.maintenance.mu.Unlock()
+		return false
+	}
+	now := time.Now().UTC()
+	s.maintenance.status.Active = true
+	s.maintenance.status.Since = &now
+	s.maintenance.status.Reason = reason
+	s.maintenance.status.Task = task
+	s.maintenance.mu.Unlock()
+
+	log.WithFields(log.Fields{
+		"reason": reason,
+	}).Warning("entering maintenance, submissions are refused")
+	s.subsystems.setMaintenance(true)
+	return true
+}
+
+// exitMaintenance resumes normal operation.
+func (s *Server) exitMaintenance() {
+	s.subsystems.setMaintenance(false)
+	s.maintenance.mu.Lock()
+	s.maintenance.status.Active = false
+	s.maintenance.status.Since = nil
+	s.maintenance.status.Reason = ""
+	s.maintenance.status.Task = ""
+	s.maintenance.mu.Unlock()
+	log.Info("maintenance finished, submissions are accepted")
+}
+
+// refuseDuringMaintenance is middleware which refuses writes while the
+// server is in maintenance. Front ends retry the key change reports refused.
+func (s *Server) refuseDuringMaintenance(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "POST" && maintenanceWritePaths[r.URL.Path] && s.maintenance.active() {
+			if r.URL.Path == changesPath {
+				w.Header().Set("Retry-After", maintenanceReportRetryAfter)
+			} else {
+				w.Header().Set("Retry-After", maintenanceRetryAfter)
+			}
+			http.Error(w, "server is in maintenance, submissions are not accepted; try again later",
+				http.StatusServiceUnavailable)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// maintenanceTasks returns the names of the maintenance tasks available.
+func (s *Server) maintenanceTasks() map[string]bool {
+	tasks := map[string]bool{}
+	if _, ok := s.st.(storage.Maintainer); ok {
+		tasks[storage.MaintainVacuum] = true
+		tasks[storage.MaintainReindex] = true
+		tasks[storage.MaintainBackfill] = true
+	}
+	if s.settings.Admin != nil {
+		for name := range s.settings.Admin.MaintenanceCommands {
+			tasks[name] = true
+		}
+	}
+	return tasks
+}
+
+// runMaintenanceTask runs a task, which must be one of maintenanceTasks.
+func (s *Server) runMaintenanceTask(ctx context.Context, task string) error {
+	if s.settings.Admin != nil {
+		if args, ok := s.settings.Admin.MaintenanceCommands[task]; ok && len(args) > 0 {
+			out, err := exec.CommandContext(ctx, args[0], args[1:]...).CombinedOutput()
+			if len(out) > 0 {
+				log.WithFields(log.Fields{
+					"task": task,
+				}).Info(strings.TrimSpace(string(out)))
+			}
+			return errors.Wrapf(err, "%s failed", args[0])
+		}
+	}
+	if mt, ok := s.st.(storage.Maintainer); ok {
+		return errors.WithStack(mt.Maintain(ctx, task))
+	}
+	return errors.WithStack(storage.ErrNotSupported)
+}
+
+// startBackfill fills in the storage of keys stored by an earlier version in
+// the background, so that a large keyring does not hold up the server
+// starting after an upgrade.
+func (s *Server) startBackfill() {
+	mt, ok := s.st.(storage.Maintainer)
+	if !ok {
+		return
+	}
+	s.t.Go(func() error {
+		err := mt.Maintain(s.t.Context(nil), storage.MaintainBackfill)
+		if err != nil && !errors.Is(err, storage.ErrNotSupported) && s.t.Alive() {
+			log.WithField("error", err).Error("backfill failed")
+		}
+		return nil
+	})
+}
+
+// registerMaintenance serves the maintenance endpoints of the admin API.
+// An operator either runs a task in one request, which enters maintenance
+// for as long as the task takes, or enters and exits maintenance around
+// work done by other means.
+func (s *Server) registerMaintenance(r *httprouter.Router) {
+	r.GET("/maintenance", s.maintenanceStatus)
+	r.PUT("/maintenance", s.startMaintenance)
+	r.DELETE("/maintenance", s.stopMaintenance)
+	r.POST("/maintenance/:task", s.startMaintenanceTask)
+}
+
+func (s *Server) maintenanceStatus(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.maintenance.statusCopy())
+}
+
+func (s *Server) startMaintenance(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	if !s.enterMaintenance(r.FormValue("reason"), "") {
+		http.Error(w, "already in maintenance", http.StatusConflict)
+		return
+	}
+	s.maintenanceStatus(w, r, ps)
+}
+
+func (s *Server) stopMaintenance(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	status := s.maintenance.statusCopy()
+	if !status.Active {
+		http.Error(w, "not in maintenance", http.StatusConflict)
+		return
+	}
+	if status.Task != "" {
+		http.Error(w, "maintenance task "+status.Task+" is running", http.StatusConflict)
+		return
+	}
+	s.exitMaintenance()
+	s.maintenanceStatus(w, r, ps)
+}
+
+func (s *Server) startMaintenanceTask(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	task := ps.ByName("task")
+	if !s.maintenanceTasks()[task] {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+	if !s.enterMaintenance("task "+task, task) {
+		http.Error(w, "already in maintenance", http.StatusConflict)
+		return
+	}
+	s.t.Go(func() error {
+		result := &maintenanceResult{Task: task, Started: time.Now().UTC()}
+		log.WithFields(log.Fields{
+			"task": task,
+		}).Info("maintenance task started")
+		err := s.runMaintenanceTask(s.t.Context(nil), task)
+		result.Finished = time.Now().UTC()
+		if err != nil {
+			result.Error = err.Error()
+			log.WithFields(log.Fields{
+				"task": task,
+			}).Errorf("maintenance task failed: %+v", err)
+		} else {
+			log.WithFields(log.Fields{
+				"task":     task,
+				"duration": result.Finished.Sub(result.Started).String(),
+			}).Info("maintenance task done")
+		}
+		s.maintenance.mu.Lock()
+		s.maintenance.status.Last = result
+		s.maintenance.mu.Unlock()
+		s.exitMaintenance()
+		return nil
+	})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(s.maintenance.statusCopy())
+}
@@ -11,10 +11,12 @@ import (
 )
 
 var serverMetrics = struct {
-	httpRequestDuration *prometheus.HistogramVec
-	keysAdded           prometheus.Counter
-	keysIgnored         prometheus.Counter
-	keysUpdated         prometheus.Counter
+	httpRequestDuration   *prometheus.HistogramVec
+	keysAdded             prometheus.Counter
+	keysIgnored           prometheus.Counter
+	keysUpdated           prometheus.Counter
+	subsystemRunning      *prometheus.GaugeVec
+	clusterReportsPending prometheus.Gauge
 }{
 	httpRequestDuration: prometheus.NewHistogramVec(
 		prometheus.HistogramOpts{
@@ -45,6 +47,21 @@ var serverMetrics = struct {
 			Help:      "Keys updated since startup",
 		},
 	),
+	subsystemRunning: prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "hockeypuck",
+			Name:      "subsystem_running",
+			Help:      "Whether each subsystem is running, rather than stopped by an operator or paused for maintenance",
+		},
+		[]string{"subsystem"},
+	),
+	clusterReportsPending: prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: "hockeypuck",
+			Name:      "cluster_reports_pending",
+			Help:      "Key change reports from a front end not yet acknowledged by the stateful server",
+		},
+	),
 }
 
 var metricsRegister sync.Once
@@ -55,6 +72,8 @@ func registerMetrics() {
 		prometheus.MustRegister(serverMetrics.keysAdded)
 		prometheus.MustRegister(serverMetrics.keysIgnored)
 		prometheus.MustRegister(serverMetrics.keysUpdated)
+		prometheus.MustRegister(serverMetrics.subsystemRunning)
+		prometheus.MustRegister(serverMetrics.clusterReportsPending)
 	})
 }
 
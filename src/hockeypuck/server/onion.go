@@ -0,0 +1,78 @@
+package server
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	log "hockeypuck/logrus"
+	"hockeypuck/tor"
+)
+
+// publishOnion publishes the HKP listener as an onion service through the
+// Tor control port, if one is configured. Otherwise it records the address
+// of any onion service configured outside of hockeypuck.
+func (s *Server) publishOnion() error {
+	settings := s.settings.Tor
+	if settings == nil {
+		return nil
+	}
+	port := settings.VirtualPort
+	if port <= 0 {
+		port = tor.DefaultVirtualPort
+	}
+	if settings.ControlAddr == "" {
+		s.onionAddr = settings.Onion
+		if s.onionAddr != "" {
+			s.onionAddr = net.JoinHostPort(strings.TrimSuffix(s.onionAddr, "/"), strconv.Itoa(port))
+		}
+		return nil
+	}
+
+	target, err := tor.Target(s.settings.HKP.Bind)
+	if err != nil {
+		return errors.Wrapf(err, "cannot publish %q as an onion service", s.settings.HKP.Bind)
+	}
+	var key string
+	if settings.KeyFile != "" {
+		buf, err := ioutil.ReadFile(settings.KeyFile)
+		if err == nil {
+			key = strings.TrimSpace(string(buf))
+		} else if !os.IsNotExist(err) {
+			return errors.WithStack(err)
+		}
+	}
+
+	ctl, err := tor.Dial(settings.ControlAddr)
+	if err != nil {
+		return errors.Wrap(err, "cannot connect to tor control port")
+	}
+	err = ctl.Authenticate(settings.ControlPassword)
+	if err != nil {
+		ctl.Close()
+		return errors.WithStack(err)
+	}
+	onion, err := ctl.AddOnion(key, port, target)
+	if err != nil {
+		ctl.Close()
+		return errors.WithStack(err)
+	}
+	if key == "" && settings.KeyFile != "" {
+		err = ioutil.WriteFile(settings.KeyFile, []byte(onion.PrivateKey+"\n"), 0600)
+		if err != nil {
+			ctl.Close()
+			return errors.Wrap(err, "cannot save onion service key")
+		}
+	}
+	s.torCtl = ctl
+	s.onionAddr = net.JoinHostPort(onion.Hostname(), strconv.Itoa(port))
+	log.WithFields(log.Fields{
+		"onion":  s.onionAddr,
+		"target": target,
+	}).Info("published onion service")
+	return nil
+}
@@ -0,0 +1,156 @@
+package server
+
+import (
+	"hockeypuck/hkp/storage"
+	"hockeypuck/rollout"
+)
+
+// policyVersion is incremented when the meaning of a policy field changes.
+const policyVersion = 1
+
+// policy describes what this server checks when accepting and serving keys,
+// so that clients can decide how far to trust the keys it returns.
+type policy struct {
+	Version  int    `json:"version"`
+	Software string `json:"software"`
+	Hostname string `json:"hostname,omitempty"`
+	Contact  string `json:"contact,omitempty"`
+
+	Submission submissionPolicy `json:"submission"`
+	Lookup     lookupPolicy     `json:"lookup"`
+	Retention  retentionPolicy  `json:"retention"`
+	Sync       syncPolicy       `json:"sync"`
+}
+
+type submissionPolicy struct {
+	// VerifiedEmail is whether user IDs are published only once the
+	// address has been confirmed. Hockeypuck does not verify addresses.
+	VerifiedEmail bool `json:"verifiedEmail"`
+
+	// Filters are the ingest filters applied to every key.
+	Filters []string `json:"filters"`
+
+	MaxKeyLength           int `json:"maxKeyLength,omitempty"`
+	MaxPacketLength        int `json:"maxPacketLength,omitempty"`
+	MaxUserAttributeLength int `json:"maxUserAttributeLength,omitempty"`
+
+	// Limits above which submissions are refused.
+	MaxSubmissionLength int `json:"maxSubmissionLength,omitempty"`
+	MaxPackets          int `json:"maxPackets,omitempty"`
+	MaxUserIDs          int `json:"maxUserIDs,omitempty"`
+	MaxSubKeys          int `json:"maxSubKeys,omitempty"`
+
+	// BlacklistedKeys is the number of keys refused outright.
+	BlacklistedKeys int `json:"blacklistedKeys"`
+
+	// Rollout lists ingest behaviors applied to a percentage of keys.
+	Rollout []rollout.FlagStatus `json:"rollout"`
+
+	// ProofOfPossession is whether keys may be submitted with a signed
+	// challenge from /pks/challenge, and listed as verified if so.
+	ProofOfPossession bool `json:"proofOfPossession"`
+}
+
+type lookupPolicy struct {
+	SelfSignedOnly bool `json:"selfSignedOnly"`
+	KeywordSearch  bool `json:"keywordSearch"`
+
+	// Redact is what is hidden from index lookups other than by exact key
+	// ID: "email" for addresses, "uid" for whole user IDs.
+	Redact string `json:"redact,omitempty"`
+
+	// MaxKeyLength is the length of the largest key served whole, if
+	// limited. Larger keys are truncated if TruncateLargeKeys is set, and
+	// refused otherwise.
+	MaxKeyLength      int  `json:"maxKeyLength,omitempty"`
+	TruncateLargeKeys bool `json:"truncateLargeKeys,omitempty"`
+
+	// SlimKeys is whether keys are always served without superseded
+	// self-signatures or expired certifications. Clients may ask for this
+	// with options=slim regardless.
+	SlimKeys bool `json:"slimKeys,omitempty"`
+
+	// AttestedOnly is whether keys are always served with only the
+	// certifications by other keys which the key's holder has attested to.
+	// Clients may ask for this with options=attested regardless.
+	AttestedOnly bool `json:"attestedOnly,omitempty"`
+
+	// ExcludeExpired is whether expired keys are always omitted from get
+	// and index lookups. Clients may ask for this with
+	// options=exclude-expired regardless.
+	ExcludeExpired bool `json:"excludeExpired,omitempty"`
+
+	// RefuseShortKeyIDs is whether lookups by 32-bit key ID are refused.
+	RefuseShortKeyIDs bool `json:"refuseShortKeyIDs,omitempty"`
+}
+
+type retentionPolicy struct {
+	// OwnerDeletion is whether key owners may delete their keys with a
+	// signed request. Deleted keys may return by reconciliation.
+	OwnerDeletion bool `json:"ownerDeletion"`
+
+	// ExpiredKeysRemoved is whether expired or revoked keys are removed.
+	ExpiredKeysRemoved bool `json:"expiredKeysRemoved"`
+}
+
+type syncPolicy struct {
+	// Recon is whether keys are exchanged with SKS peers.
+	Recon bool `json:"recon"`
+
+	// Replica is whether this server copies a primary server verbatim.
+	Replica bool `json:"replica"`
+
+	// Merge is whether this server merges keys from another primary, which
+	// may in turn follow this one.
+	Merge bool `json:"merge"`
+
+	// Frontend is whether this server is a front end to a stateful server
+	// which runs recon on its behalf.
+	Frontend bool `json:"frontend"`
+}
+
+func (s *Server) policy() (interface{}, error) {
+	s.muSettings.RLock()
+	defer s.muSettings.RUnlock()
+
+	return &policy{
+		Version:  policyVersion,
+		Software: s.settings.Software + "/" + s.settings.Version,
+		Hostname: s.settings.Hostname,
+		Contact:  s.settings.Contact,
+		Submission: submissionPolicy{
+			Filters:                s.settings.Conflux.Recon.Settings.Filters,
+			MaxKeyLength:           s.settings.OpenPGP.MaxKeyLength,
+			MaxPacketLength:        s.settings.OpenPGP.MaxPacketLength,
+			MaxUserAttributeLength: s.settings.OpenPGP.MaxUserAttributeLength,
+			MaxSubmissionLength:    s.settings.HKP.Limits.MaxLength,
+			MaxPackets:             s.settings.HKP.Limits.MaxPackets,
+			MaxUserIDs:             s.settings.HKP.Limits.MaxUserIDs,
+			MaxSubKeys:             s.settings.HKP.Limits.MaxSubKeys,
+			BlacklistedKeys:        len(s.settings.OpenPGP.Blacklist),
+			Rollout:                s.rollout.Status(),
+			ProofOfPossession:      s.settings.HKP.Provenance.Enabled,
+		},
+		Lookup: lookupPolicy{
+			SelfSignedOnly: s.settings.HKP.Queries.SelfSignedOnly,
+			KeywordSearch: !s.settings.HKP.Queries.FingerprintOnly &&
+				storage.Supports(s.st, storage.CapKeywordSearch),
+			Redact:            s.settings.HKP.Queries.Redact,
+			MaxKeyLength:      s.settings.HKP.Queries.MaxResponseLength,
+			TruncateLargeKeys: s.settings.HKP.Queries.TruncateLargeKeys,
+			SlimKeys:          s.settings.HKP.Queries.SlimKeys,
+			AttestedOnly:      s.settings.HKP.Queries.AttestedOnly,
+			ExcludeExpired:    s.settings.HKP.Queries.ExcludeExpired,
+			RefuseShortKeyIDs: s.settings.HKP.Queries.RefuseShortKeyIDs,
+		},
+		Retention: retentionPolicy{
+			OwnerDeletion: true,
+		},
+		Sync: syncPolicy{
+			Recon:    s.sksPeer != nil || s.settings.Cluster.Frontend(),
+			Replica:  s.follower != nil && !s.settings.Replica.Merge,
+			Merge:    s.follower != nil && s.settings.Replica.Merge,
+			Frontend: s.settings.Cluster.Frontend(),
+		},
+	}, nil
+}
@@ -0,0 +1,105 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+
+	"hockeypuck/hkp/storage"
+)
+
+const (
+	healthzPath = "/healthz"
+	readyzPath  = "/readyz"
+
+	// readyDatabaseTimeout limits how long the readiness probe waits for
+	// the database.
+	readyDatabaseTimeout = 5 * time.Second
+)
+
+// probeCheck is the result of one readiness check.
+type probeCheck struct {
+	Name  string `json:"name"`
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+// probeResponse is the JSON response to a liveness or readiness probe.
+type probeResponse struct {
+	Status  string       `json:"status"`
+	Version string       `json:"version"`
+	Checks  []probeCheck `json:"checks,omitempty"`
+
+	// Subsystems reports which subsystems are stopped or paused. They do
+	// not make the server unready, as they were stopped on purpose.
+	Subsystems []SubsystemStatus `json:"subsystems,omitempty"`
+}
+
+// registerProbes serves the liveness and readiness probes, for process
+// supervisors such as Kubernetes to restart the server or hold back traffic
+// without the cost of a stats lookup.
+func (s *Server) registerProbes() {
+	s.r.GET(healthzPath, s.healthz)
+	s.r.GET(readyzPath, s.readyz)
+}
+
+// healthz responds while the process is able to serve requests at all. It
+// does not depend on the database, so that an outage there does not get
+// every server restarted.
+func (s *Server) healthz(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	writeProbe(w, &probeResponse{Status: "ok", Version: s.settings.Version})
+}
+
+// readyz responds whether the server can serve lookups and take part in
+// recon.
+func (s *Server) readyz(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	writeProbe(w, s.checkReady(r.Context()))
+}
+
+// checkReady checks that the database is reachable, and that the server is
+// live.
+func (s *Server) checkReady(ctx context.Context) *probeResponse {
+	resp := &probeResponse{Status: "ok", Version: s.settings.Version}
+	if pinger, ok := s.st.(storage.Pinger); ok {
+		ctx, cancel := context.WithTimeout(ctx, readyDatabaseTimeout)
+		resp.check("database", pinger.PingContext(ctx))
+		cancel()
+	}
+	s.checkLive(resp)
+	resp.Subsystems = s.subsystems.status()
+	return resp
+}
+
+// checkLive checks, if this server keeps the prefix tree, that the tree can
+// be read and recon has not stalled. It does not depend on the database,
+// so that it can feed the systemd watchdog without an outage there getting
+// the server restarted.
+func (s *Server) checkLive(resp *probeResponse) {
+	if s.sksPeer != nil {
+		resp.check("ptree", s.sksPeer.CheckPrefixTree())
+		resp.check("recon", s.sksPeer.CheckRecon())
+	}
+}
+
+// check records the result of a check, making the response unavailable if
+// it failed.
+func (resp *probeResponse) check(name string, err error) {
+	c := probeCheck{Name: name, OK: err == nil}
+	if err != nil {
+		c.Error = err.Error()
+		resp.Status = "unavailable"
+	}
+	resp.Checks = append(resp.Checks, c)
+}
+
+func writeProbe(w http.ResponseWriter, resp *probeResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if resp.Status != "ok" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(resp)
+}
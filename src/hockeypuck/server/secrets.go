@@ -0,0 +1,65 @@
+package server
+
+import (
+	"github.com/pkg/errors"
+
+	"hockeypuck/secrets"
+)
+
+// ResolveSecrets replaces references to secrets in settings with their
+// values. The resolver returned renews any leased secrets once started.
+func ResolveSecrets(settings *Settings) (*secrets.Resolver, error) {
+	r, err := secrets.NewResolver(settings.Secrets)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	err = expandSecrets(r, settings)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return r, nil
+}
+
+// expandSecrets replaces references to secrets in the settings which may
+// hold credentials.
+func expandSecrets(r *secrets.Resolver, settings *Settings) error {
+	values := map[string]*string{
+		"openpgp.db.dsn":        &settings.OpenPGP.DB.DSN,
+		"hkp.provenance.secret": &settings.HKP.Provenance.Secret,
+	}
+	if settings.OpenPGP.PKS != nil {
+		values["openpgp.pks.smtp.pass"] = &settings.OpenPGP.PKS.SMTP.Password
+	}
+	if settings.Replica != nil {
+		values["replica.token"] = &settings.Replica.Token
+	}
+	if settings.Tor != nil {
+		values["tor.controlPassword"] = &settings.Tor.ControlPassword
+	}
+	for name, value := range values {
+		expanded, err := r.Expand(*value)
+		if err != nil {
+			return errors.Wrapf(err, "invalid %s", name)
+		}
+		*value = expanded
+	}
+	if settings.Tracing != nil {
+		for header, value := range settings.Tracing.Headers {
+			expanded, err := r.Expand(value)
+			if err != nil {
+				return errors.Wrapf(err, "invalid tracing.headers.%s", header)
+			}
+			settings.Tracing.Headers[header] = expanded
+		}
+	}
+	partners := settings.Conflux.Recon.Partners
+	for name, partner := range partners {
+		expanded, err := r.Expand(partner.PSK)
+		if err != nil {
+			return errors.Wrapf(err, "invalid conflux.recon.partner.%s.psk", name)
+		}
+		partner.PSK = expanded
+		partners[name] = partner
+	}
+	return nil
+}
@@ -4,25 +4,50 @@ import (
 	"crypto/tls"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net"
 	"net/http"
 	"os"
 	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/carbocation/interpose"
 	"github.com/julienschmidt/httprouter"
 	"github.com/pkg/errors"
+	"golang.org/x/crypto/acme/autocert"
 	"gopkg.in/tomb.v2"
 
+	"hockeypuck/abuse"
+	"hockeypuck/accesslog"
+	"hockeypuck/announce"
+	"hockeypuck/apitoken"
+	"hockeypuck/conflux/recon"
+	"hockeypuck/deprecation"
 	"hockeypuck/hkp"
+	"hockeypuck/hkp/digestcache"
+	"hockeypuck/hkp/keycache"
+	"hockeypuck/hkp/links"
+	"hockeypuck/hkp/replica"
 	"hockeypuck/hkp/sks"
 	"hockeypuck/hkp/storage"
+	"hockeypuck/hkp/wkd"
+	"hockeypuck/ingest"
+	"hockeypuck/logging"
 	log "hockeypuck/logrus"
+	"hockeypuck/logsink"
 	"hockeypuck/metrics"
+	"hockeypuck/notify"
 	"hockeypuck/openpgp"
 	"hockeypuck/pghkp"
+	"hockeypuck/proofs"
+	"hockeypuck/proxyproto"
+	"hockeypuck/rollout"
+	"hockeypuck/sdnotify"
+	"hockeypuck/secrets"
+	"hockeypuck/tor"
+	"hockeypuck/tracing"
 )
 
 type Server struct {
@@ -31,8 +56,33 @@ type Server struct {
 	middle          *interpose.Middleware
 	r               *httprouter.Router
 	sksPeer         *sks.Peer
+	follower        *replica.Follower
 	logWriter       io.WriteCloser
+	logSink         logsink.Sink
+	tracer          *tracing.Exporter
+	accessLog       *accesslog.Log
+	tokens          *apitoken.Tokens
 	metricsListener *metrics.Metrics
+	abuseScorer     *abuse.Scorer
+	abuseLog        *abuse.EventLog
+	notifier        *notify.Dispatcher
+	reporter        *changeReporter
+	rateLimiter     *abuse.RateLimiter
+	torCtl          *tor.Controller
+	rollout         *rollout.Flags
+	announcements   *announce.Board
+	links           *links.Handler
+	ingest          *ingest.Scheduler
+	deprecations    *deprecation.Deprecations
+	proofs          *proofs.Verifier
+	secrets         *secrets.Resolver
+	onionAddr       string
+	acme            *autocert.Manager
+	maintenance     maintenance
+	subsystems      subsystems
+
+	// muSettings guards settings which may be changed by Reload.
+	muSettings sync.RWMutex
 
 	t                 tomb.Tomb
 	hkpAddr, hkpsAddr string
@@ -77,9 +127,16 @@ func KeyReaderOptions(settings *Settings) []openpgp.KeyReaderOption {
 	if settings.OpenPGP.MaxPacketLength > 0 {
 		opts = append(opts, openpgp.MaxPacketLen(settings.OpenPGP.MaxPacketLength))
 	}
+	if settings.OpenPGP.MaxUserAttributeLength > 0 {
+		opts = append(opts, openpgp.MaxUserAttributeLen(settings.OpenPGP.MaxUserAttributeLength))
+	}
 	if len(settings.OpenPGP.Blacklist) > 0 {
 		opts = append(opts, openpgp.Blacklist(settings.OpenPGP.Blacklist))
 	}
+	if settings.OpenPGP.KeyBudgetSecs > 0 {
+		opts = append(opts, openpgp.KeyBudget(time.Duration(settings.OpenPGP.KeyBudgetSecs)*time.Second))
+	}
+	opts = append(opts, openpgp.FilterOptions(settings.Conflux.Recon.Settings.Filters)...)
 	return opts
 }
 
@@ -94,12 +151,31 @@ func NewServer(settings *Settings) (*Server, error) {
 	}
 
 	var err error
+	s.secrets, err = ResolveSecrets(settings)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
 	s.st, err = DialStorage(settings)
 	if err != nil {
 		return nil, err
 	}
+	if !storage.Supports(s.st, storage.CapKeywordSearch) && !settings.HKP.Queries.FingerprintOnly {
+		log.Warningf("storage driver %q does not support keyword search; only key ID queries are available",
+			settings.OpenPGP.DB.Driver)
+	}
 
 	s.middle = interpose.New()
+	// The request ID and trace are set first, so that every later
+	// middleware, and the response to every request, carries them.
+	s.middle.Use(tracing.Handler)
+	s.middle.Use(logging.RequestID)
+	if settings.AccessLog.Enabled() {
+		s.accessLog, err = accesslog.New(settings.AccessLog)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		s.middle.Use(s.accessLog.Handler)
+	}
 	s.middle.Use(func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
 			start := time.Now()
@@ -125,28 +201,170 @@ func NewServer(settings *Settings) (*Server, error) {
 					fields[ph] = v
 				}
 			}
-			log.WithFields(fields).Info()
+			log.WithFields(fields).WithFields(logging.RequestFields(req)).Info()
 			recordHTTPRequestDuration(req.Method, scrw.statusCode, duration)
 		})
 	})
+	if settings.Abuse == nil {
+		settings.Abuse = abuse.DefaultSettings()
+	}
+	s.abuseScorer = abuse.NewScorer(settings.Abuse)
+	s.rateLimiter = abuse.NewRateLimiter(settings.Abuse.RateLimit, settings.Abuse.RateBurst)
+	if settings.Abuse.EventLog != "" {
+		s.abuseLog, err = abuse.OpenEventLog(settings.Abuse.EventLog)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		s.abuseScorer.SetEventLog(s.abuseLog)
+		s.rateLimiter.SetEventLog(s.abuseLog)
+	}
+	if settings.Tokens.Enabled() {
+		s.tokens, err = apitoken.New(settings.Tokens)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		s.middle.Use(s.tokens.Handler)
+		s.r.GET(apitoken.UsagePath, s.tokens.ServeUsage)
+	}
+	s.middle.Use(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			client := abuse.ClientAddr(req.RemoteAddr)
+			if s.abuseScorer.Banned(client) {
+				s.abuseScorer.RecordRefused(client)
+				http.Error(rw, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+				return
+			}
+			// Tokens with their own rate limit have been limited already.
+			tok, _ := apitoken.FromContext(req.Context())
+			if tok.RateLimit <= 0 && !s.rateLimiter.Allow(client) {
+				http.Error(rw, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+				return
+			}
+			next.ServeHTTP(rw, req)
+		})
+	})
+	s.middle.Use(s.refuseDuringMaintenance)
+	s.announcements, err = announce.New(settings.Announce)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	s.middle.Use(s.announcements.Handler)
+	s.deprecations, err = deprecation.New(settings.Deprecation)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	s.middle.Use(s.deprecations.Handler)
 	s.middle.UseHandler(s.r)
 
-	keyReaderOptions := KeyReaderOptions(settings)
-	userAgent := fmt.Sprintf("%s/%s", settings.Software, settings.Version)
-	s.sksPeer, err = sks.NewPeer(s.st, settings.Conflux.Recon.LevelDB.Path, &settings.Conflux.Recon.Settings, keyReaderOptions, userAgent)
+	s.notifier, err = notify.NewDispatcher(settings.Notify)
 	if err != nil {
 		return nil, errors.WithStack(err)
 	}
 
+	s.rollout, err = rollout.NewFlags(settings.Rollout)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	s.ingest = ingest.NewScheduler(settings.Ingest)
+
+	var digestCache *digestcache.Cache
+	if settings.DigestCache.Enabled() {
+		digestCache, err = digestcache.New(settings.DigestCache)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		s.st.Subscribe(digestCache.KeyChanged)
+	}
+
+	keyReaderOptions := KeyReaderOptions(settings)
+	userAgent := fmt.Sprintf("%s/%s", settings.Software, settings.Version)
+	if settings.Replica.Enabled() {
+		s.follower, err = replica.NewFollower(s.st, settings.Replica, keyReaderOptions, userAgent)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		s.follower.SetNotifier(s.notifier)
+		s.follower.SetIngestScheduler(s.ingest)
+		s.follower.SetQuarantine(settings.HKP.QuarantineDir)
+	}
+	switch {
+	case settings.Replica.Enabled() && !settings.Replica.Merge:
+		// Replicas take every key from the primary, so recon is not needed.
+		// Primaries which merge keys from each other may still recon.
+	case settings.Cluster.Frontend():
+		// Front ends share storage with the stateful server, which keeps
+		// the prefix tree and runs recon for them.
+		s.reporter, err = newChangeReporter(settings.Cluster)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+	default:
+		s.sksPeer, err = sks.NewPeer(s.st, settings.Conflux.Recon.LevelDB.Path, &settings.Conflux.Recon.Settings, keyReaderOptions, userAgent)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		s.sksPeer.SetNotifier(s.notifier)
+		s.sksPeer.SetIngestScheduler(s.ingest)
+		s.sksPeer.SetSelfCheck(settings.Conflux.Recon.SelfCheck)
+		s.sksPeer.SetQuarantine(settings.HKP.QuarantineDir)
+		if digestCache != nil {
+			s.sksPeer.SetDigestCache(digestCache)
+		}
+	}
+
 	s.metricsListener = metrics.NewMetrics(settings.Metrics)
 
+	s.acme, err = newACMEManager(settings)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
 	keyWriterOptions := KeyWriterOptions(settings)
 	options := []hkp.HandlerOption{
 		hkp.StatsFunc(s.stats),
+		hkp.PolicyFunc(s.policy),
 		hkp.SelfSignedOnly(settings.HKP.Queries.SelfSignedOnly),
 		hkp.FingerprintOnly(settings.HKP.Queries.FingerprintOnly),
+		hkp.RedactUserIDs(settings.HKP.Queries.Redact),
+		hkp.ResponseLimit(settings.HKP.Queries.MaxResponseLength, settings.HKP.Queries.TruncateLargeKeys),
+		hkp.SlimKeys(settings.HKP.Queries.SlimKeys),
+		hkp.AttestedOnly(settings.HKP.Queries.AttestedOnly),
+		hkp.ExcludeExpired(settings.HKP.Queries.ExcludeExpired),
+		hkp.RefuseShortKeyIDs(settings.HKP.Queries.RefuseShortKeyIDs),
+		hkp.CompressResponses(settings.HKP.Compression),
+		hkp.SubmissionLimits(settings.HKP.Limits),
+		hkp.Quarantine(settings.HKP.QuarantineDir),
+		hkp.KeyProvenance(settings.HKP.Provenance),
 		hkp.KeyReaderOptions(keyReaderOptions),
 		hkp.KeyWriterOptions(keyWriterOptions),
+		hkp.AbuseScorer(s.abuseScorer),
+		hkp.Notifier(s.notifier),
+		hkp.ModifiedWaitTokens(settings.Tokens.Enabled()),
+		hkp.Rollout(s.rollout),
+		hkp.IngestScheduler(s.ingest),
+	}
+	if settings.Cluster.Frontend() {
+		u, err := settings.Cluster.statefulURL()
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		options = append(options, hkp.ForwardHashQuery(u), hkp.ChangeReporter(s.reporter))
+	}
+	if settings.Proofs != nil && settings.Proofs.Enabled {
+		s.proofs = proofs.NewVerifier(settings.Proofs)
+		options = append(options, hkp.ProofVerifier(s.proofs))
+	}
+	if settings.KeyCache.Enabled() {
+		keyCache, err := keycache.New(settings.KeyCache)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		s.st.Subscribe(keyCache.KeyChanged)
+		options = append(options, hkp.KeyCache(keyCache))
+	}
+	if digestCache != nil {
+		options = append(options, hkp.DigestCache(digestCache))
 	}
 	if settings.IndexTemplate != "" {
 		options = append(options, hkp.IndexTemplate(settings.IndexTemplate))
@@ -162,6 +380,30 @@ func NewServer(settings *Settings) (*Server, error) {
 		return nil, errors.WithStack(err)
 	}
 	h.Register(s.r)
+	s.registerProbes()
+
+	if s.sksPeer != nil {
+		err = s.registerChanges(settings.Cluster)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+	}
+
+	if settings.WKD.Enabled() {
+		wh, err := wkd.NewHandler(s.st, settings.WKD)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		wh.Register(s.r)
+	}
+
+	if settings.Links.Enabled() {
+		s.links, err = links.NewHandler(settings.Links, s.r)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		s.links.Register(s.r)
+	}
 
 	if settings.Webroot != "" {
 		err := s.registerWebroot(settings.Webroot)
@@ -170,18 +412,44 @@ func NewServer(settings *Settings) (*Server, error) {
 		}
 	}
 
+	s.registerSubsystems()
 	registerMetrics()
 	s.st.Subscribe(metricsStorageNotifier)
 
 	return s, nil
 }
 
+// StorageDrivers returns the names of the supported storage drivers.
+func StorageDrivers() []string {
+	return []string{"postgres-jsonb"}
+}
+
 func DialStorage(settings *Settings) (storage.Storage, error) {
-	switch settings.OpenPGP.DB.Driver {
+	return DialDB(settings, &settings.OpenPGP.DB)
+}
+
+// DialDB connects to the database db, reading keys with the options
+// configured in settings.
+func DialDB(settings *Settings, db *DBConfig) (storage.Storage, error) {
+	switch db.Driver {
 	case "postgres-jsonb":
-		return pghkp.Dial(settings.OpenPGP.DB.DSN, KeyReaderOptions(settings))
+		opts := []pghkp.Option{
+			pghkp.WithSearch(pghkp.SearchOptions{
+				Prefix:           db.Search.Prefix,
+				DomainComponents: db.Search.DomainComponents,
+			}),
+			pghkp.WithPool(pghkp.PoolOptions{
+				MaxOpenConns:    db.MaxOpenConns,
+				MaxIdleConns:    db.MaxIdleConns,
+				ConnMaxLifetime: time.Duration(db.ConnMaxLifetimeSecs) * time.Second,
+			}),
+		}
+		if db.CacheStatements {
+			opts = append(opts, pghkp.WithStatementCache())
+		}
+		return pghkp.Dial(db.DSN, KeyReaderOptions(settings), opts...)
 	}
-	return nil, errors.Errorf("storage driver %q not supported", settings.OpenPGP.DB.Driver)
+	return nil, errors.Errorf("storage driver %q not supported, expected one of %v", db.Driver, StorageDrivers())
 }
 
 type stats struct {
@@ -193,10 +461,19 @@ type stats struct {
 	HTTPAddr      string           `json:"httpAddr"`
 	QueryConfig   statsQueryConfig `json:"queryConfig"`
 	ReconAddr     string           `json:"reconAddr"`
+	Filters       []string         `json:"filters"`
 	Software      string           `json:"software"`
 	Peers         []statsPeer      `json:"peers"`
 	NumKeys       int              `json:"numkeys,omitempty"`
 	ServerContact string           `json:"server_contact,omitempty"`
+	OnionAddr     string           `json:"onionAddr,omitempty"`
+
+	// Announcements are the operator's active announcements.
+	Announcements []announce.Announcement `json:"announcements,omitempty"`
+
+	// PTree describes the shape of the recon prefix tree, once its nodes
+	// have been counted.
+	PTree *recon.PTreeStats `json:"ptree,omitempty"`
 
 	Total  int
 	Hourly []loadStat
@@ -223,6 +500,10 @@ type statsPeer struct {
 	Name      string
 	HTTPAddr  string `json:"httpAddr"`
 	ReconAddr string `json:"reconAddr"`
+
+	// Status describes recent recon sessions with the peer, if this
+	// server runs recon.
+	Status *recon.PartnerStatus `json:"status,omitempty"`
 }
 
 type statsPeers []statsPeer
@@ -232,7 +513,18 @@ func (s statsPeers) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
 func (s statsPeers) Less(i, j int) bool { return s[i].Name < s[j].Name }
 
 func (s *Server) stats() (interface{}, error) {
-	sksStats := s.sksPeer.Stats()
+	sksStats := sks.NewStats()
+	partners := recon.PartnerMap{}
+	partnerStatus := map[string]recon.PartnerStatus{}
+	var ptreeStats *recon.PTreeStats
+	if s.sksPeer != nil {
+		sksStats = s.sksPeer.Stats()
+		partners = s.sksPeer.Partners()
+		partnerStatus = s.sksPeer.PartnerStatus()
+		ptreeStats = s.sksPeer.PTreeStats()
+	}
+	fingerprintOnly := s.settings.HKP.Queries.FingerprintOnly ||
+		!storage.Supports(s.st, storage.CapKeywordSearch)
 
 	result := &stats{
 		Now:      time.Now().UTC().Format(time.RFC3339),
@@ -241,17 +533,28 @@ func (s *Server) stats() (interface{}, error) {
 		HTTPAddr: s.settings.HKP.Bind,
 		QueryConfig: statsQueryConfig{
 			SelfSignedOnly:  s.settings.HKP.Queries.SelfSignedOnly,
-			FingerprintOnly: s.settings.HKP.Queries.FingerprintOnly,
+			FingerprintOnly: fingerprintOnly,
 		},
 		ReconAddr: s.settings.Conflux.Recon.Settings.ReconAddr,
+		Filters:   s.settings.Conflux.Recon.Settings.Filters,
 		Software:  s.settings.Software,
+		OnionAddr: s.onionAddr,
+
+		Announcements: s.announcements.Active(),
+		PTree:         ptreeStats,
 
 		Total: sksStats.Total,
 	}
+	unixSocket := strings.HasPrefix(s.settings.HKP.Bind, "unix:")
+	if unixSocket {
+		// A socket path means nothing to other servers; the onion service
+		// is how this server is reached.
+		result.HTTPAddr = s.onionAddr
+	}
 
 	if s.settings.SksCompat {
 		_t, _ := time.Parse(time.RFC3339, result.Now)
-		result.HTTPAddr = strings.Split(s.settings.HKP.Bind, ":")[1]
+		_, result.HTTPAddr, _ = net.SplitHostPort(result.HTTPAddr)
 		result.Now = _t.Format("2006-01-02 15:04:05 MST")
 		result.NumKeys = sksStats.Total
 		result.ReconAddr = strings.Split(s.settings.Conflux.Recon.Settings.ReconAddr, ":")[1]
@@ -267,6 +570,8 @@ func (s *Server) stats() (interface{}, error) {
 
 	if s.settings.Hostname != "" {
 		result.Hostname = s.settings.Hostname
+	} else if unixSocket && s.onionAddr != "" {
+		result.Hostname, _, _ = net.SplitHostPort(s.onionAddr)
 	} else if nodename != "" {
 		result.Hostname = nodename
 	}
@@ -279,20 +584,22 @@ func (s *Server) stats() (interface{}, error) {
 		result.Daily = append(result.Daily, loadStat{LoadStat: v, Time: k})
 	}
 	sort.Sort(loadStats(result.Daily))
-	for k, v := range s.settings.Conflux.Recon.Settings.Partners {
+	for k, v := range partners {
+		peer := statsPeer{
+			Name:      k,
+			HTTPAddr:  v.HTTPAddr,
+			ReconAddr: v.ReconAddr,
+		}
 		if s.settings.SksCompat {
-			result.Peers = append(result.Peers, statsPeer{
-				Name:      k,
-				HTTPAddr:  v.HTTPAddr,
-				ReconAddr: strings.ReplaceAll(v.ReconAddr, ":", " "),
-			})
-		} else {
-			result.Peers = append(result.Peers, statsPeer{
-				Name:      k,
-				HTTPAddr:  v.HTTPAddr,
-				ReconAddr: v.ReconAddr,
-			})
+			peer.ReconAddr = strings.ReplaceAll(v.ReconAddr, ":", " ")
+		}
+		if status, ok := partnerStatus[k]; ok {
+			// Errors can reveal details of the partner's network, and
+			// are only served on the admin API.
+			status.LastError = ""
+			peer.Status = &status
 		}
+		result.Peers = append(result.Peers, peer)
 	}
 	sort.Sort(statsPeers(result.Peers))
 	return result, nil
@@ -322,6 +629,14 @@ func (s *Server) registerWebroot(webroot string) error {
 	// previously registered routes.
 	for _, fi := range files {
 		name := fi.Name()
+		if name == ".well-known" && s.settings.WKD.Enabled() {
+			log.Warningf("webroot %q: .well-known is not served, since WKD is enabled", webroot)
+			continue
+		}
+		if s.links != nil && s.links.Serves("/"+name) {
+			log.Warningf("webroot %q: %s is not served, since it is a configured link", webroot, name)
+			continue
+		}
 		if !fi.IsDir() {
 			s.r.GET("/"+name, func(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
 				req.URL.Path = "/" + name
@@ -339,20 +654,62 @@ func (s *Server) registerWebroot(webroot string) error {
 
 func (s *Server) Start() error {
 	s.openLog()
+	s.secrets.Start()
+
+	if s.settings.Tracing.Enabled() {
+		var err error
+		s.tracer, err = tracing.Start(s.settings.Tracing)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+	}
 
 	s.t.Go(s.listenAndServeHKP)
 	if s.settings.HKPS != nil {
 		s.t.Go(s.listenAndServeHKPS)
 	}
+	if s.challengeBind() != "" {
+		s.t.Go(s.listenAndServeChallenge)
+	}
+	if s.settings.Admin != nil && s.settings.Admin.Bind != "" {
+		s.t.Go(s.listenAndServeAdmin)
+	}
+
+	err := s.publishOnion()
+	if err != nil {
+		return errors.WithStack(err)
+	}
 
 	if s.sksPeer != nil {
 		s.sksPeer.Start()
 	}
+	if s.follower != nil {
+		s.follower.Start()
+	}
+	if s.reporter != nil {
+		s.reporter.Start()
+	}
+
+	if s.proofs != nil {
+		s.proofs.Start()
+	}
+	if s.notifier.Enabled() {
+		s.notifier.Start()
+	}
 
 	if s.metricsListener != nil {
 		s.metricsListener.Start()
 	}
 
+	// Storage and the prefix tree were opened by NewServer. The watchdog
+	// is pinged only once the server is ready, as systemd starts the
+	// watchdog timer then.
+	notifySystemd(sdnotify.Ready)
+	err = s.startWatchdog()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	s.startBackfill()
 	return nil
 }
 
@@ -362,37 +719,145 @@ type nopCloser struct {
 
 func (nopCloser) Close() error { return nil }
 
+func (s *Server) setLogLevels(logLevel string, logLevels map[string]string) {
+	err := logging.Configure(logLevel, logLevels)
+	if err != nil {
+		log.Warningf("invalid log levels: %v", err)
+	}
+}
+
 func (s *Server) openLog() {
 	defer func() {
-		level, err := log.ParseLevel(strings.ToLower(s.settings.LogLevel))
+		s.muSettings.RLock()
+		s.setLogLevels(s.settings.LogLevel, s.settings.LogLevels)
+		s.muSettings.RUnlock()
+	}()
+
+	if s.settings.LogSink.Enabled() && s.logSink == nil {
+		sink, err := logsink.Open(s.settings.LogSink)
 		if err != nil {
-			log.Warningf("invalid LogLevel=%q: %v", s.settings.LogLevel, err)
-			return
+			log.Errorf("failed to open log sink %q: %v", s.settings.LogSink.Sink, err)
+		} else {
+			s.logSink = sink
+			logging.SetHook(sink)
 		}
-		log.SetLevel(level)
-	}()
+	}
 
 	s.logWriter = nopCloser{os.Stderr}
-	if s.settings.LogFile != "" {
+	if s.logSink != nil {
+		// Entries are sent to the sink by its hook.
+		s.logWriter = nopCloser{ioutil.Discard}
+	} else if s.settings.LogFile != "" {
 		f, err := os.OpenFile(s.settings.LogFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
 		if err != nil {
 			log.Errorf("failed to open LogFile=%q: %v", s.settings.LogFile, err)
 		}
 		s.logWriter = f
 	}
-	log.SetOutput(s.logWriter)
+	logging.SetOutput(s.logWriter)
 	log.Debug("log opened")
 }
 
 func (s *Server) closeLog() {
-	log.SetOutput(os.Stderr)
+	logging.SetOutput(os.Stderr)
 	s.logWriter.Close()
+	s.abuseLog.Close()
+	if s.logSink != nil {
+		logging.SetHook(nil)
+		s.logSink.Close()
+		s.logSink = nil
+	}
 }
 
 func (s *Server) LogRotate() {
 	w := s.logWriter
 	s.openLog()
 	w.Close()
+	if s.accessLog != nil {
+		err := s.accessLog.Rotate()
+		if err != nil {
+			log.Errorf("failed to rotate access log: %v", err)
+		}
+	}
+	if s.abuseLog != nil {
+		err := s.abuseLog.Reopen()
+		if err != nil {
+			log.Errorf("failed to reopen abuse event log: %v", err)
+		}
+	}
+}
+
+// Reload applies changed settings to the running server. Recon partners,
+// abuse scoring and rate limits, rollout percentages, announcements, and the
+// log level take effect immediately.
+// Changes to other settings, such as listen addresses and storage, are
+// ignored with a warning until the server is restarted.
+func (s *Server) Reload(settings *Settings) error {
+	if settings.Abuse == nil {
+		settings.Abuse = abuse.DefaultSettings()
+	}
+	err := expandSecrets(s.secrets, settings)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	// Every section is validated before any is applied, so that a reload
+	// which fails leaves the running settings as they were.
+	reconSettings := &settings.Conflux.Recon.Settings
+	partners := &recon.Settings{Partners: reconSettings.Partners, AllowCIDRs: reconSettings.AllowCIDRs}
+	_, err = partners.Matcher()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if settings.Rollout != nil {
+		err = settings.Rollout.Validate()
+		if err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	if settings.Announce != nil {
+		err = settings.Announce.Validate()
+		if err != nil {
+			return errors.WithStack(err)
+		}
+	}
+
+	if s.sksPeer != nil {
+		err := s.sksPeer.SetPartners(reconSettings.Partners, reconSettings.AllowCIDRs)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	err = s.rollout.SetSettings(settings.Rollout)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	err = s.announcements.SetSettings(settings.Announce)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	s.abuseScorer.SetSettings(settings.Abuse)
+	s.rateLimiter.SetLimit(settings.Abuse.RateLimit, settings.Abuse.RateBurst)
+
+	s.muSettings.Lock()
+	defer s.muSettings.Unlock()
+	if settings.HKP.Bind != s.settings.HKP.Bind ||
+		reconSettings.ReconAddr != s.settings.Conflux.Recon.Settings.ReconAddr ||
+		settings.OpenPGP.DB != s.settings.OpenPGP.DB {
+		log.Warning("listen address and storage changes require a restart")
+	}
+	s.settings.Conflux.Recon.Settings.Partners = reconSettings.Partners
+	s.settings.Conflux.Recon.Settings.AllowCIDRs = reconSettings.AllowCIDRs
+	s.settings.Abuse = settings.Abuse
+	s.settings.Rollout = settings.Rollout
+	s.settings.Announce = settings.Announce
+	s.settings.LogLevel = settings.LogLevel
+	s.settings.LogLevels = settings.LogLevels
+	s.setLogLevels(settings.LogLevel, settings.LogLevels)
+	log.WithFields(log.Fields{
+		"partners": len(reconSettings.Partners),
+		"loglevel": settings.LogLevel,
+	}).Info("settings reloaded")
+	return nil
 }
 
 func (s *Server) Wait() error {
@@ -401,15 +866,44 @@ func (s *Server) Wait() error {
 
 func (s *Server) Stop() {
 	defer s.closeLog()
+	notifySystemd(sdnotify.Stopping)
 
 	if s.sksPeer != nil {
 		s.sksPeer.Stop()
 	}
+	if s.follower != nil {
+		s.follower.Stop()
+	}
+	if s.reporter != nil {
+		s.reporter.Stop()
+	}
 	if s.metricsListener != nil {
 		s.metricsListener.Stop()
 	}
+	if s.proofs != nil {
+		s.proofs.Stop()
+	}
+	s.secrets.Stop()
+	if s.notifier.Enabled() {
+		s.notifier.Stop()
+	}
+	if s.torCtl != nil {
+		s.torCtl.Close()
+	}
 	s.t.Kill(nil)
 	s.t.Wait()
+	if s.accessLog != nil {
+		s.accessLog.Close()
+	}
+	if s.tracer != nil {
+		s.tracer.Stop()
+	}
+	if s.tokens != nil {
+		err := s.tokens.Close()
+		if err != nil {
+			log.Errorf("failed to save API token usage: %v", err)
+		}
+	}
 }
 
 // tcpKeepAliveListener sets TCP keep-alive timeouts on accepted
@@ -434,6 +928,10 @@ func (ln tcpKeepAliveListener) Accept() (net.Conn, error) {
 var newListener = (*Server).newListener
 
 func (s *Server) newListener(addr string) (net.Listener, error) {
+	if path := strings.TrimPrefix(addr, "unix:"); path != addr {
+		return s.newUnixListener(path)
+	}
+
 	ln, err := net.Listen("tcp", addr)
 	if err != nil {
 		return nil, errors.WithStack(err)
@@ -446,31 +944,79 @@ func (s *Server) newListener(addr string) (net.Listener, error) {
 	return tcpKeepAliveListener{ln.(*net.TCPListener)}, nil
 }
 
+// newUnixListener listens on a unix socket, such as one to which Tor
+// forwards an onion service. A socket left behind by a previous run is
+// replaced.
+func (s *Server) newUnixListener(path string) (net.Listener, error) {
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		err = os.Remove(path)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	s.t.Go(func() error {
+		<-s.t.Dying()
+		return ln.Close()
+	})
+	return ln, nil
+}
+
 func (s *Server) listenAndServeHKP() error {
+	trusted, err := proxyproto.ParseTrusted(s.settings.HKP.ProxyProtocol)
+	if err != nil {
+		return errors.WithStack(err)
+	}
 	ln, err := newListener(s, s.settings.HKP.Bind)
 	if err != nil {
 		return errors.WithStack(err)
 	}
 	s.hkpAddr = ln.Addr().String()
-	return http.Serve(ln, s.middle)
+	return s.newHTTPServer(s.hkpHandler()).Serve(trusted.Listener(ln))
 }
 
 func (s *Server) listenAndServeHKPS() error {
-	config := &tls.Config{
-		NextProtos: []string{"http/1.1"},
-	}
-	var err error
-	config.Certificates = make([]tls.Certificate, 1)
-	config.Certificates[0], err = tls.LoadX509KeyPair(s.settings.HKPS.Cert, s.settings.HKPS.Key)
+	config, err := s.hkpsTLSConfig()
 	if err != nil {
-		return errors.Wrapf(err, "failed to load HKPS certificate=%q key=%q", s.settings.HKPS.Cert, s.settings.HKPS.Key)
+		return errors.WithStack(err)
 	}
 
-	ln, err := newListener(s, s.settings.HKP.Bind)
+	trusted, err := proxyproto.ParseTrusted(s.settings.HKPS.ProxyProtocol)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	bind := s.settings.HKPS.Bind
+	if bind == "" {
+		bind = DefaultHKPSBind
+	}
+	ln, err := newListener(s, bind)
 	if err != nil {
 		return errors.WithStack(err)
 	}
 	s.hkpsAddr = ln.Addr().String()
-	ln = tls.NewListener(ln, config)
-	return http.Serve(ln, s.middle)
+	ln = tls.NewListener(trusted.Listener(ln), config)
+	srv := s.newHTTPServer(s.middle)
+	if !s.settings.HKP.HTTP.HTTP2 {
+		// A non-nil map keeps the server from configuring HTTP/2.
+		srv.TLSNextProto = map[string]func(*http.Server, *tls.Conn, http.Handler){}
+	}
+	return srv.Serve(ln)
+}
+
+// newHTTPServer returns a server for HKP or HKPS with the configured
+// timeouts and limits.
+func (s *Server) newHTTPServer(h http.Handler) *http.Server {
+	c := s.settings.HKP.HTTP
+	return &http.Server{
+		Handler:           h,
+		ReadHeaderTimeout: time.Duration(c.ReadHeaderTimeoutSecs) * time.Second,
+		ReadTimeout:       time.Duration(c.ReadTimeoutSecs) * time.Second,
+		WriteTimeout:      time.Duration(c.WriteTimeoutSecs) * time.Second,
+		IdleTimeout:       time.Duration(c.IdleTimeoutSecs) * time.Second,
+		MaxHeaderBytes:    c.MaxHeaderBytes,
+	}
 }
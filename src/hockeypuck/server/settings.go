@@ -21,8 +21,30 @@ import (
 	"github.com/BurntSushi/toml"
 	"github.com/pkg/errors"
 
+	"hockeypuck/abuse"
+	"hockeypuck/accesslog"
+	"hockeypuck/announce"
+	"hockeypuck/apitoken"
 	"hockeypuck/conflux/recon"
+	"hockeypuck/deprecation"
+	"hockeypuck/hkp"
+	"hockeypuck/hkp/digestcache"
+	"hockeypuck/hkp/jsonhkp"
+	"hockeypuck/hkp/keycache"
+	"hockeypuck/hkp/links"
+	"hockeypuck/hkp/replica"
+	"hockeypuck/hkp/sks"
+	"hockeypuck/hkp/wkd"
+	"hockeypuck/ingest"
+	"hockeypuck/logsink"
 	"hockeypuck/metrics"
+	"hockeypuck/notify"
+	"hockeypuck/openpgp"
+	"hockeypuck/proofs"
+	"hockeypuck/rollout"
+	"hockeypuck/secrets"
+	"hockeypuck/tor"
+	"hockeypuck/tracing"
 )
 
 type confluxConfig struct {
@@ -36,6 +58,10 @@ type levelDB struct {
 type reconConfig struct {
 	recon.Settings
 	LevelDB levelDB `toml:"leveldb"`
+
+	// SelfCheck periodically reconciles the prefix tree with the digests
+	// of the stored keys, to find keys missing from either.
+	SelfCheck *sks.SelfCheckSettings `toml:"selfCheck"`
 }
 
 const (
@@ -43,9 +69,91 @@ const (
 )
 
 type HKPConfig struct {
+	// Bind is the address on which HKP is served, either host:port or
+	// unix:/path/to/socket.
 	Bind string `toml:"bind"`
 
+	// ProxyProtocol lists the networks, such as load balancers, trusted to
+	// give the client address in a PROXY protocol header.
+	ProxyProtocol []string `toml:"proxyProtocol"`
+
 	Queries queryConfig `toml:"queries"`
+
+	// Compression compresses get and index responses for clients which
+	// accept it.
+	Compression hkp.Compression `toml:"compression"`
+
+	// HTTP tunes the HTTP servers for HKP and HKPS.
+	HTTP HTTPConfig `toml:"http"`
+
+	// Limits bound the keys accepted by /pks/add.
+	Limits hkp.Limits `toml:"limits"`
+
+	// QuarantineDir keeps submissions which contained secret key material,
+	// and keys over the key budget from any source, for operator review. If
+	// empty, they are discarded.
+	QuarantineDir string `toml:"quarantineDir"`
+
+	// Provenance accepts proof of possession with submissions, listing
+	// keys submitted without it as unverified.
+	Provenance hkp.Provenance `toml:"provenance"`
+}
+
+const (
+	DefaultReadHeaderTimeoutSecs = 10
+	DefaultReadTimeoutSecs       = 60
+	DefaultIdleTimeoutSecs       = 120
+	DefaultMaxHeaderBytes        = 1 << 16
+)
+
+// HTTPConfig bounds how long clients may take over their requests and hold
+// idle connections open, so that slow clients cannot tie up the server.
+type HTTPConfig struct {
+	// ReadHeaderTimeoutSecs limits the time to read request headers.
+	ReadHeaderTimeoutSecs int `toml:"readHeaderTimeoutSecs"`
+
+	// ReadTimeoutSecs limits the time to read a whole request, including
+	// its body. Zero is unlimited.
+	ReadTimeoutSecs int `toml:"readTimeoutSecs"`
+
+	// WriteTimeoutSecs limits the time to write a response. Zero is
+	// unlimited, which suits bulk fetchers of large keys and replicas
+	// waiting on the modified feed.
+	WriteTimeoutSecs int `toml:"writeTimeoutSecs"`
+
+	// IdleTimeoutSecs limits how long a kept-alive connection may wait for
+	// its next request.
+	IdleTimeoutSecs int `toml:"idleTimeoutSecs"`
+
+	// MaxHeaderBytes limits the size of request headers.
+	MaxHeaderBytes int `toml:"maxHeaderBytes"`
+
+	// HTTP2 enables HTTP/2 for HKPS. HKP is always served over HTTP/1.1.
+	HTTP2 bool `toml:"http2"`
+}
+
+func DefaultHTTPConfig() HTTPConfig {
+	return HTTPConfig{
+		ReadHeaderTimeoutSecs: DefaultReadHeaderTimeoutSecs,
+		ReadTimeoutSecs:       DefaultReadTimeoutSecs,
+		IdleTimeoutSecs:       DefaultIdleTimeoutSecs,
+		MaxHeaderBytes:        DefaultMaxHeaderBytes,
+	}
+}
+
+func (c *HTTPConfig) validate() error {
+	for name, v := range map[string]int{
+		"readHeaderTimeoutSecs": c.ReadHeaderTimeoutSecs,
+		"readTimeoutSecs":       c.ReadTimeoutSecs,
+		"writeTimeoutSecs":      c.WriteTimeoutSecs,
+		"idleTimeoutSecs":       c.IdleTimeoutSecs,
+		"maxHeaderBytes":        c.MaxHeaderBytes,
+	} {
+		if v < 0 {
+			return errors.Errorf("invalid hkp.http.%s %d", name, v)
+		}
+	}
+	return nil
 }
 
 type queryConfig struct {
@@ -53,12 +161,111 @@ type queryConfig struct {
 	SelfSignedOnly bool `toml:"selfSignedOnly"`
 	// Only allow fingerprint / key ID queries; no UID keyword searching allowed
 	FingerprintOnly bool `toml:"keywordSearchDisabled"`
+	// Hide email addresses ("email") or whole user IDs ("uid") from index
+	// lookups, unless the lookup is by long key ID or fingerprint
+	Redact string `toml:"redact"`
+	// Limit each key served by get lookups to this many bytes of packets;
+	// zero is unlimited
+	MaxResponseLength int `toml:"maxResponseLength"`
+	// Serve keys over the limit truncated to their self-signatures, with an
+	// X-HKP-Truncated header, rather than refusing them
+	TruncateLargeKeys bool `toml:"truncateLargeKeys"`
+	// Serve keys without superseded self-signatures or expired
+	// certifications, as clients may request with options=slim
+	SlimKeys bool `toml:"slimKeys"`
+	// Serve keys with only the certifications by other keys which the
+	// key's holder has attested to, as clients may request with
+	// options=attested
+	AttestedOnly bool `toml:"attestedOnly"`
+	// Omit expired keys from get and index lookups, as clients may request
+	// with options=exclude-expired
+	ExcludeExpired bool `toml:"excludeExpired"`
+	// Refuse get and index lookups by 32-bit key ID, which are trivially
+	// spoofed, with an explanation; 64-bit key IDs and fingerprints still
+	// work
+	RefuseShortKeyIDs bool `toml:"refuseShortKeyIDs"`
 }
 
+const (
+	DefaultHKPSBind          = ":443"
+	DefaultACMEChallengeBind = ":80"
+	DefaultACMECacheDir      = "acme"
+)
+
 type HKPSConfig struct {
+	// Bind is the address on which HKPS is served. If empty, DefaultHKPSBind
+	// is used.
 	Bind string `toml:"bind"`
 	Cert string `toml:"cert"`
 	Key  string `toml:"key"`
+
+	// ACME obtains and renews the certificate automatically, instead of
+	// loading it from Cert and Key.
+	ACME *ACMEConfig `toml:"acme"`
+
+	// ProxyProtocol lists the networks trusted to give the client address
+	// in a PROXY protocol header, as for HKP.
+	ProxyProtocol []string `toml:"proxyProtocol"`
+}
+
+type ACMEConfig struct {
+	// Hosts are the names for which certificates may be obtained. If empty,
+	// the hostname setting is used.
+	Hosts []string `toml:"hosts"`
+
+	// Email is given to the certificate authority as the account contact.
+	Email string `toml:"email"`
+
+	// DirectoryURL is the directory of the ACME certificate authority. If
+	// empty, Let's Encrypt is used.
+	DirectoryURL string `toml:"directoryURL"`
+
+	// CacheDir holds the account key and certificates across restarts, so
+	// that the authority's rate limits are not exceeded.
+	CacheDir string `toml:"cacheDir"`
+
+	// ChallengeBind is the address on which HTTP-01 challenges are
+	// answered. Other requests to it are redirected to HKPS. If it is the
+	// same as the HKP bind address, challenges are answered there instead.
+	ChallengeBind string `toml:"challengeBind"`
+}
+
+// AdminConfig configures the admin API, which is served on its own listener.
+// The admin API is not authenticated, so it should only be bound to a
+// loopback address or a unix socket.
+type AdminConfig struct {
+	// Bind is the address on which the admin API is served, either
+	// host:port or unix:/path/to/socket. If empty, there is no admin API.
+	Bind string `toml:"bind"`
+
+	// MaintenanceCommands are storage maintenance tasks run by external
+	// commands, such as pg_repack, as an argument list keyed by task name.
+	// They are run as the built-in vacuum and reindex tasks are.
+	MaintenanceCommands map[string][]string `toml:"maintenanceCommands"`
+}
+
+// ClusterConfig scales a server horizontally: stateless front ends serve
+// lookups and submissions from shared storage, while a single stateful
+// server keeps the prefix tree and runs recon.
+type ClusterConfig struct {
+	// Stateful is the HKP URL of the stateful server. If set, this server
+	// is a front end: it keeps no prefix tree, forwards hashqueries to the
+	// stateful server and reports the key changes it makes there.
+	Stateful string `toml:"stateful"`
+
+	// ReportSpool is a file in which a front end keeps the key changes not
+	// yet acknowledged by the stateful server, so that they are reported
+	// after a restart. If empty, they are only held in memory.
+	ReportSpool string `toml:"reportSpool"`
+
+	// FrontendCIDRs lists the networks from which front ends may report
+	// key changes to this server. If empty, no changes are accepted.
+	FrontendCIDRs []string `toml:"frontendCIDRs"`
+}
+
+// Frontend returns whether the server is a stateless front end.
+func (c *ClusterConfig) Frontend() bool {
+	return c != nil && c.Stateful != ""
 }
 
 type PKSConfig struct {
@@ -83,11 +290,42 @@ const (
 	DefaultDBDSN           = "database=hockeypuck host=/var/run/postgresql port=5432 sslmode=disable"
 	DefaultMaxKeyLength    = 1048576
 	DefaultMaxPacketLength = 8192
+	DefaultKeyBudgetSecs   = 30
 )
 
 type DBConfig struct {
-	Driver string `toml:"driver"`
-	DSN    string `toml:"dsn"`
+	Driver string         `toml:"driver"`
+	DSN    string         `toml:"dsn"`
+	Search DBSearchConfig `toml:"search"`
+
+	// MaxOpenConns limits the connections opened to the database. Zero
+	// means no limit.
+	MaxOpenConns int `toml:"maxOpenConns"`
+
+	// MaxIdleConns limits the idle connections kept open for reuse. Zero
+	// keeps the database/sql default of two.
+	MaxIdleConns int `toml:"maxIdleConns"`
+
+	// ConnMaxLifetimeSecs is how long a connection is reused before it is
+	// closed. Zero reuses connections indefinitely.
+	ConnMaxLifetimeSecs int `toml:"connMaxLifetimeSecs"`
+
+	// CacheStatements keeps frequent queries prepared on each connection.
+	// Leave it disabled behind a connection pooler which does not support
+	// prepared statements, such as PgBouncer in transaction mode.
+	CacheStatements bool `toml:"cacheStatements"`
+}
+
+// DBSearchConfig controls how op=index keyword searches match user IDs.
+type DBSearchConfig struct {
+	// Prefix matches search terms as prefixes of user ID words and
+	// addresses.
+	Prefix bool `toml:"prefix"`
+
+	// DomainComponents lets a search for "@example.com" find addresses at
+	// subdomains of example.com. Existing keys are matched this way once
+	// they are next updated.
+	DomainComponents bool `toml:"domainComponents"`
 }
 
 const (
@@ -139,10 +377,26 @@ type OpenPGPConfig struct {
 	// blocks casually malicious content.
 	MaxPacketLength int `toml:"maxPacketLength"`
 
+	// MaxUserAttributeLength limits the size of user attributes, such as
+	// photo IDs. Larger user attributes are discarded along with their
+	// signatures, both from submitted keys and from stored keys as updates
+	// are merged into them. To discard all user attributes or all photos,
+	// use the drop-uats or drop-photos ingest filters instead. The limit is
+	// declared to recon peers along with the filters, as max-uat-length, since
+	// the digests of affected keys differ between peers configured otherwise.
+	MaxUserAttributeLength int `toml:"maxUserAttributeLength"`
+
 	// Blacklist contains a list of public key fingerprints that are not
 	// allowed on this server at all. These keys are silently dropped from
 	// inserts, updates, and lookups.
 	Blacklist []string `toml:"blacklist"`
+
+	// KeyBudgetSecs limits how long a single key may take to parse or to
+	// merge with the stored copy. Hostile packet structures can take far
+	// longer than any genuine key; keys over the budget are rejected, and
+	// kept in the HKP quarantine directory if one is configured, rather
+	// than holding up an ingest worker. Zero is no limit.
+	KeyBudgetSecs int `toml:"keyBudgetSecs"`
 }
 
 func DefaultOpenPGP() OpenPGPConfig {
@@ -158,6 +412,7 @@ func DefaultOpenPGP() OpenPGPConfig {
 		},
 		MaxKeyLength:    DefaultMaxKeyLength,
 		MaxPacketLength: DefaultMaxPacketLength,
+		KeyBudgetSecs:   DefaultKeyBudgetSecs,
 	}
 }
 
@@ -173,11 +428,83 @@ type Settings struct {
 
 	Metrics *metrics.Settings `toml:"metrics"`
 
+	Abuse *abuse.Settings `toml:"abuse"`
+
+	// Tokens issues API tokens which raise rate limits and grant access to
+	// restricted endpoints.
+	Tokens *apitoken.Settings `toml:"tokens"`
+
+	Notify *notify.Settings `toml:"notify"`
+
+	// AccessLog writes requests to a file in Common or Combined Log Format.
+	AccessLog *accesslog.Settings `toml:"accessLog"`
+
+	// Deprecation marks legacy endpoints and parameters as deprecated and
+	// counts their use.
+	Deprecation *deprecation.Settings `toml:"deprecation"`
+
+	// Ingest shares storage writes between submissions, recon and
+	// replication.
+	Ingest *ingest.Settings `toml:"ingest"`
+
+	// Replica configures this server to follow a primary server instead of
+	// reconciling with SKS peers, or to merge keys with another primary.
+	Replica *replica.Settings `toml:"replica"`
+
+	// Tor publishes HKP as an onion service.
+	Tor *tor.Settings `toml:"tor"`
+
+	// WKD serves the Web Key Directory for local mail domains.
+	WKD *wkd.Settings `toml:"wkd"`
+
+	// Links serves stable links to keys, by fingerprint or nickname, and
+	// other configured redirects.
+	Links *links.Settings `toml:"links"`
+
+	// Rollout enables new ingest behaviors for a percentage of keys.
+	Rollout *rollout.Settings `toml:"rollout"`
+
+	// Announce publishes operator announcements, such as maintenance
+	// windows, in stats, on the web pages and optionally in a response
+	// header.
+	Announce *announce.Settings `toml:"announce"`
+
+	// KeyCache keeps popular keys in memory for get lookups.
+	KeyCache *keycache.Settings `toml:"keyCache"`
+
+	// DigestCache shares the digests of stored keys between hashquery,
+	// lookups and prefix tree updates.
+	DigestCache *digestcache.Settings `toml:"digestCache"`
+
+	// Proofs verifies the identity proofs listed in key indexes.
+	Proofs *proofs.Settings `toml:"proofs"`
+
+	// Secrets configures where references to secrets in other settings,
+	// such as the database DSN, are resolved.
+	Secrets *secrets.Settings `toml:"secrets"`
+
+	Admin *AdminConfig `toml:"admin"`
+
+	// Cluster runs this server as a stateless front end, or as the stateful
+	// server its front ends report to.
+	Cluster *ClusterConfig `toml:"cluster"`
+
 	OpenPGP OpenPGPConfig `toml:"openpgp"`
 
 	LogFile  string `toml:"logfile"`
 	LogLevel string `toml:"loglevel"`
 
+	// LogLevels sets the log levels of subsystems apart from LogLevel, by
+	// module name, such as recon = "debug".
+	LogLevels map[string]string `toml:"logLevels"`
+
+	// LogSink sends logs to syslog or journald instead of LogFile.
+	LogSink *logsink.Settings `toml:"logSink"`
+
+	// Tracing exports spans of requests, storage calls and recon rounds to
+	// an OpenTelemetry collector.
+	Tracing *tracing.Settings `toml:"tracing"`
+
 	Webroot string `toml:"webroot"`
 
 	Contact  string `toml:"contact"`
@@ -196,6 +523,7 @@ const (
 func DefaultSettings() Settings {
 	metricsSettings := metrics.DefaultSettings()
 	reconSettings := recon.DefaultSettings()
+	reconSettings.Filters, _ = openpgp.ResolveFilters(nil)
 	return Settings{
 		Conflux: confluxConfig{
 			Recon: reconConfig{
@@ -203,17 +531,40 @@ func DefaultSettings() Settings {
 				LevelDB: levelDB{
 					Path: DefaultLevelDBPath,
 				},
+				SelfCheck: sks.DefaultSelfCheckSettings(),
 			},
 		},
 		HKP: HKPConfig{
-			Bind: DefaultHKPBind,
+			Bind:        DefaultHKPBind,
+			Compression: hkp.DefaultCompression(),
+			HTTP:        DefaultHTTPConfig(),
+			Limits:      hkp.DefaultLimits(),
+			Provenance:  hkp.DefaultProvenance(),
 		},
-		Metrics:   metricsSettings,
-		OpenPGP:   DefaultOpenPGP(),
-		LogLevel:  DefaultLogLevel,
-		Software:  "Hockeypuck",
-		Version:   "~unreleased",
-		SksCompat: false,
+		Metrics:     metricsSettings,
+		Abuse:       abuse.DefaultSettings(),
+		Tokens:      apitoken.DefaultSettings(),
+		Notify:      notify.DefaultSettings(),
+		AccessLog:   accesslog.DefaultSettings(),
+		Ingest:      ingest.DefaultSettings(),
+		Deprecation: deprecation.DefaultSettings(),
+		Replica:     replica.DefaultSettings(),
+		Tor:         tor.DefaultSettings(),
+		WKD:         wkd.DefaultSettings(),
+		Links:       links.DefaultSettings(),
+		Rollout:     rollout.DefaultSettings(),
+		Announce:    announce.DefaultSettings(),
+		KeyCache:    keycache.DefaultSettings(),
+		DigestCache: digestcache.DefaultSettings(),
+		Proofs:      proofs.DefaultSettings(),
+		Secrets:     secrets.DefaultSettings(),
+		OpenPGP:     DefaultOpenPGP(),
+		LogLevel:    DefaultLogLevel,
+		LogSink:     logsink.DefaultSettings(),
+		Tracing:     tracing.DefaultSettings(),
+		Software:    "Hockeypuck",
+		Version:     "~unreleased",
+		SksCompat:   false,
 	}
 }
 
@@ -232,5 +583,48 @@ func ParseSettings(data string) (*Settings, error) {
 		return nil, errors.WithStack(err)
 	}
 
+	doc.Hockeypuck.Conflux.Recon.Settings.Filters, err = openpgp.ResolveFilters(doc.Hockeypuck.Conflux.Recon.Settings.Filters)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	doc.Hockeypuck.Conflux.Recon.Settings.Filters = openpgp.DeclareMaxUserAttributeLength(
+		doc.Hockeypuck.Conflux.Recon.Settings.Filters, doc.Hockeypuck.OpenPGP.MaxUserAttributeLength)
+
+	err = jsonhkp.CheckRedaction(doc.Hockeypuck.HKP.Queries.Redact)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	err = doc.Hockeypuck.HKP.HTTP.validate()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	err = doc.Hockeypuck.Cluster.validate(doc.Hockeypuck.Replica)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	if doc.Hockeypuck.Rollout != nil {
+		err = doc.Hockeypuck.Rollout.Validate()
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+	}
+
+	if doc.Hockeypuck.Announce != nil {
+		err = doc.Hockeypuck.Announce.Validate()
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+	}
+
+	if doc.Hockeypuck.Links != nil {
+		err = doc.Hockeypuck.Links.Validate()
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+	}
+
 	return &doc.Hockeypuck, nil
 }
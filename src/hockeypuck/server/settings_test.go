@@ -0,0 +1,67 @@
+package server
+
+import (
+	"net/http"
+	"time"
+
+	gc "gopkg.in/check.v1"
+)
+
+type SettingsSuite struct{}
+
+var _ = gc.Suite(&SettingsSuite{})
+
+func (s *SettingsSuite) TestHTTPConfigValidate(c *gc.C) {
+	for _, t := range []struct {
+		desc   string
+		config func(*HTTPConfig)
+		err    string
+	}{
+		{"defaults", func(*HTTPConfig) {}, ""},
+		{"unlimited", func(h *HTTPConfig) { *h = HTTPConfig{} }, ""},
+		{"negative read header timeout", func(h *HTTPConfig) { h.ReadHeaderTimeoutSecs = -1 },
+			"invalid hkp.http.readHeaderTimeoutSecs -1"},
+		{"negative read timeout", func(h *HTTPConfig) { h.ReadTimeoutSecs = -1 },
+			"invalid hkp.http.readTimeoutSecs -1"},
+		{"negative write timeout", func(h *HTTPConfig) { h.WriteTimeoutSecs = -30 },
+			"invalid hkp.http.writeTimeoutSecs -30"},
+		{"negative idle timeout", func(h *HTTPConfig) { h.IdleTimeoutSecs = -1 },
+			"invalid hkp.http.idleTimeoutSecs -1"},
+		{"negative max header bytes", func(h *HTTPConfig) { h.MaxHeaderBytes = -1 },
+			"invalid hkp.http.maxHeaderBytes -1"},
+	} {
+		h := DefaultHTTPConfig()
+		t.config(&h)
+		err := h.validate()
+		if t.err == "" {
+			c.Check(err, gc.IsNil, gc.Commentf("%s", t.desc))
+		} else {
+			c.Check(err, gc.ErrorMatches, t.err, gc.Commentf("%s", t.desc))
+		}
+	}
+}
+
+func (s *SettingsSuite) TestHTTPConfigParse(c *gc.C) {
+	_, err := ParseSettings(`
+[hockeypuck.hkp.http]
+idleTimeoutSecs=-5
+`)
+	c.Assert(err, gc.ErrorMatches, "invalid hkp.http.idleTimeoutSecs -5")
+
+	settings, err := ParseSettings(`
+[hockeypuck.hkp.http]
+readTimeoutSecs=5
+writeTimeoutSecs=300
+maxHeaderBytes=4096
+`)
+	c.Assert(err, gc.IsNil)
+
+	// The limits reach the servers for HKP and HKPS, with the defaults for
+	// those not set.
+	srv := (&Server{settings: settings}).newHTTPServer(http.NotFoundHandler())
+	c.Assert(srv.ReadHeaderTimeout, gc.Equals, DefaultReadHeaderTimeoutSecs*time.Second)
+	c.Assert(srv.ReadTimeout, gc.Equals, 5*time.Second)
+	c.Assert(srv.WriteTimeout, gc.Equals, 300*time.Second)
+	c.Assert(srv.IdleTimeout, gc.Equals, DefaultIdleTimeoutSecs*time.Second)
+	c.Assert(srv.MaxHeaderBytes, gc.Equals, 4096)
+}
@@ -0,0 +1,240 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+
+	log "hockeypuck/logrus"
+)
+
+// Subsystems which may be stopped and started through the admin API.
+const (
+	subsystemRecon     = "recon"
+	subsystemReplica   = "replica"
+	subsystemNotify    = "notify"
+	subsystemSelfCheck = "selfcheck"
+)
+
+// subsystem is a part of the server which an operator may stop at runtime,
+// such as during an incident, without restarting the server.
+type subsystem struct {
+	name string
+
+	// maintenance is set if the subsystem is also paused for maintenance.
+	maintenance bool
+
+	pause, resume func()
+
+	// State, guarded by subsystems.mu.
+	paused  bool
+	stopped bool
+	reason  string
+	since   time.Time
+}
+
+// SubsystemStatus describes a subsystem in the admin API and the readiness
+// probe.
+type SubsystemStatus struct {
+	Name    string `json:"name"`
+	Running bool   `json:"running"`
+
+	// Stopped is set if an operator stopped the subsystem, for Reason,
+	// Since the time given.
+	Stopped bool       `json:"stopped"`
+	Reason  string     `json:"reason,omitempty"`
+	Since   *time.Time `json:"since,omitempty"`
+
+	// Maintenance is set if the subsystem is paused for maintenance.
+	Maintenance bool `json:"maintenance,omitempty"`
+}
+
+// subsystems tracks whether each subsystem is stopped by an operator or
+// paused for maintenance, pausing and resuming it as either changes.
+type subsystems struct {
+	// change serializes changes, which may wait for a subsystem to pause,
+	// while mu guards the state reported.
+	change sync.Mutex
+
+	mu          sync.Mutex
+	list        []*subsystem
+	maintenance bool
+}
+
+// add adds a running subsystem.
+func (ss *subsystems) add(name string, maintenance bool, pause, resume func()) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	ss.list = append(ss.list, &subsystem{
+		name:        name,
+		maintenance: maintenance,
+		pause:       pause,
+		resume:      resume,
+	})
+	serverMetrics.subsystemRunning.WithLabelValues(name).Set(1)
+}
+
+func (ss *subsystems) find(name string) *subsystem {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	for _, sub := range ss.list {
+		if sub.name == name {
+			return sub
+		}
+	}
+	return nil
+}
+
+// apply pauses or resumes sub to match its state. The caller must hold
+// ss.change.
+func (ss *subsystems) apply(sub *subsystem) {
+	ss.mu.Lock()
+	pause := sub.stopped || (ss.maintenance && sub.maintenance)
+	paused := sub.paused
+	ss.mu.Unlock()
+	if pause == paused {
+		return
+	}
+	if pause {
+		sub.pause()
+		serverMetrics.subsystemRunning.WithLabelValues(sub.name).Set(0)
+	} else {
+		sub.resume()
+		serverMetrics.subsystemRunning.WithLabelValues(sub.name).Set(1)
+	}
+	ss.mu.Lock()
+	sub.paused = pause
+	ss.mu.Unlock()
+}
+
+// stop stops the named subsystem until it is started. It returns false if
+// there is no such subsystem.
+func (ss *subsystems) stop(name, reason string) bool {
+	ss.change.Lock()
+	defer ss.change.Unlock()
+	sub := ss.find(name)
+	if sub == nil {
+		return false
+	}
+	ss.mu.Lock()
+	if !sub.stopped {
+		sub.stopped = true
+		sub.since = time.Now().UTC()
+	}
+	sub.reason = reason
+	ss.mu.Unlock()
+	ss.apply(sub)
+	log.WithFields(log.Fields{
+		"subsystem": name,
+		"reason":    reason,
+	}).Warning("subsystem stopped")
+	return true
+}
+
+// start starts the named subsystem after stop, unless it is paused for
+// maintenance. It returns false if there is no such subsystem.
+func (ss *subsystems) start(name string) bool {
+	ss.change.Lock()
+	defer ss.change.Unlock()
+	sub := ss.find(name)
+	if sub == nil {
+		return false
+	}
+	ss.mu.Lock()
+	sub.stopped = false
+	sub.reason = ""
+	sub.since = time.Time{}
+	ss.mu.Unlock()
+	ss.apply(sub)
+	log.WithFields(log.Fields{
+		"subsystem": name,
+	}).Info("subsystem started")
+	return true
+}
+
+// setMaintenance pauses or resumes the subsystems paused for maintenance.
+// Those stopped by an operator stay stopped.
+func (ss *subsystems) setMaintenance(maintenance bool) {
+	ss.change.Lock()
+	defer ss.change.Unlock()
+	ss.mu.Lock()
+	ss.maintenance = maintenance
+	list := ss.list
+	ss.mu.Unlock()
+	for _, sub := range list {
+		ss.apply(sub)
+	}
+}
+
+func (ss *subsystems) status() []SubsystemStatus {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	result := []SubsystemStatus{}
+	for _, sub := range ss.list {
+		st := SubsystemStatus{
+			Name:        sub.name,
+			Running:     !sub.paused,
+			Stopped:     sub.stopped,
+			Reason:      sub.reason,
+			Maintenance: ss.maintenance && sub.maintenance,
+		}
+		if sub.stopped {
+			since := sub.since
+			st.Since = &since
+		}
+		result = append(result, st)
+	}
+	return result
+}
+
+// registerSubsystems adds the subsystems which this server runs.
+func (s *Server) registerSubsystems() {
+	if s.sksPeer != nil {
+		s.subsystems.add(subsystemRecon, true, s.sksPeer.Pause, s.sksPeer.Resume)
+		if s.settings.Conflux.Recon.SelfCheck.Enabled() {
+			s.subsystems.add(subsystemSelfCheck, false, s.sksPeer.PauseSelfChecks, s.sksPeer.ResumeSelfChecks)
+		}
+	}
+	if s.follower != nil {
+		s.subsystems.add(subsystemReplica, true, s.follower.Pause, s.follower.Resume)
+	}
+	// A front end's change reports to the stateful server are delivered by
+	// its reporter rather than the notifier, so that stopping notifications
+	// does not hold them up or drop them.
+	if s.notifier.Enabled() {
+		s.subsystems.add(subsystemNotify, false, s.notifier.Pause, s.notifier.Resume)
+	}
+}
+
+// registerSubsystemsAdmin serves the subsystem endpoints of the admin API.
+// Stopping a subsystem takes a reason, which is logged and reported until
+// the subsystem is started again.
+func (s *Server) registerSubsystemsAdmin(r *httprouter.Router) {
+	r.GET("/subsystems", s.subsystemStatus)
+	r.POST("/subsystems/:name/stop", s.stopSubsystem)
+	r.POST("/subsystems/:name/start", s.startSubsystem)
+}
+
+func (s *Server) subsystemStatus(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.subsystems.status())
+}
+
+func (s *Server) stopSubsystem(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	if !s.subsystems.stop(ps.ByName("name"), r.FormValue("reason")) {
+		http.Error(w, "no such subsystem", http.StatusNotFound)
+		return
+	}
+	s.subsystemStatus(w, r, ps)
+}
+
+func (s *Server) startSubsystem(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	if !s.subsystems.start(ps.ByName("name")) {
+		http.Error(w, "no such subsystem", http.StatusNotFound)
+		return
+	}
+	s.subsystemStatus(w, r, ps)
+}
@@ -0,0 +1,72 @@
+package server
+
+import (
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	log "hockeypuck/logrus"
+	"hockeypuck/sdnotify"
+)
+
+// notifySystemd sends state to systemd, if the server was started by a unit with
+// Type=notify.
+func notifySystemd(state string) {
+	_, err := sdnotify.Notify(state)
+	if err != nil {
+		log.WithField("error", err).Warning("cannot notify systemd")
+	}
+}
+
+// startWatchdog pings the systemd watchdog while the server passes its
+// liveness checks, if the unit sets WatchdogSec. A wedged recon loop stops
+// the pings, so that systemd restarts the server. The database is not
+// checked, as restarting the server would not bring it back.
+func (s *Server) startWatchdog() error {
+	interval, ok, err := sdnotify.WatchdogInterval()
+	if err != nil {
+		return errors.WithStack(err)
+	} else if !ok {
+		return nil
+	}
+	s.t.Go(func() error {
+		s.watchdogLoop(interval / 2)
+		return nil
+	})
+	return nil
+}
+
+func (s *Server) watchdogLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	var failing bool
+	for {
+		resp := &probeResponse{Status: "ok", Version: s.settings.Version}
+		s.checkLive(resp)
+		if resp.Status == "ok" {
+			if failing {
+				log.Info("watchdog checks passed, resuming watchdog pings")
+				notifySystemd(sdnotify.Status("serving"))
+				failing = false
+			}
+			notifySystemd(sdnotify.Watchdog)
+		} else {
+			var failed []string
+			for _, check := range resp.Checks {
+				if !check.OK {
+					failed = append(failed, check.Name+": "+check.Error)
+				}
+			}
+			status := "watchdog checks failed: " + strings.Join(failed, "; ")
+			log.Error(status)
+			notifySystemd(sdnotify.Status(status))
+			failing = true
+		}
+		select {
+		case <-s.t.Dying():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,90 @@
+// Command keygen writes synthetic OpenPGP keys generated from a seed to
+// standard output, such as to load a development keyserver with:
+//
+//	keygen -raw -n 1000 -certs 100 >keys.pgp
+//	hockeypuck-load -config hockeypuck.conf keys.pgp
+package main
+
+import (
+	"bufio"
+	"flag"
+	"io"
+	"os"
+
+	"github.com/pkg/errors"
+	xopenpgp "golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+
+	log "hockeypuck/logrus"
+	"hockeypuck/testing/keygen"
+)
+
+var (
+	seed  = flag.Int64("seed", 1, "seed from which keys are generated")
+	start = flag.Int("start", 0, "index of the first key")
+	n     = flag.Int("n", 1, "number of keys")
+	raw   = flag.Bool("raw", false, "write binary packets instead of ASCII armor")
+
+	version  = flag.Int("version", 4, "key version, 4 or 3")
+	algo     = flag.String("algo", keygen.Ed25519, "key algorithm, ed25519 or rsa")
+	bits     = flag.Int("bits", keygen.DefaultRSABits, "RSA key size")
+	uids     = flag.Int("uids", 1, "user IDs per key")
+	subkeys  = flag.Int("subkeys", 0, "subkeys per key")
+	certs    = flag.Int("certs", 0, "third-party certifications per user ID")
+	lifetime = flag.Duration("lifetime", 0, "time after creation when keys expire")
+)
+
+func main() {
+	flag.Parse()
+	err := run()
+	if err != nil {
+		log.Fatalf("%+v", err)
+	}
+}
+
+func run() error {
+	g, err := keygen.New(*seed, &keygen.Spec{
+		Version:        *version,
+		Algorithm:      *algo,
+		RSABits:        *bits,
+		UserIDs:        *uids,
+		SubKeys:        *subkeys,
+		Certifications: *certs,
+		Lifetime:       *lifetime,
+	})
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	out := bufio.NewWriter(os.Stdout)
+	var w io.Writer = out
+	var armw io.WriteCloser
+	if !*raw {
+		armw, err = armor.Encode(out, xopenpgp.PublicKeyType, nil)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		w = armw
+	}
+	for i := *start; i < *start+*n; i++ {
+		buf, err := g.Packets(i)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		_, err = w.Write(buf)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	if armw != nil {
+		err = armw.Close()
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		_, err = out.WriteString("\n")
+		if err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	return errors.WithStack(out.Flush())
+}
@@ -0,0 +1,53 @@
+package keygen
+
+import (
+	"bytes"
+	"io"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/openpgp/packet"
+)
+
+// oidCurve25519 is the length-prefixed OID of Curve25519, as described in
+// RFC 4880bis, section 9.2.
+var oidCurve25519 = []byte{0x0a, 0x2b, 0x06, 0x01, 0x04, 0x01, 0x97, 0x55, 0x01, 0x05, 0x01}
+
+// kdfSHA256AES128 are the KDF parameters of an ECDH key using SHA-256 and
+// AES-128 key wrapping.
+var kdfSHA256AES128 = []byte{0x03, 0x01, 0x08, 0x07}
+
+// x25519SubKey returns a Curve25519 ECDH subkey read from r. x/crypto can
+// parse these, but only create them with KDF parameters from an internal
+// package, so the packet is encoded here and parsed back.
+func x25519SubKey(r io.Reader, created time.Time) (*packet.PublicKey, error) {
+	var priv, point [32]byte
+	_, err := io.ReadFull(r, priv[:])
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	curve25519.ScalarBaseMult(&point, &priv)
+
+	var body bytes.Buffer
+	body.WriteByte(4)
+	writeUint32(&body, uint32(created.Unix()))
+	body.WriteByte(algoECDH)
+	body.Write(oidCurve25519)
+	// The point is prefixed with 0x40, making a 263-bit MPI.
+	body.Write([]byte{0x01, 0x07, 0x40})
+	body.Write(point[:])
+	body.Write(kdfSHA256AES128)
+
+	var buf bytes.Buffer
+	writePacket(&buf, tagPublicSubkey, body.Bytes())
+	p, err := packet.Read(&buf)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	pub, ok := p.(*packet.PublicKey)
+	if !ok {
+		return nil, errors.Errorf("expected public key packet, got %T", p)
+	}
+	return pub, nil
+}
@@ -0,0 +1,353 @@
+// Package keygen generates synthetic OpenPGP public keys for benchmarks,
+// fuzzers and simulations, instead of the handful of armored fixtures in
+// testing/data.
+//
+// Keys are generated deterministically: a Generator with the same seed and
+// Spec always generates the same key at the same index, so that a failure
+// found with generated keys can be reproduced from the seed alone. Key
+// material is derived from the seed, the key index and the purpose of the
+// key with SHA-256, and signatures are deterministic for the supported
+// algorithms.
+//
+// The secret keys are discarded, and the key material is not fit for any
+// use other than testing.
+package keygen
+
+import (
+	"bytes"
+	"crypto"
+	"fmt"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ed25519"
+	xopenpgp "golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+	"golang.org/x/crypto/openpgp/packet"
+
+	"hockeypuck/openpgp"
+)
+
+// Algorithms supported by Spec.
+const (
+	Ed25519 = "ed25519"
+	RSA     = "rsa"
+)
+
+// DefaultRSABits is the RSA key size used if Spec.RSABits is not set.
+const DefaultRSABits = 2048
+
+// DefaultCreated is the creation time used if Spec.Created is not set.
+var DefaultCreated = time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// Spec describes the keys to generate.
+type Spec struct {
+	// Version is the key packet version, 4 or 3. Version 3 keys are RSA
+	// keys, and have neither subkeys nor certifications. Defaults to 4.
+	Version int
+
+	// Algorithm is Ed25519 or RSA. Defaults to Ed25519.
+	Algorithm string
+
+	// RSABits is the size of RSA keys. Defaults to DefaultRSABits.
+	RSABits int
+
+	// UserIDs is the number of self-signed user IDs. Defaults to 1.
+	UserIDs int
+
+	// SubKeys is the number of encryption subkeys. Ed25519 keys have
+	// Curve25519 ECDH subkeys; RSA keys have RSA subkeys.
+	SubKeys int
+
+	// Certifications is the number of third-party certifications of each
+	// user ID, such as to simulate certificate flooding. The certifying
+	// keys are Ed25519 keys shared by every key generated.
+	Certifications int
+
+	// Created is the creation time of keys and signatures. Defaults to
+	// DefaultCreated.
+	Created time.Time
+
+	// Lifetime, if set, is the time after creation when keys expire.
+	Lifetime time.Duration
+}
+
+// Generator generates keys from a seed.
+type Generator struct {
+	seed int64
+	spec Spec
+
+	certifiers []*packet.PrivateKey
+}
+
+// New returns a Generator of keys described by spec, seeded with seed.
+func New(seed int64, spec *Spec) (*Generator, error) {
+	g := &Generator{seed: seed}
+	if spec != nil {
+		g.spec = *spec
+	}
+	s := &g.spec
+	if s.Version == 0 {
+		s.Version = 4
+	}
+	if s.Algorithm == "" {
+		s.Algorithm = Ed25519
+	}
+	if s.RSABits == 0 {
+		s.RSABits = DefaultRSABits
+	}
+	if s.UserIDs == 0 {
+		s.UserIDs = 1
+	}
+	if s.Created.IsZero() {
+		s.Created = DefaultCreated
+	}
+	switch {
+	case s.Version != 3 && s.Version != 4:
+		return nil, errors.Errorf("unsupported key version %d", s.Version)
+	case s.Algorithm != Ed25519 && s.Algorithm != RSA:
+		return nil, errors.Errorf("unsupported key algorithm %q", s.Algorithm)
+	case s.Algorithm == RSA && (s.RSABits < 512 || s.RSABits%16 != 0):
+		return nil, errors.Errorf("invalid RSA key size %d", s.RSABits)
+	case s.UserIDs < 0 || s.SubKeys < 0 || s.Certifications < 0 || s.Lifetime < 0:
+		return nil, errors.New("negative key spec")
+	case s.Version == 3 && s.Algorithm != RSA:
+		return nil, errors.New("version 3 keys must be RSA keys")
+	case s.Version == 3 && (s.SubKeys > 0 || s.Certifications > 0):
+		return nil, errors.New("version 3 keys cannot have subkeys or certifications")
+	}
+
+	for i := 0; i < s.Certifications; i++ {
+		_, priv, err := ed25519.GenerateKey(g.stream("certifier", i))
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		g.certifiers = append(g.certifiers, packet.NewEdDSAPrivateKey(s.Created, priv))
+	}
+	return g, nil
+}
+
+// Spec returns the spec of the keys generated, with defaults filled in.
+func (g *Generator) Spec() Spec {
+	return g.spec
+}
+
+// Packets returns the packets of the i'th key.
+func (g *Generator) Packets(i int) ([]byte, error) {
+	if g.spec.Version == 3 {
+		return g.packetsV3(i)
+	}
+	return g.packetsV4(i)
+}
+
+// Armored returns the i'th key in ASCII armor, as submitted to /pks/add.
+func (g *Generator) Armored(i int) (string, error) {
+	buf, err := g.Packets(i)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	var out bytes.Buffer
+	w, err := armor.Encode(&out, xopenpgp.PublicKeyType, nil)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	_, err = w.Write(buf)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	err = w.Close()
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	return out.String(), nil
+}
+
+// Key returns the i'th key.
+func (g *Generator) Key(i int) (*openpgp.PrimaryKey, error) {
+	buf, err := g.Packets(i)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	keys, err := openpgp.NewKeyReader(bytes.NewReader(buf)).Read()
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot read generated key %d", i)
+	}
+	if len(keys) != 1 {
+		return nil, errors.Errorf("generated key %d read as %d keys", i, len(keys))
+	}
+	return keys[0], nil
+}
+
+// Keys returns the first n keys.
+func (g *Generator) Keys(n int) ([]*openpgp.PrimaryKey, error) {
+	var keys []*openpgp.PrimaryKey
+	for i := 0; i < n; i++ {
+		key, err := g.Key(i)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// MustKeys is like Keys but panics on error, for use in tests and
+// benchmarks.
+func (g *Generator) MustKeys(n int) []*openpgp.PrimaryKey {
+	keys, err := g.Keys(n)
+	if err != nil {
+		panic(err)
+	}
+	return keys
+}
+
+// UserID returns the j'th user ID of the i'th key.
+func UserID(i, j int) string {
+	name, email := userIDParts(i, j)
+	return fmt.Sprintf("%s <%s>", name, email)
+}
+
+// Email returns the email address in the j'th user ID of the i'th key.
+func Email(i, j int) string {
+	_, email := userIDParts(i, j)
+	return email
+}
+
+func userIDParts(i, j int) (name, email string) {
+	return fmt.Sprintf("Test Key %d User %d", i, j), fmt.Sprintf("key%d.user%d@example.com", i, j)
+}
+
+func (g *Generator) privateKey(purpose string, i int) (*packet.PrivateKey, error) {
+	r := g.stream(purpose, i)
+	switch g.spec.Algorithm {
+	case RSA:
+		priv, err := generateRSA(r, g.spec.RSABits)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		return packet.NewRSAPrivateKey(g.spec.Created, priv), nil
+	default:
+		_, priv, err := ed25519.GenerateKey(r)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		return packet.NewEdDSAPrivateKey(g.spec.Created, priv), nil
+	}
+}
+
+// subKey returns the public part of an encryption subkey. Signing subkeys
+// would need a back-signature, which x/crypto cannot serialize.
+func (g *Generator) subKey(purpose string, i int) (*packet.PublicKey, error) {
+	if g.spec.Algorithm == RSA {
+		priv, err := g.privateKey(purpose, i)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		pub := &priv.PublicKey
+		pub.IsSubkey = true
+		return pub, nil
+	}
+	return x25519SubKey(g.stream(purpose, i), g.spec.Created)
+}
+
+func (g *Generator) keyLifetime() *uint32 {
+	if g.spec.Lifetime == 0 {
+		return nil
+	}
+	secs := uint32(g.spec.Lifetime / time.Second)
+	return &secs
+}
+
+func (g *Generator) packetsV4(i int) ([]byte, error) {
+	primary, err := g.privateKey("primary", i)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	pub := &primary.PublicKey
+	var buf bytes.Buffer
+	err = pub.Serialize(&buf)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	for j := 0; j < g.spec.UserIDs; j++ {
+		name, email := userIDParts(i, j)
+		uid := packet.NewUserId(name, "", email)
+		if uid == nil {
+			return nil, errors.Errorf("invalid user ID %q", UserID(i, j))
+		}
+		err = uid.Serialize(&buf)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		isPrimary := j == 0
+		selfSig := &packet.Signature{
+			SigType:         packet.SigTypePositiveCert,
+			PubKeyAlgo:      pub.PubKeyAlgo,
+			Hash:            crypto.SHA256,
+			CreationTime:    g.spec.Created,
+			IssuerKeyId:     &pub.KeyId,
+			IsPrimaryId:     &isPrimary,
+			FlagsValid:      true,
+			FlagCertify:     true,
+			FlagSign:        true,
+			KeyLifetimeSecs: g.keyLifetime(),
+		}
+		err = signUserID(&buf, selfSig, uid.Id, pub, primary)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		for _, certifier := range g.certifiers {
+			cert := &packet.Signature{
+				SigType:      packet.SigTypeGenericCert,
+				PubKeyAlgo:   certifier.PubKeyAlgo,
+				Hash:         crypto.SHA256,
+				CreationTime: g.spec.Created,
+				IssuerKeyId:  &certifier.KeyId,
+			}
+			err = signUserID(&buf, cert, uid.Id, pub, certifier)
+			if err != nil {
+				return nil, errors.WithStack(err)
+			}
+		}
+	}
+
+	for j := 0; j < g.spec.SubKeys; j++ {
+		subPub, err := g.subKey(fmt.Sprintf("subkey-%d", j), i)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		err = subPub.Serialize(&buf)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		binding := &packet.Signature{
+			SigType:                   packet.SigTypeSubkeyBinding,
+			PubKeyAlgo:                pub.PubKeyAlgo,
+			Hash:                      crypto.SHA256,
+			CreationTime:              g.spec.Created,
+			IssuerKeyId:               &pub.KeyId,
+			FlagsValid:                true,
+			FlagEncryptCommunications: true,
+			FlagEncryptStorage:        true,
+			KeyLifetimeSecs:           g.keyLifetime(),
+		}
+		err = binding.SignKey(subPub, primary, nil)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		err = binding.Serialize(&buf)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+func signUserID(buf *bytes.Buffer, sig *packet.Signature, id string, pub *packet.PublicKey, priv *packet.PrivateKey) error {
+	err := sig.SignUserId(id, pub, priv, nil)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(sig.Serialize(buf))
+}
@@ -0,0 +1,148 @@
+package keygen
+
+import (
+	"bytes"
+	"strings"
+	stdtesting "testing"
+	"time"
+
+	"golang.org/x/crypto/openpgp/packet"
+	gc "gopkg.in/check.v1"
+
+	"hockeypuck/openpgp"
+)
+
+func Test(t *stdtesting.T) { gc.TestingT(t) }
+
+type KeygenSuite struct{}
+
+var _ = gc.Suite(&KeygenSuite{})
+
+// verified reads packets back, dropping any signature which fails to
+// verify.
+func verified(c *gc.C, g *Generator, i int) *openpgp.PrimaryKey {
+	buf, err := g.Packets(i)
+	c.Assert(err, gc.IsNil)
+	keys, err := openpgp.NewKeyReader(bytes.NewReader(buf), openpgp.VerifySelfSigs()).Read()
+	c.Assert(err, gc.IsNil)
+	c.Assert(keys, gc.HasLen, 1)
+	return keys[0]
+}
+
+func keyVersion(c *gc.C, key *openpgp.PrimaryKey) int {
+	p, err := packet.Read(bytes.NewReader(key.Packet.Packet))
+	c.Assert(err, gc.IsNil)
+	switch p.(type) {
+	case *packet.PublicKey:
+		return 4
+	case *packet.PublicKeyV3:
+		return 3
+	}
+	c.Fatalf("unexpected key packet %T", p)
+	return 0
+}
+
+func (s *KeygenSuite) TestDeterministic(c *gc.C) {
+	for _, spec := range []*Spec{
+		{},
+		{Algorithm: RSA, RSABits: 1024, SubKeys: 1},
+		{Version: 3, RSABits: 1024, Algorithm: RSA},
+	} {
+		g1, err := New(42, spec)
+		c.Assert(err, gc.IsNil)
+		g2, err := New(42, spec)
+		c.Assert(err, gc.IsNil)
+		g3, err := New(43, spec)
+		c.Assert(err, gc.IsNil)
+
+		keys := g1.MustKeys(2)
+		c.Assert(keys[0].MD5, gc.Not(gc.Equals), keys[1].MD5)
+		again, err := g2.Key(1)
+		c.Assert(err, gc.IsNil)
+		c.Assert(again.MD5, gc.Equals, keys[1].MD5)
+		other, err := g3.Key(1)
+		c.Assert(err, gc.IsNil)
+		c.Assert(other.MD5, gc.Not(gc.Equals), keys[1].MD5)
+	}
+}
+
+func (s *KeygenSuite) TestArmored(c *gc.C) {
+	g, err := New(1, &Spec{SubKeys: 1})
+	c.Assert(err, gc.IsNil)
+	armored, err := g.Armored(3)
+	c.Assert(err, gc.IsNil)
+	keys := openpgp.MustReadArmorKeys(strings.NewReader(armored))
+	c.Assert(keys, gc.HasLen, 1)
+	key, err := g.Key(3)
+	c.Assert(err, gc.IsNil)
+	c.Assert(keys[0].MD5, gc.Equals, key.MD5)
+}
+
+func (s *KeygenSuite) TestV4(c *gc.C) {
+	g, err := New(1, &Spec{UserIDs: 3, SubKeys: 2, Certifications: 5, Lifetime: 365 * 24 * time.Hour})
+	c.Assert(err, gc.IsNil)
+	key := verified(c, g, 7)
+	c.Assert(keyVersion(c, key), gc.Equals, 4)
+	c.Assert(key.UserIDs, gc.HasLen, 3)
+	for j, uid := range key.UserIDs {
+		c.Assert(uid.Keywords, gc.Equals, UserID(7, j))
+		c.Assert(uid.Signatures, gc.HasLen, 6)
+	}
+	c.Assert(key.SubKeys, gc.HasLen, 2)
+	for _, sub := range key.SubKeys {
+		c.Assert(sub.Signatures, gc.HasLen, 1)
+	}
+	expires, ok := key.ExpiresAt()
+	c.Assert(ok, gc.Equals, true)
+	c.Assert(expires.Equal(DefaultCreated.Add(365*24*time.Hour)), gc.Equals, true)
+}
+
+func (s *KeygenSuite) TestRSA(c *gc.C) {
+	g, err := New(1, &Spec{Algorithm: RSA, RSABits: 1024, SubKeys: 1})
+	c.Assert(err, gc.IsNil)
+	key := verified(c, g, 0)
+	c.Assert(key.BitLen, gc.Equals, 1024)
+	c.Assert(key.UserIDs, gc.HasLen, 1)
+	c.Assert(key.SubKeys, gc.HasLen, 1)
+	c.Assert(key.SubKeys[0].BitLen, gc.Equals, 1024)
+}
+
+func (s *KeygenSuite) TestV3(c *gc.C) {
+	g, err := New(1, &Spec{Version: 3, Algorithm: RSA, RSABits: 1024, UserIDs: 2})
+	c.Assert(err, gc.IsNil)
+	// Version 3 key IDs are not a suffix of the fingerprint, so
+	// VerifySelfSigs takes their self-signatures for third-party
+	// certifications. Verify them here instead.
+	key, err := g.Key(0)
+	c.Assert(err, gc.IsNil)
+	c.Assert(keyVersion(c, key), gc.Equals, 3)
+	c.Assert(key.BitLen, gc.Equals, 1024)
+	c.Assert(key.UserIDs, gc.HasLen, 2)
+	pk, err := packet.Read(bytes.NewReader(key.Packet.Packet))
+	c.Assert(err, gc.IsNil)
+	pkV3 := pk.(*packet.PublicKeyV3)
+	for _, uid := range key.UserIDs {
+		c.Assert(uid.Signatures, gc.HasLen, 1)
+		c.Assert(uid.Signatures[0].RIssuerKeyID, gc.Equals, key.RKeyID)
+		p, err := packet.Read(bytes.NewReader(uid.Signatures[0].Packet.Packet))
+		c.Assert(err, gc.IsNil)
+		c.Assert(pkV3.VerifyUserIdSignatureV3(uid.Keywords, pkV3, p.(*packet.SignatureV3)), gc.IsNil)
+	}
+}
+
+func (s *KeygenSuite) TestInvalid(c *gc.C) {
+	for _, t := range []struct {
+		spec Spec
+		err  string
+	}{
+		{Spec{Version: 5}, "unsupported key version 5"},
+		{Spec{Algorithm: "dsa"}, `unsupported key algorithm "dsa"`},
+		{Spec{Algorithm: RSA, RSABits: 1000}, "invalid RSA key size 1000"},
+		{Spec{SubKeys: -1}, "negative key spec"},
+		{Spec{Version: 3}, "version 3 keys must be RSA keys"},
+		{Spec{Version: 3, Algorithm: RSA, Certifications: 1}, "version 3 keys cannot have subkeys or certifications"},
+	} {
+		_, err := New(0, &t.spec)
+		c.Check(err, gc.ErrorMatches, t.err)
+	}
+}
@@ -0,0 +1,117 @@
+package keygen
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+	"math/big"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/rsa"
+)
+
+// stream returns the deterministic byte stream from which the key material
+// for a purpose is read. It is SHA-256 in counter mode over the seed, the
+// purpose and the index.
+func (g *Generator) stream(purpose string, i int) io.Reader {
+	h := sha256.New()
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], uint64(g.seed))
+	h.Write(buf[:])
+	h.Write([]byte(purpose))
+	binary.BigEndian.PutUint64(buf[:], uint64(i))
+	h.Write(buf[:])
+	return &counterStream{key: h.Sum(nil)}
+}
+
+type counterStream struct {
+	key     []byte
+	counter uint64
+	block   []byte
+}
+
+func (s *counterStream) Read(p []byte) (int, error) {
+	n := 0
+	for n < len(p) {
+		if len(s.block) == 0 {
+			h := sha256.New()
+			h.Write(s.key)
+			var buf [8]byte
+			binary.BigEndian.PutUint64(buf[:], s.counter)
+			h.Write(buf[:])
+			s.block = h.Sum(nil)
+			s.counter++
+		}
+		m := copy(p[n:], s.block)
+		s.block = s.block[m:]
+		n += m
+	}
+	return n, nil
+}
+
+var bigOne = big.NewInt(1)
+
+// generateRSA generates an RSA key from r. Unlike rsa.GenerateKey, which
+// deliberately varies how much it reads, the key depends only on the
+// bytes read from r.
+func generateRSA(r io.Reader, bits int) (*rsa.PrivateKey, error) {
+	const e = 65537
+	bigE := big.NewInt(e)
+	for {
+		p, err := generatePrime(r, bits/2, bigE)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		q, err := generatePrime(r, bits-bits/2, bigE)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		if p.Cmp(q) == 0 {
+			continue
+		}
+		n := new(big.Int).Mul(p, q)
+		if n.BitLen() != bits {
+			continue
+		}
+		pminus1 := new(big.Int).Sub(p, bigOne)
+		qminus1 := new(big.Int).Sub(q, bigOne)
+		totient := new(big.Int).Mul(pminus1, qminus1)
+		d := new(big.Int).ModInverse(bigE, totient)
+		if d == nil {
+			continue
+		}
+		priv := &rsa.PrivateKey{
+			PublicKey: rsa.PublicKey{N: n, E: e},
+			D:         d,
+			Primes:    []*big.Int{p, q},
+		}
+		priv.Precompute()
+		return priv, nil
+	}
+}
+
+// generatePrime returns the first prime from a random odd number of the
+// given size with its top two bits set, such that e is coprime with p-1.
+func generatePrime(r io.Reader, bits int, e *big.Int) (*big.Int, error) {
+	buf := make([]byte, (bits+7)/8)
+	_, err := io.ReadFull(r, buf)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	p := new(big.Int).SetBytes(buf)
+	p.Rsh(p, uint(len(buf)*8-bits))
+	p.SetBit(p, bits-1, 1)
+	p.SetBit(p, bits-2, 1)
+	p.SetBit(p, 0, 1)
+	two := big.NewInt(2)
+	gcd, pminus1 := new(big.Int), new(big.Int)
+	for ; p.BitLen() == bits; p.Add(p, two) {
+		if !p.ProbablyPrime(20) {
+			continue
+		}
+		if gcd.GCD(nil, nil, e, pminus1.Sub(p, bigOne)).Cmp(bigOne) == 0 {
+			return p, nil
+		}
+	}
+	return nil, errors.Errorf("no %d-bit prime found", bits)
+}
@@ -0,0 +1,110 @@
+package keygen
+
+import (
+	"bytes"
+	"crypto"
+	_ "crypto/md5"
+	"encoding/binary"
+	"io"
+	"math/big"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/openpgp/packet"
+	"golang.org/x/crypto/rsa"
+)
+
+// Packet tags and algorithm IDs written by the encoders of packets which
+// x/crypto cannot create.
+const (
+	tagSignature    = 2
+	tagPublicKey    = 6
+	tagUserID       = 13
+	tagPublicSubkey = 14
+
+	algoRSA  = 1
+	algoECDH = 18
+	hashMD5  = 1
+)
+
+// packetsV3 returns the packets of the i'th key as a version 3 RSA key
+// with self-signed user IDs, as created by PGP 2.
+func (g *Generator) packetsV3(i int) ([]byte, error) {
+	priv, err := generateRSA(g.stream("primary", i), g.spec.RSABits)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	var body bytes.Buffer
+	body.WriteByte(3)
+	writeUint32(&body, uint32(g.spec.Created.Unix()))
+	day := 24 * time.Hour
+	days := (g.spec.Lifetime + day - 1) / day
+	body.Write([]byte{byte(days >> 8), byte(days), algoRSA})
+	writeMPI(&body, priv.N)
+	writeMPI(&body, big.NewInt(int64(priv.E)))
+	keyBody := body.Bytes()
+
+	var buf bytes.Buffer
+	writePacket(&buf, tagPublicKey, keyBody)
+	nBytes := priv.N.Bytes()
+	keyID := binary.BigEndian.Uint64(nBytes[len(nBytes)-8:])
+	for j := 0; j < g.spec.UserIDs; j++ {
+		id := UserID(i, j)
+		writePacket(&buf, tagUserID, []byte(id))
+		sig, err := signUserIDV3(priv, keyID, keyBody, id, g.spec.Created.Unix())
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		writePacket(&buf, tagSignature, sig)
+	}
+	return buf.Bytes(), nil
+}
+
+// signUserIDV3 returns the body of a version 3 certification of id, as
+// described in RFC 4880, section 5.2.2.
+func signUserIDV3(priv *rsa.PrivateKey, keyID uint64, keyBody []byte, id string, created int64) ([]byte, error) {
+	h := crypto.MD5.New()
+	// x/crypto hashes the length of a version 3 key as if its header were
+	// the six octets of a version 4 key, so the length is short by two to
+	// match the verifier.
+	n := len(keyBody) - 2
+	h.Write([]byte{0x99, byte(n >> 8), byte(n)})
+	h.Write(keyBody)
+	h.Write([]byte(id))
+	h.Write([]byte{byte(packet.SigTypeGenericCert)})
+	writeUint32(h, uint32(created))
+	digest := h.Sum(nil)
+	sig, err := rsa.SignPKCS1v15(nil, priv, crypto.MD5, digest)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	var body bytes.Buffer
+	body.Write([]byte{3, 5, byte(packet.SigTypeGenericCert)})
+	writeUint32(&body, uint32(created))
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], keyID)
+	body.Write(buf[:])
+	body.Write([]byte{algoRSA, hashMD5, digest[0], digest[1]})
+	writeMPI(&body, new(big.Int).SetBytes(sig))
+	return body.Bytes(), nil
+}
+
+func writeUint32(w io.Writer, v uint32) {
+	var buf [4]byte
+	binary.BigEndian.PutUint32(buf[:], v)
+	w.Write(buf[:])
+}
+
+func writeMPI(w *bytes.Buffer, v *big.Int) {
+	bits := v.BitLen()
+	w.Write([]byte{byte(bits >> 8), byte(bits)})
+	w.Write(v.Bytes())
+}
+
+// writePacket writes an old format packet with a two octet length, as PGP 2
+// did.
+func writePacket(w *bytes.Buffer, tag byte, body []byte) {
+	w.Write([]byte{0x80 | tag<<2 | 1, byte(len(body) >> 8), byte(len(body))})
+	w.Write(body)
+}
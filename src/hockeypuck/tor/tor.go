@@ -0,0 +1,257 @@
+// Package tor publishes services as Tor v3 onion services through the Tor
+// control port.
+//
+// An onion service added by a Controller lasts as long as the control
+// connection, so it is withdrawn when the keyserver exits.
+package tor
+
+import (
+	"encoding/hex"
+	"io/ioutil"
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	DefaultVirtualPort = 11371
+
+	dialTimeout = 10 * time.Second
+)
+
+type Settings struct {
+	// ControlAddr is the address of the Tor control port, such as
+	// 127.0.0.1:9051. If empty, no onion service is published by
+	// hockeypuck.
+	ControlAddr string `toml:"controlAddr"`
+
+	// ControlPassword authenticates to the control port, if Tor is
+	// configured with HashedControlPassword. Otherwise cookie or null
+	// authentication is used, as offered by Tor.
+	ControlPassword string `toml:"controlPassword"`
+
+	// KeyFile holds the private key of the onion service, so that its
+	// address persists across restarts. It is created if it does not exist.
+	// If empty, a new address is used each time.
+	KeyFile string `toml:"keyFile"`
+
+	// VirtualPort is the port on which the onion service is reached.
+	VirtualPort int `toml:"virtualPort"`
+
+	// Onion is the address of an onion service configured outside of
+	// hockeypuck, such as with HiddenServiceDir in torrc, for use in stats.
+	// It is ignored if ControlAddr is set.
+	Onion string `toml:"onion"`
+}
+
+func DefaultSettings() *Settings {
+	return &Settings{
+		VirtualPort: DefaultVirtualPort,
+	}
+}
+
+// Onion describes a published onion service.
+type Onion struct {
+	// ServiceID is the onion address without the .onion suffix.
+	ServiceID string
+
+	// PrivateKey is the service key, in the form KEYTYPE:BLOB accepted by
+	// AddOnion.
+	PrivateKey string
+}
+
+// Hostname returns the onion address of the service.
+func (o *Onion) Hostname() string {
+	return o.ServiceID + ".onion"
+}
+
+// Controller is a connection to the Tor control port.
+type Controller struct {
+	conn *textproto.Conn
+}
+
+// Dial connects to the Tor control port at addr.
+func Dial(addr string) (*Controller, error) {
+	conn, err := net.DialTimeout("tcp", addr, dialTimeout)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return &Controller{conn: textproto.NewConn(conn)}, nil
+}
+
+// Close closes the control connection, withdrawing any onion services it
+// added.
+func (c *Controller) Close() error {
+	return errors.WithStack(c.conn.Close())
+}
+
+// command sends a command and returns the lines of a successful reply.
+func (c *Controller) command(format string, args ...interface{}) ([]string, error) {
+	id, err := c.conn.Cmd(format, args...)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	c.conn.StartResponse(id)
+	defer c.conn.EndResponse(id)
+	_, msg, err := c.conn.ReadResponse(250)
+	if err != nil {
+		return nil, errors.Wrapf(err, "tor control %q failed", strings.Fields(format)[0])
+	}
+	return strings.Split(msg, "\n"), nil
+}
+
+// Authenticate authenticates the connection with password if given,
+// otherwise with the authentication cookie or no credentials, whichever Tor
+// offers.
+func (c *Controller) Authenticate(password string) error {
+	if password != "" {
+		_, err := c.command("AUTHENTICATE %s", quote(password))
+		return errors.WithStack(err)
+	}
+
+	lines, err := c.command("PROTOCOLINFO 1")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	methods := map[string]bool{}
+	var cookieFile string
+	for _, line := range lines {
+		if !strings.HasPrefix(line, "AUTH ") {
+			continue
+		}
+		for _, field := range splitQuoted(strings.TrimPrefix(line, "AUTH ")) {
+			kv := strings.SplitN(field, "=", 2)
+			if len(kv) != 2 {
+				continue
+			}
+			switch kv[0] {
+			case "METHODS":
+				for _, m := range strings.Split(kv[1], ",") {
+					methods[m] = true
+				}
+			case "COOKIEFILE":
+				cookieFile, err = unquote(kv[1])
+				if err != nil {
+					return errors.WithStack(err)
+				}
+			}
+		}
+	}
+
+	switch {
+	case methods["NULL"]:
+		_, err = c.command("AUTHENTICATE")
+	case methods["COOKIE"] && cookieFile != "":
+		var cookie []byte
+		cookie, err = ioutil.ReadFile(cookieFile)
+		if err != nil {
+			return errors.Wrap(err, "cannot read tor control cookie")
+		}
+		_, err = c.command("AUTHENTICATE %s", hex.EncodeToString(cookie))
+	default:
+		return errors.New("tor control port requires a password")
+	}
+	return errors.WithStack(err)
+}
+
+// AddOnion publishes an onion service which forwards virtualPort to target,
+// a host:port address or a unix:/path socket. If key is empty, a new service
+// key is created and returned in the result.
+func (c *Controller) AddOnion(key string, virtualPort int, target string) (*Onion, error) {
+	if key == "" {
+		key = "NEW:ED25519-V3"
+	}
+	lines, err := c.command("ADD_ONION %s Port=%d,%s", key, virtualPort, target)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	onion := &Onion{}
+	if !strings.HasPrefix(key, "NEW:") {
+		onion.PrivateKey = key
+	}
+	for _, line := range lines {
+		kv := strings.SplitN(line, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		switch kv[0] {
+		case "ServiceID":
+			onion.ServiceID = kv[1]
+		case "PrivateKey":
+			onion.PrivateKey = kv[1]
+		}
+	}
+	if onion.ServiceID == "" {
+		return nil, errors.New("tor did not return an onion service ID")
+	}
+	return onion, nil
+}
+
+// DelOnion withdraws an onion service added on this connection.
+func (c *Controller) DelOnion(serviceID string) error {
+	_, err := c.command("DEL_ONION %s", serviceID)
+	return errors.WithStack(err)
+}
+
+// quote returns s as a control protocol quoted string.
+func quote(s string) string {
+	return strconv.Quote(s)
+}
+
+// unquote parses a control protocol quoted string.
+func unquote(s string) (string, error) {
+	result, err := strconv.Unquote(s)
+	if err != nil {
+		return "", errors.Errorf("invalid quoted string %s", s)
+	}
+	return result, nil
+}
+
+// splitQuoted splits s on spaces which are not within a quoted string.
+func splitQuoted(s string) []string {
+	var fields []string
+	var field strings.Builder
+	var quoted, escaped bool
+	for _, r := range s {
+		switch {
+		case escaped:
+			escaped = false
+		case r == '\\' && quoted:
+			escaped = true
+		case r == '"':
+			quoted = !quoted
+		case r == ' ' && !quoted:
+			if field.Len() > 0 {
+				fields = append(fields, field.String())
+				field.Reset()
+			}
+			continue
+		}
+		field.WriteRune(r)
+	}
+	if field.Len() > 0 {
+		fields = append(fields, field.String())
+	}
+	return fields
+}
+
+// Target returns the address Tor should forward to for a listener bound to
+// bind. Unspecified hosts are replaced with the loopback address.
+func Target(bind string) (string, error) {
+	if strings.HasPrefix(bind, "unix:") {
+		return bind, nil
+	}
+	host, port, err := net.SplitHostPort(bind)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	ip := net.ParseIP(host)
+	if host == "" || (ip != nil && ip.IsUnspecified()) {
+		host = "127.0.0.1"
+	}
+	return net.JoinHostPort(host, port), nil
+}
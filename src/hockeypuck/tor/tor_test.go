@@ -0,0 +1,124 @@
+package tor
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strings"
+	stdtesting "testing"
+
+	gc "gopkg.in/check.v1"
+)
+
+func Test(t *stdtesting.T) { gc.TestingT(t) }
+
+type TorSuite struct{}
+
+var _ = gc.Suite(&TorSuite{})
+
+// fakeControl serves a single control connection, answering each command
+// with the reply returned by handle and sending the commands received on
+// cmds.
+func fakeControl(c *gc.C, handle func(cmd string) string) (string, <-chan string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, gc.IsNil)
+	cmds := make(chan string, 10)
+	go func() {
+		defer l.Close()
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		defer close(cmds)
+		rd := bufio.NewReader(conn)
+		for {
+			line, err := rd.ReadString('\n')
+			if err != nil {
+				return
+			}
+			cmd := strings.TrimRight(line, "\r\n")
+			cmds <- cmd
+			fmt.Fprint(conn, handle(cmd))
+		}
+	}()
+	return l.Addr().String(), cmds
+}
+
+func (s *TorSuite) TestAddOnion(c *gc.C) {
+	addr, cmds := fakeControl(c, func(cmd string) string {
+		switch {
+		case strings.HasPrefix(cmd, "AUTHENTICATE"):
+			return "250 OK\r\n"
+		case strings.HasPrefix(cmd, "ADD_ONION"):
+			return "250-ServiceID=abcdefghij\r\n250-PrivateKey=ED25519-V3:c2VjcmV0\r\n250 OK\r\n"
+		}
+		return "510 Unrecognized command\r\n"
+	})
+	ctl, err := Dial(addr)
+	c.Assert(err, gc.IsNil)
+	defer ctl.Close()
+
+	c.Assert(ctl.Authenticate(`pass"word`), gc.IsNil)
+	c.Assert(<-cmds, gc.Equals, `AUTHENTICATE "pass\"word"`)
+
+	onion, err := ctl.AddOnion("", 11371, "unix:/run/hkp.sock")
+	c.Assert(err, gc.IsNil)
+	c.Assert(<-cmds, gc.Equals, "ADD_ONION NEW:ED25519-V3 Port=11371,unix:/run/hkp.sock")
+	c.Assert(onion.ServiceID, gc.Equals, "abcdefghij")
+	c.Assert(onion.Hostname(), gc.Equals, "abcdefghij.onion")
+	c.Assert(onion.PrivateKey, gc.Equals, "ED25519-V3:c2VjcmV0")
+
+	err = ctl.DelOnion(onion.ServiceID)
+	c.Assert(err, gc.ErrorMatches, `.*510 "Unrecognized command"`)
+}
+
+func (s *TorSuite) TestCookieAuth(c *gc.C) {
+	cookieFile := filepath.Join(c.MkDir(), "control_auth_cookie")
+	c.Assert(ioutil.WriteFile(cookieFile, []byte{0xde, 0xad, 0xbe, 0xef}, 0600), gc.IsNil)
+
+	addr, cmds := fakeControl(c, func(cmd string) string {
+		switch {
+		case cmd == "PROTOCOLINFO 1":
+			return "250-PROTOCOLINFO 1\r\n" +
+				"250-AUTH METHODS=COOKIE,SAFECOOKIE COOKIEFILE=\"" + cookieFile + "\"\r\n" +
+				"250-VERSION Tor=\"0.4.8.9\"\r\n250 OK\r\n"
+		case cmd == "AUTHENTICATE deadbeef":
+			return "250 OK\r\n"
+		}
+		return "515 Authentication failed\r\n"
+	})
+	ctl, err := Dial(addr)
+	c.Assert(err, gc.IsNil)
+	defer ctl.Close()
+
+	c.Assert(ctl.Authenticate(""), gc.IsNil)
+	c.Assert(<-cmds, gc.Equals, "PROTOCOLINFO 1")
+	c.Assert(<-cmds, gc.Equals, "AUTHENTICATE deadbeef")
+}
+
+func (s *TorSuite) TestPasswordRequired(c *gc.C) {
+	addr, _ := fakeControl(c, func(cmd string) string {
+		return "250-PROTOCOLINFO 1\r\n250-AUTH METHODS=HASHEDPASSWORD\r\n250 OK\r\n"
+	})
+	ctl, err := Dial(addr)
+	c.Assert(err, gc.IsNil)
+	defer ctl.Close()
+	c.Assert(ctl.Authenticate(""), gc.ErrorMatches, ".*requires a password")
+}
+
+func (s *TorSuite) TestTarget(c *gc.C) {
+	for bind, target := range map[string]string{
+		":11371":             "127.0.0.1:11371",
+		"0.0.0.0:11371":      "127.0.0.1:11371",
+		"[::]:11371":         "127.0.0.1:11371",
+		"10.0.0.1:11371":     "10.0.0.1:11371",
+		"unix:/run/hkp.sock": "unix:/run/hkp.sock",
+	} {
+		result, err := Target(bind)
+		c.Assert(err, gc.IsNil)
+		c.Assert(result, gc.Equals, target, gc.Commentf("%s", bind))
+	}
+}
@@ -0,0 +1,400 @@
+package tracing
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	mrand "math/rand"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"gopkg.in/tomb.v2"
+
+	log "hockeypuck/logrus"
+)
+
+const (
+	DefaultServiceName       = "hockeypuck"
+	DefaultSampleRatio       = 1.0
+	DefaultBatchSize         = 512
+	DefaultQueueSize         = 4096
+	DefaultFlushIntervalSecs = 5
+	DefaultExportTimeoutSecs = 10
+
+	// tracesPath is where an OTLP/HTTP collector receives spans.
+	tracesPath = "/v1/traces"
+)
+
+// Settings configures the export of spans to an OpenTelemetry collector, by
+// OTLP over HTTP with JSON encoding.
+type Settings struct {
+	// Endpoint is the base URL of the collector, such as
+	// http://localhost:4318. Spans are only logged if it is empty.
+	Endpoint string `toml:"endpoint"`
+
+	// Headers are sent with each export, such as for authentication.
+	Headers map[string]string `toml:"headers"`
+
+	// ServiceName identifies the server's spans in the collector.
+	ServiceName string `toml:"serviceName"`
+
+	// SampleRatio is the fraction of new traces which are exported, from 0
+	// to 1. Traces continued from a trusted caller are exported if the
+	// caller sampled them.
+	SampleRatio float64 `toml:"sampleRatio"`
+
+	// TrustedCIDRs lists the networks, such as those of proxies in front of
+	// the server, whose sampling of the traces they pass on is honoured.
+	// Traces continued from other callers are sampled at SampleRatio, so
+	// that clients cannot have every request they make exported.
+	TrustedCIDRs []string `toml:"trustedCIDRs"`
+
+	// BatchSize is the most spans sent in one export.
+	BatchSize int `toml:"batchSize"`
+
+	// QueueSize is the most spans held for export. Spans ended while the
+	// queue is full are dropped.
+	QueueSize int `toml:"queueSize"`
+
+	// FlushIntervalSecs is how often queued spans are exported, if a full
+	// batch has not been queued sooner.
+	FlushIntervalSecs int `toml:"flushIntervalSecs"`
+
+	// ExportTimeoutSecs limits how long an export may take.
+	ExportTimeoutSecs int `toml:"exportTimeoutSecs"`
+}
+
+func DefaultSettings() *Settings {
+	return &Settings{
+		ServiceName:       DefaultServiceName,
+		SampleRatio:       DefaultSampleRatio,
+		BatchSize:         DefaultBatchSize,
+		QueueSize:         DefaultQueueSize,
+		FlushIntervalSecs: DefaultFlushIntervalSecs,
+		ExportTimeoutSecs: DefaultExportTimeoutSecs,
+	}
+}
+
+// Enabled returns whether spans are exported.
+func (s *Settings) Enabled() bool {
+	return s != nil && s.Endpoint != ""
+}
+
+// Exporter sends ended spans to a collector in batches.
+type Exporter struct {
+	settings Settings
+	url      string
+	client   *http.Client
+	resource []attribute
+	trusted  []*net.IPNet
+
+	mu      sync.Mutex
+	queue   []*Span
+	dropped int
+	full    chan struct{}
+
+	t tomb.Tomb
+}
+
+var current struct {
+	sync.RWMutex
+	exporter *Exporter
+}
+
+// Start exports spans ended from now on as configured by settings, until
+// the exporter is stopped.
+func Start(settings *Settings) (*Exporter, error) {
+	if !settings.Enabled() {
+		return nil, errors.New("no OTLP endpoint configured")
+	}
+	s := *settings
+	if s.SampleRatio < 0 || s.SampleRatio > 1 {
+		return nil, errors.Errorf("invalid sample ratio %v", s.SampleRatio)
+	}
+	if s.BatchSize <= 0 || s.QueueSize <= 0 || s.FlushIntervalSecs <= 0 || s.ExportTimeoutSecs <= 0 {
+		return nil, errors.New("invalid OTLP batch settings")
+	}
+	if s.ServiceName == "" {
+		s.ServiceName = DefaultServiceName
+	}
+	if !strings.HasPrefix(s.Endpoint, "http://") && !strings.HasPrefix(s.Endpoint, "https://") {
+		return nil, errors.Errorf("invalid OTLP endpoint %q", s.Endpoint)
+	}
+	var trusted []*net.IPNet
+	for _, cidr := range s.TrustedCIDRs {
+		_, ipnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid trusted CIDR %q", cidr)
+		}
+		trusted = append(trusted, ipnet)
+	}
+	e := &Exporter{
+		settings: s,
+		trusted:  trusted,
+		url:      strings.TrimSuffix(s.Endpoint, "/") + tracesPath,
+		client:   &http.Client{Timeout: time.Duration(s.ExportTimeoutSecs) * time.Second},
+		resource: []attribute{{"service.name", s.ServiceName}},
+		full:     make(chan struct{}, 1),
+	}
+	if hostname, err := os.Hostname(); err == nil {
+		e.resource = append(e.resource, attribute{"host.name", hostname})
+	}
+	e.t.Go(e.run)
+
+	current.Lock()
+	current.exporter = e
+	current.Unlock()
+	return e, nil
+}
+
+// Stop exports the spans still queued, and stops exporting spans.
+func (e *Exporter) Stop() {
+	current.Lock()
+	if current.exporter == e {
+		current.exporter = nil
+	}
+	current.Unlock()
+	e.t.Kill(nil)
+	e.t.Wait()
+}
+
+// sampleRoot returns whether a new trace is sampled.
+func sampleRoot() bool {
+	current.RLock()
+	e := current.exporter
+	current.RUnlock()
+	if e == nil || e.settings.SampleRatio >= 1 {
+		return true
+	}
+	return mrand.Float64() < e.settings.SampleRatio
+}
+
+// sampleParent returns whether a trace continued from a request made from
+// remoteAddr is sampled, given whether the caller sampled it.
+func sampleParent(remoteAddr string, sampled bool) bool {
+	current.RLock()
+	e := current.exporter
+	current.RUnlock()
+	if e == nil {
+		return sampled
+	}
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		for _, ipnet := range e.trusted {
+			if ipnet.Contains(ip) {
+				return sampled
+			}
+		}
+	}
+	return sampleRoot()
+}
+
+// export queues an ended span for export, if spans are exported.
+func export(s *Span) {
+	current.RLock()
+	e := current.exporter
+	current.RUnlock()
+	if e != nil {
+		e.add(s)
+	}
+}
+
+func (e *Exporter) add(s *Span) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if len(e.queue) >= e.settings.QueueSize {
+		e.dropped++
+		return
+	}
+	e.queue = append(e.queue, s)
+	if len(e.queue) >= e.settings.BatchSize {
+		select {
+		case e.full <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (e *Exporter) run() error {
+	ticker := time.NewTicker(time.Duration(e.settings.FlushIntervalSecs) * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-e.t.Dying():
+			e.flush()
+			return nil
+		case <-ticker.C:
+			e.flush()
+		case <-e.full:
+			e.flush()
+		}
+	}
+}
+
+// flush exports the queued spans in batches. Batches which cannot be
+// exported are dropped, rather than held up behind a failing collector.
+func (e *Exporter) flush() {
+	e.mu.Lock()
+	queue, dropped := e.queue, e.dropped
+	e.queue, e.dropped = nil, 0
+	e.mu.Unlock()
+
+	if dropped > 0 {
+		log.WithField("dropped", dropped).Warning("OTLP export queue full, spans dropped")
+	}
+	for len(queue) > 0 {
+		n := len(queue)
+		if n > e.settings.BatchSize {
+			n = e.settings.BatchSize
+		}
+		err := e.send(queue[:n])
+		if err != nil {
+			log.WithFields(log.Fields{
+				"spans": n,
+				"error": err,
+			}).Warning("OTLP export failed")
+		}
+		queue = queue[n:]
+	}
+}
+
+func (e *Exporter) send(spans []*Span) error {
+	body, err := json.Marshal(e.request(spans))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	req, err := http.NewRequest("POST", e.url, bytes.NewReader(body))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range e.settings.Headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer resp.Body.Close()
+	msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return errors.Errorf("collector responded %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+// The OTLP/HTTP JSON encoding of spans, as in
+// https://opentelemetry.io/docs/specs/otlp/#json-protobuf-encoding. Trace
+// and span IDs are hex, and 64-bit integers are decimal strings.
+
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	TraceState        string         `json:"traceState,omitempty"`
+	Name              string         `json:"name"`
+	Kind              SpanKind       `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	Status            *otlpStatus    `json:"status,omitempty"`
+}
+
+type otlpKeyValue struct {
+	Key   string                 `json:"key"`
+	Value map[string]interface{} `json:"value"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+// otlpStatusError is the status code of a failed span.
+const otlpStatusError = 2
+
+func (e *Exporter) request(spans []*Span) *otlpRequest {
+	scope := otlpScopeSpans{Scope: otlpScope{Name: DefaultServiceName}}
+	for _, s := range spans {
+		span := otlpSpan{
+			TraceID:           s.sc.TraceIDString(),
+			SpanID:            s.sc.SpanIDString(),
+			TraceState:        s.sc.State,
+			Name:              s.name,
+			Kind:              s.kind,
+			StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+			Attributes:        otlpAttributes(s.attrs),
+		}
+		if s.parent != [8]byte{} {
+			span.ParentSpanID = hex.EncodeToString(s.parent[:])
+		}
+		if s.err != "" {
+			span.Status = &otlpStatus{Code: otlpStatusError, Message: s.err}
+		}
+		scope.Spans = append(scope.Spans, span)
+	}
+	return &otlpRequest{ResourceSpans: []otlpResourceSpans{{
+		Resource:   otlpResource{Attributes: otlpAttributes(e.resource)},
+		ScopeSpans: []otlpScopeSpans{scope},
+	}}}
+}
+
+func otlpAttributes(attrs []attribute) []otlpKeyValue {
+	var result []otlpKeyValue
+	for _, attr := range attrs {
+		result = append(result, otlpKeyValue{Key: attr.key, Value: otlpValue(attr.value)})
+	}
+	return result
+}
+
+func otlpValue(v interface{}) map[string]interface{} {
+	switch v := v.(type) {
+	case string:
+		return map[string]interface{}{"stringValue": v}
+	case bool:
+		return map[string]interface{}{"boolValue": v}
+	case int:
+		return map[string]interface{}{"intValue": strconv.Itoa(v)}
+	case int64:
+		return map[string]interface{}{"intValue": strconv.FormatInt(v, 10)}
+	case float64:
+		return map[string]interface{}{"doubleValue": v}
+	default:
+		return map[string]interface{}{"stringValue": fmt.Sprint(v)}
+	}
+}
@@ -0,0 +1,350 @@
+// Package tracing propagates W3C Trace Context headers through the server,
+// so that a request may be followed across hockeypuck and the proxies and
+// peers it talks to, without a full tracing system.
+//
+// Handler accepts the traceparent and tracestate headers of incoming
+// requests, starting a new trace for those without one, and adds the trace
+// to the request context. Log entries for the request carry its trace ID,
+// spans within it are logged at debug level when they end, and Transport
+// passes the trace on to outbound requests.
+//
+// Spans may also be exported to an OpenTelemetry collector over OTLP, so
+// that operators can see where slow requests spend their time. See
+// Settings and Start.
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	log "hockeypuck/logrus"
+)
+
+// Header names, as in https://www.w3.org/TR/trace-context/.
+const (
+	TraceParentHeader = "traceparent"
+	TraceStateHeader  = "tracestate"
+)
+
+// maxTraceStateLength is the longest tracestate passed on. Longer values are
+// dropped rather than truncated, since truncating may break its entries.
+const maxTraceStateLength = 512
+
+// FlagSampled is set in the trace flags when the caller may have recorded
+// the trace.
+const FlagSampled = 0x01
+
+// SpanContext identifies a span within a trace.
+type SpanContext struct {
+	TraceID [16]byte
+	SpanID  [8]byte
+	Flags   byte
+
+	// State is the vendor-specific tracestate, passed on unchanged.
+	State string
+}
+
+// Parse parses a traceparent header.
+func Parse(traceparent string) (SpanContext, error) {
+	var sc SpanContext
+	s := strings.TrimSpace(traceparent)
+	// Later versions may append fields, which are ignored.
+	if len(s) < 55 || (len(s) > 55 && s[55] != '-') {
+		return sc, errors.Errorf("invalid traceparent %q", traceparent)
+	}
+	parts := strings.Split(s[:55], "-")
+	if len(parts) != 4 || len(parts[0]) != 2 || len(parts[1]) != 32 ||
+		len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return sc, errors.Errorf("invalid traceparent %q", traceparent)
+	}
+	for _, part := range parts {
+		if strings.ToLower(part) != part {
+			return sc, errors.Errorf("invalid traceparent %q", traceparent)
+		}
+	}
+	version, err := hex.DecodeString(parts[0])
+	if err != nil || version[0] == 0xff || (version[0] == 0 && len(s) != 55) {
+		return sc, errors.Errorf("invalid traceparent version in %q", traceparent)
+	}
+	flags, err := hex.DecodeString(parts[3])
+	if err != nil {
+		return sc, errors.Errorf("invalid traceparent flags in %q", traceparent)
+	}
+	sc.Flags = flags[0]
+	_, err = hex.Decode(sc.TraceID[:], []byte(parts[1]))
+	if err != nil || sc.TraceID == [16]byte{} {
+		return sc, errors.Errorf("invalid trace ID in %q", traceparent)
+	}
+	_, err = hex.Decode(sc.SpanID[:], []byte(parts[2]))
+	if err != nil || sc.SpanID == [8]byte{} {
+		return sc, errors.Errorf("invalid parent ID in %q", traceparent)
+	}
+	return sc, nil
+}
+
+// String returns the span context as a traceparent header.
+func (sc SpanContext) String() string {
+	return "00-" + sc.TraceIDString() + "-" + sc.SpanIDString() + "-" + hex.EncodeToString([]byte{sc.Flags})
+}
+
+func (sc SpanContext) TraceIDString() string { return hex.EncodeToString(sc.TraceID[:]) }
+func (sc SpanContext) SpanIDString() string  { return hex.EncodeToString(sc.SpanID[:]) }
+
+// newRoot returns the context of the first span of a new trace, which is
+// sampled as chosen by the exporter, if any.
+func newRoot() SpanContext {
+	var sc SpanContext
+	rand.Read(sc.TraceID[:])
+	rand.Read(sc.SpanID[:])
+	if sampleRoot() {
+		sc.Flags = FlagSampled
+	}
+	return sc
+}
+
+// Sampled returns whether the span may be recorded.
+func (sc SpanContext) Sampled() bool { return sc.Flags&FlagSampled != 0 }
+
+// child returns the context of a new span in the same trace.
+func (sc SpanContext) child() SpanContext {
+	child := sc
+	rand.Read(child.SpanID[:])
+	return child
+}
+
+type contextKey struct{}
+
+// NewContext returns a context carrying the span context sc.
+func NewContext(ctx context.Context, sc SpanContext) context.Context {
+	return context.WithValue(ctx, contextKey{}, sc)
+}
+
+// FromContext returns the span context carried by ctx, if any.
+func FromContext(ctx context.Context) (SpanContext, bool) {
+	if ctx == nil {
+		return SpanContext{}, false
+	}
+	sc, ok := ctx.Value(contextKey{}).(SpanContext)
+	return sc, ok
+}
+
+// Fields returns log fields identifying the trace and span carried by ctx,
+// or nil if it carries none.
+func Fields(ctx context.Context) log.Fields {
+	sc, ok := FromContext(ctx)
+	if !ok {
+		return nil
+	}
+	return log.Fields{
+		"trace-id": sc.TraceIDString(),
+		"span-id":  sc.SpanIDString(),
+	}
+}
+
+// SpanKind is the role of a span in a request between services, as in
+// OpenTelemetry.
+type SpanKind int
+
+const (
+	KindInternal SpanKind = 1
+	KindServer   SpanKind = 2
+	KindClient   SpanKind = 3
+)
+
+type attribute struct {
+	key   string
+	value interface{}
+}
+
+// Span is an operation within a trace, such as a storage query.
+type Span struct {
+	name   string
+	kind   SpanKind
+	sc     SpanContext
+	parent [8]byte
+	start  time.Time
+	end    time.Time
+	attrs  []attribute
+	err    string
+}
+
+// StartSpan starts a span named name within the trace carried by ctx, or
+// within a new trace if it carries none. The returned context carries the
+// new span, for spans and requests made within it.
+func StartSpan(ctx context.Context, name string) (context.Context, *Span) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	span := &Span{name: name, kind: KindInternal, start: time.Now()}
+	if parent, ok := FromContext(ctx); ok {
+		span.sc = parent.child()
+		span.parent = parent.SpanID
+	} else {
+		span.sc = newRoot()
+	}
+	return NewContext(ctx, span.sc), span
+}
+
+// SetKind sets the role of the span in a request between services. Spans
+// are internal unless set otherwise.
+func (s *Span) SetKind(kind SpanKind) {
+	s.kind = kind
+}
+
+// SetAttribute describes the span with a value, such as the number of keys
+// found by a query. Values are exported as strings, unless they are bools,
+// integers or floats.
+func (s *Span) SetAttribute(key string, value interface{}) {
+	s.attrs = append(s.attrs, attribute{key, value})
+}
+
+// SetError marks the span as failed with err, unless err is nil.
+func (s *Span) SetError(err error) {
+	if err != nil {
+		s.err = err.Error()
+	}
+}
+
+// End logs the span at debug level, with how long it took, and exports it
+// if it is sampled.
+func (s *Span) End() {
+	s.end = time.Now()
+	fields := log.Fields{
+		"span":     s.name,
+		"trace-id": s.sc.TraceIDString(),
+		"span-id":  s.sc.SpanIDString(),
+		"duration": s.end.Sub(s.start).String(),
+	}
+	if s.parent != [8]byte{} {
+		fields["parent-id"] = hex.EncodeToString(s.parent[:])
+	}
+	if s.err != "" {
+		fields["error"] = s.err
+	}
+	log.WithFields(fields).Debug("span")
+	if s.sc.Sampled() {
+		export(s)
+	}
+}
+
+// statusRecorder records the status of a response.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusRecorder) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusRecorder) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+// Flush implements http.Flusher, if the underlying writer does.
+func (w *statusRecorder) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Handler serves each request within a span, continuing the trace given by
+// its traceparent header or starting a new one, and adds the span to the
+// request context. The caller's sampling of the trace is only honoured if
+// it is trusted; see Settings.TrustedCIDRs.
+func Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		span := &Span{
+			name:  r.Method + " " + r.URL.Path,
+			kind:  KindServer,
+			start: time.Now(),
+		}
+		parent, err := Parse(r.Header.Get(TraceParentHeader))
+		if err == nil {
+			span.sc = parent.child()
+			span.parent = parent.SpanID
+			span.sc.Flags &^= FlagSampled
+			if sampleParent(r.RemoteAddr, parent.Sampled()) {
+				span.sc.Flags |= FlagSampled
+			}
+			// Multiple tracestate headers are one list.
+			state := strings.Join(r.Header.Values(TraceStateHeader), ",")
+			if len(state) <= maxTraceStateLength {
+				span.sc.State = state
+			}
+		} else {
+			span.sc = newRoot()
+		}
+		span.SetAttribute("http.method", r.Method)
+		span.SetAttribute("http.target", r.URL.Path)
+
+		rec := &statusRecorder{ResponseWriter: w}
+		defer func() {
+			if rec.status == 0 {
+				rec.status = http.StatusOK
+			}
+			span.SetAttribute("http.status_code", rec.status)
+			if rec.status >= http.StatusInternalServerError {
+				span.SetError(errors.New(http.StatusText(rec.status)))
+			}
+			span.End()
+		}()
+		next.ServeHTTP(rec, r.WithContext(NewContext(r.Context(), span.sc)))
+	})
+}
+
+// Transport passes the trace carried by the context of each request on to
+// the server, as a new span within it. Requests without a trace are sent
+// unchanged.
+type Transport struct {
+	// Base makes the requests. If nil, http.DefaultTransport is used.
+	Base http.RoundTripper
+}
+
+func (t *Transport) RoundTrip(r *http.Request) (*http.Response, error) {
+	base := t.Base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	if _, ok := FromContext(r.Context()); !ok {
+		return base.RoundTrip(r)
+	}
+	ctx, span := StartSpan(r.Context(), r.Method+" "+r.URL.Host)
+	defer span.End()
+	span.SetKind(KindClient)
+	span.SetAttribute("http.method", r.Method)
+	span.SetAttribute("http.url", fmt.Sprintf("%s://%s%s", r.URL.Scheme, r.URL.Host, r.URL.Path))
+
+	sc, _ := FromContext(ctx)
+	// A RoundTripper must not modify the request it is given.
+	r = r.Clone(r.Context())
+	r.Header.Set(TraceParentHeader, sc.String())
+	if sc.State != "" {
+		r.Header.Set(TraceStateHeader, sc.State)
+	} else {
+		r.Header.Del(TraceStateHeader)
+	}
+	resp, err := base.RoundTrip(r)
+	if err != nil {
+		span.SetError(err)
+		return nil, err
+	}
+	span.SetAttribute("http.status_code", resp.StatusCode)
+	if resp.StatusCode >= http.StatusInternalServerError {
+		span.SetError(errors.New(resp.Status))
+	}
+	return resp, nil
+}
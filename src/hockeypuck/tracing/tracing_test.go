@@ -0,0 +1,316 @@
+package tracing
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	stdtesting "testing"
+
+	gc "gopkg.in/check.v1"
+
+	log "hockeypuck/logrus"
+)
+
+func Test(t *stdtesting.T) { gc.TestingT(t) }
+
+type TracingSuite struct{}
+
+var _ = gc.Suite(&TracingSuite{})
+
+const testTraceParent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+
+func (s *TracingSuite) TestParse(c *gc.C) {
+	sc, err := Parse(testTraceParent)
+	c.Assert(err, gc.IsNil)
+	c.Assert(sc.TraceIDString(), gc.Equals, "4bf92f3577b34da6a3ce929d0e0e4736")
+	c.Assert(sc.SpanIDString(), gc.Equals, "00f067aa0ba902b7")
+	c.Assert(sc.Flags, gc.Equals, byte(FlagSampled))
+	c.Assert(sc.String(), gc.Equals, testTraceParent)
+
+	// Later versions may add fields.
+	sc, err = Parse("cc-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00-extra")
+	c.Assert(err, gc.IsNil)
+	c.Assert(sc.String(), gc.Equals, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00")
+
+	for _, bad := range []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e473x-00f067aa0ba902b7-01",
+		"00_4bf92f3577b34da6a3ce929d0e0e4736_00f067aa0ba902b7_01",
+	} {
+		_, err := Parse(bad)
+		c.Check(err, gc.NotNil, gc.Commentf("%q", bad))
+	}
+}
+
+func (s *TracingSuite) TestHandler(c *gc.C) {
+	var got SpanContext
+	h := Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var ok bool
+		got, ok = FromContext(r.Context())
+		c.Assert(ok, gc.Equals, true)
+	}))
+
+	req := httptest.NewRequest("GET", "/pks/lookup", nil)
+	req.Header.Set(TraceParentHeader, testTraceParent)
+	req.Header.Add(TraceStateHeader, "congo=t61rcWkgMzE")
+	req.Header.Add(TraceStateHeader, "rojo=00f067aa0ba902b7")
+	h.ServeHTTP(httptest.NewRecorder(), req)
+	c.Assert(got.TraceIDString(), gc.Equals, "4bf92f3577b34da6a3ce929d0e0e4736")
+	c.Assert(got.SpanIDString(), gc.Not(gc.Equals), "00f067aa0ba902b7")
+	c.Assert(got.Flags, gc.Equals, byte(FlagSampled))
+	c.Assert(got.State, gc.Equals, "congo=t61rcWkgMzE,rojo=00f067aa0ba902b7")
+
+	// An oversized tracestate is dropped.
+	req.Header.Set(TraceStateHeader, "congo="+strings.Repeat("x", maxTraceStateLength))
+	h.ServeHTTP(httptest.NewRecorder(), req)
+	c.Assert(got.TraceIDString(), gc.Equals, "4bf92f3577b34da6a3ce929d0e0e4736")
+	c.Assert(got.State, gc.Equals, "")
+
+	// Requests without a valid traceparent start a new trace.
+	req = httptest.NewRequest("GET", "/pks/lookup", nil)
+	req.Header.Set(TraceParentHeader, "garbage")
+	h.ServeHTTP(httptest.NewRecorder(), req)
+	c.Assert(got.TraceID, gc.Not(gc.Equals), [16]byte{})
+	c.Assert(got.TraceIDString(), gc.Not(gc.Equals), "4bf92f3577b34da6a3ce929d0e0e4736")
+	c.Assert(got.SpanID, gc.Not(gc.Equals), [8]byte{})
+}
+
+func (s *TracingSuite) TestStartSpan(c *gc.C) {
+	ctx, root := StartSpan(context.Background(), "root")
+	defer root.End()
+	rootSC, ok := FromContext(ctx)
+	c.Assert(ok, gc.Equals, true)
+	c.Assert(rootSC.TraceID, gc.Not(gc.Equals), [16]byte{})
+
+	ctx, child := StartSpan(ctx, "child")
+	defer child.End()
+	childSC, ok := FromContext(ctx)
+	c.Assert(ok, gc.Equals, true)
+	c.Assert(childSC.TraceID, gc.Equals, rootSC.TraceID)
+	c.Assert(childSC.SpanID, gc.Not(gc.Equals), rootSC.SpanID)
+	c.Assert(child.parent, gc.Equals, rootSC.SpanID)
+
+	c.Assert(Fields(ctx), gc.DeepEquals, log.Fields{
+		"trace-id": childSC.TraceIDString(),
+		"span-id":  childSC.SpanIDString(),
+	})
+	c.Assert(Fields(context.Background()), gc.IsNil)
+}
+
+func (s *TracingSuite) TestTransport(c *gc.C) {
+	var header http.Header
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header = r.Header
+	}))
+	defer srv.Close()
+	client := &http.Client{Transport: &Transport{}}
+
+	// Requests without a trace are sent as they are.
+	req, err := http.NewRequest("GET", srv.URL, nil)
+	c.Assert(err, gc.IsNil)
+	resp, err := client.Do(req)
+	c.Assert(err, gc.IsNil)
+	resp.Body.Close()
+	c.Assert(header.Get(TraceParentHeader), gc.Equals, "")
+
+	parent, err := Parse(testTraceParent)
+	c.Assert(err, gc.IsNil)
+	parent.State = "congo=t61rcWkgMzE"
+	req = req.WithContext(NewContext(context.Background(), parent))
+	resp, err = client.Do(req)
+	c.Assert(err, gc.IsNil)
+	resp.Body.Close()
+	sent, err := Parse(header.Get(TraceParentHeader))
+	c.Assert(err, gc.IsNil)
+	c.Assert(sent.TraceID, gc.Equals, parent.TraceID)
+	c.Assert(sent.SpanID, gc.Not(gc.Equals), parent.SpanID)
+	c.Assert(header.Get(TraceStateHeader), gc.Equals, "congo=t61rcWkgMzE")
+
+	// The request given is not changed.
+	c.Assert(req.Header.Get(TraceParentHeader), gc.Equals, "")
+}
+
+func (s *TracingSuite) TestExport(c *gc.C) {
+	var requests []map[string]interface{}
+	var header http.Header
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.Check(r.URL.Path, gc.Equals, "/v1/traces")
+		header = r.Header
+		var req map[string]interface{}
+		c.Check(json.NewDecoder(r.Body).Decode(&req), gc.IsNil)
+		requests = append(requests, req)
+	}))
+	defer collector.Close()
+
+	settings := DefaultSettings()
+	settings.Endpoint = collector.URL
+	settings.Headers = map[string]string{"Authorization": "Bearer test"}
+	e, err := Start(settings)
+	c.Assert(err, gc.IsNil)
+
+	h := Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, span := StartSpan(r.Context(), "storage.lookup")
+		span.SetAttribute("hkp.keys", 2)
+		span.SetError(errors.New("database unavailable"))
+		span.End()
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	req := httptest.NewRequest("GET", "/pks/lookup", nil)
+	req.Header.Set(TraceParentHeader, testTraceParent)
+	h.ServeHTTP(httptest.NewRecorder(), req)
+
+	// Spans are exported when the exporter stops, if not before.
+	e.Stop()
+	c.Assert(requests, gc.HasLen, 1)
+	c.Assert(header.Get("Authorization"), gc.Equals, "Bearer test")
+	c.Assert(header.Get("Content-Type"), gc.Equals, "application/json")
+
+	var got struct {
+		ResourceSpans []struct {
+			Resource struct {
+				Attributes []struct {
+					Key   string
+					Value map[string]interface{}
+				}
+			}
+			ScopeSpans []struct {
+				Spans []struct {
+					TraceID      string
+					SpanID       string
+					ParentSpanID string
+					Name         string
+					Kind         int
+					Attributes   []struct {
+						Key   string
+						Value map[string]interface{}
+					}
+					Status *struct {
+						Code    int
+						Message string
+					}
+				}
+			}
+		}
+	}
+	buf, err := json.Marshal(requests[0])
+	c.Assert(err, gc.IsNil)
+	c.Assert(json.Unmarshal(buf, &got), gc.IsNil)
+	c.Assert(got.ResourceSpans, gc.HasLen, 1)
+	c.Assert(got.ResourceSpans[0].Resource.Attributes[0].Key, gc.Equals, "service.name")
+	c.Assert(got.ResourceSpans[0].Resource.Attributes[0].Value["stringValue"], gc.Equals, "hockeypuck")
+	spans := got.ResourceSpans[0].ScopeSpans[0].Spans
+	c.Assert(spans, gc.HasLen, 2)
+
+	lookup, server := spans[0], spans[1]
+	c.Assert(server.Name, gc.Equals, "GET /pks/lookup")
+	c.Assert(server.Kind, gc.Equals, int(KindServer))
+	c.Assert(server.TraceID, gc.Equals, "4bf92f3577b34da6a3ce929d0e0e4736")
+	c.Assert(server.ParentSpanID, gc.Equals, "00f067aa0ba902b7")
+	c.Assert(server.Status, gc.IsNil)
+	var status interface{}
+	for _, attr := range server.Attributes {
+		if attr.Key == "http.status_code" {
+			status = attr.Value["intValue"]
+		}
+	}
+	c.Assert(status, gc.Equals, "404")
+
+	c.Assert(lookup.Name, gc.Equals, "storage.lookup")
+	c.Assert(lookup.Kind, gc.Equals, int(KindInternal))
+	c.Assert(lookup.TraceID, gc.Equals, server.TraceID)
+	c.Assert(lookup.ParentSpanID, gc.Equals, server.SpanID)
+	c.Assert(lookup.Attributes[0].Key, gc.Equals, "hkp.keys")
+	c.Assert(lookup.Attributes[0].Value["intValue"], gc.Equals, "2")
+	c.Assert(lookup.Status.Code, gc.Equals, 2)
+	c.Assert(lookup.Status.Message, gc.Equals, "database unavailable")
+
+	// Spans ended after the exporter stops are not exported.
+	_, span := StartSpan(context.Background(), "late")
+	span.End()
+	c.Assert(requests, gc.HasLen, 1)
+}
+
+func (s *TracingSuite) TestTrustedSampling(c *gc.C) {
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer collector.Close()
+
+	settings := DefaultSettings()
+	settings.Endpoint = collector.URL
+	settings.SampleRatio = 0
+	settings.TrustedCIDRs = []string{"10.0.0.0/8"}
+	e, err := Start(settings)
+	c.Assert(err, gc.IsNil)
+	defer e.Stop()
+
+	var got SpanContext
+	h := Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got, _ = FromContext(r.Context())
+	}))
+	for _, t := range []struct {
+		remoteAddr string
+		sampled    bool
+	}{
+		{"10.1.2.3:4567", true},
+		// Clients elsewhere cannot have their requests exported.
+		{"192.0.2.1:4567", false},
+	} {
+		req := httptest.NewRequest("GET", "/pks/lookup", nil)
+		req.RemoteAddr = t.remoteAddr
+		req.Header.Set(TraceParentHeader, testTraceParent)
+		h.ServeHTTP(httptest.NewRecorder(), req)
+		c.Assert(got.TraceIDString(), gc.Equals, "4bf92f3577b34da6a3ce929d0e0e4736")
+		c.Assert(got.Sampled(), gc.Equals, t.sampled, gc.Commentf("%s", t.remoteAddr))
+	}
+
+	settings.TrustedCIDRs = []string{"10.0.0.0"}
+	_, err = Start(settings)
+	c.Assert(err, gc.ErrorMatches, `invalid trusted CIDR "10.0.0.0".*`)
+}
+
+func (s *TracingSuite) TestSampling(c *gc.C) {
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.Error("unexpected export")
+	}))
+	defer collector.Close()
+
+	settings := DefaultSettings()
+	settings.Endpoint = collector.URL
+	settings.SampleRatio = 0
+	e, err := Start(settings)
+	c.Assert(err, gc.IsNil)
+
+	// New traces are not sampled.
+	ctx, span := StartSpan(context.Background(), "root")
+	span.End()
+	sc, _ := FromContext(ctx)
+	c.Assert(sc.Sampled(), gc.Equals, false)
+
+	// Nor are traces continued from an unsampled caller.
+	parent, err := Parse("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00")
+	c.Assert(err, gc.IsNil)
+	_, span = StartSpan(NewContext(context.Background(), parent), "child")
+	span.End()
+	e.Stop()
+
+	for _, bad := range []func(*Settings){
+		func(s *Settings) { s.Endpoint = "" },
+		func(s *Settings) { s.Endpoint = "localhost:4318" },
+		func(s *Settings) { s.SampleRatio = 1.5 },
+		func(s *Settings) { s.BatchSize = 0 },
+	} {
+		settings := DefaultSettings()
+		settings.Endpoint = collector.URL
+		bad(settings)
+		_, err := Start(settings)
+		c.Assert(err, gc.NotNil)
+	}
+}